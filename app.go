@@ -87,9 +87,38 @@ func (o *Application) OnStop() {
 	log.Warn("application stopped")
 }
 
+// Reload the config and the logger before the http server runs again, the
+// config being applied is reverted if it fails
+func (o *Application) restart() error {
+	err := o.reload()
+	if err != nil && gConfigApplier.restarting(err) {
+		err = o.reload()
+	}
+	return err
+}
+
+// A new config replaces the old one, as the jobs kept across the restart
+// still read it
+func (o *Application) reload() error {
+	cnf := NewConfig()
+	if err := cnf.Load(o.cnfPath); err != nil {
+		return err
+	}
+	o.Cnf = cnf
+	UninitLog()
+	if err := InitLog(); err != nil {
+		return err
+	}
+	gSelfCheck = RunSelfCheck(o.Cnf)
+	return gSelfCheck.Err()
+}
+
 func (o *Application) Run() {
 	var err error
 
+	// The config being applied when the agent stopped is reverted
+	reverted := gConfigApplier.recover(o.cnfPath)
+
 	// Load the config
 	err = o.Cnf.Load(o.cnfPath)
 	if err != nil {
@@ -105,9 +134,27 @@ func (o *Application) Run() {
 
 	log.Print("")
 	log.Print("application started")
+	if reverted {
+		gConfigApplier.alert()
+	}
+
+	// Fail fast on a broken config or environment, rather than on the first job
+	gSelfCheck = RunSelfCheck(o.Cnf)
+	if err = gSelfCheck.Err(); err != nil {
+		log.Fatalf("self check failed: %s", err)
+	}
 
-	// Run the http server
-	err = gHttpServer.Run()
+	// Run the http server, again with the config file after a restart by a
+	// config apply
+	for {
+		err = gHttpServer.Run()
+		if !gConfigApplier.restarting(err) {
+			break
+		}
+		if err = o.restart(); err != nil {
+			log.Fatalf("restart failed: %s", err)
+		}
+	}
 	if err != nil {
 		log.Fatalf("application quited, because http server quited abnormally: %s", err)
 	}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A job submitted with require_approval is pending_approval until an admin
+// other than its submitter approves it by /cmd/approve, then it is queued,
+// or scheduled if its run_at is ahead. /cmd/reject cancels it without
+// running. The pending jobs are not kept across restarts.
+
+// The jobs pending approval
+type Approvals struct {
+	mu   sync.Mutex
+	jobs map[string]*pendingApproval
+}
+
+type pendingApproval struct {
+	job *Job
+	ctx context.Context
+	req *RunCmdReq
+}
+
+var (
+	gApprovals = &Approvals{jobs: make(map[string]*pendingApproval)}
+
+	errNotPendingApproval = errors.New("job is not pending approval")
+)
+
+// Keep the job until approved
+func (o *Approvals) Add(job *Job, ctx context.Context, req *RunCmdReq) {
+	job.record(JobEvent{Type: JEPendingApproval, Reason: &StatusReason{Code: RCApprovalRequired}})
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.jobs[job.Id] = &pendingApproval{job: job, ctx: ctx, req: req}
+	log.Infof("job %s pending approval, cmd: %s", job.Id, job.Cmd)
+}
+
+func (o *Approvals) take(id string) *pendingApproval {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p := o.jobs[id]
+	delete(o.jobs, id)
+	return p
+}
+
+func (o *Approvals) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.jobs)
+}
+
+// Forget the job canceled while pending
+func (o *Approvals) Remove(id string) {
+	o.take(id)
+}
+
+// Queue the approved job, or schedule it at its run_at
+func (o *Approvals) Approve(id, by string) error {
+	p := o.take(id)
+	if p == nil || !p.job.approve(by) {
+		return errNotPendingApproval
+	}
+	var err error
+	if p.req.RunAt != nil && p.req.RunAt.After(time.Now()) {
+		err = gDelayedJobs.Add(p.job, p.ctx, p.req)
+	} else {
+		err = submitJob(p.ctx, p.job)
+	}
+	if err != nil {
+		log.Warnf("reject approved job %s: %s", id, err)
+		finishUnrun(p.job, JSFailed, err.Error())
+	}
+	return nil
+}
+
+// Cancel the job without running
+func (o *Approvals) Reject(id, msg string) error {
+	p := o.take(id)
+	if p == nil || !p.job.reject(msg) {
+		return errNotPendingApproval
+	}
+	return nil
+}
+
+// Queue the job pending approval, false if it is not pending any more
+func (o *Job) approve(by string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.Status != JSPendingApproval {
+		return false
+	}
+	o.recordLocked(JobEvent{Type: JEApproved, By: by})
+	return true
+}
+
+func (o *Job) reject(msg string) bool {
+	o.mu.Lock()
+	if o.claimed || o.Status != JSPendingApproval {
+		o.mu.Unlock()
+		return false
+	}
+	o.claimed = true
+	o.recordLocked(JobEvent{Type: JEFinished, Status: JSCanceled, Error: "rejected",
+		Reason: &StatusReason{Code: RCRejected, Message: msg}})
+	o.mu.Unlock()
+
+	o.cancelFunc()
+	o.sign()
+	o.closeOutput()
+	return true
+}
+
+// Admins other than the submitter approve or reject, anyone if the
+// authentication is disabled
+func canApproveJob(tok *Token, job *Job) error {
+	if tok == nil {
+		return nil
+	}
+	if !tok.Admin {
+		return errors.New("only admins approve jobs")
+	}
+	if tok.Name == job.Tenant {
+		return errors.New("the submitter can't approve its own job")
+	}
+	return nil
+}
+
+// Handler to approve or reject a job pending approval
+func approvalHandler(w http.ResponseWriter, r *http.Request, approve bool) {
+	tok := RequestToken(r)
+	id := strings.TrimSpace(r.FormValue("id"))
+	job := gJobBookkeeper.Get(id)
+	if job == nil && proxyForwarded(w, r, id) {
+		return
+	}
+	if job == nil {
+		ServeJSON(w, NewResponse().SetError(ECJobNotFound, "job not found: "+id))
+		return
+	}
+	if err := canApproveJob(tok, job); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECForbidden, err.Error()))
+		return
+	}
+	by := tokenTenant(tok)
+	var err error
+	if approve {
+		err = gApprovals.Approve(id, by)
+	} else {
+		err = gApprovals.Reject(id, r.FormValue("reason"))
+	}
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECJobNotPendingApproval, err.Error()+": "+id))
+		return
+	}
+	if approve {
+		log.Infof("audit: job %s approved by %s", id, by)
+	} else {
+		log.Infof("audit: job %s rejected by %s", id, by)
+	}
+	ServeJSON(w, NewResponse())
+}
+
+func ApproveCmdHandler(w http.ResponseWriter, r *http.Request) {
+	approvalHandler(w, r, true)
+}
+
+func RejectCmdHandler(w http.ResponseWriter, r *http.Request) {
+	approvalHandler(w, r, false)
+}
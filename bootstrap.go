@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const bootstrapUrl = apiUrlPrefix + "/bootstrap"
+
+// The config pushed to a freshly installed agent with the one-time
+// bootstrap::token
+type BootstrapReq struct {
+	TlsCert string     `json:"tls_cert,omitempty"` // PEM, served after a restart
+	TlsKey  string     `json:"tls_key,omitempty"`
+	Tokens  []TokenReq `json:"tokens,omitempty"` // Created in the token store, their values are returned once
+	Tags    []string   `json:"tags,omitempty"`
+}
+
+type BootstrapRes struct {
+	Tokens          []*TokenRes `json:"tokens,omitempty"`
+	Tags            []string    `json:"tags,omitempty"`
+	RestartRequired bool        `json:"restart_required"` // The tls takes effect after a restart
+}
+
+// What the bootstrap pushed, kept in bootstrap::dir. Once the file exists
+// the bootstrap is locked.
+type BootstrapState struct {
+	TlsCert   string    `json:"tls_cert,omitempty"` // Paths of the files
+	TlsKey    string    `json:"tls_key,omitempty"`
+	TokenFile string    `json:"token_file,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	Time      time.Time `json:"time"`
+	By        string    `json:"by"` // Remote address of the controller
+}
+
+// Serialize the bootstraps, only the first one succeeds
+var bootstrapMu sync.Mutex
+
+func bootstrapStatePath(dir string) string {
+	return filepath.Join(dir, "bootstrap.json")
+}
+
+// The state of the bootstrap, nil if not bootstrapped yet
+func readBootstrapState(dir string) (*BootstrapState, error) {
+	b, err := ioutil.ReadFile(bootstrapStatePath(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st BootstrapState
+	if err = json.Unmarshal(b, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Handler of the provisioning: a controller pushes the tls certificate, the
+// tokens and the tags with the bootstrap token, then the handler locks itself.
+func BootstrapHandler(w http.ResponseWriter, r *http.Request) {
+	cnf := gApp.Cnf
+	if cnf.BootstrapToken == "" {
+		ServeJSONWithStatus(w, http.StatusForbidden, NewResponse().SetError(ECForbidden, "bootstrap is disabled"))
+		return
+	}
+	if value := bearerToken(r); value == "" || !hashEqual(value, cnf.BootstrapToken) {
+		msg := "audit: bootstrap denied from " + r.RemoteAddr + ": invalid bootstrap token"
+		log.Warn(msg)
+		ReportWarningEvent(EventAuthFailed, msg)
+		ServeJSONWithStatus(w, http.StatusUnauthorized, NewResponse().SetError(ECUnauthorized, "invalid bootstrap token"))
+		return
+	}
+
+	bootstrapMu.Lock()
+	defer bootstrapMu.Unlock()
+	if st, err := readBootstrapState(cnf.BootstrapDir); st != nil || err != nil {
+		msg := "bootstrap is locked"
+		if st != nil {
+			msg += ", bootstrapped at " + st.Time.Format(time.RFC3339) + " by " + st.By
+		}
+		ServeJSONWithStatus(w, http.StatusForbidden, NewResponse().SetError(ECBootstrapLocked, msg))
+		return
+	}
+
+	var req BootstrapReq
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("failed to read r.Body: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to read body"))
+		return
+	}
+	defer r.Body.Close()
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		log.Errorf("failed to unmarshall data: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to unmarshall data"))
+		return
+	}
+	if err = req.validate(); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+
+	st, res, err := applyBootstrap(&req, cnf)
+	if err != nil {
+		log.Errorf("bootstrap failed: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	st.By = r.RemoteAddr
+	if err = writeBootstrapState(cnf.BootstrapDir, st); err != nil {
+		log.Errorf("bootstrap failed: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	log.Infof("audit: agent bootstrapped by %s, tls: %v, tokens: %d, tags: %v",
+		r.RemoteAddr, st.TlsCert != "", len(res.Tokens), st.Tags)
+	ServeJSON(w, NewResponse().SetData(res))
+}
+
+func (o *BootstrapReq) validate() error {
+	if (o.TlsCert == "") != (o.TlsKey == "") {
+		return errors.New("tls_cert and tls_key must be given together")
+	}
+	if o.TlsCert != "" {
+		if _, err := tls.X509KeyPair([]byte(o.TlsCert), []byte(o.TlsKey)); err != nil {
+			return errors.New("invalid tls certificate: " + err.Error())
+		}
+	}
+	for i := range o.Tokens {
+		if o.Tokens[i].Name == "" {
+			return errors.New("param name of the token is empty")
+		}
+		for k := range o.Tokens[i].AllowedTimes {
+			if err := o.Tokens[i].AllowedTimes[k].Validate(); err != nil {
+				return err
+			}
+		}
+		for _, line := range o.Tokens[i].SshKeys {
+			if _, err := parseAuthorizedKey(line); err != nil {
+				return errors.New("invalid ssh key: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Write the certificate and create the tokens, the tokens and the tags take
+// effect at once
+func applyBootstrap(req *BootstrapReq, cnf *Config) (*BootstrapState, *BootstrapRes, error) {
+	if err := os.MkdirAll(cnf.BootstrapDir, 0700); err != nil {
+		return nil, nil, err
+	}
+	st := &BootstrapState{Tags: req.Tags, Time: time.Now()}
+	res := &BootstrapRes{Tags: req.Tags}
+
+	if req.TlsCert != "" {
+		st.TlsCert = filepath.Join(cnf.BootstrapDir, "tls.crt")
+		st.TlsKey = filepath.Join(cnf.BootstrapDir, "tls.key")
+		if err := ioutil.WriteFile(st.TlsCert, []byte(req.TlsCert), 0644); err != nil {
+			return nil, nil, err
+		}
+		if err := ioutil.WriteFile(st.TlsKey, []byte(req.TlsKey), 0600); err != nil {
+			return nil, nil, err
+		}
+		res.RestartRequired = true
+	}
+
+	if len(req.Tokens) > 0 {
+		store := tokenStore()
+		if store == nil {
+			// Kept in the bootstrap dir if auth::token_file isn't set
+			path := cnf.AuthTokenFile
+			if path == "" {
+				path = filepath.Join(cnf.BootstrapDir, "tokens.json")
+				st.TokenFile = path
+			}
+			var err error
+			if store, err = NewTokenStore(path); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, t := range req.Tokens {
+			value, tok, err := store.Create(t.Name, t.Admin, time.Duration(t.TtlSeconds)*time.Second, t.AllowedTimes, t.SshKeys)
+			if err != nil {
+				return nil, nil, err
+			}
+			res.Tokens = append(res.Tokens, &TokenRes{Value: value, Token: tok})
+		}
+		// The auth is enabled from now on
+		setTokenStore(store)
+	}
+
+	cnf.addTags(req.Tags)
+	return st, res, nil
+}
+
+// Write the state to a temporary file, then move it to the path, which locks
+// the bootstrap
+func writeBootstrapState(dir string, st *BootstrapState) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := bootstrapStatePath(dir)
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
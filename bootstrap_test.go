@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// The tokens and the tags of a bootstrap take effect while the requests are
+// served
+func TestBootstrapWhileServing(t *testing.T) {
+	setupJobs(t)
+	gApp.Cnf.BootstrapDir = t.TempDir()
+	gApp.Cnf.Tags = []string{"dc1"}
+	defer setTokenStore(nil)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			authenticateToken("x")
+			matchTags(gApp.Cnf.AgentTags(), []string{"dc2"})
+		}
+	}()
+	_, res, err := applyBootstrap(&BootstrapReq{Tokens: []TokenReq{{Name: "ops"}}, Tags: []string{"dc2"}}, gApp.Cnf)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := authenticateToken(res.Tokens[0].Value); err != nil || tok.Name != "ops" {
+		t.Fatalf("got %+v, %v", tok, err)
+	}
+	if !matchTags(gApp.Cnf.AgentTags(), []string{"dc2"}) {
+		t.Fatalf("got tags %v", gApp.Cnf.AgentTags())
+	}
+}
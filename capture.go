@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The files listed by capture_files of a job are read when its process
+// exits, and attached to the job, e.g. a report the cmd writes, so no second
+// round trip to the file api is needed.
+
+// A file read after the job's process exits
+type CapturedFile struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`           // Of the file, data may be shorter
+	Data      []byte `json:"data,omitempty"` // Base64 in json
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+const captureMaxFiles = 16
+
+func validateCaptureFiles(paths []string) error {
+	if len(paths) > captureMaxFiles {
+		return errors.New("param capture_files has more than " + strconv.Itoa(captureMaxFiles) + " files")
+	}
+	for _, p := range paths {
+		if strings.TrimSpace(p) == "" {
+			return errors.New("param capture_files has an empty path")
+		}
+	}
+	return nil
+}
+
+// Read the capture files of the job, at most job::capture_max_size KB each.
+// Relative paths are in the job's dir.
+func captureFiles(job *Job) []*CapturedFile {
+	if len(job.CaptureFiles) == 0 {
+		return nil
+	}
+	max := int64(gApp.Cnf.JobCaptureMaxSize) << 10
+	res := make([]*CapturedFile, 0, len(job.CaptureFiles))
+	for _, p := range job.CaptureFiles {
+		f := &CapturedFile{Path: p}
+		if err := f.read(job.Dir, max); err != nil {
+			f.Error = err.Error()
+		}
+		res = append(res, f)
+	}
+	return res
+}
+
+func (o *CapturedFile) read(dir string, max int64) error {
+	p := o.Path
+	if !filepath.IsAbs(p) && dir != "" {
+		p = filepath.Join(dir, p)
+	}
+	hostPath, err := JailPath(p)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(hostPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+	o.Size = fi.Size()
+	if o.Data, err = ioutil.ReadAll(io.LimitReader(f, max)); err != nil {
+		return err
+	}
+	o.Truncated = o.Size > int64(len(o.Data))
+	return nil
+}
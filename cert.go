@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Certificates deployed by the agent: verified, then written to files or the
+// windows cert store, and the expirations of the watched ones reported. The
+// agent's own https certificate is reloaded when its files change, so it can
+// be renewed without a restart.
+
+type CertInfo struct {
+	Path      string    `json:"path,omitempty"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	DaysLeft  int       `json:"days_left"`
+	Expiring  bool      `json:"expiring,omitempty"` // Within cert::warn_days
+	Error     string    `json:"error,omitempty"`    // Why the file can't be read
+}
+
+type CertVerifyReq struct {
+	Cert    string `json:"cert"`            // PEM, the leaf first, then the intermediates
+	Roots   string `json:"roots,omitempty"` // PEM of the trusted roots, the system's by default
+	DNSName string `json:"dns_name,omitempty"`
+}
+
+type CertVerifyRes struct {
+	Valid bool        `json:"valid"`
+	Error string      `json:"error,omitempty"`
+	Chain []*CertInfo `json:"chain"` // The verified chain, or the given certificates if invalid
+}
+
+type CertInstallReq struct {
+	CertVerifyReq
+	Key     string `json:"key,omitempty"` // PEM
+	Path    string `json:"path,omitempty"`
+	KeyPath string `json:"key_path,omitempty"`
+	Store   string `json:"store,omitempty"` // A store of the local machine, e.g. My or Root, windows only
+	// Replace the agent's own https certificate, in effect for the new connections
+	Self bool `json:"self,omitempty"`
+	// Install even if the chain doesn't verify, e.g. a self-signed one
+	SkipVerify bool `json:"skip_verify,omitempty"`
+}
+
+func newCertInfo(c *x509.Certificate) *CertInfo {
+	return &CertInfo{
+		Subject:   c.Subject.String(),
+		Issuer:    c.Issuer.String(),
+		DNSNames:  c.DNSNames,
+		Serial:    hex.EncodeToString(c.SerialNumber.Bytes()),
+		NotBefore: c.NotBefore,
+		NotAfter:  c.NotAfter,
+		DaysLeft:  int(time.Until(c.NotAfter).Hours() / 24),
+		Expiring:  time.Until(c.NotAfter) < time.Duration(gApp.Cnf.CertWarnDays)*24*time.Hour,
+	}
+}
+
+func parseCerts(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return certs, nil
+}
+
+// Verify the chain of the first certificate by the others as the
+// intermediates
+func verifyCerts(req *CertVerifyReq) (*CertVerifyRes, error) {
+	certs, err := parseCerts([]byte(req.Cert))
+	if err != nil {
+		return nil, err
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       req.DNSName,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if req.Roots != "" {
+		opts.Roots = x509.NewCertPool()
+		if !opts.Roots.AppendCertsFromPEM([]byte(req.Roots)) {
+			return nil, errors.New("no PEM certificate found in roots")
+		}
+	}
+
+	res := &CertVerifyRes{Chain: []*CertInfo{}}
+	chains, err := certs[0].Verify(opts)
+	if err != nil {
+		res.Error = err.Error()
+		for _, c := range certs {
+			res.Chain = append(res.Chain, newCertInfo(c))
+		}
+		return res, nil
+	}
+	res.Valid = true
+	for _, c := range chains[0] {
+		res.Chain = append(res.Chain, newCertInfo(c))
+	}
+	return res, nil
+}
+
+// Handler to verify a certificate chain without installing it
+func VerifyCertHandler(w http.ResponseWriter, r *http.Request) {
+	var req CertVerifyReq
+	if !parseJSONBody(w, r, &req) {
+		return
+	}
+	res, err := verifyCerts(&req)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(res))
+}
+
+// Handler to verify a certificate and install it to the files, the windows
+// cert store or the agent itself
+func InstallCertHandler(w http.ResponseWriter, r *http.Request) {
+	var req CertInstallReq
+	if !parseJSONBody(w, r, &req) {
+		return
+	}
+	if req.Self {
+		if gApp.Cnf.TlsCert == "" {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "the agent doesn't serve https, set server::tls_cert"))
+			return
+		}
+		req.Path, req.KeyPath = gApp.Cnf.TlsCert, gApp.Cnf.TlsKey
+	}
+	if req.Path == "" && req.Store == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param path, store or self is required"))
+		return
+	}
+	if (req.Key == "") != (req.KeyPath == "") || (req.Self && req.Key == "") {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param key and key_path must be given together"))
+		return
+	}
+	res, err := verifyCerts(&req.CertVerifyReq)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	if !res.Valid && !req.SkipVerify {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid certificate chain: "+res.Error))
+		return
+	}
+	if req.Key != "" {
+		if _, err := tls.X509KeyPair([]byte(req.Cert), []byte(req.Key)); err != nil {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "the key doesn't match the certificate: "+err.Error()))
+			return
+		}
+	}
+
+	if err = installCert(&req); err != nil {
+		log.Errorf("install certificate %s failed: %s", res.Chain[0].Subject, err)
+		ServeJSON(w, NewResponse().SetError(ECFileIOFailed, err.Error()))
+		return
+	}
+	log.Infof("audit: certificate %s (serial %s) installed by %s, path: %s, store: %s, self: %v",
+		res.Chain[0].Subject, res.Chain[0].Serial, tokenTenant(RequestToken(r)), req.Path, req.Store, req.Self)
+	ServeJSON(w, NewResponse().SetData(res))
+}
+
+func installCert(req *CertInstallReq) error {
+	if req.Store != "" {
+		if err := installCertToStore(req.Store, req.Cert); err != nil {
+			return err
+		}
+	}
+	if req.Path == "" {
+		return nil
+	}
+	// The key first, the reloader of the agent's certificate checks the
+	// certificate's file
+	files := []struct {
+		path, data string
+		perm       os.FileMode
+	}{{req.KeyPath, req.Key, 0600}, {req.Path, req.Cert, 0644}}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		path := f.path
+		if !req.Self {
+			var err error
+			if path, err = JailPath(path); err != nil {
+				return err
+			}
+		}
+		if err := writeFileAtomic(path, []byte(f.data), f.perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// The certificates of cert::watch_paths and the agent's own, a dir means its
+// *.pem, *.crt and *.cer files
+func watchedCerts() []*CertInfo {
+	var paths []string
+	if gApp.Cnf.TlsCert != "" {
+		paths = append(paths, gApp.Cnf.TlsCert)
+	}
+	for _, p := range gApp.Cnf.CertWatchPaths {
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			for _, ext := range []string{"*.pem", "*.crt", "*.cer"} {
+				m, _ := filepath.Glob(filepath.Join(p, ext))
+				paths = append(paths, m...)
+			}
+			continue
+		}
+		paths = append(paths, p)
+	}
+
+	res := []*CertInfo{}
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(p)
+		if err == nil {
+			var certs []*x509.Certificate
+			if certs, err = parseCerts(b); err == nil {
+				info := newCertInfo(certs[0])
+				info.Path = p
+				res = append(res, info)
+				continue
+			}
+		}
+		res = append(res, &CertInfo{Path: p, Error: err.Error()})
+	}
+	return res
+}
+
+// Handler to report the expirations of the watched certificates, the ones
+// expiring within the given days or cert::warn_days only if expiring is set
+func CertExpiryHandler(w http.ResponseWriter, r *http.Request) {
+	certs := watchedCerts()
+	if r.FormValue("expiring") != "" {
+		days, err := strconv.Atoi(r.FormValue("expiring"))
+		if err != nil {
+			days = gApp.Cnf.CertWarnDays
+		}
+		expiring := []*CertInfo{}
+		for _, c := range certs {
+			if c.Error == "" && c.DaysLeft < days {
+				expiring = append(expiring, c)
+			}
+		}
+		certs = expiring
+	}
+	ServeJSON(w, NewResponse().SetData(certs))
+}
+
+// Reload the certificate of the agent when its file changes
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	o := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := o.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fi, err := os.Stat(o.certFile)
+	if err != nil {
+		if o.cert != nil {
+			return o.cert, nil
+		}
+		return nil, err
+	}
+	if o.cert != nil && fi.ModTime().Equal(o.modTime) {
+		return o.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+	if err != nil {
+		if o.cert != nil {
+			// Keep serving the old one, e.g. between writing the two files
+			log.Warnf("reload the tls certificate failed: %s", err)
+			return o.cert, nil
+		}
+		return nil, err
+	}
+	if o.cert != nil {
+		log.Infof("tls certificate %s reloaded", o.certFile)
+	}
+	o.cert, o.modTime = &cert, fi.ModTime()
+	return o.cert, nil
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+)
+
+func installCertToStore(store, certPEM string) error {
+	return errors.New("param store is only supported on windows")
+}
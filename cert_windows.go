@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// Add the certificate to a store of the local machine by certutil, an existing
+// one is replaced
+func installCertToStore(store, certPEM string) error {
+	f, err := ioutil.TempFile("", "shell-agent-cert")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(certPEM)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return runTool("certutil", "-addstore", "-f", store, f.Name())
+}
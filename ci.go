@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Experimental: the agent as the execution backend of a gitlab runner of the
+// custom executor, so the existing ci configs run on the hosts managed. The
+// runner runs the agent binary as its executables, "shell-agent ci config",
+// "ci prepare", "ci run <script> <stage>" and "ci cleanup", which call
+// /api/v1/ci/* of the agent of SHELL_AGENT_URL. Each script of a stage runs
+// as a job labeled ci_job and ci_stage, its output streamed back as it
+// comes. The github runner has no such executor, so it's not supported.
+
+const ciExecArg = "ci"
+
+var errCiDisabled = errors.New("ci is disabled by enabled of the [ci] config section")
+
+// The dirs of the ci jobs on the agent's host
+type CiConfigRes struct {
+	BuildsDir string `json:"builds_dir"`
+	CacheDir  string `json:"cache_dir"`
+	Hostname  string `json:"hostname"`
+	Version   string `json:"version"`
+}
+
+type CiRunReq struct {
+	JobId  string `json:"job_id"` // CI_JOB_ID
+	Stage  string `json:"stage"`  // e.g. get_sources or build_script
+	Script string `json:"script"`
+}
+
+type CiCleanupReq struct {
+	JobId string `json:"job_id"`
+}
+
+// The dirs of the ci jobs, made if missing
+func ciDirs() (*CiConfigRes, error) {
+	cnf := gApp.Cnf
+	res := &CiConfigRes{Version: VERSION}
+	res.Hostname, _ = os.Hostname()
+	var err error
+	if res.BuildsDir, err = filepath.Abs(cnf.CiBuildsDir); err != nil {
+		return nil, err
+	}
+	if res.CacheDir, err = filepath.Abs(cnf.CiCacheDir); err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{res.BuildsDir, res.CacheDir} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		if cnf.CiRunAs == "" {
+			continue
+		}
+		u, err := user.Lookup(cnf.CiRunAs)
+		if err == nil {
+			err = chownToUser(dir, u)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Handler of the config and the prepare stages of the runner
+func CiConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if !gApp.Cnf.CiEnabled {
+		ServeJSON(w, NewResponse().SetError(ECForbidden, errCiDisabled.Error()))
+		return
+	}
+	res, err := ciDirs()
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECFileIOFailed, err.Error()))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(res))
+}
+
+// Handler running the script of a stage, its stdout and stderr are streamed
+// as the body as they come, the result is in the trailers X-Job-Status,
+// X-Job-Exit-Code and X-Job-Error. The job is canceled if the runner goes
+// away, e.g. the ci job is canceled.
+func CiRunHandler(w http.ResponseWriter, r *http.Request) {
+	if !gApp.Cnf.CiEnabled {
+		ServeJSON(w, NewResponse().SetError(ECForbidden, errCiDisabled.Error()))
+		return
+	}
+	var ci CiRunReq
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("failed to read r.Body: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to read body"))
+		return
+	}
+	defer r.Body.Close()
+	if err := json.Unmarshal(body, &ci); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid body: "+err.Error()))
+		return
+	}
+	if ci.JobId == "" || !labelName.MatchString(ci.JobId) || !labelName.MatchString(ci.Stage) {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param job_id or stage is invalid"))
+		return
+	}
+	dirs, err := ciDirs()
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECFileIOFailed, err.Error()))
+		return
+	}
+	// The scripts of the runner are bash
+	script := ci.Script
+	if runtime.GOOS != "windows" && !strings.HasPrefix(script, "#!") {
+		script = "#!/usr/bin/env bash\n" + script
+	}
+	req := &RunCmdReq{Script: script, RunAs: gApp.Cnf.CiRunAs, Dir: dirs.BuildsDir,
+		Labels: map[string]string{"ci_job": ci.JobId, "ci_stage": ci.Stage}}
+	if err := req.validate(); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	tok := RequestToken(r)
+	job, err := startJob(req, tokenTenant(tok))
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(newJobErrno(err), err.Error()))
+		return
+	}
+	log.Infof("audit: ci job %s stage %s run by %s, job %s", ci.JobId, ci.Stage, tokenTenant(tok), job.Id)
+	backlog, c := job.Subscribe()
+	defer job.Unsubscribe(c)
+
+	w.Header().Set(ContentType, "text/plain; charset=utf-8")
+	w.Header().Set("X-Job-Id", job.Id)
+	w.Header().Set("Trailer", "X-Job-Status, X-Job-Exit-Code, X-Job-Error")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	for _, chunk := range backlog {
+		io.WriteString(w, chunk.Data)
+	}
+	for done := false; !done; {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case chunk, ok := <-c:
+			if ok {
+				io.WriteString(w, chunk.Data)
+				continue
+			}
+			if !job.Finished() {
+				fmt.Fprintf(w, "\n[shell-agent: output too fast, dropped, see job %s]\n", job.Id)
+			}
+			done = true
+		case <-r.Context().Done():
+			log.Warnf("ci job %s stage %s gone, cancel job %s", ci.JobId, ci.Stage, job.Id)
+			cancelJob(job.Id, nil)
+			return
+		case <-gHttpServer.quitC:
+			return
+		}
+	}
+	<-job.Done()
+	s := job.Snapshot()
+	w.Header().Set("X-Job-Status", string(s.Status))
+	w.Header().Set("X-Job-Exit-Code", strconv.Itoa(s.ExitCode))
+	w.Header().Set("X-Job-Error", s.Error)
+}
+
+// Handler of the cleanup stage, the jobs of the ci job still running are
+// canceled
+func CiCleanupHandler(w http.ResponseWriter, r *http.Request) {
+	if !gApp.Cnf.CiEnabled {
+		ServeJSON(w, NewResponse().SetError(ECForbidden, errCiDisabled.Error()))
+		return
+	}
+	var ci CiCleanupReq
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("failed to read r.Body: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to read body"))
+		return
+	}
+	defer r.Body.Close()
+	if err := json.Unmarshal(body, &ci); err != nil || ci.JobId == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param job_id is empty"))
+		return
+	}
+	tok := RequestToken(r)
+	ids := []string{}
+	for _, j := range gJobBookkeeper.GetAll() {
+		if j.Finished() || j.Labels["ci_job"] != ci.JobId || !canManageJob(tok, j) {
+			continue
+		}
+		if _, err := cancelJob(j.Id, tok); err == nil {
+			ids = append(ids, j.Id)
+		}
+	}
+	ServeJSON(w, NewResponse().SetData(ids))
+}
+
+// The client of the agent run by the runner as its executables
+type ciClient struct {
+	url   string
+	token string
+	hc    *http.Client
+}
+
+func newCiClient() *ciClient {
+	o := &ciClient{url: strings.TrimSuffix(os.Getenv("SHELL_AGENT_URL"), "/"), token: os.Getenv("SHELL_AGENT_TOKEN"),
+		hc: &http.Client{}}
+	if o.url == "" {
+		o.url = "http://127.0.0.1:8080"
+	}
+	if os.Getenv("SHELL_AGENT_INSECURE") == "true" {
+		o.hc.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	return o
+}
+
+func (o *ciClient) do(ctx context.Context, path string, v interface{}) (*http.Response, error) {
+	method, body := http.MethodGet, []byte(nil)
+	if v != nil {
+		method = http.MethodPost
+		body, _ = json.Marshal(v)
+	}
+	req, err := http.NewRequest(method, o.url+apiUrlPrefix+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(ContentType, JsonContentType)
+	if o.token != "" {
+		req.Header.Set("Authorization", "Bearer "+o.token)
+	}
+	return o.hc.Do(req)
+}
+
+// Call the api returning a json response, its data is decoded into v
+func (o *ciClient) call(path string, req interface{}, v interface{}) error {
+	resp, err := o.do(context.Background(), path, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	res := &Response{Data: v}
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("%s: invalid response: %s", resp.Status, err)
+	}
+	if res.Errno != ECSuccess {
+		return fmt.Errorf("errno %d: %s", res.Errno, res.Error)
+	}
+	return nil
+}
+
+// The exit code of the runner's env, e.g. BUILD_FAILURE_EXIT_CODE
+func ciExitCode(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return n
+	}
+	return def
+}
+
+// Run a stage of the runner, the exit code is returned
+func ciExec(args []string) int {
+	buildFailure := ciExitCode("BUILD_FAILURE_EXIT_CODE", 1)
+	systemFailure := ciExitCode("SYSTEM_FAILURE_EXIT_CODE", 2)
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: shell-agent ci config|prepare|run <script> <stage>|cleanup")
+		return systemFailure
+	}
+	o := newCiClient()
+	jobId := os.Getenv("CUSTOM_ENV_CI_JOB_ID")
+
+	switch args[0] {
+	case "config":
+		var res CiConfigRes
+		if err := o.call("/ci/config", nil, &res); err != nil {
+			fmt.Fprintf(os.Stderr, "shell-agent %s: %s\n", o.url, err)
+			return systemFailure
+		}
+		json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"builds_dir":           res.BuildsDir,
+			"cache_dir":            res.CacheDir,
+			"builds_dir_is_shared": true,
+			"hostname":             res.Hostname,
+			"driver":               map[string]string{"name": "shell-agent", "version": res.Version},
+		})
+	case "prepare":
+		var res CiConfigRes
+		if err := o.call("/ci/config", nil, &res); err != nil {
+			fmt.Fprintf(os.Stderr, "shell-agent %s: %s\n", o.url, err)
+			return systemFailure
+		}
+		fmt.Printf("Running on %s by shell-agent %s\n", res.Hostname, res.Version)
+	case "run":
+		if len(args) < 3 {
+			fmt.Fprintln(os.Stderr, "usage: shell-agent ci run <script> <stage>")
+			return systemFailure
+		}
+		script, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return systemFailure
+		}
+		return o.run(&CiRunReq{JobId: jobId, Stage: args[2], Script: string(script)}, buildFailure, systemFailure)
+	case "cleanup":
+		var ids []string
+		if err := o.call("/ci/cleanup", &CiCleanupReq{JobId: jobId}, &ids); err != nil {
+			fmt.Fprintf(os.Stderr, "shell-agent %s: %s\n", o.url, err)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "unknown ci stage: "+args[0])
+		return systemFailure
+	}
+	return 0
+}
+
+// Run the script of a stage streaming its output, the connection is closed
+// on SIGTERM of the runner, which cancels the job
+func (o *ciClient) run(req *CiRunReq, buildFailure, systemFailure int) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigC
+		cancel()
+	}()
+
+	resp, err := o.do(ctx, "/ci/run", req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "shell-agent %s: %s\n", o.url, err)
+		return systemFailure
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("X-Job-Id") == "" {
+		var res Response
+		json.NewDecoder(resp.Body).Decode(&res)
+		fmt.Fprintf(os.Stderr, "shell-agent %s: %s, errno %d: %s\n", o.url, resp.Status, res.Errno, res.Error)
+		return systemFailure
+	}
+	if _, err = io.Copy(os.Stdout, resp.Body); err != nil {
+		fmt.Fprintf(os.Stderr, "shell-agent %s: job %s: %s\n", o.url, resp.Header.Get("X-Job-Id"), err)
+		return systemFailure
+	}
+	status := resp.Trailer.Get("X-Job-Status")
+	switch status {
+	case JSFinished:
+		return 0
+	case JSFailed, JSTimedOut:
+		// Failed to start if it never ran
+		if resp.Trailer.Get("X-Job-Exit-Code") == "0" {
+			fmt.Fprintf(os.Stderr, "shell-agent: job %s %s: %s\n", resp.Header.Get("X-Job-Id"), status, resp.Trailer.Get("X-Job-Error"))
+			return systemFailure
+		}
+		return buildFailure
+	}
+	fmt.Fprintf(os.Stderr, "shell-agent: job %s %s: %s\n", resp.Header.Get("X-Job-Id"), status, resp.Trailer.Get("X-Job-Error"))
+	return systemFailure
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The clock of the agent: its wall time, its uptime, the ntp sync of the host
+// clock where known, and the skew against the controller. The skew is
+// measured by the Date of the controller's responses in the pull mode, or
+// given by the caller of /time with its own time. A skew over
+// agent::max_clock_skew is warned, it shifts the run_at of the jobs, the runs
+// of the schedules and the times of the jobs.
+
+type ClockSkew struct {
+	Seconds float64   `json:"seconds"` // The agent ahead of the reference, negative if behind
+	Source  string    `json:"source"`  // controller, or client for the caller of /time
+	Time    time.Time `json:"time"`    // When measured
+}
+
+type NtpStatus struct {
+	Synchronized bool    `json:"synchronized"`
+	MaxErrorMs   float64 `json:"max_error_ms"`
+	EstErrorMs   float64 `json:"est_error_ms"`
+}
+
+type ClockStatus struct {
+	Time          time.Time `json:"time"`
+	UnixNano      int64     `json:"unix_nano"`
+	Timezone      string    `json:"timezone"`
+	UtcOffset     int       `json:"utc_offset_seconds"`
+	StartTime     time.Time `json:"start_time"`
+	UptimeSeconds float64   `json:"uptime_seconds"` // Monotonic, unaffected by the clock changes
+	// Of the host clock, absent where unknown
+	Ntp *NtpStatus `json:"ntp,omitempty"`
+	// The last measured, absent if never
+	Skew         *ClockSkew `json:"skew,omitempty"`
+	SkewExceeded bool       `json:"skew_exceeded"`
+}
+
+type Clock struct {
+	mu       sync.Mutex
+	skew     *ClockSkew
+	exceeded bool
+}
+
+var (
+	// Keeps the monotonic reading for the uptime
+	gStartTime = time.Now()
+	gClock     = &Clock{}
+)
+
+func uptimeSeconds() float64 {
+	return float64(time.Since(gStartTime)/time.Millisecond) / 1000
+}
+
+// Record the skew, warned once when it goes over the threshold
+func (o *Clock) observe(seconds float64, source string) {
+	seconds = math.Round(seconds*1000) / 1000
+	max := gApp.Cnf.MaxClockSkew
+	exceeded := max > 0 && math.Abs(seconds) > float64(max)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if exceeded && !o.exceeded {
+		log.Warnf("clock skew %.3fs against the %s exceeds %ds, the run_at, the schedules and the job times are off",
+			seconds, source, max)
+	} else if !exceeded && o.exceeded {
+		log.Infof("clock skew %.3fs against the %s is back within %ds", seconds, source, max)
+	}
+	o.skew = &ClockSkew{Seconds: seconds, Source: source, Time: time.Now()}
+	o.exceeded = exceeded
+}
+
+// Measure the skew by the Date of the response received at recv, which has
+// the second truncated
+func (o *Clock) observeDate(date string, recv time.Time, source string) {
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return
+	}
+	o.observe(recv.Sub(t.Add(500*time.Millisecond)).Seconds(), source)
+}
+
+// The last skew, nil if never measured
+func (o *Clock) Skew() (*ClockSkew, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.skew == nil {
+		return nil, false
+	}
+	s := *o.skew
+	return &s, o.exceeded
+}
+
+func (o *Clock) Status() *ClockStatus {
+	now := time.Now()
+	zone, offset := now.Zone()
+	res := &ClockStatus{
+		Time:          now,
+		UnixNano:      now.UnixNano(),
+		Timezone:      zone,
+		UtcOffset:     offset,
+		StartTime:     gStartTime,
+		UptimeSeconds: uptimeSeconds(),
+	}
+	res.Ntp, _ = readNtpStatus()
+	res.Skew, res.SkewExceeded = o.Skew()
+	return res
+}
+
+// Handler showing the clock of the agent. With the param ref, the caller's
+// time as RFC3339, the skew against it is measured as well.
+func TimeHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	if ref := strings.TrimSpace(r.FormValue("ref")); ref != "" {
+		t, err := time.Parse(time.RFC3339Nano, ref)
+		if err != nil {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param ref must be RFC3339: "+err.Error()))
+			return
+		}
+		gClock.observe(now.Sub(t).Seconds(), "client")
+	}
+	ServeJSON(w, NewResponse().SetData(gClock.Status()))
+}
@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// The state of the kernel clock discipline, read by adjtimex
+const (
+	timeError = 5    // TIME_ERROR, the clock is not synchronized
+	staUnsync = 0x40 // STA_UNSYNC
+)
+
+func readNtpStatus() (*NtpStatus, error) {
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return nil, err
+	}
+	return &NtpStatus{
+		Synchronized: state != timeError && tx.Status&staUnsync == 0,
+		MaxErrorMs:   float64(tx.Maxerror) / 1000,
+		EstErrorMs:   float64(tx.Esterror) / 1000,
+	}, nil
+}
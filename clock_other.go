@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func readNtpStatus() (*NtpStatus, error) {
+	return nil, errors.New("the ntp status is only supported on linux")
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	log "github.com/Sirupsen/logrus"
 	"sort"
 	"sync"
@@ -9,19 +10,437 @@ import (
 )
 
 type Job struct {
-	Id         string    `json:"id"`
-	Status     JobStatus `json:"status"`
-	Error      string    `json:"error"` // Error msg when fork & exec
-	Cmd        string    `json:"cmd"`
-	Dir        string    `json:"dir"`
-	Env        []string  `json:"env"`
-	Stdout     string    `json:"stdout"`
-	Stderr     string    `json:"stderr"`
-	ExitCode   int       `json:"exit_code"`
-	Pid        int       `json:"pid"`
-	CreateTime time.Time `json:"create_time"`
-	FinishTime time.Time `json:"finish_time"`
+	Id          string    `json:"id"`
+	Seq         int64     `json:"seq"` // Of the agent's sequence when created
+	FinishSeq   int64     `json:"finish_seq,omitempty"`
+	Status      JobStatus `json:"status"`
+	Error       string    `json:"error"` // Error msg when fork & exec
+	Cmd         string    `json:"cmd"`
+	Script      bool      `json:"script,omitempty"` // The cmd is run as a script file
+	RunAs       string    `json:"run_as,omitempty"`
+	Tenant      string    `json:"tenant,omitempty"` // Name of the submitting token, sharing the job pool fairly
+	Dir         string    `json:"dir"`
+	Env         []string  `json:"env"`
+	EnvPass     []string  `json:"env_pass,omitempty"`
+	IdleTimeout int       `json:"idle_timeout_seconds,omitempty"`
+	Timeout     int       `json:"timeout_seconds,omitempty"`
+
+	ConcurrencyGroup string            `json:"concurrency_group,omitempty"`
+	CaptureFiles     []string          `json:"capture_files,omitempty"`
+	ParseAs          string            `json:"parse_as,omitempty"`
+	PsObjects        bool              `json:"ps_objects,omitempty"`
+	PsDepth          int               `json:"ps_depth,omitempty"`
+	Record           bool              `json:"record,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	KeepHistory      int               `json:"keep_history,omitempty"`
+	Template         string            `json:"template,omitempty"` // Of the history kept by keep_history
+	// The invocation as resolved when the job started, if record is set
+	Recording  *JobRecording `json:"recording,omitempty"`
+	ReplayOf   string        `json:"replay_of,omitempty"` // The job whose recording this job runs
+	RunAt      *time.Time    `json:"run_at,omitempty"`
+	ScheduleId string        `json:"schedule_id,omitempty"` // The schedule running the job
+
+	RequireApproval bool          `json:"require_approval,omitempty"`
+	ApprovedBy      string        `json:"approved_by,omitempty"`
+	Reason          *StatusReason `json:"reason,omitempty"` // Why the job is in its status
+
+	RunIf          string           `json:"run_if,omitempty"`
+	Preconditions  []Condition      `json:"preconditions,omitempty"`
+	Postconditions []Condition      `json:"postconditions,omitempty"`
+	Unmet          *ConditionResult `json:"unmet_condition,omitempty"` // Why the job is blocked or failed
+	Rollback       string           `json:"rollback,omitempty"`
+	RollbackJobId  string           `json:"rollback_job_id,omitempty"` // The job running the rollback cmd
+
+	SELinuxContext  string   `json:"selinux_context,omitempty"`
+	AppArmorProfile string   `json:"apparmor_profile,omitempty"`
+	Seccomp         bool     `json:"seccomp,omitempty"`
+	Sandbox         *Sandbox `json:"sandbox,omitempty"`
+	RestrictedToken bool     `json:"restricted_token,omitempty"`
+	LowIntegrity    bool     `json:"low_integrity,omitempty"`
+
+	Stdout string          `json:"stdout"`
+	Stderr string          `json:"stderr"`
+	Files  []*CapturedFile `json:"files,omitempty"` // The capture_files read after the process exits
+	// The stdout parsed by parse_as, or why it failed
+	Parsed     []map[string]string `json:"parsed,omitempty"`
+	ParseError string              `json:"parse_error,omitempty"`
+	// The objects of the powershell pipeline with ps_objects
+	Objects    json.RawMessage `json:"objects,omitempty"`
+	ExitCode   int             `json:"exit_code"`
+	Signal     string          `json:"signal,omitempty"`     // The signal terminating the process, exit_code is -1 then
+	KillPhase  string          `json:"kill_phase,omitempty"` // terminate or kill, by which a stopped process exited
+	Pid        int             `json:"pid"`
+	CreateTime time.Time       `json:"create_time"`
+	FinishTime time.Time       `json:"finish_time"`
+
+	LastOutputTime time.Time   `json:"last_output_time"`
+	Liveness       Liveness    `json:"liveness,omitempty"` // Only for running jobs
+	Timeline       JobTimeline `json:"timeline"`
+
+	Signature string `json:"signature,omitempty"` // Signature of the finished job by the agent's key
+
 	cancelFunc context.CancelFunc
+	// The recording this job runs instead of resolving its invocation
+	replay       *JobRecording
+	cpuTicks     uint64
+	cpuCheckTime time.Time
+
+	// Guard the state, the output and its subscribers
+	mu          sync.Mutex
+	events      []JobEvent
+	stdout      *outputWriter
+	stderr      *outputWriter
+	marks       []OutputMark
+	subscribers map[chan OutputChunk]struct{}
+	outputDone  bool
+	// Taken by a worker or canceled before, so it runs at most once
+	claimed bool
+	// Bytes of the request and the output accounted by gMemoryGuard
+	mem int64
+	// Closed when the job finishes
+	doneC chan struct{}
+}
+
+// Namespaces isolating a job from the host, linux only
+type Sandbox struct {
+	NoNetwork     bool     `json:"no_network,omitempty"`      // Only a loopback interface
+	PrivateTmp    bool     `json:"private_tmp,omitempty"`     // An empty tmpfs on /tmp
+	ReadOnlyPaths []string `json:"read_only_paths,omitempty"` // Absolute paths bind mounted read-only
+}
+
+// When a job reaches its stages, so the wait in the queue can be told from
+// the run. The times are folded from the events, unreached stages are nil.
+type JobTimeline struct {
+	QueuedAt      *time.Time `json:"queued_at,omitempty"` // Nil while waiting for its run_at
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	FirstOutputAt *time.Time `json:"first_output_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	KilledAt      *time.Time `json:"killed_at,omitempty"`
+}
+
+// A piece of output of a job
+type OutputChunk struct {
+	Stream string    `json:"stream"` // stdout or stderr
+	Offset int64     `json:"offset"` // Of the data in the stream
+	Time   time.Time `json:"time"`   // When written, zero if unknown
+	Data   string    `json:"data"`
+}
+
+type Liveness string
+
+const (
+	// Producing output or consuming cpu recently
+	LVActive Liveness = "active"
+	// The process exists, but neither produces output nor consumes cpu
+	LVSilent = "silent"
+	// The process doesn't exist any more
+	LVGone = "gone"
+)
+
+// The job is regarded as silent if it has no progress in this period
+const livenessWindow = time.Minute
+
+// Probe the process to refresh the liveness of a running job
+func (o *Job) UpdateLiveness() {
+	o.mu.Lock()
+	status, pid := o.Status, o.Pid
+	if status != JSRunning || pid == 0 {
+		o.Liveness = ""
+	}
+	o.mu.Unlock()
+	if status != JSRunning || pid == 0 {
+		return
+	}
+
+	// Probe without the lock, the job may finish meanwhile
+	exists := processExists(pid)
+	ticks, ok := processCpuTicks(pid)
+	now := time.Now()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.Status != JSRunning {
+		return
+	}
+	if !exists {
+		o.Liveness = LVGone
+		return
+	}
+	if ok && ticks != o.cpuTicks {
+		o.cpuTicks = ticks
+		o.cpuCheckTime = now
+	}
+
+	last := o.lastActiveLocked()
+	if o.cpuCheckTime.After(last) {
+		last = o.cpuCheckTime
+	}
+	if now.Sub(last) < livenessWindow {
+		o.Liveness = LVActive
+	} else {
+		o.Liveness = LVSilent
+	}
+}
+
+// When the job outputs last time, or is created if no output yet
+func (o *Job) LastActive() time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.lastActiveLocked()
+}
+
+func (o *Job) lastActiveLocked() time.Time {
+	if o.LastOutputTime.After(o.CreateTime) {
+		return o.LastOutputTime
+	}
+	return o.CreateTime
+}
+
+// The current status of the job
+func (o *Job) CurrentStatus() JobStatus {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.Status
+}
+
+// Take the job to run it, false if it has been canceled before
+func (o *Job) claim() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.claimed {
+		return false
+	}
+	o.claimed = true
+	return true
+}
+
+// Queue the job waiting for its run_at, false if it has been canceled
+func (o *Job) queueScheduled() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.Status != JSScheduled {
+		return false
+	}
+	o.recordLocked(JobEvent{Type: JEQueued})
+	return true
+}
+
+// Cancel the job not taken by a worker yet, which finishes without running.
+// False if it is running or finished.
+func (o *Job) cancelPending() bool {
+	o.mu.Lock()
+	if o.claimed || (o.Status != JSQueued && o.Status != JSScheduled && o.Status != JSPendingApproval) {
+		o.mu.Unlock()
+		return false
+	}
+	o.claimed = true
+	o.recordLocked(JobEvent{Type: JEFinished, Status: JSCanceled, Error: "canceled before running"})
+	o.mu.Unlock()
+
+	o.cancelFunc()
+	o.sign()
+	o.closeOutput()
+	return true
+}
+
+func (o *Job) initOutput() {
+	o.stdout = newOutputWriter(o, "stdout")
+	o.stderr = newOutputWriter(o, "stderr")
+	o.doneC = make(chan struct{})
+}
+
+// The channel is closed when the job finishes
+func (o *Job) Done() <-chan struct{} {
+	return o.doneC
+}
+
+// Bytes of stdout and stderr so far
+func (o *Job) OutputSize() (int, int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stdout == nil {
+		return len(o.Stdout), len(o.Stderr)
+	}
+	return int(o.stdout.Len()), int(o.stderr.Len())
+}
+
+// The stdout and stderr so far
+func (o *Job) Output() (string, string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.outputLocked()
+}
+
+func (o *Job) outputLocked() (string, string) {
+	// Decoded from json or a snapshot rather than run here
+	if o.stdout == nil {
+		return o.Stdout, o.Stderr
+	}
+	return o.stdout.String(), o.stderr.String()
+}
+
+func (o *Job) Finished() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.outputDone
+}
+
+// Marshal the job with its output, which lives in the output writers
+func (o *Job) MarshalJSON() ([]byte, error) {
+	type job Job
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stdout == nil {
+		return json.Marshal((*job)(o))
+	}
+	stdout, stderr := o.outputLocked()
+	return json.Marshal(&struct {
+		*job
+		Stdout string `json:"stdout"`
+		Stderr string `json:"stderr"`
+	}{(*job)(o), stdout, stderr})
+}
+
+// A consistent copy of the job with its output, which the handlers can read
+// and marshal while the worker goes on changing the job
+func (o *Job) Snapshot() *Job {
+	return o.snapshot(true)
+}
+
+func (o *Job) snapshot(output bool) *Job {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := &Job{
+		Id:               o.Id,
+		Seq:              o.Seq,
+		FinishSeq:        o.FinishSeq,
+		Status:           o.Status,
+		Error:            o.Error,
+		Cmd:              o.Cmd,
+		Script:           o.Script,
+		RunAs:            o.RunAs,
+		Tenant:           o.Tenant,
+		Dir:              o.Dir,
+		Env:              copyStrings(o.Env),
+		EnvPass:          copyStrings(o.EnvPass),
+		IdleTimeout:      o.IdleTimeout,
+		Timeout:          o.Timeout,
+		ConcurrencyGroup: o.ConcurrencyGroup,
+		CaptureFiles:     copyStrings(o.CaptureFiles),
+		ParseAs:          o.ParseAs,
+		PsObjects:        o.PsObjects,
+		PsDepth:          o.PsDepth,
+		Record:           o.Record,
+		Labels:           o.Labels,
+		KeepHistory:      o.KeepHistory,
+		Template:         o.Template,
+		Recording:        o.Recording,
+		ReplayOf:         o.ReplayOf,
+		Files:            o.Files,
+		Parsed:           o.Parsed,
+		ParseError:       o.ParseError,
+		Objects:          o.Objects,
+		RunAt:            o.RunAt,
+		ScheduleId:       o.ScheduleId,
+		RequireApproval:  o.RequireApproval,
+		ApprovedBy:       o.ApprovedBy,
+		Reason:           o.Reason,
+		RunIf:            o.RunIf,
+		Preconditions:    append([]Condition{}, o.Preconditions...),
+		Postconditions:   append([]Condition{}, o.Postconditions...),
+		Unmet:            o.Unmet,
+		Rollback:         o.Rollback,
+		RollbackJobId:    o.RollbackJobId,
+		SELinuxContext:   o.SELinuxContext,
+		AppArmorProfile:  o.AppArmorProfile,
+		Seccomp:          o.Seccomp,
+		RestrictedToken:  o.RestrictedToken,
+		LowIntegrity:     o.LowIntegrity,
+		ExitCode:         o.ExitCode,
+		Signal:           o.Signal,
+		KillPhase:        o.KillPhase,
+		Pid:              o.Pid,
+		CreateTime:       o.CreateTime,
+		FinishTime:       o.FinishTime,
+		LastOutputTime:   o.LastOutputTime,
+		Liveness:         o.Liveness,
+		Timeline:         o.Timeline,
+		Signature:        o.Signature,
+		outputDone:       o.outputDone,
+	}
+	if o.Sandbox != nil {
+		sandbox := *o.Sandbox
+		sandbox.ReadOnlyPaths = copyStrings(o.Sandbox.ReadOnlyPaths)
+		s.Sandbox = &sandbox
+	}
+	if output {
+		s.Stdout, s.Stderr = o.outputLocked()
+	}
+	return s
+}
+
+func copyStrings(a []string) []string {
+	if a == nil {
+		return nil
+	}
+	return append([]string{}, a...)
+}
+
+// Called with mu held. A subscriber that can't keep up is dropped
+// rather than blocking the job.
+func (o *Job) publish(chunk OutputChunk) {
+	for c := range o.subscribers {
+		select {
+		case c <- chunk:
+		default:
+			log.Warnf("drop slow output subscriber of job: %s", o.Id)
+			delete(o.subscribers, c)
+			close(c)
+		}
+	}
+}
+
+// Mark the output complete, all the subscribers' channels are closed
+func (o *Job) closeOutput() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.outputDone = true
+	for c := range o.subscribers {
+		close(c)
+	}
+	o.subscribers = nil
+	o.stdout.finish()
+	o.stderr.finish()
+	close(o.doneC)
+}
+
+// Subscribe to the output of the job. The output so far is returned as the
+// backlog in the chunks as written, the following output is sent to the channel, which is closed when
+// the job finishes or the subscriber is too slow.
+func (o *Job) Subscribe() ([]OutputChunk, chan OutputChunk) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	backlog := o.outputChunksLocked()
+	c := make(chan OutputChunk, 256)
+	if o.outputDone {
+		close(c)
+		return backlog, c
+	}
+	if o.subscribers == nil {
+		o.subscribers = make(map[chan OutputChunk]struct{})
+	}
+	o.subscribers[c] = struct{}{}
+	return backlog, c
+}
+
+func (o *Job) Unsubscribe(c chan OutputChunk) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.subscribers[c]; ok {
+		delete(o.subscribers, c)
+		close(c)
+	}
 }
 
 type Jobs []*Job
@@ -36,15 +455,23 @@ func (o Jobs) Less(i, j int) bool {
 	return o[i].CreateTime.Before(o[j].CreateTime)
 }
 
+// Number of the shards of the bookkeeper. The jobs are spread over the
+// shards by their ids, so that the readers polling the jobs hold only read
+// locks of single shards, rather than blocking the submissions.
+const jobShardCount = 32
+
+type jobShard struct {
+	jobs map[string]*Job
+	sync.RWMutex
+}
+
 type JobBookkeeper struct {
 	expireDays int
 
-	jobs map[string]*Job
+	shards [jobShardCount]jobShard
 
 	quitC  chan struct{}
 	cancel context.CancelFunc
-
-	sync.RWMutex
 }
 
 func NewJobBookkeeper(expireDays int) *JobBookkeeper {
@@ -54,14 +481,16 @@ func NewJobBookkeeper(expireDays int) *JobBookkeeper {
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	o := JobBookkeeper{
+	o := &JobBookkeeper{
 		expireDays: expireDays,
-		jobs:       make(map[string]*Job),
 		quitC:      make(chan struct{}),
 		cancel:     cancel,
 	}
+	for i := range o.shards {
+		o.shards[i].jobs = make(map[string]*Job)
+	}
 	go o.checkExpire(ctx)
-	return &o
+	return o
 }
 
 func (o *JobBookkeeper) Close() error {
@@ -70,35 +499,94 @@ func (o *JobBookkeeper) Close() error {
 	return nil
 }
 
+// The shard of the id by its FNV-1a hash
+func (o *JobBookkeeper) shard(id string) *jobShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
+	}
+	return &o.shards[h%jobShardCount]
+}
+
 // Record the job's info
 func (o *JobBookkeeper) Add(j *Job) {
-	o.Lock()
-	defer o.Unlock()
 	if j == nil {
 		return
 	}
-	o.jobs[j.Id] = j
+	s := o.shard(j.Id)
+	s.Lock()
+	defer s.Unlock()
+	s.jobs[j.Id] = j
 }
 
 // Get the job info by id
 func (o *JobBookkeeper) Get(id string) *Job {
-	o.Lock()
-	defer o.Unlock()
-	if j, ok := o.jobs[id]; ok {
-		return j
-	} else {
+	s := o.shard(id)
+	s.RLock()
+	defer s.RUnlock()
+	return s.jobs[id]
+}
+
+func (o *JobBookkeeper) Remove(id string) {
+	s := o.shard(id)
+	s.Lock()
+	defer s.Unlock()
+	delete(s.jobs, id)
+}
+
+// Remove the finished jobs matched and release their output, the removed
+// ones are returned
+func (o *JobBookkeeper) Delete(match func(j *Job) bool) []*Job {
+	var deleted []*Job
+	for i := range o.shards {
+		s := &o.shards[i]
+		s.Lock()
+		for k, j := range s.jobs {
+			if j.Finished() && match(j) {
+				delete(s.jobs, k)
+				deleted = append(deleted, j)
+			}
+		}
+		s.Unlock()
+	}
+	for _, j := range deleted {
+		j.release()
+	}
+	return deleted
+}
+
+// The snapshot of the job by id with its liveness refreshed, nil if not
+// found
+func (o *JobBookkeeper) Snapshot(id string) *Job {
+	j := o.Get(id)
+	if j == nil {
 		return nil
 	}
+	j.UpdateLiveness()
+	return j.Snapshot()
+}
+
+// The snapshots of all jobs ordered by create time desc
+func (o *JobBookkeeper) Snapshots() []*Job {
+	jobs := o.GetAll()
+	for i, j := range jobs {
+		j.UpdateLiveness()
+		jobs[i] = j.Snapshot()
+	}
+	return jobs
 }
 
 // Get all jobs ordered by create time desc
 func (o *JobBookkeeper) GetAll() []*Job {
-	o.Lock()
-	defer o.Unlock()
-	// The job that
 	var jobs Jobs
-	for _, j := range o.jobs {
-		jobs = append(jobs, j)
+	for i := range o.shards {
+		s := &o.shards[i]
+		s.RLock()
+		for _, j := range s.jobs {
+			jobs = append(jobs, j)
+		}
+		s.RUnlock()
 	}
 	sort.Sort(sort.Reverse(jobs))
 	return jobs
@@ -119,17 +607,23 @@ func (o *JobBookkeeper) checkExpire(ctx context.Context) {
 }
 
 func (o *JobBookkeeper) expire() {
-	o.Lock()
-	defer o.Unlock()
-	purgedCnt := 0
-	for k, j := range o.jobs {
-		if j.Status == JSRunning {
-			continue
-		}
-		if time.Duration(o.expireDays)*time.Hour*24 < time.Now().Sub(j.FinishTime) {
-			delete(o.jobs, k)
-			purgedCnt++
+	var purged []*Job
+	for i := range o.shards {
+		s := &o.shards[i]
+		s.Lock()
+		for k, j := range s.jobs {
+			if !j.Finished() {
+				continue
+			}
+			if time.Duration(o.expireDays)*time.Hour*24 < time.Now().Sub(j.FinishTime) {
+				delete(s.jobs, k)
+				purged = append(purged, j)
+			}
 		}
+		s.Unlock()
+	}
+	for _, j := range purged {
+		j.release()
 	}
-	log.Debugf("purged %d outdated jobs", purgedCnt)
+	log.Debugf("purged %d outdated jobs", len(purged))
 }
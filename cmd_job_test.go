@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type jobStore interface {
+	Add(j *Job)
+	Get(id string) *Job
+	GetAll() []*Job
+}
+
+// The bookkeeper before it was sharded, one lock for all the jobs, kept as
+// the baseline of the benchmarks
+type globalLockBookkeeper struct {
+	mu   sync.RWMutex
+	jobs map[string]*Job
+}
+
+func (o *globalLockBookkeeper) Add(j *Job) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.jobs[j.Id] = j
+}
+
+func (o *globalLockBookkeeper) Get(id string) *Job {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.jobs[id]
+}
+
+func (o *globalLockBookkeeper) GetAll() []*Job {
+	o.mu.RLock()
+	jobs := make(Jobs, 0, len(o.jobs))
+	for _, j := range o.jobs {
+		jobs = append(jobs, j)
+	}
+	o.mu.RUnlock()
+	sort.Sort(sort.Reverse(jobs))
+	return jobs
+}
+
+const benchJobs = 10000
+
+func benchJobIds(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%08x-c222-4c02-46e7-c1bd95ec176b", i)
+	}
+	return ids
+}
+
+// Run the benchmark on both bookkeepers filled with benchJobs jobs
+func benchBookkeepers(b *testing.B, f func(b *testing.B, store jobStore, ids []string)) {
+	ids := benchJobIds(benchJobs)
+	fill := func(store jobStore) jobStore {
+		for i, id := range ids {
+			store.Add(&Job{Id: id, CreateTime: time.Unix(int64(i), 0)})
+		}
+		return store
+	}
+	b.Run("global", func(b *testing.B) {
+		f(b, fill(&globalLockBookkeeper{jobs: make(map[string]*Job)}), ids)
+	})
+	b.Run("sharded", func(b *testing.B) {
+		bk := NewJobBookkeeper(1)
+		defer bk.Close()
+		f(b, fill(bk), ids)
+	})
+}
+
+func BenchmarkBookkeeperGet(b *testing.B) {
+	benchBookkeepers(b, func(b *testing.B, store jobStore, ids []string) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				store.Get(ids[i%len(ids)])
+			}
+		})
+	})
+}
+
+func BenchmarkBookkeeperAdd(b *testing.B) {
+	benchBookkeepers(b, func(b *testing.B, store jobStore, ids []string) {
+		var n int64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				i := atomic.AddInt64(&n, 1)
+				store.Add(&Job{Id: ids[i%int64(len(ids))], CreateTime: time.Unix(i, 0)})
+			}
+		})
+	})
+}
+
+// The polling readers while the jobs are submitted, one add per 10 gets
+func BenchmarkBookkeeperGetWhileAdding(b *testing.B) {
+	benchBookkeepers(b, func(b *testing.B, store jobStore, ids []string) {
+		var n int64
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if i%10 == 0 {
+					k := atomic.AddInt64(&n, 1)
+					store.Add(&Job{Id: ids[k%int64(len(ids))], CreateTime: time.Unix(k, 0)})
+				} else {
+					store.Get(ids[i%len(ids)])
+				}
+			}
+		})
+	})
+}
+
+// Listing all the jobs while others are submitted
+func BenchmarkBookkeeperGetAll(b *testing.B) {
+	benchBookkeepers(b, func(b *testing.B, store jobStore, ids []string) {
+		quitC := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-quitC:
+					return
+				default:
+				}
+				store.Add(&Job{Id: ids[i%len(ids)], CreateTime: time.Unix(int64(i), 0)})
+			}
+		}()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			store.GetAll()
+		}
+		b.StopTimer()
+		close(quitC)
+		wg.Wait()
+	})
+}
+
+func TestJobBookkeeper(t *testing.T) {
+	bk := NewJobBookkeeper(1)
+	defer bk.Close()
+	ids := benchJobIds(100)
+	for i, id := range ids {
+		bk.Add(&Job{Id: id, CreateTime: time.Unix(int64(i), 0)})
+	}
+	if j := bk.Get(ids[42]); j == nil || j.Id != ids[42] {
+		t.Fatalf("got %v", j)
+	}
+	all := bk.GetAll()
+	if len(all) != len(ids) {
+		t.Fatalf("got %d jobs", len(all))
+	}
+	// Ordered by create time desc across the shards
+	for i, j := range all {
+		if j.Id != ids[len(ids)-1-i] {
+			t.Fatalf("job %d is %s", i, j.Id)
+		}
+	}
+	bk.Remove(ids[42])
+	if bk.Get(ids[42]) != nil || len(bk.GetAll()) != len(ids)-1 {
+		t.Fatal("job not removed")
+	}
+}
+
+// The state of a job is the fold of its events
+func TestJobEventFold(t *testing.T) {
+	setupJobs(t)
+	job := &Job{Id: "fold"}
+	job.initOutput()
+
+	job.record(JobEvent{Type: JECreated})
+	if job.Status != JSQueued || job.Seq == 0 || job.Timeline.QueuedAt == nil {
+		t.Fatalf("created: status %s, seq %d", job.Status, job.Seq)
+	}
+	runAt := time.Now().Add(time.Hour)
+	job.record(JobEvent{Type: JEScheduled, RunAt: &runAt})
+	if job.Status != JSScheduled || job.RunAt != &runAt || job.Timeline.QueuedAt != nil {
+		t.Fatalf("scheduled: status %s", job.Status)
+	}
+	job.record(JobEvent{Type: JEQueued})
+	job.record(JobEvent{Type: JEStarted, Pid: 42})
+	if job.Status != JSRunning || job.Pid != 42 || job.Timeline.StartedAt == nil {
+		t.Fatalf("started: status %s, pid %d", job.Status, job.Pid)
+	}
+
+	// The output within a second is merged into one event
+	job.stdout.Write([]byte("a\n"))
+	job.stdout.Write([]byte("b\n"))
+	if job.Timeline.FirstOutputAt == nil || job.LastOutputTime.IsZero() {
+		t.Fatal("output not recorded")
+	}
+	job.record(JobEvent{Type: JEKilled})
+	job.record(JobEvent{Type: JEFinished, Status: JSCanceled, ExitCode: -1, Signal: "killed", KillPhase: KPKill, Error: "canceled"})
+	if job.Status != JSCanceled || job.ExitCode != -1 || job.Signal != "killed" || job.KillPhase != KPKill || job.Error != "canceled" {
+		t.Fatalf("finished: status %s, exit code %d, signal %s, kill phase %s", job.Status, job.ExitCode, job.Signal, job.KillPhase)
+	}
+	if job.FinishSeq <= job.Seq || job.Timeline.KilledAt == nil || job.Timeline.FinishedAt == nil {
+		t.Fatalf("finished: seq %d, finish seq %d", job.Seq, job.FinishSeq)
+	}
+
+	events := job.Events(0)
+	var types []JobEventType
+	for i, ev := range events {
+		if ev.Seq != i+1 {
+			t.Fatalf("event %d has seq %d", i, ev.Seq)
+		}
+		types = append(types, ev.Type)
+	}
+	want := []JobEventType{JECreated, JEScheduled, JEQueued, JEStarted, JEOutput, JEKilled, JEFinished}
+	if fmt.Sprint(types) != fmt.Sprint(want) {
+		t.Fatalf("got events %v", types)
+	}
+	if events[4].Size != 4 {
+		t.Fatalf("got output size %d", events[4].Size)
+	}
+}
+
+func TestJobCancelPending(t *testing.T) {
+	setupJobs(t)
+	job, _, err := newJob(&RunCmdReq{Cmd: "true"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !job.cancelPending() {
+		t.Fatal("queued job not canceled")
+	}
+	if job.CurrentStatus() != JSCanceled || !job.Finished() {
+		t.Fatalf("got status %s", job.CurrentStatus())
+	}
+	// Never run by a worker afterwards
+	if job.claim() {
+		t.Fatal("canceled job claimed")
+	}
+
+	running, _, err := newJob(&RunCmdReq{Cmd: "true"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	running.claim()
+	if running.cancelPending() {
+		t.Fatal("claimed job canceled as pending")
+	}
+}
+
+// A snapshot doesn't change with the job
+func TestJobSnapshot(t *testing.T) {
+	setupJobs(t)
+	job, _, err := newJob(&RunCmdReq{Cmd: "true", Env: []string{"A=1"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.stdout.Write([]byte("before\n"))
+	s := job.Snapshot()
+
+	job.record(JobEvent{Type: JEStarted, Pid: 7})
+	job.stdout.Write([]byte("after\n"))
+	job.Env[0] = "A=2"
+	if s.Status != JSQueued || s.Pid != 0 || s.Stdout != "before\n" || s.Env[0] != "A=1" {
+		t.Fatalf("snapshot changed: status %s, pid %d, stdout %q, env %v", s.Status, s.Pid, s.Stdout, s.Env)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+type ConditionType string
+
+const (
+	CTFileExists     ConditionType = "file_exists"
+	CTFileAbsent                   = "file_absent"
+	CTServiceRunning               = "service_running"
+	CTDiskFree                     = "disk_free"   // At least min_free_mb free on the disk of path
+	CTPortOpen                     = "port_open"   // Something listens on addr
+	CTPortClosed                   = "port_closed" // Nothing listens on addr
+	CTHttpStatus                   = "http_status" // Get of url answers status, 200 by default
+)
+
+// A condition of the host checked by the agent, e.g. the preconditions of a
+// job are checked before it runs, so a doomed cmd fails fast with the reason,
+// and the postconditions after it, so a deploy verifies itself.
+type Condition struct {
+	Type      ConditionType `json:"type"`
+	Path      string        `json:"path,omitempty"`
+	Service   string        `json:"service,omitempty"`
+	MinFreeMB uint64        `json:"min_free_mb,omitempty"`
+	Addr      string        `json:"addr,omitempty"` // host:port
+	Url       string        `json:"url,omitempty"`
+	Status    int           `json:"status,omitempty"`
+	// Check again every second until met within the seconds, e.g. a service
+	// taking a while to come up, 0 means checked once
+	WithinSeconds int `json:"within_seconds,omitempty"`
+}
+
+// An unmet condition and why
+type ConditionResult struct {
+	Condition
+	Reason string `json:"reason"`
+}
+
+const conditionDialTimeout = 3 * time.Second
+
+func (o *Condition) validate() error {
+	if o.WithinSeconds < 0 {
+		return fmt.Errorf("condition %s: param within_seconds must not be negative", o.Type)
+	}
+	switch o.Type {
+	case CTFileExists, CTFileAbsent:
+		if o.Path == "" {
+			return fmt.Errorf("condition %s: param path is empty", o.Type)
+		}
+	case CTServiceRunning:
+		if o.Service == "" {
+			return fmt.Errorf("condition %s: param service is empty", o.Type)
+		}
+	case CTDiskFree:
+		if o.Path == "" || o.MinFreeMB == 0 {
+			return fmt.Errorf("condition %s: param path or min_free_mb is empty", o.Type)
+		}
+	case CTPortOpen, CTPortClosed:
+		if _, _, err := net.SplitHostPort(o.Addr); err != nil {
+			return fmt.Errorf("condition %s: invalid param addr, expect host:port: %s", o.Type, err)
+		}
+	case CTHttpStatus:
+		if u, err := url.Parse(o.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("condition %s: invalid param url, expect http(s)://host/path", o.Type)
+		}
+	default:
+		return fmt.Errorf("unknown condition type: %q", o.Type)
+	}
+	return nil
+}
+
+func validateConditions(conds []Condition) error {
+	for i := range conds {
+		if err := conds[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Nil if the condition is met, otherwise why not
+func (o *Condition) Check() error {
+	if err := o.validate(); err != nil {
+		return err
+	}
+	switch o.Type {
+	case CTFileExists, CTFileAbsent, CTDiskFree:
+		path, err := JailPath(o.Path)
+		if err != nil {
+			return err
+		}
+		if o.Type == CTDiskFree {
+			free, err := diskFree(path)
+			if err != nil {
+				return err
+			}
+			if free < o.MinFreeMB<<20 {
+				return fmt.Errorf("%dMB free on %s, want %dMB", free>>20, o.Path, o.MinFreeMB)
+			}
+			return nil
+		}
+		_, err = os.Stat(path)
+		if o.Type == CTFileExists && err != nil {
+			return fmt.Errorf("%s doesn't exist: %s", o.Path, err)
+		}
+		if o.Type == CTFileAbsent && !os.IsNotExist(err) {
+			return fmt.Errorf("%s exists", o.Path)
+		}
+	case CTServiceRunning:
+		running, err := serviceRunning(o.Service)
+		if err != nil {
+			return err
+		}
+		if !running {
+			return fmt.Errorf("service %s is not running", o.Service)
+		}
+	case CTPortOpen, CTPortClosed:
+		conn, err := net.DialTimeout("tcp", o.Addr, conditionDialTimeout)
+		if err == nil {
+			conn.Close()
+		}
+		if o.Type == CTPortOpen && err != nil {
+			return fmt.Errorf("port %s is closed: %s", o.Addr, err)
+		}
+		if o.Type == CTPortClosed && err == nil {
+			return errors.New("port " + o.Addr + " is open")
+		}
+	case CTHttpStatus:
+		want := o.Status
+		if want == 0 {
+			want = http.StatusOK
+		}
+		resp, err := NewOutboundClient(conditionDialTimeout * 3).Get(o.Url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			return fmt.Errorf("%s answered %d, want %d", o.Url, resp.StatusCode, want)
+		}
+	}
+	return nil
+}
+
+// Check the condition until met within its within_seconds, or ctx is done
+func (o *Condition) Wait(ctx context.Context) error {
+	deadline := time.Now().Add(time.Duration(o.WithinSeconds) * time.Second)
+	for {
+		err := o.Check()
+		if err == nil || !time.Now().Before(deadline) {
+			return err
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// The first unmet condition, nil if all are met
+func checkConditions(ctx context.Context, conds []Condition) *ConditionResult {
+	for _, c := range conds {
+		if err := c.Wait(ctx); err != nil {
+			return &ConditionResult{Condition: c, Reason: err.Error()}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// Bytes available to unprivileged users on the filesystem of path
+func diskFree(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// Whether the service is running by systemd, or launchd on darwin. Without
+// systemd the init script's status is asked.
+func serviceRunning(name string) (bool, error) {
+	var cmd *exec.Cmd
+	switch {
+	case runtime.GOOS == "darwin":
+		cmd = exec.Command("launchctl", "list", name)
+	default:
+		if _, err := exec.LookPath("systemctl"); err == nil {
+			cmd = exec.Command("systemctl", "is-active", "--quiet", name)
+		} else {
+			cmd = exec.Command("service", name, "status")
+		}
+	}
+	err := cmd.Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,71 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	scManagerConnect    = 0x0001
+	serviceQueryStatus  = 0x0004
+	serviceRunningState = 0x00000004
+)
+
+var (
+	modkernel32            = syscall.NewLazyDLL("kernel32.dll")
+	procGetDiskFreeSpaceEx = modkernel32.NewProc("GetDiskFreeSpaceExW")
+	procOpenSCManager      = modadvapi32.NewProc("OpenSCManagerW")
+	procOpenService        = modadvapi32.NewProc("OpenServiceW")
+	procQueryServiceStatus = modadvapi32.NewProc("QueryServiceStatus")
+	procCloseServiceHandle = modadvapi32.NewProc("CloseServiceHandle")
+)
+
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// Bytes available to the agent's user on the volume of path
+func diskFree(path string) (uint64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	r, _, err := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), 0, 0)
+	if r == 0 {
+		return 0, err
+	}
+	return free, nil
+}
+
+// Whether the service is running by the service control manager
+func serviceRunning(name string) (bool, error) {
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return false, err
+	}
+	scm, _, err := procOpenSCManager.Call(0, 0, scManagerConnect)
+	if scm == 0 {
+		return false, err
+	}
+	defer procCloseServiceHandle.Call(scm)
+	svc, _, err := procOpenService.Call(scm, uintptr(unsafe.Pointer(p)), serviceQueryStatus)
+	if svc == 0 {
+		return false, err
+	}
+	defer procCloseServiceHandle.Call(svc)
+	var st serviceStatus
+	if r, _, err := procQueryServiceStatus.Call(svc, uintptr(unsafe.Pointer(&st))); r == 0 {
+		return false, err
+	}
+	return st.CurrentState == serviceRunningState, nil
+}
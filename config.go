@@ -3,15 +3,177 @@ package main
 import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/astaxie/beego/config"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
 )
 
 type Config struct {
-	Addr     string
-	LogDir   string
-	LogLevel string
+	Addr       string
+	TlsCert    string // Empty means plain http
+	TlsKey     string
+	Tags       []string // Labels of the agent, e.g. the site or the role
+	LogDir     string
+	LogLevel   string
+	LogOutputs []string // file, stdout, stderr or syslog
+
+	MaxClockSkew int // Seconds of the clock skew against the controller warned, 0 means never
 
 	ExpireDays int
 
+	JobShell []string // Empty means sh -c, or cmd /c on windows
+	JobPath  string   // PATH of the jobs, empty means the agent's PATH
+	JobEnv   []string // KEY=VALUE of the jobs
+	// KB read at most from each of the capture_files of a job
+	JobCaptureMaxSize int
+	JobScriptDir      string // Where the scripts of the jobs are written
+
+	JobDefaultTimeout int // Seconds of the jobs not giving timeout_seconds, 0 means never
+	JobMaxTimeout     int // Seconds the timeout_seconds given are capped to, 0 means no cap
+	// Seconds from asking a stopped job to exit to killing it, 0 means kill at once
+	JobKillGrace int
+
+	FetchProxy         string // Override ProxyUrl for fetching files
+	FetchRetries       int
+	FetchMaxRetries    int // Cap of the retries a request can ask for
+	FetchTimeout       int // Seconds a download may take in all
+	FetchHeaderTimeout int // Seconds to wait for the response headers
+	FetchRateLimit     int // KB per second, 0 means unlimited
+	// Base64 encoded ed25519 keys, one of which must sign the fetched files,
+	// empty means unsigned
+	FetchPublicKeys []string
+
+	UploadRateLimit   int // KB per second of an sftp session, 0 means unlimited
+	DownloadRateLimit int // KB per second of an sftp session, 0 means unlimited
+	TotalRateLimit    int // KB per second shared by all transfers, 0 means unlimited
+
+	CorsAllowedOrigins   []string // Empty means cors is disabled
+	CorsAllowedMethods   []string
+	CorsAllowedHeaders   []string
+	CorsExposedHeaders   []string
+	CorsAllowCredentials bool
+	CorsMaxAge           int
+
+	ControllerUrl         string // Empty means the pull mode is disabled
+	ControllerToken       string
+	ControllerAgentId     string
+	ControllerPollTimeout int // Seconds of a long poll
+	ControllerHeartbeat   int // Seconds between the heartbeats, 0 means none
+
+	ProxyUrl string // Proxy of all outbound connections, empty means the environment is used
+	NoProxy  []string
+
+	SigningKeyFile string // Empty means the jobs are not signed
+
+	EncryptionKeyFile string // Empty means the job data on disk is not encrypted
+
+	SmtpAddr     string // host:port, empty means the email notification is disabled
+	SmtpFrom     string
+	SmtpUsername string
+	SmtpPassword string
+
+	JailRoot string // Root of the file apis and the job directories, empty means no jail
+
+	SeccompDenySyscalls []string
+	SeccompEnforce      bool // Apply seccomp to all the jobs
+
+	AuthAdminToken string // Bootstrap admin token, the auth is disabled if both are empty
+	AuthTokenFile  string // Hashed tokens managed by the admin api
+
+	ElevationMaxDuration int // Max seconds of an elevation
+
+	LdapUrl          string // ldap:// or ldaps://, empty means no LDAP auth
+	LdapStartTls     bool
+	LdapCaFile       string // CAs verifying the server, empty means the system ones
+	LdapBindDn       string // Searching the users, empty means they search themselves
+	LdapBindPassword string
+	LdapUserDn       string // The dn of the user name bound without a bind_dn, e.g. %s@corp.example.com
+	LdapBaseDn       string
+	LdapUserFilter   string // %s is the user name
+	LdapGroupAttr    string
+	LdapAdminGroups  []string // Their members get an admin token
+	LdapUserGroups   []string // Their members get a token, empty means any user
+	LdapTimeout      int      // Seconds
+	LdapCacheTtl     int      // Seconds a successful login is cached, 0 means never
+
+	KerberosKeytab  string   // Keys of the service principals, empty means no Negotiate auth
+	KerberosService string   // The service principal accepted, empty means any of the keytab
+	KerberosRealms  []string // Realms of the clients, empty means those of the keytab
+	KerberosMaxSkew int      // Seconds
+
+	AdminPprof bool // Serve net/http/pprof under the admin api
+
+	PoolSize      int      // Jobs running at the same time
+	PoolQueueSize int      // Jobs waiting for a worker, more are rejected
+	PoolWeights   []string // <tenant>:<weight>, the share of the workers of a tenant, default to 1
+
+	MemoryLimit    int    // MB of the jobs' requests and output, 0 means unlimited
+	MemoryRingSize int    // KB of the recent output of a stream kept in memory, the older is spilled
+	MemorySpillDir string // Where the output is spilled
+
+	PeerUrls            []string // Agents the jobs are forwarded to by their target tags
+	PeerToken           string
+	PeerRefreshInterval int // Seconds between refreshing the tags of the peers
+
+	BootstrapToken string // One-time token of /bootstrap, empty means disabled
+	BootstrapDir   string // Where the pushed config is kept
+
+	CertWatchPaths []string // Certificate files or dirs whose expirations are reported
+	CertWarnDays   int      // A certificate is expiring within the days
+
+	ScheduleDir         string // Where the delayed jobs are kept across restarts
+	ScheduleMaxFailures int    // A schedule is paused after the consecutive failures, 0 means never
+
+	WatchInterval int // Seconds between the scans of the watched dirs
+
+	PolicyUrl       string // Base url of the policy bundles, empty means no policy
+	PolicyToken     string
+	PolicyPublicKey string // Base64 encoded ed25519 key verifying the bundles, empty means unsigned
+	PolicyDir       string // Where the policy in effect is kept across restarts
+	PolicyInterval  int    // Seconds between the fetches
+
+	ApplyWindow       int    // Seconds for the server to be healthy after a config or a policy is applied
+	ApplyAlertWebhook string // Posted the state of an apply reverted
+	ApplyAlertEmail   string
+
+	HistoryDir        string // Where the results kept by keep_history are
+	HistoryMaxEntries int    // Results kept of a request at most
+	HistoryMaxOutput  int    // KB of a stream of a result kept, the rest is cut
+
+	LibraryDir string // Where the profiles imported are kept
+
+	GitTimeout int // Seconds a git command may run before it's killed
+
+	PtyEnabled     bool     // Interactive shells by /admin/pty
+	PtyShell       []string // The shell and its args, default to $SHELL or cmd
+	PtyIdleTimeout int      // Seconds without input or output a session is closed after, 0 means never
+	PtyMaxSessions int      // Sessions open at a time, 0 means unlimited
+
+	Shares []*NetworkShare // Windows shares connected by their credentials, each of its own section
+
+	ServiceAccounts        []*ServiceAccount // The principals of the schedules and the watches, each of its own section
+	ServiceAccountRequired bool              // The schedules and the watches must name a service account
+
+	Hooks []*Hook // The endpoints /hook/<name> run by the external systems, each of its own section
+
+	CiEnabled   bool   // The execution backend of a gitlab runner by /api/v1/ci/*, experimental
+	CiBuildsDir string // Where the ci jobs build
+	CiCacheDir  string
+	CiRunAs     string // The user the ci jobs run as, empty means the agent's
+
+	SftpEnabled bool // The ssh server of the sftp subsystem on SftpListen
+	SftpListen  string
+	SftpHostKey string // The ed25519 host key, generated if the file doesn't exist
+	SftpHome    string // Where the sessions start, relative paths are under it
+	// The CA keys signing the user certificates, which log in as the tokens
+	// named by their principals
+	SftpTrustedUserCaKeys string
+	SftpExec              bool // The commands of ssh are run as jobs of the token
+
+	JanitorInterval int            // Minutes between the cleanups, 0 means only on demand
+	JanitorRules    []*JanitorRule // Dirs pruned by the janitor, each of its own section
+
 	cnfPath  string
 	innerCnf config.Configer
 
@@ -50,10 +212,258 @@ func (o *Config) Reload() error {
 
 	o.LogDir = o.innerCnf.DefaultString("log::dir", "../log")
 	o.LogLevel = o.innerCnf.DefaultString("log::level", "info")
+	o.LogOutputs = o.innerCnf.DefaultStrings("log::outputs", []string{"file"})
 
 	o.ExpireDays = o.innerCnf.DefaultInt("expire_days", 7)
+
+	o.JobShell = strings.Fields(o.osString("job", "shell", ""))
+	o.JobPath = o.osString("job", "path", "")
+	o.JobEnv = o.osStrings("job", "env", nil)
+	o.JobCaptureMaxSize = o.innerCnf.DefaultInt("job::capture_max_size", 64)
+	o.JobScriptDir = o.innerCnf.DefaultString("job::script_dir", "../scripts")
+	o.JobDefaultTimeout = o.innerCnf.DefaultInt("job::default_timeout", 0)
+	o.JobMaxTimeout = o.innerCnf.DefaultInt("job::max_timeout", 0)
+	o.JobKillGrace = o.innerCnf.DefaultInt("job::kill_grace", 10)
+
+	o.FetchProxy = o.innerCnf.DefaultString("fetch::proxy", "")
+	o.FetchRetries = o.innerCnf.DefaultInt("fetch::retries", 3)
+	o.FetchMaxRetries = o.innerCnf.DefaultInt("fetch::max_retries", 10)
+	o.FetchTimeout = o.innerCnf.DefaultInt("fetch::timeout", 3600)
+	o.FetchHeaderTimeout = o.innerCnf.DefaultInt("fetch::header_timeout", 30)
+	o.FetchRateLimit = o.innerCnf.DefaultInt("fetch::rate_limit", 0)
+	o.FetchPublicKeys = o.innerCnf.DefaultStrings("fetch::public_keys", nil)
+
+	o.UploadRateLimit = o.innerCnf.DefaultInt("transfer::upload_rate_limit", 0)
+	o.DownloadRateLimit = o.innerCnf.DefaultInt("transfer::download_rate_limit", 0)
+	o.TotalRateLimit = o.innerCnf.DefaultInt("transfer::total_rate_limit", 0)
+
+	o.CorsAllowedOrigins = o.innerCnf.DefaultStrings("cors::allowed_origins", nil)
+	o.CorsAllowedMethods = o.innerCnf.DefaultStrings("cors::allowed_methods", []string{"GET", "POST"})
+	o.CorsAllowedHeaders = o.innerCnf.DefaultStrings("cors::allowed_headers", []string{"Content-Type", "Authorization"})
+	o.CorsExposedHeaders = o.innerCnf.DefaultStrings("cors::exposed_headers",
+		[]string{"ETag", "X-Job-Id", "X-Job-Status", "X-Job-Exit-Code", "X-Job-Error"})
+	o.CorsAllowCredentials = o.innerCnf.DefaultBool("cors::allow_credentials", false)
+	o.CorsMaxAge = o.innerCnf.DefaultInt("cors::max_age", 600)
+
+	hostname, _ := os.Hostname()
+	o.ControllerUrl = strings.TrimRight(o.innerCnf.DefaultString("controller::url", ""), "/")
+	o.ControllerToken = o.innerCnf.DefaultString("controller::token", "")
+	o.ControllerAgentId = o.innerCnf.DefaultString("controller::agent_id", hostname)
+	o.ControllerPollTimeout = o.innerCnf.DefaultInt("controller::poll_timeout", 30)
+	o.ControllerHeartbeat = o.innerCnf.DefaultInt("controller::heartbeat_interval", 15)
+
+	o.ProxyUrl = o.innerCnf.DefaultString("proxy::url", "")
+	o.NoProxy = o.innerCnf.DefaultStrings("proxy::no_proxy", []string{"localhost", "127.0.0.1"})
+
+	o.SigningKeyFile = o.innerCnf.DefaultString("signing::key_file", "")
+
+	o.EncryptionKeyFile = o.innerCnf.DefaultString("encryption::key_file", "")
+
+	o.SmtpAddr = o.innerCnf.DefaultString("smtp::addr", "")
+	o.SmtpFrom = o.innerCnf.DefaultString("smtp::from", "shell-agent@"+hostname)
+	o.SmtpUsername = o.innerCnf.DefaultString("smtp::username", "")
+	o.SmtpPassword = o.innerCnf.DefaultString("smtp::password", "")
+
+	o.JailRoot = o.innerCnf.DefaultString("jail::root", "")
+
+	o.SeccompDenySyscalls = o.innerCnf.DefaultStrings("seccomp::deny_syscalls", []string{
+		"ptrace", "mount", "umount2", "pivot_root", "reboot", "kexec_load", "kexec_file_load",
+		"init_module", "finit_module", "delete_module", "swapon", "swapoff", "bpf"})
+	o.SeccompEnforce = o.innerCnf.DefaultBool("seccomp::enforce", false)
+
+	o.AuthAdminToken = o.innerCnf.DefaultString("auth::admin_token", "")
+	o.AuthTokenFile = o.innerCnf.DefaultString("auth::token_file", "")
+	o.ElevationMaxDuration = o.innerCnf.DefaultInt("auth::elevation_max_duration", 3600)
+
+	o.LdapUrl = o.innerCnf.DefaultString("ldap::url", "")
+	o.LdapStartTls = o.innerCnf.DefaultBool("ldap::start_tls", false)
+	o.LdapCaFile = o.innerCnf.DefaultString("ldap::ca_file", "")
+	o.LdapBindDn = o.innerCnf.DefaultString("ldap::bind_dn", "")
+	o.LdapBindPassword = o.innerCnf.DefaultString("ldap::bind_password", "")
+	o.LdapUserDn = o.innerCnf.DefaultString("ldap::user_dn", "")
+	o.LdapBaseDn = o.innerCnf.DefaultString("ldap::base_dn", "")
+	o.LdapUserFilter = o.innerCnf.DefaultString("ldap::user_filter", "(sAMAccountName=%s)")
+	o.LdapGroupAttr = o.innerCnf.DefaultString("ldap::group_attr", "memberOf")
+	o.LdapAdminGroups = o.innerCnf.DefaultStrings("ldap::admin_groups", nil)
+	o.LdapUserGroups = o.innerCnf.DefaultStrings("ldap::user_groups", nil)
+	o.LdapTimeout = o.innerCnf.DefaultInt("ldap::timeout", 10)
+	o.LdapCacheTtl = o.innerCnf.DefaultInt("ldap::cache_ttl", 300)
+
+	o.KerberosKeytab = o.innerCnf.DefaultString("kerberos::keytab", "")
+	o.KerberosService = o.innerCnf.DefaultString("kerberos::service", "")
+	o.KerberosRealms = o.innerCnf.DefaultStrings("kerberos::realms", nil)
+	o.KerberosMaxSkew = o.innerCnf.DefaultInt("kerberos::max_skew", 300)
+
+	o.AdminPprof = o.innerCnf.DefaultBool("admin::pprof", false)
+
+	o.PoolSize = o.innerCnf.DefaultInt("pool::size", 32)
+	o.PoolQueueSize = o.innerCnf.DefaultInt("pool::queue_size", 1000)
+	o.PoolWeights = o.innerCnf.DefaultStrings("pool::weights", nil)
+
+	o.MemoryLimit = o.innerCnf.DefaultInt("memory::limit", 0)
+	o.MemoryRingSize = o.innerCnf.DefaultInt("memory::ring_size", 256)
+	o.MemorySpillDir = o.innerCnf.DefaultString("memory::spill_dir", "../spill")
+
+	o.PeerUrls = o.innerCnf.DefaultStrings("peers::urls", nil)
+	o.PeerToken = o.innerCnf.DefaultString("peers::token", "")
+	o.PeerRefreshInterval = o.innerCnf.DefaultInt("peers::refresh_interval", 60)
+
+	o.BootstrapToken = o.innerCnf.DefaultString("bootstrap::token", "")
+	o.BootstrapDir = o.innerCnf.DefaultString("bootstrap::dir", "../bootstrap")
+
+	o.CertWatchPaths = o.innerCnf.DefaultStrings("cert::watch_paths", nil)
+	o.CertWarnDays = o.innerCnf.DefaultInt("cert::warn_days", 30)
+
+	o.ScheduleDir = o.innerCnf.DefaultString("schedule::dir", "../schedule")
+	o.ScheduleMaxFailures = o.innerCnf.DefaultInt("schedule::max_failures", 5)
+
+	o.WatchInterval = o.innerCnf.DefaultInt("watch::interval", 2)
+
+	o.PolicyUrl = o.innerCnf.DefaultString("policy::url", "")
+	o.PolicyToken = o.innerCnf.DefaultString("policy::token", "")
+	o.PolicyPublicKey = o.innerCnf.DefaultString("policy::public_key", "")
+	o.PolicyDir = o.innerCnf.DefaultString("policy::dir", "../policy")
+	o.PolicyInterval = o.innerCnf.DefaultInt("policy::interval", 300)
+
+	o.ApplyWindow = o.innerCnf.DefaultInt("apply::window", 60)
+	o.ApplyAlertWebhook = o.innerCnf.DefaultString("apply::alert_webhook", "")
+	o.ApplyAlertEmail = o.innerCnf.DefaultString("apply::alert_email", "")
+
+	o.HistoryDir = o.innerCnf.DefaultString("history::dir", "../history")
+	o.HistoryMaxEntries = o.innerCnf.DefaultInt("history::max_entries", 100)
+	o.HistoryMaxOutput = o.innerCnf.DefaultInt("history::max_output", 64)
+
+	o.LibraryDir = o.innerCnf.DefaultString("library::dir", "../library")
+
+	o.GitTimeout = o.innerCnf.DefaultInt("git::timeout", 600)
+
+	o.PtyEnabled = o.innerCnf.DefaultBool("pty::enabled", false)
+	o.PtyShell = strings.Fields(o.osString("pty", "shell", ""))
+	o.PtyIdleTimeout = o.innerCnf.DefaultInt("pty::idle_timeout", 600)
+	o.PtyMaxSessions = o.innerCnf.DefaultInt("pty::max_sessions", 10)
+
+	o.Shares = nil
+	for _, name := range o.innerCnf.DefaultStrings("shares::names", nil) {
+		section := "share_" + name + "::"
+		o.Shares = append(o.Shares, &NetworkShare{
+			Name:     name,
+			Path:     o.innerCnf.DefaultString(section+"path", ""),
+			Username: o.innerCnf.DefaultString(section+"username", ""),
+			Password: o.innerCnf.DefaultString(section+"password", ""),
+		})
+	}
+
+	o.ServiceAccounts = nil
+	for _, name := range o.innerCnf.DefaultStrings("service_accounts::names", nil) {
+		section := "service_account_" + name + "::"
+		o.ServiceAccounts = append(o.ServiceAccounts, &ServiceAccount{
+			Name:   name,
+			Allow:  o.innerCnf.DefaultStrings(section+"allow", nil),
+			RunAs:  o.innerCnf.DefaultStrings(section+"run_as", nil),
+			Owners: o.innerCnf.DefaultStrings(section+"owners", nil),
+		})
+	}
+	o.ServiceAccountRequired = o.innerCnf.DefaultBool("service_accounts::required", false)
+
+	o.Hooks = nil
+	for _, name := range o.innerCnf.DefaultStrings("hooks::names", nil) {
+		section := "hook_" + name + "::"
+		verify := o.innerCnf.DefaultString(section+"verify", HVHmac)
+		header := "X-Hub-Signature-256"
+		if verify == HVToken {
+			header = "X-Gitlab-Token"
+		}
+		o.Hooks = append(o.Hooks, &Hook{
+			Name:           name,
+			Profile:        o.innerCnf.DefaultString(section+"profile", ""),
+			Secret:         o.innerCnf.DefaultString(section+"secret", ""),
+			Verify:         verify,
+			Header:         o.innerCnf.DefaultString(section+"header", header),
+			Events:         o.innerCnf.DefaultStrings(section+"events", nil),
+			EventHeader:    o.innerCnf.DefaultString(section+"event_header", "X-GitHub-Event"),
+			ServiceAccount: o.innerCnf.DefaultString(section+"service_account", ""),
+		})
+	}
+
+	o.CiEnabled = o.innerCnf.DefaultBool("ci::enabled", false)
+	o.CiBuildsDir = o.innerCnf.DefaultString("ci::builds_dir", "../ci/builds")
+	o.CiCacheDir = o.innerCnf.DefaultString("ci::cache_dir", "../ci/cache")
+	o.CiRunAs = o.innerCnf.DefaultString("ci::run_as", "")
+
+	o.SftpEnabled = o.innerCnf.DefaultBool("sftp::enabled", false)
+	o.SftpListen = o.innerCnf.DefaultString("sftp::listen", ":2222")
+	o.SftpHostKey = o.innerCnf.DefaultString("sftp::host_key", "sftp_host_key.pem")
+	o.SftpHome = o.innerCnf.DefaultString("sftp::home", "/")
+	o.SftpTrustedUserCaKeys = o.innerCnf.DefaultString("sftp::trusted_user_ca_keys", "")
+	o.SftpExec = o.innerCnf.DefaultBool("sftp::exec", false)
+
+	o.JanitorInterval = o.innerCnf.DefaultInt("janitor::interval", 60)
+	o.JanitorRules = nil
+	for _, name := range o.innerCnf.DefaultStrings("janitor::rules", nil) {
+		section := "janitor_" + name + "::"
+		o.JanitorRules = append(o.JanitorRules, &JanitorRule{
+			Name:        name,
+			Path:        o.innerCnf.DefaultString(section+"path", ""),
+			Pattern:     o.innerCnf.DefaultString(section+"pattern", "*"),
+			MaxAgeHours: o.innerCnf.DefaultInt(section+"max_age_hours", 0),
+			MaxSizeMB:   o.innerCnf.DefaultInt(section+"max_size_mb", 0),
+		})
+	}
+
 	//listen port
 	o.Addr = o.innerCnf.DefaultString("server::address", ":10080")
+	o.TlsCert = o.innerCnf.DefaultString("server::tls_cert", "")
+	o.TlsKey = o.innerCnf.DefaultString("server::tls_key", "")
+	o.Tags = o.innerCnf.DefaultStrings("agent::tags", nil)
+	o.MaxClockSkew = o.innerCnf.DefaultInt("agent::max_clock_skew", 5)
 
+	o.loadBootstrap()
 	return nil
 }
+
+// Fill the settings pushed by /bootstrap, those of the config file win
+func (o *Config) loadBootstrap() {
+	st, err := readBootstrapState(o.BootstrapDir)
+	if err != nil {
+		log.Errorf("read bootstrap state failed: %s", err)
+		return
+	}
+	if st == nil {
+		return
+	}
+	if o.TlsCert == "" && o.TlsKey == "" {
+		o.TlsCert, o.TlsKey = st.TlsCert, st.TlsKey
+	}
+	if o.AuthTokenFile == "" {
+		o.AuthTokenFile = st.TokenFile
+	}
+	// The tags of both
+	o.Tags = mergeTags(o.Tags, st.Tags)
+}
+
+// Guards Tags, which the bootstrap merges into while the requests are served
+var gTagsMu sync.RWMutex
+
+// The tags of the agent
+func (o *Config) AgentTags() []string {
+	gTagsMu.RLock()
+	defer gTagsMu.RUnlock()
+	return o.Tags
+}
+
+func (o *Config) addTags(tags []string) {
+	gTagsMu.Lock()
+	o.Tags = mergeTags(o.Tags, tags)
+	gTagsMu.Unlock()
+}
+
+// Read section::key, which is overridden by the section of the os, e.g. job_windows::key
+func (o *Config) osString(section, key, def string) string {
+	def = o.innerCnf.DefaultString(section+"::"+key, def)
+	return o.innerCnf.DefaultString(section+"_"+runtime.GOOS+"::"+key, def)
+}
+
+func (o *Config) osStrings(section, key string, def []string) []string {
+	def = o.innerCnf.DefaultStrings(section+"::"+key, def)
+	return o.innerCnf.DefaultStrings(section+"_"+runtime.GOOS+"::"+key, def)
+}
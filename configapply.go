@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A new config is applied blue/green: /admin/config/apply validates it and
+// runs the self check on it, keeps the current file as <cnf>.prev, and
+// restarts the http server with the new one. If the server doesn't come back
+// healthy within the window, the previous file is restored, the server is
+// restarted again with it and an alert is raised. The marker <cnf>.applying
+// lives during the window, so that the previous file is restored at the next
+// start if the agent dies meanwhile.
+
+type ConfigApplyReq struct {
+	Config        string `json:"config"`                   // The content of the new config file
+	WindowSeconds int    `json:"window_seconds,omitempty"` // Default to apply::window
+}
+
+type ConfigApplyStatus string
+
+const (
+	CASApplying ConfigApplyStatus = "applying" // Waiting for the server to come back healthy
+	CASApplied                    = "applied"
+	CASReverted                   = "reverted"
+)
+
+type ConfigApplyState struct {
+	Status   ConfigApplyStatus `json:"status"`
+	By       string            `json:"by,omitempty"`
+	Time     time.Time         `json:"time"`
+	Deadline time.Time         `json:"deadline"`
+	Error    string            `json:"error,omitempty"`    // Why reverted
+	Warnings []string          `json:"warnings,omitempty"` // Of the self check
+}
+
+type ConfigApplier struct {
+	mu    sync.Mutex
+	state *ConfigApplyState
+	// The http server is stopped to run again with the config file
+	restart bool
+}
+
+var (
+	gConfigApplier = &ConfigApplier{}
+)
+
+func prevConfigPath(path string) string     { return path + ".prev" }
+func applyingConfigPath(path string) string { return path + ".applying" }
+
+// Validate the new config, then restart with it. The state is returned at
+// once, the outcome is known by Status().
+func (o *ConfigApplier) Apply(path string, req *ConfigApplyReq, by string) (*ConfigApplyState, error) {
+	if path == "" {
+		return nil, errors.New("the agent runs without a config file")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.state != nil && o.state.Status == CASApplying {
+		return nil, errors.New("a config is being applied")
+	}
+
+	newPath := path + ".new"
+	if err := writeFileAtomic(newPath, []byte(req.Config), 0600); err != nil {
+		return nil, err
+	}
+	defer os.Remove(newPath)
+	cnf := NewConfig()
+	if err := cnf.Load(newPath); err != nil {
+		return nil, fmt.Errorf("invalid config: %s", err)
+	}
+	check := RunSelfCheck(cnf)
+	if err := check.Err(); err != nil {
+		return nil, fmt.Errorf("self check failed: %s", err)
+	}
+
+	window := req.WindowSeconds
+	if window <= 0 {
+		window = gApp.Cnf.ApplyWindow
+	}
+	now := time.Now()
+	st := &ConfigApplyState{Status: CASApplying, By: by, Time: now,
+		Deadline: now.Add(time.Duration(window) * time.Second), Warnings: check.Warnings}
+
+	cur, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeFileAtomic(prevConfigPath(path), cur, 0600); err != nil {
+		return nil, err
+	}
+	b, _ := json.Marshal(st)
+	if err = writeFileAtomic(applyingConfigPath(path), b, 0600); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(newPath, path); err != nil {
+		os.Remove(applyingConfigPath(path))
+		return nil, err
+	}
+	o.state = st
+	log.Warnf("config applying, the server restarts and must be healthy by %s", st.Deadline.Format(time.RFC3339))
+
+	// After the response is sent
+	time.AfterFunc(100*time.Millisecond, func() {
+		o.Restart()
+		o.watch(path, st)
+	})
+	return st.copy(), nil
+}
+
+func (o *ConfigApplyState) copy() *ConfigApplyState {
+	s := *o
+	return &s
+}
+
+// The state of the last apply, nil if none
+func (o *ConfigApplier) Status() *ConfigApplyState {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.state == nil {
+		return nil
+	}
+	return o.state.copy()
+}
+
+// Stop the http server to run it again with the config file
+func (o *ConfigApplier) Restart() {
+	o.mu.Lock()
+	o.restart = true
+	o.mu.Unlock()
+	log.Warn("http server restarting")
+	gHttpServer.Restart()
+}
+
+// Called when the http server returns, whether to run it again. An error
+// while applying reverts the config.
+func (o *ConfigApplier) restarting(err error) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.restart {
+		o.restart = false
+		return true
+	}
+	if err != nil && o.state != nil && o.state.Status == CASApplying {
+		o.revertLocked(gApp.cnfPath, err.Error())
+		return true
+	}
+	return false
+}
+
+// Revert the config if the server isn't healthy by the deadline
+func (o *ConfigApplier) watch(path string, st *ConfigApplyState) {
+	err := waitHealthy(st.Deadline)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.state != st || st.Status != CASApplying {
+		return
+	}
+	if err == nil {
+		st.Status = CASApplied
+		os.Remove(applyingConfigPath(path))
+		log.Infof("audit: config applied by %s", st.By)
+		return
+	}
+	o.revertLocked(path, "not healthy in time: "+err.Error())
+	go o.Restart()
+}
+
+// Restore the previous config file and raise the alert, called with mu held
+func (o *ConfigApplier) revertLocked(path, reason string) {
+	if o.state == nil {
+		o.state = &ConfigApplyState{Time: time.Now()}
+	}
+	o.state.Status, o.state.Error = CASReverted, reason
+	b, err := ioutil.ReadFile(prevConfigPath(path))
+	if err == nil {
+		err = writeFileAtomic(path, b, 0600)
+	}
+	if err != nil {
+		log.Errorf("restore config from %s failed: %s", prevConfigPath(path), err)
+	}
+	os.Remove(applyingConfigPath(path))
+	st := o.state.copy()
+	go raiseAlert("config apply", "config reverted: "+reason, st)
+}
+
+// Revert the config applied when the agent stopped, called at startup before
+// the config is loaded. True if reverted, alert() is called once the config
+// is loaded.
+func (o *ConfigApplier) recover(path string) bool {
+	b, err := ioutil.ReadFile(applyingConfigPath(path))
+	if err != nil {
+		return false
+	}
+	var st ConfigApplyState
+	json.Unmarshal(b, &st)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.state = &st
+	o.state.Status, o.state.Error = CASReverted, "the agent stopped while applying"
+	b, err = ioutil.ReadFile(prevConfigPath(path))
+	if err == nil {
+		err = writeFileAtomic(path, b, 0600)
+	}
+	os.Remove(applyingConfigPath(path))
+	if err != nil {
+		o.state.Error += ", restore failed: " + err.Error()
+	}
+	return true
+}
+
+func (o *ConfigApplier) alert() {
+	if st := o.Status(); st != nil {
+		raiseAlert("config apply", "config reverted: "+st.Error, st)
+	}
+}
+
+// Probe the http server every second until it is serving, an error if it
+// isn't by the deadline
+func waitHealthy(deadline time.Time) error {
+	err := errors.New("not probed")
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		if err = probeServer(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Whether the http server of the agent answers, the answers other than the
+// server errors count, e.g. 401
+func probeServer() error {
+	host, port, err := net.SplitHostPort(gApp.Cnf.Addr)
+	if err != nil {
+		return err
+	}
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	scheme := "http"
+	if gApp.Cnf.TlsCert != "" {
+		scheme = "https"
+	}
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		// The certificate is the agent's own, not issued for the loopback
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	resp, err := client.Get(scheme + "://" + net.JoinHostPort(host, port) + apiUrlPrefix + "/version")
+	if err != nil {
+		return err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("unexpected http status: %s", resp.Status)
+	}
+	return nil
+}
+
+// Tell an apply reverted to the log, the event log, apply::alert_webhook and
+// apply::alert_email
+func raiseAlert(what, msg string, v interface{}) {
+	log.Errorf("alert of %s: %s", what, msg)
+	ReportErrorEvent(EventApplyReverted, msg)
+	if gApp.Cnf.ApplyAlertWebhook != "" {
+		go postWebhook(gApp.Cnf.ApplyAlertWebhook, what, v)
+	}
+	if gApp.Cnf.ApplyAlertEmail != "" && gApp.Cnf.SmtpAddr != "" {
+		host, _ := os.Hostname()
+		b, _ := json.MarshalIndent(v, "", "  ")
+		go sendEmail(gApp.Cnf.ApplyAlertEmail, what, msg, fmt.Sprintf("Host: %s\r\n\r\n%s\r\n",
+			host, strings.Replace(string(b), "\n", "\r\n", -1)))
+	}
+}
+
+// Handler to apply a new config file
+func ApplyConfigHandler(w http.ResponseWriter, r *http.Request) {
+	var req ConfigApplyReq
+	if !parseJSONBody(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Config) == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param config is required"))
+		return
+	}
+	by := tokenTenant(RequestToken(r))
+	st, err := gConfigApplier.Apply(gApp.cnfPath, &req, by)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	log.Infof("audit: config applying by %s, window until %s", by, st.Deadline.Format(time.RFC3339))
+	ServeJSON(w, NewResponse().SetData(st))
+}
+
+// Handler showing the state of the last apply
+func ApplyConfigStatusHandler(w http.ResponseWriter, r *http.Request) {
+	ServeJSON(w, NewResponse().SetData(gConfigApplier.Status()))
+}
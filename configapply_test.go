@@ -0,0 +1,54 @@
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The jobs run on and are found across a restart by a config apply
+func TestRestartKeepsJobs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	setupJobs(t)
+	gApp.Cnf.ScheduleDir = t.TempDir()
+	gApp.Cnf.PoolSize, gApp.Cnf.PoolQueueSize = 2, 10
+	if err := InitJobPool(); err != nil {
+		t.Fatal(err)
+	}
+	defer gJobPool.Close()
+	job, err := startJob(&RunCmdReq{Cmd: "echo ready; sleep 30"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitOutput(t, job, "ready")
+	bookkeeper, pool, guard, delayed := gJobBookkeeper, gJobPool, gMemoryGuard, gDelayedJobs
+
+	atomic.StoreInt32(&gHttpServer.restarting, 1)
+	defer atomic.StoreInt32(&gHttpServer.restarting, 0)
+	UninitDelayedJobs()
+	UninitJobPool()
+	UninitMemoryGuard()
+	UninitCmdHandler()
+	for _, f := range []func() error{InitCmdHandler, InitMemoryGuard, InitJobPool, InitDelayedJobs} {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gJobBookkeeper != bookkeeper || gJobPool != pool || gMemoryGuard != guard || gDelayedJobs != delayed {
+		t.Fatal("job state replaced")
+	}
+	if gJobBookkeeper.Get(job.Id) != job || job.Finished() {
+		t.Fatalf("job lost, status %s", job.CurrentStatus())
+	}
+	if _, err := cancelJob(job.Id, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-job.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("job not canceled")
+	}
+}
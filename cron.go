@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A cron expression of the standard five fields, minute hour day-of-month
+// month day-of-week, or one of the macros @yearly, @monthly, @weekly, @daily
+// and @hourly. The fields take *, lists, ranges, steps and the names of the
+// months and the weekdays. Like vixie cron, when both the day of month and
+// the day of week are restricted, a day matching either runs. A time skipped
+// by daylight saving time doesn't run that day, and a time repeated runs
+// once, but for the schedules of every hour.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+	loc                           *time.Location
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronFields = []cronField{
+		{name: "minute", min: 0, max: 59},
+		{name: "hour", min: 0, max: 23},
+		{name: "day of month", min: 1, max: 31},
+		{name: "month", min: 1, max: 12, names: map[string]int{
+			"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+			"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+		}},
+		// 7 is sunday as well
+		{name: "day of week", min: 0, max: 7, names: map[string]int{
+			"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+		}},
+	}
+
+	cronMacros = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// Parse the expression, the run times are in the location, local if nil
+func ParseCron(spec string, loc *time.Location) (*CronSchedule, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@") {
+		m, ok := cronMacros[strings.ToLower(spec)]
+		if !ok {
+			return nil, fmt.Errorf("unknown macro %q", spec)
+		}
+		spec = m
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("expect 5 fields: minute hour day-of-month month day-of-week, got %d", len(fields))
+	}
+
+	var bits [5]uint64
+	for i, f := range cronFields {
+		var err error
+		if bits[i], err = parseCronField(fields[i], f); err != nil {
+			return nil, err
+		}
+	}
+	o := &CronSchedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: fields[2] == "*" || fields[2] == "?",
+		dowStar: fields[4] == "*" || fields[4] == "?",
+		loc:     loc,
+	}
+	if o.dow&(1<<7) != 0 {
+		o.dow |= 1
+	}
+	return o, nil
+}
+
+func parseCronField(s string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		expr, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("%s: invalid step in %q", f.name, part)
+			}
+			expr, step = part[:i], n
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case expr == "*" || expr == "?":
+		case strings.Contains(expr, "-"):
+			i := strings.Index(expr, "-")
+			var err error
+			if lo, err = f.value(expr[:i]); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(expr[i+1:]); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("%s: range %q is reversed", f.name, expr)
+			}
+		default:
+			var err error
+			if lo, err = f.value(expr); err != nil {
+				return 0, err
+			}
+			// a/step runs from a to the end
+			if step == 1 {
+				hi = lo
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (o cronField) value(s string) (int, error) {
+	if v, ok := o.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid value %q", o.name, s)
+	}
+	if v < o.min || v > o.max {
+		return 0, fmt.Errorf("%s: %d is out of %d-%d", o.name, v, o.min, o.max)
+	}
+	return v, nil
+}
+
+func (o *CronSchedule) Location() *time.Location {
+	return o.loc
+}
+
+const cronEveryHour = 1<<24 - 1
+
+// The first run time after t, zero if none within 5 years, e.g. feb 30
+func (o *CronSchedule) Next(t time.Time) time.Time {
+	loc := o.loc
+	t = t.In(loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + 5
+
+wrap:
+	if t.Year() > limit {
+		return time.Time{}
+	}
+	for o.month&(1<<uint(t.Month())) == 0 {
+		year := t.Year()
+		t = cronDate(t.Year(), t.Month()+1, 1, 0, loc)
+		if t.Year() != year {
+			goto wrap
+		}
+	}
+	for !o.dayMatches(t) {
+		month := t.Month()
+		t = cronDate(t.Year(), t.Month(), t.Day()+1, 0, loc)
+		if t.Month() != month {
+			goto wrap
+		}
+	}
+	for o.hour&(1<<uint(t.Hour())) == 0 {
+		day := t.Day()
+		t = cronDate(t.Year(), t.Month(), t.Day(), t.Hour()+1, loc)
+		if t.Day() != day {
+			goto wrap
+		}
+	}
+	for o.minute&(1<<uint(t.Minute())) == 0 {
+		t = t.Add(time.Minute)
+		if t.Minute() == 0 {
+			goto wrap
+		}
+	}
+	// The second pass of a repeated hour, time.Date gives the first
+	if o.hour != cronEveryHour && !time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc).Equal(t) {
+		t = t.Add(time.Minute)
+		goto wrap
+	}
+	return t
+}
+
+// The start of the hour on the wall clock of loc. When the clock skips it
+// by daylight saving time, time.Date gives a time before it, and the first
+// time after it is taken instead.
+func cronDate(year int, month time.Month, day, hour int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, hour, 0, 0, 0, loc)
+	wall := time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+	if got := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC); got.Before(wall) {
+		t = t.Add(wall.Sub(got))
+	}
+	return t
+}
+
+func (o *CronSchedule) dayMatches(t time.Time) bool {
+	dom := o.dom&(1<<uint(t.Day())) != 0
+	dow := o.dow&(1<<uint(t.Weekday())) != 0
+	if o.domStar || o.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// The next n run times after t
+func (o *CronSchedule) NextN(t time.Time, n int) []time.Time {
+	res := []time.Time{}
+	for i := 0; i < n; i++ {
+		if t = o.Next(t); t.IsZero() {
+			break
+		}
+		res = append(res, t)
+	}
+	return res
+}
+
+// Parse the expression in the named timezone, local if empty
+func parseCronIn(spec, tz string) (*CronSchedule, error) {
+	loc := time.Local
+	if tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return nil, errors.New("invalid timezone: " + tz)
+		}
+	}
+	sch, err := ParseCron(spec, loc)
+	if err != nil {
+		return nil, errors.New("invalid cron: " + err.Error())
+	}
+	return sch, nil
+}
+
+type SchedulePreviewRes struct {
+	Cron     string      `json:"cron"`
+	Timezone string      `json:"timezone"`
+	Next     []time.Time `json:"next"`
+}
+
+// Handler to validate a cron expression and preview its next n run times, so
+// a misconfigured schedule shows up before it silently never runs.
+func SchedulePreviewHandler(w http.ResponseWriter, r *http.Request) {
+	spec := strings.TrimSpace(r.FormValue("cron"))
+	if spec == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param cron is empty"))
+		return
+	}
+	n := 5
+	if s := r.FormValue("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n <= 0 || n > 100 {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid param n, expect 1-100: "+s))
+			return
+		}
+	}
+	sch, err := parseCronIn(spec, r.FormValue("tz"))
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	next := sch.NextN(time.Now(), n)
+	if len(next) == 0 {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid cron: it never runs"))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(&SchedulePreviewRes{
+		Cron:     spec,
+		Timezone: sch.Location().String(),
+		Next:     next,
+	}))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	saoPaulo, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, c := range []struct {
+		spec string
+		loc  *time.Location
+		from string
+		want []string
+	}{
+		{"*/15 * * * *", time.UTC, "2021-01-01T00:07:30Z", []string{"2021-01-01T00:15:00Z", "2021-01-01T00:30:00Z"}},
+		// The months of 31 days only
+		{"0 0 31 * *", time.UTC, "2021-01-31T00:00:00Z", []string{"2021-03-31T00:00:00Z", "2021-05-31T00:00:00Z"}},
+		{"0 0 29 feb *", time.UTC, "2021-01-01T00:00:00Z", []string{"2024-02-29T00:00:00Z", "2028-02-29T00:00:00Z"}},
+		{"0 0 30 2 *", time.UTC, "2021-01-01T00:00:00Z", nil},
+		{"30 23 31 12 *", time.UTC, "2021-12-31T23:30:00Z", []string{"2022-12-31T23:30:00Z"}},
+		{"@monthly", time.UTC, "2021-12-15T10:00:00Z", []string{"2022-01-01T00:00:00Z", "2022-02-01T00:00:00Z"}},
+		// Either the day of month or the day of week, 7 is sunday
+		{"0 9 15 * mon", time.UTC, "2021-03-01T09:00:00Z", []string{"2021-03-08T09:00:00Z", "2021-03-15T09:00:00Z", "2021-03-22T09:00:00Z"}},
+		{"0 0 * * 7", time.UTC, "2021-03-01T00:00:00Z", []string{"2021-03-07T00:00:00Z"}},
+		// 02:30 is skipped when daylight saving time starts
+		{"30 2 * * *", newYork, "2021-03-13T12:00:00-05:00", []string{"2021-03-15T02:30:00-04:00"}},
+		{"*/30 * * * *", newYork, "2021-03-14T01:00:00-05:00", []string{"2021-03-14T01:30:00-05:00", "2021-03-14T03:00:00-04:00"}},
+		// 01:30 is repeated when it ends, an hourly schedule runs in both
+		{"30 1 * * *", newYork, "2021-11-06T12:00:00-04:00", []string{"2021-11-07T01:30:00-04:00", "2021-11-08T01:30:00-05:00"}},
+		{"0 * * * *", newYork, "2021-11-07T00:30:00-04:00", []string{"2021-11-07T01:00:00-04:00", "2021-11-07T01:00:00-05:00", "2021-11-07T02:00:00-05:00"}},
+		// Midnight is skipped
+		{"0 0 * * *", saoPaulo, "2018-11-03T12:00:00-03:00", []string{"2018-11-05T00:00:00-02:00"}},
+		{"0 1 4 11 *", saoPaulo, "2018-11-03T12:00:00-03:00", []string{"2018-11-04T01:00:00-02:00", "2019-11-04T01:00:00-03:00"}},
+	} {
+		sch, err := ParseCron(c.spec, c.loc)
+		if err != nil {
+			t.Fatalf("%s: %s", c.spec, err)
+		}
+		from, err := time.Parse(time.RFC3339, c.from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// One at least, none of a time which never comes
+		n := len(c.want)
+		if n == 0 {
+			n = 1
+		}
+		var got []string
+		for _, next := range sch.NextN(from, n) {
+			got = append(got, next.Format(time.RFC3339))
+		}
+		if strings.Join(got, " ") != strings.Join(c.want, " ") {
+			t.Errorf("%s from %s: got %v, want %v", c.spec, c.from, got, c.want)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8",
+		"5-1 * * * *", "*/0 * * * *", "* * * foo *", "@reboot"} {
+		if _, err := ParseCron(spec, time.UTC); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// /cmd/diff compares two jobs, e.g. the same cmd on two hosts or on two
+// days: the metadata fields which differ, and the line diff of the outputs.
+// A job forwarded to a peer is fetched from the peer. The outputs are
+// compared by the longest common subsequence of the lines, too large ones
+// are shown as replaced wholly.
+
+type JobDiff struct {
+	A      string        `json:"a"`
+	B      string        `json:"b"`
+	Equal  bool          `json:"equal"`
+	Fields []*FieldDiff  `json:"fields,omitempty"` // Only the differing ones
+	Stdout *OutputDiff   `json:"stdout"`
+	Stderr *OutputDiff   `json:"stderr"`
+	text   []*diffedText // The sections of the unified diff
+}
+
+type FieldDiff struct {
+	Name string      `json:"name"`
+	A    interface{} `json:"a"`
+	B    interface{} `json:"b"`
+}
+
+type OutputDiff struct {
+	Equal   bool        `json:"equal"`
+	Added   int         `json:"added"`   // Lines
+	Removed int         `json:"removed"` // Lines
+	Hunks   []*DiffHunk `json:"hunks,omitempty"`
+}
+
+// Lines of the hunk start with " ", "-" or "+", the starts count from 1
+type DiffHunk struct {
+	AStart int      `json:"a_start"`
+	ALines int      `json:"a_lines"`
+	BStart int      `json:"b_start"`
+	BLines int      `json:"b_lines"`
+	Lines  []string `json:"lines"`
+}
+
+type diffedText struct {
+	name  string
+	hunks []*DiffHunk
+}
+
+const (
+	diffContext = 3
+	// Cells of the lcs table, beyond which the outputs are replaced wholly
+	diffMaxCells = 1 << 22
+)
+
+// The metadata compared, in the order shown
+func diffFields(job *Job) [][2]interface{} {
+	return [][2]interface{}{
+		{"cmd", job.Cmd},
+		{"script", job.Script},
+		{"run_as", job.RunAs},
+		{"tenant", job.Tenant},
+		{"dir", job.Dir},
+		{"env", job.Env},
+		{"env_pass", job.EnvPass},
+		{"status", job.Status},
+		{"exit_code", job.ExitCode},
+		{"signal", job.Signal},
+		{"error", job.Error},
+		{"unmet_condition", job.Unmet},
+	}
+}
+
+func diffJobs(a, b *Job) *JobDiff {
+	res := &JobDiff{A: a.Id, B: b.Id}
+	fa, fb := diffFields(a), diffFields(b)
+	var la, lb []string
+	for i := range fa {
+		ja, _ := json.Marshal(fa[i][1])
+		jb, _ := json.Marshal(fb[i][1])
+		name := fa[i][0].(string)
+		la = append(la, name+": "+string(ja))
+		lb = append(lb, name+": "+string(jb))
+		if !bytes.Equal(ja, jb) {
+			res.Fields = append(res.Fields, &FieldDiff{Name: name, A: fa[i][1], B: fb[i][1]})
+		}
+	}
+	res.text = append(res.text, &diffedText{name: "job", hunks: diffLines(la, lb).Hunks})
+	res.Stdout = diffLines(splitLines(a.Stdout), splitLines(b.Stdout))
+	res.Stderr = diffLines(splitLines(a.Stderr), splitLines(b.Stderr))
+	res.text = append(res.text, &diffedText{"stdout", res.Stdout.Hunks}, &diffedText{"stderr", res.Stderr.Hunks})
+	res.Equal = len(res.Fields) == 0 && res.Stdout.Equal && res.Stderr.Equal
+	return res
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+func diffLines(a, b []string) *OutputDiff {
+	// The common prefix and suffix are kept out of the table
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	var ops []diffOp
+	for _, l := range a[:pre] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	ops = append(ops, lcsOps(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+	for _, l := range a[len(a)-suf:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+
+	res := &OutputDiff{}
+	for _, op := range ops {
+		switch op.kind {
+		case '+':
+			res.Added++
+		case '-':
+			res.Removed++
+		}
+	}
+	res.Equal = res.Added == 0 && res.Removed == 0
+	res.Hunks = diffHunks(ops)
+	return res
+}
+
+// The edits of a to b by the longest common subsequence
+func lcsOps(a, b []string) []diffOp {
+	var ops []diffOp
+	n, m := len(a), len(b)
+	if (n+1)*(m+1) > diffMaxCells {
+		for _, l := range a {
+			ops = append(ops, diffOp{'-', l})
+		}
+		for _, l := range b {
+			ops = append(ops, diffOp{'+', l})
+		}
+		return ops
+	}
+	// lcs[i][j] of a[i:] and b[j:]
+	w := m + 1
+	lcs := make([]int32, (n+1)*w)
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i*w+j] = lcs[(i+1)*w+j+1] + 1
+			} else if lcs[(i+1)*w+j] >= lcs[i*w+j+1] {
+				lcs[i*w+j] = lcs[(i+1)*w+j]
+			} else {
+				lcs[i*w+j] = lcs[i*w+j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[(i+1)*w+j] >= lcs[i*w+j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < m; j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
+
+// Group the edits into hunks with diffContext lines of context around,
+// hunks whose contexts touch are merged
+func diffHunks(ops []diffOp) []*DiffHunk {
+	// Lines of a and b before ops[k]
+	ai, bi := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for k, op := range ops {
+		ai[k+1], bi[k+1] = ai[k], bi[k]
+		if op.kind != '+' {
+			ai[k+1]++
+		}
+		if op.kind != '-' {
+			bi[k+1]++
+		}
+	}
+	var hunks []*DiffHunk
+	for k := 0; k < len(ops); k++ {
+		if ops[k].kind == ' ' {
+			continue
+		}
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		// Extend over the edits within the context
+		end := k + 1
+		for e := k + 1; e < len(ops) && e <= end+2*diffContext; e++ {
+			if ops[e].kind != ' ' {
+				end = e + 1
+			}
+		}
+		k = end - 1
+		if end += diffContext; end > len(ops) {
+			end = len(ops)
+		}
+		h := &DiffHunk{
+			AStart: ai[start] + 1,
+			ALines: ai[end] - ai[start],
+			BStart: bi[start] + 1,
+			BLines: bi[end] - bi[start],
+		}
+		for _, op := range ops[start:end] {
+			h.Lines = append(h.Lines, string(op.kind)+op.line)
+		}
+		hunks = append(hunks, h)
+	}
+	return hunks
+}
+
+// Render as a unified diff, a section for the metadata and each output
+func (o *JobDiff) Unified() string {
+	var buf bytes.Buffer
+	for _, t := range o.text {
+		if len(t.hunks) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "--- a/%s/%s\n+++ b/%s/%s\n", o.A, t.name, o.B, t.name)
+		for _, h := range t.hunks {
+			fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(h.AStart, h.ALines), hunkRange(h.BStart, h.BLines))
+			for _, l := range h.Lines {
+				buf.WriteString(l)
+				buf.WriteByte('\n')
+			}
+		}
+	}
+	return buf.String()
+}
+
+// The range of a hunk header, an empty range starts at the line before
+func hunkRange(start, lines int) string {
+	if lines == 0 {
+		return fmt.Sprintf("%d,0", start-1)
+	}
+	if lines == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, lines)
+}
+
+// The job with its output, fetched from the peer if forwarded
+func diffedJob(ctx context.Context, id string, tok *Token) (*Job, ErrorCode, error) {
+	if job := managedJob(id, tok); job != nil {
+		return job.Snapshot(), ECSuccess, nil
+	}
+	if gPeerRegistry != nil {
+		if f := gPeerRegistry.Forwarded(id); f != nil && (tok == nil || tok.Admin || f.tenant == tok.Name) {
+			peer := f.peer
+			var job Job
+			resp := Response{Data: &job}
+			err := gPeerRegistry.call(ctx, http.MethodGet, peer+apiUrlPrefix+"/cmd/query?id="+url.QueryEscape(id), nil, tok, &resp)
+			if err == nil && resp.Errno != ECSuccess {
+				err = errors.New(resp.Error)
+			}
+			if err != nil {
+				return nil, ECPeerFailed, fmt.Errorf("fetch job %s from peer %s failed: %s", id, peer, err)
+			}
+			return &job, ECSuccess, nil
+		}
+	}
+	return nil, ECJobNotFound, errors.New("job not found: " + id)
+}
+
+// Handler to compare two jobs, as json, or as a unified diff with
+// format=unified
+func DiffCmdHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if format != "" && format != "json" && format != "unified" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid param format: "+format))
+		return
+	}
+	var jobs [2]*Job
+	for i, p := range []string{"a", "b"} {
+		id := strings.TrimSpace(r.FormValue(p))
+		if id == "" {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param "+p+" is empty"))
+			return
+		}
+		job, errno, err := diffedJob(r.Context(), id, RequestToken(r))
+		if err != nil {
+			ServeJSON(w, NewResponse().SetError(errno, err.Error()))
+			return
+		}
+		jobs[i] = job
+	}
+	res := diffJobs(jobs[0], jobs[1])
+	if format == "unified" {
+		w.Header().Set(ContentType, "text/x-diff; charset=utf-8")
+		w.Write([]byte(res.Unified()))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(res))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	for _, c := range []struct {
+		a, b           string
+		added, removed int
+		hunks          string // The ranges of each hunk and its lines joined by |
+	}{
+		{"a\nb\n", "a\nb\n", 0, 0, ""},
+		{"", "", 0, 0, ""},
+		{"", "a\n", 1, 0, "-0,0 +1 +a"},
+		{"a\n", "", 0, 1, "-1 +0,0 -a"},
+		{"a\nb\nc\n", "a\nx\nc\n", 1, 1, "-1,3 +1,3  a|-b|+x| c"},
+		// The context is 3 lines around
+		{"1\n2\n3\n4\n5\n6\n7\n8\n", "1\n2\n3\n4\n5\n6\n7\n8\n9\n", 1, 0, "-6,3 +6,4  6| 7| 8|+9"},
+		// Hunks whose contexts touch are merged, the others are not
+		{"a\n1\n2\n3\n4\n5\n6\nb\n", "A\n1\n2\n3\n4\n5\n6\nB\n", 2, 2, "-1,8 +1,8 -a|+A| 1| 2| 3| 4| 5| 6|-b|+B"},
+		{"a\n1\n2\n3\n4\n5\n6\n7\nb\n", "A\n1\n2\n3\n4\n5\n6\n7\nB\n", 2, 2, "-1,4 +1,4 -a|+A| 1| 2| 3, -6,4 +6,4  5| 6| 7|-b|+B"},
+		// By the longest common subsequence
+		{"x\na\nb\nc\n", "a\nb\nc\nx\n", 1, 1, "-1,4 +1,4 -x| a| b| c|+x"},
+	} {
+		d := diffLines(splitLines(c.a), splitLines(c.b))
+		var hunks []string
+		for _, h := range d.Hunks {
+			hunks = append(hunks, fmt.Sprintf("-%s +%s %s", hunkRange(h.AStart, h.ALines), hunkRange(h.BStart, h.BLines), strings.Join(h.Lines, "|")))
+		}
+		got := strings.Join(hunks, ", ")
+		if d.Added != c.added || d.Removed != c.removed || d.Equal != (c.added+c.removed == 0) || got != c.hunks {
+			t.Errorf("%q to %q: got +%d -%d %s", c.a, c.b, d.Added, d.Removed, got)
+		}
+	}
+}
+
+func TestDiffJobs(t *testing.T) {
+	a := &Job{Id: "a", Cmd: "uptime", Status: JSFinished, Stdout: "load 1\nusers 2\n"}
+	b := &Job{Id: "b", Cmd: "uptime", Status: JSFailed, ExitCode: 1, Stdout: "load 3\nusers 2\n"}
+	d := diffJobs(a, b)
+	if d.Equal || len(d.Fields) != 2 || d.Fields[0].Name != "status" || d.Fields[1].Name != "exit_code" || !d.Stderr.Equal {
+		t.Fatalf("got %+v", d)
+	}
+	want := `--- a/a/job
++++ b/b/job
+@@ -5,8 +5,8 @@
+ dir: ""
+ env: null
+ env_pass: null
+-status: "finished"
+-exit_code: 0
++status: "failed"
++exit_code: 1
+ signal: ""
+ error: ""
+ unmet_condition: null
+--- a/a/stdout
++++ b/b/stdout
+@@ -1,2 +1,2 @@
+-load 1
++load 3
+ users 2
+`
+	if got := d.Unified(); got != want {
+		t.Fatalf("got\n%s", got)
+	}
+	if d := diffJobs(a, a); !d.Equal || d.Unified() != "" {
+		t.Fatalf("got %+v", d)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Disks, partitions and mounted filesystems of the host, read from /sys and
+// /proc on linux, the win32 api and the storage cmdlets on windows. The SMART
+// summary needs smartctl of smartmontools.
+
+type DiskInfo struct {
+	Name       string           `json:"name"`
+	Device     string           `json:"device"` // Also the device of smartctl
+	Model      string           `json:"model,omitempty"`
+	Serial     string           `json:"serial,omitempty"`
+	Size       uint64           `json:"size"`
+	Rotational bool             `json:"rotational,omitempty"` // Linux only
+	Removable  bool             `json:"removable,omitempty"`
+	Health     string           `json:"health,omitempty"` // Windows only, e.g. Healthy
+	Partitions []*PartitionInfo `json:"partitions"`
+	Smart      *SmartInfo       `json:"smart,omitempty"`
+}
+
+type PartitionInfo struct {
+	Name        string   `json:"name"`
+	Device      string   `json:"device"`
+	Size        uint64   `json:"size"`
+	Mountpoints []string `json:"mountpoints,omitempty"`
+}
+
+type MountInfo struct {
+	Device      string  `json:"device"`
+	Mountpoint  string  `json:"mountpoint"`
+	Fstype      string  `json:"fstype"`
+	Label       string  `json:"label,omitempty"` // Windows only
+	ReadOnly    bool    `json:"read_only,omitempty"`
+	Total       uint64  `json:"total"`
+	Used        uint64  `json:"used"`
+	Free        uint64  `json:"free"`
+	Avail       uint64  `json:"avail"`        // Free to unprivileged users
+	UsedPercent float64 `json:"used_percent"` // Of the space usable by unprivileged users, like df
+	Inodes      uint64  `json:"inodes,omitempty"`
+	InodesFree  uint64  `json:"inodes_free,omitempty"`
+	Error       string  `json:"error,omitempty"` // Why the usage can't be read, e.g. a hung nfs
+}
+
+type SmartInfo struct {
+	Passed       *bool  `json:"passed,omitempty"`      // Nil if unknown
+	Temperature  int    `json:"temperature,omitempty"` // Celsius
+	PowerOnHours int    `json:"power_on_hours,omitempty"`
+	Error        string `json:"error,omitempty"` // Why the summary can't be read
+}
+
+func (o *MountInfo) setUsage(total, free, avail uint64) {
+	o.Total, o.Free, o.Avail = total, free, avail
+	o.Used = total - free
+	if o.Used+avail > 0 {
+		o.UsedPercent = float64(int(float64(o.Used)/float64(o.Used+avail)*10000)) / 100
+	}
+}
+
+// The SMART summary of the device by smartctl
+func smartInfo(device string) *SmartInfo {
+	if _, err := exec.LookPath("smartctl"); err != nil {
+		return &SmartInfo{Error: "smartctl not found, install smartmontools"}
+	}
+	// The exit status of smartctl is a bitmask of the problems found, the
+	// output is read anyway
+	out, err := exec.Command("smartctl", "-j", "-H", "-A", device).Output()
+	var res struct {
+		Smartctl struct {
+			Messages []struct {
+				String string `json:"string"`
+			} `json:"messages"`
+		} `json:"smartctl"`
+		SmartStatus *struct {
+			Passed bool `json:"passed"`
+		} `json:"smart_status"`
+		Temperature struct {
+			Current int `json:"current"`
+		} `json:"temperature"`
+		PowerOnTime struct {
+			Hours int `json:"hours"`
+		} `json:"power_on_time"`
+	}
+	if jerr := json.Unmarshal(out, &res); jerr != nil {
+		if err == nil {
+			err = jerr
+		}
+		return &SmartInfo{Error: "smartctl: " + err.Error()}
+	}
+	if res.SmartStatus == nil {
+		msg := "no SMART status"
+		if len(res.Smartctl.Messages) > 0 {
+			msg = res.Smartctl.Messages[0].String
+		}
+		return &SmartInfo{Error: msg}
+	}
+	return &SmartInfo{
+		Passed:       &res.SmartStatus.Passed,
+		Temperature:  res.Temperature.Current,
+		PowerOnHours: res.PowerOnTime.Hours,
+	}
+}
+
+// Handler to list the disks and their partitions, with the SMART summaries
+// if smart is set
+func ListDiskHandler(w http.ResponseWriter, r *http.Request) {
+	disks, err := listDisks()
+	if err != nil {
+		log.Errorf("list disks failed: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	if smart, _ := strconv.ParseBool(r.FormValue("smart")); smart {
+		for _, d := range disks {
+			d.Smart = smartInfo(d.Device)
+		}
+	}
+	ServeJSON(w, NewResponse().SetData(disks))
+}
+
+// Handler to list the mounted filesystems and their usage, the pseudo ones of
+// no size like proc are included only if all is set
+func ListMountHandler(w http.ResponseWriter, r *http.Request) {
+	mounts, err := listMounts()
+	if err != nil {
+		log.Errorf("list mounts failed: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	if all, _ := strconv.ParseBool(r.FormValue("all")); !all {
+		sized := []*MountInfo{}
+		for _, m := range mounts {
+			if m.Total > 0 || m.Error != "" {
+				sized = append(sized, m)
+			}
+		}
+		mounts = sized
+	}
+	ServeJSON(w, NewResponse().SetData(mounts))
+}
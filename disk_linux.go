@@ -0,0 +1,157 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The block devices which aren't disks
+var diskSkipPrefixes = []string{"loop", "ram", "zram", "dm-", "md", "sr", "nbd"}
+
+func sysBlockValue(path string) string {
+	b, _ := ioutil.ReadFile(path)
+	return strings.TrimSpace(string(b))
+}
+
+// Bytes of the device of the sysfs dir, its size is in 512-byte sectors
+func sysBlockSize(dir string) uint64 {
+	n, _ := strconv.ParseUint(sysBlockValue(filepath.Join(dir, "size")), 10, 64)
+	return n * 512
+}
+
+func listDisks() ([]*DiskInfo, error) {
+	mounts, err := listMounts()
+	if err != nil {
+		return nil, err
+	}
+	mountpoints := map[string][]string{}
+	for _, m := range mounts {
+		mountpoints[m.Device] = append(mountpoints[m.Device], m.Mountpoint)
+	}
+
+	entries, err := ioutil.ReadDir("/sys/block")
+	if err != nil {
+		return nil, err
+	}
+	res := []*DiskInfo{}
+	for _, e := range entries {
+		name := e.Name()
+		skip := false
+		for _, p := range diskSkipPrefixes {
+			skip = skip || strings.HasPrefix(name, p)
+		}
+		dir := filepath.Join("/sys/block", name)
+		if skip || sysBlockSize(dir) == 0 {
+			continue
+		}
+		d := &DiskInfo{
+			Name:       name,
+			Device:     "/dev/" + name,
+			Model:      sysBlockValue(filepath.Join(dir, "device/model")),
+			Serial:     sysBlockValue(filepath.Join(dir, "device/serial")),
+			Size:       sysBlockSize(dir),
+			Rotational: sysBlockValue(filepath.Join(dir, "queue/rotational")) == "1",
+			Removable:  sysBlockValue(filepath.Join(dir, "removable")) == "1",
+			Partitions: []*PartitionInfo{},
+		}
+		if d.Serial == "" {
+			d.Serial = sysBlockValue(filepath.Join(dir, "serial"))
+		}
+		parts, _ := filepath.Glob(filepath.Join(dir, name+"*", "partition"))
+		for _, p := range parts {
+			pdir := filepath.Dir(p)
+			pname := filepath.Base(pdir)
+			d.Partitions = append(d.Partitions, &PartitionInfo{
+				Name:        pname,
+				Device:      "/dev/" + pname,
+				Size:        sysBlockSize(pdir),
+				Mountpoints: mountpoints["/dev/"+pname],
+			})
+		}
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+// The octal escapes of the spaces, tabs and so on in /proc/self/mounts
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func listMounts() ([]*MountInfo, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := []*MountInfo{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		m := &MountInfo{
+			Device:     unescapeMountField(fields[0]),
+			Mountpoint: unescapeMountField(fields[1]),
+			Fstype:     fields[2],
+		}
+		for _, opt := range strings.Split(fields[3], ",") {
+			m.ReadOnly = m.ReadOnly || opt == "ro"
+		}
+		if err := statMount(m); err != nil {
+			m.Error = err.Error()
+		}
+		res = append(res, m)
+	}
+	return res, s.Err()
+}
+
+// Statfs of a network filesystem may hang when its server is gone
+func statMount(m *MountInfo) error {
+	done := make(chan error, 1)
+	var st syscall.Statfs_t
+	go func() {
+		done <- syscall.Statfs(m.Mountpoint, &st)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+	case <-time.After(2 * time.Second):
+		return errors.New("statfs timed out")
+	}
+	bsize := uint64(st.Frsize)
+	if bsize == 0 {
+		bsize = uint64(st.Bsize)
+	}
+	m.setUsage(st.Blocks*bsize, st.Bfree*bsize, st.Bavail*bsize)
+	m.Inodes, m.InodesFree = st.Files, st.Ffree
+	return nil
+}
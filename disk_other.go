@@ -0,0 +1,18 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"errors"
+)
+
+var errDiskUnsupported = errors.New("disks and mounts are only supported on linux and windows")
+
+func listDisks() ([]*DiskInfo, error) {
+	return nil, errDiskUnsupported
+}
+
+func listMounts() ([]*MountInfo, error) {
+	return nil, errDiskUnsupported
+}
@@ -0,0 +1,150 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	driveRemote        = 4
+	driveCdrom         = 5
+	fileReadOnlyVolume = 0x00080000
+	diskListScript     = `$disks = @(Get-Disk | ForEach-Object {
+	[pscustomobject]@{
+		Number = $_.Number; Model = $_.FriendlyName; Serial = $_.SerialNumber; Size = $_.Size
+		Removable = $_.BusType.ToString() -eq 'USB'; Health = $_.HealthStatus.ToString()
+		Partitions = @(Get-Partition -DiskNumber $_.Number -ErrorAction SilentlyContinue | ForEach-Object {
+			[pscustomobject]@{ Number = $_.PartitionNumber; Size = $_.Size; AccessPaths = @($_.AccessPaths) }
+		})
+	}
+})
+ConvertTo-Json -Compress -Depth 4 -InputObject $disks`
+)
+
+var (
+	procGetLogicalDriveStrings = modkernel32.NewProc("GetLogicalDriveStringsW")
+	procGetDriveType           = modkernel32.NewProc("GetDriveTypeW")
+	procGetVolumeInformation   = modkernel32.NewProc("GetVolumeInformationW")
+)
+
+type windowsDisk struct {
+	Number     int
+	Model      string
+	Serial     string
+	Size       uint64
+	Removable  bool
+	Health     string
+	Partitions []struct {
+		Number      int
+		Size        uint64
+		AccessPaths []string
+	}
+}
+
+func listDisks() ([]*DiskInfo, error) {
+	out, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", diskListScript).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Get-Disk: %s", err)
+	}
+	var disks []windowsDisk
+	if err = json.Unmarshal(out, &disks); err != nil {
+		return nil, err
+	}
+	res := []*DiskInfo{}
+	for _, wd := range disks {
+		name := "PhysicalDrive" + strconv.Itoa(wd.Number)
+		d := &DiskInfo{
+			Name:       name,
+			Device:     "/dev/pd" + strconv.Itoa(wd.Number),
+			Model:      wd.Model,
+			Serial:     wd.Serial,
+			Size:       wd.Size,
+			Removable:  wd.Removable,
+			Health:     wd.Health,
+			Partitions: []*PartitionInfo{},
+		}
+		for _, wp := range wd.Partitions {
+			p := &PartitionInfo{
+				Name:   name + "Partition" + strconv.Itoa(wp.Number),
+				Device: `\\?\GLOBALROOT\Device\Harddisk` + strconv.Itoa(wd.Number) + `\Partition` + strconv.Itoa(wp.Number),
+				Size:   wp.Size,
+			}
+			// The drive letters and the mounted folders, not the volume guid paths
+			for _, ap := range wp.AccessPaths {
+				if len(ap) > 0 && ap[0] != '\\' {
+					p.Mountpoints = append(p.Mountpoints, ap)
+				}
+			}
+			d.Partitions = append(d.Partitions, p)
+		}
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+func listMounts() ([]*MountInfo, error) {
+	buf := make([]uint16, 256)
+	n, _, err := procGetLogicalDriveStrings.Call(uintptr(len(buf)), uintptr(unsafe.Pointer(&buf[0])))
+	if n == 0 {
+		return nil, err
+	}
+	res := []*MountInfo{}
+	for _, root := range splitUTF16z(buf[:n]) {
+		m := &MountInfo{Device: root[:2], Mountpoint: root}
+		p, _ := syscall.UTF16PtrFromString(root)
+		typ, _, _ := procGetDriveType.Call(uintptr(unsafe.Pointer(p)))
+		if typ == driveRemote {
+			m.Fstype = "remote"
+		}
+		// An empty cd drive fails the calls below
+		label := make([]uint16, syscall.MAX_PATH+1)
+		fstype := make([]uint16, syscall.MAX_PATH+1)
+		var flags uint32
+		r, _, err := procGetVolumeInformation.Call(uintptr(unsafe.Pointer(p)),
+			uintptr(unsafe.Pointer(&label[0])), uintptr(len(label)), 0, 0, uintptr(unsafe.Pointer(&flags)),
+			uintptr(unsafe.Pointer(&fstype[0])), uintptr(len(fstype)))
+		if r == 0 {
+			if typ != driveCdrom {
+				m.Error = err.Error()
+			}
+			res = append(res, m)
+			continue
+		}
+		m.Label = syscall.UTF16ToString(label)
+		m.Fstype = syscall.UTF16ToString(fstype)
+		m.ReadOnly = flags&fileReadOnlyVolume != 0
+
+		var avail, total, free uint64
+		r, _, err = procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)),
+			uintptr(unsafe.Pointer(&avail)), uintptr(unsafe.Pointer(&total)), uintptr(unsafe.Pointer(&free)))
+		if r == 0 {
+			m.Error = err.Error()
+		} else {
+			m.setUsage(total, free, avail)
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// The strings of a double-null-terminated list
+func splitUTF16z(buf []uint16) []string {
+	var res []string
+	start := 0
+	for i, c := range buf {
+		if c == 0 {
+			if i > start {
+				res = append(res, syscall.UTF16ToString(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return res
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nu7hatch/gouuid"
+)
+
+// A request of a token to run jobs as another user for a while, which
+// takes effect only after an admin approves it.
+type Elevation struct {
+	Id         string          `json:"id"`
+	TokenId    string          `json:"token_id"`
+	TokenName  string          `json:"token_name"`
+	RunAs      string          `json:"run_as"`
+	Reason     string          `json:"reason"`
+	Duration   int             `json:"duration_seconds"`
+	Status     ElevationStatus `json:"status"`
+	ReviewedBy string          `json:"reviewed_by,omitempty"`
+	CreateTime time.Time       `json:"create_time"`
+	ExpireTime time.Time       `json:"expire_time"` // Set when approved
+}
+
+type ElevationStatus string
+
+const (
+	ESPending  ElevationStatus = "pending"
+	ESApproved                 = "approved"
+	ESDenied                   = "denied"
+	ESExpired                  = "expired"
+)
+
+// Pending requests not reviewed in this period expire
+const elevationPendingTimeout = 24 * time.Hour
+
+var (
+	errElevationNotFound = errors.New("elevation not found")
+	errElevationReviewed = errors.New("elevation already reviewed")
+)
+
+// The elevations are kept in memory only, a restart revokes them all
+type ElevationStore struct {
+	elevations map[string]*Elevation
+
+	sync.Mutex
+}
+
+var (
+	gElevationStore = NewElevationStore()
+)
+
+func NewElevationStore() *ElevationStore {
+	return &ElevationStore{elevations: make(map[string]*Elevation)}
+}
+
+func (o *ElevationStore) Request(tok *Token, runAs, reason string, duration int) (*Elevation, error) {
+	u, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	e := &Elevation{
+		Id:         u.String(),
+		TokenId:    tok.Id,
+		TokenName:  tok.Name,
+		RunAs:      runAs,
+		Reason:     reason,
+		Duration:   duration,
+		Status:     ESPending,
+		CreateTime: time.Now(),
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	o.expire()
+	o.elevations[e.Id] = e
+	log.Infof("audit: elevation %s requested by token %s(%s), run_as: %s, duration: %ds, reason: %s",
+		e.Id, tok.Name, tok.Id, runAs, duration, reason)
+	c := *e
+	return &c, nil
+}
+
+// Approve or deny a pending elevation, an approved one starts counting down now
+func (o *ElevationStore) Review(id string, approve bool, reviewer string) (*Elevation, error) {
+	o.Lock()
+	defer o.Unlock()
+	o.expire()
+	e, ok := o.elevations[id]
+	if !ok {
+		return nil, errElevationNotFound
+	}
+	if e.Status != ESPending {
+		return nil, errElevationReviewed
+	}
+	e.ReviewedBy = reviewer
+	e.Status = ESDenied
+	if approve {
+		e.Status = ESApproved
+		e.ExpireTime = time.Now().Add(time.Duration(e.Duration) * time.Second)
+	}
+	log.Infof("audit: elevation %s of token %s %s by %s, run_as: %s", e.Id, e.TokenName, e.Status, reviewer, e.RunAs)
+	c := *e
+	return &c, nil
+}
+
+func (o *ElevationStore) List() []*Elevation {
+	o.Lock()
+	defer o.Unlock()
+	o.expire()
+	list := make([]*Elevation, 0, len(o.elevations))
+	for _, e := range o.elevations {
+		c := *e
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreateTime.Before(list[j].CreateTime) })
+	return list
+}
+
+// Check if the token holds an approved elevation to run as the user
+func (o *ElevationStore) Allowed(tokenId, runAs string) bool {
+	o.Lock()
+	defer o.Unlock()
+	o.expire()
+	for _, e := range o.elevations {
+		if e.Status == ESApproved && e.TokenId == tokenId && e.RunAs == runAs {
+			return true
+		}
+	}
+	return false
+}
+
+// Mark the elevations out of time as expired, and forget the old ones, the lock must be held
+func (o *ElevationStore) expire() {
+	now := time.Now()
+	for id, e := range o.elevations {
+		switch {
+		case e.Status == ESApproved && now.After(e.ExpireTime):
+			e.Status = ESExpired
+			log.Infof("audit: elevation %s of token %s expired, run_as: %s", e.Id, e.TokenName, e.RunAs)
+		case e.Status == ESPending && now.Sub(e.CreateTime) > elevationPendingTimeout:
+			e.Status = ESExpired
+		case e.Status != ESPending && e.Status != ESApproved && now.Sub(e.CreateTime) > 7*elevationPendingTimeout:
+			delete(o.elevations, id)
+		}
+	}
+}
+
+// Only admin tokens and tokens with an approved elevation may run jobs as
+// another user, any caller may if the auth is disabled.
+func checkRunAs(tok *Token, runAs string) error {
+	if runAs == "" || tok == nil || tok.Admin {
+		return nil
+	}
+	if gElevationStore.Allowed(tok.Id, runAs) {
+		log.Infof("audit: token %s(%s) runs a job as %s by elevation", tok.Name, tok.Id, runAs)
+		return nil
+	}
+	return errors.New("run_as " + runAs + " needs an approved elevation")
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The encoders below work on the generic value tree decoded from json, i.e.
+// map[string]interface{}, []interface{}, string, json.Number, bool and nil,
+// so that every response keeps the field names of its json tags.
+
+func decodeGeneric(data []byte) (interface{}, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	err := d.Decode(&v)
+	return v, err
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	yamlPlainRe    = regexp.MustCompile(`^[A-Za-z_/][A-Za-z0-9 _./@+-]*$`)
+	yamlReservedRe = regexp.MustCompile(`^(?i:true|false|yes|no|on|off|null|y|n|~)$`)
+	yamlNumberRe   = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+)
+
+func EncodeYAML(v interface{}) []byte {
+	var buf bytes.Buffer
+	writeYAML(&buf, v, 0)
+	return buf.Bytes()
+}
+
+func writeYAML(buf *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat("  ", indent)
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 0 {
+			buf.WriteString(pad + "{}\n")
+			return
+		}
+		for _, k := range sortedKeys(t) {
+			buf.WriteString(pad + yamlString(k, indent) + ":")
+			writeYAMLValue(buf, t[k], indent)
+		}
+	case []interface{}:
+		if len(t) == 0 {
+			buf.WriteString(pad + "[]\n")
+			return
+		}
+		for _, e := range t {
+			if m, ok := e.(map[string]interface{}); ok && len(m) > 0 {
+				// Put the first key on the line of "-"
+				var item bytes.Buffer
+				writeYAML(&item, m, indent+1)
+				buf.WriteString(pad + "- ")
+				buf.Write(item.Bytes()[len(pad)+2:])
+				continue
+			}
+			buf.WriteString(pad + "-")
+			writeYAMLValue(buf, e, indent)
+		}
+	default:
+		buf.WriteString(pad + yamlScalar(v, indent) + "\n")
+	}
+}
+
+// Write the value following a "key:" or "-"
+func writeYAMLValue(buf *bytes.Buffer, v interface{}, indent int) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 0 {
+			buf.WriteString(" {}\n")
+			return
+		}
+		buf.WriteString("\n")
+		writeYAML(buf, t, indent+1)
+	case []interface{}:
+		if len(t) == 0 {
+			buf.WriteString(" []\n")
+			return
+		}
+		buf.WriteString("\n")
+		writeYAML(buf, t, indent+1)
+	default:
+		buf.WriteString(" " + yamlScalar(v, indent+1) + "\n")
+	}
+}
+
+func yamlScalar(v interface{}, indent int) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(t)
+	case json.Number:
+		n := t.String()
+		// YAML 1.1 parsers need a dot in floats, e.g. 1.0e-05 rather than 1e-05
+		if i := strings.IndexAny(n, "eE"); i >= 0 && !strings.Contains(n, ".") {
+			n = n[:i] + ".0" + n[i:]
+		}
+		return n
+	case string:
+		return yamlString(t, indent)
+	}
+	return jsonString(v)
+}
+
+// Use a plain scalar if it can't be mistaken, a literal block for readable
+// multi-line output, and a json string otherwise, which is valid yaml.
+func yamlString(s string, indent int) string {
+	if yamlPlainRe.MatchString(s) && !yamlReservedRe.MatchString(s) && !strings.HasSuffix(s, " ") {
+		return s
+	}
+	if strings.Contains(s, "\n") && isPrintable(s) {
+		chomp := "-"
+		if strings.HasSuffix(s, "\n") {
+			chomp = ""
+			if strings.HasSuffix(s, "\n\n") {
+				chomp = "+"
+			}
+		}
+		header := "|" + chomp
+		if strings.HasPrefix(s, " ") || strings.HasPrefix(s, "\n") {
+			header = "|2" + chomp
+		}
+		pad := strings.Repeat("  ", indent)
+		lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+		for i, l := range lines {
+			if l != "" {
+				lines[i] = pad + l
+			}
+		}
+		return header + "\n" + strings.Join(lines, "\n")
+	}
+	return jsonString(s)
+}
+
+func jsonString(v interface{}) string {
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	e.Encode(v)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func isPrintable(s string) bool {
+	for _, r := range s {
+		if r == '\r' || r == 0xfeff || (r < 0x20 && r != '\n' && r != '\t') {
+			return false
+		}
+	}
+	return true
+}
+
+// Decode the block style yaml, as written by EncodeYAML, into the generic
+// value tree. The flow collections and the double quoted strings are taken
+// as json; anchors, tags, folded and multi-line plain scalars are not
+// supported.
+func DecodeYAML(data []byte) (interface{}, error) {
+	d := &yamlDecoder{lines: strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")}
+	if d.indent() == 0 && strings.TrimSpace(d.lines[d.pos]) == "---" {
+		d.pos++
+	}
+	v, err := d.node(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.indent() >= 0 {
+		return nil, d.errorf("unexpected indentation")
+	}
+	return v, nil
+}
+
+type yamlDecoder struct {
+	lines []string
+	pos   int
+}
+
+func (o *yamlDecoder) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("yaml line %d: %s", o.pos+1, fmt.Sprintf(format, args...))
+}
+
+// The indentation of the next line of content, -1 at the end
+func (o *yamlDecoder) indent() int {
+	for ; o.pos < len(o.lines); o.pos++ {
+		l := o.lines[o.pos]
+		t := strings.TrimLeft(l, " ")
+		if t != "" && !strings.HasPrefix(t, "#") {
+			return len(l) - len(t)
+		}
+	}
+	return -1
+}
+
+func isYAMLSeqItem(s string) bool {
+	return s == "-" || strings.HasPrefix(s, "- ")
+}
+
+// The node indented by min at least, null if none
+func (o *yamlDecoder) node(min int) (interface{}, error) {
+	n := o.indent()
+	if n < min {
+		return nil, nil
+	}
+	l := o.lines[o.pos][n:]
+	if isYAMLSeqItem(l) {
+		return o.seq(n)
+	}
+	if _, _, ok := yamlKey(l); ok {
+		return o.mapping(n)
+	}
+	return o.scalar(l, n)
+}
+
+func (o *yamlDecoder) seq(n int) (interface{}, error) {
+	list := []interface{}{}
+	for o.indent() == n && isYAMLSeqItem(o.lines[o.pos][n:]) {
+		rest := strings.TrimLeft(o.lines[o.pos][n+1:], " ")
+		var v interface{}
+		var err error
+		if _, _, ok := yamlKey(rest); ok || isYAMLSeqItem(rest) {
+			// A node starting on the line of "-", as if on the next line
+			m := len(o.lines[o.pos]) - len(rest)
+			o.lines[o.pos] = strings.Repeat(" ", m) + rest
+			v, err = o.node(m)
+		} else if rest == "" || strings.HasPrefix(rest, "#") {
+			o.pos++
+			v, err = o.node(n + 1)
+		} else {
+			v, err = o.scalar(rest, n)
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func (o *yamlDecoder) mapping(n int) (interface{}, error) {
+	m := make(map[string]interface{})
+	for o.indent() == n && !isYAMLSeqItem(o.lines[o.pos][n:]) {
+		key, rest, ok := yamlKey(o.lines[o.pos][n:])
+		if !ok {
+			return nil, o.errorf("a key is expected")
+		}
+		if _, dup := m[key]; dup {
+			return nil, o.errorf("duplicate key %q", key)
+		}
+		var v interface{}
+		var err error
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			v, err = o.scalar(rest, n)
+		} else if o.pos++; o.indent() == n && isYAMLSeqItem(o.lines[o.pos][n:]) {
+			// A sequence may be at the indentation of its key
+			v, err = o.seq(n)
+		} else {
+			v, err = o.node(n + 1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// Split "key: value", the key is plain or a json string
+func yamlKey(l string) (string, string, bool) {
+	if strings.HasPrefix(l, `"`) {
+		end := 1
+		for ; end < len(l) && l[end] != '"'; end++ {
+			if l[end] == '\\' {
+				end++
+			}
+		}
+		var key string
+		if end >= len(l) || json.Unmarshal([]byte(l[:end+1]), &key) != nil {
+			return "", "", false
+		}
+		rest := l[end+1:]
+		if rest != ":" && !strings.HasPrefix(rest, ": ") {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(rest[1:]), true
+	}
+	if l == "" || strings.ContainsAny(l[:1], "\t#'{[|>&*!%@`") {
+		return "", "", false
+	}
+	i := strings.Index(l, ": ")
+	if i < 0 && strings.HasSuffix(l, ":") {
+		i = len(l) - 1
+	}
+	if i <= 0 || strings.Contains(l[:i], " #") {
+		return "", "", false
+	}
+	return strings.TrimSpace(l[:i]), strings.TrimSpace(l[i+1:]), true
+}
+
+// The scalar or the flow collection s on the current line, following a
+// "key:" or "-" indented by parent. A literal block scalar is read from the
+// next lines.
+func (o *yamlDecoder) scalar(s string, parent int) (interface{}, error) {
+	switch s[0] {
+	case '\t':
+		return nil, o.errorf("tabs are not allowed for indentation")
+	case '|':
+		o.pos++
+		return o.literal(s, parent)
+	case '>', '&', '*', '!':
+		return nil, o.errorf("unsupported: %s", s)
+	case '"', '\'', '{', '[':
+		v, rest, err := yamlFlow(s)
+		if err == nil {
+			if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+				err = fmt.Errorf("unexpected %q", rest)
+			}
+		}
+		if err != nil {
+			return nil, o.errorf("%s", err)
+		}
+		o.pos++
+		return v, nil
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	o.pos++
+	return yamlPlain(strings.TrimSpace(s)), nil
+}
+
+// A flow collection or a quoted scalar at the start of s, and the rest of s.
+// Json is a flow collection too.
+func yamlFlow(s string) (interface{}, string, error) {
+	s = strings.TrimLeft(s, " ")
+	if s == "" {
+		return nil, s, errors.New("unexpected end of flow")
+	}
+	switch s[0] {
+	case '[':
+		list := []interface{}{}
+		for s = strings.TrimLeft(s[1:], " "); !strings.HasPrefix(s, "]"); {
+			v, rest, err := yamlFlow(s)
+			if err != nil {
+				return nil, s, err
+			}
+			list = append(list, v)
+			if s, err = yamlFlowNext(rest, ']'); err != nil {
+				return nil, s, err
+			}
+		}
+		return list, s[1:], nil
+	case '{':
+		m := make(map[string]interface{})
+		for s = strings.TrimLeft(s[1:], " "); !strings.HasPrefix(s, "}"); {
+			k, rest, err := yamlFlow(s)
+			if err != nil {
+				return nil, s, err
+			}
+			key, ok := k.(string)
+			if n, isNum := k.(json.Number); isNum {
+				key, ok = n.String(), true
+			}
+			if rest = strings.TrimLeft(rest, " "); !ok || !strings.HasPrefix(rest, ":") {
+				return nil, s, fmt.Errorf("a key is expected at %q", s)
+			}
+			if m[key], rest, err = yamlFlow(rest[1:]); err != nil {
+				return nil, s, err
+			}
+			if s, err = yamlFlowNext(rest, '}'); err != nil {
+				return nil, s, err
+			}
+		}
+		return m, s[1:], nil
+	case '"':
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		var str string
+		if end >= len(s) || json.Unmarshal([]byte(s[:end+1]), &str) != nil {
+			return nil, s, errors.New("invalid double quoted string")
+		}
+		return str, s[end+1:], nil
+	case '\'':
+		for end := 1; end < len(s); end++ {
+			if s[end] != '\'' {
+				continue
+			}
+			if end+1 < len(s) && s[end+1] == '\'' {
+				end++
+				continue
+			}
+			return strings.ReplaceAll(s[1:end], "''", "'"), s[end+1:], nil
+		}
+		return nil, s, errors.New("unterminated single quoted string")
+	}
+	// A plain scalar ends by an indicator or a ":" followed by a space
+	end := 0
+	for ; end < len(s); end++ {
+		c := s[end]
+		if c == ',' || c == ']' || c == '}' || c == ':' && (end+1 == len(s) || strings.IndexByte(" ,]}", s[end+1]) >= 0) {
+			break
+		}
+	}
+	return yamlPlain(strings.TrimSpace(s[:end])), s[end:], nil
+}
+
+// Skip the "," following an entry of a flow collection, s is left at the
+// next entry or the end
+func yamlFlowNext(s string, end byte) (string, error) {
+	s = strings.TrimLeft(s, " ")
+	if strings.HasPrefix(s, ",") {
+		return strings.TrimLeft(s[1:], " "), nil
+	}
+	if s == "" || s[0] != end {
+		return s, fmt.Errorf("\",\" or \"%c\" is expected at %q", end, s)
+	}
+	return s, nil
+}
+
+func yamlPlain(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if yamlNumberRe.MatchString(s) {
+		return json.Number(s)
+	}
+	return s
+}
+
+// A literal block scalar with its chomping and indentation indicators
+func (o *yamlDecoder) literal(header string, parent int) (interface{}, error) {
+	if i := strings.Index(header, " #"); i >= 0 {
+		header = header[:i]
+	}
+	chomp, indent := byte(0), -1
+	for _, c := range []byte(strings.TrimSpace(header[1:])) {
+		switch {
+		case c == '-' || c == '+':
+			chomp = c
+		case c >= '1' && c <= '9':
+			indent = parent + int(c-'0')
+		default:
+			return nil, o.errorf("invalid block scalar header: %s", header)
+		}
+	}
+	var lines []string
+	for ; o.pos < len(o.lines); o.pos++ {
+		l := o.lines[o.pos]
+		t := strings.TrimLeft(l, " ")
+		n := len(l) - len(t)
+		if t == "" {
+			if n > indent && indent >= 0 {
+				t = l[indent:]
+			}
+			lines = append(lines, t)
+			continue
+		}
+		if indent < 0 {
+			if n <= parent {
+				break
+			}
+			indent = n
+		}
+		if n < indent {
+			break
+		}
+		lines = append(lines, l[indent:])
+	}
+	end := len(lines)
+	for end > 0 && lines[end-1] == "" {
+		end--
+	}
+	s := strings.Join(lines[:end], "\n")
+	switch {
+	case chomp == '+':
+		breaks := len(lines) - end
+		if end > 0 {
+			breaks++
+		}
+		s += strings.Repeat("\n", breaks)
+	case chomp == 0 && end > 0:
+		s += "\n"
+	}
+	return s, nil
+}
+
+func EncodeMsgpack(v interface{}) []byte {
+	var buf bytes.Buffer
+	writeMsgpack(&buf, v)
+	return buf.Bytes()
+}
+
+func writeMsgpack(buf *bytes.Buffer, v interface{}) {
+	switch t := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if t {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			writeMsgpackInt(buf, i)
+		} else {
+			f, _ := t.Float64()
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		}
+	case string:
+		n := len(t)
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.WriteByte(0xd9)
+			buf.WriteByte(byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdb)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.WriteString(t)
+	case []interface{}:
+		writeMsgpackLen(buf, len(t), 0x90, 0xdc)
+		for _, e := range t {
+			writeMsgpack(buf, e)
+		}
+	case map[string]interface{}:
+		writeMsgpackLen(buf, len(t), 0x80, 0xde)
+		for _, k := range sortedKeys(t) {
+			writeMsgpack(buf, k)
+			writeMsgpack(buf, t[k])
+		}
+	}
+}
+
+// Write the header of an array or a map, the 32 bit code follows the 16 bit one
+func writeMsgpackLen(buf *bytes.Buffer, n int, fix, code16 byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(code16 + 1)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i >= -32 && i < 0:
+		buf.WriteByte(byte(int8(i)))
+	case i >= 0 && i <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(i))
+	case i >= 0:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, uint64(i))
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
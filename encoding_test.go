@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustDecodeGeneric(t *testing.T, s string) interface{} {
+	v, err := decodeGeneric([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// What EncodeYAML writes, DecodeYAML reads back as it was
+func TestYAMLRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		`{"cmd":"systemctl status nginx","timeout_seconds":30,"async":true,"dir":null}`,
+		`{"env":["A=1","B=two words"],"labels":{"app":"web","tier":"1"}}`,
+		`{"script":"#!/bin/sh\nset -e\necho hi\n","keep":"a\n\n","strip":"no newline\nat end"}`,
+		`{"indented":"  leading spaces\nsecond\n","empty":"","reserved":["yes","no","null","true","~"]}`,
+		`{"nested":[{"name":"a","args":["-x","--y=1"]},{"name":"b","args":[]}],"m":{}}`,
+		`{"quote":"it's \"quoted\": yes # not a comment","tab":"a\tb","unicode":"héllo","cr":"a\r\nb"}`,
+		`{"float":1.5,"exp":1e-05,"neg":-3,"big":12345678901234}`,
+		`[1,"two",[3,4],{"five":5}]`,
+	} {
+		v := mustDecodeGeneric(t, s)
+		y := EncodeYAML(v)
+		got, err := DecodeYAML(y)
+		if err != nil {
+			t.Errorf("%s: decode failed: %s\n%s", s, err, y)
+			continue
+		}
+		// 1e-05 is written as 1.0e-05
+		if !reflect.DeepEqual(normalizeNumbers(got), normalizeNumbers(v)) {
+			t.Errorf("%s: got %#v\n%s", s, got, y)
+		}
+	}
+}
+
+func normalizeNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{})
+		for k, e := range t {
+			m[k] = normalizeNumbers(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			l[i] = normalizeNumbers(e)
+		}
+		return l
+	case interface{ Float64() (float64, error) }:
+		f, _ := t.Float64()
+		return f
+	}
+	return v
+}
+
+func TestEncodeYAML(t *testing.T) {
+	v := mustDecodeGeneric(t, `{"name":"deploy","args":["a"],"script":"echo 1\necho 2\n","on":"yes"}`)
+	want := "args:\n  - a\nname: deploy\n\"on\": \"yes\"\nscript: |\n  echo 1\n  echo 2\n"
+	if got := string(EncodeYAML(v)); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDecodeYAML(t *testing.T) {
+	y := `---
+# a profile
+name: deploy   # trailing comment
+args:
+- -x
+- "quoted: value"
+env: [A=1, 'B=it''s']
+opts: {retries: 3, verbose: true}
+script: |-
+    line 1
+      line 2
+`
+	got, err := DecodeYAML([]byte(y))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustDecodeGeneric(t, `{"name":"deploy","args":["-x","quoted: value"],"env":["A=1","B=it's"],
+		"opts":{"retries":3,"verbose":true},"script":"line 1\n  line 2"}`)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v", got)
+	}
+
+	for _, bad := range []string{
+		"a: 1\na: 2\n",
+		"a: &anchor 1\n",
+		"a: >\n  folded\n",
+		"a:\n\t- 1\n",
+		"a: [1, 2\n",
+		"a: 1\n  b: 2\n",
+	} {
+		if _, err := DecodeYAML([]byte(bad)); err == nil {
+			t.Errorf("%q decoded", bad)
+		}
+	}
+}
+
+func TestEncodeMsgpack(t *testing.T) {
+	for _, c := range []struct {
+		json string
+		hex  string
+	}{
+		{`null`, "c0"},
+		{`true`, "c3"},
+		{`false`, "c2"},
+		{`0`, "00"},
+		{`127`, "7f"},
+		{`-1`, "ff"},
+		{`-32`, "e0"},
+		{`-33`, "d0df"},
+		{`128`, "cc80"},
+		{`256`, "cd0100"},
+		{`65536`, "ce00010000"},
+		{`4294967296`, "cf0000000100000000"},
+		{`-129`, "d1ff7f"},
+		{`-32769`, "d2ffff7fff"},
+		{`-2147483649`, "d3ffffffff7fffffff"},
+		{`1.5`, "cb3ff8000000000000"},
+		{`"abc"`, "a3616263"},
+		{`[1,"a"]`, "9201a161"},
+		// By the order of the keys
+		{`{"b":1,"a":2}`, "82a16102a16201"},
+	} {
+		got := hex.EncodeToString(EncodeMsgpack(mustDecodeGeneric(t, c.json)))
+		if got != c.hex {
+			t.Errorf("%s: got %s, want %s", c.json, got, c.hex)
+		}
+	}
+
+	// The lengths past the fix formats
+	s := strings.Repeat("x", 32)
+	if b := EncodeMsgpack(s); !bytes.Equal(b[:2], []byte{0xd9, 32}) || len(b) != 34 {
+		t.Errorf("str8 header % x", b[:2])
+	}
+	s = strings.Repeat("x", 256)
+	if b := EncodeMsgpack(s); !bytes.Equal(b[:3], []byte{0xda, 1, 0}) {
+		t.Errorf("str16 header % x", b[:3])
+	}
+	list := make([]interface{}, 16)
+	if b := EncodeMsgpack(list); !bytes.Equal(b[:3], []byte{0xdc, 0, 16}) || len(b) != 3+16 {
+		t.Errorf("array16 header % x", b[:3])
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The job data the agent keeps on disk, the spilled output, the delayed
+// jobs and the results of keep_history, is sealed by AES-256-GCM with the
+// key of encryption::key_file. Each file, or each spilled block, is the
+// magic, a random nonce and the ciphertext, authenticated with the name of
+// its file, so that a file can't be swapped for another.
+var gStorageKey cipher.AEAD
+
+var sealedMagic = []byte("SAE1")
+
+var errNoStorageKey = errors.New("encrypted, but no encryption::key_file set")
+
+func init() {
+	gHttpServer.AddToInit(InitStorageKey)
+}
+
+func InitStorageKey() error {
+	gStorageKey = nil
+	if gApp.Cnf.EncryptionKeyFile == "" {
+		return nil
+	}
+	aead, err := loadOrCreateStorageKey(gApp.Cnf.EncryptionKeyFile)
+	if err != nil {
+		log.Errorf("load encryption key failed: %s", err)
+		return err
+	}
+	gStorageKey = aead
+	return nil
+}
+
+// Load the hex encoded 256 bits key, a new key is generated if the file
+// doesn't exist
+func loadOrCreateStorageKey(path string) (cipher.AEAD, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err = ioutil.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		log.Warnf("generated a new encryption key: %s", path)
+		return newStorageKey(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("not a hex encoded 256 bits key: " + path)
+	}
+	return newStorageKey(key)
+}
+
+func newStorageKey(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal the data of the file named name, as is without a key
+func sealData(data []byte, name string) []byte {
+	if gStorageKey == nil {
+		return data
+	}
+	out := make([]byte, len(sealedMagic)+gStorageKey.NonceSize(), len(sealedMagic)+gStorageKey.NonceSize()+len(data)+gStorageKey.Overhead())
+	copy(out, sealedMagic)
+	nonce := out[len(sealedMagic):]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return gStorageKey.Seal(out, nonce, data, []byte(name))
+}
+
+// Open the data sealed by sealData. The data without the magic is taken as
+// plaintext, so that the files written before the key was set are read, and
+// sealed when written again.
+func openData(data []byte, name string) ([]byte, error) {
+	if !bytes.HasPrefix(data, sealedMagic) {
+		return data, nil
+	}
+	if gStorageKey == nil {
+		return nil, errNoStorageKey
+	}
+	data = data[len(sealedMagic):]
+	if len(data) < gStorageKey.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	n := gStorageKey.NonceSize()
+	return gStorageKey.Open(nil, data[:n], data[n:], []byte(name))
+}
+
+func writeFileSealed(path string, data []byte, perm os.FileMode) error {
+	return writeFileAtomic(path, sealData(data, filepath.Base(path)), perm)
+}
+
+func readFileSealed(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err = openData(b, filepath.Base(path))
+	if err != nil {
+		return nil, fmt.Errorf("open %s failed: %s", path, err)
+	}
+	return b, nil
+}
+
+// The spill files are appended a block at a time, so with a key each block
+// is sealed on its own, prefixed by its length
+func sealRecord(data []byte, name string) []byte {
+	sealed := sealData(data, name)
+	out := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(out, uint32(len(sealed)))
+	return append(out, sealed...)
+}
+
+func openRecords(data []byte, name string) ([]byte, error) {
+	var out []byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return out, io.ErrUnexpectedEOF
+		}
+		n := binary.BigEndian.Uint32(data)
+		if uint64(len(data)-4) < uint64(n) {
+			return out, io.ErrUnexpectedEOF
+		}
+		b, err := openData(data[4:4+n], name)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, b...)
+		data = data[4+n:]
+	}
+	return out, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setupStorageKey(t *testing.T) {
+	aead, err := loadOrCreateStorageKey(filepath.Join(t.TempDir(), "key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gStorageKey = aead
+	t.Cleanup(func() { gStorageKey = nil })
+}
+
+func TestSealedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.json")
+	// Written before the key was set
+	if err := writeFileSealed(path, []byte(`{"cmd":"plain"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setupStorageKey(t)
+	if b, err := readFileSealed(path); err != nil || string(b) != `{"cmd":"plain"}` {
+		t.Fatalf("got %q, %v", b, err)
+	}
+
+	secret := []byte(`{"cmd":"mysql -psecret"}`)
+	if err := writeFileSealed(path, secret, 0600); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := ioutil.ReadFile(path)
+	if bytes.Contains(raw, []byte("secret")) || !bytes.HasPrefix(raw, sealedMagic) {
+		t.Fatalf("not sealed: %q", raw)
+	}
+	if b, err := readFileSealed(path); err != nil || !bytes.Equal(b, secret) {
+		t.Fatalf("got %q, %v", b, err)
+	}
+
+	// Bound to the name of the file
+	other := filepath.Join(dir, "b.json")
+	ioutil.WriteFile(other, raw, 0600)
+	if _, err := readFileSealed(other); err == nil {
+		t.Fatal("opened as another file")
+	}
+	raw[len(raw)-1] ^= 1
+	ioutil.WriteFile(path, raw, 0600)
+	if _, err := readFileSealed(path); err == nil {
+		t.Fatal("tampered file opened")
+	}
+
+	gStorageKey = nil
+	if _, err := readFileSealed(other); err == nil || !strings.Contains(err.Error(), "no encryption::key_file") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// The spilled output is sealed a block at a time, and read back whole
+func TestSealedSpill(t *testing.T) {
+	setupJobs(t)
+	gApp.Cnf.MemoryRingSize = 32
+	setupStorageKey(t)
+	job, _, err := newJob(&RunCmdReq{Cmd: "true"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []byte(strings.Repeat("password=hunter2 ", 1000) + "\n")
+	var want []byte
+	for i := 0; i < 10; i++ {
+		job.stdout.Write(line)
+		want = append(want, line...)
+	}
+	if job.stdout.spillSize == 0 {
+		t.Fatal("nothing spilled")
+	}
+	raw, _ := ioutil.ReadFile(job.stdout.path)
+	if bytes.Contains(raw, []byte("hunter2")) {
+		t.Fatal("spill file in plaintext")
+	}
+	if stdout, _ := job.Output(); stdout != string(want) {
+		t.Fatalf("got %d bytes, want %d", len(stdout), len(want))
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// Ids of the events written to the Windows Event Log when running as a
+// Windows service, so that the monitoring can match them.
+const (
+	EventServiceStart  = 1
+	EventServiceStop   = 2
+	EventServiceFatal  = 3
+	EventPanic         = 4
+	EventAuthFailed    = 5
+	EventAdminDenied   = 6
+	EventApplyReverted = 7
+)
+
+const eventSource = "shell-agent"
+
+var (
+	// Opened only when running as a Windows service
+	gEventLog *eventLog
+)
+
+func ReportInfoEvent(id uint32, msg string) {
+	if gEventLog != nil {
+		gEventLog.report(eventInfo, id, msg)
+	}
+}
+
+func ReportWarningEvent(id uint32, msg string) {
+	if gEventLog != nil {
+		gEventLog.report(eventWarning, id, msg)
+	}
+}
+
+func ReportErrorEvent(id uint32, msg string) {
+	if gEventLog != nil {
+		gEventLog.report(eventError, id, msg)
+	}
+}
+
+// Report the fatal and panic entries of the log, which stop the agent
+type EventLogHook struct {
+}
+
+func (o *EventLogHook) Fire(entry *log.Entry) error {
+	ReportErrorEvent(EventServiceFatal, entry.Message)
+	return nil
+}
+
+func (o *EventLogHook) Levels() []log.Level {
+	return []log.Level{log.FatalLevel, log.PanicLevel}
+}
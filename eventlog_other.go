@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+)
+
+const (
+	eventError   = 1
+	eventWarning = 2
+	eventInfo    = 4
+)
+
+type eventLog struct{}
+
+func openEventLog(source string) (*eventLog, error) {
+	return nil, errors.New("event log is only supported on windows")
+}
+
+func (o *eventLog) report(etype uint16, id uint32, msg string) error {
+	return nil
+}
+
+func (o *eventLog) Close() error {
+	return nil
+}
@@ -0,0 +1,110 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	eventError   = 1
+	eventWarning = 2
+	eventInfo    = 4
+
+	hkeyLocalMachine = 0x80000002
+	keySetValue      = 0x0002
+	regExpandSz      = 2
+	regDword         = 4
+
+	eventLogKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+	// Provides the messages of the ids 1 to 1000, so the event viewer shows
+	// the reported strings as they are.
+	eventMessageFile = `%SystemRoot%\System32\EventCreate.exe`
+)
+
+var (
+	procRegisterEventSource   = modadvapi32.NewProc("RegisterEventSourceW")
+	procDeregisterEventSource = modadvapi32.NewProc("DeregisterEventSource")
+	procReportEvent           = modadvapi32.NewProc("ReportEventW")
+	procRegCreateKeyEx        = modadvapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueEx         = modadvapi32.NewProc("RegSetValueExW")
+)
+
+type eventLog struct {
+	h syscall.Handle
+}
+
+func openEventLog(source string) (*eventLog, error) {
+	// Not fatal, the events are still written without the message file
+	installEventSource(source)
+
+	name, err := syscall.UTF16PtrFromString(source)
+	if err != nil {
+		return nil, err
+	}
+	r, _, e := procRegisterEventSource.Call(0, uintptr(unsafe.Pointer(name)))
+	if r == 0 {
+		return nil, e
+	}
+	return &eventLog{h: syscall.Handle(r)}, nil
+}
+
+func (o *eventLog) report(etype uint16, id uint32, msg string) error {
+	s, err := syscall.UTF16PtrFromString(strings.Replace(msg, "\x00", "", -1))
+	if err != nil {
+		return err
+	}
+	r, _, e := procReportEvent.Call(uintptr(o.h), uintptr(etype), 0, uintptr(id), 0,
+		1, 0, uintptr(unsafe.Pointer(&s)), 0)
+	if r == 0 {
+		return e
+	}
+	return nil
+}
+
+func (o *eventLog) Close() error {
+	r, _, e := procDeregisterEventSource.Call(uintptr(o.h))
+	if r == 0 {
+		return e
+	}
+	return nil
+}
+
+// Register the source under the Application log, which needs the rights of
+// an administrator, as the service account LocalSystem has.
+func installEventSource(source string) error {
+	path, err := syscall.UTF16PtrFromString(eventLogKey + source)
+	if err != nil {
+		return err
+	}
+	var key syscall.Handle
+	r, _, _ := procRegCreateKeyEx.Call(hkeyLocalMachine, uintptr(unsafe.Pointer(path)), 0, 0, 0,
+		keySetValue, 0, uintptr(unsafe.Pointer(&key)), 0)
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+	defer syscall.RegCloseKey(key)
+
+	file, _ := syscall.UTF16FromString(eventMessageFile)
+	if err = setRegValue(key, "EventMessageFile", regExpandSz, unsafe.Pointer(&file[0]), len(file)*2); err != nil {
+		return err
+	}
+	types := uint32(eventError | eventWarning | eventInfo)
+	return setRegValue(key, "TypesSupported", regDword, unsafe.Pointer(&types), 4)
+}
+
+func setRegValue(key syscall.Handle, name string, vtype uint32, data unsafe.Pointer, size int) error {
+	n, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	r, _, _ := procRegSetValueEx.Call(uintptr(key), uintptr(unsafe.Pointer(n)), 0, uintptr(vtype),
+		uintptr(data), uintptr(size))
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+	return nil
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A small expression language for run_if, e.g.
+//
+//	facts.os == "linux" && facts.mem_gb > 8
+//	"gpu" in facts.tags || job("3dcb8bb9-...").exit_code == 0
+//
+// Values are numbers, strings, booleans, null, lists and maps. Strings in
+// double quotes have the escapes of go, those in single quotes are raw. The
+// operators are || && ! == != < <= > >= =~ (regexp match) and in (element of
+// a list or substring), with the usual precedence and parentheses. A
+// missing field of a map is null.
+
+type Expr interface {
+	eval(env *exprEnv) (interface{}, error)
+}
+
+type exprEnv struct {
+	vars  map[string]interface{}
+	funcs map[string]func(args []interface{}) (interface{}, error)
+}
+
+type (
+	exprLit   struct{ v interface{} }
+	exprVar   struct{ name string }
+	exprField struct{ x, key Expr }
+	exprCall  struct {
+		name string
+		args []Expr
+	}
+	exprNot    struct{ x Expr }
+	exprBinary struct {
+		op   string
+		l, r Expr
+	}
+)
+
+type exprParser struct {
+	toks []string
+	pos  int
+}
+
+// Parse the expression, the names are only resolved by the evaluation
+func ParseExpr(s string) (Expr, error) {
+	toks, err := exprTokens(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	x, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %s", p.toks[p.pos])
+	}
+	return x, nil
+}
+
+var exprOps = []string{"||", "&&", "==", "!=", "<=", ">=", "=~", "<", ">", "!", "(", ")", "[", "]", ".", ","}
+
+func exprTokens(s string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(s) && s[j] != c {
+				if s[j] == '\\' && c == '"' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, s[i:j+1])
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '-' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			j := i + 1
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.') {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		default:
+			op := ""
+			for _, o := range exprOps {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q", c)
+			}
+			toks = append(toks, op)
+			i += len(op)
+		}
+	}
+	return toks, nil
+}
+
+func (o *exprParser) peek() string {
+	if o.pos < len(o.toks) {
+		return o.toks[o.pos]
+	}
+	return ""
+}
+
+func (o *exprParser) expect(tok string) error {
+	if o.peek() != tok {
+		if o.peek() == "" {
+			return fmt.Errorf("missing %s", tok)
+		}
+		return fmt.Errorf("expected %s, got %s", tok, o.peek())
+	}
+	o.pos++
+	return nil
+}
+
+func (o *exprParser) or() (Expr, error) {
+	return o.binary([]string{"||"}, o.and)
+}
+
+func (o *exprParser) and() (Expr, error) {
+	return o.binary([]string{"&&"}, o.not)
+}
+
+func (o *exprParser) binary(ops []string, next func() (Expr, error)) (Expr, error) {
+	l, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := o.peek()
+		found := false
+		for _, x := range ops {
+			found = found || op == x
+		}
+		if !found {
+			return l, nil
+		}
+		o.pos++
+		r, err := next()
+		if err != nil {
+			return nil, err
+		}
+		l = &exprBinary{op: op, l: l, r: r}
+	}
+}
+
+func (o *exprParser) not() (Expr, error) {
+	if o.peek() == "!" {
+		o.pos++
+		x, err := o.not()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNot{x}, nil
+	}
+	return o.compare()
+}
+
+func (o *exprParser) compare() (Expr, error) {
+	l, err := o.postfix()
+	if err != nil {
+		return nil, err
+	}
+	switch op := o.peek(); op {
+	case "==", "!=", "<", "<=", ">", ">=", "=~", "in":
+		o.pos++
+		r, err := o.postfix()
+		if err != nil {
+			return nil, err
+		}
+		if lit, ok := r.(*exprLit); ok && op == "=~" {
+			s, _ := lit.v.(string)
+			if _, err := regexp.Compile(s); err != nil {
+				return nil, err
+			}
+		}
+		return &exprBinary{op: op, l: l, r: r}, nil
+	}
+	return l, nil
+}
+
+func (o *exprParser) postfix() (Expr, error) {
+	x, err := o.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch o.peek() {
+		case ".":
+			o.pos++
+			name := o.peek()
+			if !isExprIdent(name) {
+				return nil, fmt.Errorf("expected a field name after ., got %s", name)
+			}
+			o.pos++
+			x = &exprField{x, &exprLit{name}}
+		case "[":
+			o.pos++
+			key, err := o.or()
+			if err != nil {
+				return nil, err
+			}
+			if err = o.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &exprField{x, key}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (o *exprParser) primary() (Expr, error) {
+	tok := o.peek()
+	if tok == "" {
+		return nil, errors.New("unexpected end")
+	}
+	o.pos++
+	switch {
+	case tok == "(":
+		x, err := o.or()
+		if err != nil {
+			return nil, err
+		}
+		return x, o.expect(")")
+	case tok[0] == '"':
+		s, err := strconv.Unquote(tok)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", tok)
+		}
+		return &exprLit{s}, nil
+	case tok[0] == '\'':
+		// Raw, without escapes
+		return &exprLit{tok[1 : len(tok)-1]}, nil
+	case tok[0] == '-' || tok[0] >= '0' && tok[0] <= '9':
+		f, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", tok)
+		}
+		return &exprLit{f}, nil
+	case tok == "true" || tok == "false":
+		return &exprLit{tok == "true"}, nil
+	case tok == "null":
+		return &exprLit{nil}, nil
+	case isExprIdent(tok):
+		if o.peek() != "(" {
+			return &exprVar{tok}, nil
+		}
+		o.pos++
+		call := &exprCall{name: tok}
+		for o.peek() != ")" {
+			if len(call.args) > 0 {
+				if err := o.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := o.or()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+		}
+		o.pos++
+		return call, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", tok)
+}
+
+func isExprIdent(tok string) bool {
+	return tok != "" && (tok[0] == '_' || unicode.IsLetter(rune(tok[0]))) && tok != "in"
+}
+
+func (o *exprLit) eval(env *exprEnv) (interface{}, error) {
+	return o.v, nil
+}
+
+func (o *exprVar) eval(env *exprEnv) (interface{}, error) {
+	v, ok := env.vars[o.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown name %s", o.name)
+	}
+	return v, nil
+}
+
+func (o *exprField) eval(env *exprEnv) (interface{}, error) {
+	x, err := o.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	key, err := o.key.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch x := x.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		k, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("key of a map must be a string, got %v", key)
+		}
+		return x[k], nil
+	case []interface{}:
+		f, ok := key.(float64)
+		if !ok || f != float64(int(f)) {
+			return nil, fmt.Errorf("index of a list must be an integer, got %v", key)
+		}
+		if i := int(f); i >= 0 && i < len(x) {
+			return x[i], nil
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%v has no fields", x)
+}
+
+func (o *exprCall) eval(env *exprEnv) (interface{}, error) {
+	f := env.funcs[o.name]
+	if f == nil {
+		return nil, fmt.Errorf("unknown function %s", o.name)
+	}
+	args := make([]interface{}, len(o.args))
+	for i, a := range o.args {
+		v, err := a.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return f(args)
+}
+
+func (o *exprNot) eval(env *exprEnv) (interface{}, error) {
+	v, err := o.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("! needs a boolean, got %v", v)
+	}
+	return !b, nil
+}
+
+func (o *exprBinary) eval(env *exprEnv) (interface{}, error) {
+	l, err := o.l.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	// || and && short circuit
+	if o.op == "||" || o.op == "&&" {
+		lb, ok := l.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %v", o.op, l)
+		}
+		if lb == (o.op == "||") {
+			return lb, nil
+		}
+		r, err := o.r.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := r.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %v", o.op, r)
+		}
+		return rb, nil
+	}
+	r, err := o.r.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch o.op {
+	case "==":
+		return reflect.DeepEqual(l, r), nil
+	case "!=":
+		return !reflect.DeepEqual(l, r), nil
+	case "=~":
+		ls, ok1 := l.(string)
+		rs, ok2 := r.(string)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("=~ needs strings, got %v and %v", l, r)
+		}
+		re, err := regexp.Compile(rs)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(ls), nil
+	case "in":
+		switch r := r.(type) {
+		case []interface{}:
+			for _, e := range r {
+				if reflect.DeepEqual(l, e) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case string:
+			ls, ok := l.(string)
+			if !ok {
+				return nil, fmt.Errorf("in a string needs a string, got %v", l)
+			}
+			return strings.Contains(r, ls), nil
+		case nil:
+			return false, nil
+		}
+		return nil, fmt.Errorf("in needs a list or a string, got %v", r)
+	}
+	// The orderings of numbers or strings
+	var c int
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%s compares %v with %v", o.op, l, r)
+		}
+		c = compareFloats(lv, rv)
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s compares %v with %v", o.op, l, r)
+		}
+		c = strings.Compare(lv, rv)
+	default:
+		return nil, fmt.Errorf("%s compares %v with %v", o.op, l, r)
+	}
+	switch o.op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	}
+	return c >= 0, nil
+}
+
+func compareFloats(a, b float64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// Evaluate the expression to a boolean
+func EvalBool(x Expr, env *exprEnv) (bool, error) {
+	v, err := x.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("not a boolean: %v", v)
+	}
+	return b, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+)
+
+func TestEvalExpr(t *testing.T) {
+	env := &exprEnv{
+		vars: map[string]interface{}{"facts": map[string]interface{}{
+			"os":     "linux",
+			"mem_gb": 15.5,
+			"cpus":   8.0,
+			"tags":   []interface{}{"prod", "prod/db"},
+		}},
+		funcs: map[string]func([]interface{}) (interface{}, error){
+			"job": func(args []interface{}) (interface{}, error) {
+				if args[0] == "ok" {
+					return map[string]interface{}{"status": "finished", "exit_code": 0.0}, nil
+				}
+				return nil, nil
+			},
+		},
+	}
+	for _, c := range []struct {
+		expr string
+		want bool
+	}{
+		{`facts.os == "linux" && facts.mem_gb > 8`, true},
+		{`facts.os != 'linux' || facts.cpus >= 16`, false},
+		{`"prod" in facts.tags && !("dev" in facts.tags)`, true},
+		{`"inu" in facts.os`, true},
+		{`facts["os"] =~ "^lin" && facts.tags[1] == "prod/db"`, true},
+		{`facts.tags[5] == null && facts.gpu == null`, true},
+		{`"x" in facts.gpu`, false},
+		{`job("ok").exit_code == 0 && job("ok").status == "finished"`, true},
+		{`job("nope") == null`, true},
+		{`job("nope").exit_code == 0`, false},
+		{`"b" > "a" && -1 < 0 && 1.5 <= 1.5`, true},
+		// && binds tighter than ||
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		// Short circuits past a type error
+		{`false && facts.os > 1`, false},
+		{`"a\tb" == 'a\tb'`, false},
+	} {
+		x, err := ParseExpr(c.expr)
+		if err != nil {
+			t.Errorf("%s: %s", c.expr, err)
+			continue
+		}
+		if got, err := EvalBool(x, env); err != nil || got != c.want {
+			t.Errorf("%s: got %v, %v", c.expr, got, err)
+		}
+	}
+
+	// Refused by the parser
+	for _, s := range []string{``, `facts.os ==`, `(true`, `"open`, `facts.`, `a =~ "("`, `1 2`, `#`} {
+		if _, err := ParseExpr(s); err == nil {
+			t.Errorf("%q: no parse error", s)
+		}
+	}
+	// Refused by the evaluation
+	for _, s := range []string{`facts.os`, `host.os == "linux"`, `nope(1)`, `facts.os > 1`, `!facts.os`,
+		`facts.cpus && true`, `1 in facts.os`, `facts.os.name == 1`, `facts.tags[0.5] == 1`} {
+		x, err := ParseExpr(s)
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+			continue
+		}
+		if _, err := EvalBool(x, env); err == nil {
+			t.Errorf("%s: no eval error", s)
+		}
+	}
+
+	env.funcs["job"] = func([]interface{}) (interface{}, error) { return nil, errors.New("down") }
+	x, _ := ParseExpr(`job("a") == null`)
+	if _, err := EvalBool(x, env); err == nil || err.Error() != "down" {
+		t.Errorf("got %v", err)
+	}
+}
+
+// run_if against the facts of this host
+func TestEvalRunIf(t *testing.T) {
+	gApp.Cnf = NewConfig()
+	if ok, err := evalRunIf(`facts.os == "` + runtime.GOOS + `" && facts.cpus >= 1 && facts.hostname != ""`); err != nil || !ok {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	if ok, err := evalRunIf(`facts.os == "plan9"`); err != nil || ok {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	if _, err := evalRunIf(`facts.cpus`); err == nil {
+		t.Fatal("no error")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"runtime"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The facts of the host, which run_if of a job is evaluated against, and
+// /facts shows
+
+func hostFacts() map[string]interface{} {
+	host, _ := os.Hostname()
+	// With the ancestors of the hierarchical tags
+	var tags []interface{}
+	for _, t := range expandTags(gApp.Cnf.AgentTags()) {
+		tags = append(tags, t)
+	}
+	f := map[string]interface{}{
+		"os":       runtime.GOOS,
+		"arch":     runtime.GOARCH,
+		"hostname": host,
+		"cpus":     float64(runtime.NumCPU()),
+		"tags":     tags,
+		"version":  VERSION,
+	}
+	if s, err := readHostSample(); err == nil {
+		f["mem_gb"] = roundFact(float64(s.memory.Total) / (1 << 30))
+		f["mem_available_gb"] = roundFact(float64(s.memory.Available) / (1 << 30))
+		if len(s.load) > 0 {
+			f["load"] = s.load[0]
+		}
+	}
+	return f
+}
+
+func roundFact(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// The result of a job for run_if, null if not found
+func jobFact(args []interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errors.New("job() takes a job id")
+	}
+	id, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("job() takes a job id")
+	}
+	job := gJobBookkeeper.Get(id)
+	if job == nil {
+		return nil, nil
+	}
+	s := job.snapshot(false)
+	return map[string]interface{}{
+		"id":        s.Id,
+		"status":    string(s.Status),
+		"exit_code": float64(s.ExitCode),
+		"signal":    s.Signal,
+		"error":     s.Error,
+		"tenant":    s.Tenant,
+	}, nil
+}
+
+// Evaluate run_if of a job against the facts of the host and the results of
+// the other jobs
+func evalRunIf(runIf string) (bool, error) {
+	x, err := ParseExpr(runIf)
+	if err != nil {
+		return false, err
+	}
+	env := &exprEnv{
+		vars:  map[string]interface{}{"facts": hostFacts()},
+		funcs: map[string]func([]interface{}) (interface{}, error){"job": jobFact},
+	}
+	return EvalBool(x, env)
+}
+
+func FactsHandler(w http.ResponseWriter, r *http.Request) {
+	if expr := r.FormValue("eval"); expr != "" {
+		ok, err := evalRunIf(expr)
+		if err != nil {
+			log.Debugf("eval %s failed: %s", expr, err)
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+			return
+		}
+		ServeJSON(w, NewResponse().SetData(ok))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(hostFacts()))
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The filter of the jobs taken by /cmd/list, /cmd/list_ndjson, /cmd/cancel
+// and /cmd/delete, e.g.
+//
+//	status=failed,blocked AND label.app=web AND created>-24h
+//	NOT (tenant=ci OR cmd~"^make ")
+//
+// A term compares a field of the job with a value, by = != (a comma
+// separated list means any of them), ~ (regexp match), and < <= > >= for the
+// numbers and the times. A time is RFC3339, a date, or a duration relative
+// to now like -24h or -7d. AND binds tighter than OR, the keywords are case
+// insensitive, values with spaces or operators are double quoted.
+
+type JobFilter interface {
+	match(s *Job) bool
+}
+
+type (
+	filterAnd  struct{ l, r JobFilter }
+	filterOr   struct{ l, r JobFilter }
+	filterNot  struct{ x JobFilter }
+	filterTerm struct {
+		field string
+		kind  filterKind
+		get   func(s *Job) (interface{}, bool)
+		op    string
+		strs  []string
+		re    *regexp.Regexp
+		num   float64
+		time  time.Time
+	}
+)
+
+type filterKind int
+
+const (
+	fkString filterKind = iota
+	fkNumber
+	fkTime
+)
+
+type filterField struct {
+	kind filterKind
+	// The value of the job, false if it has none, e.g. the finish time of a
+	// running job
+	get func(s *Job) (interface{}, bool)
+}
+
+func stringField(f func(s *Job) string) filterField {
+	return filterField{fkString, func(s *Job) (interface{}, bool) { return f(s), true }}
+}
+
+func timeField(f func(s *Job) *time.Time) filterField {
+	return filterField{fkTime, func(s *Job) (interface{}, bool) {
+		t := f(s)
+		if t == nil {
+			return nil, false
+		}
+		return *t, true
+	}}
+}
+
+// The names of the labels of a job
+var labelName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+var filterFields = map[string]filterField{
+	"id":          stringField(func(s *Job) string { return s.Id }),
+	"status":      stringField(func(s *Job) string { return string(s.Status) }),
+	"tenant":      stringField(func(s *Job) string { return s.Tenant }),
+	"cmd":         stringField(func(s *Job) string { return s.Cmd }),
+	"dir":         stringField(func(s *Job) string { return s.Dir }),
+	"run_as":      stringField(func(s *Job) string { return s.RunAs }),
+	"error":       stringField(func(s *Job) string { return s.Error }),
+	"signal":      stringField(func(s *Job) string { return s.Signal }),
+	"group":       stringField(func(s *Job) string { return s.ConcurrencyGroup }),
+	"schedule_id": stringField(func(s *Job) string { return s.ScheduleId }),
+	"replay_of":   stringField(func(s *Job) string { return s.ReplayOf }),
+	"approved_by": stringField(func(s *Job) string { return s.ApprovedBy }),
+	"reason": stringField(func(s *Job) string {
+		if s.Reason == nil {
+			return ""
+		}
+		return s.Reason.Code
+	}),
+	"exit_code":  {fkNumber, func(s *Job) (interface{}, bool) { return float64(s.ExitCode), s.Timeline.FinishedAt != nil }},
+	"pid":        {fkNumber, func(s *Job) (interface{}, bool) { return float64(s.Pid), s.Pid != 0 }},
+	"seq":        {fkNumber, func(s *Job) (interface{}, bool) { return float64(s.Seq), true }},
+	"finish_seq": {fkNumber, func(s *Job) (interface{}, bool) { return float64(s.FinishSeq), s.FinishSeq != 0 }},
+	"created":    timeField(func(s *Job) *time.Time { return &s.CreateTime }),
+	"started":    timeField(func(s *Job) *time.Time { return s.Timeline.StartedAt }),
+	"finished":   timeField(func(s *Job) *time.Time { return s.Timeline.FinishedAt }),
+	"run_at":     timeField(func(s *Job) *time.Time { return s.RunAt }),
+}
+
+// The field by name, label.<name> is a label of the job
+func lookupFilterField(name string) (filterField, bool) {
+	if strings.HasPrefix(name, "label.") && len(name) > len("label.") {
+		key := name[len("label."):]
+		return stringField(func(s *Job) string { return s.Labels[key] }), true
+	}
+	f, ok := filterFields[name]
+	return f, ok
+}
+
+type filterParser struct {
+	toks []string
+	pos  int
+	now  time.Time
+}
+
+// Parse the filter, the relative times are taken from now
+func ParseJobFilter(s string, now time.Time) (JobFilter, error) {
+	toks, err := filterTokens(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return nil, errors.New("empty filter")
+	}
+	p := &filterParser{toks: toks, now: now}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %s", p.toks[p.pos])
+	}
+	return f, nil
+}
+
+var filterOps = []string{"!=", "<=", ">=", "=", "<", ">", "~", "(", ")"}
+
+// The characters ending a bare word
+const filterSpecials = " \t\n\r\"!=<>~()"
+
+func filterTokens(s string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, s[i:j+1])
+			i = j + 1
+		default:
+			op := ""
+			for _, o := range filterOps {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op != "" {
+				toks = append(toks, op)
+				i += len(op)
+				continue
+			}
+			j := i
+			for j < len(s) && !strings.ContainsRune(filterSpecials, rune(s[j])) {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected %q", c)
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+func (o *filterParser) peek() string {
+	if o.pos < len(o.toks) {
+		return o.toks[o.pos]
+	}
+	return ""
+}
+
+// The keyword, case insensitive
+func (o *filterParser) keyword(k string) bool {
+	if strings.EqualFold(o.peek(), k) {
+		o.pos++
+		return true
+	}
+	return false
+}
+
+func (o *filterParser) or() (JobFilter, error) {
+	l, err := o.and()
+	if err != nil {
+		return nil, err
+	}
+	for o.keyword("OR") {
+		r, err := o.and()
+		if err != nil {
+			return nil, err
+		}
+		l = &filterOr{l, r}
+	}
+	return l, nil
+}
+
+func (o *filterParser) and() (JobFilter, error) {
+	l, err := o.not()
+	if err != nil {
+		return nil, err
+	}
+	for o.keyword("AND") {
+		r, err := o.not()
+		if err != nil {
+			return nil, err
+		}
+		l = &filterAnd{l, r}
+	}
+	return l, nil
+}
+
+func (o *filterParser) not() (JobFilter, error) {
+	if o.keyword("NOT") {
+		x, err := o.not()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{x}, nil
+	}
+	if o.peek() == "(" {
+		o.pos++
+		x, err := o.or()
+		if err != nil {
+			return nil, err
+		}
+		if o.peek() != ")" {
+			return nil, errors.New("missing )")
+		}
+		o.pos++
+		return x, nil
+	}
+	return o.term()
+}
+
+func (o *filterParser) term() (JobFilter, error) {
+	name := o.peek()
+	if name == "" {
+		return nil, errors.New("unexpected end")
+	}
+	field, ok := lookupFilterField(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown field %s", name)
+	}
+	o.pos++
+	t := &filterTerm{field: name, kind: field.kind, get: field.get, op: o.peek()}
+	switch t.op {
+	case "=", "!=", "~", "<", "<=", ">", ">=":
+		o.pos++
+	default:
+		return nil, fmt.Errorf("expected an operator after %s", name)
+	}
+	tok := o.peek()
+	if tok == "" || tok == "(" || tok == ")" {
+		return nil, fmt.Errorf("expected a value after %s%s", name, t.op)
+	}
+	o.pos++
+	quoted := tok[0] == '"'
+	value := tok
+	if quoted {
+		var err error
+		if value, err = strconv.Unquote(tok); err != nil {
+			return nil, fmt.Errorf("invalid string %s", tok)
+		}
+	}
+	if err := t.parseValue(value, quoted, o.now); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (o *filterTerm) parseValue(value string, quoted bool, now time.Time) error {
+	if o.op == "~" {
+		if o.kind != fkString {
+			return fmt.Errorf("~ takes a string field, not %s", o.field)
+		}
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return fmt.Errorf("invalid regexp of %s: %s", o.field, err)
+		}
+		o.re = re
+		return nil
+	}
+	switch o.kind {
+	case fkString:
+		if o.op != "=" && o.op != "!=" {
+			return fmt.Errorf("%s takes a number or a time field, not %s", o.op, o.field)
+		}
+		// Any of the comma separated values, unless quoted
+		if quoted {
+			o.strs = []string{value}
+		} else {
+			o.strs = strings.Split(value, ",")
+		}
+	case fkNumber:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number of %s: %s", o.field, value)
+		}
+		o.num = f
+	case fkTime:
+		t, err := parseFilterTime(value, now)
+		if err != nil {
+			return fmt.Errorf("invalid time of %s: %s", o.field, value)
+		}
+		o.time = t
+	}
+	return nil
+}
+
+// RFC3339, a date of the local time, or a duration relative to now with the
+// units of go and d for days, e.g. -24h, -7d
+func parseFilterTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(time.Duration(days * float64(24*time.Hour))), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(d), nil
+}
+
+func (o *filterAnd) match(s *Job) bool { return o.l.match(s) && o.r.match(s) }
+func (o *filterOr) match(s *Job) bool  { return o.l.match(s) || o.r.match(s) }
+func (o *filterNot) match(s *Job) bool { return !o.x.match(s) }
+
+// A job without the value matches only !=
+func (o *filterTerm) match(s *Job) bool {
+	v, ok := o.get(s)
+	if !ok {
+		return o.op == "!="
+	}
+	if o.re != nil {
+		return o.re.MatchString(v.(string))
+	}
+	var c int
+	switch o.kind {
+	case fkString:
+		in := false
+		for _, x := range o.strs {
+			in = in || v.(string) == x
+		}
+		return in == (o.op == "=")
+	case fkNumber:
+		switch f := v.(float64); {
+		case f < o.num:
+			c = -1
+		case f > o.num:
+			c = 1
+		}
+	case fkTime:
+		c = v.(time.Time).Compare(o.time)
+	}
+	switch o.op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+// The filter of the request by the param filter, nil if absent
+func requestJobFilter(r *http.Request) (JobFilter, error) {
+	s := strings.TrimSpace(r.FormValue("filter"))
+	if s == "" {
+		return nil, nil
+	}
+	f, err := ParseJobFilter(s, time.Now())
+	if err != nil {
+		return nil, errors.New("invalid param filter: " + err.Error())
+	}
+	return f, nil
+}
+
+// Whether the job matches the filter, a nil filter matches all
+func matchJob(f JobFilter, j *Job) bool {
+	return f == nil || f.match(j.snapshot(false))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobFilter(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	hourAgo, dayAgo := now.Add(-time.Hour), now.Add(-24*time.Hour)
+	jobs := map[string]*Job{
+		"web": {Id: "web", Status: JSFinished, Tenant: "ci", Cmd: "make deploy", ExitCode: 0,
+			Labels: map[string]string{"app": "web"}, CreateTime: hourAgo, Timeline: JobTimeline{FinishedAt: &now}},
+		"db": {Id: "db", Status: JSFailed, Tenant: "ops", Cmd: "pg_dump db", ExitCode: 2,
+			Labels: map[string]string{"app": "db"}, CreateTime: dayAgo.Add(-time.Minute), Timeline: JobTimeline{FinishedAt: &hourAgo}},
+		"run": {Id: "run", Status: JSRunning, Tenant: "ci", Cmd: "sleep 60", Pid: 42, CreateTime: now},
+	}
+	for _, c := range []struct {
+		filter string
+		want   string
+	}{
+		{"status=finished", "web"},
+		{"status=failed,running", "db run"},
+		{"status!=failed,running", "web"},
+		{`status="failed,running"`, ""},
+		{"label.app=web OR tenant=ops", "db web"},
+		{"label.app!=web", "db run"},
+		{`cmd~"^make "`, "web"},
+		{"NOT (tenant=ci OR cmd~dump)", ""},
+		{"not tenant=ci and exit_code=2", "db"},
+		// AND binds tighter than OR
+		{"tenant=ops OR tenant=ci AND pid>0", "db run"},
+		{"(tenant=ops OR tenant=ci) AND pid>0", "run"},
+		// A running job has no exit code nor finish time, it matches only !=
+		{"exit_code!=0", "db run"},
+		{"exit_code>=0", "db web"},
+		{"finished<-30m", "db"},
+		{"created>-24h", "run web"},
+		{"created>-1d", "run web"},
+		{"created<2021-06-01T11:30:00Z", "db web"},
+		{"finished>=2021-06-01T12:00:00Z", "web"},
+	} {
+		f, err := ParseJobFilter(c.filter, now)
+		if err != nil {
+			t.Errorf("%s: %s", c.filter, err)
+			continue
+		}
+		var got []string
+		for _, id := range []string{"db", "run", "web"} {
+			if f.match(jobs[id]) {
+				got = append(got, id)
+			}
+		}
+		if strings.Join(got, " ") != c.want {
+			t.Errorf("%s: got %v, want %s", c.filter, got, c.want)
+		}
+	}
+
+	for _, s := range []string{"", "status", "status=", "nope=1", "status>1", "pid~1", "pid=x", "created>yesterday",
+		"cmd~(", "(status=failed", "status=failed)", "status=failed AND", `cmd="open`, "label.=x"} {
+		if _, err := ParseJobFilter(s, now); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Host firewall rules managed as structured objects, by iptables on linux and
+// the windows firewall on windows. Only the rules created by the agent are
+// listed and removed, they're marked by the name shell-agent:<name>. With
+// dry_run the commands are returned without being run.
+type FirewallRule struct {
+	Name      string `json:"name"`
+	Direction string `json:"direction"`          // in or out
+	Action    string `json:"action"`             // allow or deny
+	Protocol  string `json:"protocol,omitempty"` // tcp, udp, or any by default
+	Port      string `json:"port,omitempty"`     // The local port of in, the remote one of out, 22 or 8000-8100
+	Remote    string `json:"remote,omitempty"`   // An ip or a cidr
+}
+
+type FirewallReq struct {
+	Rule   FirewallRule `json:"rule"`
+	DryRun bool         `json:"dry_run,omitempty"`
+	// Add a rule cutting the agent off all the same
+	Force bool `json:"force,omitempty"`
+}
+
+type FirewallRes struct {
+	Commands []string `json:"commands"`
+	DryRun   bool     `json:"dry_run,omitempty"`
+}
+
+const firewallRulePrefix = "shell-agent:"
+
+var (
+	firewallNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+	firewallPortRe = regexp.MustCompile(`^([0-9]{1,5})(-([0-9]{1,5}))?$`)
+)
+
+func (o *FirewallRule) validate() error {
+	if !firewallNameRe.MatchString(o.Name) {
+		return errors.New("invalid param name, expect 1-64 letters, digits, _, . and -")
+	}
+	if o.Direction != "in" && o.Direction != "out" {
+		return errors.New("invalid param direction, expect in or out")
+	}
+	if o.Action != "allow" && o.Action != "deny" {
+		return errors.New("invalid param action, expect allow or deny")
+	}
+	if o.Protocol == "" {
+		o.Protocol = "any"
+	}
+	if o.Protocol != "tcp" && o.Protocol != "udp" && o.Protocol != "any" {
+		return errors.New("invalid param protocol, expect tcp, udp or any")
+	}
+	if o.Port != "" {
+		if o.Protocol == "any" {
+			return errors.New("param port needs protocol tcp or udp")
+		}
+		if _, _, err := o.portRange(); err != nil {
+			return err
+		}
+	}
+	if o.Remote != "" && net.ParseIP(o.Remote) == nil {
+		if _, _, err := net.ParseCIDR(o.Remote); err != nil {
+			return errors.New("invalid param remote, expect an ip or a cidr")
+		}
+	}
+	return nil
+}
+
+func (o *FirewallRule) portRange() (int, int, error) {
+	m := firewallPortRe.FindStringSubmatch(o.Port)
+	if m == nil {
+		return 0, 0, errors.New("invalid param port, expect 22 or 8000-8100")
+	}
+	lo, _ := strconv.Atoi(m[1])
+	hi := lo
+	if m[3] != "" {
+		hi, _ = strconv.Atoi(m[3])
+	}
+	if lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, errors.New("invalid param port, expect 1-65535")
+	}
+	return lo, hi, nil
+}
+
+// Whether the rule would deny the connections to the agent's own port
+func (o *FirewallRule) locksOut() bool {
+	if o.Direction != "in" || o.Action != "deny" || o.Protocol == "udp" {
+		return false
+	}
+	_, p, err := net.SplitHostPort(gApp.Cnf.Addr)
+	if err != nil {
+		return false
+	}
+	port, _ := strconv.Atoi(p)
+	if o.Port == "" {
+		return true
+	}
+	lo, hi, _ := o.portRange()
+	return port >= lo && port <= hi
+}
+
+func joinCommands(cmds [][]string) []string {
+	res := []string{}
+	for _, c := range cmds {
+		res = append(res, strings.Join(c, " "))
+	}
+	return res
+}
+
+// Run the commands in order, stop at the first failure
+func runCommands(cmds [][]string) error {
+	for _, c := range cmds {
+		if err := runTool(c[0], c[1:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler to list the rules created by the agent
+func ListFirewallHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := listFirewallRules()
+	if err != nil {
+		log.Errorf("list firewall rules failed: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(rules))
+}
+
+// Handler to add a rule, the rule of the same name is replaced
+func AddFirewallHandler(w http.ResponseWriter, r *http.Request) {
+	var req FirewallReq
+	if !parseJSONBody(w, r, &req) {
+		return
+	}
+	rule := &req.Rule
+	if err := rule.validate(); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	if rule.locksOut() && !req.Force {
+		ServeJSON(w, NewResponse().SetError(ECForbidden,
+			"the rule denies the agent's own port "+gApp.Cnf.Addr+", add force to do it all the same"))
+		return
+	}
+
+	cmds, err := removeFirewallCmds(rule.Name)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	add, err := addFirewallCmds(rule)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	cmds = append(cmds, add...)
+	serveFirewallCommands(w, r, cmds, req.DryRun, "firewall rule "+rule.Name+" added")
+}
+
+// Handler to remove a rule by name
+func RemoveFirewallHandler(w http.ResponseWriter, r *http.Request) {
+	var req FirewallReq
+	if !parseJSONBody(w, r, &req) {
+		return
+	}
+	name := req.Rule.Name
+	if !firewallNameRe.MatchString(name) {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid param name: "+name))
+		return
+	}
+	cmds, err := removeFirewallCmds(name)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	if len(cmds) == 0 {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "firewall rule not found: "+name))
+		return
+	}
+	serveFirewallCommands(w, r, cmds, req.DryRun, "firewall rule "+name+" removed")
+}
+
+func serveFirewallCommands(w http.ResponseWriter, r *http.Request, cmds [][]string, dryRun bool, what string) {
+	res := &FirewallRes{Commands: joinCommands(cmds), DryRun: dryRun}
+	if dryRun {
+		ServeJSON(w, NewResponse().SetData(res))
+		return
+	}
+	if err := runCommands(cmds); err != nil {
+		log.Errorf("%s failed: %s", what, err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	log.Infof("audit: %s by %s: %s", what, tokenTenant(RequestToken(r)), strings.Join(res.Commands, "; "))
+	ServeJSON(w, NewResponse().SetData(res))
+}
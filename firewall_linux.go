@@ -0,0 +1,156 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// The binaries for the rule, ip6tables too if the rule has no remote
+func iptablesBins(remote string) ([]string, error) {
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return nil, errors.New("iptables is not found, install it or iptables-nft")
+	}
+	ip := net.ParseIP(remote)
+	if ip == nil {
+		ip, _, _ = net.ParseCIDR(remote)
+	}
+	switch {
+	case ip != nil && ip.To4() == nil:
+		return []string{"ip6tables"}, nil
+	case ip != nil:
+		return []string{"iptables"}, nil
+	}
+	bins := []string{"iptables"}
+	if _, err := exec.LookPath("ip6tables"); err == nil {
+		bins = append(bins, "ip6tables")
+	}
+	return bins, nil
+}
+
+func addFirewallCmds(rule *FirewallRule) ([][]string, error) {
+	bins, err := iptablesBins(rule.Remote)
+	if err != nil {
+		return nil, err
+	}
+	chain, remote := "INPUT", "-s"
+	if rule.Direction == "out" {
+		chain, remote = "OUTPUT", "-d"
+	}
+	// Inserted first, so the rules appended by others don't shadow it
+	args := []string{"-I", chain, "1"}
+	if rule.Remote != "" {
+		args = append(args, remote, rule.Remote)
+	}
+	if rule.Protocol != "any" {
+		args = append(args, "-p", rule.Protocol)
+	}
+	if rule.Port != "" {
+		args = append(args, "--dport", strings.Replace(rule.Port, "-", ":", 1))
+	}
+	target := "ACCEPT"
+	if rule.Action == "deny" {
+		target = "DROP"
+	}
+	args = append(args, "-m", "comment", "--comment", firewallRulePrefix+rule.Name, "-j", target)
+
+	var cmds [][]string
+	for _, bin := range bins {
+		cmds = append(cmds, append([]string{bin}, args...))
+	}
+	return cmds, nil
+}
+
+// The managed rules of iptables -S by the binary, in the tokens of the rules
+func iptablesRules() (map[string][][]string, error) {
+	bins, err := iptablesBins("")
+	if err != nil {
+		return nil, err
+	}
+	rules := make(map[string][][]string)
+	for _, bin := range bins {
+		out, err := exec.Command(bin, "-S").Output()
+		if err != nil {
+			return nil, errors.New(bin + " -S: " + err.Error())
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if !strings.HasPrefix(line, "-A ") || !strings.Contains(line, firewallRulePrefix) {
+				continue
+			}
+			var tokens []string
+			for _, t := range strings.Fields(line) {
+				tokens = append(tokens, strings.Trim(t, `"`))
+			}
+			rules[bin] = append(rules[bin], tokens)
+		}
+	}
+	return rules, nil
+}
+
+func parseIptablesRule(tokens []string) *FirewallRule {
+	rule := &FirewallRule{Direction: "in", Action: "allow", Protocol: "any"}
+	for i := 0; i+1 < len(tokens); i++ {
+		v := tokens[i+1]
+		switch tokens[i] {
+		case "-A":
+			if v == "OUTPUT" {
+				rule.Direction = "out"
+			}
+		case "-s", "-d":
+			rule.Remote = strings.TrimSuffix(strings.TrimSuffix(v, "/32"), "/128")
+		case "-p":
+			rule.Protocol = v
+		case "--dport":
+			rule.Port = strings.Replace(v, ":", "-", 1)
+		case "--comment":
+			rule.Name = strings.TrimPrefix(v, firewallRulePrefix)
+		case "-j":
+			if v != "ACCEPT" {
+				rule.Action = "deny"
+			}
+		}
+	}
+	return rule
+}
+
+func listFirewallRules() ([]*FirewallRule, error) {
+	all, err := iptablesRules()
+	if err != nil {
+		return nil, err
+	}
+	res := []*FirewallRule{}
+	seen := make(map[string]bool)
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		for _, tokens := range all[bin] {
+			rule := parseIptablesRule(tokens)
+			// The same rule of both families is listed once
+			if !seen[rule.Name] {
+				seen[rule.Name] = true
+				res = append(res, rule)
+			}
+		}
+	}
+	return res, nil
+}
+
+func removeFirewallCmds(name string) ([][]string, error) {
+	all, err := iptablesRules()
+	if err != nil {
+		return nil, err
+	}
+	var cmds [][]string
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		for _, tokens := range all[bin] {
+			if parseIptablesRule(tokens).Name != name {
+				continue
+			}
+			cmd := append([]string{bin, "-D"}, tokens[1:]...)
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds, nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"errors"
+)
+
+var errFirewallUnsupported = errors.New("firewall rules are only supported on linux and windows")
+
+func addFirewallCmds(rule *FirewallRule) ([][]string, error) {
+	return nil, errFirewallUnsupported
+}
+
+func listFirewallRules() ([]*FirewallRule, error) {
+	return nil, errFirewallUnsupported
+}
+
+func removeFirewallCmds(name string) ([][]string, error) {
+	return nil, errFirewallUnsupported
+}
@@ -0,0 +1,112 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The rules with their filters, unlike netsh show rule the json isn't localized
+const firewallListScript = `$rules = @(Get-NetFirewallRule -DisplayName '` + firewallRulePrefix + `*' | ForEach-Object {
+	$p = $_ | Get-NetFirewallPortFilter
+	$a = $_ | Get-NetFirewallAddressFilter
+	[pscustomobject]@{
+		Name = $_.DisplayName; Direction = $_.Direction.ToString(); Action = $_.Action.ToString()
+		Protocol = $p.Protocol; LocalPort = $p.LocalPort; RemotePort = $p.RemotePort; RemoteAddress = $a.RemoteAddress
+	}
+})
+ConvertTo-Json -Compress -InputObject $rules`
+
+type windowsFirewallRule struct {
+	Name          string
+	Direction     string
+	Action        string
+	Protocol      string
+	LocalPort     interface{}
+	RemotePort    interface{}
+	RemoteAddress interface{}
+}
+
+func addFirewallCmds(rule *FirewallRule) ([][]string, error) {
+	action := "allow"
+	if rule.Action == "deny" {
+		action = "block"
+	}
+	cmd := []string{"netsh", "advfirewall", "firewall", "add", "rule", "name=" + firewallRulePrefix + rule.Name,
+		"dir=" + rule.Direction, "action=" + action, "protocol=" + rule.Protocol}
+	if rule.Port != "" {
+		if rule.Direction == "in" {
+			cmd = append(cmd, "localport="+rule.Port)
+		} else {
+			cmd = append(cmd, "remoteport="+rule.Port)
+		}
+	}
+	if rule.Remote != "" {
+		cmd = append(cmd, "remoteip="+rule.Remote)
+	}
+	return [][]string{cmd}, nil
+}
+
+// A single value of the filter, empty for Any
+func firewallFilterValue(v interface{}) string {
+	if a, ok := v.([]interface{}); ok {
+		var s []string
+		for _, e := range a {
+			s = append(s, fmt.Sprint(e))
+		}
+		v = strings.Join(s, ",")
+	}
+	s := fmt.Sprint(v)
+	if v == nil || strings.EqualFold(s, "any") {
+		return ""
+	}
+	return s
+}
+
+func listFirewallRules() ([]*FirewallRule, error) {
+	out, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", firewallListScript).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Get-NetFirewallRule: %s", err)
+	}
+	var rules []windowsFirewallRule
+	if err = json.Unmarshal(out, &rules); err != nil {
+		return nil, err
+	}
+	res := []*FirewallRule{}
+	for _, r := range rules {
+		rule := &FirewallRule{
+			Name:      strings.TrimPrefix(r.Name, firewallRulePrefix),
+			Direction: "in",
+			Action:    "allow",
+			Protocol:  strings.ToLower(r.Protocol),
+			Port:      firewallFilterValue(r.LocalPort),
+			Remote:    firewallFilterValue(r.RemoteAddress),
+		}
+		if r.Direction == "Outbound" {
+			rule.Direction = "out"
+			rule.Port = firewallFilterValue(r.RemotePort)
+		}
+		if r.Action != "Allow" {
+			rule.Action = "deny"
+		}
+		res = append(res, rule)
+	}
+	return res, nil
+}
+
+func removeFirewallCmds(name string) ([][]string, error) {
+	rules, err := listFirewallRules()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		if r.Name == name {
+			return [][]string{{"netsh", "advfirewall", "firewall", "delete", "rule", "name=" + firewallRulePrefix + name}}, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// /fs/watch streams the changes of the entries of dirs, as server-sent events
+// or over a websocket, so controllers react to host side changes without
+// polling by list jobs. The dirs are watched by inotify on linux and by
+// ReadDirectoryChangesW on windows, and polled every second elsewhere. The
+// subdirs are not watched.
+
+type FsEvent struct {
+	Time time.Time `json:"time"`
+	Path string    `json:"path"` // Under the dir as requested
+	Op   string    `json:"op"`
+}
+
+// The ops of the events
+const (
+	FsCreate = "create"
+	FsWrite  = "write"
+	FsRemove = "remove"
+	FsRename = "rename" // The old name, the new name comes as a create
+	// Events were lost, because the client or the os queue fell behind
+	FsOverflow = "overflow"
+)
+
+const (
+	fsWatchMaxPaths   = 64
+	fsWatchBufferSize = 1024
+	fsPollPeriod      = time.Second
+)
+
+// The watch of a dir, implemented by the platforms as
+//
+//	func newFsNotifier(dir, hostDir string, emit func(op, name string)) (fsNotifier, error)
+//
+// where emit gets the name of the entry changed, or "" for the dir itself.
+type fsNotifier interface {
+	Close()
+}
+
+type fsStream struct {
+	eventC    chan FsEvent
+	lost      int32
+	notifiers []fsNotifier
+}
+
+func newFsStream() *fsStream {
+	return &fsStream{eventC: make(chan FsEvent, fsWatchBufferSize)}
+}
+
+func (o *fsStream) watch(dir string) (ErrorCode, error) {
+	hostDir, err := JailPath(dir)
+	if err != nil {
+		return ECPathNotAllowed, err
+	}
+	fi, err := os.Stat(hostDir)
+	if os.IsNotExist(err) {
+		return ECFileNotFound, err
+	}
+	if err != nil {
+		return ECFileIOFailed, err
+	}
+	if !fi.IsDir() {
+		return ECInvalidParam, fmt.Errorf("not a dir: %s", dir)
+	}
+	n, err := newFsNotifier(dir, hostDir, func(op, name string) {
+		o.emit(FsEvent{Time: time.Now(), Path: filepath.Join(dir, name), Op: op})
+	})
+	if err != nil {
+		return ECFileIOFailed, err
+	}
+	o.notifiers = append(o.notifiers, n)
+	return ECSuccess, nil
+}
+
+// Never blocks the notifiers, the events are dropped when the buffer is full
+func (o *fsStream) emit(ev FsEvent) {
+	select {
+	case o.eventC <- ev:
+	default:
+		atomic.StoreInt32(&o.lost, 1)
+	}
+}
+
+// The next events to send, with an overflow event after a loss
+func (o *fsStream) next(ev FsEvent) []FsEvent {
+	if atomic.SwapInt32(&o.lost, 0) == 1 {
+		return []FsEvent{ev, {Time: time.Now(), Op: FsOverflow}}
+	}
+	return []FsEvent{ev}
+}
+
+func (o *fsStream) Close() {
+	for _, n := range o.notifiers {
+		n.Close()
+	}
+}
+
+// Handler to stream the changes of the dirs given by the path params, as
+// server-sent "fs" events, or as websocket text messages if upgraded
+func FsWatchHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	paths := r.Form["path"]
+	if len(paths) == 0 {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param path is empty"))
+		return
+	}
+	if len(paths) > fsWatchMaxPaths {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "more than "+strconv.Itoa(fsWatchMaxPaths)+" paths"))
+		return
+	}
+	s := newFsStream()
+	defer s.Close()
+	for _, p := range paths {
+		if errno, err := s.watch(p); err != nil {
+			ServeJSON(w, NewResponse().SetError(errno, err.Error()))
+			return
+		}
+	}
+	log.Infof("fs watch of %d dirs opened: %s", len(paths), r.RemoteAddr)
+	if IsWebsocketRequest(r) {
+		s.serveWebsocket(w, r)
+	} else {
+		s.serveSse(w, r)
+	}
+	log.Infof("fs watch closed: %s", r.RemoteAddr)
+}
+
+func (o *fsStream) serveSse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(ContentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	flush()
+
+	ticker := time.NewTicker(sseKeepalivePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-o.eventC:
+			for _, e := range o.next(ev) {
+				b, _ := json.Marshal(e)
+				if _, err := fmt.Fprintf(w, "event: fs\ndata: %s\n\n", b); err != nil {
+					return
+				}
+			}
+			flush()
+		case <-ticker.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flush()
+		case <-r.Context().Done():
+			return
+		case <-gHttpServer.quitC:
+			return
+		}
+	}
+}
+
+func (o *fsStream) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := UpgradeWebsocket(w, r)
+	if err != nil {
+		log.Errorf("websocket upgrade failed: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	// The client only closes, the read loop ends with the connection
+	closedC := make(chan struct{})
+	go func() {
+		defer close(closedC)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case ev := <-o.eventC:
+			for _, e := range o.next(ev) {
+				b, _ := json.Marshal(e)
+				if err := conn.WriteMessage(WsText, b); err != nil {
+					return
+				}
+			}
+		case <-closedC:
+			return
+		case <-gHttpServer.quitC:
+			conn.WriteMessage(wsClose, nil)
+			return
+		}
+	}
+}
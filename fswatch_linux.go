@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+type inotifyNotifier struct {
+	f *os.File
+}
+
+func newFsNotifier(dir, hostDir string, emit func(op, name string)) (fsNotifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	if _, err = syscall.InotifyAddWatch(fd, hostDir, inotifyMask); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+	// Non blocking, so the reads are on the poller and Close ends them
+	o := &inotifyNotifier{f: os.NewFile(uintptr(fd), "inotify")}
+	go o.read(dir, emit)
+	return o, nil
+}
+
+func (o *inotifyNotifier) Close() {
+	o.f.Close()
+}
+
+func (o *inotifyNotifier) read(dir string, emit func(op, name string)) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := o.f.Read(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "file already closed") {
+				log.Errorf("read inotify events of %s failed: %s", dir, err)
+			}
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			start := off + syscall.SizeofInotifyEvent
+			off = start + int(ev.Len)
+			name := strings.TrimRight(string(buf[start:off]), "\x00")
+			switch {
+			case ev.Mask&syscall.IN_Q_OVERFLOW != 0:
+				emit(FsOverflow, "")
+			case ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+				emit(FsCreate, name)
+			case ev.Mask&syscall.IN_MODIFY != 0:
+				emit(FsWrite, name)
+			case ev.Mask&syscall.IN_DELETE != 0:
+				emit(FsRemove, name)
+			case ev.Mask&syscall.IN_MOVED_FROM != 0:
+				emit(FsRename, name)
+			case ev.Mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0:
+				emit(FsRemove, "")
+			}
+		}
+	}
+}
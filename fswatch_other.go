@@ -0,0 +1,76 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"io/ioutil"
+	"time"
+)
+
+// Without a notification api here, the entries of the dir are polled
+
+type pollNotifier struct {
+	quitC chan struct{}
+}
+
+type polledEntry struct {
+	size    int64
+	modTime time.Time
+}
+
+func newFsNotifier(dir, hostDir string, emit func(op, name string)) (fsNotifier, error) {
+	entries, err := scanDir(hostDir)
+	if err != nil {
+		return nil, err
+	}
+	o := &pollNotifier{quitC: make(chan struct{})}
+	go o.poll(hostDir, entries, emit)
+	return o, nil
+}
+
+func (o *pollNotifier) Close() {
+	close(o.quitC)
+}
+
+func scanDir(dir string) (map[string]polledEntry, error) {
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]polledEntry, len(list))
+	for _, fi := range list {
+		res[fi.Name()] = polledEntry{size: fi.Size(), modTime: fi.ModTime()}
+	}
+	return res, nil
+}
+
+func (o *pollNotifier) poll(hostDir string, prev map[string]polledEntry, emit func(op, name string)) {
+	ticker := time.NewTicker(fsPollPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-o.quitC:
+			return
+		}
+		cur, err := scanDir(hostDir)
+		if err != nil {
+			emit(FsRemove, "")
+			return
+		}
+		for name, e := range cur {
+			if p, ok := prev[name]; !ok {
+				emit(FsCreate, name)
+			} else if p != e {
+				emit(FsWrite, name)
+			}
+		}
+		for name := range prev {
+			if _, ok := cur[name]; !ok {
+				emit(FsRemove, name)
+			}
+		}
+		prev = cur
+	}
+}
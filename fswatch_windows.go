@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const dirChangesMask = syscall.FILE_NOTIFY_CHANGE_FILE_NAME | syscall.FILE_NOTIFY_CHANGE_DIR_NAME |
+	syscall.FILE_NOTIFY_CHANGE_SIZE | syscall.FILE_NOTIFY_CHANGE_LAST_WRITE
+
+var procGetOverlappedResult = modkernel32.NewProc("GetOverlappedResult")
+
+type dirChangesNotifier struct {
+	h      syscall.Handle
+	closed int32
+}
+
+func newFsNotifier(dir, hostDir string, emit func(op, name string)) (fsNotifier, error) {
+	p, err := syscall.UTF16PtrFromString(hostDir)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(p, syscall.FILE_LIST_DIRECTORY,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE, nil,
+		syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS|syscall.FILE_FLAG_OVERLAPPED, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("CreateFile", err)
+	}
+	o := &dirChangesNotifier{h: h}
+	go o.read(dir, emit)
+	return o, nil
+}
+
+// Cancel the pending read, which then closes the handle
+func (o *dirChangesNotifier) Close() {
+	atomic.StoreInt32(&o.closed, 1)
+	syscall.CancelIoEx(o.h, nil)
+}
+
+func (o *dirChangesNotifier) read(dir string, emit func(op, name string)) {
+	defer syscall.CloseHandle(o.h)
+
+	// DWORD aligned, as ReadDirectoryChangesW requires
+	buf := make([]uint32, 16<<10)
+	for atomic.LoadInt32(&o.closed) == 0 {
+		// Without an event, the result is waited on the handle
+		ov := &syscall.Overlapped{}
+		var n uint32
+		err := syscall.ReadDirectoryChanges(o.h, (*byte)(unsafe.Pointer(&buf[0])), uint32(len(buf)*4),
+			false, dirChangesMask, nil, ov, 0)
+		if err == nil {
+			err = getOverlappedResult(o.h, ov, &n)
+		}
+		if err == syscall.ERROR_OPERATION_ABORTED {
+			return
+		}
+		if err != nil {
+			log.Errorf("watch changes of %s failed: %s", dir, err)
+			emit(FsRemove, "")
+			return
+		}
+		if n == 0 {
+			// The changes didn't fit the buffer
+			emit(FsOverflow, "")
+			continue
+		}
+
+		b := (*[64 << 10]byte)(unsafe.Pointer(&buf[0]))[:n:n]
+		for off := uint32(0); off < n; {
+			info := (*syscall.FileNotifyInformation)(unsafe.Pointer(&b[off]))
+			l := info.FileNameLength / 2
+			name := syscall.UTF16ToString((*[32 << 10]uint16)(unsafe.Pointer(&info.FileName))[:l:l])
+			switch info.Action {
+			case syscall.FILE_ACTION_ADDED, syscall.FILE_ACTION_RENAMED_NEW_NAME:
+				emit(FsCreate, name)
+			case syscall.FILE_ACTION_MODIFIED:
+				emit(FsWrite, name)
+			case syscall.FILE_ACTION_REMOVED:
+				emit(FsRemove, name)
+			case syscall.FILE_ACTION_RENAMED_OLD_NAME:
+				emit(FsRename, name)
+			}
+			if info.NextEntryOffset == 0 {
+				break
+			}
+			off += info.NextEntryOffset
+		}
+	}
+}
+
+// Wait for the overlapped io to complete
+func getOverlappedResult(h syscall.Handle, ov *syscall.Overlapped, n *uint32) error {
+	r, _, err := procGetOverlappedResult.Call(uintptr(h), uintptr(unsafe.Pointer(ov)), uintptr(unsafe.Pointer(n)), 1)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
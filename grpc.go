@@ -0,0 +1,567 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The cmd api served over grpc as the service of shellagent.proto, beside
+// the http api on the same address. The grpc clients need http/2, which the
+// server speaks over tls only, so it's served when tls_cert is set. The
+// requests are authenticated by the same bearer tokens, sent as the metadata
+// "authorization", and the jobs are not forwarded to the peers. The browsers
+// and the http/1.1 clients call it by gRPC-Web or Connect, see grpcweb.go.
+
+const (
+	grpcUrlPrefix      = "/shellagent.v1.ShellAgent/"
+	grpcContentType    = "application/grpc"
+	grpcMaxMessageSize = 4 << 20
+)
+
+// The status codes of grpc used
+const (
+	grpcOK                 = 0
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcAborted            = 10
+	grpcUnimplemented      = 12
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// The errno of the failed call, as it's returned by the http api
+const grpcErrnoTrailer = "X-Shell-Agent-Errno"
+
+type grpcError struct {
+	code  int
+	errno ErrorCode
+	msg   string
+}
+
+func (o *grpcError) Error() string {
+	return o.msg
+}
+
+func newGrpcError(errno ErrorCode, msg string) error {
+	return &grpcError{code: grpcCode(errno), errno: errno, msg: msg}
+}
+
+// A call of the service by grpc, gRPC-Web or Connect
+func IsGrpcRequest(r *http.Request) bool {
+	protocol, _ := grpcProtocol(r)
+	return protocol >= 0
+}
+
+func grpcCode(errno ErrorCode) int {
+	switch errno {
+	case ECSuccess:
+		return grpcOK
+	case ECInvalidParam:
+		return grpcInvalidArgument
+	case ECJobNotFound:
+		return grpcNotFound
+	case ECForbidden, ECPathNotAllowed:
+		return grpcPermissionDenied
+	case ECMemoryLimit, ECQueueFull:
+		return grpcResourceExhausted
+	case ECJobNotRunning, ECNoPeer:
+		return grpcFailedPrecondition
+	case ECSubscriberDropped:
+		return grpcAborted
+	case ECUnauthorized:
+		return grpcUnauthenticated
+	}
+	return grpcUnknown
+}
+
+// The grpc-message is percent encoded but the printable ascii
+func grpcEncodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// The response of a call: the messages, then the status in the trailers, or
+// in the headers if the call fails before any message. By gRPC-Web the
+// trailers are the last frame, by Connect the status is the end-stream
+// message, or the http status and the body of a unary call.
+type grpcStream struct {
+	w        http.ResponseWriter
+	flusher  http.Flusher
+	protocol int
+	json     bool
+	res      []pbJsonField // The response message of the method, for json
+	started  bool
+	unary    []byte // The response of a unary connect call, written by Finish
+}
+
+func newGrpcStream(w http.ResponseWriter, r *http.Request) *grpcStream {
+	o := &grpcStream{w: w}
+	o.protocol, o.json = grpcProtocol(r)
+	if o.protocol < 0 {
+		o.protocol, o.json = protoGrpc, false
+	}
+	if o.protocol == protoGrpc {
+		w.Header().Set(ContentType, grpcContentType)
+	} else {
+		w.Header().Set(ContentType, strings.TrimSpace(strings.SplitN(r.Header.Get(ContentType), ";", 2)[0]))
+	}
+	o.flusher, _ = w.(http.Flusher)
+	return o
+}
+
+func (o *grpcStream) Send(m *pbWriter) error {
+	b := m.buf
+	if o.json {
+		var err error
+		if b, err = pbToJson(o.res, b); err != nil {
+			return err
+		}
+	}
+	if o.protocol == protoConnect {
+		o.unary = b
+		return nil
+	}
+	return o.writeFrame(0, b)
+}
+
+func (o *grpcStream) writeFrame(flags byte, b []byte) error {
+	if !o.started {
+		o.started = true
+		o.w.WriteHeader(http.StatusOK)
+	}
+	frame := make([]byte, 5, 5+len(b))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(b)))
+	frame = append(frame, b...)
+	if o.protocol == protoGrpcWebText {
+		frame = []byte(base64.StdEncoding.EncodeToString(frame))
+	}
+	if _, err := o.w.Write(frame); err != nil {
+		return err
+	}
+	if o.flusher != nil {
+		o.flusher.Flush()
+	}
+	return nil
+}
+
+// End the call with the status of the error, nil is ok
+func (o *grpcStream) Finish(err error) {
+	code, errno, msg := grpcOK, ECSuccess, ""
+	if err != nil {
+		code, errno, msg = grpcUnknown, ECUnknown, err.Error()
+		if e, ok := err.(*grpcError); ok {
+			code, errno = e.code, e.errno
+		}
+	}
+	switch o.protocol {
+	case protoGrpcWeb, protoGrpcWebText:
+		o.writeFrame(grpcWebTrailerFlag, grpcWebTrailers(code, errno, msg))
+		return
+	case protoConnectStream:
+		o.writeFrame(connectEndStreamFlag, connectEndStream(code, errno, msg))
+		return
+	case protoConnect:
+		o.finishConnect(code, errno, msg)
+		return
+	}
+	prefix := http.TrailerPrefix
+	if !o.started {
+		prefix = ""
+	}
+	h := o.w.Header()
+	h.Set(prefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		h.Set(prefix+"Grpc-Message", grpcEncodeMessage(msg))
+	}
+	if errno != ECSuccess {
+		h.Set(prefix+grpcErrnoTrailer, strconv.Itoa(int(errno)))
+	}
+	if !o.started {
+		o.started = true
+		o.w.WriteHeader(http.StatusOK)
+	}
+}
+
+// The response of a unary connect call, or its error as json
+func (o *grpcStream) finishConnect(code int, errno ErrorCode, msg string) {
+	if code == grpcOK {
+		o.w.WriteHeader(http.StatusOK)
+		o.w.Write(o.unary)
+		return
+	}
+	e, status := newConnectError(code, msg)
+	b, _ := json.Marshal(e)
+	o.w.Header().Set(ContentType, JsonContentType)
+	o.w.Header().Set(grpcErrnoTrailer, strconv.Itoa(int(errno)))
+	o.w.WriteHeader(status)
+	o.w.Write(b)
+}
+
+// Reply a call which fails before reaching its handler, e.g. by the auth
+func serveGrpcError(w http.ResponseWriter, r *http.Request, errno ErrorCode, msg string) {
+	newGrpcStream(w, r).Finish(newGrpcError(errno, msg))
+}
+
+// Read the request message, un-enveloped by a unary connect call, and turn
+// the json into protobuf
+func (o *grpcStream) readRequest(r io.Reader, schema []pbJsonField) ([]byte, error) {
+	var b []byte
+	var err error
+	switch o.protocol {
+	case protoConnect:
+		if b, err = ioutil.ReadAll(io.LimitReader(r, grpcMaxMessageSize+1)); err != nil {
+			return nil, newGrpcError(ECInvalidParam, "truncated request message")
+		}
+		if len(b) > grpcMaxMessageSize {
+			return nil, newGrpcError(ECInvalidParam, fmt.Sprintf("request message larger than %d bytes", grpcMaxMessageSize))
+		}
+	case protoGrpcWebText:
+		b, err = readGrpcMessage(base64.NewDecoder(base64.StdEncoding, r))
+	default:
+		b, err = readGrpcMessage(r)
+	}
+	if err != nil || !o.json {
+		return b, err
+	}
+	if b, err = pbFromJson(schema, b); err != nil {
+		return nil, newGrpcError(ECInvalidParam, "invalid request message: "+err.Error())
+	}
+	return b, nil
+}
+
+// Read the request message of a unary call
+func readGrpcMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, newGrpcError(ECInvalidParam, "missing request message")
+	}
+	if prefix[0] != 0 {
+		return nil, newGrpcError(ECInvalidParam, "compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > grpcMaxMessageSize {
+		return nil, newGrpcError(ECInvalidParam, fmt.Sprintf("request message larger than %d bytes", grpcMaxMessageSize))
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, newGrpcError(ECInvalidParam, "truncated request message")
+	}
+	return b, nil
+}
+
+type grpcMethod struct {
+	handler   func(*http.Request, *grpcStream, []pbField) error
+	req, res  []pbJsonField
+	streaming bool
+}
+
+// The methods of the service by name
+var grpcMethods = map[string]grpcMethod{
+	"RunCmd":       {grpcRunCmd, pbjRunCmdRequest, pbjJob, false},
+	"QueryCmd":     {grpcQueryCmd, pbjIdRequest, pbjJob, false},
+	"ListCmd":      {grpcListCmd, pbjListCmdRequest, pbjListCmdResponse, false},
+	"CancelCmd":    {grpcCancelCmd, pbjIdRequest, pbjCancelCmdResponse, false},
+	"StreamOutput": {grpcStreamOutput, pbjStreamOutputRequest, pbjJobOutput, true},
+}
+
+// Handler of the calls of the grpc service
+func GrpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !IsGrpcRequest(r) {
+		http.Error(w, "grpc requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	defer r.Body.Close()
+	s := newGrpcStream(w, r)
+	method := strings.TrimPrefix(r.URL.Path, grpcUrlPrefix)
+	m, ok := grpcMethods[method]
+	if !ok {
+		s.Finish(&grpcError{code: grpcUnimplemented, errno: ECInvalidParam, msg: "unknown method: " + method})
+		return
+	}
+	s.res = m.res
+	if m.streaming && s.protocol == protoConnect {
+		s.Finish(newGrpcError(ECInvalidParam, method+" streams, call it by application/connect+proto or application/connect+json"))
+		return
+	}
+	if enc := r.Header.Get(grpcEncodingHeader(s.protocol)); enc != "" && enc != "identity" {
+		s.Finish(newGrpcError(ECInvalidParam, "encoding not supported: "+enc))
+		return
+	}
+	body, err := s.readRequest(r.Body, m.req)
+	if err != nil {
+		s.Finish(err)
+		return
+	}
+	fields, err := pbFields(body)
+	if err != nil {
+		s.Finish(newGrpcError(ECInvalidParam, err.Error()))
+		return
+	}
+	s.Finish(m.handler(r, s, fields))
+}
+
+// The request of the body of /cmd/run in extra_json, with the typed fields
+// set over it
+func grpcRunCmdReq(fields []pbField) (*RunCmdReq, error) {
+	body := make(map[string]interface{})
+	labels := make(map[string]string)
+	var env []string
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			body["cmd"] = f.String()
+		case 2:
+			body["script"] = f.String()
+		case 3:
+			body["run_as"] = f.String()
+		case 4:
+			body["dir"] = f.String()
+		case 5:
+			env = append(env, f.String())
+		case 6:
+			body["async"] = f.Bool()
+		case 7:
+			body["idle_timeout_seconds"] = int32(f.Value)
+		case 8:
+			if err := pbMapEntry(f.Data, labels); err != nil {
+				return nil, err
+			}
+		case 9:
+			body["profile"] = f.String()
+		}
+	}
+	for _, f := range fields {
+		if f.Num != 15 || len(f.Data) == 0 {
+			continue
+		}
+		var extra map[string]interface{}
+		if err := json.Unmarshal(f.Data, &extra); err != nil {
+			return nil, errors.New("invalid extra_json: " + err.Error())
+		}
+		for k, v := range extra {
+			if _, ok := body[k]; !ok {
+				body[k] = v
+			}
+		}
+	}
+	if env != nil {
+		body["env"] = env
+	}
+	if len(labels) > 0 {
+		body["labels"] = labels
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	var req RunCmdReq
+	if err = decodeRunCmdReq(b, &req); err != nil {
+		return nil, err
+	}
+	if err = req.validate(); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func grpcRunCmd(r *http.Request, s *grpcStream, fields []pbField) error {
+	req, err := grpcRunCmdReq(fields)
+	if err != nil {
+		return newGrpcError(ECInvalidParam, err.Error())
+	}
+	tok := RequestToken(r)
+	if err := checkRunAs(tok, req.RunAs); err != nil {
+		return newGrpcError(ECForbidden, err.Error())
+	}
+	job, err := startJob(req, tokenTenant(tok))
+	if err != nil {
+		return newGrpcError(newJobErrno(err), err.Error())
+	}
+	if !req.Async {
+		select {
+		case <-job.Done():
+		case <-r.Context().Done():
+			return newGrpcError(ECUnknown, "call canceled, job "+job.Id+" goes on")
+		}
+	}
+	return s.Send(grpcJob(job.Snapshot()))
+}
+
+// The only string field of the requests by id
+func grpcRequestId(fields []pbField) (string, error) {
+	var id string
+	for _, f := range fields {
+		if f.Num == 1 {
+			id = strings.TrimSpace(f.String())
+		}
+	}
+	if id == "" {
+		return "", newGrpcError(ECInvalidParam, "param id is empty")
+	}
+	return id, nil
+}
+
+func grpcQueryCmd(r *http.Request, s *grpcStream, fields []pbField) error {
+	id, err := grpcRequestId(fields)
+	if err != nil {
+		return err
+	}
+	job := gJobBookkeeper.Snapshot(id)
+	if job == nil || !canManageJob(RequestToken(r), job) {
+		return newGrpcError(ECJobNotFound, "job not found: "+id)
+	}
+	return s.Send(grpcJob(job))
+}
+
+func grpcListCmd(r *http.Request, s *grpcStream, fields []pbField) error {
+	var filter JobFilter
+	for _, f := range fields {
+		if f.Num != 1 || strings.TrimSpace(f.String()) == "" {
+			continue
+		}
+		var err error
+		if filter, err = ParseJobFilter(strings.TrimSpace(f.String()), time.Now()); err != nil {
+			return newGrpcError(ECInvalidParam, "invalid param filter: "+err.Error())
+		}
+	}
+	tok := RequestToken(r)
+	var res pbWriter
+	for _, j := range gJobBookkeeper.Snapshots() {
+		if canManageJob(tok, j) && (filter == nil || filter.match(j)) {
+			res.Message(1, grpcJob(j))
+		}
+	}
+	if len(res.buf) > grpcMaxMessageSize {
+		return newGrpcError(ECInvalidParam, "too many jobs, narrow them by the filter")
+	}
+	return s.Send(&res)
+}
+
+func grpcCancelCmd(r *http.Request, s *grpcStream, fields []pbField) error {
+	id, err := grpcRequestId(fields)
+	if err != nil {
+		return err
+	}
+	if errno, err := cancelJob(id, RequestToken(r)); err != nil {
+		return newGrpcError(errno, err.Error())
+	}
+	log.Infof("audit: job %s canceled over grpc by %s", id, tokenTenant(RequestToken(r)))
+	return s.Send(&pbWriter{})
+}
+
+// Stream the output of the job from its start, or past the offsets the
+// client has got, then the job once finished
+func grpcStreamOutput(r *http.Request, s *grpcStream, fields []pbField) error {
+	id, err := grpcRequestId(fields)
+	if err != nil {
+		return err
+	}
+	job := managedJob(id, RequestToken(r))
+	if job == nil {
+		return newGrpcError(ECJobNotFound, "job not found: "+id)
+	}
+	var stdout, stderr int64
+	for _, f := range fields {
+		switch f.Num {
+		case 2:
+			stdout = int64(f.Value)
+		case 3:
+			stderr = int64(f.Value)
+		}
+	}
+	offsets, err := outputOffsets(job, stdout, stderr)
+	if err != nil {
+		return newGrpcError(ECInvalidParam, err.Error())
+	}
+	backlog, c := job.Subscribe()
+	defer job.Unsubscribe(c)
+
+	send := func(chunk OutputChunk) error {
+		chunk, ok := chunkAfter(chunk, offsets)
+		if !ok {
+			return nil
+		}
+		var m pbWriter
+		m.String(1, id)
+		m.String(2, chunk.Stream)
+		m.Bytes(3, []byte(chunk.Data))
+		m.Int(4, chunk.Offset)
+		m.Time(5, chunk.Time)
+		return s.Send(&m)
+	}
+	for _, chunk := range backlog {
+		if err := send(chunk); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case chunk, ok := <-c:
+			if ok {
+				if err := send(chunk); err != nil {
+					return err
+				}
+				continue
+			}
+			if !job.Finished() {
+				return newGrpcError(ECSubscriberDropped, "output subscriber too slow, dropped")
+			}
+			<-job.Done()
+			var m pbWriter
+			m.String(1, id)
+			m.Message(6, grpcJob(job.Snapshot()))
+			return s.Send(&m)
+		case <-r.Context().Done():
+			return r.Context().Err()
+		case <-gHttpServer.quitC:
+			return &grpcError{code: grpcUnavailable, errno: ECUnknown, msg: "agent quitting"}
+		}
+	}
+}
+
+// The job message of a snapshot
+func grpcJob(j *Job) *pbWriter {
+	var m pbWriter
+	m.String(1, j.Id)
+	m.String(2, string(j.Status))
+	m.String(3, j.Cmd)
+	m.Int(4, int64(int32(j.ExitCode)))
+	m.String(5, j.Error)
+	m.String(6, j.Stdout)
+	m.String(7, j.Stderr)
+	m.Int(8, int64(j.Pid))
+	m.String(9, j.Tenant)
+	m.Time(10, j.CreateTime)
+	m.Time(11, j.FinishTime)
+	m.StringMap(12, j.Labels)
+	m.Int(13, j.Seq)
+	if b, err := json.Marshal(j); err == nil {
+		m.Bytes(15, b)
+	}
+	return &m
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The service of grpc.go also served to the browsers and the plain http
+// clients, over http/1.1 as well: gRPC-Web in binary or base64 text, and the
+// Connect protocol, unary calls with an un-enveloped body and streaming ones
+// with an end-stream message. The messages are in protobuf or in the json
+// mapping of proto3, by the content type.
+
+// The protocols of the calls
+const (
+	protoGrpc = iota
+	protoGrpcWeb
+	protoGrpcWebText
+	protoConnect
+	protoConnectStream
+)
+
+// The flags of the frames beside a message
+const (
+	grpcWebTrailerFlag   = 0x80
+	connectEndStreamFlag = 0x02
+)
+
+// The protocol of a call and whether its messages are in json by the content
+// type, -1 if it's not a call
+func grpcProtocol(r *http.Request) (int, bool) {
+	ct := strings.ToLower(r.Header.Get(ContentType))
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+	ct = strings.TrimSpace(ct)
+	base, codec := ct, "proto"
+	if i := strings.IndexByte(ct, '+'); i >= 0 {
+		base, codec = ct[:i], ct[i+1:]
+	}
+	protocol := -1
+	switch base {
+	case grpcContentType:
+		protocol = protoGrpc
+	case "application/grpc-web":
+		protocol = protoGrpcWeb
+	case "application/grpc-web-text":
+		protocol = protoGrpcWebText
+	case "application/connect":
+		protocol = protoConnectStream
+	case "application/proto", "application/json":
+		if strings.HasPrefix(r.URL.Path, grpcUrlPrefix) {
+			protocol, codec = protoConnect, strings.TrimPrefix(base, "application/")
+		}
+	}
+	if codec != "proto" && codec != "json" {
+		return -1, false
+	}
+	return protocol, codec == "json"
+}
+
+// The header of the compression of the request messages
+func grpcEncodingHeader(protocol int) string {
+	switch protocol {
+	case protoConnect:
+		return "Content-Encoding"
+	case protoConnectStream:
+		return "Connect-Content-Encoding"
+	}
+	return "Grpc-Encoding"
+}
+
+// The codes of connect and their http status by the grpc codes
+var connectCodes = map[int]struct {
+	name   string
+	status int
+}{
+	grpcUnknown:            {"unknown", http.StatusInternalServerError},
+	grpcInvalidArgument:    {"invalid_argument", http.StatusBadRequest},
+	grpcNotFound:           {"not_found", http.StatusNotFound},
+	grpcPermissionDenied:   {"permission_denied", http.StatusForbidden},
+	grpcResourceExhausted:  {"resource_exhausted", http.StatusTooManyRequests},
+	grpcFailedPrecondition: {"failed_precondition", http.StatusBadRequest},
+	grpcAborted:            {"aborted", http.StatusConflict},
+	grpcUnimplemented:      {"unimplemented", http.StatusNotImplemented},
+	grpcUnavailable:        {"unavailable", http.StatusServiceUnavailable},
+	grpcUnauthenticated:    {"unauthenticated", http.StatusUnauthorized},
+}
+
+type connectError struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// The error of a failed connect call, with the errno as its metadata
+func newConnectError(code int, msg string) (*connectError, int) {
+	c, ok := connectCodes[code]
+	if !ok {
+		c = connectCodes[grpcUnknown]
+	}
+	return &connectError{Code: c.name, Message: msg}, c.status
+}
+
+// The trailers of a grpc-web call as the last frame
+func grpcWebTrailers(code int, errno ErrorCode, msg string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "grpc-status: %d\r\n", code)
+	if msg != "" {
+		fmt.Fprintf(&b, "grpc-message: %s\r\n", grpcEncodeMessage(msg))
+	}
+	if errno != ECSuccess {
+		fmt.Fprintf(&b, "%s: %d\r\n", strings.ToLower(grpcErrnoTrailer), errno)
+	}
+	return []byte(b.String())
+}
+
+// The end-stream message of a streaming connect call
+func connectEndStream(code int, errno ErrorCode, msg string) []byte {
+	end := make(map[string]interface{})
+	if code != grpcOK {
+		end["error"], _ = newConnectError(code, msg)
+		end["metadata"] = map[string][]string{strings.ToLower(grpcErrnoTrailer): {strconv.Itoa(int(errno))}}
+	}
+	b, _ := json.Marshal(end)
+	return b
+}
+
+// The kinds of the fields by their json mapping
+const (
+	pbjString = iota
+	pbjBytes
+	pbjBool
+	pbjInt32
+	pbjInt64
+	pbjTime
+	pbjMap
+	pbjMessage
+)
+
+// A field of a message of shellagent.proto for the json mapping: its name in
+// the proto, the json name is the lowerCamelCase of it
+type pbJsonField struct {
+	Num      int
+	Name     string
+	Kind     int
+	Repeated bool
+	Message  []pbJsonField
+}
+
+var (
+	pbjRunCmdRequest = []pbJsonField{
+		{Num: 1, Name: "cmd"},
+		{Num: 2, Name: "script"},
+		{Num: 3, Name: "run_as"},
+		{Num: 4, Name: "dir"},
+		{Num: 5, Name: "env", Repeated: true},
+		{Num: 6, Name: "async", Kind: pbjBool},
+		{Num: 7, Name: "idle_timeout_seconds", Kind: pbjInt32},
+		{Num: 8, Name: "labels", Kind: pbjMap},
+		{Num: 9, Name: "profile"},
+		{Num: 15, Name: "extra_json"},
+	}
+	pbjIdRequest           = []pbJsonField{{Num: 1, Name: "id"}}
+	pbjListCmdRequest      = []pbJsonField{{Num: 1, Name: "filter"}}
+	pbjCancelCmdResponse   = []pbJsonField{}
+	pbjStreamOutputRequest = []pbJsonField{
+		{Num: 1, Name: "id"},
+		{Num: 2, Name: "stdout_offset", Kind: pbjInt64},
+		{Num: 3, Name: "stderr_offset", Kind: pbjInt64},
+	}
+	pbjJob = []pbJsonField{
+		{Num: 1, Name: "id"},
+		{Num: 2, Name: "status"},
+		{Num: 3, Name: "cmd"},
+		{Num: 4, Name: "exit_code", Kind: pbjInt32},
+		{Num: 5, Name: "error"},
+		{Num: 6, Name: "stdout"},
+		{Num: 7, Name: "stderr"},
+		{Num: 8, Name: "pid", Kind: pbjInt32},
+		{Num: 9, Name: "tenant"},
+		{Num: 10, Name: "create_time", Kind: pbjTime},
+		{Num: 11, Name: "finish_time", Kind: pbjTime},
+		{Num: 12, Name: "labels", Kind: pbjMap},
+		{Num: 13, Name: "seq", Kind: pbjInt64},
+		{Num: 15, Name: "json"},
+	}
+	pbjListCmdResponse = []pbJsonField{{Num: 1, Name: "jobs", Kind: pbjMessage, Repeated: true, Message: pbjJob}}
+	pbjJobOutput       = []pbJsonField{
+		{Num: 1, Name: "job_id"},
+		{Num: 2, Name: "stream"},
+		{Num: 3, Name: "data", Kind: pbjBytes},
+		{Num: 4, Name: "offset", Kind: pbjInt64},
+		{Num: 5, Name: "time", Kind: pbjTime},
+		{Num: 6, Name: "job", Kind: pbjMessage, Message: pbjJob},
+	}
+)
+
+func (o *pbJsonField) jsonName() string {
+	parts := strings.Split(o.Name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+func (o *pbJsonField) wire() int {
+	switch o.Kind {
+	case pbjBool, pbjInt32, pbjInt64:
+		return pbVarint
+	}
+	return pbBytes
+}
+
+// The json of a protobuf message, the unknown fields are left out
+func pbToJson(schema []pbJsonField, b []byte) ([]byte, error) {
+	obj, err := pbJsonObject(schema, b)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(obj)
+}
+
+func pbJsonObject(schema []pbJsonField, b []byte) (map[string]interface{}, error) {
+	fields, err := pbFields(b)
+	if err != nil {
+		return nil, err
+	}
+	obj := make(map[string]interface{})
+	for _, f := range fields {
+		var sf *pbJsonField
+		for i := range schema {
+			if schema[i].Num == f.Num {
+				sf = &schema[i]
+			}
+		}
+		if sf == nil {
+			continue
+		}
+		if f.Wire != sf.wire() {
+			return nil, fmt.Errorf("protobuf: wire type %d of field %s", f.Wire, sf.Name)
+		}
+		name := sf.jsonName()
+		if sf.Kind == pbjMap {
+			m, _ := obj[name].(map[string]string)
+			if m == nil {
+				m = make(map[string]string)
+				obj[name] = m
+			}
+			if err := pbMapEntry(f.Data, m); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		v, err := sf.jsonValue(f)
+		if err != nil {
+			return nil, err
+		}
+		if sf.Repeated {
+			list, _ := obj[name].([]interface{})
+			obj[name] = append(list, v)
+		} else {
+			obj[name] = v
+		}
+	}
+	return obj, nil
+}
+
+func (o *pbJsonField) jsonValue(f pbField) (interface{}, error) {
+	switch o.Kind {
+	case pbjBytes:
+		return f.Data, nil
+	case pbjBool:
+		return f.Bool(), nil
+	case pbjInt32:
+		return int32(f.Value), nil
+	case pbjInt64:
+		return strconv.FormatInt(int64(f.Value), 10), nil
+	case pbjTime:
+		fields, err := pbFields(f.Data)
+		if err != nil {
+			return nil, err
+		}
+		var sec, nsec int64
+		for _, tf := range fields {
+			switch tf.Num {
+			case 1:
+				sec = int64(tf.Value)
+			case 2:
+				nsec = int64(tf.Value)
+			}
+		}
+		return time.Unix(sec, nsec).UTC().Format(time.RFC3339Nano), nil
+	case pbjMessage:
+		return pbJsonObject(o.Message, f.Data)
+	}
+	return f.String(), nil
+}
+
+// The protobuf message of a json object, by the json or the proto names of
+// the fields. The integers are numbers or strings, and the unknown fields
+// are refused.
+func pbFromJson(schema []pbJsonField, b []byte) ([]byte, error) {
+	var m pbWriter
+	if len(strings.TrimSpace(string(b))) == 0 {
+		return nil, nil
+	}
+	if err := pbWriteJson(&m, schema, b); err != nil {
+		return nil, err
+	}
+	return m.buf, nil
+}
+
+func pbWriteJson(m *pbWriter, schema []pbJsonField, b []byte) error {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return err
+	}
+	for name := range obj {
+		known := false
+		for i := range schema {
+			known = known || name == schema[i].Name || name == schema[i].jsonName()
+		}
+		if !known {
+			return fmt.Errorf("unknown field %q", name)
+		}
+	}
+	for i := range schema {
+		sf := &schema[i]
+		raw, ok := obj[sf.jsonName()]
+		if !ok {
+			raw, ok = obj[sf.Name]
+		}
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		if err := sf.writeJson(m, raw); err != nil {
+			return fmt.Errorf("field %s: %s", sf.Name, err)
+		}
+	}
+	return nil
+}
+
+func (o *pbJsonField) writeJson(m *pbWriter, raw json.RawMessage) error {
+	if o.Repeated {
+		var list []json.RawMessage
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return err
+		}
+		one := *o
+		one.Repeated = false
+		for _, item := range list {
+			if o.Kind == pbjString {
+				// Written even if empty
+				var s string
+				if err := json.Unmarshal(item, &s); err != nil {
+					return err
+				}
+				m.Strings(o.Num, []string{s})
+			} else if err := one.writeJson(m, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	switch o.Kind {
+	case pbjString:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return err
+		}
+		m.String(o.Num, s)
+	case pbjBytes:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return err
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			if b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "=")); err != nil {
+				return errors.New("invalid base64")
+			}
+		}
+		m.Bytes(o.Num, b)
+	case pbjBool:
+		var v bool
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return err
+		}
+		m.Bool(o.Num, v)
+	case pbjInt32, pbjInt64:
+		s := string(raw)
+		if strings.HasPrefix(s, `"`) {
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return err
+			}
+		}
+		bits := 64
+		if o.Kind == pbjInt32 {
+			bits = 32
+		}
+		v, err := strconv.ParseInt(s, 10, bits)
+		if err != nil {
+			return err
+		}
+		m.Int(o.Num, v)
+	case pbjTime:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return err
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return err
+		}
+		m.Time(o.Num, t)
+	case pbjMap:
+		var v map[string]string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return err
+		}
+		m.StringMap(o.Num, v)
+	case pbjMessage:
+		var sub pbWriter
+		if err := pbWriteJson(&sub, o.Message, raw); err != nil {
+			return err
+		}
+		m.Message(o.Num, &sub)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The frames of a response, the flags of each and its data
+func grpcTestFrames(t *testing.T, b []byte) (flags []byte, data [][]byte) {
+	for len(b) > 0 {
+		if len(b) < 5 || uint32(len(b)-5) < binary.BigEndian.Uint32(b[1:5]) {
+			t.Fatalf("truncated frame %q", b)
+		}
+		n := 5 + int(binary.BigEndian.Uint32(b[1:5]))
+		flags, data = append(flags, b[0]), append(data, b[5:n])
+		b = b[n:]
+	}
+	return
+}
+
+func grpcTestCall(method, contentType string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", grpcUrlPrefix+method, bytes.NewReader(body))
+	r.Header.Set(ContentType, contentType)
+	w := httptest.NewRecorder()
+	GrpcHandler(w, r)
+	return w
+}
+
+func grpcTestFrame(b []byte) []byte {
+	frame := make([]byte, 5, 5+len(b))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(b)))
+	return append(frame, b...)
+}
+
+func TestGrpcWeb(t *testing.T) {
+	setupJobs(t)
+	job, _, err := newJob(&RunCmdReq{Cmd: "true"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req pbWriter
+	req.String(1, job.Id)
+
+	for _, text := range []bool{false, true} {
+		ct, body := "application/grpc-web+proto", grpcTestFrame(req.buf)
+		if text {
+			ct, body = "application/grpc-web-text", []byte(base64.StdEncoding.EncodeToString(body))
+		}
+		w := grpcTestCall("QueryCmd", ct, body)
+		b := w.Body.Bytes()
+		if text {
+			// Each frame is encoded on its own, padded
+			var decoded []byte
+			for s := w.Body.String(); len(s) >= 4; s = s[4:] {
+				q, err := base64.StdEncoding.DecodeString(s[:4])
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded = append(decoded, q...)
+			}
+			b = decoded
+		}
+		if w.Header().Get(ContentType) != ct {
+			t.Errorf("%s: got content type %s", ct, w.Header().Get(ContentType))
+		}
+		flags, data := grpcTestFrames(t, b)
+		if len(flags) != 2 || flags[0] != 0 || flags[1] != grpcWebTrailerFlag || string(data[1]) != "grpc-status: 0\r\n" {
+			t.Fatalf("%s: got frames %v %q", ct, flags, data)
+		}
+		fields, err := pbFields(data[0])
+		if err != nil || fields[0].Num != 1 || fields[0].String() != job.Id {
+			t.Fatalf("%s: got job %v, %v", ct, fields, err)
+		}
+	}
+
+	req = pbWriter{}
+	req.String(1, "nope")
+	w := grpcTestCall("QueryCmd", "application/grpc-web", grpcTestFrame(req.buf))
+	flags, data := grpcTestFrames(t, w.Body.Bytes())
+	if w.Code != 200 || len(flags) != 1 || string(data[0]) != "grpc-status: 5\r\ngrpc-message: job not found: nope\r\nx-shell-agent-errno: 1003\r\n" {
+		t.Fatalf("got %d %v %q", w.Code, flags, data)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	setupJobs(t)
+	job, _, err := newJob(&RunCmdReq{Cmd: "true", Labels: map[string]string{"app": "web"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := grpcTestCall("QueryCmd", "application/json", []byte(`{"id":"`+job.Id+`"}`))
+	var res map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != 200 {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	if res["id"] != job.Id || res["cmd"] != "true" || res["createTime"] == nil || res["labels"].(map[string]interface{})["app"] != "web" {
+		t.Fatalf("got %s", w.Body)
+	}
+
+	for _, c := range []struct {
+		method, ct, body string
+		status           int
+		want             string
+	}{
+		{"QueryCmd", "application/json", `{"id":"nope"}`, 404, `{"code":"not_found","message":"job not found: nope"}`},
+		{"QueryCmd", "application/json", `{"idd":"x"}`, 400, `"code":"invalid_argument"`},
+		{"QueryCmd", "application/proto", "", 400, `{"code":"invalid_argument","message":"param id is empty"}`},
+		{"StreamOutput", "application/json", `{"id":"x"}`, 400, `"code":"invalid_argument"`},
+		{"Nope", "application/json", `{}`, 501, `"code":"unimplemented"`},
+	} {
+		w := grpcTestCall(c.method, c.ct, []byte(c.body))
+		if w.Code != c.status || !strings.Contains(w.Body.String(), c.want) || w.Header().Get(ContentType) != JsonContentType {
+			t.Errorf("%s %s: got %d %s", c.method, c.body, w.Code, w.Body)
+		}
+	}
+
+	// Streaming, the end-stream message carries the error
+	w = grpcTestCall("StreamOutput", "application/connect+json", grpcTestFrame([]byte(`{"id":"nope","stdoutOffset":"0"}`)))
+	flags, data := grpcTestFrames(t, w.Body.Bytes())
+	if w.Code != 200 || len(flags) != 1 || flags[0] != connectEndStreamFlag ||
+		string(data[0]) != `{"error":{"code":"not_found","message":"job not found: nope"},"metadata":{"x-shell-agent-errno":["1003"]}}` {
+		t.Fatalf("got %d %v %q", w.Code, flags, data)
+	}
+}
+
+// The json mapping of proto3 both ways
+func TestPbJson(t *testing.T) {
+	in := `{"cmd":"ls","run_as":"nobody","env":["A=1",""],"async":true,"idleTimeoutSeconds":"30","labels":{"a":"b"}}`
+	b, err := pbFromJson(pbjRunCmdRequest, []byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := pbToJson(pbjRunCmdRequest, b)
+	want := `{"async":true,"cmd":"ls","env":["A=1",""],"idleTimeoutSeconds":30,"labels":{"a":"b"},"runAs":"nobody"}`
+	if err != nil || string(out) != want {
+		t.Fatalf("got %s, %v", out, err)
+	}
+
+	var m pbWriter
+	m.String(1, "id")
+	m.Bytes(3, []byte{0xff, 0})
+	m.Int(4, 1<<40)
+	var job pbWriter
+	job.Int(4, -1)
+	m.Message(6, &job)
+	out, err = pbToJson(pbjJobOutput, m.buf)
+	want = `{"data":"/wA=","job":{"exitCode":-1},"jobId":"id","offset":"1099511627776"}`
+	if err != nil || string(out) != want {
+		t.Fatalf("got %s, %v", out, err)
+	}
+	if b, err = pbFromJson(pbjJobOutput, out); err != nil || !bytes.Equal(b, m.buf) {
+		t.Fatalf("got %x, %v, want %x", b, err, m.buf)
+	}
+
+	for _, s := range []string{`{"cmd":1}`, `{"async":"yes"}`, `{"idleTimeoutSeconds":"4294967296"}`, `{"x":1}`, `[]`} {
+		if _, err := pbFromJson(pbjRunCmdRequest, []byte(s)); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+}
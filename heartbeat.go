@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// In the pull mode, the agent posts a heartbeat to the controller every
+// heartbeat_interval seconds, with the work it has and the room it has left,
+// so that the controller dispatches to the least loaded of the agents on
+// equivalent hosts.
+//
+//   POST <url>/agents/heartbeat
+//        {"agent_id":"<id>", "time":"...", "jobs":{...}, "headroom":{...}}
+
+type Heartbeat struct {
+	AgentId  string         `json:"agent_id"`
+	Time     time.Time      `json:"time"`
+	Version  string         `json:"version"`
+	Tags     []string       `json:"tags,omitempty"`
+	Jobs     HeartbeatJobs  `json:"jobs"`
+	Headroom Headroom       `json:"headroom"`
+	Clock    HeartbeatClock `json:"clock"`
+}
+
+// The clock of the agent, see /time
+type HeartbeatClock struct {
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	// Against the controller by the last response, absent if never measured
+	SkewSeconds  *float64 `json:"skew_seconds,omitempty"`
+	SkewExceeded bool     `json:"skew_exceeded"`
+	// Of the host clock, absent where unknown
+	NtpSynchronized *bool `json:"ntp_synchronized,omitempty"`
+}
+
+// The work of the agent
+type HeartbeatJobs struct {
+	Running         int `json:"running"`
+	Queued          int `json:"queued"`    // Waiting for a worker
+	Scheduled       int `json:"scheduled"` // Waiting for their run_at
+	PendingApproval int `json:"pending_approval"`
+	// Unfinished jobs by concurrency group, the running one included
+	Groups map[string]int `json:"groups,omitempty"`
+}
+
+// The room left for more jobs
+type Headroom struct {
+	// False if a job would be rejected now, the queue is full or the job
+	// memory is over the limit
+	Accepting   bool `json:"accepting"`
+	Workers     int  `json:"workers"`
+	FreeWorkers int  `json:"free_workers"`
+	FreeQueue   int  `json:"free_queue"`
+	// Of the job output kept in memory, absent if unlimited
+	JobMemoryFreeMb *int64 `json:"job_memory_free_mb,omitempty"`
+
+	// Of the host, absent where the host stats are not supported
+	Cpus                int       `json:"cpus"`
+	CpuPercent          *float64  `json:"cpu_percent,omitempty"` // Busy since the last heartbeat
+	Load                []float64 `json:"load,omitempty"`
+	MemAvailableMb      *uint64   `json:"mem_available_mb,omitempty"`
+	MemAvailablePercent *float64  `json:"mem_available_percent,omitempty"`
+}
+
+// The heartbeat now, the cpu busy since the prev sample if any
+func newHeartbeat(agentId string, prev, cur *hostSample) *Heartbeat {
+	pool := gJobPool.Stats()
+	hb := &Heartbeat{
+		AgentId: agentId,
+		Time:    time.Now(),
+		Version: VERSION,
+		Tags:    gApp.Cnf.AgentTags(),
+		Jobs: HeartbeatJobs{
+			Running:         pool.Busy,
+			Queued:          pool.Queued,
+			Scheduled:       gDelayedJobs.Len(),
+			PendingApproval: gApprovals.Len(),
+			Groups:          gConcurrencyGroups.Stats(),
+		},
+		Headroom: Headroom{
+			Workers:     pool.Size,
+			FreeWorkers: pool.Size - pool.Busy,
+			FreeQueue:   pool.QueueSize - pool.Queued,
+			Cpus:        runtime.NumCPU(),
+		},
+	}
+	hb.Clock.UptimeSeconds = uptimeSeconds()
+	if skew, exceeded := gClock.Skew(); skew != nil {
+		hb.Clock.SkewSeconds, hb.Clock.SkewExceeded = &skew.Seconds, exceeded
+	}
+	if ntp, err := readNtpStatus(); err == nil {
+		hb.Clock.NtpSynchronized = &ntp.Synchronized
+	}
+	h := &hb.Headroom
+	if h.FreeWorkers < 0 {
+		h.FreeWorkers = 0
+	}
+	if h.FreeQueue < 0 {
+		h.FreeQueue = 0
+	}
+	h.Accepting = h.FreeQueue > 0 && !gMemoryGuard.Exceeded()
+	if limit := gMemoryGuard.Limit(); limit > 0 {
+		free := (limit - gMemoryGuard.Used()) >> 20
+		if free < 0 {
+			free = 0
+		}
+		h.JobMemoryFreeMb = &free
+	}
+	if cur != nil {
+		h.Load = cur.load
+		if cur.memory.Total > 0 {
+			mb := cur.memory.Available >> 20
+			pct := float64(int(float64(cur.memory.Available)/float64(cur.memory.Total)*10000)) / 100
+			h.MemAvailableMb, h.MemAvailablePercent = &mb, &pct
+		}
+		if prev != nil && cur.cpuTotal > prev.cpuTotal {
+			pct := newHostStats(prev, cur).CpuPercent
+			h.CpuPercent = &pct
+		}
+	}
+	return hb
+}
+
+func (o *ControllerPoller) heartbeat(ctx context.Context, interval time.Duration) {
+	defer o.wg.Done()
+	// The first one after an interval, when the job pool is up, with the cpu
+	// busy of the interval
+	prev, _ := readHostSample()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		cur, _ := readHostSample()
+		if err := o.sendHeartbeat(ctx, newHeartbeat(o.agentId, prev, cur)); err != nil && ctx.Err() == nil {
+			log.Warnf("heartbeat to controller failed: %s", err)
+		}
+		if cur != nil {
+			prev = cur
+		}
+	}
+}
+
+func (o *ControllerPoller) sendHeartbeat(ctx context.Context, hb *Heartbeat) error {
+	b, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, o.url+"/agents/heartbeat", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(ContentType, JsonContentType)
+	// Late heartbeats are useless, don't let one hang until the next
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	resp, err := o.do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected http status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A hook is an endpoint /hook/<name> bound to a profile, so the external
+// systems, e.g. github, gitlab or an alerting tool, run a predefined job on
+// their events without a controller in the middle. The requests carry no
+// token but are verified by the hmac signature of their body, or by a
+// shared token. The jobs run async as the service account of the hook, or
+// as the tenant hook:<name>.
+
+const hookUrlPrefix = "/hook/"
+
+const (
+	HVHmac  = "hmac"  // The header is "sha256=<hex>" or <hex> of the hmac-sha256 of the body
+	HVToken = "token" // The header is the secret itself
+)
+
+const (
+	// The bodies larger are refused
+	hookMaxBody = 1 << 20
+	// The payload larger is not passed to the job
+	hookMaxPayloadEnv = 32 << 10
+)
+
+type Hook struct {
+	Name           string   `json:"name"`
+	Profile        string   `json:"profile"` // The profile the jobs are run by
+	Secret         string   `json:"-"`
+	Verify         string   `json:"verify"`           // hmac or token
+	Header         string   `json:"header"`           // Of the signature or the token
+	Events         []string `json:"events,omitempty"` // The events run, empty means any
+	EventHeader    string   `json:"event_header"`
+	ServiceAccount string   `json:"service_account,omitempty"`
+}
+
+// The result of a request to a hook, the job is async
+type HookRes struct {
+	Hook       string     `json:"hook"`
+	Event      string     `json:"event,omitempty"`
+	Ignored    bool       `json:"ignored,omitempty"` // The event is not one of the hook's
+	Id         string     `json:"id,omitempty"`
+	CreateTime *time.Time `json:"create_time,omitempty"`
+}
+
+var (
+	gHooks map[string]*Hook
+)
+
+func init() {
+	gHttpServer.AddToInit(InitHooks)
+}
+
+func InitHooks() error {
+	hooks := make(map[string]*Hook)
+	for _, h := range gApp.Cnf.Hooks {
+		if err := h.validate(); err != nil {
+			log.Errorf("invalid hook %s: %s", h.Name, err)
+			return err
+		}
+		hooks[h.Name] = h
+	}
+	gHooks = hooks
+	return nil
+}
+
+func (o *Hook) validate() error {
+	if o.Profile == "" {
+		return errors.New("profile is empty")
+	}
+	if o.Secret == "" {
+		return errors.New("secret is empty")
+	}
+	switch o.Verify {
+	case HVHmac, HVToken:
+	default:
+		return errors.New("invalid verify: " + o.Verify)
+	}
+	if o.ServiceAccount == "" {
+		return nil
+	}
+	// Checked by the config, the accounts may be initialized later
+	for _, sa := range gApp.Cnf.ServiceAccounts {
+		if sa.Name == o.ServiceAccount {
+			return nil
+		}
+	}
+	return errors.New("service account not found: " + o.ServiceAccount)
+}
+
+// Whether the request is from the holder of the secret
+func (o *Hook) verify(r *http.Request, body []byte) bool {
+	value := strings.TrimSpace(r.Header.Get(o.Header))
+	if value == "" {
+		return false
+	}
+	if o.Verify == HVToken {
+		return hashEqual(value, o.Secret)
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(value, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(o.Secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+func (o *Hook) accepts(event string) bool {
+	if len(o.Events) == 0 {
+		return true
+	}
+	for _, e := range o.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// The request of the job run by the event: the profile, with the hook, the
+// event and the payload in the environment
+func (o *Hook) runCmdReq(event string, body []byte) (*RunCmdReq, error) {
+	b, _ := json.Marshal(map[string]string{"profile": o.Profile})
+	var req RunCmdReq
+	if err := decodeRunCmdReq(b, &req); err != nil {
+		return nil, err
+	}
+	req.Async = true
+	// The agent's environment is passed as if the profile had no env
+	if len(req.Env) == 0 && len(req.EnvPass) == 0 {
+		req.EnvPass = []string{"*"}
+	}
+	req.Env = append(copyStrings(req.Env), "HOOK_NAME="+o.Name, "HOOK_EVENT="+event)
+	if len(body) <= hookMaxPayloadEnv {
+		req.Env = append(req.Env, "HOOK_PAYLOAD="+string(body))
+	}
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// Handler of the requests to the hooks by the external systems
+func HookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		ServeJSONWithStatus(w, http.StatusMethodNotAllowed, NewResponse().SetError(ECInvalidParam, "use POST"))
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, hookUrlPrefix)
+	hook := gHooks[name]
+	if hook == nil {
+		ServeJSONWithStatus(w, http.StatusNotFound, NewResponse().SetError(ECHookNotFound, "hook not found: "+name))
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, hookMaxBody+1))
+	if err != nil {
+		log.Errorf("failed to read r.Body: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to read body"))
+		return
+	}
+	defer r.Body.Close()
+	if len(body) > hookMaxBody {
+		ServeJSONWithStatus(w, http.StatusRequestEntityTooLarge,
+			NewResponse().SetError(ECInvalidParam, fmt.Sprintf("body larger than %d bytes", hookMaxBody)))
+		return
+	}
+	if !hook.verify(r, body) {
+		msg := fmt.Sprintf("audit: hook %s denied from %s: invalid %s", name, r.RemoteAddr, hook.Verify)
+		log.Warn(msg)
+		ReportWarningEvent(EventAuthFailed, msg)
+		ServeJSONWithStatus(w, http.StatusUnauthorized, NewResponse().SetError(ECUnauthorized, "invalid "+hook.Verify))
+		return
+	}
+
+	res := &HookRes{Hook: name, Event: r.Header.Get(hook.EventHeader)}
+	if !hook.accepts(res.Event) {
+		log.Infof("hook %s ignored event %q from %s", name, res.Event, r.RemoteAddr)
+		res.Ignored = true
+		ServeJSON(w, NewResponse().SetData(res))
+		return
+	}
+	req, err := hook.runCmdReq(res.Event, body)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, fmt.Sprintf("invalid profile %s: %s", hook.Profile, err)))
+		return
+	}
+	tenant, err := runTenant(hook.ServiceAccount, "hook:"+name, req)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECForbidden, err.Error()))
+		return
+	}
+	job, err := startJob(req, tenant)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(newJobErrno(err), err.Error()))
+		return
+	}
+	log.Infof("audit: hook %s triggered by event %q from %s, job %s as %s", name, res.Event, r.RemoteAddr, job.Id, tenant)
+	res.Id, res.CreateTime = job.Id, &job.CreateTime
+	ServeJSON(w, NewResponse().SetData(res))
+}
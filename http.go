@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
@@ -8,17 +9,24 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 )
 
 type HttpServer struct {
-	ln             net.Listener
-	s              http.Server
-	wg             *sync.WaitGroup
-	pending        int32
-	stopped        bool
+	ln      net.Listener
+	s       *http.Server
+	wg      *sync.WaitGroup
+	pending int32
+	stopped bool
+	// Set while stopped to run again with a new config, the subsystems
+	// keeping the jobs keep them across the restart
+	restarting     int32
 	started        bool
 	initializers   []func() error
+	starters       []func()
 	uninitializers []func()
+	// Closed when the server is stopping, long-lived connections should quit
+	quitC chan struct{}
 }
 
 func NewHttpServer() *HttpServer {
@@ -31,6 +39,11 @@ var (
 	gHttpServer = NewHttpServer()
 )
 
+const (
+	apiUrlPrefix   = "/api/v1"
+	adminUrlPrefix = apiUrlPrefix + "/admin/"
+)
+
 func (o *HttpServer) Init() error {
 	var err error
 	for _, f := range o.initializers {
@@ -42,9 +55,10 @@ func (o *HttpServer) Init() error {
 	return nil
 }
 
+// Uninitialize in the reverse order of the initialization
 func (o *HttpServer) Uninit() {
-	for _, f := range o.initializers {
-		f()
+	for i := len(o.uninitializers) - 1; i >= 0; i-- {
+		o.uninitializers[i]()
 	}
 }
 
@@ -62,16 +76,26 @@ func (o *HttpServer) Run() error {
 		log.Errorf("http server init failed: %s", err)
 		return err
 	}
+	atomic.StoreInt32(&o.restarting, 0)
 	defer o.Uninit()
+	for _, f := range o.starters {
+		f()
+	}
 	// Prepare the middleware and http handlers
 	n := negroni.New()
 	mux := ServeMux()
 	n.UseFunc(RecoveryMiddleware)
 	n.UseFunc(LoggerMiddleware)
+	n.UseFunc(CorsMiddleware)
+	n.UseFunc(AuthMiddleware)
 	n.UseFunc(CutServiceMiddleware)
+	n.UseFunc(GzipMiddleware)
+	n.UseFunc(NegotiateMiddleware)
 	n.UseHandler(mux)
 
-	o.s.Handler = n
+	// A new server each run, the connections of the previous one may linger
+	o.s = &http.Server{Handler: n}
+	o.quitC = make(chan struct{})
 
 	o.ln, err = net.Listen("tcp", gApp.Cnf.Addr)
 	if err != nil {
@@ -79,10 +103,20 @@ func (o *HttpServer) Run() error {
 		return err
 	}
 
-	log.Printf("http server serving addr: %s", gApp.Cnf.Addr)
 	o.started = true
 	o.wg.Add(1)
-	err = o.s.Serve(o.ln)
+	if gApp.Cnf.TlsCert != "" {
+		log.Printf("https server serving addr: %s", gApp.Cnf.Addr)
+		// The certificate is reloaded when renewed
+		var reloader *certReloader
+		if reloader, err = newCertReloader(gApp.Cnf.TlsCert, gApp.Cnf.TlsKey); err == nil {
+			o.s.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+			err = o.s.ServeTLS(o.ln, "", "")
+		}
+	} else {
+		log.Printf("http server serving addr: %s", gApp.Cnf.Addr)
+		err = o.s.Serve(o.ln)
+	}
 	log.Errorf("http server quit: %s", err)
 	o.wg.Done()
 
@@ -100,27 +134,128 @@ func (o *HttpServer) Stop() {
 		return
 	}
 	o.stopped = true
+	close(o.quitC)
 	o.ln.Close()
 	o.wg.Wait()
 }
 
+// Stop the server to run it again with the config file
+func (o *HttpServer) Restart() {
+	atomic.StoreInt32(&o.restarting, 1)
+	o.Stop()
+}
+
+// Whether the server is stopped to run again, for the initializers and the
+// uninitializers
+func (o *HttpServer) Restarting() bool {
+	return atomic.LoadInt32(&o.restarting) != 0
+}
+
 func (o *HttpServer) AddToInit(f func() error) {
 	o.initializers = append(o.initializers, f)
 }
 
+// Run after all the initializers, for the subsystems using the others
+func (o *HttpServer) AddToStart(f func()) {
+	o.starters = append(o.starters, f)
+}
+
 func (o *HttpServer) AddToUninit(f func()) {
 	o.uninitializers = append(o.uninitializers, f)
 }
 
 func ServeMux() *http.ServeMux {
-	apiUrlPrefix := "/api/v1"
 	mux := http.NewServeMux()
 
 	mux.HandleFunc(apiUrlPrefix+"/cmd/run", RunCmdHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cmd/run_raw", RunRawCmdHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cmd/run_stream", RunStreamCmdHandler)
 	mux.HandleFunc(apiUrlPrefix+"/cmd/query", QueryCmdHandler)
 	mux.HandleFunc(apiUrlPrefix+"/cmd/list", ListCmdHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cmd/events", JobEventsHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cmd/list_ndjson", ListCmdNdjsonHandler)
 	mux.HandleFunc(apiUrlPrefix+"/cmd/cancel", CancelCmdHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cmd/delete", DeleteCmdHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cmd/replay", ReplayCmdHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cmd/diff", DiffCmdHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cmd/approve", ApproveCmdHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cmd/since", SinceCmdHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cmd/output", OutputCmdHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cmd/history_by_template", HistoryByTemplateHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cmd/reject", RejectCmdHandler)
+	mux.HandleFunc(apiUrlPrefix+"/facts", FactsHandler)
+	mux.HandleFunc(apiUrlPrefix+"/policy", PolicyHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cmd/ws", WsCmdHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cmd/notify", NotifyCmdHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cmd/notify_sse", NotifySseHandler)
+	mux.HandleFunc(grpcUrlPrefix, GrpcHandler)
+	mux.HandleFunc(hookUrlPrefix, HookHandler)
+	mux.HandleFunc(apiUrlPrefix+"/ci/config", CiConfigHandler)
+	mux.HandleFunc(apiUrlPrefix+"/ci/run", CiRunHandler)
+	mux.HandleFunc(apiUrlPrefix+"/ci/cleanup", CiCleanupHandler)
 	mux.HandleFunc(apiUrlPrefix+"/status/mem", StatusMemHandler)
+	mux.HandleFunc(apiUrlPrefix+"/status/pool", StatusPoolHandler)
+	mux.HandleFunc(apiUrlPrefix+"/status/janitor", StatusJanitorHandler)
+	mux.HandleFunc(apiUrlPrefix+"/stats/stream", StatsStreamHandler)
+	mux.HandleFunc(apiUrlPrefix+"/version", VersionHandler)
+	mux.HandleFunc(apiUrlPrefix+"/time", TimeHandler)
+	mux.HandleFunc(apiUrlPrefix+"/peers", ListPeersHandler)
+	mux.HandleFunc(apiUrlPrefix+"/rollout/run", RunRolloutHandler)
+	mux.HandleFunc(apiUrlPrefix+"/rollout/query", QueryRolloutHandler)
+	mux.HandleFunc(apiUrlPrefix+"/rollout/list", ListRolloutHandler)
+	mux.HandleFunc(apiUrlPrefix+"/rollout/cancel", CancelRolloutHandler)
+	mux.HandleFunc(apiUrlPrefix+"/schedule/preview", SchedulePreviewHandler)
+	mux.HandleFunc(apiUrlPrefix+"/schedule/create", CreateScheduleHandler)
+	mux.HandleFunc(apiUrlPrefix+"/schedule/list", ListScheduleHandler)
+	mux.HandleFunc(apiUrlPrefix+"/schedule/delete", DeleteScheduleHandler)
+	mux.HandleFunc(apiUrlPrefix+"/schedule/resume", ResumeScheduleHandler)
+	mux.HandleFunc(apiUrlPrefix+"/schedule/history", ScheduleHistoryHandler)
+	mux.HandleFunc(apiUrlPrefix+"/watch/create", CreateWatchHandler)
+	mux.HandleFunc(apiUrlPrefix+"/watch/update", UpdateWatchHandler)
+	mux.HandleFunc(apiUrlPrefix+"/watch/list", ListWatchHandler)
+	mux.HandleFunc(apiUrlPrefix+"/watch/delete", DeleteWatchHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cert/verify", VerifyCertHandler)
+	mux.HandleFunc(apiUrlPrefix+"/cert/expiry", CertExpiryHandler)
+	mux.HandleFunc(apiUrlPrefix+"/disk/list", ListDiskHandler)
+	mux.HandleFunc(apiUrlPrefix+"/disk/mounts", ListMountHandler)
+	mux.HandleFunc(apiUrlPrefix+"/systask/list", ListSchedTaskHandler)
+	mux.HandleFunc(bootstrapUrl, BootstrapHandler)
+	mux.HandleFunc(apiUrlPrefix+"/git/clone", GitCloneHandler)
+	mux.HandleFunc(apiUrlPrefix+"/git/pull", GitPullHandler)
+	mux.HandleFunc(apiUrlPrefix+"/git/checkout", GitCheckoutHandler)
+	mux.HandleFunc(apiUrlPrefix+"/file/fetch", FetchFileHandler)
+	mux.HandleFunc(apiUrlPrefix+"/fs/watch", FsWatchHandler)
+	mux.HandleFunc(apiUrlPrefix+"/elevation/request", RequestElevationHandler)
+	mux.HandleFunc(adminUrlPrefix+"token/create", CreateTokenHandler)
+	mux.HandleFunc(adminUrlPrefix+"token/list", ListTokenHandler)
+	mux.HandleFunc(adminUrlPrefix+"token/update", UpdateTokenHandler)
+	mux.HandleFunc(adminUrlPrefix+"token/revoke", RevokeTokenHandler)
+	mux.HandleFunc(adminUrlPrefix+"token/rotate", RotateTokenHandler)
+	mux.HandleFunc(adminUrlPrefix+"loglevel", LogLevelHandler)
+	mux.HandleFunc(adminUrlPrefix+"diag", DiagHandler)
+	mux.HandleFunc(adminUrlPrefix+"user/create", CreateUserHandler)
+	mux.HandleFunc(adminUrlPrefix+"user/disable", DisableUserHandler)
+	mux.HandleFunc(adminUrlPrefix+"user/authorized_keys", AuthorizedKeysHandler)
+	mux.HandleFunc(adminUrlPrefix+"group/member", GroupMemberHandler)
+	mux.HandleFunc(adminUrlPrefix+"firewall/list", ListFirewallHandler)
+	mux.HandleFunc(adminUrlPrefix+"firewall/add", AddFirewallHandler)
+	mux.HandleFunc(adminUrlPrefix+"firewall/remove", RemoveFirewallHandler)
+	mux.HandleFunc(adminUrlPrefix+"cert/install", InstallCertHandler)
+	mux.HandleFunc(adminUrlPrefix+"config/apply", ApplyConfigHandler)
+	mux.HandleFunc(adminUrlPrefix+"config/apply_status", ApplyConfigStatusHandler)
+	mux.HandleFunc(adminUrlPrefix+"pty", PtyHandler)
+	mux.HandleFunc(adminUrlPrefix+"pty/list", ListPtyHandler)
+	mux.HandleFunc(adminUrlPrefix+"pty/close", ClosePtyHandler)
+	mux.HandleFunc(adminUrlPrefix+"library/export", ExportLibraryHandler)
+	mux.HandleFunc(adminUrlPrefix+"library/import", ImportLibraryHandler)
+	mux.HandleFunc(adminUrlPrefix+"janitor/run", RunJanitorHandler)
+	mux.HandleFunc(adminUrlPrefix+"job/scrub", ScrubJobsHandler)
+	mux.HandleFunc(adminUrlPrefix+"systask/create", CreateSchedTaskHandler)
+	mux.HandleFunc(adminUrlPrefix+"systask/delete", DeleteSchedTaskHandler)
+	mux.HandleFunc(pprofUrlPrefix, PprofHandler)
+	mux.HandleFunc(adminUrlPrefix+"elevation/list", ListElevationHandler)
+	mux.HandleFunc(adminUrlPrefix+"elevation/approve", ApproveElevationHandler)
+	mux.HandleFunc(adminUrlPrefix+"elevation/deny", DenyElevationHandler)
 
 	return mux
 }
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type TokenReq struct {
+	Id           string `json:"id,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Admin        bool   `json:"admin,omitempty"`
+	TtlSeconds   int    `json:"ttl_seconds,omitempty"`   // 0 means never expire
+	GraceSeconds int    `json:"grace_seconds,omitempty"` // How long the old value keeps working after a rotation
+
+	AllowedTimes []TimeWindow `json:"allowed_times,omitempty"`
+	// Lines of authorized_keys, the update leaves the keys as they are if absent
+	SshKeys []string `json:"ssh_keys,omitempty"`
+}
+
+type TokenRes struct {
+	Value string `json:"value"` // Only returned here, keep it safe
+	*Token
+}
+
+// Handler to create an api token
+func CreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := parseTokenReq(w, r)
+	if !ok {
+		return
+	}
+	if req.Name == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param name is empty"))
+		return
+	}
+
+	value, tok, err := tokenStore().Create(req.Name, req.Admin, time.Duration(req.TtlSeconds)*time.Second, req.AllowedTimes, req.SshKeys)
+	if err != nil {
+		log.Errorf("create token failed: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	log.Infof("token created: %s(%s), admin: %v, by: %s", tok.Name, tok.Id, tok.Admin, RequestToken(r).Name)
+	ServeJSON(w, NewResponse().SetData(&TokenRes{Value: value, Token: tok}))
+}
+
+// Handler to list the api tokens, without their values
+func ListTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if tokenStore() == nil {
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "auth::token_file is not configured"))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(tokenStore().List()))
+}
+
+// Handler to replace the time windows of an api token, and its ssh keys if given
+func UpdateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := parseTokenReq(w, r)
+	if !ok {
+		return
+	}
+
+	tok, err := tokenStore().SetAllowedTimes(req.Id, req.AllowedTimes)
+	if err == nil && req.SshKeys != nil {
+		tok, err = tokenStore().SetSshKeys(req.Id, req.SshKeys)
+	}
+	if err == errTokenNotFound {
+		ServeJSON(w, NewResponse().SetError(ECTokenNotFound, "token not found: "+req.Id))
+		return
+	}
+	if err != nil {
+		log.Errorf("update token failed: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	log.Infof("token updated: %s(%s), allowed times: %v, ssh keys: %d, by: %s", tok.Name, tok.Id, tok.AllowedTimes, len(tok.SshKeys), RequestToken(r).Name)
+	ServeJSON(w, NewResponse().SetData(tok))
+}
+
+// Handler to revoke an api token
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := parseTokenReq(w, r)
+	if !ok {
+		return
+	}
+
+	tok, err := tokenStore().Revoke(req.Id)
+	if err == errTokenNotFound {
+		ServeJSON(w, NewResponse().SetError(ECTokenNotFound, "token not found: "+req.Id))
+		return
+	}
+	if err != nil {
+		log.Errorf("revoke token failed: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	log.Infof("token revoked: %s(%s), by: %s", tok.Name, tok.Id, RequestToken(r).Name)
+	ServeJSON(w, NewResponse().SetData(tok))
+}
+
+// Handler to replace the value of an api token
+func RotateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := parseTokenReq(w, r)
+	if !ok {
+		return
+	}
+
+	value, tok, err := tokenStore().Rotate(req.Id, time.Duration(req.TtlSeconds)*time.Second,
+		time.Duration(req.GraceSeconds)*time.Second)
+	if err == errTokenNotFound {
+		ServeJSON(w, NewResponse().SetError(ECTokenNotFound, "token not found: "+req.Id))
+		return
+	}
+	if err != nil {
+		log.Errorf("rotate token failed: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	log.Infof("token rotated: %s(%s), by: %s", tok.Name, tok.Id, RequestToken(r).Name)
+	ServeJSON(w, NewResponse().SetData(&TokenRes{Value: value, Token: tok}))
+}
+
+func parseTokenReq(w http.ResponseWriter, r *http.Request) (*TokenReq, bool) {
+	if tokenStore() == nil {
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "auth::token_file is not configured"))
+		return nil, false
+	}
+
+	var req TokenReq
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("failed to read r.Body: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to read body"))
+		return nil, false
+	}
+	defer r.Body.Close()
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		log.Errorf("failed to unmarshall data: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to unmarshall data"))
+		return nil, false
+	}
+	for i := range req.AllowedTimes {
+		if err := req.AllowedTimes[i].Validate(); err != nil {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+			return nil, false
+		}
+	}
+	for _, line := range req.SshKeys {
+		if _, err := parseAuthorizedKey(line); err != nil {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid ssh key: "+err.Error()))
+			return nil, false
+		}
+	}
+	return &req, true
+}
+
+type ElevationReq struct {
+	Id       string `json:"id,omitempty"`
+	RunAs    string `json:"run_as,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Duration int    `json:"duration_seconds,omitempty"`
+}
+
+// Handler to request the elevation to run jobs as another user, it needs the approval of an admin
+func RequestElevationHandler(w http.ResponseWriter, r *http.Request) {
+	tok := RequestToken(r)
+	if tok == nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "auth is disabled, no elevation is needed"))
+		return
+	}
+	req, ok := parseElevationReq(w, r)
+	if !ok {
+		return
+	}
+	if req.RunAs == "" || req.Reason == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param run_as or reason is empty"))
+		return
+	}
+	if req.Duration <= 0 || req.Duration > gApp.Cnf.ElevationMaxDuration {
+		req.Duration = gApp.Cnf.ElevationMaxDuration
+	}
+
+	e, err := gElevationStore.Request(tok, req.RunAs, req.Reason, req.Duration)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(e))
+}
+
+// Handler to list the elevations
+func ListElevationHandler(w http.ResponseWriter, r *http.Request) {
+	ServeJSON(w, NewResponse().SetData(gElevationStore.List()))
+}
+
+// Handler to approve a pending elevation
+func ApproveElevationHandler(w http.ResponseWriter, r *http.Request) {
+	reviewElevation(w, r, true)
+}
+
+// Handler to deny a pending elevation
+func DenyElevationHandler(w http.ResponseWriter, r *http.Request) {
+	reviewElevation(w, r, false)
+}
+
+func reviewElevation(w http.ResponseWriter, r *http.Request, approve bool) {
+	req, ok := parseElevationReq(w, r)
+	if !ok {
+		return
+	}
+	reviewer := ""
+	if tok := RequestToken(r); tok != nil {
+		reviewer = tok.Name
+	}
+
+	e, err := gElevationStore.Review(req.Id, approve, reviewer)
+	if err == errElevationNotFound {
+		ServeJSON(w, NewResponse().SetError(ECElevationNotFound, "elevation not found: "+req.Id))
+		return
+	}
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(e))
+}
+
+func parseElevationReq(w http.ResponseWriter, r *http.Request) (*ElevationReq, bool) {
+	var req ElevationReq
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("failed to read r.Body: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to read body"))
+		return nil, false
+	}
+	defer r.Body.Close()
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		log.Errorf("failed to unmarshall data: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to unmarshall data"))
+		return nil, false
+	}
+	return &req, true
+}
+
+type LogLevelReq struct {
+	Level   string   `json:"level,omitempty"`
+	Outputs []string `json:"outputs,omitempty"`
+}
+
+// Handler to get or change the log level and outputs at runtime, the change
+// is lost when the config is reloaded.
+func LogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var req LogLevelReq
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Errorf("failed to read r.Body: %s", err)
+			ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to read body"))
+			return
+		}
+		defer r.Body.Close()
+
+		if err := json.Unmarshal(body, &req); err != nil {
+			log.Errorf("failed to unmarshall data: %s", err)
+			ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to unmarshall data"))
+			return
+		}
+
+		if req.Level != "" {
+			level, err := log.ParseLevel(req.Level)
+			if err != nil {
+				ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+				return
+			}
+			log.SetLevel(level)
+			log.Warnf("log level changed to %s", level)
+		}
+		if len(req.Outputs) > 0 {
+			if err := gLogTargets.Set(req.Outputs); err != nil {
+				ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+				return
+			}
+			log.Warnf("log outputs changed to %v", req.Outputs)
+		}
+	}
+
+	ServeJSON(w, NewResponse().SetData(&LogLevelReq{
+		Level:   log.GetLevel().String(),
+		Outputs: gLogTargets.Names(),
+	}))
+}
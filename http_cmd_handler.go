@@ -1,13 +1,19 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha1"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"os/exec"
+	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -17,14 +23,81 @@ import (
 )
 
 type RunCmdReq struct {
-	Cmd   string   `json:"cmd"`
-	Async bool     `json:"async,omitempty"`
-	Dir   string   `json:"dir,omitempty"`
-	Env   []string `json:"env,omitempty"`
+	Cmd string `json:"cmd"`
+	// Instead of cmd, written to a file which is run, for the large scripts
+	Script string   `json:"script,omitempty"`
+	RunAs  string   `json:"run_as,omitempty"` // User running the job, unix only
+	Async  bool     `json:"async,omitempty"`
+	Dir    string   `json:"dir,omitempty"`
+	Env    []string `json:"env,omitempty"`
+	// Patterns of the agent's environment variables passed to the job, e.g. "AWS_*"
+	EnvPass []string `json:"env_pass,omitempty"`
+
+	// Kill the job if it produces no output for the given seconds, 0 means never
+	IdleTimeout int `json:"idle_timeout_seconds,omitempty"`
+	// Kill the job if it runs longer than the given seconds, 0 means never
+	Timeout int `json:"timeout_seconds,omitempty"`
+	// Reuse the job of an identical request within the given seconds instead
+	// of running it again, 0 means never
+	CacheTtl int `json:"cache_ttl_seconds,omitempty"`
+	// Keep the results of the last runs of the same request, up to
+	// history::max_entries, for /cmd/history_by_template
+	KeepHistory int `json:"keep_history,omitempty"`
+	// The jobs of the same group run one at a time in the submission order,
+	// e.g. the schema migrations
+	ConcurrencyGroup string `json:"concurrency_group,omitempty"`
+	// Files read after the process exits and attached to the job, relative
+	// to dir, e.g. a report the cmd writes
+	CaptureFiles []string `json:"capture_files,omitempty"`
+	// Parse the stdout into rows attached as parsed: df, ps, netstat,
+	// tasklist, csv, wmic or table
+	ParseAs string `json:"parse_as,omitempty"`
+	// Run the cmd in powershell and attach the objects of its pipeline as
+	// json, converted to the depth, default to 4
+	PsObjects bool `json:"ps_objects,omitempty"`
+	PsDepth   int  `json:"ps_depth,omitempty"`
+	// The profile of the policy the request is decoded over, its fields are
+	// the defaults, only by /cmd/run and /cmd/run_raw
+	Profile string `json:"profile,omitempty"`
+	// Keep the invocation as resolved when the job starts, for /cmd/replay
+	Record bool `json:"record,omitempty"`
+	// Free form labels of the job, for the filter of label.<name>
+	Labels map[string]string `json:"labels,omitempty"`
+	// Queue the job at the time rather than now, kept across restarts, async only
+	RunAt *time.Time `json:"run_at,omitempty"`
+	// The schedule running the job
+	scheduleId string
+	// An expression of the host facts and the results of other jobs, the job
+	// is skipped without running if false, e.g. facts.os == "linux"
+	RunIf string `json:"run_if,omitempty"`
+	// Hold the job until an admin other than the submitter approves it by
+	// /cmd/approve, async only
+	RequireApproval bool `json:"require_approval,omitempty"`
+	// Checked before the cmd runs, the job is blocked without running if any is unmet
+	Preconditions []Condition `json:"preconditions,omitempty"`
+	// Checked after the cmd succeeds, the job fails if any is unmet, and the
+	// rollback cmd is run then
+	Postconditions []Condition `json:"postconditions,omitempty"`
+	Rollback       string      `json:"rollback,omitempty"`
+
+	// Run the job on an agent having all these tags, forwarded to a peer if
+	// this agent doesn't match, only by /cmd/run and /cmd/run_raw
+	TargetTags []string `json:"target_tags,omitempty"`
+
+	// Mandatory access control of the job, linux only
+	SELinuxContext  string `json:"selinux_context,omitempty"`
+	AppArmorProfile string `json:"apparmor_profile,omitempty"`
+	// Deny the syscalls of seccomp::deny_syscalls, linux amd64 and arm64 only
+	Seccomp bool `json:"seccomp,omitempty"`
+	// Run the job in its own namespaces, linux only
+	Sandbox *Sandbox `json:"sandbox,omitempty"`
+	// Run the job without privileges or at low integrity level, windows only
+	RestrictedToken bool `json:"restricted_token,omitempty"`
+	LowIntegrity    bool `json:"low_integrity,omitempty"`
 }
 
-type QueryCmdRes Job
-type SyncRunCmdRes Job
+type QueryCmdRes = Job
+type SyncRunCmdRes = Job
 type AsyncRuncmdRes struct {
 	Id         string    `json:"id"`
 	CreateTime time.Time `json:"create_time"`
@@ -40,151 +113,902 @@ func init() {
 }
 
 func InitCmdHandler() error {
-	gJobBookkeeper = NewJobBookkeeper(gApp.Cnf.ExpireDays)
+	cnf := gApp.Cnf
+	if cnf.JobDefaultTimeout < 0 || cnf.JobMaxTimeout < 0 {
+		return errors.New("job::default_timeout and job::max_timeout must not be negative")
+	}
+	if cnf.JobMaxTimeout > 0 && cnf.JobDefaultTimeout > cnf.JobMaxTimeout {
+		return fmt.Errorf("job::default_timeout %d is over job::max_timeout %d", cnf.JobDefaultTimeout, cnf.JobMaxTimeout)
+	}
+	if cnf.JobKillGrace < 0 {
+		return errors.New("job::kill_grace must not be negative")
+	}
+	// The jobs live on across a restart by a config apply
+	if gJobBookkeeper != nil && gHttpServer.Restarting() {
+		return nil
+	}
+	gJobBookkeeper = NewJobBookkeeper(cnf.ExpireDays)
 	return nil
 }
 
+// The timeout of a job in seconds: the one requested, else the default of
+// the config, capped to the max of the config
+func jobTimeout(timeout int) int {
+	if timeout == 0 {
+		timeout = gApp.Cnf.JobDefaultTimeout
+	}
+	if max := gApp.Cnf.JobMaxTimeout; max > 0 && (timeout == 0 || timeout > max) {
+		timeout = max
+	}
+	return timeout
+}
+
 func UninitCmdHandler() {
+	if gHttpServer.Restarting() {
+		return
+	}
 	gJobBookkeeper.Close()
 }
 
 func RunCmdHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
-	var req RunCmdReq
+	if r.URL.Query().Get("stream") == "true" {
+		RunStreamCmdHandler(w, r)
+		return
+	}
+	req, ok := parseRunCmdReq(w, r)
+	if !ok {
+		return
+	}
+	if !matchTags(gApp.Cnf.AgentTags(), req.TargetTags) {
+		forwardRun(w, r, req)
+		return
+	}
+
+	job, err := startJob(req, tokenTenant(RequestToken(r)))
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(newJobErrno(err), err.Error()))
+		return
+	}
+
+	var resp interface{}
+	if !req.Async {
+		<-job.Done()
+		resp = job
+	} else {
+		resp = &AsyncRuncmdRes{
+			Id:         job.Id,
+			CreateTime: job.CreateTime,
+		}
+	}
+	ServeJSON(w, NewResponse().SetData(resp))
+
+}
+
+// Handler to run the cmd synchronously, the stdout is returned as the body,
+// and the job's metadata is returned in the headers.
+func RunRawCmdHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := parseRunCmdReq(w, r)
+	if !ok {
+		return
+	}
+	if req.RunAt != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param run_at is not supported by run_raw"))
+		return
+	}
+	if !matchTags(gApp.Cnf.AgentTags(), req.TargetTags) {
+		forwardRun(w, r, req)
+		return
+	}
+
+	job, err := startJob(req, tokenTenant(RequestToken(r)))
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(newJobErrno(err), err.Error()))
+		return
+	}
+	<-job.Done()
+
+	w.Header().Set(ContentType, "text/plain; charset=utf-8")
+	w.Header().Set("X-Job-Id", job.Id)
+	w.Header().Set("X-Job-Status", string(job.Status))
+	w.Header().Set("X-Job-Exit-Code", strconv.Itoa(job.ExitCode))
+	if job.Error != "" {
+		w.Header().Set("X-Job-Error", job.Error)
+	}
+	stdout, _ := job.Output()
+	io.WriteString(w, stdout)
+}
+
+// Handler to run the cmd synchronously streaming its output as server-sent
+// events while it runs: a "started" event with the job id, a "stdout" or
+// "stderr" event of each line, and a "finished" event with the job. The id
+// of a line event is the bytes of stdout and stderr sent, so a client
+// reconnecting with the param id of the job and the Last-Event-ID resumes
+// after them.
+func RunStreamCmdHandler(w http.ResponseWriter, r *http.Request) {
+	// The body is the request, not a form
+	if id := strings.TrimSpace(r.URL.Query().Get("id")); id != "" {
+		resumeStream(w, r, id)
+		return
+	}
+	req, ok := parseRunCmdReq(w, r)
+	if !ok {
+		return
+	}
+	if req.RunAt != nil || req.Async {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param run_at and async are not supported by run_stream"))
+		return
+	}
+	if !matchTags(gApp.Cnf.AgentTags(), req.TargetTags) {
+		ServeJSON(w, NewResponse().SetError(ECNoPeer, "run_stream is not forwarded to the peers: "+errTargetTags.Error()))
+		return
+	}
+
+	job, err := startJob(req, tokenTenant(RequestToken(r)))
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(newJobErrno(err), err.Error()))
+		return
+	}
+	streamJob(w, r, job, nil)
+}
+
+// Stream the job again from the Last-Event-ID, or the param last_event_id
+func resumeStream(w http.ResponseWriter, r *http.Request, id string) {
+	job := gJobBookkeeper.Get(id)
+	if job == nil || !canManageJob(RequestToken(r), job) {
+		ServeJSON(w, NewResponse().SetError(ECJobNotFound, "job not found: "+id))
+		return
+	}
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = r.URL.Query().Get("last_event_id")
+	}
+	var offsets map[string]int64
+	if lastId != "" {
+		var err error
+		if offsets, err = parseStreamEventId(lastId, job); err != nil {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+			return
+		}
+	}
+	log.Debugf("stream of job %s resumed after %s", id, lastId)
+	streamJob(w, r, job, offsets)
+}
+
+// The offsets of stdout and stderr of the event id "<stdout>,<stderr>"
+func parseStreamEventId(s string, job *Job) (map[string]int64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, errors.New("invalid Last-Event-ID: " + s)
+	}
+	stdout, err1 := strconv.ParseInt(parts[0], 10, 64)
+	stderr, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return nil, errors.New("invalid Last-Event-ID: " + s)
+	}
+	offsets, err := outputOffsets(job, stdout, stderr)
+	if err != nil {
+		return nil, errors.New("invalid Last-Event-ID: " + s)
+	}
+	return offsets, nil
+}
+
+// Stream the output of the job past the offsets as server-sent events until
+// it finishes
+func streamJob(w http.ResponseWriter, r *http.Request, job *Job, offsets map[string]int64) {
+	backlog, c := job.Subscribe()
+	defer job.Unsubscribe(c)
+
+	w.Header().Set(ContentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Job-Id", job.Id)
+	flusher, _ := w.(http.Flusher)
+	send := func(event, id string, v interface{}) {
+		b, _ := json.Marshal(v)
+		if id != "" {
+			fmt.Fprintf(w, "id: %s\n", id)
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	}
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	send("started", "", &AsyncRuncmdRes{Id: job.Id, CreateTime: job.Snapshot().CreateTime})
+
+	lines := newStreamLines(job, offsets)
+	emit := func(l *OutputLine) { send(l.Stream, lines.eventId(), l) }
+	add := func(chunk OutputChunk) {
+		if chunk, ok := chunkAfter(chunk, offsets); ok {
+			lines.add(chunk, emit)
+		}
+	}
+	for _, chunk := range backlog {
+		add(chunk)
+	}
+	flush()
+
+	ticker := time.NewTicker(sseKeepalivePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case chunk, ok := <-c:
+			if ok {
+				add(chunk)
+				flush()
+				continue
+			}
+			lines.flush(emit)
+			if !job.Finished() {
+				send("error", "", NewResponse().SetError(ECSubscriberDropped, "output subscriber too slow, dropped"))
+				flush()
+				return
+			}
+			<-job.Done()
+			send("finished", "", job.Snapshot())
+			flush()
+			return
+		case <-ticker.C:
+			// Keep the proxies in between from closing the idle connection
+			fmt.Fprint(w, ": keepalive\n\n")
+			flush()
+		case <-r.Context().Done():
+			return
+		case <-gHttpServer.quitC:
+			return
+		}
+	}
+}
+
+// The output split into lines by stream as it comes, a line is held until
+// its newline or the end of the output
+type streamLines struct {
+	partial map[string]*OutputLine
+	count   map[string]int
+	// Bytes of each stream in the lines emitted
+	sent map[string]int64
+}
+
+// The lines after the offsets continue the numbers of the lines before
+func newStreamLines(job *Job, offsets map[string]int64) *streamLines {
+	o := &streamLines{partial: make(map[string]*OutputLine), count: make(map[string]int), sent: make(map[string]int64)}
+	if len(offsets) > 0 {
+		stdout, stderr := job.Output()
+		for stream, s := range map[string]string{"stdout": stdout, "stderr": stderr} {
+			n := offsets[stream]
+			if n > int64(len(s)) {
+				n = int64(len(s))
+			}
+			o.count[stream] = strings.Count(s[:n], "\n")
+			o.sent[stream] = n
+		}
+	}
+	return o
+}
+
+// The id of the event of the line just emitted
+func (o *streamLines) eventId() string {
+	return fmt.Sprintf("%d,%d", o.sent["stdout"], o.sent["stderr"])
+}
+
+func (o *streamLines) add(chunk OutputChunk, emit func(*OutputLine)) {
+	data := chunk.Data
+	offset := chunk.Offset
+	for data != "" {
+		text := data
+		i := strings.IndexByte(data, '\n')
+		if i >= 0 {
+			text, data = data[:i], data[i+1:]
+			offset += int64(i + 1)
+		} else {
+			offset += int64(len(data))
+			data = ""
+		}
+		l := o.partial[chunk.Stream]
+		if l == nil {
+			o.count[chunk.Stream]++
+			l = &OutputLine{Stream: chunk.Stream, Line: o.count[chunk.Stream], Time: chunk.Time}
+			o.partial[chunk.Stream] = l
+		}
+		l.Text += text
+		if i >= 0 {
+			delete(o.partial, chunk.Stream)
+			o.sent[chunk.Stream] = offset
+			emit(l)
+		}
+	}
+	// Sent with the line once its newline comes
+	if l := o.partial[chunk.Stream]; l != nil {
+		l.end = offset
+	}
+}
+
+// Emit the lines without a newline at the end of the output
+func (o *streamLines) flush(emit func(*OutputLine)) {
+	for _, stream := range []string{"stdout", "stderr"} {
+		if l := o.partial[stream]; l != nil {
+			delete(o.partial, stream)
+			o.sent[stream] = l.end
+			emit(l)
+		}
+	}
+}
+
+func parseRunCmdReq(w http.ResponseWriter, r *http.Request) (*RunCmdReq, bool) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Errorf("failed to read r.Body: %s", err)
 		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to read body"))
-		return
+		return nil, false
 	}
 	defer r.Body.Close()
 
-	if err := json.Unmarshal(body, &req); err != nil {
+	req, errno, err := checkRunCmdReq(body, RequestToken(r))
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(errno, err.Error()))
+		return nil, false
+	}
+	return req, true
+}
+
+// Decode the run request over its profile and check it for the token, the
+// same whichever way the job is submitted
+func checkRunCmdReq(body []byte, tok *Token) (*RunCmdReq, ErrorCode, error) {
+	var req RunCmdReq
+	if err := decodeRunCmdReq(body, &req); err != nil {
+		if req.Profile != "" {
+			return nil, ECInvalidParam, err
+		}
 		log.Errorf("failed to unmarshall data: %s body:%s", err, body)
-		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to unmarshall data"))
-		return
+		return nil, ECUnknown, errors.New("failed to unmarshall data")
 	}
 
-	if req.Cmd == "" {
-		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param cmd is empty"))
-		return
+	if err := req.validate(); err != nil {
+		return nil, ECInvalidParam, err
+	}
+	if err := checkRunAs(tok, req.RunAs); err != nil {
+		return nil, ECForbidden, err
+	}
+	return &req, ECSuccess, nil
+}
+
+func (o *RunCmdReq) validate() error {
+	if o.Cmd == "" && o.Script == "" {
+		return errors.New("param cmd is empty")
+	}
+	if o.Cmd != "" && o.Script != "" {
+		return errors.New("param cmd and script are exclusive")
+	}
+	for _, conds := range [][]Condition{o.Preconditions, o.Postconditions} {
+		if err := validateConditions(conds); err != nil {
+			return err
+		}
+	}
+	if o.Timeout < 0 {
+		return errors.New("param timeout_seconds must not be negative")
+	}
+	if o.CacheTtl < 0 {
+		return errors.New("param cache_ttl_seconds must not be negative")
+	}
+	if o.KeepHistory < 0 {
+		return errors.New("param keep_history must not be negative")
+	}
+	if o.RunAt != nil && !o.Async {
+		return errors.New("param run_at needs async")
+	}
+	if o.RequireApproval && !o.Async {
+		return errors.New("param require_approval needs async")
+	}
+	if o.RunIf != "" {
+		if _, err := ParseExpr(o.RunIf); err != nil {
+			return errors.New("invalid param run_if: " + err.Error())
+		}
+	}
+	for k := range o.Labels {
+		if !labelName.MatchString(k) {
+			return errors.New("invalid label name: " + k)
+		}
+	}
+	if err := validateParseAs(o.ParseAs); err != nil {
+		return err
+	}
+	if err := o.validatePsObjects(); err != nil {
+		return err
+	}
+	return validateCaptureFiles(o.CaptureFiles)
+}
+
+// Create a job for the request and record it, the returned context is
+// canceled when the job is canceled. The id is generated if empty.
+func newJob(req *RunCmdReq, id string) (*Job, context.Context, error) {
+	if err := gMemoryGuard.Admit(); err != nil {
+		return nil, nil, err
 	}
 
 	var job Job
 	job.Cmd = req.Cmd
+	if req.Script != "" {
+		job.Cmd, job.Script = req.Script, true
+	}
+	job.RunAs = req.RunAs
 	job.Dir = req.Dir
 	job.Env = req.Env
-	job.Status = JSRunning
-	job.CreateTime = time.Now()
+	job.EnvPass = req.EnvPass
+	job.IdleTimeout = req.IdleTimeout
+	job.Timeout = jobTimeout(req.Timeout)
+	job.ConcurrencyGroup = req.ConcurrencyGroup
+	job.CaptureFiles = req.CaptureFiles
+	job.ParseAs = req.ParseAs
+	job.PsObjects = req.PsObjects
+	job.PsDepth = req.PsDepth
+	job.Record = req.Record
+	job.Labels = req.Labels
+	job.KeepHistory = req.KeepHistory
+	job.ScheduleId = req.scheduleId
+	job.RunIf = req.RunIf
+	job.RequireApproval = req.RequireApproval
+	job.Preconditions = req.Preconditions
+	job.Postconditions = req.Postconditions
+	job.Rollback = req.Rollback
+	job.SELinuxContext = req.SELinuxContext
+	job.AppArmorProfile = req.AppArmorProfile
+	job.Sandbox = req.Sandbox
+	job.Seccomp = req.Seccomp || gApp.Cnf.SeccompEnforce
+	job.RestrictedToken = req.RestrictedToken
+	job.LowIntegrity = req.LowIntegrity
 	job.FinishTime = time.Unix(0, 0)
 
-	u4, err := uuid.NewV4()
-	if err != nil {
-		log.Errorf("failed to genereate uuid: %s", err)
-		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to generate uuid"))
-		return
+	job.Id = id
+	if job.Id == "" {
+		u4, err := uuid.NewV4()
+		if err != nil {
+			log.Errorf("failed to genereate uuid: %s", err)
+			return nil, nil, errors.New("failed to generate uuid")
+		}
+		job.Id = u4.String()
 	}
-	job.Id = u4.String()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	job.cancelFunc = cancel
+	job.initOutput()
+	job.record(JobEvent{Type: JECreated})
 
+	job.mem = int64(len(job.Cmd) + len(job.Dir))
+	for _, kv := range job.Env {
+		job.mem += int64(len(kv))
+	}
+	gMemoryGuard.Add(job.mem)
 	gJobBookkeeper.Add(&job)
+	gJobSeq.Done(job.Seq)
+	return &job, ctx, nil
+}
 
-	var resp interface{}
-	if !req.Async {
-		cmdWorker(ctx, &job)
-		resp = (*SyncRunCmdRes)(&job)
-	} else {
-		go cmdWorker(ctx, &job)
-		resp = &AsyncRuncmdRes{
-			Id:         job.Id,
-			CreateTime: job.CreateTime,
+// Create a job for the request and queue it to the job pool, the jobs of a
+// tenant share the pool fairly with the others.
+func startJob(req *RunCmdReq, tenant string) (*Job, error) {
+	if !matchTags(gApp.Cnf.AgentTags(), req.TargetTags) {
+		return nil, errTargetTags
+	}
+	if err := checkPolicyCmd(req); err != nil {
+		return nil, err
+	}
+	var key string
+	if req.CacheTtl > 0 {
+		key = jobCacheKey(req, tenant)
+		if job := gJobCache.Get(key); job != nil {
+			log.Debugf("job %s reused from the cache, cmd: %s", job.Id, job.Cmd)
+			return job, nil
 		}
 	}
-	ServeJSON(w, NewResponse().SetData(resp))
+	job, ctx, err := newJob(req, "")
+	if err != nil {
+		return nil, err
+	}
+	job.Tenant = tenant
+	if req.KeepHistory > 0 {
+		job.Template = jobTemplate(req, tenant)
+	}
+	if req.RequireApproval {
+		gApprovals.Add(job, ctx, req)
+	} else if req.RunAt != nil && req.RunAt.After(time.Now()) {
+		err = gDelayedJobs.Add(job, ctx, req)
+	} else {
+		err = submitJob(ctx, job)
+	}
+	if err != nil {
+		log.Warnf("reject job %s: %s", job.Id, err)
+		gJobBookkeeper.Remove(job.Id)
+		job.release()
+		return nil, err
+	}
+	if key != "" {
+		gJobCache.Put(key, job.Id, time.Duration(req.CacheTtl)*time.Second)
+	}
+	if job.Template != "" {
+		go gJobHistory.Watch(job)
+	}
+	return job, nil
+}
 
+// Queue the job to the job pool, or after the earlier jobs of its
+// concurrency group
+func submitJob(ctx context.Context, job *Job) error {
+	run := func() { cmdWorker(ctx, job) }
+	if job.ConcurrencyGroup != "" {
+		return gConcurrencyGroups.Submit(job.ConcurrencyGroup, job.Tenant, run)
+	}
+	return gJobPool.Submit(job.Tenant, run)
+}
+
+// The tenant of the requests authenticated by the token
+func tokenTenant(tok *Token) string {
+	if tok == nil {
+		return ""
+	}
+	return tok.Name
+}
+
+func newJobErrno(err error) ErrorCode {
+	switch err {
+	case errMemoryLimit:
+		return ECMemoryLimit
+	case errQueueFull:
+		return ECQueueFull
+	case errTargetTags:
+		return ECNoPeer
+	case errCmdNotAllowed:
+		return ECForbidden
+	}
+	return ECUnknown
 }
 
 func cmdWorker(ctx context.Context, job *Job) {
+	// Canceled while queued, and finished already
+	if !job.claim() {
+		return
+	}
 	var err error
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
+	// The result recorded when the worker returns
+	fin := JobEvent{Type: JEFinished, Status: JSFailed}
 
 	defer func() {
-		job.FinishTime = time.Now()
-		job.Stdout = stdout.String()
-		job.Stderr = stderr.String()
+		job.record(fin)
+		job.sign()
+		job.closeOutput()
 	}()
 
 	//arch:amd64 os:windows
 	goarch := runtime.GOARCH
 	goos := runtime.GOOS
 
-	var cmd *exec.Cmd
+	if job.RunIf != "" {
+		ok, err := evalRunIf(job.RunIf)
+		if err != nil {
+			log.Warnf("job %s not run, run_if failed: %s", job.Id, err)
+			fin.Error = "run_if failed: " + err.Error()
+			return
+		}
+		if !ok {
+			log.Infof("job %s skipped, run_if is false: %s", job.Id, job.RunIf)
+			fin.Status = JSSkipped
+			fin.Reason = &StatusReason{Code: RCRunIfFalse, Message: job.RunIf}
+			return
+		}
+	}
+
+	if unmet := checkConditions(ctx, job.Preconditions); unmet != nil {
+		log.Warnf("job %s blocked, precondition %s unmet: %s", job.Id, unmet.Type, unmet.Reason)
+		fin.Error = "precondition unmet: " + unmet.Reason
+		fin.Status = JSBlocked
+		fin.Unmet = unmet
+		fin.Reason = &StatusReason{Code: RCPreconditionUnmet, Message: unmet.Reason}
+		return
+	}
+
+	args := []string{"sh", "-c", job.Cmd}
 	if goos == "windows" {
-		cmd = exec.Command("cmd", "/c", job.Cmd)
-	} else {
-		cmd = exec.Command("sh", "-c", job.Cmd)
+		args = []string{"cmd", "/c", job.Cmd}
+	}
+	if len(gApp.Cnf.JobShell) > 0 {
+		args = append(append([]string{}, gApp.Cnf.JobShell...), job.Cmd)
+	}
+	if job.PsObjects {
+		args = psObjectsArgs(job)
+	}
+	var scriptPath string
+	if job.Script {
+		if args, scriptPath, err = writeJobScript(job); err != nil {
+			log.Errorf("write the script of job %s failed: %s", job.Id, err)
+			fin.Error = err.Error()
+			return
+		}
+		defer os.Remove(scriptPath)
 	}
+	shell := args
+	args, err = confineArgs(job, args)
+	if err != nil {
+		log.Errorf("confine job %s failed: %s", job.Id, err)
+		fin.Error = err.Error()
+		return
+	}
+	cmd := exec.Command(args[0], args[1:]...)
 
-	cmd.Dir = job.Dir
-	cmd.Env = append(cmd.Env, job.Env...)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	// The working directory defaults to the jail root in the jail
+	cmd.Dir, err = JailPath(job.Dir)
+	if err != nil {
+		log.Errorf("job %s dir %s denied: %s", job.Id, job.Dir, err)
+		fin.Error = err.Error()
+		return
+	}
+	setProcessGroup(cmd)
+	setNamespaces(cmd, job)
+	if err = setCredential(cmd, job.RunAs); err != nil {
+		log.Errorf("run job %s as %s failed: %s", job.Id, job.RunAs, err)
+		fin.Error = err.Error()
+		return
+	}
+	release, err := setRestrictedToken(cmd, job)
+	if err != nil {
+		log.Errorf("restrict the token of job %s failed: %s", job.Id, err)
+		fin.Error = err.Error()
+		return
+	}
+	defer release()
+	cmd.Env = jobEnv(job)
+	if job.replay != nil {
+		// The jail, the confinement or the policy may have changed since the
+		// recording
+		args, cmd.Dir, cmd.Env, err = job.replay.resolve(job, scriptPath, cmd.Env)
+		if err != nil {
+			log.Errorf("replay job %s refused: %s", job.Id, err)
+			fin.Error = "replay refused: " + err.Error()
+			return
+		}
+		cmd.Path, cmd.Args, cmd.Err = args[0], args, nil
+		if lp, err := exec.LookPath(args[0]); err == nil {
+			cmd.Path = lp
+		}
+	}
+	cmd.Stdout = job.stdout
+	cmd.Stderr = job.stderr
 
 	log.Infof("running cmd: %s, job id: %s arch:%s os:%s", job.Cmd, job.Id, goarch, goos)
 	err = cmd.Start()
 	if err != nil {
 		log.Errorf("cmd.Start failed: %s", err)
-		job.Error = err.Error()
-		job.Status = JSFailed
+		fin.Error = err.Error()
 		return
 	}
 
-	job.Pid = cmd.Process.Pid
+	started := JobEvent{Type: JEStarted, Pid: cmd.Process.Pid}
+	if job.Record {
+		started.Recording = newJobRecording(cmd.Args, shell, cmd.Dir, cmd.Env, scriptPath)
+	}
+	job.record(started)
+
+	var idleC <-chan time.Time
+	if job.IdleTimeout > 0 {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		idleC = ticker.C
+	}
+	var timeoutC <-chan time.Time
+	if job.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(job.Timeout) * time.Second)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
 
 	doneC := make(chan struct{})
+	watchDoneC := make(chan struct{})
 	canceled := false
-	// Wait for context cancel
+	idled := false
+	timedOut := false
+	killPhase := ""
+	// Wait for context cancel, the job being idle too long, or its timeout
 	go func() {
-		select {
-		case <-ctx.Done():
-			canceled = true
-			cmd.Process.Kill()
-			log.Info("canceling the process: ", job.Id)
-		case <-doneC:
+		defer close(watchDoneC)
+		for {
+			select {
+			case <-ctx.Done():
+				canceled = true
+				job.record(JobEvent{Type: JEKilled})
+				log.Info("canceling the process: ", job.Id)
+				killPhase = stopProcess(cmd, doneC)
+				return
+			case <-idleC:
+				if time.Since(job.LastActive()) < time.Duration(job.IdleTimeout)*time.Second {
+					continue
+				}
+				idled = true
+				job.record(JobEvent{Type: JEKilled})
+				log.Warn("killing the idle process: ", job.Id)
+				killPhase = stopProcess(cmd, doneC)
+				return
+			case <-timeoutC:
+				timedOut = true
+				job.record(JobEvent{Type: JEKilled, Reason: &StatusReason{Code: RCTimedOut}})
+				log.Warnf("killing the process running over %d seconds: %s", job.Timeout, job.Id)
+				killPhase = stopProcess(cmd, doneC)
+				return
+			case <-doneC:
+				return
+			}
 		}
 	}()
 
 	// Wait until the process exits or be killed
 	err = cmd.Wait()
 	close(doneC)
+	<-watchDoneC
+	fin.KillPhase = killPhase
+	fin.Files = captureFiles(job)
+	if job.PsObjects {
+		fin.Objects, fin.ParseError = psObjects(job)
+	} else {
+		fin.Parsed, fin.ParseError = parseJobOutput(job)
+	}
+	if cmd.ProcessState != nil {
+		fin.ExitCode, fin.Signal = exitStatus(cmd.ProcessState)
+	}
 	if err != nil {
 		// The process has been killed, exit with non-zero, or termiated by some signal
 		log.Error("c.Process.Wait failed: ", err)
 
-		if ee, ok := err.(*exec.ExitError); ok && ee.Exited() {
-			exitCode := ee.Sys().(syscall.WaitStatus).ExitStatus()
-			log.Error("process exited with non-zero exit code: ", exitCode)
-			job.ExitCode = exitCode
+		if fin.Signal != "" {
+			log.Error("process terminated by signal: ", fin.Signal)
+		} else if fin.ExitCode != 0 {
+			log.Error("process exited with non-zero exit code: ", fin.ExitCode)
 		}
 
-		job.Error = err.Error()
-		job.Status = JSFailed
+		fin.Error = err.Error()
+		fin.Status = JSFailed
 
 	} else {
 		log.Info("process finished: ", job.Id)
-		job.Status = JSFinished
+		fin.Status = JSFinished
 	}
 
 	// If has been canceled by user
 	if canceled {
 		log.Warn("process canceled: ", job.Id)
-		job.Error = err.Error()
-		job.Status = JSCanceled
+		// Nil if it exited cleanly when asked to
+		if err != nil {
+			fin.Error = err.Error()
+		} else {
+			fin.Error = "canceled by request"
+		}
+		fin.Status = JSCanceled
+	}
+
+	if idled {
+		fin.Error = fmt.Sprintf("killed because of no output for %d seconds", job.IdleTimeout)
+		fin.Status = JSFailed
+	}
+
+	if timedOut {
+		fin.Error = fmt.Sprintf("killed because of running over %d seconds", job.Timeout)
+		fin.Status = JSTimedOut
+		fin.Reason = &StatusReason{Code: RCTimedOut, Message: fin.Error}
+	}
+
+	if fin.Status == JSFinished && len(job.Postconditions) > 0 {
+		unmet := checkConditions(ctx, job.Postconditions)
+		if ctx.Err() != nil {
+			log.Warn("process canceled while checking the postconditions: ", job.Id)
+			fin.Error = "canceled while checking the postconditions"
+			fin.Status = JSCanceled
+		} else if unmet != nil {
+			log.Warnf("job %s failed, postcondition %s unmet: %s", job.Id, unmet.Type, unmet.Reason)
+			fin.Error = "postcondition unmet: " + unmet.Reason
+			fin.Status = JSFailed
+			fin.Unmet = unmet
+			if job.Rollback != "" {
+				fin.RollbackJobId = runRollback(job)
+			}
+		}
+	}
+}
+
+// Stop the process in two phases: ask it to exit, then kill it if it is
+// still running after job::kill_grace seconds. Returns the phase which
+// stopped it.
+func stopProcess(cmd *exec.Cmd, doneC <-chan struct{}) string {
+	if grace := gApp.Cnf.JobKillGrace; grace > 0 {
+		if err := terminateProcessTree(cmd); err != nil {
+			log.Warnf("failed to terminate the process %d: %s", cmd.Process.Pid, err)
+		} else {
+			select {
+			case <-doneC:
+				return KPTerminate
+			case <-time.After(time.Duration(grace) * time.Second):
+				log.Warnf("the process %d is still running after %d seconds, killing it", cmd.Process.Pid, grace)
+			}
+		}
+	}
+	killProcessTree(cmd)
+	return KPKill
+}
+
+// The exit code of the exited process, or -1 and the signal terminating it.
+// The wait status is only asserted for the signal, which windows never has.
+func exitStatus(state *os.ProcessState) (int, string) {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return -1, ws.Signal().String()
+	}
+	return state.ExitCode(), ""
+}
+
+// Run the rollback cmd of the job as a job of its own with the same settings.
+// It runs in the worker of the job rather than waiting for the pool again.
+func runRollback(job *Job) string {
+	req := &RunCmdReq{
+		Cmd:             job.Rollback,
+		RunAs:           job.RunAs,
+		Dir:             job.Dir,
+		Env:             job.Env,
+		EnvPass:         job.EnvPass,
+		IdleTimeout:     job.IdleTimeout,
+		Timeout:         job.Timeout,
+		SELinuxContext:  job.SELinuxContext,
+		AppArmorProfile: job.AppArmorProfile,
+		Seccomp:         job.Seccomp,
+		Sandbox:         job.Sandbox,
+		RestrictedToken: job.RestrictedToken,
+		LowIntegrity:    job.LowIntegrity,
+	}
+	// The policy may have changed since the job was accepted
+	if err := checkPolicyCmd(req); err != nil {
+		log.Errorf("rollback of job %s refused: %s, cmd: %s", job.Id, err, req.Cmd)
+		return ""
+	}
+	rb, ctx, err := newJob(req, "")
+	if err != nil {
+		log.Errorf("rollback of job %s failed: %s", job.Id, err)
+		return ""
+	}
+	rb.Tenant = job.Tenant
+	log.Warnf("rolling back job %s by job %s, cmd: %s", job.Id, rb.Id, rb.Cmd)
+	cmdWorker(ctx, rb)
+	return rb.Id
+}
+
+// The environment of the job: the agent's environment, or the part selected
+// by env_pass, or none if only env is given, then the configured defaults,
+// then env of the job. The later ones win.
+func jobEnv(job *Job) []string {
+	var env []string
+	if len(job.EnvPass) > 0 {
+		env = passEnv(job.EnvPass)
+	} else if len(job.Env) == 0 {
+		env = os.Environ()
+	}
+	env = append(env, gApp.Cnf.JobEnv...)
+	if gApp.Cnf.JobPath != "" {
+		env = append(env, "PATH="+gApp.Cnf.JobPath)
 	}
+	return append(env, job.Env...)
+}
 
+// Select the agent's environment variables whose name matches any of the
+// patterns. The values are not recorded into the job, as they may be secrets.
+func passEnv(patterns []string) []string {
+	env := []string{}
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		for _, p := range patterns {
+			if runtime.GOOS == "windows" {
+				// Environment variables are case insensitive on windows
+				name, p = strings.ToUpper(name), strings.ToUpper(p)
+			}
+			if ok, _ := path.Match(p, name); ok {
+				env = append(env, kv)
+				break
+			}
+		}
+	}
+	return env
 }
 
 // Handler to query the job info by job id
@@ -194,35 +1018,240 @@ func QueryCmdHandler(w http.ResponseWriter, r *http.Request) {
 		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param id is empty"))
 		return
 	}
-	job := gJobBookkeeper.Get(id)
-	if job == nil {
+	// Marshalled twice below, the snapshot keeps the etag matching the body
+	resp := gJobBookkeeper.Snapshot(id)
+	if resp != nil && !canManageJob(RequestToken(r), resp) {
+		resp = nil
+	}
+	if resp == nil && proxyForwarded(w, r, id) {
+		return
+	}
+	if resp == nil {
 		ServeJSON(w, NewResponse().SetError(ECJobNotFound, "job not found: "+id))
 		return
 	}
-	resp := (*QueryCmdRes)(job)
+
+	// Polling clients get a cheap 304 if the job is unchanged
+	b, err := json.Marshal(resp)
+	if err == nil {
+		etag := fmt.Sprintf(`"%x"`, sha1.Sum(b))
+		w.Header().Set("ETag", etag)
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
 	ServeJSON(w, NewResponse().SetData(resp))
 
 }
 
+func etagMatch(ifNoneMatch string, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler to list the jobs, all or those matching the param filter
 func ListCmdHandler(w http.ResponseWriter, r *http.Request) {
-	jobs := gJobBookkeeper.GetAll()
+	filter, err := requestJobFilter(r)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	tok := RequestToken(r)
+	jobs := []*Job{}
+	for _, s := range gJobBookkeeper.Snapshots() {
+		if canManageJob(tok, s) && (filter == nil || filter.match(s)) {
+			jobs = append(jobs, s)
+		}
+	}
 	ServeJSON(w, NewResponse().SetData(jobs))
 }
 
-// Handler to cancel the job by job id
+// Handler to list all jobs as newline delimited json, one job per line, so
+// that very large histories can be consumed incrementally. The param filter
+// selects the jobs as /cmd/list does.
+func ListCmdNdjsonHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := requestJobFilter(r)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	tok := RequestToken(r)
+	jobs := gJobBookkeeper.GetAll()
+	w.Header().Set(ContentType, NdjsonContentType)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for i, j := range jobs {
+		j.UpdateLiveness()
+		s := j.Snapshot()
+		if !canManageJob(tok, s) || (filter != nil && !filter.match(s)) {
+			continue
+		}
+		if err := enc.Encode(s); err != nil {
+			log.Errorf("Error occured when marshalling job: %s", err)
+			return
+		}
+		if flusher != nil && i%100 == 99 {
+			flusher.Flush()
+		}
+	}
+}
+
+// Handler to cancel the job by job id, or in bulk the unfinished jobs
+// matching the param filter
 func CancelCmdHandler(w http.ResponseWriter, r *http.Request) {
 	id := strings.TrimSpace(r.FormValue("id"))
-	job := gJobBookkeeper.Get(id)
-	if job == nil {
-		ServeJSON(w, NewResponse().SetError(ECJobNotFound, "job not found: "+id))
+	if id == "" && r.FormValue("filter") != "" {
+		cancelJobs(w, r)
 		return
 	}
-	if job.Status != JSRunning {
-		ServeJSON(w, NewResponse().SetError(ECJobNotRunning, "job is not running: "+id))
+	if gJobBookkeeper.Get(id) == nil && proxyForwarded(w, r, id) {
+		return
+	}
+	if errno, err := cancelJob(id, RequestToken(r)); err != nil {
+		ServeJSON(w, NewResponse().SetError(errno, err.Error()))
 		return
 	}
-	// Cancel the job
-	job.cancelFunc()
 	ServeJSON(w, NewResponse())
 	return
 }
+
+// Handler to delete the records of finished jobs with their output, by id,
+// or in bulk by the param filter, and the older params status, tenant,
+// schedule_id and before (the finish time), all of them given must match. A
+// token which is not admin deletes only its own jobs.
+func DeleteCmdHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+		ServeJSONWithStatus(w, http.StatusMethodNotAllowed, NewResponse().SetError(ECInvalidParam, "use DELETE or POST"))
+		return
+	}
+	tok := RequestToken(r)
+	id := strings.TrimSpace(r.FormValue("id"))
+	if id != "" {
+		job := gJobBookkeeper.Get(id)
+		if job == nil && proxyForwarded(w, r, id) {
+			return
+		}
+		if job == nil || !canManageJob(tok, job) {
+			ServeJSON(w, NewResponse().SetError(ECJobNotFound, "job not found: "+id))
+			return
+		}
+		deleted := gJobBookkeeper.Delete(func(j *Job) bool { return j.Id == id })
+		if len(deleted) == 0 {
+			ServeJSON(w, NewResponse().SetError(ECJobNotFinished, "job is not finished: "+id))
+			return
+		}
+		log.Infof("audit: job %s deleted by %s", id, tokenTenant(tok))
+		ServeJSON(w, NewResponse().SetData([]string{id}))
+		return
+	}
+
+	// Comma separated
+	statuses := make(map[string]bool)
+	for _, s := range strings.Split(r.FormValue("status"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			statuses[s] = true
+		}
+	}
+	tenant := r.FormValue("tenant")
+	scheduleId := r.FormValue("schedule_id")
+	var before time.Time
+	if s := r.FormValue("before"); s != "" {
+		var err error
+		if before, err = time.Parse(time.RFC3339, s); err != nil {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid param before: "+s))
+			return
+		}
+	}
+	filter, err := requestJobFilter(r)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	if len(statuses) == 0 && tenant == "" && scheduleId == "" && before.IsZero() && filter == nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param id, filter, status, tenant, schedule_id or before is needed"))
+		return
+	}
+	deleted := gJobBookkeeper.Delete(func(j *Job) bool {
+		if !canManageJob(tok, j) || !matchJob(filter, j) {
+			return false
+		}
+		if len(statuses) > 0 && !statuses[string(j.CurrentStatus())] {
+			return false
+		}
+		if (tenant != "" && j.Tenant != tenant) || (scheduleId != "" && j.ScheduleId != scheduleId) {
+			return false
+		}
+		return before.IsZero() || j.FinishTime.Before(before)
+	})
+	ids := make([]string, 0, len(deleted))
+	for _, j := range deleted {
+		ids = append(ids, j.Id)
+	}
+	log.Infof("audit: %d jobs deleted by %s, filter: %s", len(ids), tokenTenant(tok), r.Form.Encode())
+	ServeJSON(w, NewResponse().SetData(ids))
+}
+
+// Admins see, delete or replay any job, the others only their own
+func canManageJob(tok *Token, job *Job) bool {
+	return tok == nil || tok.Admin || job.Tenant == tok.Name
+}
+
+// The job of the id the token manages, nil otherwise, so that the jobs of the
+// other tenants are not found
+func managedJob(id string, tok *Token) *Job {
+	job := gJobBookkeeper.Get(id)
+	if job == nil || !canManageJob(tok, job) {
+		return nil
+	}
+	return job
+}
+
+// Cancel the unfinished jobs matching the filter, which the token manages
+func cancelJobs(w http.ResponseWriter, r *http.Request) {
+	tok := RequestToken(r)
+	filter, err := requestJobFilter(r)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	ids := []string{}
+	for _, j := range gJobBookkeeper.GetAll() {
+		if j.Finished() || !canManageJob(tok, j) || !matchJob(filter, j) {
+			continue
+		}
+		if _, err := cancelJob(j.Id, tok); err == nil {
+			ids = append(ids, j.Id)
+		}
+	}
+	log.Infof("audit: %d jobs canceled by %s, filter: %s", len(ids), tokenTenant(tok), r.FormValue("filter"))
+	ServeJSON(w, NewResponse().SetData(ids))
+}
+
+// Cancel the job for the token, the jobs it doesn't manage are not found
+// like in DeleteCmdHandler. Nil means the agent itself.
+func cancelJob(id string, tok *Token) (ErrorCode, error) {
+	job := gJobBookkeeper.Get(id)
+	if job == nil || !canManageJob(tok, job) {
+		return ECJobNotFound, errors.New("job not found: " + id)
+	}
+	// A queued, scheduled or pending job finishes at once without running
+	if job.cancelPending() {
+		gDelayedJobs.Remove(id)
+		gApprovals.Remove(id)
+		log.Infof("job %s canceled before running", id)
+		return ECSuccess, nil
+	}
+	// Queued here means taken by a worker and about to start
+	if s := job.CurrentStatus(); s != JSRunning && s != JSQueued {
+		return ECJobNotRunning, errors.New("job is not running or pending: " + id)
+	}
+	// Cancel the job
+	job.cancelFunc()
+	return ECSuccess, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Set up the globals the jobs need without starting the http server
+func setupJobs(t testing.TB) {
+	cnf := NewConfig()
+	cnf.MemorySpillDir = t.TempDir()
+	cnf.JobKillGrace = 5
+	gApp.Cnf = cnf
+	gMemoryGuard = NewMemoryGuard(0)
+	gJobBookkeeper = NewJobBookkeeper(1)
+	gDelayedJobs = NewDelayedJobs(t.TempDir())
+	t.Cleanup(func() {
+		gDelayedJobs.Close()
+		gJobBookkeeper.Close()
+		gMemoryGuard.Close()
+	})
+}
+
+// Wait until the stdout of the job contains s
+func waitOutput(t *testing.T, job *Job, s string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if stdout, _ := job.Output(); strings.Contains(stdout, s) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s didn't output %q", job.Id, s)
+}
+
+func TestCancelJobExitingOnTerm(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	setupJobs(t)
+	job, ctx, err := newJob(&RunCmdReq{Cmd: "trap 'exit 0' TERM; echo ready; while :; do sleep 0.1; done"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cmdWorker(ctx, job)
+	waitOutput(t, job, "ready")
+
+	if code, err := cancelJob(job.Id, nil); err != nil {
+		t.Fatalf("cancel failed: %d %s", code, err)
+	}
+	select {
+	case <-job.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("job not stopped")
+	}
+	s := job.Snapshot()
+	if s.Status != JSCanceled || s.KillPhase != KPTerminate || s.ExitCode != 0 {
+		t.Fatalf("got status %s, kill_phase %s, exit_code %d", s.Status, s.KillPhase, s.ExitCode)
+	}
+	if s.Error != "canceled by request" {
+		t.Fatalf("got error %q", s.Error)
+	}
+}
+
+func TestCancelJobOfOtherTenant(t *testing.T) {
+	setupJobs(t)
+	job, _, err := newJob(&RunCmdReq{Cmd: "true"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Tenant = "team-a"
+	if errno, _ := cancelJob(job.Id, &Token{Name: "team-b"}); errno != ECJobNotFound {
+		t.Fatalf("canceled by another tenant, errno %d", errno)
+	}
+	if job.CurrentStatus() != JSQueued {
+		t.Fatalf("got status %s", job.CurrentStatus())
+	}
+	if _, err := cancelJob(job.Id, &Token{Name: "team-a"}); err != nil {
+		t.Fatal(err)
+	}
+	if job.CurrentStatus() != JSCanceled {
+		t.Fatalf("got status %s", job.CurrentStatus())
+	}
+}
+
+func TestStreamLinesResume(t *testing.T) {
+	setupJobs(t)
+	job, _, err := newJob(&RunCmdReq{Cmd: "true"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.stdout.Write([]byte("a1\na2\n"))
+	job.stderr.Write([]byte("b1\n"))
+	job.stdout.Write([]byte("a3\npartial"))
+
+	collect := func(offsets map[string]int64) (got []string) {
+		lines := newStreamLines(job, offsets)
+		emit := func(l *OutputLine) {
+			got = append(got, fmt.Sprintf("%s:%d:%s@%s", l.Stream, l.Line, l.Text, lines.eventId()))
+		}
+		for _, chunk := range job.OutputChunks() {
+			if chunk, ok := chunkAfter(chunk, offsets); ok {
+				lines.add(chunk, emit)
+			}
+		}
+		lines.flush(emit)
+		return got
+	}
+	all := collect(nil)
+	want := []string{"stdout:1:a1@3,0", "stdout:2:a2@6,0", "stderr:1:b1@6,3", "stdout:3:a3@9,3", "stdout:4:partial@16,3"}
+	if fmt.Sprint(all) != fmt.Sprint(want) {
+		t.Fatalf("got %v", all)
+	}
+	// Resumed after the event of a2
+	offsets, err := parseStreamEventId("6,0", job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := collect(offsets); fmt.Sprint(got) != fmt.Sprint(want[2:]) {
+		t.Fatalf("got %v", got)
+	}
+	for _, bad := range []string{"6", "17,0", "-1,0", "a,b"} {
+		if _, err := parseStreamEventId(bad, job); err == nil {
+			t.Errorf("%s parsed", bad)
+		}
+	}
+}
+
+// A token which is not admin reads only the jobs of its tenant
+func TestReadJobsOfOtherTenant(t *testing.T) {
+	setupJobs(t)
+	job, _, err := newJob(&RunCmdReq{Cmd: "true"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Tenant = "team-a"
+	request := func(tok *Token, handler http.HandlerFunc, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, withToken(httptest.NewRequest("GET", url, nil), tok))
+		return w
+	}
+	a, b := &Token{Name: "team-a"}, &Token{Name: "team-b"}
+	for _, c := range []struct {
+		handler http.HandlerFunc
+		url     string
+	}{
+		{QueryCmdHandler, "/api/v1/cmd/query?id=" + job.Id},
+		{JobEventsHandler, "/api/v1/cmd/events?id=" + job.Id},
+		{OutputCmdHandler, "/api/v1/cmd/output?id=" + job.Id},
+		{DiffCmdHandler, "/api/v1/cmd/diff?a=" + job.Id + "&b=" + job.Id},
+		{NotifySseHandler, "/api/v1/cmd/notify_sse?id=" + job.Id},
+	} {
+		if w := request(b, c.handler, c.url); !strings.Contains(w.Body.String(), "job not found") {
+			t.Errorf("%s: got %s", c.url, w.Body)
+		}
+	}
+	if w := request(a, QueryCmdHandler, "/api/v1/cmd/query?id="+job.Id); !strings.Contains(w.Body.String(), job.Id) {
+		t.Errorf("query of its own job: got %s", w.Body)
+	}
+	for _, h := range []http.HandlerFunc{ListCmdHandler, ListCmdNdjsonHandler} {
+		for tok, want := range map[*Token]bool{a: true, b: false, {Name: "root", Admin: true}: true} {
+			if w := request(tok, h, "/api/v1/cmd/list"); strings.Contains(w.Body.String(), job.Id) != want {
+				t.Errorf("%s: got %s", tok.Name, w.Body)
+			}
+		}
+	}
+}
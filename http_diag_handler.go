@@ -0,0 +1,248 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const pprofUrlPrefix = adminUrlPrefix + "pprof/"
+
+// Size of the tail of app.log put into the bundle
+const diagLogTail = 1 << 20
+
+const redacted = "<redacted>"
+
+type DiagInfo struct {
+	Version    string       `json:"version"`
+	GoVersion  string       `json:"go_version"`
+	Os         string       `json:"os"`
+	Arch       string       `json:"arch"`
+	Hostname   string       `json:"hostname"`
+	Pid        int          `json:"pid"`
+	NumCpu     int          `json:"num_cpu"`
+	Goroutines int          `json:"goroutines"`
+	LogLevel   string       `json:"log_level"`
+	LogOutputs []string     `json:"log_outputs"`
+	JobMemory  int64        `json:"job_memory"`       // Bytes held by the jobs
+	JobMemCap  int64        `json:"job_memory_limit"` // 0 means unlimited
+	Pools      []*PoolStats `json:"pools"`
+	SelfCheck  *SelfCheck   `json:"self_check,omitempty"`
+	Time       time.Time    `json:"time"`
+}
+
+// The state of a job without its output and environment
+type DiagJob struct {
+	Id             string    `json:"id"`
+	Status         JobStatus `json:"status"`
+	Error          string    `json:"error,omitempty"`
+	Cmd            string    `json:"cmd"`
+	RunAs          string    `json:"run_as,omitempty"`
+	Dir            string    `json:"dir"`
+	Pid            int       `json:"pid"`
+	ExitCode       int       `json:"exit_code"`
+	StdoutSize     int       `json:"stdout_size"`
+	StderrSize     int       `json:"stderr_size"`
+	CreateTime     time.Time `json:"create_time"`
+	FinishTime     time.Time `json:"finish_time"`
+	LastOutputTime time.Time `json:"last_output_time"`
+	Liveness       Liveness  `json:"liveness,omitempty"`
+}
+
+// Handler to download a zip bundle for troubleshooting: the goroutine dump,
+// the heap profile, the tail of the log, the redacted config and the jobs.
+func DiagHandler(w http.ResponseWriter, r *http.Request) {
+	hostname, _ := os.Hostname()
+	name := "shell-agent-diag-" + hostname + "-" + time.Now().Format("20060102-150405") + ".zip"
+	by := r.RemoteAddr
+	if tok := RequestToken(r); tok != nil {
+		by = tok.Name
+	}
+	log.Infof("audit: diag bundle downloaded by %s", by)
+
+	w.Header().Set(ContentType, "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(name))
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	entries := []struct {
+		name  string
+		write func(io.Writer) error
+	}{
+		{"info.json", writeDiagInfo},
+		{"goroutines.txt", func(w io.Writer) error { return rpprof.Lookup("goroutine").WriteTo(w, 2) }},
+		{"heap.pprof", func(w io.Writer) error {
+			runtime.GC()
+			return rpprof.Lookup("heap").WriteTo(w, 0)
+		}},
+		{"memstats.json", func(w io.Writer) error {
+			var stat runtime.MemStats
+			runtime.ReadMemStats(&stat)
+			return writeDiagJSON(w, stat)
+		}},
+		{"config.json", func(w io.Writer) error { return writeDiagJSON(w, redactedConfig(gApp.Cnf)) }},
+		{"jobs.json", writeDiagJobs},
+		{"app.log", writeDiagLog},
+	}
+	for _, e := range entries {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			log.Errorf("write diag bundle failed: %s", err)
+			return
+		}
+		// Keep the rest of the bundle if one part fails
+		if err = e.write(f); err != nil {
+			log.Warnf("collect %s of diag bundle failed: %s", e.name, err)
+			io.WriteString(f, "\nfailed to collect: "+err.Error()+"\n")
+		}
+	}
+}
+
+func writeDiagJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func writeDiagInfo(w io.Writer) error {
+	hostname, _ := os.Hostname()
+	info := &DiagInfo{
+		Version:    VERSION,
+		GoVersion:  runtime.Version(),
+		Os:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		Hostname:   hostname,
+		Pid:        os.Getpid(),
+		NumCpu:     runtime.NumCPU(),
+		Goroutines: runtime.NumGoroutine(),
+		LogLevel:   log.GetLevel().String(),
+		Time:       time.Now(),
+	}
+	if gLogTargets != nil {
+		info.LogOutputs = gLogTargets.Names()
+	}
+	if gJobPool != nil {
+		info.Pools = []*PoolStats{gJobPool.Stats()}
+	}
+	info.SelfCheck = gSelfCheck
+	if gMemoryGuard != nil {
+		info.JobMemory, info.JobMemCap = gMemoryGuard.Used(), gMemoryGuard.Limit()
+	}
+	return writeDiagJSON(w, info)
+}
+
+func writeDiagJobs(w io.Writer) error {
+	jobs := gJobBookkeeper.GetAll()
+	res := make([]*DiagJob, 0, len(jobs))
+	for _, job := range jobs {
+		job.UpdateLiveness()
+		stdout, stderr := job.OutputSize()
+		j := job.snapshot(false)
+		res = append(res, &DiagJob{
+			Id:             j.Id,
+			Status:         j.Status,
+			Error:          j.Error,
+			Cmd:            j.Cmd,
+			RunAs:          j.RunAs,
+			Dir:            j.Dir,
+			Pid:            j.Pid,
+			ExitCode:       j.ExitCode,
+			StdoutSize:     stdout,
+			StderrSize:     stderr,
+			CreateTime:     j.CreateTime,
+			FinishTime:     j.FinishTime,
+			LastOutputTime: j.LastOutputTime,
+			Liveness:       j.Liveness,
+		})
+	}
+	return writeDiagJSON(w, res)
+}
+
+func writeDiagLog(w io.Writer) error {
+	f, err := os.Open(filepath.Join(gApp.Cnf.LogDir, "app.log"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() > diagLogTail {
+		if _, err = f.Seek(-diagLogTail, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Copy the config with the secrets masked
+func redactedConfig(cnf *Config) *Config {
+	c := *cnf
+	for _, s := range []*string{&c.ControllerToken, &c.SmtpPassword, &c.AuthAdminToken, &c.BootstrapToken, &c.PeerToken} {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	for _, s := range []*string{&c.ProxyUrl, &c.FetchProxy, &c.ControllerUrl} {
+		*s = redactUrl(*s)
+	}
+	c.PeerUrls = make([]string, len(cnf.PeerUrls))
+	for i, u := range cnf.PeerUrls {
+		c.PeerUrls[i] = redactUrl(u)
+	}
+	c.Shares = make([]*NetworkShare, len(cnf.Shares))
+	for i, s := range cnf.Shares {
+		masked := *s
+		if masked.Password != "" {
+			masked.Password = redacted
+		}
+		c.Shares[i] = &masked
+	}
+	// The values of the job env may be credentials too
+	c.JobEnv = make([]string, len(cnf.JobEnv))
+	for i, kv := range cnf.JobEnv {
+		c.JobEnv[i] = strings.SplitN(kv, "=", 2)[0] + "=" + redacted
+	}
+	return &c
+}
+
+// Handler of net/http/pprof under /api/v1/admin/pprof/, e.g.
+// go tool pprof http://<agent>/api/v1/admin/pprof/profile?seconds=30
+func PprofHandler(w http.ResponseWriter, r *http.Request) {
+	if !gApp.Cnf.AdminPprof {
+		ServeJSONWithStatus(w, http.StatusForbidden, NewResponse().SetError(ECForbidden, "pprof is disabled by admin::pprof"))
+		return
+	}
+	switch name := strings.TrimPrefix(r.URL.Path, pprofUrlPrefix); name {
+	case "":
+		// The index only lists the profiles under /debug/pprof/
+		r.URL.Path = "/debug/pprof/"
+		pprof.Index(w, r)
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Handler(name).ServeHTTP(w, r)
+	}
+}
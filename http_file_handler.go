@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type FetchFileReq struct {
+	Url       string `json:"url"`
+	Path      string `json:"path"`
+	Checksum  string `json:"checksum,omitempty"`   // Format: <algo>:<hex>, algo is md5, sha1, sha256 or sha512
+	Retries   int    `json:"retries,omitempty"`    // Default to the configured retries
+	RateLimit int    `json:"rate_limit,omitempty"` // KB per second, can only lower the configured limit
+	// Base64 encoded ed25519 signature of the file, default to the one at
+	// <url>.sig, checked only with fetch::public_keys
+	Signature string `json:"signature,omitempty"`
+}
+
+type FetchFileRes struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+	Attempts int    `json:"attempts"`
+}
+
+var (
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errSignatureInvalid = errors.New("invalid signature")
+)
+
+var (
+	// Shared by all transfers, so that concurrent transfers can't saturate the NIC together
+	gTotalRateLimiter *RateLimiter
+	// The keys of fetch::public_keys
+	gFetchKeys []ed25519.PublicKey
+)
+
+func init() {
+	gHttpServer.AddToInit(InitFileHandler)
+}
+
+func InitFileHandler() error {
+	gTotalRateLimiter = NewRateLimiter(int64(gApp.Cnf.TotalRateLimit) * 1024)
+	gFetchKeys = nil
+	for _, s := range gApp.Cnf.FetchPublicKeys {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			log.Errorf("invalid fetch public key: %s", s)
+			return errors.New("invalid fetch public key")
+		}
+		gFetchKeys = append(gFetchKeys, b)
+	}
+	return nil
+}
+
+// Wrap r with the per fetch limit and the total limit
+func throttle(r io.Reader, rate int) io.Reader {
+	r = NewThrottledReader(r, NewRateLimiter(int64(rate)*1024))
+	return NewThrottledReader(r, gTotalRateLimiter)
+}
+
+// Handler to download a url to a local path
+func FetchFileHandler(w http.ResponseWriter, r *http.Request) {
+	var req FetchFileReq
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("failed to read r.Body: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to read body"))
+		return
+	}
+	defer r.Body.Close()
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		log.Errorf("failed to unmarshall data: %s body:%s", err, body)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to unmarshall data"))
+		return
+	}
+
+	if req.Url == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param url is empty"))
+		return
+	}
+	if req.Path == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param path is empty"))
+		return
+	}
+
+	algo, sum := "sha256", ""
+	if req.Checksum != "" {
+		parts := strings.SplitN(req.Checksum, ":", 2)
+		if len(parts) != 2 || newHash(parts[0]) == nil {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid checksum: "+req.Checksum))
+			return
+		}
+		algo, sum = strings.ToLower(parts[0]), strings.ToLower(parts[1])
+	}
+
+	path, err := JailPath(req.Path)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECPathNotAllowed, err.Error()))
+		return
+	}
+
+	retries := req.Retries
+	if retries <= 0 {
+		retries = gApp.Cnf.FetchRetries
+	}
+	if retries > gApp.Cnf.FetchMaxRetries {
+		retries = gApp.Cnf.FetchMaxRetries
+	}
+	rate := gApp.Cnf.FetchRateLimit
+	if req.RateLimit > 0 && (rate <= 0 || req.RateLimit < rate) {
+		rate = req.RateLimit
+	}
+	res := &FetchFileRes{Path: req.Path}
+	for {
+		res.Attempts++
+		res.Size, res.Checksum, err = fetchFile(req.Url, path, algo, sum, req.Signature, rate)
+		// The same url would give the same content again
+		if err == nil || err == errChecksumMismatch || err == errSignatureInvalid || res.Attempts > retries {
+			break
+		}
+		log.Warnf("fetch %s failed, attempt %d: %s", req.Url, res.Attempts, err)
+		time.Sleep(time.Duration(res.Attempts) * time.Second)
+	}
+
+	if err == errChecksumMismatch {
+		ServeJSON(w, NewResponse().SetError(ECChecksumMismatch, "checksum mismatch: "+res.Checksum).SetData(res))
+		return
+	}
+	if err == errSignatureInvalid {
+		log.Warnf("audit: fetch %s refused: %s", req.Url, err)
+		ServeJSON(w, NewResponse().SetError(ECSignatureInvalid, err.Error()).SetData(res))
+		return
+	}
+	if err != nil {
+		log.Errorf("fetch %s failed: %s", req.Url, err)
+		ServeJSON(w, NewResponse().SetError(ECFetchFailed, err.Error()).SetData(res))
+		return
+	}
+	log.Infof("fetched %s to %s, size: %d", req.Url, req.Path, res.Size)
+	ServeJSON(w, NewResponse().SetData(res))
+}
+
+// Download rawurl into a temporary file beside path, then move it to path
+// only if the checksum matches and, with fetch::public_keys, the signature is
+// valid.
+func fetchFile(rawurl, path, algo, sum, sig string, rate int) (int64, string, error) {
+	client := &http.Client{
+		Timeout: time.Duration(gApp.Cnf.FetchTimeout) * time.Second,
+		Transport: &http.Transport{
+			Proxy:                 fetchProxy,
+			DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: time.Duration(gApp.Cnf.FetchHeaderTimeout) * time.Second,
+		},
+	}
+	resp, err := client.Get(rawurl)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", fmt.Errorf("unexpected http status: %s", resp.Status)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, "", err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".fetch")
+	if err != nil {
+		return 0, "", err
+	}
+	defer os.Remove(f.Name())
+
+	h := newHash(algo)
+	n, err := io.Copy(io.MultiWriter(f, h), throttle(resp.Body, rate))
+	f.Close()
+	if err != nil {
+		return n, "", err
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if sum != "" && sum != actual {
+		return n, algo + ":" + actual, errChecksumMismatch
+	}
+	if len(gFetchKeys) > 0 {
+		if err = verifyFetched(client, f.Name(), rawurl, sig); err != nil {
+			return n, algo + ":" + actual, err
+		}
+	}
+	return n, algo + ":" + actual, os.Rename(f.Name(), path)
+}
+
+// Verify the downloaded file by any of the keys, against sig or the signature
+// at <rawurl>.sig
+func verifyFetched(client *http.Client, name, rawurl, sig string) error {
+	if sig == "" {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return err
+		}
+		u.Path += ".sig"
+		resp, err := client.Get(u.String())
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return errSignatureInvalid
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected http status of the signature: %s", resp.Status)
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if err != nil {
+			return err
+		}
+		sig = string(b)
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(sig))
+	if err != nil {
+		return errSignatureInvalid
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	for _, key := range gFetchKeys {
+		if ed25519.Verify(key, data, b) {
+			return nil
+		}
+	}
+	return errSignatureInvalid
+}
+
+func fetchProxy(r *http.Request) (*url.URL, error) {
+	if gApp.Cnf.FetchProxy == "" {
+		return OutboundProxy(r)
+	}
+	return proxyFor(gApp.Cnf.FetchProxy, r)
+}
+
+func newHash(algo string) hash.Hash {
+	switch strings.ToLower(algo) {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func fetchTestRequest(t *testing.T, body string) (*Response, *FetchFileRes) {
+	w := httptest.NewRecorder()
+	FetchFileHandler(w, httptest.NewRequest("POST", "/api/v1/file/fetch", strings.NewReader(body)))
+	var res Response
+	var data FetchFileRes
+	res.Data = &data
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%s: %s", err, w.Body)
+	}
+	return &res, &data
+}
+
+func setupFetch(t *testing.T) {
+	setupJobs(t)
+	gApp.Cnf.FetchRetries = 3
+	gApp.Cnf.FetchMaxRetries = 10
+	gApp.Cnf.FetchTimeout = 60
+	gApp.Cnf.FetchHeaderTimeout = 30
+	InitFileHandler()
+}
+
+// A checksum mismatch is returned at once, and the retries are capped
+func TestFetchFileRetries(t *testing.T) {
+	setupFetch(t)
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "f")
+
+	res, data := fetchTestRequest(t, fmt.Sprintf(`{"url":"%s/f", "path":"%s", "checksum":"sha256:00", "retries":5}`, srv.URL, path))
+	if res.Errno != ECChecksumMismatch || data.Attempts != 1 || atomic.LoadInt32(&hits) != 1 {
+		t.Fatalf("got %d %s, %d attempts, %d hits", res.Errno, res.Error, data.Attempts, hits)
+	}
+
+	gApp.Cnf.FetchMaxRetries = 1
+	res, data = fetchTestRequest(t, fmt.Sprintf(`{"url":"%s/broken", "path":"%s", "retries":100}`, srv.URL, path))
+	if res.Errno != ECFetchFailed || data.Attempts != 2 {
+		t.Fatalf("got %d %s, %d attempts", res.Errno, res.Error, data.Attempts)
+	}
+}
+
+// A server which doesn't answer fails at fetch::header_timeout
+func TestFetchFileHeaderTimeout(t *testing.T) {
+	setupFetch(t)
+	gApp.Cnf.FetchHeaderTimeout = 1
+	gApp.Cnf.FetchMaxRetries = 0
+	doneC := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-doneC:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(doneC)
+
+	start := time.Now()
+	res, _ := fetchTestRequest(t, fmt.Sprintf(`{"url":"%s/f", "path":"%s"}`, srv.URL, filepath.Join(t.TempDir(), "f")))
+	if res.Errno != ECFetchFailed || !strings.Contains(res.Error, "timeout") {
+		t.Fatalf("got %d %s", res.Errno, res.Error)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Fatalf("took %s", d)
+	}
+}
+
+// With fetch::public_keys a file is moved into place only if signed by one of
+// them, by the request or at <url>.sig
+func TestFetchFileSignature(t *testing.T) {
+	setupFetch(t)
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	gApp.Cnf.FetchPublicKeys = []string{base64.StdEncoding.EncodeToString(pub)}
+	if err := InitFileHandler(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { gFetchKeys = nil }()
+	sign := func(k ed25519.PrivateKey) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(k, []byte("hello")))
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/signed.sig":
+			w.Write([]byte(sign(key) + "\n"))
+		case "/forged.sig":
+			w.Write([]byte(sign(other)))
+		case "/signed", "/forged", "/unsigned":
+			w.Write([]byte("hello"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	for _, c := range []struct {
+		file, sig string
+		errno     ErrorCode
+	}{
+		{"signed", "", ECSuccess},
+		{"forged", "", ECSignatureInvalid},
+		{"unsigned", "", ECSignatureInvalid},
+		{"unsigned", sign(key), ECSuccess},
+		{"signed", sign(other), ECSignatureInvalid},
+	} {
+		path := filepath.Join(t.TempDir(), "f")
+		res, _ := fetchTestRequest(t, fmt.Sprintf(`{"url":"%s/%s", "path":"%s", "signature":"%s"}`, srv.URL, c.file, path, c.sig))
+		if res.Errno != c.errno {
+			t.Errorf("%s %q: got %d %s", c.file, c.sig, res.Errno, res.Error)
+		}
+		if _, err := os.Stat(path); (err == nil) != (c.errno == ECSuccess) {
+			t.Errorf("%s %q: file in place: %v", c.file, c.sig, err == nil)
+		}
+	}
+}
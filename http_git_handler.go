@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type GitReq struct {
+	Url      string `json:"url,omitempty"`
+	Dir      string `json:"dir"`
+	Branch   string `json:"branch,omitempty"`
+	Depth    int    `json:"depth,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	hostDir string // Dir mapped into the jail
+}
+
+type GitRes struct {
+	Dir    string `json:"dir"`
+	Branch string `json:"branch"`
+	Commit string `json:"commit"`
+	Output string `json:"output"`
+}
+
+// Handler to clone a repository into req.Dir
+func GitCloneHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := parseGitReq(w, r)
+	if !ok {
+		return
+	}
+	if req.Url == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param url is empty"))
+		return
+	}
+
+	args := []string{"clone"}
+	if req.Branch != "" {
+		if !validGitRef(req.Branch) {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid branch: "+req.Branch))
+			return
+		}
+		args = append(args, "--branch", req.Branch)
+	}
+	if req.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(req.Depth))
+	}
+	args = append(args, "--", req.Url, req.hostDir)
+
+	serveGitResult(w, r, req, "", args)
+}
+
+// Handler to pull the current branch of the repository in req.Dir
+func GitPullHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := parseGitReq(w, r)
+	if !ok {
+		return
+	}
+	serveGitResult(w, r, req, req.hostDir, []string{"pull", "--ff-only"})
+}
+
+// Handler to checkout req.Branch of the repository in req.Dir
+func GitCheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := parseGitReq(w, r)
+	if !ok {
+		return
+	}
+	if req.Branch == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param branch is empty"))
+		return
+	}
+	if !validGitRef(req.Branch) {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid branch: "+req.Branch))
+		return
+	}
+	// The -- after the branch keeps it from being taken as a path
+	serveGitResult(w, r, req, req.hostDir, []string{"checkout", req.Branch, "--"})
+}
+
+// A ref given to git can't be taken as an option
+func validGitRef(ref string) bool {
+	return !strings.HasPrefix(ref, "-") && !strings.ContainsAny(ref, "\x00\n")
+}
+
+func parseGitReq(w http.ResponseWriter, r *http.Request) (*GitReq, bool) {
+	var req GitReq
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("failed to read r.Body: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to read body"))
+		return nil, false
+	}
+	defer r.Body.Close()
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		log.Errorf("failed to unmarshall data: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to unmarshall data"))
+		return nil, false
+	}
+
+	if req.Dir == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param dir is empty"))
+		return nil, false
+	}
+	if req.hostDir, err = JailPath(req.Dir); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECPathNotAllowed, err.Error()))
+		return nil, false
+	}
+	return &req, true
+}
+
+func serveGitResult(w http.ResponseWriter, r *http.Request, req *GitReq, dir string, args []string) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(gApp.Cnf.GitTimeout)*time.Second)
+	defer cancel()
+	out, err := runGit(ctx, dir, gitAuthEnv(req), args...)
+	if err != nil {
+		log.Errorf("git %s failed: %s", args[0], err)
+		ServeJSON(w, NewResponse().SetError(ECGitFailed, err.Error()).SetData(&GitRes{Dir: req.Dir, Output: out}))
+		return
+	}
+
+	res := &GitRes{Dir: req.Dir, Output: out}
+	res.Branch, _ = runGit(ctx, req.hostDir, nil, "rev-parse", "--abbrev-ref", "HEAD")
+	res.Commit, _ = runGit(ctx, req.hostDir, nil, "rev-parse", "HEAD")
+	res.Branch = strings.TrimSpace(res.Branch)
+	res.Commit = strings.TrimSpace(res.Commit)
+	ServeJSON(w, NewResponse().SetData(res))
+}
+
+// Inject the credential as an http header through the environment, so that
+// it is neither written into .git/config nor visible in the process list.
+func gitAuthEnv(req *GitReq) []string {
+	if req.Username == "" && req.Password == "" {
+		return nil
+	}
+	cred := base64.StdEncoding.EncodeToString([]byte(req.Username + ":" + req.Password))
+	return []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic " + cred,
+	}
+}
+
+// Run git until the context is done, when git is killed with the helpers it
+// runs, e.g. git-remote-https
+func runGit(ctx context.Context, dir string, env []string, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error { return killProcessTree(cmd) }
+	cmd.WaitDelay = 5 * time.Second
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Env = append(cmd.Env, outboundProxyEnv()...)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return out.String(), fmt.Errorf("git killed after running %d seconds", gApp.Cnf.GitTimeout)
+		}
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return out.String(), errors.New(msg)
+		}
+		return out.String(), err
+	}
+	return out.String(), nil
+}
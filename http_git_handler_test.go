@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func gitTestRequest(t *testing.T, body string) *Response {
+	w := httptest.NewRecorder()
+	GitCheckoutHandler(w, httptest.NewRequest("POST", "/api/v1/git/checkout", strings.NewReader(body)))
+	var res Response
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%s: %s", err, w.Body)
+	}
+	return &res
+}
+
+func TestGitCheckout(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	setupJobs(t)
+	gApp.Cnf.GitTimeout = 60
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"-c", "user.name=t", "-c", "user.email=t@t", "commit", "-q", "--allow-empty", "-m", "init"},
+		{"branch", "release"},
+	} {
+		if out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s %s", args, err, out)
+		}
+	}
+	// A file of the name of the branch
+	ioutil.WriteFile(filepath.Join(dir, "release"), []byte("x"), 0644)
+
+	res := gitTestRequest(t, `{"dir":"`+dir+`", "branch":"release"}`)
+	if res.Errno != ECSuccess {
+		t.Fatalf("got %d %s", res.Errno, res.Error)
+	}
+	if b, _ := json.Marshal(res.Data); !strings.Contains(string(b), `"branch":"release"`) {
+		t.Fatalf("got %s", b)
+	}
+	for _, branch := range []string{"-b", "--orphan=x", "-f"} {
+		if res := gitTestRequest(t, `{"dir":"`+dir+`", "branch":"`+branch+`"}`); res.Errno != ECInvalidParam {
+			t.Errorf("%s: got %d %s", branch, res.Errno, res.Error)
+		}
+	}
+}
+
+// A git hanging is killed at git::timeout
+func TestGitTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	setupJobs(t)
+	gApp.Cnf.GitTimeout = 1
+	bin := t.TempDir()
+	ioutil.WriteFile(filepath.Join(bin, "git"), []byte("#!/bin/sh\nsleep 30 &\nwait\n"), 0755)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	start := time.Now()
+	res := gitTestRequest(t, `{"dir":"`+t.TempDir()+`", "branch":"main"}`)
+	if res.Errno != ECGitFailed || !strings.Contains(res.Error, "killed") {
+		t.Fatalf("got %d %s", res.Errno, res.Error)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("took %s", d)
+	}
+}
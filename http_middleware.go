@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/urfave/negroni"
 	"net/http"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,6 +26,56 @@ func CutServiceMiddleware(rw http.ResponseWriter, r *http.Request, next http.Han
 	gHttpServer.wg.Done()
 }
 
+// Allow browser based dashboards of the configured origins to call the api
+func CorsMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	origin := r.Header.Get("Origin")
+	cnf := gApp.Cnf
+	if origin == "" || len(cnf.CorsAllowedOrigins) == 0 {
+		next(rw, r)
+		return
+	}
+
+	rw.Header().Add("Vary", "Origin")
+	allowed := false
+	for _, o := range cnf.CorsAllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		log.Debugf("cors origin not allowed: %s", origin)
+		next(rw, r)
+		return
+	}
+
+	h := rw.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	if cnf.CorsAllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	allowedHeaders, exposedHeaders := cnf.CorsAllowedHeaders, cnf.CorsExposedHeaders
+	// The headers of gRPC-Web and Connect
+	if strings.HasPrefix(r.URL.Path, grpcUrlPrefix) {
+		allowedHeaders = append(append([]string{}, allowedHeaders...),
+			"X-Grpc-Web", "X-User-Agent", "Grpc-Timeout", "Connect-Protocol-Version", "Connect-Timeout-Ms")
+		exposedHeaders = append(append([]string{}, exposedHeaders...), "Grpc-Status", "Grpc-Message", grpcErrnoTrailer)
+	}
+	if len(exposedHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(exposedHeaders, ", "))
+	}
+
+	// Answer the preflight request directly
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		h.Set("Access-Control-Allow-Methods", strings.Join(cnf.CorsAllowedMethods, ", "))
+		h.Set("Access-Control-Allow-Headers", strings.Join(allowedHeaders, ", "))
+		h.Set("Access-Control-Max-Age", strconv.Itoa(cnf.CorsMaxAge))
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	next(rw, r)
+}
+
 func RecoveryMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -32,6 +88,7 @@ func RecoveryMiddleware(rw http.ResponseWriter, r *http.Request, next http.Handl
 
 			f := "PANIC: %s\n%s"
 			log.Errorf(f, err, stack)
+			ReportErrorEvent(EventPanic, fmt.Sprintf(f, err, stack))
 		}
 	}()
 
@@ -47,3 +104,246 @@ func LoggerMiddleware(rw http.ResponseWriter, r *http.Request, next http.Handler
 	res := rw.(negroni.ResponseWriter)
 	log.Debugf("Request completed %v in %v", res.Status(), time.Since(start))
 }
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gw          *gzip.Writer
+	wroteHeader bool
+	noBody      bool
+}
+
+func (o *gzipResponseWriter) WriteHeader(code int) {
+	if !o.wroteHeader {
+		o.wroteHeader = true
+		o.noBody = code == http.StatusNotModified || code == http.StatusNoContent
+		if !o.noBody {
+			// The length is unknown after compressing
+			o.Header().Del("Content-Length")
+			o.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+	o.ResponseWriter.WriteHeader(code)
+}
+
+func (o *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !o.wroteHeader {
+		o.WriteHeader(http.StatusOK)
+	}
+	if o.noBody {
+		return o.ResponseWriter.Write(b)
+	}
+	return o.gw.Write(b)
+}
+
+// Flush the compressed data so far, so that streamed output reaches the client timely
+func (o *gzipResponseWriter) Flush() {
+	o.gw.Flush()
+	if f, ok := o.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Compress the response if the client accepts gzip, verbose job outputs
+// shrink a lot, which matters for agents behind slow links.
+func GzipMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	rw.Header().Add("Vary", "Accept-Encoding")
+	// The websocket connection needs the raw writer to hijack, and grpc has
+	// its own framing
+	if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || IsWebsocketRequest(r) || IsGrpcRequest(r) {
+		next(rw, r)
+		return
+	}
+
+	gw := gzip.NewWriter(rw)
+	grw := &gzipResponseWriter{ResponseWriter: rw, gw: gw}
+	next(grw, r)
+	if grw.wroteHeader && !grw.noBody {
+		gw.Close()
+	}
+}
+
+const (
+	YamlContentType    = "application/x-yaml;charset=UTF-8"
+	MsgpackContentType = "application/x-msgpack"
+)
+
+// Buffer a json response to transcode it, other responses pass through
+type negotiateResponseWriter struct {
+	http.ResponseWriter
+	buf         bytes.Buffer
+	code        int
+	passThrough bool
+	wroteHeader bool
+}
+
+func (o *negotiateResponseWriter) WriteHeader(code int) {
+	if o.wroteHeader {
+		return
+	}
+	o.wroteHeader = true
+	o.code = code
+	if !strings.HasPrefix(o.Header().Get(ContentType), "application/json") {
+		o.passThrough = true
+		o.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (o *negotiateResponseWriter) Write(b []byte) (int, error) {
+	if !o.wroteHeader {
+		o.WriteHeader(http.StatusOK)
+	}
+	if o.passThrough {
+		return o.ResponseWriter.Write(b)
+	}
+	return o.buf.Write(b)
+}
+
+func (o *negotiateResponseWriter) Flush() {
+	if f, ok := o.ResponseWriter.(http.Flusher); ok && o.passThrough {
+		f.Flush()
+	}
+}
+
+// Transcode json responses to yaml or msgpack according to the Accept header
+func NegotiateMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	accept := r.Header.Get("Accept")
+	if IsWebsocketRequest(r) || IsGrpcRequest(r) {
+		next(rw, r)
+		return
+	}
+	var contentType string
+	var encode func(interface{}) []byte
+	switch {
+	case strings.Contains(accept, "yaml"):
+		contentType, encode = YamlContentType, EncodeYAML
+	case strings.Contains(accept, "msgpack"):
+		contentType, encode = MsgpackContentType, EncodeMsgpack
+	default:
+		next(rw, r)
+		return
+	}
+
+	rw.Header().Add("Vary", "Accept")
+	nrw := &negotiateResponseWriter{ResponseWriter: rw}
+	next(nrw, r)
+	if nrw.passThrough || !nrw.wroteHeader {
+		return
+	}
+
+	v, err := decodeGeneric(nrw.buf.Bytes())
+	if err != nil {
+		log.Errorf("failed to transcode response: %s", err)
+		rw.WriteHeader(nrw.code)
+		rw.Write(nrw.buf.Bytes())
+		return
+	}
+	rw.Header().Set(ContentType, contentType)
+	rw.WriteHeader(nrw.code)
+	rw.Write(encode(v))
+}
+
+// The value of "Authorization: Bearer <token>", empty if none
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// The token of "Authorization: Negotiate", nil if none
+func negotiateToken(r *http.Request) []byte {
+	h := r.Header.Get("Authorization")
+	if len(h) <= 10 || !strings.EqualFold(h[:10], "negotiate ") {
+		return nil
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(h[10:]))
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+// The token of the value, by auth::admin_token, the token file or the policy
+func authenticateToken(value string) (*Token, error) {
+	if value == "" {
+		return nil, errTokenInvalid
+	}
+	if gApp.Cnf.AuthAdminToken != "" && hashEqual(value, gApp.Cnf.AuthAdminToken) {
+		return &Token{Id: configAdminTokenId, Name: configAdminTokenId, Admin: true}, nil
+	}
+	var tok *Token
+	err := errTokenInvalid
+	if store := tokenStore(); store != nil {
+		tok, err = store.Authenticate(value)
+	}
+	if err == errTokenInvalid && gPolicy != nil {
+		if t := gPolicy.Authenticate(value); t != nil {
+			tok, err = t, nil
+		}
+	}
+	return tok, err
+}
+
+// Authenticate the request by its bearer token if the auth is enabled, the
+// admin api needs an admin token.
+func AuthMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if !AuthEnabled() {
+		next(rw, r)
+		return
+	}
+
+	// Authenticated by the bootstrap token, or by the secrets of the hooks
+	if r.URL.Path == bootstrapUrl || strings.HasPrefix(r.URL.Path, hookUrlPrefix) {
+		next(rw, r)
+		return
+	}
+
+	var tok *Token
+	var err error
+	if user, password, ok := r.BasicAuth(); ok && gLdap != nil {
+		tok, err = gLdap.Authenticate(user, password)
+	} else if neg := negotiateToken(r); neg != nil && gKerberos != nil {
+		var reply []byte
+		if tok, reply, err = gKerberos.Authenticate(neg); err == nil && reply != nil {
+			rw.Header().Set("WWW-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString(reply))
+		}
+	} else {
+		tok, err = authenticateToken(bearerToken(r))
+	}
+	if err != nil {
+		msg := fmt.Sprintf("auth failed: %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, err)
+		log.Warn(msg)
+		ReportWarningEvent(EventAuthFailed, msg)
+		if IsGrpcRequest(r) {
+			serveGrpcError(rw, r, ECUnauthorized, err.Error())
+			return
+		}
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		if gLdap != nil {
+			rw.Header().Add("WWW-Authenticate", `Basic realm="shell-agent"`)
+		}
+		if gKerberos != nil {
+			rw.Header().Add("WWW-Authenticate", "Negotiate")
+		}
+		ServeJSONWithStatus(rw, http.StatusUnauthorized, NewResponse().SetError(ECUnauthorized, err.Error()))
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, adminUrlPrefix) && !tok.Admin {
+		msg := fmt.Sprintf("admin api denied: %s %s from %s, token: %s", r.Method, r.URL.Path, r.RemoteAddr, tok.Name)
+		log.Warn(msg)
+		ReportWarningEvent(EventAdminDenied, msg)
+		ServeJSONWithStatus(rw, http.StatusForbidden, NewResponse().SetError(ECForbidden, "admin token required"))
+		return
+	}
+	if tenant := r.Header.Get(tenantHeader); tenant != "" && r.Header.Get(forwardedHeader) != "" {
+		if !tok.Admin {
+			log.Warnf("%s: %s %s from %s, token: %s", errOnBehalf, r.Method, r.URL.Path, r.RemoteAddr, tok.Name)
+			ServeJSONWithStatus(rw, http.StatusForbidden, NewResponse().SetError(ECForbidden, errOnBehalf.Error()))
+			return
+		}
+		// The request of a peer forwarding for the tenant
+		tok = &Token{Id: tok.Id, Name: tenant, Admin: r.Header.Get(tenantAdminHeader) == "1"}
+	}
+	next(rw, withToken(r, tok))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type NotifyCmdReq struct {
+	Id      string `json:"id"`
+	Webhook string `json:"webhook,omitempty"` // The finished job is posted to the url as json
+	Email   string `json:"email,omitempty"`   // The summary of the finished job is mailed to the address
+}
+
+const (
+	notifyRetries      = 3
+	sseKeepalivePeriod = 15 * time.Second
+)
+
+// Handler to get notified when a job finishes, by a webhook or an email
+func NotifyCmdHandler(w http.ResponseWriter, r *http.Request) {
+	var req NotifyCmdReq
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("failed to read r.Body: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to read body"))
+		return
+	}
+	defer r.Body.Close()
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		log.Errorf("failed to unmarshall data: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to unmarshall data"))
+		return
+	}
+
+	if req.Webhook == "" && req.Email == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param webhook or email is needed"))
+		return
+	}
+	if err := checkNotifyTargets(req.Webhook, &req.Email); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+
+	job := managedJob(req.Id, RequestToken(r))
+	if job == nil {
+		ServeJSON(w, NewResponse().SetError(ECJobNotFound, "job not found: "+req.Id))
+		return
+	}
+
+	go func() {
+		<-job.Done()
+		if req.Webhook != "" {
+			notifyWebhook(req.Webhook, job)
+		}
+		if req.Email != "" {
+			notifyEmail(req.Email, job)
+		}
+	}()
+	ServeJSON(w, NewResponse())
+}
+
+// Handler to wait for a job to finish as server-sent events, the finished
+// job is sent as a "finished" event.
+func NotifySseHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.FormValue("id"))
+	if id == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param id is empty"))
+		return
+	}
+	job := managedJob(id, RequestToken(r))
+	if job == nil {
+		ServeJSON(w, NewResponse().SetError(ECJobNotFound, "job not found: "+id))
+		return
+	}
+
+	w.Header().Set(ContentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	flush()
+
+	ticker := time.NewTicker(sseKeepalivePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-job.Done():
+			b, _ := json.Marshal(job)
+			fmt.Fprintf(w, "event: finished\ndata: %s\n\n", b)
+			flush()
+			return
+		case <-ticker.C:
+			// Keep the proxies in between from closing the idle connection
+			fmt.Fprint(w, ": keepalive\n\n")
+			flush()
+		case <-r.Context().Done():
+			return
+		case <-gHttpServer.quitC:
+			return
+		}
+	}
+}
+
+// Validate the webhook and the email if any, the email is normalized
+func checkNotifyTargets(webhook string, email *string) error {
+	if webhook != "" {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("invalid webhook: " + webhook)
+		}
+	}
+	if *email != "" {
+		if gApp.Cnf.SmtpAddr == "" {
+			return errors.New("smtp is not configured")
+		}
+		addr, err := mail.ParseAddress(*email)
+		if err != nil {
+			return errors.New("invalid email: " + *email)
+		}
+		*email = addr.Address
+	}
+	return nil
+}
+
+func notifyWebhook(rawurl string, job *Job) {
+	postWebhook(rawurl, "job "+job.Id, job)
+}
+
+// Post v as json to the url, retried on failures
+func postWebhook(rawurl, what string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Error occured when marshalling %s: %s", what, err)
+		return
+	}
+	client := NewOutboundClient(30 * time.Second)
+	for i := 1; ; i++ {
+		resp, err := client.Post(rawurl, JsonContentType, bytes.NewReader(b))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				log.Infof("notified webhook of %s: %s", what, rawurl)
+				return
+			}
+			err = fmt.Errorf("unexpected http status: %s", resp.Status)
+		}
+		if i >= notifyRetries {
+			log.Errorf("notify webhook of %s failed: %s", what, err)
+			return
+		}
+		time.Sleep(time.Duration(i) * time.Second)
+	}
+}
+
+func notifyEmail(to string, job *Job) {
+	body := fmt.Sprintf("Cmd: %s\r\nStatus: %s\r\nExit code: %d\r\nError: %s\r\nCreated: %s\r\nFinished: %s\r\n",
+		job.Cmd, job.Status, job.ExitCode, job.Error, job.CreateTime.Format(time.RFC3339), job.FinishTime.Format(time.RFC3339))
+	sendEmail(to, "job "+job.Id, fmt.Sprintf("job %s %s", job.Id, job.Status), body)
+}
+
+// Mail the body to the address by the smtp of the config
+func sendEmail(to, what, subject, body string) {
+	cnf := gApp.Cnf
+	var auth smtp.Auth
+	if cnf.SmtpUsername != "" {
+		host := strings.Split(cnf.SmtpAddr, ":")[0]
+		auth = smtp.PlainAuth("", cnf.SmtpUsername, cnf.SmtpPassword, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: [shell-agent] %s\r\n\r\n%s", cnf.SmtpFrom, to, subject, body)
+
+	if err := smtp.SendMail(cnf.SmtpAddr, auth, cnf.SmtpFrom, []string{to}, msg.Bytes()); err != nil {
+		log.Errorf("notify email of %s failed: %s", what, err)
+		return
+	}
+	log.Infof("notified email of %s: %s", what, to)
+}
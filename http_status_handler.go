@@ -7,6 +7,25 @@ import (
 	"runtime"
 )
 
+type VersionRes struct {
+	Version   string   `json:"version"`
+	PublicKey string   `json:"public_key,omitempty"` // Base64 encoded ed25519 key verifying the job signatures
+	Tags      []string `json:"tags,omitempty"`
+	// Of the central policy in effect, e.g. default@3,eu@12
+	PolicyVersion string `json:"policy_version,omitempty"`
+}
+
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	res := &VersionRes{Version: VERSION, Tags: gApp.Cnf.AgentTags()}
+	if gJobSigner != nil {
+		res.PublicKey = gJobSigner.PublicKey()
+	}
+	if gPolicy != nil {
+		res.PolicyVersion = gPolicy.Version()
+	}
+	ServeJSON(w, NewResponse().SetData(res))
+}
+
 func StatusMemHandler(w http.ResponseWriter, r *http.Request) {
 	var stat runtime.MemStats
 	runtime.ReadMemStats(&stat)
@@ -18,5 +37,13 @@ func StatusMemHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set(ContentType, JsonContentType)
 	w.Write(b)
 }
+
+// Handler to get the metrics of the worker pools
+func StatusPoolHandler(w http.ResponseWriter, r *http.Request) {
+	stats := gJobPool.Stats()
+	stats.Groups = gConcurrencyGroups.Stats()
+	ServeJSON(w, NewResponse().SetData([]*PoolStats{stats}))
+}
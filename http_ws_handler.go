@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Messages of the websocket control channel, one json object per text
+// message. Requests from the client:
+//
+//	{"type":"submit", "ref":"<client ref>", "req":{<RunCmdReq>}, "subscribe":true}
+//	{"type":"cancel", "id":"<job id>"}
+//	{"type":"subscribe", "id":"<job id>", "offsets":{"stdout":1042,"stderr":87}}
+//	{"type":"unsubscribe", "id":"<job id>"}
+//
+// Events from the agent:
+//
+//	{"type":"submitted", "ref":"<client ref>", "id":"<job id>"}
+//	{"type":"canceled", "id":"<job id>"}
+//	{"type":"output", "id":"<job id>", "stream":"stdout", "offset":1042, "data":"..."}
+//
+// A client subscribing again after a drop sets the offsets of the streams
+// it has got, the offset of an output plus the length of its data, to get
+// the rest of the output only.
+//
+//	{"type":"finished", "id":"<job id>", "job":{<Job>}}
+//	{"type":"error", "ref":"...", "id":"...", "errno":1002, "error":"..."}
+type WsCmdMessage struct {
+	Type      string           `json:"type"`
+	Ref       string           `json:"ref,omitempty"`
+	Id        string           `json:"id,omitempty"`
+	Req       json.RawMessage  `json:"req,omitempty"` // A RunCmdReq, of a profile too
+	Subscribe bool             `json:"subscribe,omitempty"`
+	Offsets   map[string]int64 `json:"offsets,omitempty"`
+	Stream    string           `json:"stream,omitempty"`
+	Offset    int64            `json:"offset,omitempty"`
+	Data      string           `json:"data,omitempty"`
+	Time      *time.Time       `json:"time,omitempty"` // When the output was written
+	Job       *Job             `json:"job,omitempty"`
+	Errno     ErrorCode        `json:"errno,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+type wsCmdSession struct {
+	conn *WsConn
+	// The token authenticating the upgrade request
+	token *Token
+	// Output subscriptions by job id
+	subs map[string]chan OutputChunk
+	wg   sync.WaitGroup
+
+	sync.Mutex
+}
+
+// Handler of the websocket control channel, which multiplexes the submission,
+// cancellation and output of many jobs over one connection.
+func WsCmdHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := UpgradeWebsocket(w, r)
+	if err != nil {
+		log.Errorf("websocket upgrade failed: %s", err)
+		return
+	}
+	log.Infof("websocket control channel opened: %s", r.RemoteAddr)
+	s := &wsCmdSession{conn: conn, token: RequestToken(r), subs: make(map[string]chan OutputChunk)}
+	s.serve()
+	log.Infof("websocket control channel closed: %s", r.RemoteAddr)
+}
+
+func (o *wsCmdSession) serve() {
+	doneC := make(chan struct{})
+	defer func() {
+		close(doneC)
+		o.conn.Close()
+		o.unsubscribeAll()
+		o.wg.Wait()
+	}()
+
+	// Close the connection when the server stops, which ends the read loop
+	go func() {
+		select {
+		case <-gHttpServer.quitC:
+			o.conn.WriteMessage(wsClose, nil)
+			o.conn.Close()
+		case <-doneC:
+		}
+	}()
+
+	for {
+		op, data, err := o.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg WsCmdMessage
+		if op != WsText || json.Unmarshal(data, &msg) != nil {
+			o.send(&WsCmdMessage{Type: "error", Errno: ECInvalidParam, Error: "invalid message"})
+			continue
+		}
+
+		switch msg.Type {
+		case "submit":
+			o.submit(&msg)
+		case "cancel":
+			if errno, err := cancelJob(msg.Id, o.token); err != nil {
+				o.sendError(&msg, errno, err.Error())
+			} else {
+				o.send(&WsCmdMessage{Type: "canceled", Ref: msg.Ref, Id: msg.Id})
+			}
+		case "subscribe":
+			o.subscribe(&msg)
+		case "unsubscribe":
+			o.unsubscribe(msg.Id)
+		default:
+			o.sendError(&msg, ECInvalidParam, "unknown message type: "+msg.Type)
+		}
+	}
+}
+
+func (o *wsCmdSession) submit(msg *WsCmdMessage) {
+	if len(msg.Req) == 0 {
+		o.sendError(msg, ECInvalidParam, "param req is empty")
+		return
+	}
+	req, errno, err := checkRunCmdReq(msg.Req, o.token)
+	if err != nil {
+		o.sendError(msg, errno, err.Error())
+		return
+	}
+	job, err := startJob(req, tokenTenant(o.token))
+	if err != nil {
+		o.sendError(msg, newJobErrno(err), err.Error())
+		return
+	}
+	o.send(&WsCmdMessage{Type: "submitted", Ref: msg.Ref, Id: job.Id})
+
+	if msg.Subscribe {
+		o.subscribe(&WsCmdMessage{Ref: msg.Ref, Id: job.Id})
+	}
+}
+
+func (o *wsCmdSession) subscribe(msg *WsCmdMessage) {
+	job := managedJob(msg.Id, o.token)
+	if job == nil {
+		o.sendError(msg, ECJobNotFound, "job not found: "+msg.Id)
+		return
+	}
+	offsets, err := outputOffsets(job, msg.Offsets["stdout"], msg.Offsets["stderr"])
+	if err != nil {
+		o.sendError(msg, ECInvalidParam, err.Error())
+		return
+	}
+
+	o.Lock()
+	if _, ok := o.subs[msg.Id]; ok {
+		o.Unlock()
+		o.sendError(msg, ECInvalidParam, "job already subscribed: "+msg.Id)
+		return
+	}
+	backlog, c := job.Subscribe()
+	o.subs[msg.Id] = c
+	o.Unlock()
+
+	for _, chunk := range backlog {
+		if chunk, ok := chunkAfter(chunk, offsets); ok {
+			o.sendOutput(job.Id, chunk)
+		}
+	}
+	o.wg.Add(1)
+	go o.forward(job, c, offsets)
+}
+
+// Forward the output of the job past the offsets until it finishes
+func (o *wsCmdSession) forward(job *Job, c chan OutputChunk, offsets map[string]int64) {
+	defer o.wg.Done()
+	for chunk := range c {
+		if chunk, ok := chunkAfter(chunk, offsets); ok {
+			o.sendOutput(job.Id, chunk)
+		}
+	}
+
+	o.Lock()
+	if o.subs[job.Id] != c {
+		// Unsubscribed by the client
+		o.Unlock()
+		return
+	}
+	delete(o.subs, job.Id)
+	o.Unlock()
+
+	if !job.Finished() {
+		o.send(&WsCmdMessage{Type: "error", Id: job.Id, Errno: ECSubscriberDropped, Error: "output subscriber too slow, dropped"})
+		return
+	}
+	o.send(&WsCmdMessage{Type: "finished", Id: job.Id, Job: job})
+}
+
+func (o *wsCmdSession) unsubscribe(id string) {
+	o.Lock()
+	c, ok := o.subs[id]
+	delete(o.subs, id)
+	o.Unlock()
+	if ok {
+		if job := gJobBookkeeper.Get(id); job != nil {
+			job.Unsubscribe(c)
+		}
+	}
+}
+
+func (o *wsCmdSession) unsubscribeAll() {
+	o.Lock()
+	ids := make([]string, 0, len(o.subs))
+	for id := range o.subs {
+		ids = append(ids, id)
+	}
+	o.Unlock()
+	for _, id := range ids {
+		o.unsubscribe(id)
+	}
+}
+
+func (o *wsCmdSession) sendOutput(id string, chunk OutputChunk) {
+	msg := &WsCmdMessage{Type: "output", Id: id, Stream: chunk.Stream, Offset: chunk.Offset, Data: chunk.Data}
+	if !chunk.Time.IsZero() {
+		msg.Time = &chunk.Time
+	}
+	o.send(msg)
+}
+
+func (o *wsCmdSession) sendError(msg *WsCmdMessage, errno ErrorCode, err string) {
+	o.send(&WsCmdMessage{Type: "error", Ref: msg.Ref, Id: msg.Id, Errno: errno, Error: err})
+}
+
+func (o *wsCmdSession) send(msg *WsCmdMessage) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		log.Errorf("Error occured when marshalling message: %s", err)
+		return
+	}
+	// Errors show up in the read loop, which ends the session
+	o.conn.WriteMessage(WsText, b)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// The submissions over the websocket are checked like /api/v1/cmd/run
+func TestCheckRunCmdReq(t *testing.T) {
+	setupJobs(t)
+	for _, c := range []struct {
+		body  string
+		errno ErrorCode
+	}{
+		{`{"cmd":"true"}`, ECSuccess},
+		{`{"script":"#!/bin/sh\ntrue\n"}`, ECSuccess},
+		{`{}`, ECInvalidParam},
+		{`{"cmd":"true", "script":"true"}`, ECInvalidParam},
+		{`{"cmd":"true", "timeout_seconds":-1}`, ECInvalidParam},
+		{`{"cmd":"true", "profile":"missing"}`, ECInvalidParam},
+		{`{"cmd":"true", "run_as":"root"}`, ECForbidden},
+		{`{"cmd":`, ECUnknown},
+	} {
+		_, errno, err := checkRunCmdReq([]byte(c.body), &Token{Name: "ci"})
+		if errno != c.errno {
+			t.Errorf("%s: got errno %d, %v", c.body, errno, err)
+		}
+	}
+}
+
+// A client subscribing again gets the output past its offsets only
+func TestWsSubscribeOffsets(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	setupJobs(t)
+	job, ctx, err := newJob(&RunCmdReq{Cmd: "printf 'a\\nb\\n'; printf 'e\\n' >&2; printf c"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cmdWorker(ctx, job)
+	select {
+	case <-job.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("job not finished")
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(WsCmdHandler))
+	defer srv.Close()
+	c := dialWsTest(t, srv.URL)
+	defer c.conn.Close()
+	read := func() *WsCmdMessage {
+		var msg WsCmdMessage
+		if _, data := c.readFrame(t); json.Unmarshal(data, &msg) != nil {
+			t.Fatalf("invalid message %s", data)
+		}
+		return &msg
+	}
+
+	c.writeFrame(true, WsText, []byte(`{"type":"subscribe","id":"`+job.Id+`","offsets":{"stdout":2,"stderr":1}}`))
+	got := map[string]string{}
+	for {
+		msg := read()
+		if msg.Type == "finished" {
+			break
+		}
+		if msg.Type != "output" || msg.Offset < 1 {
+			t.Fatalf("got %+v", msg)
+		}
+		got[msg.Stream] += msg.Data
+	}
+	if got["stdout"] != "b\nc" || got["stderr"] != "\n" {
+		t.Fatalf("got %q", got)
+	}
+
+	c.writeFrame(true, WsText, []byte(`{"type":"subscribe","id":"`+job.Id+`","offsets":{"stdout":6}}`))
+	if msg := read(); msg.Type != "error" || msg.Errno != ECInvalidParam {
+		t.Fatalf("got %+v", msg)
+	}
+}
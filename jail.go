@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With jail::root configured, the paths of the file and git apis and the
+// working directories of the jobs are resolved under the root like in a
+// chroot: "/data/a.txt" means <root>/data/a.txt, and neither ".." nor
+// symlinks can lead out of the root.
+
+// A windows share of shares::names, connected by the credential before a
+// path under it is used
+type NetworkShare struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"` // \\server\share
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+var (
+	// The canonical jail root, empty means no jail
+	gJailRoot string
+
+	errPathNotAllowed = errors.New("path is out of the jail")
+)
+
+func init() {
+	gHttpServer.AddToInit(InitJail)
+}
+
+func InitJail() error {
+	gJailRoot = ""
+	if gApp.Cnf.JailRoot == "" {
+		return nil
+	}
+	root, err := filepath.Abs(gApp.Cnf.JailRoot)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		return errors.New("jail root is not a directory: " + root)
+	}
+	gJailRoot = root
+	return nil
+}
+
+// Map p into the jail and resolve its symlinks, p is returned as is without a
+// jail. On windows a long path gets the \\?\ prefix, and the share of the
+// config holding it is connected.
+func JailPath(p string) (string, error) {
+	if gJailRoot == "" {
+		if err := connectShare(p); err != nil {
+			return "", err
+		}
+		return longPath(p), nil
+	}
+	if filepath.VolumeName(p) != "" {
+		return "", errPathNotAllowed
+	}
+	full := filepath.Join(gJailRoot, filepath.Clean(string(filepath.Separator)+p))
+	if err := connectShare(full); err != nil {
+		return "", err
+	}
+	resolved, err := evalExistingSymlinks(full)
+	if err != nil {
+		return "", err
+	}
+	if !inJail(resolved) {
+		return "", errPathNotAllowed
+	}
+	return longPath(resolved), nil
+}
+
+// Resolve the symlinks of the longest existing prefix of p, the rest of p may not exist yet
+func evalExistingSymlinks(p string) (string, error) {
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if _, err := os.Lstat(p); err == nil {
+			// A dangling symlink, which could be created out of the jail
+			return "", errPathNotAllowed
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = parent
+	}
+}
+
+func inJail(p string) bool {
+	rel, err := filepath.Rel(gJailRoot, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The janitor prunes the dirs of janitor::rules periodically or on demand:
+// the entries not modified for max_age_hours first, then the oldest ones
+// until the total is under max_size_mb. The spilled output of the jobs no
+// longer kept is always cleaned up.
+
+type JanitorRule struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	Pattern     string `json:"pattern"` // Glob of the names of the entries of path
+	MaxAgeHours int    `json:"max_age_hours,omitempty"`
+	MaxSizeMB   int    `json:"max_size_mb,omitempty"`
+
+	// Entries which must be kept whatever their age
+	keep func(name string) bool
+}
+
+type JanitorRuleReport struct {
+	Rule      string   `json:"rule"`
+	Removed   int      `json:"removed"`
+	Reclaimed int64    `json:"reclaimed"`       // Bytes
+	Paths     []string `json:"paths,omitempty"` // The first janitorMaxReportPaths removed
+	Error     string   `json:"error,omitempty"`
+}
+
+type JanitorReport struct {
+	Time      time.Time            `json:"time"`
+	DryRun    bool                 `json:"dry_run,omitempty"`
+	Duration  float64              `json:"duration_ms"`
+	Removed   int                  `json:"removed"`
+	Reclaimed int64                `json:"reclaimed"`
+	Rules     []*JanitorRuleReport `json:"rules"`
+}
+
+type JanitorStats struct {
+	Runs      int64          `json:"runs"`
+	Removed   int64          `json:"removed"`
+	Reclaimed int64          `json:"reclaimed"`
+	LastRun   *JanitorReport `json:"last_run,omitempty"`
+	// Totals by rule
+	Rules map[string]*JanitorRuleReport `json:"rules"`
+}
+
+type janitorEntry struct {
+	path    string
+	size    int64
+	modTime time.Time // The newest of a dir's tree
+}
+
+const (
+	janitorMaxReportPaths = 100
+	// Spilled output younger than it may belong to a job being created
+	janitorSpillMinAge = time.Hour
+)
+
+type Janitor struct {
+	rules    []*JanitorRule
+	interval time.Duration
+
+	// One cleanup at a time
+	runMu sync.Mutex
+
+	mu    sync.Mutex
+	stats JanitorStats
+
+	quitC chan struct{}
+	wg    sync.WaitGroup
+}
+
+var (
+	gJanitor *Janitor
+)
+
+func init() {
+	gHttpServer.AddToInit(InitJanitor)
+	gHttpServer.AddToUninit(UninitJanitor)
+}
+
+func InitJanitor() error {
+	for _, r := range gApp.Cnf.JanitorRules {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	gJanitor = NewJanitor(gApp.Cnf.JanitorRules, time.Duration(gApp.Cnf.JanitorInterval)*time.Minute)
+	return nil
+}
+
+func UninitJanitor() {
+	gJanitor.Close()
+}
+
+func (o *JanitorRule) validate() error {
+	if o.Path == "" {
+		return errors.New("janitor rule " + o.Name + ": path is required")
+	}
+	if _, err := filepath.Match(o.Pattern, ""); err != nil {
+		return errors.New("janitor rule " + o.Name + ": invalid pattern " + o.Pattern)
+	}
+	if o.MaxAgeHours <= 0 && o.MaxSizeMB <= 0 {
+		return errors.New("janitor rule " + o.Name + ": max_age_hours or max_size_mb is required")
+	}
+	return nil
+}
+
+// The rule of the spilled output of the jobs no longer in the bookkeeper
+func spillJanitorRule() *JanitorRule {
+	return &JanitorRule{
+		Name:        "spill",
+		Path:        gApp.Cnf.MemorySpillDir,
+		Pattern:     "*",
+		MaxAgeHours: int(janitorSpillMinAge / time.Hour),
+		keep: func(name string) bool {
+			id := strings.TrimSuffix(strings.TrimSuffix(name, ".stdout"), ".stderr")
+			return gJobBookkeeper.Get(id) != nil
+		},
+	}
+}
+
+func NewJanitor(rules []*JanitorRule, interval time.Duration) *Janitor {
+	o := &Janitor{
+		rules:    append([]*JanitorRule{spillJanitorRule()}, rules...),
+		interval: interval,
+		stats:    JanitorStats{Rules: make(map[string]*JanitorRuleReport)},
+		quitC:    make(chan struct{}),
+	}
+	if interval > 0 {
+		o.wg.Add(1)
+		go o.loop()
+	}
+	return o
+}
+
+func (o *Janitor) Close() {
+	close(o.quitC)
+	o.wg.Wait()
+}
+
+func (o *Janitor) loop() {
+	defer o.wg.Done()
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			o.Run(false)
+		case <-o.quitC:
+			return
+		}
+	}
+}
+
+// Clean up by all the rules, with dryRun only report what would be removed
+func (o *Janitor) Run(dryRun bool) *JanitorReport {
+	o.runMu.Lock()
+	defer o.runMu.Unlock()
+
+	res := &JanitorReport{Time: time.Now(), DryRun: dryRun, Rules: []*JanitorRuleReport{}}
+	for _, r := range o.rules {
+		rr := r.run(dryRun)
+		if rr.Error != "" {
+			log.Warnf("janitor rule %s failed: %s", r.Name, rr.Error)
+		}
+		res.Removed += rr.Removed
+		res.Reclaimed += rr.Reclaimed
+		res.Rules = append(res.Rules, rr)
+	}
+	res.Duration = float64(time.Since(res.Time)) / float64(time.Millisecond)
+	if dryRun {
+		return res
+	}
+	if res.Removed > 0 {
+		log.Infof("janitor removed %d entries, %d bytes reclaimed", res.Removed, res.Reclaimed)
+	}
+
+	o.mu.Lock()
+	o.stats.Runs++
+	o.stats.Removed += int64(res.Removed)
+	o.stats.Reclaimed += res.Reclaimed
+	o.stats.LastRun = res
+	for _, rr := range res.Rules {
+		total := o.stats.Rules[rr.Rule]
+		if total == nil {
+			total = &JanitorRuleReport{Rule: rr.Rule}
+			o.stats.Rules[rr.Rule] = total
+		}
+		total.Removed += rr.Removed
+		total.Reclaimed += rr.Reclaimed
+		total.Error = rr.Error
+	}
+	o.mu.Unlock()
+	return res
+}
+
+func (o *Janitor) Stats() *JanitorStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := o.stats
+	s.Rules = make(map[string]*JanitorRuleReport, len(o.stats.Rules))
+	for name, rr := range o.stats.Rules {
+		copied := *rr
+		s.Rules[name] = &copied
+	}
+	return &s
+}
+
+func (o *JanitorRule) run(dryRun bool) *JanitorRuleReport {
+	res := &JanitorRuleReport{Rule: o.Name}
+	entries, err := o.entries()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			res.Error = err.Error()
+		}
+		return res
+	}
+
+	// The oldest first
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	maxAge := time.Duration(o.MaxAgeHours) * time.Hour
+	maxSize := int64(o.MaxSizeMB) << 20
+	for _, e := range entries {
+		expired := o.MaxAgeHours > 0 && time.Since(e.modTime) > maxAge
+		oversize := o.MaxSizeMB > 0 && total > maxSize
+		if !expired && !oversize {
+			break
+		}
+		if !dryRun {
+			if err := os.RemoveAll(e.path); err != nil {
+				res.Error = err.Error()
+				continue
+			}
+		}
+		total -= e.size
+		res.Removed++
+		res.Reclaimed += e.size
+		if len(res.Paths) < janitorMaxReportPaths {
+			res.Paths = append(res.Paths, e.path)
+		}
+	}
+	return res
+}
+
+// The entries of the path matching the pattern, with their sizes
+func (o *JanitorRule) entries() ([]*janitorEntry, error) {
+	infos, err := ioutil.ReadDir(o.Path)
+	if err != nil {
+		return nil, err
+	}
+	var res []*janitorEntry
+	for _, fi := range infos {
+		if ok, _ := filepath.Match(o.Pattern, fi.Name()); !ok {
+			continue
+		}
+		if o.keep != nil && o.keep(fi.Name()) {
+			continue
+		}
+		e := &janitorEntry{path: filepath.Join(o.Path, fi.Name()), size: fi.Size(), modTime: fi.ModTime()}
+		if fi.IsDir() {
+			e.size = 0
+			filepath.Walk(e.path, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return nil
+				}
+				if !info.IsDir() {
+					e.size += info.Size()
+				}
+				if info.ModTime().After(e.modTime) {
+					e.modTime = info.ModTime()
+				}
+				return nil
+			})
+		}
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+// Handler to run the janitor now, or report what it would remove with dry_run
+func RunJanitorHandler(w http.ResponseWriter, r *http.Request) {
+	dryRun, _ := strconv.ParseBool(r.FormValue("dry_run"))
+	res := gJanitor.Run(dryRun)
+	if !dryRun {
+		log.Infof("audit: janitor run by %s, %d entries removed", tokenTenant(RequestToken(r)), res.Removed)
+	}
+	ServeJSON(w, NewResponse().SetData(res))
+}
+
+// Handler to report the space reclaimed by the janitor
+func StatusJanitorHandler(w http.ResponseWriter, r *http.Request) {
+	ServeJSON(w, NewResponse().SetData(gJanitor.Stats()))
+}
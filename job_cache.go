@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// The jobs of the requests with cache_ttl_seconds, by the hash of the request
+// and its tenant. An identical request within the ttl gets the cached job
+// rather than running the cmd again, e.g. a monitoring system asking the same
+// every minute. The failed and canceled jobs aren't reused.
+type JobCache struct {
+	entries map[string]*jobCacheEntry
+	sync.Mutex
+}
+
+type jobCacheEntry struct {
+	id     string
+	expire time.Time
+}
+
+var (
+	gJobCache = &JobCache{entries: make(map[string]*jobCacheEntry)}
+)
+
+// The key of the request, the fields not affecting the result are left out
+func jobCacheKey(req *RunCmdReq, tenant string) string {
+	k := *req
+	k.Async, k.CacheTtl, k.KeepHistory, k.TargetTags = false, 0, 0, nil
+	b, _ := json.Marshal(&k)
+	h := sha256.New()
+	h.Write([]byte(tenant))
+	h.Write([]byte{0})
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// The cached job of the key, which may be still running, nil if none
+func (o *JobCache) Get(key string) *Job {
+	o.Lock()
+	defer o.Unlock()
+	e := o.entries[key]
+	if e == nil {
+		return nil
+	}
+	job := gJobBookkeeper.Get(e.id)
+	if time.Now().After(e.expire) || job == nil {
+		delete(o.entries, key)
+		return nil
+	}
+	if s := job.CurrentStatus(); s == JSFailed || s == JSTimedOut || s == JSCanceled || s == JSBlocked {
+		delete(o.entries, key)
+		return nil
+	}
+	return job
+}
+
+func (o *JobCache) Put(key, id string, ttl time.Duration) {
+	o.Lock()
+	defer o.Unlock()
+	now := time.Now()
+	for k, e := range o.entries {
+		if now.After(e.expire) {
+			delete(o.entries, k)
+		}
+	}
+	o.entries[key] = &jobCacheEntry{id: id, expire: now.Add(ttl)}
+}
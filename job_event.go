@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type JobEventType string
+
+const (
+	JECreated   JobEventType = "created"   // Queued to the job pool
+	JEScheduled JobEventType = "scheduled" // Waiting for its run_at instead
+	JEQueued    JobEventType = "queued"    // Queued to the job pool at its run_at
+	JEStarted   JobEventType = "started"   // The process started
+	JEOutput    JobEventType = "output"    // A chunk of stdout or stderr
+	JEKilled    JobEventType = "killed"    // The process is being stopped by a cancel, the idle timeout or the timeout
+	JEFinished  JobEventType = "finished"  // Finished, failed or canceled
+
+	JEPendingApproval JobEventType = "pending_approval" // Waiting for an approval instead
+	JEApproved        JobEventType = "approved"         // Queued by an admin approving it
+)
+
+// A state transition of a job. The job is changed only by appending events,
+// its state is the fold of the events, so that the history of a job can be
+// reconstructed, and the readers holding the job's lock never see a half
+// updated job.
+type JobEvent struct {
+	Seq      int          `json:"seq"`
+	Type     JobEventType `json:"type"`
+	Time     time.Time    `json:"time"`
+	Status   JobStatus    `json:"status,omitempty"`
+	Pid      int          `json:"pid,omitempty"`
+	ExitCode int          `json:"exit_code,omitempty"`
+	Signal   string       `json:"signal,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	By       string       `json:"by,omitempty"` // The tenant approving the job
+	Stream   string       `json:"stream,omitempty"`
+	Size     int64        `json:"size,omitempty"` // Bytes of the output
+	// The condition failing the job
+	Unmet         *ConditionResult    `json:"unmet_condition,omitempty"`
+	RollbackJobId string              `json:"rollback_job_id,omitempty"`
+	RunAt         *time.Time          `json:"run_at,omitempty"`
+	Files         []*CapturedFile     `json:"files,omitempty"`
+	Recording     *JobRecording       `json:"recording,omitempty"`
+	Parsed        []map[string]string `json:"parsed,omitempty"`
+	ParseError    string              `json:"parse_error,omitempty"`
+	Objects       json.RawMessage     `json:"objects,omitempty"`
+	Reason        *StatusReason       `json:"reason,omitempty"`
+	KillPhase     string              `json:"kill_phase,omitempty"`
+	// The number of the agent's sequence given to the job created or finished
+	AgentSeq int64 `json:"agent_seq,omitempty"`
+}
+
+// Append the event and apply it to the job
+func (o *Job) record(ev JobEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.recordLocked(ev)
+}
+
+// Called with mu held. The output of a stream within one second is merged
+// into one event, so a chatty job doesn't pile up events.
+func (o *Job) recordLocked(ev JobEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if n := len(o.events); n > 0 && ev.Type == JEOutput {
+		last := &o.events[n-1]
+		if last.Type == JEOutput && last.Stream == ev.Stream &&
+			last.Time.Truncate(time.Second).Equal(ev.Time.Truncate(time.Second)) {
+			last.Size += ev.Size
+			last.Time = ev.Time
+			o.apply(ev)
+			return
+		}
+	}
+	ev.Seq = len(o.events) + 1
+	switch ev.Type {
+	case JECreated:
+		// Visible once the job is added to the bookkeeper
+		ev.AgentSeq = gJobSeq.Next(true)
+	case JEFinished:
+		ev.AgentSeq = gJobSeq.Next(false)
+	}
+	o.events = append(o.events, ev)
+	o.apply(ev)
+}
+
+func (o *Job) apply(ev JobEvent) {
+	switch ev.Type {
+	case JECreated:
+		o.Status = JSQueued
+		o.CreateTime = ev.Time
+		o.Seq = ev.AgentSeq
+		o.Timeline.QueuedAt = &ev.Time
+	case JEScheduled:
+		o.Status = JSScheduled
+		o.RunAt = ev.RunAt
+		o.Timeline.QueuedAt = nil
+	case JEQueued:
+		o.Status = JSQueued
+		o.Timeline.QueuedAt = &ev.Time
+	case JEPendingApproval:
+		o.Status = JSPendingApproval
+		o.Reason = ev.Reason
+		o.Timeline.QueuedAt = nil
+	case JEApproved:
+		o.Status = JSQueued
+		o.Reason = nil
+		o.ApprovedBy = ev.By
+		o.Timeline.QueuedAt = &ev.Time
+	case JEStarted:
+		o.Status = JSRunning
+		o.Pid = ev.Pid
+		o.Recording = ev.Recording
+		o.Timeline.StartedAt = &ev.Time
+	case JEOutput:
+		o.LastOutputTime = ev.Time
+		if o.Timeline.FirstOutputAt == nil {
+			o.Timeline.FirstOutputAt = &ev.Time
+		}
+	case JEKilled:
+		if o.Timeline.KilledAt == nil {
+			o.Timeline.KilledAt = &ev.Time
+		}
+	case JEFinished:
+		o.Timeline.FinishedAt = &ev.Time
+		o.Status = ev.Status
+		o.ExitCode = ev.ExitCode
+		o.Signal = ev.Signal
+		o.KillPhase = ev.KillPhase
+		o.Files = ev.Files
+		o.Parsed, o.ParseError = ev.Parsed, ev.ParseError
+		o.Objects = ev.Objects
+		o.Error = ev.Error
+		o.FinishTime = ev.Time
+		o.FinishSeq = ev.AgentSeq
+		o.Unmet = ev.Unmet
+		o.Reason = ev.Reason
+		o.RollbackJobId = ev.RollbackJobId
+		o.Liveness = ""
+	}
+}
+
+// The events after the given seq
+func (o *Job) Events(since int) []JobEvent {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if since < 0 {
+		since = 0
+	}
+	if since >= len(o.events) {
+		return []JobEvent{}
+	}
+	return append([]JobEvent{}, o.events[since:]...)
+}
+
+// Handler to get the state transitions of a job, the events after the
+// optional since are returned, so the clients can follow a job incrementally.
+func JobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.FormValue("id"))
+	if id == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param id is empty"))
+		return
+	}
+	since := 0
+	if s := r.FormValue("since"); s != "" {
+		var err error
+		if since, err = strconv.Atoi(s); err != nil {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid param since: "+s))
+			return
+		}
+	}
+	job := managedJob(id, RequestToken(r))
+	if job == nil && proxyForwarded(w, r, id) {
+		return
+	}
+	if job == nil {
+		ServeJSON(w, NewResponse().SetError(ECJobNotFound, "job not found: "+id))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(job.Events(since)))
+}
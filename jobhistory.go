@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The results of the last runs of a request with keep_history are kept by
+// its template, the hash of the request and its tenant without the fields
+// varying between the runs, e.g. the runs of a schedule. They are kept in
+// <history::dir>/<template>.json with the output gzipped, and compared by
+// /cmd/history_by_template: the line diff of each run against the previous,
+// and the series of the numbers in the output which changed, so that a trend
+// like the growth of the disk usage shows.
+
+// Series returned at most, in the order their lines first appear
+const historyMaxSeries = 200
+
+var (
+	historyNumber = regexp.MustCompile(`-?\d+(?:\.\d+)?`)
+	gJobHistory   = &JobHistory{}
+)
+
+// The result of a run
+type HistoryEntry struct {
+	JobId      string    `json:"job_id"`
+	Status     JobStatus `json:"status"`
+	ExitCode   int       `json:"exit_code"`
+	CreateTime time.Time `json:"create_time"`
+	FinishTime time.Time `json:"finish_time"`
+	DurationMs int64     `json:"duration_ms"` // Of the process
+	StdoutSize int       `json:"stdout_size"` // Bytes of the whole output
+	StderrSize int       `json:"stderr_size"`
+	// The output kept is cut to history::max_output
+	Truncated bool   `json:"truncated,omitempty"`
+	Stdout    string `json:"stdout,omitempty"`
+	Stderr    string `json:"stderr,omitempty"`
+}
+
+type historyFileEntry struct {
+	HistoryEntry
+	StdoutGz []byte `json:"stdout_gz,omitempty"`
+	StderrGz []byte `json:"stderr_gz,omitempty"`
+}
+
+type historyFile struct {
+	Template string              `json:"template"`
+	Cmd      string              `json:"cmd"`
+	Tenant   string              `json:"tenant,omitempty"`
+	Keep     int                 `json:"keep"`
+	Entries  []*historyFileEntry `json:"entries"` // The oldest first
+}
+
+// A run compared with the previous one
+type HistoryChange struct {
+	From   string       `json:"from"` // The job ids
+	To     string       `json:"to"`
+	Equal  bool         `json:"equal"`
+	Fields []*FieldDiff `json:"fields,omitempty"` // The status or the exit_code if differing
+	Stdout *OutputDiff  `json:"stdout"`
+	Stderr *OutputDiff  `json:"stderr"`
+}
+
+// A number of the stdout across the runs, the number at the field of the
+// line, which is the line with its numbers replaced by #, suffixed by (n) if
+// the nth of the output alike
+type HistorySeries struct {
+	Line   string     `json:"line"`
+	Field  int        `json:"field"`  // From 1
+	Values []*float64 `json:"values"` // Of the entries, null where the line is missing
+	First  float64    `json:"first"`
+	Last   float64    `json:"last"`
+	Min    float64    `json:"min"`
+	Max    float64    `json:"max"`
+	Delta  float64    `json:"delta"` // Last minus first
+}
+
+type HistoryRes struct {
+	Template string           `json:"template"`
+	Cmd      string           `json:"cmd"`
+	Tenant   string           `json:"tenant,omitempty"`
+	Keep     int              `json:"keep"`
+	Entries  []*HistoryEntry  `json:"entries"` // The oldest first
+	Changes  []*HistoryChange `json:"changes"`
+	// Only the series whose values changed
+	Series []*HistorySeries `json:"series"`
+}
+
+type JobHistory struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func init() {
+	gHttpServer.AddToInit(InitJobHistory)
+}
+
+func InitJobHistory() error {
+	gJobHistory = &JobHistory{dir: gApp.Cnf.HistoryDir}
+	return nil
+}
+
+// The template of the request, the fields not affecting the result and those
+// varying between the runs are left out
+func jobTemplate(req *RunCmdReq, tenant string) string {
+	k := *req
+	k.RunAt, k.Labels, k.RequireApproval, k.Record, k.Profile = nil, nil, false, false, ""
+	return jobCacheKey(&k, tenant)[:16]
+}
+
+func (o *JobHistory) path(template string) string {
+	return filepath.Join(o.dir, template+".json")
+}
+
+// Keep the result of the job once it finishes, the canceled jobs aren't kept
+func (o *JobHistory) Watch(job *Job) {
+	<-job.Done()
+	s := job.Snapshot()
+	if s.Status == JSCanceled {
+		return
+	}
+	if err := o.Add(s); err != nil {
+		log.Errorf("keep the history of job %s failed: %s", s.Id, err)
+	}
+}
+
+func (o *JobHistory) Add(job *Job) error {
+	max := gApp.Cnf.HistoryMaxOutput << 10
+	e := &historyFileEntry{HistoryEntry: HistoryEntry{
+		JobId:      job.Id,
+		Status:     job.Status,
+		ExitCode:   job.ExitCode,
+		CreateTime: job.CreateTime,
+		FinishTime: job.FinishTime,
+		StdoutSize: len(job.Stdout),
+		StderrSize: len(job.Stderr),
+	}}
+	if job.Timeline.StartedAt != nil {
+		e.DurationMs = int64(job.FinishTime.Sub(*job.Timeline.StartedAt) / time.Millisecond)
+	}
+	var cut [2]bool
+	e.StdoutGz, cut[0] = gzipOutput(job.Stdout, max)
+	e.StderrGz, cut[1] = gzipOutput(job.Stderr, max)
+	e.Truncated = cut[0] || cut[1]
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	h, err := o.load(job.Template)
+	if os.IsNotExist(err) {
+		h, err = &historyFile{Template: job.Template}, nil
+	}
+	if err != nil {
+		return err
+	}
+	h.Cmd, h.Tenant = job.Cmd, job.Tenant
+	h.Keep = job.KeepHistory
+	if h.Keep > gApp.Cnf.HistoryMaxEntries {
+		h.Keep = gApp.Cnf.HistoryMaxEntries
+	}
+	h.Entries = append(h.Entries, e)
+	if n := len(h.Entries) - h.Keep; n > 0 {
+		h.Entries = h.Entries[n:]
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(o.dir, 0700); err != nil {
+		return err
+	}
+	return writeFileSealed(o.path(job.Template), b, 0600)
+}
+
+func (o *JobHistory) load(template string) (*historyFile, error) {
+	b, err := readFileSealed(o.path(template))
+	if err != nil {
+		return nil, err
+	}
+	var h historyFile
+	if err = json.Unmarshal(b, &h); err != nil {
+		return nil, fmt.Errorf("invalid history file %s: %s", o.path(template), err)
+	}
+	return &h, nil
+}
+
+// The last results of the template compared, up to limit if not 0. The
+// outputs and the hunks of the diffs are returned with output.
+func (o *JobHistory) Get(template string, limit int, output bool) (*HistoryRes, error) {
+	o.mu.Lock()
+	h, err := o.load(template)
+	o.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(h.Entries) > limit {
+		h.Entries = h.Entries[len(h.Entries)-limit:]
+	}
+
+	res := &HistoryRes{Template: h.Template, Cmd: h.Cmd, Tenant: h.Tenant, Keep: h.Keep,
+		Entries: []*HistoryEntry{}, Changes: []*HistoryChange{}}
+	var stdouts []string
+	for i, fe := range h.Entries {
+		e := fe.HistoryEntry
+		if e.Stdout, err = gunzipOutput(fe.StdoutGz); err == nil {
+			e.Stderr, err = gunzipOutput(fe.StderrGz)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid output of job %s: %s", e.JobId, err)
+		}
+		stdouts = append(stdouts, e.Stdout)
+		if i > 0 {
+			res.Changes = append(res.Changes, compareHistory(res.Entries[i-1], &e, output))
+		}
+		res.Entries = append(res.Entries, &e)
+	}
+	if !output {
+		for _, e := range res.Entries {
+			e.Stdout, e.Stderr = "", ""
+		}
+	}
+	res.Series = historySeries(stdouts)
+	return res, nil
+}
+
+func compareHistory(a, b *HistoryEntry, hunks bool) *HistoryChange {
+	c := &HistoryChange{From: a.JobId, To: b.JobId}
+	if a.Status != b.Status {
+		c.Fields = append(c.Fields, &FieldDiff{Name: "status", A: a.Status, B: b.Status})
+	}
+	if a.ExitCode != b.ExitCode {
+		c.Fields = append(c.Fields, &FieldDiff{Name: "exit_code", A: a.ExitCode, B: b.ExitCode})
+	}
+	c.Stdout = diffLines(splitLines(a.Stdout), splitLines(b.Stdout))
+	c.Stderr = diffLines(splitLines(a.Stderr), splitLines(b.Stderr))
+	if !hunks {
+		c.Stdout.Hunks, c.Stderr.Hunks = nil, nil
+	}
+	c.Equal = len(c.Fields) == 0 && c.Stdout.Equal && c.Stderr.Equal
+	return c
+}
+
+// The numbers of the outputs by their lines, those which changed
+func historySeries(outputs []string) []*HistorySeries {
+	index := make(map[string]*HistorySeries)
+	var all []*HistorySeries
+	for i, out := range outputs {
+		alike := make(map[string]int)
+		for _, line := range splitLines(out) {
+			nums := historyNumber.FindAllString(line, -1)
+			if len(nums) == 0 {
+				continue
+			}
+			pattern := historyNumber.ReplaceAllString(strings.TrimSpace(line), "#")
+			alike[pattern]++
+			if n := alike[pattern]; n > 1 {
+				pattern = fmt.Sprintf("%s (%d)", pattern, n)
+			}
+			for f, num := range nums {
+				v, err := strconv.ParseFloat(num, 64)
+				if err != nil {
+					continue
+				}
+				key := pattern + "\x00" + strconv.Itoa(f)
+				s := index[key]
+				if s == nil {
+					s = &HistorySeries{Line: pattern, Field: f + 1, Values: make([]*float64, len(outputs))}
+					index[key] = s
+					all = append(all, s)
+				}
+				s.Values[i] = &v
+			}
+		}
+	}
+
+	res := []*HistorySeries{}
+	for _, s := range all {
+		var first, last *float64
+		changed := false
+		for _, v := range s.Values {
+			if v == nil {
+				continue
+			}
+			if first == nil {
+				first = v
+				s.Min, s.Max = *v, *v
+			}
+			if *v != *first {
+				changed = true
+			}
+			if *v < s.Min {
+				s.Min = *v
+			}
+			if *v > s.Max {
+				s.Max = *v
+			}
+			last = v
+		}
+		if !changed {
+			continue
+		}
+		s.First, s.Last, s.Delta = *first, *last, *last-*first
+		if res = append(res, s); len(res) == historyMaxSeries {
+			break
+		}
+	}
+	return res
+}
+
+// The output gzipped, cut to max bytes first, and whether cut
+func gzipOutput(s string, max int) ([]byte, bool) {
+	cut := false
+	if len(s) > max {
+		s, cut = s[:max], true
+	}
+	if s == "" {
+		return nil, cut
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	return buf.Bytes(), cut
+}
+
+func gunzipOutput(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	s, err := ioutil.ReadAll(zr)
+	return string(s), err
+}
+
+// Handler comparing the kept results of the template, or of the template of
+// the job by the param id
+func HistoryByTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	template := strings.TrimSpace(r.FormValue("template"))
+	if id := strings.TrimSpace(r.FormValue("id")); template == "" && id != "" {
+		job := managedJob(id, RequestToken(r))
+		if job == nil && proxyForwarded(w, r, id) {
+			return
+		}
+		if job == nil {
+			ServeJSON(w, NewResponse().SetError(ECJobNotFound, "job not found: "+id))
+			return
+		}
+		if template = job.snapshot(false).Template; template == "" {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "the job keeps no history: "+id))
+			return
+		}
+	}
+	if template == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param template or id is required"))
+		return
+	}
+	if strings.ContainsAny(template, `/\.`) {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid param template: "+template))
+		return
+	}
+	limit := 0
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid param limit: "+s))
+			return
+		}
+	}
+	res, err := gJobHistory.Get(template, limit, r.FormValue("output") != "")
+	if tok := RequestToken(r); err == nil && tok != nil && !tok.Admin && res.Tenant != tok.Name {
+		err = os.ErrNotExist
+	}
+	if os.IsNotExist(err) {
+		ServeJSON(w, NewResponse().SetError(ECHistoryNotFound, "history not found: "+template))
+		return
+	}
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECFileIOFailed, err.Error()))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(res))
+}
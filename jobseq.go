@@ -0,0 +1,174 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The agent numbers the jobs by a monotonic sequence, kept increasing across
+// restarts: a job takes a number when created, its seq, and another when
+// finished, its finish_seq. A controller reading /cmd/since from the last
+// number it processed gets every job created or finished since, in the order
+// of the numbers, so it detects the jobs and the results missed while it was
+// disconnected, and processes each result once.
+
+// Numbers reserved on disk at a time, the unused ones are skipped by a restart
+const jobSeqBlock = 1000
+
+type JobSeq struct {
+	path string
+
+	mu       sync.Mutex
+	first    int64 // The first given since the start
+	last     int64 // The last given
+	reserved int64 // The numbers up to it are reserved on disk
+	// Given to the jobs being created, not visible yet
+	pending map[int64]bool
+}
+
+var (
+	gJobSeq = &JobSeq{first: 1, pending: make(map[int64]bool)}
+)
+
+func init() {
+	gHttpServer.AddToInit(InitJobSeq)
+}
+
+func InitJobSeq() error {
+	seq, err := NewJobSeq(filepath.Join(gApp.Cnf.ScheduleDir, "job_seq"))
+	if err != nil {
+		log.Errorf("load job seq failed: %s", err)
+		return err
+	}
+	// Monotonic as well after a restart of the http server
+	if seq.last < gJobSeq.last {
+		seq.first, seq.last, seq.reserved = gJobSeq.last+1, gJobSeq.last, gJobSeq.last
+	}
+	gJobSeq = seq
+	return nil
+}
+
+func NewJobSeq(path string) (*JobSeq, error) {
+	o := &JobSeq{path: path, pending: make(map[int64]bool)}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if o.last, err = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	o.reserved = o.last
+	o.first = o.last + 1
+	return o, nil
+}
+
+// The next number, pending until done if the job isn't visible yet
+func (o *JobSeq) Next(pending bool) int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.last++
+	if o.last > o.reserved && o.path != "" {
+		o.reserved = o.last + jobSeqBlock - 1
+		b := []byte(strconv.FormatInt(o.reserved, 10))
+		if err := writeFileAtomic(o.path, b, 0644); err != nil {
+			log.Errorf("reserve job seq in %s failed: %s", o.path, err)
+		}
+	}
+	if pending {
+		o.pending[o.last] = true
+	}
+	return o.last
+}
+
+// The job of the number is visible
+func (o *JobSeq) Done(seq int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.pending, seq)
+}
+
+// The number up to which all the jobs are visible, and the first since the
+// start
+func (o *JobSeq) Visible() (int64, int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	v := o.last
+	for seq := range o.pending {
+		if seq <= v {
+			v = seq - 1
+		}
+	}
+	return v, o.first
+}
+
+type SinceRes struct {
+	// Continue from it, the last number of the jobs, or the one asked if none
+	LastSeq int64 `json:"last_seq"`
+	// The first number since the agent started, the jobs between the one
+	// asked and it were lost by a restart
+	FirstSeq int64  `json:"first_seq"`
+	More     bool   `json:"more"` // More jobs after last_seq, beyond the limit
+	Jobs     []*Job `json:"jobs"`
+}
+
+// The jobs the token manages created or finished after the number, up to
+// limit, each job once by its latest number
+func jobsSince(seq int64, limit int, tok *Token) *SinceRes {
+	visible, first := gJobSeq.Visible()
+	res := &SinceRes{LastSeq: seq, FirstSeq: first, Jobs: []*Job{}}
+	type entry struct {
+		seq int64
+		job *Job
+	}
+	var entries []entry
+	for _, j := range gJobBookkeeper.GetAll() {
+		j.UpdateLiveness()
+		s := j.Snapshot()
+		if !canManageJob(tok, s) {
+			continue
+		}
+		n := s.Seq
+		if s.FinishSeq > n && s.FinishSeq <= visible {
+			n = s.FinishSeq
+		}
+		if n > seq && n <= visible {
+			entries = append(entries, entry{n, s})
+		}
+	}
+	sort.Slice(entries, func(i, k int) bool { return entries[i].seq < entries[k].seq })
+	if limit > 0 && len(entries) > limit {
+		entries, res.More = entries[:limit], true
+	}
+	for _, e := range entries {
+		res.Jobs = append(res.Jobs, e.job)
+		res.LastSeq = e.seq
+	}
+	return res
+}
+
+// Handler to list the jobs created or finished after the param seq
+func SinceCmdHandler(w http.ResponseWriter, r *http.Request) {
+	seq, err := strconv.ParseInt(r.FormValue("seq"), 10, 64)
+	if err != nil || seq < 0 {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param seq must be a non negative integer"))
+		return
+	}
+	limit := 1000
+	if s := r.FormValue("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param limit must be a positive integer"))
+			return
+		}
+	}
+	ServeJSON(w, NewResponse().SetData(jobsSince(seq, limit, RequestToken(r))))
+}
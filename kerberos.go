@@ -0,0 +1,722 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// With kerberos::keytab the clients of a Kerberos realm, e.g. the domain
+// accounts of Active Directory, log in to the api by "Authorization:
+// Negotiate" of SPNEGO, the ticket of the service principal of the keytab
+// they get from their KDC. The ticket is decrypted by the keytab and the
+// authenticator checked against the clock and the replays, without reaching
+// the KDC. The client principal logs in as the token of its name without the
+// realm, so it needs a token but no secret of it. Only Kerberos is spoken,
+// NTLM is refused.
+
+const (
+	krbAes128 = 17 // aes128-cts-hmac-sha1-96
+	krbAes256 = 18 // aes256-cts-hmac-sha1-96
+	krbRc4    = 23 // rc4-hmac
+
+	krbUsageTicket        = 2
+	krbUsageAuthenticator = 11
+	krbUsageApRepPart     = 12
+)
+
+var (
+	// The OIDs of the mechanisms, encoded
+	spnegoOid = []byte{0x2b, 0x06, 0x01, 0x05, 0x05, 0x02}
+	krb5Oid   = []byte{0x2a, 0x86, 0x48, 0x86, 0xf7, 0x12, 0x01, 0x02, 0x02}
+	// The one Windows sends by a bug kept since Windows 2000
+	msKrb5Oid = []byte{0x2a, 0x86, 0x48, 0x82, 0xf7, 0x12, 0x01, 0x02, 0x02}
+
+	errKrbNoKerberos = errors.New("no kerberos ticket, only kerberos is supported")
+	errKrbNoKey      = errors.New("no key of the ticket in the keytab")
+	errKrbIntegrity  = errors.New("kerberos integrity check failed")
+)
+
+type KerberosAuth struct {
+	keys    []krbKey
+	service string
+	realms  []string
+	skew    time.Duration
+
+	mu     sync.Mutex
+	replay map[string]time.Time // The authenticators seen, until they are stale
+}
+
+// A key of a service principal in the keytab
+type krbKey struct {
+	principal string // name/instance@REALM
+	kvno      uint32
+	etype     int64
+	key       []byte
+}
+
+type krbPrincipal struct {
+	names []string
+	realm string
+}
+
+func (o *krbPrincipal) String() string {
+	return strings.Join(o.names, "/") + "@" + o.realm
+}
+
+// The fields of an AP-REQ, its ticket decrypted
+type krbApReq struct {
+	mutual     bool
+	service    krbPrincipal
+	client     krbPrincipal
+	sessionKey []byte
+	keyType    int64
+	startTime  time.Time
+	endTime    time.Time
+	ctime      time.Time
+	cusec      int64
+	seqNumber  int64
+	hasSeq     bool
+}
+
+var gKerberos *KerberosAuth
+
+func init() {
+	gHttpServer.AddToInit(InitKerberos)
+}
+
+func InitKerberos() error {
+	gKerberos = nil
+	if gApp.Cnf.KerberosKeytab == "" {
+		return nil
+	}
+	o, err := NewKerberosAuth(gApp.Cnf)
+	if err != nil {
+		log.Errorf("invalid kerberos config: %s", err)
+		return err
+	}
+	gKerberos = o
+	return nil
+}
+
+func NewKerberosAuth(cnf *Config) (*KerberosAuth, error) {
+	b, err := ioutil.ReadFile(cnf.KerberosKeytab)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseKeytab(b)
+	if err != nil {
+		return nil, err
+	}
+	o := &KerberosAuth{
+		service: cnf.KerberosService,
+		realms:  cnf.KerberosRealms,
+		skew:    time.Duration(cnf.KerberosMaxSkew) * time.Second,
+		replay:  make(map[string]time.Time),
+	}
+	for _, k := range keys {
+		if k.etype != krbAes128 && k.etype != krbAes256 && k.etype != krbRc4 {
+			continue
+		}
+		if o.service != "" && !strings.EqualFold(k.principal, o.service) {
+			continue
+		}
+		o.keys = append(o.keys, k)
+		if len(cnf.KerberosRealms) == 0 {
+			o.realms = append(o.realms, k.principal[strings.LastIndex(k.principal, "@")+1:])
+		}
+	}
+	if len(o.keys) == 0 {
+		return nil, errors.New("no aes or rc4 key of the service in kerberos::keytab")
+	}
+	return o, nil
+}
+
+// Authenticate the client of the token of "Authorization: Negotiate", and
+// return the token of "WWW-Authenticate: Negotiate" to reply
+func (o *KerberosAuth) Authenticate(token []byte) (*Token, []byte, error) {
+	apReq, spnego, mech, err := unwrapNegotiate(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := o.verify(apReq, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	realm := false
+	for _, r := range o.realms {
+		realm = realm || strings.EqualFold(r, req.client.realm)
+	}
+	if !realm {
+		return nil, nil, fmt.Errorf("realm of %s not allowed", req.client.String())
+	}
+	store := tokenStore()
+	if store == nil {
+		return nil, nil, errTokenInvalid
+	}
+	tok, err := store.AuthenticateName(strings.Join(req.client.names, "/"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", req.client.String(), err)
+	}
+	log.Infof("audit: %s logged in by kerberos as token %s", req.client.String(), tok.Id)
+
+	var reply []byte
+	if req.mutual {
+		apRep, err := req.apRep()
+		if err != nil {
+			return nil, nil, err
+		}
+		reply = ber(0x60, ber(0x06, mech), []byte{0x02, 0x00}, apRep)
+	}
+	if spnego {
+		fields := [][]byte{ber(0xa0, berInt(0x0a, 0)), ber(0xa1, ber(0x06, mech))}
+		if reply != nil {
+			fields = append(fields, ber(0xa2, ber(0x04, reply)))
+		}
+		reply = ber(0xa1, ber(0x30, fields...))
+	}
+	return tok, reply, nil
+}
+
+// The AP-REQ of a SPNEGO token, or of a bare kerberos one, and the kerberos
+// mechanism it came by
+func unwrapNegotiate(token []byte) ([]byte, bool, []byte, error) {
+	r := &berReader{b: token}
+	gss := &berReader{b: r.expect(0x60)}
+	oid := gss.expect(0x06)
+	if r.err != nil || gss.err != nil {
+		return nil, false, nil, errors.New("invalid negotiate token")
+	}
+	if bytes.Equal(oid, krb5Oid) || bytes.Equal(oid, msKrb5Oid) {
+		if len(gss.b) < 2 || gss.b[0] != 0x01 || gss.b[1] != 0x00 {
+			return nil, false, nil, errors.New("not a kerberos AP-REQ")
+		}
+		return gss.b[2:], false, oid, nil
+	}
+	if !bytes.Equal(oid, spnegoOid) {
+		return nil, false, nil, errKrbNoKerberos
+	}
+
+	// NegTokenInit, whose mechToken is of the first of its mechTypes
+	neg := &berReader{b: explicit(gss, 0, 0x30)}
+	var mechToken []byte
+	for neg.err == nil && len(neg.b) > 0 {
+		tag, content := neg.next()
+		if tag == 0xa2 {
+			mechToken = (&berReader{b: content}).expect(0x04)
+		}
+	}
+	if gss.err != nil || neg.err != nil {
+		return nil, false, nil, errors.New("invalid spnego token")
+	}
+	if mechToken == nil {
+		return nil, false, nil, errKrbNoKerberos
+	}
+	apReq, _, mech, err := unwrapNegotiate(mechToken)
+	return apReq, true, mech, err
+}
+
+// Decrypt the ticket of the AP-REQ and its authenticator, and check them
+func (o *KerberosAuth) verify(b []byte, now time.Time) (*krbApReq, error) {
+	r := &berReader{b: b}
+	ap := &berReader{b: (&berReader{b: r.expect(0x6e)}).expect(0x30)}
+	if explicitInt(ap, 0) != 5 || explicitInt(ap, 1) != 14 {
+		return nil, errors.New("not a kerberos AP-REQ")
+	}
+	options := explicit(ap, 2, 0x03)
+	ticket := &berReader{b: (&berReader{b: explicit(ap, 3, 0x61)}).expect(0x30)}
+	authEtype, _, authCipher := encryptedData(ap, 4)
+
+	explicitInt(ticket, 0)
+	var req krbApReq
+	req.service.realm = string(explicit(ticket, 1, 0x1b))
+	req.service.names = principalName(ticket, 2)
+	etype, kvno, cipherText := encryptedData(ticket, 3)
+	if err := firstErr(r, ap, ticket); err != nil {
+		return nil, fmt.Errorf("invalid kerberos AP-REQ: %s", err)
+	}
+	req.mutual = len(options) > 1 && options[1]&0x20 != 0
+
+	// Decrypted by a key of the service, of the kvno first
+	var plain []byte
+	err := errKrbNoKey
+	for _, first := range []bool{true, false} {
+		for _, k := range o.keys {
+			if plain != nil || k.etype != etype || (k.kvno == kvno) != first || !strings.EqualFold(k.principal, req.service.String()) {
+				continue
+			}
+			if plain, err = krbDecrypt(k.etype, k.key, krbUsageTicket, cipherText); err != nil {
+				plain = nil
+			}
+		}
+	}
+	if plain == nil {
+		return nil, fmt.Errorf("ticket of %s: %s", req.service.String(), err)
+	}
+
+	// EncTicketPart
+	r = &berReader{b: plain}
+	enc := &berReader{b: (&berReader{b: r.expect(0x63)}).expect(0x30)}
+	explicit(enc, 0, 0x03)
+	key := &berReader{b: explicit(enc, 1, 0x30)}
+	req.keyType = explicitInt(key, 0)
+	req.sessionKey = explicit(key, 1, 0x04)
+	req.client.realm = string(explicit(enc, 2, 0x1b))
+	req.client.names = principalName(enc, 3)
+	explicit(enc, 4, 0x30)
+	authTime := explicitTime(enc, 5)
+	req.startTime = authTime
+	if hasExplicit(enc, 6) {
+		req.startTime = explicitTime(enc, 6)
+	}
+	req.endTime = explicitTime(enc, 7)
+	if err := firstErr(r, enc, key); err != nil {
+		return nil, fmt.Errorf("invalid kerberos ticket: %s", err)
+	}
+	if now.After(req.endTime.Add(o.skew)) {
+		return nil, fmt.Errorf("ticket of %s expired at %s", req.client.String(), req.endTime)
+	}
+	if req.startTime.After(now.Add(o.skew)) {
+		return nil, fmt.Errorf("ticket of %s not valid until %s", req.client.String(), req.startTime)
+	}
+
+	// Authenticator, by the session key
+	if authEtype != req.keyType {
+		return nil, errors.New("authenticator not encrypted by the session key")
+	}
+	if plain, err = krbDecrypt(req.keyType, req.sessionKey, krbUsageAuthenticator, authCipher); err != nil {
+		return nil, fmt.Errorf("authenticator of %s: %s", req.client.String(), err)
+	}
+	r = &berReader{b: plain}
+	auth := &berReader{b: (&berReader{b: r.expect(0x62)}).expect(0x30)}
+	explicitInt(auth, 0)
+	client := krbPrincipal{realm: string(explicit(auth, 1, 0x1b))}
+	client.names = principalName(auth, 2)
+	if hasExplicit(auth, 3) {
+		explicit(auth, 3, 0x30)
+	}
+	req.cusec = explicitInt(auth, 4)
+	req.ctime = explicitTime(auth, 5)
+	if hasExplicit(auth, 6) {
+		explicit(auth, 6, 0x30)
+	}
+	if hasExplicit(auth, 7) {
+		req.seqNumber, req.hasSeq = explicitInt(auth, 7), true
+	}
+	if err := firstErr(r, auth); err != nil {
+		return nil, fmt.Errorf("invalid kerberos authenticator: %s", err)
+	}
+	if client.String() != req.client.String() {
+		return nil, fmt.Errorf("authenticator of %s in the ticket of %s", client.String(), req.client.String())
+	}
+	if d := now.Sub(req.ctime); d > o.skew || d < -o.skew {
+		return nil, fmt.Errorf("clock of %s off by %s", req.client.String(), d.Round(time.Second))
+	}
+	if err := o.checkReplay(&req, now); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// Refuse an authenticator seen within the skew, by its client, time and
+// service
+func (o *KerberosAuth) checkReplay(req *krbApReq, now time.Time) error {
+	key := fmt.Sprintf("%s %d.%06d %s", req.client.String(), req.ctime.Unix(), req.cusec, req.service.String())
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for k, expire := range o.replay {
+		if now.After(expire) {
+			delete(o.replay, k)
+		}
+	}
+	if _, ok := o.replay[key]; ok {
+		return fmt.Errorf("authenticator of %s replayed", req.client.String())
+	}
+	o.replay[key] = req.ctime.Add(2 * o.skew)
+	return nil
+}
+
+// The AP-REP proving the service to the client asking the mutual auth
+func (o *krbApReq) apRep() ([]byte, error) {
+	fields := [][]byte{
+		ber(0xa0, berString(0x18, o.ctime.UTC().Format("20060102150405Z"))),
+		ber(0xa1, berInt(0x02, o.cusec)),
+	}
+	if o.hasSeq {
+		fields = append(fields, ber(0xa3, berInt(0x02, o.seqNumber)))
+	}
+	c, err := krbEncrypt(o.keyType, o.sessionKey, krbUsageApRepPart, ber(0x7b, ber(0x30, fields...)))
+	if err != nil {
+		return nil, err
+	}
+	return ber(0x6f, ber(0x30,
+		ber(0xa0, berInt(0x02, 5)),
+		ber(0xa1, berInt(0x02, 15)),
+		ber(0xa2, ber(0x30, ber(0xa0, berInt(0x02, o.keyType)), ber(0xa2, ber(0x04, c)))),
+	)), nil
+}
+
+// The field of the context tag [n] of a sequence, of the tag
+func explicit(r *berReader, n, tag byte) []byte {
+	inner := &berReader{b: r.expect(0xa0 | n)}
+	b := inner.expect(tag)
+	if r.err == nil {
+		r.err = inner.err
+	}
+	return b
+}
+
+func hasExplicit(r *berReader, n byte) bool {
+	return r.err == nil && len(r.b) > 0 && r.b[0] == 0xa0|n
+}
+
+func explicitInt(r *berReader, n byte) int64 {
+	inner := &berReader{b: r.expect(0xa0 | n)}
+	v := inner.int(0x02)
+	if r.err == nil {
+		r.err = inner.err
+	}
+	return v
+}
+
+func explicitTime(r *berReader, n byte) time.Time {
+	s := string(explicit(r, n, 0x18))
+	t, err := time.Parse("20060102150405Z", s)
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("invalid kerberos time %q", s)
+	}
+	return t
+}
+
+func principalName(r *berReader, n byte) []string {
+	p := &berReader{b: explicit(r, n, 0x30)}
+	explicitInt(p, 0)
+	list := &berReader{b: explicit(p, 1, 0x30)}
+	var names []string
+	for list.err == nil && len(list.b) > 0 {
+		names = append(names, list.string(0x1b))
+	}
+	if err := firstErr(p, list); err != nil && r.err == nil {
+		r.err = err
+	}
+	return names
+}
+
+// The etype, the kvno and the cipher of an EncryptedData
+func encryptedData(r *berReader, n byte) (int64, uint32, []byte) {
+	e := &berReader{b: explicit(r, n, 0x30)}
+	etype := explicitInt(e, 0)
+	var kvno int64
+	if hasExplicit(e, 1) {
+		kvno = explicitInt(e, 1)
+	}
+	c := explicit(e, 2, 0x04)
+	if r.err == nil {
+		r.err = e.err
+	}
+	return etype, uint32(kvno), c
+}
+
+func firstErr(readers ...*berReader) error {
+	for _, r := range readers {
+		if r.err != nil {
+			return r.err
+		}
+	}
+	return nil
+}
+
+// Read the keys of a keytab file of version 0x502
+func parseKeytab(b []byte) ([]krbKey, error) {
+	if len(b) < 2 || b[0] != 0x05 || b[1] != 0x02 {
+		return nil, errors.New("not a keytab of version 0x502")
+	}
+	b = b[2:]
+	var keys []krbKey
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("truncated keytab")
+		}
+		size := int32(binary.BigEndian.Uint32(b))
+		b = b[4:]
+		if size < 0 {
+			// A hole of a deleted entry
+			size = -size
+			if int(size) > len(b) {
+				return nil, errors.New("truncated keytab")
+			}
+			b = b[size:]
+			continue
+		}
+		if int(size) > len(b) {
+			return nil, errors.New("truncated keytab")
+		}
+		k, err := parseKeytabEntry(b[:size])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+		b = b[size:]
+	}
+	return keys, nil
+}
+
+func parseKeytabEntry(e []byte) (krbKey, error) {
+	var k krbKey
+	bad := false
+	take := func(n int) []byte {
+		if bad || len(e) < n {
+			bad = true
+			return make([]byte, n)
+		}
+		v := e[:n]
+		e = e[n:]
+		return v
+	}
+	str := func() string {
+		return string(take(int(binary.BigEndian.Uint16(take(2)))))
+	}
+	count := int(binary.BigEndian.Uint16(take(2)))
+	realm := str()
+	var names []string
+	for i := 0; i < count && !bad; i++ {
+		names = append(names, str())
+	}
+	take(4 + 4) // Name type and timestamp
+	k.kvno = uint32(take(1)[0])
+	k.etype = int64(binary.BigEndian.Uint16(take(2)))
+	k.key = append([]byte{}, take(int(binary.BigEndian.Uint16(take(2))))...)
+	if len(e) >= 4 {
+		if v := binary.BigEndian.Uint32(e); v != 0 {
+			k.kvno = v
+		}
+	}
+	if bad {
+		return k, errors.New("truncated keytab entry")
+	}
+	k.principal = strings.Join(names, "/") + "@" + realm
+	return k, nil
+}
+
+// Decrypt the cipher of an EncryptedData, the confounder dropped
+func krbDecrypt(etype int64, key []byte, usage uint32, c []byte) ([]byte, error) {
+	switch etype {
+	case krbAes128, krbAes256:
+		if len(c) < aes.BlockSize+12 || len(key) != krbKeySize(etype) {
+			return nil, errKrbIntegrity
+		}
+		ke, ki := krbDeriveKey(key, usage, 0xaa), krbDeriveKey(key, usage, 0x55)
+		p, err := aesCtsDecrypt(ke, c[:len(c)-12])
+		if err != nil {
+			return nil, err
+		}
+		mac := hmac.New(sha1.New, ki)
+		mac.Write(p)
+		if !hmac.Equal(mac.Sum(nil)[:12], c[len(c)-12:]) {
+			return nil, errKrbIntegrity
+		}
+		return p[aes.BlockSize:], nil
+	case krbRc4:
+		if len(c) < md5.Size+8 {
+			return nil, errKrbIntegrity
+		}
+		k1 := rc4HmacKey(key, usage)
+		k3 := hmacMd5(k1, c[:md5.Size])
+		rc, err := rc4.NewCipher(k3)
+		if err != nil {
+			return nil, err
+		}
+		p := make([]byte, len(c)-md5.Size)
+		rc.XORKeyStream(p, c[md5.Size:])
+		if !hmac.Equal(hmacMd5(k1, p), c[:md5.Size]) {
+			return nil, errKrbIntegrity
+		}
+		return p[8:], nil
+	}
+	return nil, fmt.Errorf("kerberos etype %d not supported", etype)
+}
+
+// Encrypt p with a random confounder
+func krbEncrypt(etype int64, key []byte, usage uint32, p []byte) ([]byte, error) {
+	switch etype {
+	case krbAes128, krbAes256:
+		if len(key) != krbKeySize(etype) {
+			return nil, errors.New("invalid kerberos key size")
+		}
+		plain := make([]byte, aes.BlockSize, aes.BlockSize+len(p))
+		if _, err := rand.Read(plain); err != nil {
+			return nil, err
+		}
+		plain = append(plain, p...)
+		ke, ki := krbDeriveKey(key, usage, 0xaa), krbDeriveKey(key, usage, 0x55)
+		c, err := aesCtsEncrypt(ke, plain)
+		if err != nil {
+			return nil, err
+		}
+		mac := hmac.New(sha1.New, ki)
+		mac.Write(plain)
+		return append(c, mac.Sum(nil)[:12]...), nil
+	case krbRc4:
+		plain := make([]byte, 8, 8+len(p))
+		if _, err := rand.Read(plain); err != nil {
+			return nil, err
+		}
+		plain = append(plain, p...)
+		k1 := rc4HmacKey(key, usage)
+		sum := hmacMd5(k1, plain)
+		rc, err := rc4.NewCipher(hmacMd5(k1, sum))
+		if err != nil {
+			return nil, err
+		}
+		c := make([]byte, len(plain))
+		rc.XORKeyStream(c, plain)
+		return append(sum, c...), nil
+	}
+	return nil, fmt.Errorf("kerberos etype %d not supported", etype)
+}
+
+func krbKeySize(etype int64) int {
+	if etype == krbAes128 {
+		return 16
+	}
+	return 32
+}
+
+// The key of the usage, by DK of RFC 3961
+func krbDeriveKey(key []byte, usage uint32, kind byte) []byte {
+	constant := make([]byte, 5)
+	binary.BigEndian.PutUint32(constant, usage)
+	constant[4] = kind
+	return krbDerive(key, constant)
+}
+
+func krbDerive(key, constant []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil
+	}
+	in := nfold(constant, aes.BlockSize)
+	var out []byte
+	for len(out) < len(key) {
+		next := make([]byte, aes.BlockSize)
+		block.Encrypt(next, in)
+		out, in = append(out, next...), next
+	}
+	return out[:len(key)]
+}
+
+// Stretch or fold in into n bytes, by n-fold of RFC 3961
+func nfold(in []byte, n int) []byte {
+	k := len(in)
+	a, b := n, k
+	for b != 0 {
+		a, b = b, a%b
+	}
+	lcm := n * k / a
+	out := make([]byte, n)
+	carry := 0
+	for i := lcm - 1; i >= 0; i-- {
+		// The most significant bit of the rotated input added into this byte
+		msbit := ((k << 3) - 1 + ((k<<3)+13)*(i/k) + ((k - i%k) << 3)) % (k << 3)
+		carry += ((int(in[(k-1-(msbit>>3))%k])<<8 | int(in[(k-(msbit>>3))%k])) >> uint(msbit&7+1)) & 0xff
+		carry += int(out[i%n])
+		out[i%n] = byte(carry)
+		carry >>= 8
+	}
+	for i := n - 1; i >= 0 && carry != 0; i-- {
+		carry += int(out[i])
+		out[i] = byte(carry)
+		carry >>= 8
+	}
+	return out
+}
+
+// AES in CBC with the cipher text stealing of RFC 3962, the last two blocks
+// swapped, by a zero iv
+func aesCtsEncrypt(key, p []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) < aes.BlockSize {
+		return nil, errors.New("aes-cts: message shorter than a block")
+	}
+	n := (len(p) + aes.BlockSize - 1) / aes.BlockSize
+	d := len(p) - (n-1)*aes.BlockSize
+	full := make([]byte, n*aes.BlockSize)
+	copy(full, p)
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(full, full)
+	if n == 1 {
+		return full, nil
+	}
+	c := make([]byte, 0, len(p))
+	c = append(c, full[:(n-2)*aes.BlockSize]...)
+	c = append(c, full[(n-1)*aes.BlockSize:]...)
+	return append(c, full[(n-2)*aes.BlockSize:(n-2)*aes.BlockSize+d]...), nil
+}
+
+func aesCtsDecrypt(key, c []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(c) < aes.BlockSize {
+		return nil, errors.New("aes-cts: message shorter than a block")
+	}
+	p := make([]byte, len(c))
+	if len(c) == aes.BlockSize {
+		block.Decrypt(p, c)
+		return p, nil
+	}
+	n := (len(c) + aes.BlockSize - 1) / aes.BlockSize
+	d := len(c) - (n-1)*aes.BlockSize
+	prev := make([]byte, aes.BlockSize)
+	head := (n - 2) * aes.BlockSize
+	if n > 2 {
+		cipher.NewCBCDecrypter(block, prev).CryptBlocks(p[:head], c[:head])
+		prev = c[head-aes.BlockSize : head]
+	}
+	// The last block padded by the tail of the decrypted one before it
+	x, y := c[head:head+aes.BlockSize], c[head+aes.BlockSize:]
+	dx := make([]byte, aes.BlockSize)
+	block.Decrypt(dx, x)
+	for i := 0; i < d; i++ {
+		p[head+aes.BlockSize+i] = dx[i] ^ y[i]
+	}
+	last := append(append([]byte{}, y...), dx[d:]...)
+	block.Decrypt(p[head:head+aes.BlockSize], last)
+	for i := 0; i < aes.BlockSize; i++ {
+		p[head+i] ^= prev[i]
+	}
+	return p, nil
+}
+
+// K1 of rc4-hmac of RFC 4757 for the usage
+func rc4HmacKey(key []byte, usage uint32) []byte {
+	if usage == 3 {
+		usage = 8
+	}
+	var t [4]byte
+	binary.LittleEndian.PutUint32(t[:], usage)
+	return hmacMd5(key, t[:])
+}
+
+func hmacMd5(key, data []byte) []byte {
+	mac := hmac.New(md5.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
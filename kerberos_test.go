@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The vectors of RFC 3961 and RFC 3962
+func TestKerberosCrypto(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		bits int
+		want string
+	}{
+		{"012345", 64, "be072631276b1955"},
+		{"password", 56, "78a07b6caf85fa"},
+		{"Rough Consensus, and Running Code", 64, "bb6ed30870b7f0e0"},
+		{"password", 168, "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{"MASSACHVSETTS INSTITVTE OF TECHNOLOGY", 192, "db3b0d8f0b061e603282b308a50841229ad798fab9540c1b"},
+		{"Q", 168, "518a54a215a8452a518a54a215a8452a518a54a215"},
+		{"ba", 168, "fb25d531ae8974499f52fd92ea9857c4ba24cf297e"},
+		{"kerberos", 64, "6b65726265726f73"},
+		{"kerberos", 128, "6b65726265726f737b9b5b2b93132b93"},
+		{"kerberos", 256, "6b65726265726f737b9b5b2b93132b935c9bdcdad95c9899c4cae4dee6d6cae4"},
+	} {
+		if got := hex.EncodeToString(nfold([]byte(c.in), c.bits/8)); got != c.want {
+			t.Errorf("%d-fold(%s): got %s, want %s", c.bits, c.in, got, c.want)
+		}
+	}
+
+	// The keys of "password" by 1 iteration, from their pbkdf2
+	for _, c := range []struct{ tkey, want string }{
+		{"cdedb5281bb2f801565a1122b2563515", "42263c6e89f4fc28b8df68ee09799f15"},
+		{"cdedb5281bb2f801565a1122b25635150ad1f7a04bb9f3a333ecc0e2e1f70837", "fe697b52bc0d3ce14432ba036a92e65bbb52280990a2fa27883998d72af30161"},
+	} {
+		if got := hex.EncodeToString(krbDerive(unhex(t, c.tkey), []byte("kerberos"))); got != c.want {
+			t.Errorf("key of %s: got %s, want %s", c.tkey, got, c.want)
+		}
+	}
+
+	key := []byte("chicken teriyaki")
+	plain := unhex(t, "4920776f756c64206c696b652074686520 47656e6572616c20476175277320436869636b656e2c20706c656173652c")
+	for _, c := range []struct {
+		n    int
+		want string
+	}{
+		{17, "c6353568f2bf8cb4d8a580362da7ff7f97"},
+		{31, "fc00783e0efdb2c1d445d4c8eff7ed2297687268d6ecccc0c07b25e25ecfe5"},
+		{32, "39312523a78662d5be7fcbcc98ebf5a897687268d6ecccc0c07b25e25ecfe584"},
+		{47, "97687268d6ecccc0c07b25e25ecfe584b3fffd940c16a18c1b5549d2f838029e39312523a78662d5be7fcbcc98ebf5"},
+	} {
+		c1, err := aesCtsEncrypt(key, plain[:c.n])
+		if err != nil || hex.EncodeToString(c1) != c.want {
+			t.Errorf("%d bytes: got %x, %v, want %s", c.n, c1, err, c.want)
+		}
+		if p, err := aesCtsDecrypt(key, c1); err != nil || !bytes.Equal(p, plain[:c.n]) {
+			t.Errorf("%d bytes: decrypted to %x, %v", c.n, p, err)
+		}
+	}
+
+	for _, etype := range []int64{krbAes128, krbAes256, krbRc4} {
+		key := bytes.Repeat([]byte{7}, krbKeySize(etype))
+		if etype == krbRc4 {
+			key = key[:16]
+		}
+		c, err := krbEncrypt(etype, key, krbUsageTicket, []byte("ticket"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, err := krbDecrypt(etype, key, krbUsageTicket, c); err != nil || string(p) != "ticket" {
+			t.Errorf("etype %d: got %q, %v", etype, p, err)
+		}
+		if _, err := krbDecrypt(etype, key, krbUsageAuthenticator, c); err != errKrbIntegrity {
+			t.Errorf("etype %d: decrypted by the key of another usage: %v", etype, err)
+		}
+	}
+}
+
+// A keytab of the keys of the service principal
+func krbTestKeytab(principal string, kvno uint32, keys map[int64][]byte) []byte {
+	at := strings.LastIndex(principal, "@")
+	names := strings.Split(principal[:at], "/")
+	b := []byte{0x05, 0x02}
+	str := func(e []byte, s string) []byte {
+		e = binary.BigEndian.AppendUint16(e, uint16(len(s)))
+		return append(e, s...)
+	}
+	for etype, key := range keys {
+		e := binary.BigEndian.AppendUint16(nil, uint16(len(names)))
+		e = str(e, principal[at+1:])
+		for _, n := range names {
+			e = str(e, n)
+		}
+		e = binary.BigEndian.AppendUint32(e, 1)
+		e = binary.BigEndian.AppendUint32(e, uint32(time.Now().Unix()))
+		e = append(e, byte(kvno))
+		e = binary.BigEndian.AppendUint16(e, uint16(etype))
+		e = str(e, string(key))
+		e = binary.BigEndian.AppendUint32(e, kvno)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(e)))
+		b = append(b, e...)
+	}
+	// A hole
+	b = binary.BigEndian.AppendUint32(b, uint32(0xfffffffc))
+	return append(b, 0, 0, 0, 0)
+}
+
+type krbTestTicket struct {
+	client, service  string // name@REALM
+	etype            int64
+	key              []byte // Of the service
+	kvno             int64
+	start, end, time time.Time // Of the ticket and of the authenticator
+	mutual           bool
+}
+
+func krbTestPrincipal(p string) (string, []byte) {
+	at := strings.LastIndex(p, "@")
+	var names [][]byte
+	for _, n := range strings.Split(p[:at], "/") {
+		names = append(names, berString(0x1b, n))
+	}
+	return p[at+1:], ber(0x30, ber(0xa0, berInt(0x02, 1)), ber(0xa1, ber(0x30, names...)))
+}
+
+func krbTestTime(t time.Time) []byte {
+	return berString(0x18, t.UTC().Format("20060102150405Z"))
+}
+
+// The SPNEGO token of an AP-REQ of the ticket, and the session key
+func (o *krbTestTicket) token(t *testing.T) ([]byte, []byte) {
+	session := bytes.Repeat([]byte{9}, krbKeySize(o.etype))
+	if o.etype == krbRc4 {
+		session = session[:16]
+	}
+	crealm, cname := krbTestPrincipal(o.client)
+	srealm, sname := krbTestPrincipal(o.service)
+	encTicket := ber(0x63, ber(0x30,
+		ber(0xa0, ber(0x03, make([]byte, 5))),
+		ber(0xa1, ber(0x30, ber(0xa0, berInt(0x02, o.etype)), ber(0xa1, ber(0x04, session)))),
+		ber(0xa2, berString(0x1b, crealm)),
+		ber(0xa3, cname),
+		ber(0xa4, ber(0x30, ber(0xa0, berInt(0x02, 1)), ber(0xa1, ber(0x04)))),
+		ber(0xa5, krbTestTime(o.start)),
+		ber(0xa6, krbTestTime(o.start)),
+		ber(0xa7, krbTestTime(o.end)),
+	))
+	ticketCipher, err := krbEncrypt(o.etype, o.key, krbUsageTicket, encTicket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := ber(0x62, ber(0x30,
+		ber(0xa0, berInt(0x02, 5)),
+		ber(0xa1, berString(0x1b, crealm)),
+		ber(0xa2, cname),
+		ber(0xa4, berInt(0x02, int64(o.time.Nanosecond()/1000))),
+		ber(0xa5, krbTestTime(o.time)),
+		ber(0xa7, berInt(0x02, 42)),
+	))
+	authCipher, err := krbEncrypt(o.etype, session, krbUsageAuthenticator, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := []byte{0, 0, 0, 0, 0}
+	if o.mutual {
+		options[1] = 0x20
+	}
+	apReq := ber(0x6e, ber(0x30,
+		ber(0xa0, berInt(0x02, 5)),
+		ber(0xa1, berInt(0x02, 14)),
+		ber(0xa2, ber(0x03, options)),
+		ber(0xa3, ber(0x61, ber(0x30,
+			ber(0xa0, berInt(0x02, 5)),
+			ber(0xa1, berString(0x1b, srealm)),
+			ber(0xa2, sname),
+			ber(0xa3, ber(0x30, ber(0xa0, berInt(0x02, o.etype)), ber(0xa1, berInt(0x02, o.kvno)), ber(0xa2, ber(0x04, ticketCipher)))),
+		))),
+		ber(0xa4, ber(0x30, ber(0xa0, berInt(0x02, o.etype)), ber(0xa2, ber(0x04, authCipher)))),
+	))
+	krb := ber(0x60, ber(0x06, krb5Oid), []byte{0x01, 0x00}, apReq)
+	mechs := ber(0x30, ber(0x06, msKrb5Oid), ber(0x06, krb5Oid))
+	return ber(0x60, ber(0x06, spnegoOid), ber(0xa0, ber(0x30, ber(0xa0, mechs), ber(0xa2, ber(0x04, krb))))), session
+}
+
+func setupKerberos(t *testing.T, keytab []byte) {
+	setupJobs(t)
+	path := filepath.Join(t.TempDir(), "agent.keytab")
+	if err := os.WriteFile(path, keytab, 0600); err != nil {
+		t.Fatal(err)
+	}
+	gApp.Cnf.KerberosKeytab = path
+	gApp.Cnf.KerberosMaxSkew = 300
+	if err := InitKerberos(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gKerberos = nil })
+	store, err := NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTokenStore(store)
+	t.Cleanup(func() { setTokenStore(nil) })
+	if _, _, err = store.Create("alice", false, 0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKerberosAuthenticate(t *testing.T) {
+	service := "HTTP/agent.corp.example.com@CORP.EXAMPLE.COM"
+	aesKey, rc4Key := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	setupKerberos(t, krbTestKeytab(service, 3, map[int64][]byte{krbAes256: aesKey, krbRc4: rc4Key}))
+	now := time.Now()
+	valid := krbTestTicket{client: "alice@CORP.EXAMPLE.COM", service: service, etype: krbAes256, key: aesKey, kvno: 3,
+		start: now.Add(-time.Hour), end: now.Add(time.Hour), time: now}
+
+	for i, c := range []struct {
+		name   string
+		change func(*krbTestTicket)
+		err    string
+	}{
+		{"aes", func(*krbTestTicket) {}, ""},
+		{"rc4", func(k *krbTestTicket) { k.etype, k.key, k.kvno = krbRc4, rc4Key, 0 }, ""},
+		{"mutual", func(k *krbTestTicket) { k.mutual = true }, ""},
+		{"other key", func(k *krbTestTicket) { k.key = bytes.Repeat([]byte{3}, 32) }, errKrbIntegrity.Error()},
+		{"other service", func(k *krbTestTicket) { k.service = "HTTP/other@CORP.EXAMPLE.COM" }, errKrbNoKey.Error()},
+		{"expired", func(k *krbTestTicket) { k.end = now.Add(-time.Hour) }, "expired"},
+		{"not yet valid", func(k *krbTestTicket) { k.start = now.Add(time.Hour) }, "not valid until"},
+		{"skewed", func(k *krbTestTicket) { k.time = now.Add(-10 * time.Minute) }, "clock of alice@CORP.EXAMPLE.COM off"},
+		{"other realm", func(k *krbTestTicket) { k.client = "alice@EVIL.COM" }, "realm of alice@EVIL.COM not allowed"},
+		{"no token", func(k *krbTestTicket) { k.client = "bob@CORP.EXAMPLE.COM" }, errTokenInvalid.Error()},
+	} {
+		k := valid
+		// Not a replay of the one before
+		k.time = k.time.Add(time.Duration(i) * time.Millisecond)
+		c.change(&k)
+		token, session := k.token(t)
+		tok, reply, err := gKerberos.Authenticate(token)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: got %+v, %v", c.name, tok, err)
+			}
+			continue
+		}
+		if err != nil || tok.Name != "alice" {
+			t.Fatalf("%s: got %+v, %v", c.name, tok, err)
+		}
+		// negTokenResp of accept-completed, with the AP-REP if mutual
+		resp := &berReader{b: reply}
+		neg := &berReader{b: resp.expect(0xa1)}
+		seq := &berReader{b: neg.expect(0x30)}
+		state, mech := explicit(seq, 0, 0x0a), explicit(seq, 1, 0x06)
+		if firstErr(resp, neg, seq) != nil || !bytes.Equal(state, []byte{0}) || !bytes.Equal(mech, krb5Oid) || hasExplicit(seq, 2) != k.mutual {
+			t.Fatalf("%s: got reply %x", c.name, reply)
+		}
+		if k.mutual {
+			gss := &berReader{b: (&berReader{b: explicit(seq, 2, 0x04)}).expect(0x60)}
+			gss.expect(0x06)
+			ap := &berReader{b: (&berReader{b: gss.b[2:]}).expect(0x6f)}
+			rep := &berReader{b: ap.expect(0x30)}
+			explicitInt(rep, 0)
+			explicitInt(rep, 1)
+			etype, _, cipherText := encryptedData(rep, 2)
+			p, err := krbDecrypt(etype, session, krbUsageApRepPart, cipherText)
+			if err != nil || !bytes.HasPrefix(p, []byte{0x7b}) {
+				t.Fatalf("%s: got AP-REP %x, %v", c.name, p, err)
+			}
+		}
+	}
+
+	token, _ := valid.token(t)
+	if _, _, err := gKerberos.Authenticate(token); err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Fatalf("replay: got %v", err)
+	}
+
+	// NTLM only
+	ntlm := ber(0x60, ber(0x06, spnegoOid), ber(0xa0, ber(0x30, ber(0xa0, ber(0x30, ber(0x06, []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0x82, 0x37, 0x02, 0x02, 0x0a}))))))
+	if _, _, err := gKerberos.Authenticate(ntlm); err != errKrbNoKerberos {
+		t.Fatalf("ntlm: got %v", err)
+	}
+}
+
+func TestKerberosNegotiate(t *testing.T) {
+	service := "HTTP/agent.corp.example.com@CORP.EXAMPLE.COM"
+	key := bytes.Repeat([]byte{1}, 16)
+	setupKerberos(t, krbTestKeytab(service, 1, map[int64][]byte{krbAes128: key}))
+	now := time.Now()
+	ticket := krbTestTicket{client: "alice@CORP.EXAMPLE.COM", service: service, etype: krbAes128, key: key, kvno: 1,
+		start: now, end: now.Add(time.Hour), time: now, mutual: true}
+	token, _ := ticket.token(t)
+
+	var got *Token
+	next := func(w http.ResponseWriter, r *http.Request) { got = RequestToken(r) }
+	r := httptest.NewRequest("GET", "/api/v1/cmd/list", nil)
+	r.Header.Set("Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(token))
+	w := httptest.NewRecorder()
+	AuthMiddleware(w, r, next)
+	if got == nil || got.Name != "alice" || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Negotiate ") {
+		t.Fatalf("got %d %+v %v", w.Code, got, w.Header())
+	}
+
+	// Replayed
+	got, w = nil, httptest.NewRecorder()
+	AuthMiddleware(w, r, next)
+	if got != nil || w.Code != http.StatusUnauthorized || !strings.Contains(strings.Join(w.Header()["Www-Authenticate"], ","), "Negotiate") {
+		t.Fatalf("got %d %+v %v", w.Code, got, w.Header())
+	}
+}
@@ -0,0 +1,712 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// With ldap::url the users of LDAP or Active Directory log in by their name
+// and password, to the api by "Authorization: Basic" and to the sftp server.
+// The user is searched by ldap::user_filter, bound as by its password, and
+// authorized by the groups of ldap::group_attr: the members of
+// ldap::admin_groups get an admin token, the members of ldap::user_groups
+// one which is not admin, named by the user name, which is its tenant.
+
+type LdapAuth struct {
+	addr      string
+	ldaps     bool
+	startTls  bool
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	ttl       time.Duration
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]*ldapLogin // By the user name and the password
+}
+
+type ldapLogin struct {
+	token  *Token
+	expire time.Time
+}
+
+// The result of the search of a user
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string // By the lower case name
+}
+
+var (
+	gLdap *LdapAuth
+
+	errLdapNoGroup = errors.New("not a member of the ldap groups of the agent")
+)
+
+func init() {
+	gHttpServer.AddToInit(InitLdap)
+}
+
+func InitLdap() error {
+	gLdap = nil
+	if gApp.Cnf.LdapUrl == "" {
+		return nil
+	}
+	o, err := NewLdapAuth(gApp.Cnf)
+	if err != nil {
+		log.Errorf("invalid ldap config: %s", err)
+		return err
+	}
+	if !o.ldaps && !o.startTls {
+		log.Warnf("ldap::url %s without start_tls, the passwords go in clear", gApp.Cnf.LdapUrl)
+	}
+	gLdap = o
+	return nil
+}
+
+func NewLdapAuth(cnf *Config) (*LdapAuth, error) {
+	u, err := url.Parse(cnf.LdapUrl)
+	if err != nil {
+		return nil, err
+	}
+	o := &LdapAuth{
+		addr:     u.Host,
+		ldaps:    u.Scheme == "ldaps",
+		startTls: cnf.LdapStartTls,
+		timeout:  time.Duration(cnf.LdapTimeout) * time.Second,
+		ttl:      time.Duration(cnf.LdapCacheTtl) * time.Second,
+		cache:    make(map[[sha256.Size]byte]*ldapLogin),
+	}
+	switch {
+	case u.Scheme != "ldap" && u.Scheme != "ldaps":
+		return nil, errors.New("ldap::url must be ldap:// or ldaps://")
+	case u.Hostname() == "":
+		return nil, errors.New("ldap::url has no host")
+	case o.ldaps && o.startTls:
+		return nil, errors.New("ldap::start_tls needs an ldap:// url")
+	case cnf.LdapBindDn == "" && cnf.LdapUserDn == "":
+		return nil, errors.New("ldap::bind_dn or ldap::user_dn is required")
+	case !strings.Contains(cnf.LdapUserFilter, "%s"):
+		return nil, errors.New("ldap::user_filter has no %s")
+	case len(cnf.LdapAdminGroups) == 0 && len(cnf.LdapUserGroups) == 0:
+		// Anyone of the directory would be let in
+		log.Warn("no ldap::admin_groups nor ldap::user_groups, any user of the directory logs in")
+	}
+	if _, err = parseLdapFilter(strings.Replace(cnf.LdapUserFilter, "%s", "x", -1)); err != nil {
+		return nil, fmt.Errorf("invalid ldap::user_filter: %s", err)
+	}
+	if u.Port() == "" {
+		port := "389"
+		if o.ldaps {
+			port = "636"
+		}
+		o.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	o.tlsConfig = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	if cnf.LdapCaFile != "" {
+		b, err := ioutil.ReadFile(cnf.LdapCaFile)
+		if err != nil {
+			return nil, err
+		}
+		o.tlsConfig.RootCAs = x509.NewCertPool()
+		if !o.tlsConfig.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificate found in " + cnf.LdapCaFile)
+		}
+	}
+	return o, nil
+}
+
+// The token of the user, by a bind with the password, cached for
+// ldap::cache_ttl
+func (o *LdapAuth) Authenticate(user, password string) (*Token, error) {
+	// An empty password would be an unauthenticated bind, which succeeds
+	if user == "" || password == "" || strings.ContainsAny(user, "\x00\r\n") {
+		return nil, errTokenInvalid
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	now := time.Now()
+	o.mu.Lock()
+	for k, l := range o.cache {
+		if now.After(l.expire) {
+			delete(o.cache, k)
+		}
+	}
+	l := o.cache[key]
+	o.mu.Unlock()
+	if l != nil {
+		return l.token, nil
+	}
+
+	tok, err := o.login(user, password)
+	if err != nil {
+		return nil, err
+	}
+	if o.ttl > 0 {
+		o.mu.Lock()
+		o.cache[key] = &ldapLogin{token: tok, expire: now.Add(o.ttl)}
+		o.mu.Unlock()
+	}
+	return tok, nil
+}
+
+func (o *LdapAuth) login(user, password string) (*Token, error) {
+	cnf := gApp.Cnf
+	c, err := o.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	filter := strings.Replace(cnf.LdapUserFilter, "%s", ldapEscapeFilter(user), -1)
+	var entry *ldapEntry
+	if cnf.LdapBindDn != "" {
+		if err = c.bind(cnf.LdapBindDn, cnf.LdapBindPassword); err != nil {
+			return nil, fmt.Errorf("ldap bind of bind_dn failed: %s", err)
+		}
+		if entry, err = c.searchOne(cnf.LdapBaseDn, filter, cnf.LdapGroupAttr); err != nil {
+			return nil, err
+		}
+		if err = c.bind(entry.dn, password); err != nil {
+			return nil, errTokenInvalid
+		}
+	} else {
+		dn := strings.Replace(cnf.LdapUserDn, "%s", ldapEscapeDn(user), -1)
+		if err = c.bind(dn, password); err != nil {
+			return nil, errTokenInvalid
+		}
+		if entry, err = c.searchOne(cnf.LdapBaseDn, filter, cnf.LdapGroupAttr); err != nil {
+			return nil, err
+		}
+	}
+
+	groups := entry.attrs[strings.ToLower(cnf.LdapGroupAttr)]
+	tok := &Token{Id: "ldap:" + user, Name: user}
+	switch {
+	case ldapMemberOf(groups, cnf.LdapAdminGroups):
+		tok.Admin = true
+	case len(cnf.LdapUserGroups) > 0 && !ldapMemberOf(groups, cnf.LdapUserGroups):
+		return nil, errLdapNoGroup
+	}
+	log.Infof("audit: ldap login of %s as %s, admin: %v", user, entry.dn, tok.Admin)
+	return tok, nil
+}
+
+// Whether any of the groups, by their dn, is one of names, a dn or a cn
+func ldapMemberOf(groups, names []string) bool {
+	for _, g := range groups {
+		cn := ""
+		if rdn := strings.SplitN(g, ",", 2)[0]; strings.HasPrefix(strings.ToLower(rdn), "cn=") {
+			cn = rdn[3:]
+		}
+		for _, n := range names {
+			if strings.EqualFold(g, n) || (cn != "" && strings.EqualFold(cn, n)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Escape the value for a filter, RFC 4515
+func ldapEscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Escape the value for an attribute value of a dn, RFC 4514
+func ldapEscapeDn(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			(c == ' ' || c == '#') && i == 0,
+			c == ' ' && i == len(s)-1:
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// A connection to the directory, the requests are sent one by one
+type ldapConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	id      int64
+	timeout time.Duration
+}
+
+func (o *LdapAuth) dial() (*ldapConn, error) {
+	d := &net.Dialer{Timeout: o.timeout}
+	var conn net.Conn
+	var err error
+	if o.ldaps {
+		conn, err = tls.DialWithDialer(d, "tcp", o.addr, o.tlsConfig)
+	} else {
+		conn, err = d.Dial("tcp", o.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(o.timeout))
+	c := &ldapConn{conn: conn, r: bufio.NewReader(conn), timeout: o.timeout}
+	if o.startTls {
+		// The extended request of StartTLS
+		if _, err = c.call(ber(0x77, berString(0x80, "1.3.6.1.4.1.1466.20037")), 0x78); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap start tls failed: %s", err)
+		}
+		tc := tls.Client(conn, o.tlsConfig)
+		if err = tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		c.conn, c.r = tc, bufio.NewReader(tc)
+	}
+	return c, nil
+}
+
+func (o *ldapConn) close() {
+	o.id++
+	// The unbind request has no response
+	o.conn.Write(ber(0x30, berInt(0x02, o.id), []byte{0x42, 0}))
+	o.conn.Close()
+}
+
+// Send the op, and return the content of the response of the tag
+func (o *ldapConn) call(op []byte, tag byte) ([]byte, error) {
+	o.id++
+	if _, err := o.conn.Write(ber(0x30, berInt(0x02, o.id), op)); err != nil {
+		return nil, err
+	}
+	t, content, err := o.read()
+	if err != nil {
+		return nil, err
+	}
+	if t != tag {
+		return nil, fmt.Errorf("unexpected ldap response %#x", t)
+	}
+	return content, ldapResult(content)
+}
+
+// Read a message of the current request, its op tag and content
+func (o *ldapConn) read() (byte, []byte, error) {
+	tag, msg, err := berReadFrom(o.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != 0x30 {
+		return 0, nil, errors.New("invalid ldap message")
+	}
+	r := &berReader{b: msg}
+	if id := r.int(0x02); r.err == nil && id != o.id {
+		return 0, nil, fmt.Errorf("unexpected ldap message id %d", id)
+	}
+	t, content := r.next()
+	return t, content, r.err
+}
+
+func (o *ldapConn) bind(dn, password string) error {
+	_, err := o.call(ber(0x60, berInt(0x02, 3), berString(0x04, dn), berString(0x80, password)), 0x61)
+	return err
+}
+
+// Search the single entry matching the filter under base, with its attr
+func (o *ldapConn) searchOne(base, filter, attr string) (*ldapEntry, error) {
+	f, err := parseLdapFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	o.id++
+	req := ber(0x63,
+		berString(0x04, base),
+		berInt(0x0a, 2), // wholeSubtree
+		berInt(0x0a, 0), // neverDerefAliases
+		berInt(0x02, 2), // sizeLimit, two tell an ambiguous filter
+		berInt(0x02, int64(o.timeout/time.Second)), // timeLimit
+		[]byte{0x01, 1, 0},                         // typesOnly
+		f,
+		ber(0x30, berString(0x04, attr)))
+	if _, err = o.conn.Write(ber(0x30, berInt(0x02, o.id), req)); err != nil {
+		return nil, err
+	}
+	var entries []*ldapEntry
+	for {
+		tag, content, err := o.read()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case 0x64:
+			e, err := parseLdapEntry(content)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		case 0x73:
+			// A referral to another server isn't followed
+		case 0x65:
+			// sizeLimitExceeded with two entries is ambiguous too
+			if err = ldapResult(content); err != nil && len(entries) < 2 {
+				return nil, err
+			}
+			if len(entries) != 1 {
+				return nil, fmt.Errorf("%d ldap users match %s", len(entries), filter)
+			}
+			return entries[0], nil
+		default:
+			return nil, fmt.Errorf("unexpected ldap response %#x", tag)
+		}
+	}
+}
+
+// The error of the LDAPResult, nil on success
+func ldapResult(content []byte) error {
+	r := &berReader{b: content}
+	code := r.int(0x0a)
+	r.string(0x04) // matchedDN
+	msg := r.string(0x04)
+	if r.err != nil {
+		return r.err
+	}
+	if code != 0 {
+		return fmt.Errorf("ldap result %d: %s", code, msg)
+	}
+	return nil
+}
+
+func parseLdapEntry(content []byte) (*ldapEntry, error) {
+	r := &berReader{b: content}
+	e := &ldapEntry{dn: r.string(0x04), attrs: make(map[string][]string)}
+	attrs := &berReader{b: r.expect(0x30)}
+	for r.err == nil && attrs.err == nil && len(attrs.b) > 0 {
+		a := &berReader{b: attrs.expect(0x30)}
+		name := strings.ToLower(a.string(0x04))
+		vals := &berReader{b: a.expect(0x31)}
+		for len(vals.b) > 0 && vals.err == nil {
+			e.attrs[name] = append(e.attrs[name], vals.string(0x04))
+		}
+		if a.err != nil || vals.err != nil {
+			return nil, errors.New("invalid ldap entry")
+		}
+	}
+	if r.err != nil || attrs.err != nil {
+		return nil, errors.New("invalid ldap entry")
+	}
+	return e, nil
+}
+
+// Encode the filter of the string representation, RFC 4515: &, |, !,
+// =, ~=, >=, <=, presence, substrings and extensible matches
+func parseLdapFilter(s string) ([]byte, error) {
+	p := &ldapFilterParser{s: s}
+	f := p.filter()
+	if p.err == nil && p.pos != len(s) {
+		p.fail("trailing characters")
+	}
+	return f, p.err
+}
+
+type ldapFilterParser struct {
+	s   string
+	pos int
+	err error
+}
+
+func (o *ldapFilterParser) fail(msg string) {
+	if o.err == nil {
+		o.err = fmt.Errorf("%s at %d", msg, o.pos)
+	}
+}
+
+func (o *ldapFilterParser) filter() []byte {
+	if o.pos >= len(o.s) || o.s[o.pos] != '(' {
+		o.fail("( expected")
+		return nil
+	}
+	o.pos++
+	var f []byte
+	if o.pos < len(o.s) {
+		switch o.s[o.pos] {
+		case '&', '|':
+			tag := byte(0xa0)
+			if o.s[o.pos] == '|' {
+				tag = 0xa1
+			}
+			o.pos++
+			var list [][]byte
+			for o.err == nil && o.pos < len(o.s) && o.s[o.pos] == '(' {
+				list = append(list, o.filter())
+			}
+			f = ber(tag, list...)
+		case '!':
+			o.pos++
+			f = ber(0xa2, o.filter())
+		default:
+			f = o.item()
+		}
+	}
+	if o.pos >= len(o.s) || o.s[o.pos] != ')' {
+		o.fail(") expected")
+		return nil
+	}
+	o.pos++
+	return f
+}
+
+func (o *ldapFilterParser) item() []byte {
+	end := strings.IndexByte(o.s[o.pos:], ')')
+	if end < 0 {
+		o.fail(") expected")
+		return nil
+	}
+	item := o.s[o.pos : o.pos+end]
+	o.pos += end
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		o.fail("= expected")
+		return nil
+	}
+	attr, value := item[:eq], item[eq+1:]
+	tag := byte(0xa3)
+	switch attr[len(attr)-1] {
+	case '~':
+		tag = 0xa8
+	case '>':
+		tag = 0xa5
+	case '<':
+		tag = 0xa6
+	case ':':
+		return o.extensible(attr[:len(attr)-1], value)
+	}
+	if tag != 0xa3 {
+		attr = attr[:len(attr)-1]
+	}
+	if attr == "" || strings.ContainsAny(attr, "()*\\ ") {
+		o.fail("invalid attribute " + attr)
+		return nil
+	}
+	if tag == 0xa3 && value == "*" {
+		return berString(0x87, attr)
+	}
+	if tag == 0xa3 && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		var subs [][]byte
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			t := byte(0x81) // any
+			if i == 0 {
+				t = 0x80 // initial
+			} else if i == len(parts)-1 {
+				t = 0x82 // final
+			}
+			subs = append(subs, berString(t, o.unescape(part)))
+		}
+		return ber(0xa4, berString(0x04, attr), ber(0x30, subs...))
+	}
+	return ber(tag, berString(0x04, attr), berString(0x04, o.unescape(value)))
+}
+
+// attr[:dn][:rule]:=value, e.g. the nested groups of AD by
+// memberOf:1.2.840.113556.1.4.1941:=<dn>
+func (o *ldapFilterParser) extensible(lhs, value string) []byte {
+	parts := strings.Split(lhs, ":")
+	var rule, attr string
+	dn := false
+	attr = parts[0]
+	for _, p := range parts[1:] {
+		if strings.EqualFold(p, "dn") {
+			dn = true
+		} else {
+			rule = p
+		}
+	}
+	if attr == "" && rule == "" {
+		o.fail("extensible match without attribute nor rule")
+		return nil
+	}
+	var fields [][]byte
+	if rule != "" {
+		fields = append(fields, berString(0x81, rule))
+	}
+	if attr != "" {
+		fields = append(fields, berString(0x82, attr))
+	}
+	fields = append(fields, berString(0x83, o.unescape(value)))
+	if dn {
+		fields = append(fields, []byte{0x84, 1, 0xff})
+	}
+	return ber(0xa9, fields...)
+}
+
+// Decode the \xx escapes of a value
+func (o *ldapFilterParser) unescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		var c byte
+		if i+2 >= len(s) {
+			o.fail("invalid escape")
+			return ""
+		}
+		if _, err := fmt.Sscanf(s[i+1:i+3], "%02x", &c); err != nil {
+			o.fail("invalid escape")
+			return ""
+		}
+		b.WriteByte(c)
+		i += 2
+	}
+	return b.String()
+}
+
+// The TLV of the tag with the parts as its content, BER with definite
+// lengths as LDAP requires
+func ber(tag byte, parts ...[]byte) []byte {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	b := []byte{tag}
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	case n < 0x10000:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func berString(tag byte, s string) []byte {
+	return ber(tag, []byte(s))
+}
+
+// A two's complement integer, or an enumerated, in the fewest bytes
+func berInt(tag byte, v int64) []byte {
+	b := []byte{byte(v)}
+	for v < -0x80 || v > 0x7f {
+		v >>= 8
+		b = append([]byte{byte(v)}, b...)
+	}
+	return ber(tag, b)
+}
+
+// Read a TLV of at most 16MB
+func berReadFrom(r io.Reader) (byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(h[1])
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 3 {
+			return 0, nil, errors.New("unsupported ber length")
+		}
+		var l [3]byte
+		if _, err := io.ReadFull(r, l[:size]); err != nil {
+			return 0, nil, err
+		}
+		n = 0
+		for _, c := range l[:size] {
+			n = n<<8 | int(c)
+		}
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return h[0], b, err
+}
+
+// Read the TLVs of a content one by one, the first error sticks
+type berReader struct {
+	b   []byte
+	err error
+}
+
+func (o *berReader) next() (byte, []byte) {
+	if o.err != nil {
+		return 0, nil
+	}
+	if len(o.b) < 2 {
+		o.err = io.ErrUnexpectedEOF
+		return 0, nil
+	}
+	tag, n, off := o.b[0], int(o.b[1]), 2
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 3 || len(o.b) < 2+size {
+			o.err = errors.New("invalid ber length")
+			return 0, nil
+		}
+		n = 0
+		for _, c := range o.b[2 : 2+size] {
+			n = n<<8 | int(c)
+		}
+		off += size
+	}
+	if len(o.b) < off+n {
+		o.err = io.ErrUnexpectedEOF
+		return 0, nil
+	}
+	content := o.b[off : off+n]
+	o.b = o.b[off+n:]
+	return tag, content
+}
+
+func (o *berReader) expect(tag byte) []byte {
+	t, content := o.next()
+	if o.err == nil && t != tag {
+		o.err = fmt.Errorf("ber tag %#x expected, got %#x", tag, t)
+	}
+	return content
+}
+
+func (o *berReader) string(tag byte) string {
+	return string(o.expect(tag))
+}
+
+func (o *berReader) int(tag byte) int64 {
+	b := o.expect(tag)
+	if o.err == nil && (len(b) == 0 || len(b) > 8) {
+		o.err = errors.New("invalid ber integer")
+	}
+	var v int64
+	for i, c := range b {
+		if i == 0 && c&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int64(c)
+	}
+	return v
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseLdapFilter(t *testing.T) {
+	eq := func(attr, value string) []byte { return ber(0xa3, berString(0x04, attr), berString(0x04, value)) }
+	for _, c := range []struct {
+		filter string
+		want   []byte
+	}{
+		{"(cn=a)", []byte{0xa3, 7, 0x04, 2, 'c', 'n', 0x04, 1, 'a'}},
+		{"(cn=*)", []byte{0x87, 2, 'c', 'n'}},
+		{`(cn=a\2a\29)`, eq("cn", "a*)")},
+		{"(!(cn=a))", ber(0xa2, eq("cn", "a"))},
+		{"(&(objectClass=user)(|(cn=a)(cn=b)))", ber(0xa0, eq("objectClass", "user"), ber(0xa1, eq("cn", "a"), eq("cn", "b")))},
+		{"(uidNumber>=10)", ber(0xa5, berString(0x04, "uidNumber"), berString(0x04, "10"))},
+		{"(cn=a*b*c)", ber(0xa4, berString(0x04, "cn"), ber(0x30, berString(0x80, "a"), berString(0x81, "b"), berString(0x82, "c")))},
+		{"(cn=*b*)", ber(0xa4, berString(0x04, "cn"), ber(0x30, berString(0x81, "b")))},
+		{"(memberOf:1.2.840.113556.1.4.1941:=cn=g)", ber(0xa9, berString(0x81, "1.2.840.113556.1.4.1941"), berString(0x82, "memberOf"), berString(0x83, "cn=g"))},
+	} {
+		got, err := parseLdapFilter(c.filter)
+		if err != nil || !bytes.Equal(got, c.want) {
+			t.Errorf("%s: got %x, %v, want %x", c.filter, got, err, c.want)
+		}
+	}
+	for _, f := range []string{"", "cn=a", "(cn=a", "(cn=a))", "(=a)", `(cn=\2)`, "(&(cn=a)x)"} {
+		if _, err := parseLdapFilter(f); err == nil {
+			t.Errorf("%q: no error", f)
+		}
+	}
+	if got := ldapEscapeFilter(`*)(cn=\`); got != `\2a\29\28cn=\5c` {
+		t.Errorf("escaped to %s", got)
+	}
+}
+
+// A directory of a service account and three users, which serves the binds
+// and the searches of an equality filter of sAMAccountName
+type ldapTestServer struct {
+	ln    net.Listener
+	binds int32
+}
+
+var ldapTestUsers = map[string]struct {
+	password string
+	groups   []string
+}{
+	"cn=svc,dc=example,dc=com":   {"svc-secret", nil},
+	"cn=alice,dc=example,dc=com": {"alice-secret", []string{"CN=Agent Admins,OU=Groups,DC=example,DC=com"}},
+	"cn=bob,dc=example,dc=com":   {"bob-secret", []string{"CN=Agent Users,OU=Groups,DC=example,DC=com", "CN=Staff,DC=example,DC=com"}},
+	"cn=carol,dc=example,dc=com": {"carol-secret", []string{"CN=Staff,DC=example,DC=com"}},
+}
+
+func startLdapTestServer(t *testing.T) *ldapTestServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &ldapTestServer{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go o.serve(conn)
+		}
+	}()
+	return o
+}
+
+func (o *ldapTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	bound := ""
+	reply := func(id int64, ops ...[]byte) {
+		for _, op := range ops {
+			conn.Write(ber(0x30, berInt(0x02, id), op))
+		}
+	}
+	result := func(tag byte, code int64) []byte {
+		return ber(tag, berInt(0x0a, code), berString(0x04, ""), berString(0x04, ""))
+	}
+	for {
+		_, msg, err := berReadFrom(conn)
+		if err != nil {
+			return
+		}
+		r := &berReader{b: msg}
+		id := r.int(0x02)
+		tag, content := r.next()
+		op := &berReader{b: content}
+		switch tag {
+		case 0x60:
+			op.int(0x02)
+			dn, password := op.string(0x04), op.string(0x80)
+			atomic.AddInt32(&o.binds, 1)
+			if u, ok := ldapTestUsers[dn]; !ok || u.password != password {
+				reply(id, result(0x61, 49))
+				continue
+			}
+			bound = dn
+			reply(id, result(0x61, 0))
+		case 0x63:
+			for i := 0; i < 6; i++ {
+				op.next()
+			}
+			ftag, f := op.next()
+			if bound == "" {
+				reply(id, result(0x65, 50))
+				continue
+			}
+			var entries [][]byte
+			fr := &berReader{b: f}
+			if attr, value := fr.string(0x04), fr.string(0x04); ftag == 0xa3 && strings.EqualFold(attr, "sAMAccountName") {
+				dn := "cn=" + value + ",dc=example,dc=com"
+				if u, ok := ldapTestUsers[dn]; ok {
+					var vals [][]byte
+					for _, g := range u.groups {
+						vals = append(vals, berString(0x04, g))
+					}
+					entries = append(entries, ber(0x64, berString(0x04, dn),
+						ber(0x30, ber(0x30, berString(0x04, "memberOf"), ber(0x31, vals...)))))
+				}
+			}
+			reply(id, append(entries, result(0x65, 0))...)
+		default:
+			return
+		}
+	}
+}
+
+func setupLdap(t *testing.T, srv *ldapTestServer) {
+	setupJobs(t)
+	cnf := gApp.Cnf
+	cnf.LdapUrl = "ldap://" + srv.ln.Addr().String()
+	cnf.LdapBindDn, cnf.LdapBindPassword = "cn=svc,dc=example,dc=com", "svc-secret"
+	cnf.LdapBaseDn = "dc=example,dc=com"
+	cnf.LdapUserFilter = "(sAMAccountName=%s)"
+	cnf.LdapGroupAttr = "memberOf"
+	cnf.LdapAdminGroups = []string{"Agent Admins"}
+	cnf.LdapUserGroups = []string{"cn=agent users,ou=groups,dc=example,dc=com"}
+	cnf.LdapTimeout, cnf.LdapCacheTtl = 5, 60
+	if err := InitLdap(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gLdap = nil })
+}
+
+// The users are authorized by their groups, the admins by ldap::admin_groups
+func TestLdapAuthenticate(t *testing.T) {
+	srv := startLdapTestServer(t)
+	setupLdap(t, srv)
+	for _, c := range []struct {
+		user, password string
+		admin          bool
+		err            string
+	}{
+		{"alice", "alice-secret", true, ""},
+		{"bob", "bob-secret", false, ""},
+		{"carol", "carol-secret", false, errLdapNoGroup.Error()},
+		{"bob", "wrong", false, errTokenInvalid.Error()},
+		{"bob", "", false, errTokenInvalid.Error()},
+		{"*", "bob-secret", false, "0 ldap users"},
+	} {
+		tok, err := gLdap.Authenticate(c.user, c.password)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: got %+v, %v", c.user, tok, err)
+			}
+			continue
+		}
+		if err != nil || tok.Name != c.user || tok.Admin != c.admin {
+			t.Errorf("%s: got %+v, %v", c.user, tok, err)
+		}
+	}
+
+	// Cached until ldap::cache_ttl
+	binds := atomic.LoadInt32(&srv.binds)
+	if _, err := gLdap.Authenticate("bob", "bob-secret"); err != nil || atomic.LoadInt32(&srv.binds) != binds {
+		t.Fatalf("not cached: %v, %d binds", err, atomic.LoadInt32(&srv.binds)-binds)
+	}
+}
+
+// The users bind as ldap::user_dn without a bind_dn, and log in to the api by
+// basic auth
+func TestLdapBasicAuth(t *testing.T) {
+	srv := startLdapTestServer(t)
+	setupLdap(t, srv)
+	gApp.Cnf.LdapBindDn, gApp.Cnf.LdapBindPassword = "", ""
+	gApp.Cnf.LdapUserDn = "cn=%s,dc=example,dc=com"
+	if err := InitLdap(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got *Token
+	next := func(w http.ResponseWriter, r *http.Request) { got = RequestToken(r) }
+	for _, c := range []struct {
+		user, password string
+		status         int
+	}{
+		{"bob", "bob-secret", http.StatusOK},
+		{"bob", "alice-secret", http.StatusUnauthorized},
+		{"alice,dc=example", "alice-secret", http.StatusUnauthorized},
+	} {
+		got = nil
+		r := httptest.NewRequest("GET", "/api/v1/cmd/list", nil)
+		r.SetBasicAuth(c.user, c.password)
+		w := httptest.NewRecorder()
+		AuthMiddleware(w, r, next)
+		if w.Code != c.status || (c.status == http.StatusOK && (got == nil || got.Name != c.user || got.Admin)) {
+			t.Errorf("%s: got %d %+v %s", c.user, w.Code, got, w.Body)
+		}
+	}
+}
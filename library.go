@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The library of an agent is the profiles of the run requests and the
+// schedules in effect. It's exported as a versioned yaml bundle and imported
+// on another agent, to replicate a known-good setup across a fleet without a
+// controller. The profiles imported are kept in library::dir/profiles.json,
+// those of the policy override them by name.
+
+// The version of the bundle format, the bundles of a later one are refused
+const libraryBundleVersion = 1
+
+type LibraryBundle struct {
+	Version    int                        `json:"version"`
+	Agent      string                     `json:"agent,omitempty"` // The hostname exported from
+	ExportTime time.Time                  `json:"export_time"`
+	Profiles   map[string]json.RawMessage `json:"profiles,omitempty"`
+	Schedules  []*ScheduleReq             `json:"schedules,omitempty"`
+}
+
+// The names of the entries imported by what is done with them
+type LibraryChanges struct {
+	Added     []string `json:"added,omitempty"`
+	Updated   []string `json:"updated,omitempty"`
+	Unchanged []string `json:"unchanged,omitempty"`
+}
+
+type LibraryImportRes struct {
+	Version   int             `json:"version"`
+	Agent     string          `json:"agent,omitempty"`
+	DryRun    bool            `json:"dry_run"`
+	Profiles  *LibraryChanges `json:"profiles"`
+	Schedules *LibraryChanges `json:"schedules"`
+}
+
+// The profiles imported
+type Profiles struct {
+	path string
+
+	mu       sync.RWMutex
+	profiles map[string]json.RawMessage
+}
+
+var (
+	gProfiles *Profiles
+)
+
+func init() {
+	gHttpServer.AddToInit(InitProfiles)
+}
+
+func InitProfiles() error {
+	gProfiles = NewProfiles(filepath.Join(gApp.Cnf.LibraryDir, "profiles.json"))
+	return gProfiles.load()
+}
+
+func NewProfiles(path string) *Profiles {
+	return &Profiles{path: path, profiles: make(map[string]json.RawMessage)}
+}
+
+func (o *Profiles) load() error {
+	b, err := ioutil.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &o.profiles)
+	}
+	if err != nil {
+		return errors.New("invalid " + o.path + ": " + err.Error())
+	}
+	log.Infof("%d profiles loaded from %s", len(o.profiles), o.path)
+	return nil
+}
+
+// Called with mu held
+func (o *Profiles) save() error {
+	b, err := json.MarshalIndent(o.profiles, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(o.path), 0700); err == nil {
+			err = writeFileAtomic(o.path, b, 0600)
+		}
+	}
+	return err
+}
+
+// The profile imported, nil if none
+func (o *Profiles) Get(name string) json.RawMessage {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.profiles[name]
+}
+
+func (o *Profiles) All() map[string]json.RawMessage {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	all := make(map[string]json.RawMessage, len(o.profiles))
+	for name, p := range o.profiles {
+		all[name] = p
+	}
+	return all
+}
+
+// Add the profiles, replacing those of the same names. Only the changes are
+// reported if dry.
+func (o *Profiles) Import(profiles map[string]json.RawMessage, dry bool) (*LibraryChanges, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	changes := &LibraryChanges{}
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cur := o.profiles[name]
+		switch {
+		case cur == nil:
+			changes.Added = append(changes.Added, name)
+		case sameJSON(cur, profiles[name]):
+			changes.Unchanged = append(changes.Unchanged, name)
+		default:
+			changes.Updated = append(changes.Updated, name)
+		}
+	}
+	if dry || len(changes.Added)+len(changes.Updated) == 0 {
+		return changes, nil
+	}
+	prev := o.profiles
+	o.profiles = make(map[string]json.RawMessage, len(prev)+len(profiles))
+	for name, p := range prev {
+		o.profiles[name] = p
+	}
+	for name, p := range profiles {
+		o.profiles[name] = p
+	}
+	if err := o.save(); err != nil {
+		o.profiles = prev
+		return nil, fmt.Errorf("keep profiles in %s failed: %s", o.path, err)
+	}
+	return changes, nil
+}
+
+// Whether the json values are the same but for the formatting and the order
+// of the keys
+func sameJSON(a, b json.RawMessage) bool {
+	va, erra := decodeGeneric(a)
+	vb, errb := decodeGeneric(b)
+	return erra == nil && errb == nil && reflect.DeepEqual(va, vb)
+}
+
+// The profile of the policy, else the one imported, nil if none
+func lookupProfile(name string) json.RawMessage {
+	if gPolicy != nil {
+		if p := gPolicy.Current(); p != nil && p.Profiles[name] != nil {
+			return p.Profiles[name]
+		}
+	}
+	if gProfiles != nil {
+		return gProfiles.Get(name)
+	}
+	return nil
+}
+
+// The library in effect: the profiles imported and of the policy, and the
+// schedules but their history. Those of the policy are left out, as they'd
+// run twice on an agent of the same policy.
+func exportLibrary() *LibraryBundle {
+	hostname, _ := os.Hostname()
+	b := &LibraryBundle{Version: libraryBundleVersion, Agent: hostname, ExportTime: time.Now(),
+		Profiles: gProfiles.All()}
+	if gPolicy != nil {
+		if p := gPolicy.Current(); p != nil {
+			for name, profile := range p.Profiles {
+				b.Profiles[name] = profile
+			}
+		}
+	}
+	for _, s := range gSchedules.List() {
+		if !s.Policy {
+			b.Schedules = append(b.Schedules, s.req())
+		}
+	}
+	return b
+}
+
+// Decode a bundle in yaml, or in json
+func parseLibraryBundle(body []byte) (*LibraryBundle, error) {
+	var v interface{}
+	var err error
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		v, err = decodeGeneric(trimmed)
+	} else {
+		v, err = DecodeYAML(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := v.(map[string]interface{}); !ok {
+		return nil, errors.New("a bundle is expected")
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var bundle LibraryBundle
+	if err = json.Unmarshal(b, &bundle); err != nil {
+		return nil, err
+	}
+	if bundle.Version <= 0 {
+		return nil, errors.New("the version of the bundle is missing")
+	}
+	if bundle.Version > libraryBundleVersion {
+		return nil, fmt.Errorf("bundle version %d is not supported, up to %d", bundle.Version, libraryBundleVersion)
+	}
+	return &bundle, nil
+}
+
+// Handler to download the library in effect as a yaml bundle
+func ExportLibraryHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(exportLibrary())
+	var v interface{}
+	if err == nil {
+		v, err = decodeGeneric(b)
+	}
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	hostname, _ := os.Hostname()
+	name := "shell-agent-library-" + hostname + "-" + time.Now().Format("20060102-150405") + ".yaml"
+	log.Infof("audit: library exported by %s", tokenTenant(RequestToken(r)))
+
+	w.Header().Set(ContentType, YamlContentType)
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(name))
+	w.Write(EncodeYAML(v))
+}
+
+// Handler to import a library bundle, all at once or nothing. The profiles
+// and the schedules of the same names are replaced.
+func ImportLibraryHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("failed to read r.Body: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to read body"))
+		return
+	}
+	defer r.Body.Close()
+	dry := r.FormValue("dry_run") == "true"
+	bundle, err := parseLibraryBundle(body)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid bundle: "+err.Error()))
+		return
+	}
+
+	for name, p := range bundle.Profiles {
+		var req RunCmdReq
+		if err := json.Unmarshal(p, &req); err != nil {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, fmt.Sprintf("invalid profile %s: %s", name, err)))
+			return
+		}
+	}
+	tok := RequestToken(r)
+	names := make(map[string]bool)
+	for _, s := range bundle.Schedules {
+		if s == nil {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid bundle: a schedule is null"))
+			return
+		}
+		if s.Name != "" && names[s.Name] {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "duplicate schedule: "+s.Name))
+			return
+		}
+		names[s.Name] = true
+		if code, err := checkScheduleReq(tok, s); err != nil {
+			ServeJSON(w, NewResponse().SetError(code, fmt.Sprintf("invalid schedule %s: %s", scheduleLabel(s), err)))
+			return
+		}
+	}
+
+	res := &LibraryImportRes{Version: bundle.Version, Agent: bundle.Agent, DryRun: dry}
+	// The schedules may still be refused by their crons
+	if res.Schedules, err = gSchedules.Import(bundle.Schedules, tokenTenant(tok), true); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	if res.Profiles, err = gProfiles.Import(bundle.Profiles, dry); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECFileIOFailed, err.Error()))
+		return
+	}
+	if !dry {
+		if res.Schedules, err = gSchedules.Import(bundle.Schedules, tokenTenant(tok), false); err != nil {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+			return
+		}
+		log.Infof("audit: library of %s imported by %s, profiles: %d added, %d updated, schedules: %d added, %d updated",
+			bundle.Agent, tokenTenant(tok), len(res.Profiles.Added), len(res.Profiles.Updated),
+			len(res.Schedules.Added), len(res.Schedules.Updated))
+	}
+	ServeJSON(w, NewResponse().SetData(res))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLibraryBundle(t *testing.T) {
+	for _, c := range []struct {
+		body string
+		err  string // A part of the error, * for any
+	}{
+		{"version: 1\nagent: web-1\nprofiles:\n  uptime: {cmd: uptime}\nschedules:\n  - name: nightly\n    cron: \"0 3 * * *\"\n    cmd: backup\n", ""},
+		{`{"version":1,"profiles":{"uptime":{"cmd":"uptime"}}}`, ""},
+		{"agent: web-1\n", "version of the bundle is missing"},
+		{"version: 2\n", "bundle version 2 is not supported"},
+		{"- version: 1\n", "a bundle is expected"},
+		{"version: [1\n", "*"},
+		{`{"version":"1"}`, "*"},
+	} {
+		b, err := parseLibraryBundle([]byte(c.body))
+		switch {
+		case c.err != "":
+			if err == nil || c.err != "*" && !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%q: got %v", c.body, err)
+			}
+		case err != nil:
+			t.Errorf("%q: %s", c.body, err)
+		case b.Version != 1 || !sameJSON(b.Profiles["uptime"], json.RawMessage(`{"cmd":"uptime"}`)):
+			t.Errorf("%q: got %+v", c.body, b)
+		}
+	}
+
+	b, err := parseLibraryBundle([]byte("version: 1\nschedules:\n  - name: nightly\n    cron: \"0 3 * * *\"\n    cmd: backup\n"))
+	if err != nil || len(b.Schedules) != 1 || b.Schedules[0].Name != "nightly" || b.Schedules[0].Cron != "0 3 * * *" {
+		t.Fatalf("got %+v, %v", b, err)
+	}
+}
+
+// The profiles of the same names are replaced, and kept on disk
+func TestProfilesImport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "library", "profiles.json")
+	p := NewProfiles(path)
+	changes, err := p.Import(map[string]json.RawMessage{"a": json.RawMessage(`{"cmd":"a","async":true}`), "b": json.RawMessage(`{"cmd":"b"}`)}, false)
+	if err != nil || strings.Join(changes.Added, ",") != "a,b" {
+		t.Fatalf("got %+v, %v", changes, err)
+	}
+
+	// Unchanged but for the order of the keys
+	imports := map[string]json.RawMessage{
+		"a": json.RawMessage(`{ "async": true, "cmd": "a" }`),
+		"b": json.RawMessage(`{"cmd":"b2"}`),
+		"c": json.RawMessage(`{"cmd":"c"}`),
+	}
+	changes, err = p.Import(imports, true)
+	if err != nil || strings.Join(changes.Unchanged, ",") != "a" || strings.Join(changes.Updated, ",") != "b" || strings.Join(changes.Added, ",") != "c" {
+		t.Fatalf("got %+v, %v", changes, err)
+	}
+	if p.Get("c") != nil || !sameJSON(p.Get("b"), json.RawMessage(`{"cmd":"b"}`)) {
+		t.Fatal("changed by a dry run")
+	}
+	if _, err = p.Import(imports, false); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewProfiles(path)
+	if err = loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.All()) != 3 || !sameJSON(loaded.Get("b"), imports["b"]) {
+		t.Fatalf("got %s", loaded.All())
+	}
+}
@@ -1,12 +1,37 @@
 package main
 
 import (
+	"errors"
 	log "github.com/Sirupsen/logrus"
 	rotator "github.com/firnsan/file-rotator"
 	"io"
 	stdlog "log"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
+)
+
+// A target receiving the log entries with their levels, e.g. syslog
+type levelWriter interface {
+	WriteLevel(level log.Level, msg string) error
+	Close() error
+}
+
+// The outputs of the log, which can be switched at runtime. The plain
+// writers get the formatted output, the level writers get the entries by
+// the hook.
+type LogTargets struct {
+	names   []string
+	writers []io.Writer
+	leveled []levelWriter
+	closers []io.Closer
+
+	sync.RWMutex
+}
+
+var (
+	gLogTargets *LogTargets
 )
 
 func InitLog() error {
@@ -17,15 +42,18 @@ func InitLog() error {
 		return err
 	}
 
-	fw, err := rotator.NewFileRotator(gApp.Cnf.LogDir + "/app.log")
-	if err != nil {
+	targets := &LogTargets{}
+	if err = targets.Set(gApp.Cnf.LogOutputs); err != nil {
 		log.Errorf("set log failed: %s", err)
 		return err
 	}
+	gLogTargets = targets
 
-	log.SetOutput(fw)
+	log.SetOutput(targets)
 	log.SetLevel(level)
+	log.AddHook(targets)
 	log.AddHook(NewAlarmHook())
+	log.AddHook(&EventLogHook{})
 
 	// Also need to set the stdlog's output to this writer
 	w := log.StandardLogger().Writer()
@@ -49,6 +77,105 @@ func UninitLog() {
 	log.Printf("uninit log success")
 }
 
+// Open the outputs by their names: file, stdout, stderr or syslog, then
+// replace the current ones.
+func (o *LogTargets) Set(names []string) error {
+	if len(names) == 0 {
+		return errors.New("no log output")
+	}
+
+	var writers []io.Writer
+	var leveled []levelWriter
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case "file":
+			fw, err := rotator.NewFileRotator(gApp.Cnf.LogDir + "/app.log")
+			if err != nil {
+				closeAll()
+				return err
+			}
+			writers = append(writers, fw)
+			closers = append(closers, fw)
+		case "stdout":
+			writers = append(writers, os.Stdout)
+		case "stderr":
+			writers = append(writers, os.Stderr)
+		case "syslog":
+			sw, err := newSyslogWriter()
+			if err != nil {
+				closeAll()
+				return err
+			}
+			leveled = append(leveled, sw)
+			closers = append(closers, sw)
+		default:
+			closeAll()
+			return errors.New("unknown log output: " + name)
+		}
+	}
+
+	o.Lock()
+	old := o.closers
+	o.names, o.writers, o.leveled, o.closers = names, writers, leveled, closers
+	o.Unlock()
+
+	for _, c := range old {
+		c.Close()
+	}
+	return nil
+}
+
+func (o *LogTargets) Names() []string {
+	o.RLock()
+	defer o.RUnlock()
+	return o.names
+}
+
+func (o *LogTargets) Write(p []byte) (int, error) {
+	o.RLock()
+	defer o.RUnlock()
+	for _, w := range o.writers {
+		w.Write(p)
+	}
+	return len(p), nil
+}
+
+func (o *LogTargets) Close() error {
+	o.Lock()
+	defer o.Unlock()
+	for _, c := range o.closers {
+		c.Close()
+	}
+	o.names, o.writers, o.leveled, o.closers = nil, nil, nil, nil
+	return nil
+}
+
+func (o *LogTargets) Fire(entry *log.Entry) error {
+	o.RLock()
+	defer o.RUnlock()
+	if len(o.leveled) == 0 {
+		return nil
+	}
+	msg, err := entry.String()
+	if err != nil {
+		return err
+	}
+	for _, w := range o.leveled {
+		w.WriteLevel(entry.Level, msg)
+	}
+	return nil
+}
+
+func (o *LogTargets) Levels() []log.Level {
+	return log.AllLevels
+}
+
 type AlarmHook struct {
 }
 
@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log/syslog"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func newSyslogWriter() (*syslogWriter, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "shell-agent")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+func (o *syslogWriter) WriteLevel(level log.Level, msg string) error {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return o.w.Crit(msg)
+	case log.ErrorLevel:
+		return o.w.Err(msg)
+	case log.WarnLevel:
+		return o.w.Warning(msg)
+	case log.InfoLevel:
+		return o.w.Info(msg)
+	}
+	return o.w.Debug(msg)
+}
+
+func (o *syslogWriter) Close() error {
+	return o.w.Close()
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type syslogWriter struct{}
+
+func newSyslogWriter() (*syslogWriter, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
+
+func (o *syslogWriter) WriteLevel(level log.Level, msg string) error {
+	return nil
+}
+
+func (o *syslogWriter) Close() error {
+	return nil
+}
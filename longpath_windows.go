@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The win32 apis limit the paths to MAX_PATH unless prefixed by \\?\, which
+// turns off their normalization, so a path is made absolute and clean first.
+// A UNC path \\server\share\... becomes \\?\UNC\server\share\...
+
+// Dirs are limited to 248 chars, files to 260
+const windowsMaxPath = 248
+
+var (
+	modmpr                  = syscall.NewLazyDLL("mpr.dll")
+	procWNetAddConnection2W = modmpr.NewProc("WNetAddConnection2W")
+
+	// The shares of the config connected
+	sharesMu        sync.Mutex
+	sharesConnected = make(map[string]bool)
+)
+
+func longPath(p string) string {
+	if p == "" || strings.HasPrefix(p, `\\?\`) {
+		return p
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil || len(abs) < windowsMaxPath {
+		return p
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
+
+// The NETRESOURCE of WNetAddConnection2
+type netResource struct {
+	Scope       uint32
+	Type        uint32
+	DisplayType uint32
+	Usage       uint32
+	LocalName   *uint16
+	RemoteName  *uint16
+	Comment     *uint16
+	Provider    *uint16
+}
+
+const resourceTypeDisk = 1
+
+// Connect the share of the config holding p by its credential, once
+func connectShare(p string) error {
+	if strings.HasPrefix(p, `\\?\UNC\`) {
+		p = `\\` + p[len(`\\?\UNC\`):]
+	}
+	for _, s := range gApp.Cnf.Shares {
+		if !inShare(p, s.Path) {
+			continue
+		}
+		sharesMu.Lock()
+		defer sharesMu.Unlock()
+		if sharesConnected[s.Name] {
+			return nil
+		}
+		remote, err := syscall.UTF16PtrFromString(strings.TrimRight(s.Path, `\`))
+		if err != nil {
+			return err
+		}
+		var user, password *uint16
+		if s.Username != "" {
+			if user, err = syscall.UTF16PtrFromString(s.Username); err != nil {
+				return err
+			}
+			if password, err = syscall.UTF16PtrFromString(s.Password); err != nil {
+				return err
+			}
+		}
+		nr := netResource{Type: resourceTypeDisk, RemoteName: remote}
+		r, _, _ := procWNetAddConnection2W.Call(uintptr(unsafe.Pointer(&nr)),
+			uintptr(unsafe.Pointer(password)), uintptr(unsafe.Pointer(user)), 0)
+		if r != 0 {
+			return errors.New("connect share " + s.Name + " failed: " + syscall.Errno(r).Error())
+		}
+		sharesConnected[s.Name] = true
+		log.Infof("share %s connected: %s", s.Name, s.Path)
+		return nil
+	}
+	return nil
+}
+
+// Whether p is the share or under it, case insensitive
+func inShare(p, share string) bool {
+	share = strings.TrimRight(share, `\`)
+	return len(p) >= len(share) && strings.EqualFold(p[:len(share)], share) &&
+		(len(p) == len(share) || p[len(share)] == '\\')
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
-	_ "fmt"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"time"
 
 	"github.com/judwhite/go-svc/svc"
 )
@@ -13,9 +15,16 @@ import (
 // 	gApp = NewApplication()
 // )
 
+// Rotation of the service log, which is set up before the config is loaded
+const (
+	serviceLogMaxSize    = 10 << 20
+	serviceLogMaxBackups = 5
+	serviceLogMaxAge     = 30 * 24 * time.Hour
+)
+
 // program implements svc.Service
 type program struct {
-	LogFile *os.File
+	LogFile *RotatingFile
 	svr     *server
 }
 
@@ -23,7 +32,7 @@ func (p *program) Init(env svc.Environment) error {
 
 	log.Printf("is win service? %v\n", env.IsWindowsService())
 
-	// write to "example.log" when running as a Windows Service
+	// write to "example.log" when running as a Windows Service, rotated by size and day
 
 	if env.IsWindowsService() {
 
@@ -37,7 +46,7 @@ func (p *program) Init(env svc.Environment) error {
 
 		logPath := filepath.Join(dir, "example.log")
 
-		f, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		f, err := NewRotatingFile(logPath, serviceLogMaxSize, serviceLogMaxBackups, serviceLogMaxAge)
 
 		if err != nil {
 
@@ -49,6 +58,11 @@ func (p *program) Init(env svc.Environment) error {
 
 		log.SetOutput(f)
 
+		// Also report the lifecycle events to the Windows Event Log
+		if gEventLog, err = openEventLog(eventSource); err != nil {
+			log.Printf("open event log failed: %s\n", err)
+		}
+
 	}
 
 	return nil
@@ -59,7 +73,16 @@ func (p *program) Start() error {
 
 	log.Printf("Starting...\n")
 
-	go p.svr.start()
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				ReportErrorEvent(EventPanic, fmt.Sprintf("PANIC: %s\n%s", err, debug.Stack()))
+				panic(err)
+			}
+		}()
+		p.svr.start()
+	}()
+	ReportInfoEvent(EventServiceStart, "shell-agent "+VERSION+" started")
 
 	return nil
 
@@ -76,6 +99,7 @@ func (p *program) Stop() error {
 	}
 
 	log.Printf("Stopped.\n")
+	ReportInfoEvent(EventServiceStop, "shell-agent stopped")
 
 	return nil
 
@@ -83,12 +107,25 @@ func (p *program) Stop() error {
 
 func main() {
 
+	// Re-executed as the helper loading the seccomp filter of a job
+	if len(os.Args) > 1 && os.Args[1] == seccompExecArg {
+		seccompExec(os.Args[2:])
+	}
+	// Run as an executable of a gitlab runner of the custom executor
+	if len(os.Args) > 1 && os.Args[1] == ciExecArg {
+		os.Exit(ciExec(os.Args[2:]))
+	}
+
 	prg := program{
 		svr: &server{},
 	}
 
 	defer func() {
 
+		if gEventLog != nil {
+			gEventLog.Close()
+		}
+
 		if prg.LogFile != nil {
 
 			if closeErr := prg.LogFile.Close(); closeErr != nil {
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var errMemoryLimit = errors.New("memory limit exceeded, try again later")
+
+// Account the memory held by the jobs: their requests and buffered output.
+// Above the limit, the output of the finished jobs is spilled to disk from
+// the oldest, and new jobs are rejected if that isn't enough.
+type MemoryGuard struct {
+	limit int64 // 0 means unlimited
+	used  int64
+
+	shedC chan struct{}
+	quitC chan struct{}
+	// Serialize the shedding
+	shedMu sync.Mutex
+}
+
+var (
+	gMemoryGuard *MemoryGuard
+)
+
+func init() {
+	gHttpServer.AddToInit(InitMemoryGuard)
+	gHttpServer.AddToUninit(UninitMemoryGuard)
+}
+
+func InitMemoryGuard() error {
+	// Kept with the jobs it accounts across a restart by a config apply
+	if gMemoryGuard != nil && gHttpServer.Restarting() {
+		return nil
+	}
+	gMemoryGuard = NewMemoryGuard(int64(gApp.Cnf.MemoryLimit) << 20)
+	return nil
+}
+
+func UninitMemoryGuard() {
+	if gHttpServer.Restarting() {
+		return
+	}
+	gMemoryGuard.Close()
+}
+
+func NewMemoryGuard(limit int64) *MemoryGuard {
+	o := &MemoryGuard{
+		limit: limit,
+		shedC: make(chan struct{}, 1),
+		quitC: make(chan struct{}),
+	}
+	go o.loop()
+	return o
+}
+
+func (o *MemoryGuard) Close() {
+	close(o.quitC)
+}
+
+func (o *MemoryGuard) Used() int64 {
+	return atomic.LoadInt64(&o.used)
+}
+
+func (o *MemoryGuard) Limit() int64 {
+	return o.limit
+}
+
+func (o *MemoryGuard) Exceeded() bool {
+	return o.limit > 0 && o.Used() > o.limit
+}
+
+// Account n more bytes, or less if n is negative
+func (o *MemoryGuard) Add(n int64) {
+	if atomic.AddInt64(&o.used, n) > o.limit && o.limit > 0 && n > 0 {
+		select {
+		case o.shedC <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Check if a new job can be accepted, shedding first if above the limit
+func (o *MemoryGuard) Admit() error {
+	if !o.Exceeded() {
+		return nil
+	}
+	o.shed()
+	if o.Exceeded() {
+		log.Warnf("reject the job, memory used: %d, limit: %d", o.Used(), o.limit)
+		return errMemoryLimit
+	}
+	return nil
+}
+
+func (o *MemoryGuard) loop() {
+	for {
+		select {
+		case <-o.shedC:
+			o.shed()
+		case <-o.quitC:
+			return
+		}
+	}
+}
+
+// Spill the output of the finished jobs to disk, the oldest first, until
+// below the limit
+func (o *MemoryGuard) shed() {
+	o.shedMu.Lock()
+	defer o.shedMu.Unlock()
+	if !o.Exceeded() {
+		return
+	}
+
+	var jobs []*Job
+	for _, j := range gJobBookkeeper.GetAll() {
+		if j.Finished() && !j.Spilled() {
+			jobs = append(jobs, j)
+		}
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].FinishTime.Before(jobs[k].FinishTime) })
+
+	spilled := 0
+	for _, j := range jobs {
+		if !o.Exceeded() {
+			break
+		}
+		if err := j.spill(); err != nil {
+			log.Errorf("spill the output of job %s failed: %s", j.Id, err)
+			return
+		}
+		spilled++
+	}
+	log.Infof("spilled the output of %d jobs, memory used: %d, limit: %d", spilled, o.Used(), o.limit)
+}
+
+// Move the output of a finished job to the spill dir
+func (o *Job) spill() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.stdout.spillAll(); err != nil {
+		return err
+	}
+	return o.stderr.spillAll()
+}
+
+// Whether the output of the job is all on disk
+func (o *Job) Spilled() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.stdout.memSize == 0 && o.stderr.memSize == 0
+}
+
+// Release the memory and the spilled files of a purged job
+func (o *Job) release() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.stdout.release()
+	o.stderr.release()
+	o.marks = nil
+	gMemoryGuard.Add(-o.mem)
+	o.mem = 0
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The output of a stream is kept in a ring of fixed-size blocks, when the
+// ring is full the oldest block is appended to the spill file, so that a
+// chatty job holds at most memory::ring_size in memory per stream. The
+// blocks are recycled, rather than growing a buffer by copying.
+const outputBlockSize = 32 << 10
+
+var outputBlockPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, outputBlockSize)
+		return &b
+	},
+}
+
+// Collect the output of a job, record when the job outputs last time, and
+// fan out the output to the subscribers. Guarded by the job's mu.
+type outputWriter struct {
+	job    *Job
+	stream string
+
+	// The most recent output, the last block is being filled
+	blocks     []*[]byte
+	ringBlocks int
+	memSize    int64
+	// The older output, appended to the file at path
+	path      string
+	file      *os.File
+	spillSize int64
+	spillErr  error
+	// The blocks are sealed in the file by the storage key
+	sealed bool
+	// After the job finishes, the blocks are compacted into one slice, which
+	// doesn't come from the pool
+	compacted bool
+}
+
+func newOutputWriter(job *Job, stream string) *outputWriter {
+	ringBlocks := gApp.Cnf.MemoryRingSize << 10 / outputBlockSize
+	if ringBlocks < 1 {
+		ringBlocks = 1
+	}
+	return &outputWriter{
+		job:        job,
+		stream:     stream,
+		ringBlocks: ringBlocks,
+		path:       filepath.Join(gApp.Cnf.MemorySpillDir, job.Id+"."+stream),
+	}
+}
+
+func (o *outputWriter) Write(p []byte) (int, error) {
+	o.job.mu.Lock()
+	defer o.job.mu.Unlock()
+	now := time.Now()
+	o.job.recordLocked(JobEvent{Type: JEOutput, Time: now, Stream: o.stream, Size: int64(len(p))})
+	o.job.markLocked(o.stream, o.Len(), now)
+	if len(o.job.subscribers) > 0 {
+		o.job.publish(OutputChunk{Stream: o.stream, Offset: o.Len(), Time: now, Data: string(p)})
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		last := len(o.blocks) - 1
+		if last < 0 || len(*o.blocks[last]) == cap(*o.blocks[last]) {
+			if len(o.blocks) >= o.ringBlocks && o.spillErr == nil {
+				o.spill(1)
+			}
+			o.blocks = append(o.blocks, outputBlockPool.Get().(*[]byte))
+			last = len(o.blocks) - 1
+		}
+		b := o.blocks[last]
+		k := copy((*b)[len(*b):cap(*b)], p)
+		*b = (*b)[:len(*b)+k]
+		p = p[k:]
+	}
+	o.memSize += int64(n)
+	o.job.mem += int64(n)
+	gMemoryGuard.Add(int64(n))
+	return n, nil
+}
+
+// Append the oldest n blocks to the spill file. On failure the output is
+// kept in memory rather than lost.
+func (o *outputWriter) spill(n int) {
+	if o.file == nil {
+		err := os.MkdirAll(filepath.Dir(o.path), 0700)
+		if err == nil {
+			o.file, err = os.OpenFile(o.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			o.sealed = gStorageKey != nil
+		}
+		if err != nil {
+			log.Errorf("spill the %s of job %s failed: %s", o.stream, o.job.Id, err)
+			o.spillErr = err
+			return
+		}
+	}
+
+	var freed int64
+	for _, b := range o.blocks[:n] {
+		data := *b
+		if o.sealed {
+			data = sealRecord(data, filepath.Base(o.path))
+		}
+		if _, err := o.file.Write(data); err != nil {
+			log.Errorf("spill the %s of job %s failed: %s", o.stream, o.job.Id, err)
+			o.spillErr = err
+			break
+		}
+		freed += int64(len(*b))
+		o.putBlock(b)
+		o.blocks = o.blocks[1:]
+	}
+	o.spillSize += freed
+	o.memSize -= freed
+	o.job.mem -= freed
+	gMemoryGuard.Add(-freed)
+}
+
+// Move all the output in memory to the spill file
+func (o *outputWriter) spillAll() error {
+	if len(o.blocks) > 0 {
+		o.spill(len(o.blocks))
+	}
+	o.closeFile()
+	return o.spillErr
+}
+
+func (o *outputWriter) putBlock(b *[]byte) {
+	if !o.compacted {
+		*b = (*b)[:0]
+		outputBlockPool.Put(b)
+	}
+}
+
+func (o *outputWriter) closeFile() {
+	if o.file != nil {
+		o.file.Close()
+		o.file = nil
+	}
+}
+
+// Called when the job finishes, release the spare room of the blocks
+func (o *outputWriter) finish() {
+	o.closeFile()
+	if o.compacted {
+		return
+	}
+	var data []byte
+	if o.memSize > 0 {
+		data = make([]byte, 0, o.memSize)
+	}
+	for _, b := range o.blocks {
+		data = append(data, *b...)
+		o.putBlock(b)
+	}
+	o.blocks = nil
+	o.compacted = true
+	if len(data) > 0 {
+		o.blocks = []*[]byte{&data}
+	}
+}
+
+// Remove the spill file and free the memory
+func (o *outputWriter) release() {
+	o.closeFile()
+	if o.spillSize > 0 {
+		os.Remove(o.path)
+	}
+	for _, b := range o.blocks {
+		o.putBlock(b)
+	}
+	o.blocks = nil
+	o.job.mem -= o.memSize
+	gMemoryGuard.Add(-o.memSize)
+	o.memSize = 0
+}
+
+func (o *outputWriter) Len() int64 {
+	return o.spillSize + o.memSize
+}
+
+func (o *outputWriter) String() string {
+	var buf strings.Builder
+	buf.Grow(int(o.Len()))
+	if o.spillSize > 0 {
+		data, err := ioutil.ReadFile(o.path)
+		if err == nil && o.sealed {
+			data, err = openRecords(data, filepath.Base(o.path))
+		}
+		if err != nil {
+			log.Errorf("read the spilled %s of job %s failed: %s", o.stream, o.job.Id, err)
+		}
+		buf.Write(data)
+	}
+	for _, b := range o.blocks {
+		buf.Write(*b)
+	}
+	return buf.String()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The output of a job is marked with the time each piece is written, so that
+// it can be played back with its real timing, and the time a line printed is
+// known. The writes of a stream within outputMarkResolution share a mark.
+// Beyond outputMarkLimit marks per job, the later output is timed by the last
+// mark of its stream.
+const (
+	outputMarkResolution = 10 * time.Millisecond
+	outputMarkLimit      = 20000
+	// Bytes of a mark accounted by gMemoryGuard
+	outputMarkSize = 48
+)
+
+// The bytes of the stream from the offset up to the next mark of the stream
+// were written at the time
+type OutputMark struct {
+	Stream string
+	Offset int64
+	Time   time.Time
+}
+
+type OutputLine struct {
+	Stream string    `json:"stream"`
+	Line   int       `json:"line"` // Numbered from 1 in its stream
+	Time   time.Time `json:"time"` // When its first byte was written, zero if unknown
+	Text   string    `json:"text"` // Without the newline
+
+	// The offset of its stream past the text so far
+	end int64
+}
+
+type OutputTimesRes struct {
+	Id     string        `json:"id"`
+	Chunks []OutputChunk `json:"chunks,omitempty"`
+	Lines  []OutputLine  `json:"lines,omitempty"`
+}
+
+// Mark the output of the stream from the offset, called with mu held
+func (o *Job) markLocked(stream string, offset int64, t time.Time) {
+	n := len(o.marks)
+	if n >= outputMarkLimit {
+		return
+	}
+	if n > 0 {
+		last := o.marks[n-1]
+		if last.Stream == stream && t.Sub(last.Time) < outputMarkResolution {
+			return
+		}
+	}
+	o.marks = append(o.marks, OutputMark{Stream: stream, Offset: offset, Time: t})
+	o.mem += outputMarkSize
+	gMemoryGuard.Add(outputMarkSize)
+}
+
+// The output split at the marks, in the order written. The output without a
+// mark, e.g. of a job decoded from json, comes first without a time.
+func (o *Job) outputChunksLocked() []OutputChunk {
+	stdout, stderr := o.outputLocked()
+	data := map[string]string{"stdout": stdout, "stderr": stderr}
+
+	// The end of each mark, the offset of the next mark of its stream
+	ends := make([]int64, len(o.marks))
+	last := make(map[string]int)
+	for i, m := range o.marks {
+		if k, ok := last[m.Stream]; ok {
+			ends[k] = m.Offset
+		}
+		last[m.Stream] = i
+	}
+	for stream, k := range last {
+		ends[k] = int64(len(data[stream]))
+	}
+
+	var chunks []OutputChunk
+	for _, stream := range []string{"stdout", "stderr"} {
+		end := int64(len(data[stream]))
+		for _, m := range o.marks {
+			if m.Stream == stream && m.Offset < end {
+				end = m.Offset
+				break
+			}
+		}
+		if end > 0 {
+			chunks = append(chunks, OutputChunk{Stream: stream, Data: data[stream][:end]})
+		}
+	}
+	for i, m := range o.marks {
+		s := data[m.Stream]
+		end := ends[i]
+		if end > int64(len(s)) {
+			end = int64(len(s))
+		}
+		if m.Offset < end {
+			chunks = append(chunks, OutputChunk{Stream: m.Stream, Offset: m.Offset, Time: m.Time, Data: s[m.Offset:end]})
+		}
+	}
+	return chunks
+}
+
+// The offsets of the output a client has already got, checked against the
+// output of the job
+func outputOffsets(job *Job, stdout, stderr int64) (map[string]int64, error) {
+	outSize, errSize := job.OutputSize()
+	if stdout < 0 || stderr < 0 || stdout > int64(outSize) || stderr > int64(errSize) {
+		return nil, fmt.Errorf("offsets %d,%d past the output of %d,%d bytes", stdout, stderr, outSize, errSize)
+	}
+	return map[string]int64{"stdout": stdout, "stderr": stderr}, nil
+}
+
+// The part of the chunk past the offset of its stream, which a resuming
+// client has received already. False if it has received all of the chunk.
+func chunkAfter(chunk OutputChunk, offsets map[string]int64) (OutputChunk, bool) {
+	skip := offsets[chunk.Stream] - chunk.Offset
+	if skip <= 0 {
+		return chunk, true
+	}
+	if skip >= int64(len(chunk.Data)) {
+		return chunk, false
+	}
+	chunk.Data = chunk.Data[skip:]
+	chunk.Offset += skip
+	return chunk, true
+}
+
+// The output of the job in chunks as written
+func (o *Job) OutputChunks() []OutputChunk {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.outputChunksLocked()
+}
+
+// Split the chunks into lines, in the order the lines started. A line is
+// timed by the chunk of its first byte.
+func timedLines(chunks []OutputChunk) []OutputLine {
+	var lines []OutputLine
+	// The line being written of each stream, an index of lines
+	open := make(map[string]int)
+	count := make(map[string]int)
+	for _, c := range chunks {
+		data := c.Data
+		for data != "" {
+			text := data
+			i := strings.IndexByte(data, '\n')
+			if i >= 0 {
+				text, data = data[:i], data[i+1:]
+			} else {
+				data = ""
+			}
+			if k, ok := open[c.Stream]; ok {
+				lines[k].Text += text
+			} else {
+				count[c.Stream]++
+				lines = append(lines, OutputLine{Stream: c.Stream, Line: count[c.Stream], Time: c.Time, Text: text})
+				open[c.Stream] = len(lines) - 1
+			}
+			if i >= 0 {
+				delete(open, c.Stream)
+			}
+		}
+	}
+	return lines
+}
+
+// Stream the chunks as ndjson with the pauses between them as written,
+// divided by speed and capped to maxGap
+func playOutput(w http.ResponseWriter, r *http.Request, chunks []OutputChunk, speed float64, maxGap time.Duration) {
+	w.Header().Set(ContentType, NdjsonContentType)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	var prev time.Time
+	for _, c := range chunks {
+		if !prev.IsZero() && !c.Time.IsZero() {
+			gap := time.Duration(float64(c.Time.Sub(prev)) / speed)
+			if gap > maxGap {
+				gap = maxGap
+			}
+			if gap > 0 {
+				select {
+				case <-time.After(gap):
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+		if !c.Time.IsZero() {
+			prev = c.Time
+		}
+		if err := enc.Encode(c); err != nil {
+			log.Debugf("play the output failed: %s", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// Handler showing the output of the job with the times it was written, in
+// chunks, or in lines with the param lines, or played back as ndjson with the
+// real timing with the param play
+func OutputCmdHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.FormValue("id"))
+	if id == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param id is empty"))
+		return
+	}
+	job := managedJob(id, RequestToken(r))
+	if job == nil && proxyForwarded(w, r, id) {
+		return
+	}
+	if job == nil {
+		ServeJSON(w, NewResponse().SetError(ECJobNotFound, "job not found: "+id))
+		return
+	}
+	stream := r.FormValue("stream")
+	if stream != "" && stream != "stdout" && stream != "stderr" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param stream must be stdout or stderr"))
+		return
+	}
+
+	chunks := job.OutputChunks()
+	if stream != "" {
+		filtered := chunks[:0]
+		for _, c := range chunks {
+			if c.Stream == stream {
+				filtered = append(filtered, c)
+			}
+		}
+		chunks = filtered
+	}
+
+	if r.FormValue("play") != "" {
+		speed := 1.0
+		if s := r.FormValue("speed"); s != "" {
+			var err error
+			if speed, err = strconv.ParseFloat(s, 64); err != nil || speed <= 0 {
+				ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param speed must be a positive number"))
+				return
+			}
+		}
+		maxGap := 5 * time.Second
+		if s := r.FormValue("max_gap"); s != "" {
+			secs, err := strconv.ParseFloat(s, 64)
+			if err != nil || secs < 0 {
+				ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param max_gap must be a non negative number"))
+				return
+			}
+			maxGap = time.Duration(secs * float64(time.Second))
+		}
+		playOutput(w, r, chunks, speed, maxGap)
+		return
+	}
+
+	res := &OutputTimesRes{Id: id}
+	if r.FormValue("lines") != "" {
+		res.Lines = timedLines(chunks)
+	} else {
+		res.Chunks = chunks
+	}
+	ServeJSON(w, NewResponse().SetData(res))
+}
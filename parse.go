@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// The stdout of a job with parse_as is parsed into rows when the process
+// exits, and attached to the job as parsed, so the consumers don't scrape
+// the common tabular outputs by regexps. The keys are the normalized column
+// headers, e.g. "Use%" becomes "use", the values are kept as strings. A
+// failing parse is reported by parse_error, it doesn't fail the job.
+
+type outputParser func(string) ([]map[string]string, error)
+
+var outputParsers = map[string]outputParser{
+	"df":       parseDf,
+	"ps":       parseTable,
+	"netstat":  parseNetstat,
+	"tasklist": parseTasklist,
+	"csv":      parseCsv,
+	"wmic":     parseCsv, // wmic ... /format:csv
+	"table":    parseTable,
+}
+
+var errNoHeader = errors.New("no header line")
+
+func validateParseAs(name string) error {
+	if _, ok := outputParsers[name]; name != "" && !ok {
+		return errors.New("invalid param parse_as: " + name)
+	}
+	return nil
+}
+
+// Parse the stdout of the job by its parse_as
+func parseJobOutput(job *Job) ([]map[string]string, string) {
+	parse := outputParsers[job.ParseAs]
+	if parse == nil {
+		return nil, ""
+	}
+	stdout, _ := job.Output()
+	rows, err := parse(stdout)
+	if err != nil {
+		return nil, err.Error()
+	}
+	if rows == nil {
+		rows = []map[string]string{}
+	}
+	return rows, ""
+}
+
+var nonAlnum = regexp.MustCompile(`[^a-z0-9]+`)
+
+// The key of a column header, e.g. "Mem Usage" becomes "mem_usage"
+func columnKey(header string) string {
+	return strings.Trim(nonAlnum.ReplaceAllString(strings.ToLower(header), "_"), "_")
+}
+
+// The non blank lines, without the carriage returns of windows
+func outputLines(s string) []string {
+	var lines []string
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimRight(l, "\r")
+		if strings.TrimSpace(l) != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// Columns separated by whitespace under a header line, the last column
+// takes the rest of the line, e.g. the command of ps
+func parseTable(s string) ([]map[string]string, error) {
+	lines := outputLines(s)
+	if len(lines) == 0 {
+		return nil, errNoHeader
+	}
+	var keys []string
+	for _, h := range strings.Fields(lines[0]) {
+		keys = append(keys, columnKey(h))
+	}
+	var rows []map[string]string
+	for _, l := range lines[1:] {
+		rows = append(rows, splitRow(keys, l))
+	}
+	return rows, nil
+}
+
+// Split the line by whitespace into the keys, the last takes the rest
+func splitRow(keys []string, line string) map[string]string {
+	row := make(map[string]string, len(keys))
+	rest := strings.TrimSpace(line)
+	for i, k := range keys {
+		if i == len(keys)-1 {
+			row[k] = rest
+			break
+		}
+		f := strings.Fields(rest)
+		if len(f) == 0 {
+			break
+		}
+		row[k] = f[0]
+		rest = strings.TrimSpace(rest[len(f[0]):])
+	}
+	return row
+}
+
+// df, where "Mounted on" is one column, the mount point may have spaces,
+// and a long filesystem may be wrapped to a line of its own
+func parseDf(s string) ([]map[string]string, error) {
+	lines := outputLines(s)
+	if len(lines) == 0 || !strings.Contains(lines[0], "Mounted on") {
+		return nil, errNoHeader
+	}
+	var keys []string
+	for _, h := range strings.Fields(strings.Replace(lines[0], "Mounted on", "Mounted_on", 1)) {
+		keys = append(keys, columnKey(h))
+	}
+	var rows []map[string]string
+	for i := 1; i < len(lines); i++ {
+		l := lines[i]
+		if len(strings.Fields(l)) == 1 && i+1 < len(lines) {
+			i++
+			l += " " + lines[i]
+		}
+		rows = append(rows, splitRow(keys, l))
+	}
+	return rows, nil
+}
+
+// netstat of linux or windows, only the internet sockets
+func parseNetstat(s string) ([]map[string]string, error) {
+	var rows []map[string]string
+	linux := strings.Contains(s, "Recv-Q")
+	for _, l := range outputLines(s) {
+		f := strings.Fields(l)
+		if len(f) == 0 {
+			continue
+		}
+		if strings.HasPrefix(l, "Active UNIX") {
+			break
+		}
+		proto := strings.ToLower(f[0])
+		if !strings.HasPrefix(proto, "tcp") && !strings.HasPrefix(proto, "udp") {
+			continue
+		}
+		row := map[string]string{"proto": f[0]}
+		if linux {
+			if len(f) < 5 {
+				continue
+			}
+			row["recv_q"], row["send_q"] = f[1], f[2]
+			f = f[2:]
+		}
+		if len(f) < 3 {
+			continue
+		}
+		row["local_address"], row["foreign_address"] = f[1], f[2]
+		f = f[3:]
+		// udp has no state
+		if len(f) > 0 && isSocketState(f[0]) {
+			row["state"] = f[0]
+			f = f[1:]
+		}
+		if len(f) > 0 {
+			if linux {
+				row["pid_program"] = strings.Join(f, " ")
+			} else {
+				row["pid"] = f[0]
+			}
+		}
+		rows = append(rows, row)
+	}
+	if rows == nil && !strings.Contains(s, "Proto") {
+		return nil, errNoHeader
+	}
+	return rows, nil
+}
+
+func isSocketState(s string) bool {
+	for _, c := range s {
+		if (c < 'A' || c > 'Z') && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return s != "" && s != "-"
+}
+
+// tasklist of windows, the table whose column widths are given by the
+// ==== line under the header, or /fo csv
+func parseTasklist(s string) ([]map[string]string, error) {
+	lines := outputLines(s)
+	if len(lines) > 0 && strings.HasPrefix(lines[0], `"`) {
+		return parseCsv(s)
+	}
+	if len(lines) < 2 || !strings.HasPrefix(lines[1], "=") {
+		return nil, errNoHeader
+	}
+	// The columns by the runs of =
+	var bounds [][2]int
+	sep := lines[1]
+	for i := 0; i < len(sep); {
+		if sep[i] != '=' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(sep) && sep[j] == '=' {
+			j++
+		}
+		bounds = append(bounds, [2]int{i, j})
+		i = j
+	}
+	keys := make([]string, len(bounds))
+	for i, b := range bounds {
+		keys[i] = columnKey(substr(lines[0], b[0], b[1]))
+	}
+	var rows []map[string]string
+	for _, l := range lines[2:] {
+		row := make(map[string]string, len(keys))
+		for i, b := range bounds {
+			end := b[1]
+			// The last column takes the rest
+			if i == len(bounds)-1 {
+				end = len(l)
+			}
+			row[keys[i]] = strings.TrimSpace(substr(l, b[0], end))
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func substr(s string, start, end int) string {
+	if start > len(s) {
+		return ""
+	}
+	if end > len(s) {
+		end = len(s)
+	}
+	return s[start:end]
+}
+
+// csv with a header line, like wmic /format:csv and tasklist /fo csv
+func parseCsv(s string) ([]map[string]string, error) {
+	r := csv.NewReader(strings.NewReader(strings.Join(outputLines(s), "\n")))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errNoHeader
+	}
+	keys := make([]string, len(records[0]))
+	for i, h := range records[0] {
+		keys[i] = columnKey(h)
+	}
+	var rows []map[string]string
+	for _, rec := range records[1:] {
+		row := make(map[string]string, len(keys))
+		for i, v := range rec {
+			if i < len(keys) {
+				row[keys[i]] = v
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
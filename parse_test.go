@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseOutput(t *testing.T) {
+	for _, c := range []struct {
+		parser string
+		out    string
+		want   string // The rows as json
+	}{
+		{"ps", "  PID TTY          TIME CMD\n    1 ?        00:00:02 /sbin/init splash\n  42 pts/0    00:00:00 bash\n",
+			`[{"cmd":"/sbin/init splash","pid":"1","time":"00:00:02","tty":"?"},{"cmd":"bash","pid":"42","time":"00:00:00","tty":"pts/0"}]`},
+		// The blank lines and the carriage returns are left out
+		{"table", "NAME  Mem Usage\r\n\r\nagent 12 MB\r\n", `[{"mem":"12","name":"agent","usage":"MB"}]`},
+		// The mount point with spaces, and the filesystem wrapped to a line of its own
+		{"df", "Filesystem     1K-blocks  Used Available Use% Mounted on\n/dev/sda1        1000   400       600  40% /mnt/my disk\n" +
+			"/dev/mapper/very-long-name\n                 2000  1000      1000  50% /\n",
+			`[{"1k_blocks":"1000","available":"600","filesystem":"/dev/sda1","mounted_on":"/mnt/my disk","use":"40%","used":"400"},` +
+				`{"1k_blocks":"2000","available":"1000","filesystem":"/dev/mapper/very-long-name","mounted_on":"/","use":"50%","used":"1000"}]`},
+		{"netstat", "Active Internet connections (servers and established)\n" +
+			"Proto Recv-Q Send-Q Local Address           Foreign Address         State       PID/Program name\n" +
+			"tcp        0      0 0.0.0.0:22              0.0.0.0:*               LISTEN      812/sshd: /usr/sbin\n" +
+			"udp        0      0 127.0.0.53:53           0.0.0.0:*                           -\n" +
+			"Active UNIX domain sockets (servers and established)\nunix  2      [ ACC ]     STREAM     LISTENING     1234\n",
+			`[{"foreign_address":"0.0.0.0:*","local_address":"0.0.0.0:22","pid_program":"812/sshd: /usr/sbin","proto":"tcp","recv_q":"0","send_q":"0","state":"LISTEN"},` +
+				`{"foreign_address":"0.0.0.0:*","local_address":"127.0.0.53:53","pid_program":"-","proto":"udp","recv_q":"0","send_q":"0"}]`},
+		{"netstat", "\r\nActive Connections\r\n\r\n  Proto  Local Address          Foreign Address        State           PID\r\n" +
+			"  TCP    0.0.0.0:135            0.0.0.0:0              LISTENING       948\r\n  UDP    0.0.0.0:500            *:*                                    4\r\n",
+			`[{"foreign_address":"0.0.0.0:0","local_address":"0.0.0.0:135","pid":"948","proto":"TCP","state":"LISTENING"},` +
+				`{"foreign_address":"*:*","local_address":"0.0.0.0:500","pid":"4","proto":"UDP"}]`},
+		{"netstat", "Active Internet connections (w/o servers)\nProto Recv-Q Send-Q Local Address Foreign Address State\n", `null`},
+		// The columns by the = runs, the last takes the rest
+		{"tasklist", "\r\nImage Name                     PID Session Name        Session#    Mem Usage\r\n" +
+			"========================= ======== ================ =========== ============\r\n" +
+			"System Idle Process              0 Services                   0          8 K\r\n" +
+			"svchost.exe                    948 Services                   0     25,132 K\r\n",
+			`[{"image_name":"System Idle Process","mem_usage":"8 K","pid":"0","session":"0","session_name":"Services"},` +
+				`{"image_name":"svchost.exe","mem_usage":"25,132 K","pid":"948","session":"0","session_name":"Services"}]`},
+		{"tasklist", "\"Image Name\",\"PID\"\r\n\"a b.exe\",\"4\"\r\n", `[{"image_name":"a b.exe","pid":"4"}]`},
+		{"wmic", "\r\nNode,Caption,FreeSpace\r\nHOST,C:,\"1,024\"\r\nHOST,D:\r\n",
+			`[{"caption":"C:","freespace":"1,024","node":"HOST"},{"caption":"D:","node":"HOST"}]`},
+		{"csv", "a\n", `null`},
+	} {
+		rows, err := outputParsers[c.parser](c.out)
+		got, _ := json.Marshal(rows)
+		if err != nil || string(got) != c.want {
+			t.Errorf("%s of %q: got %s, %v", c.parser, c.out, got, err)
+		}
+	}
+
+	for _, c := range []struct{ parser, out string }{
+		{"table", ""},
+		{"df", "Filesystem 1K-blocks\n"},
+		{"tasklist", "Image Name PID\nsvchost.exe 948\n"},
+		{"netstat", "nothing here\n"},
+		{"csv", "a,\"b\n"},
+	} {
+		if rows, err := outputParsers[c.parser](c.out); err == nil {
+			t.Errorf("%s of %q: got %v", c.parser, c.out, rows)
+		}
+	}
+	if validateParseAs("") != nil || validateParseAs("df") != nil || validateParseAs("xml") == nil {
+		t.Error("validateParseAs")
+	}
+}
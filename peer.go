@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A job whose target_tags this agent doesn't match is forwarded to a peer
+// agent of peers::urls that does, e.g. when the controller reaches only one
+// agent of a network segment. The tags of the peers are learned from their
+// /api/v1/version. The forwarded job keeps the peer's id, the query, cancel
+// and events of it are proxied to the peer. The requests to the peer carry
+// the tenant of the caller, so the job runs as the caller on the peer, and
+// only the tenant managing it may reach it there or here.
+
+// Set on the forwarded requests, a peer never forwards them again
+const forwardedHeader = "X-Shell-Agent-Forwarded"
+
+// The tenant a forwarded request is made for, and whether it is an admin. A
+// peer takes them only from an admin token.
+const (
+	tenantHeader      = "X-Shell-Agent-Tenant"
+	tenantAdminHeader = "X-Shell-Agent-Tenant-Admin"
+)
+
+var (
+	errTargetTags = errors.New("this agent doesn't match the target tags")
+	errNoPeer     = errors.New("no peer matches the target tags")
+	errOnBehalf   = errors.New("only an admin token forwards on behalf of a tenant")
+)
+
+type Peer struct {
+	Url      string    `json:"url"`
+	Tags     []string  `json:"tags"`
+	LastSeen time.Time `json:"last_seen"`
+	Error    string    `json:"error,omitempty"` // Of the last refresh
+}
+
+// A job forwarded to a peer
+type forwardedJob struct {
+	peer   string
+	tenant string
+	time   time.Time
+}
+
+type PeerRegistry struct {
+	token   string
+	refresh time.Duration
+	client  *http.Client
+
+	peers []*Peer
+	// Peer urls by the ids of the forwarded jobs
+	forwards map[string]*forwardedJob
+	sync.RWMutex
+
+	quitC  chan struct{}
+	cancel context.CancelFunc
+}
+
+var (
+	gPeerRegistry *PeerRegistry
+)
+
+func init() {
+	gHttpServer.AddToInit(InitPeerRegistry)
+	gHttpServer.AddToUninit(UninitPeerRegistry)
+}
+
+func InitPeerRegistry() error {
+	if len(gApp.Cnf.PeerUrls) == 0 {
+		return nil
+	}
+	gPeerRegistry = NewPeerRegistry(gApp.Cnf.PeerUrls, gApp.Cnf.PeerToken,
+		time.Duration(gApp.Cnf.PeerRefreshInterval)*time.Second)
+	return nil
+}
+
+func UninitPeerRegistry() {
+	if gPeerRegistry != nil {
+		gPeerRegistry.Close()
+		gPeerRegistry = nil
+	}
+}
+
+func NewPeerRegistry(urls []string, token string, refresh time.Duration) *PeerRegistry {
+	if refresh <= 0 {
+		refresh = time.Minute
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &PeerRegistry{
+		token:    token,
+		refresh:  refresh,
+		client:   NewOutboundClient(0),
+		forwards: make(map[string]*forwardedJob),
+		quitC:    make(chan struct{}),
+		cancel:   cancel,
+	}
+	for _, u := range urls {
+		o.peers = append(o.peers, &Peer{Url: strings.TrimRight(u, "/")})
+	}
+	go o.loop(ctx)
+	return o
+}
+
+func (o *PeerRegistry) Close() error {
+	o.cancel()
+	<-o.quitC
+	return nil
+}
+
+func (o *PeerRegistry) loop(ctx context.Context) {
+	defer close(o.quitC)
+	ticker := time.NewTicker(o.refresh)
+	defer ticker.Stop()
+	for {
+		o.refreshTags(ctx)
+		o.expire()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Learn the tags of the peers
+func (o *PeerRegistry) refreshTags(ctx context.Context) {
+	o.RLock()
+	peers := append([]*Peer{}, o.peers...)
+	o.RUnlock()
+
+	for _, p := range peers {
+		var res struct {
+			Errno ErrorCode   `json:"errno"`
+			Error string      `json:"error"`
+			Data  *VersionRes `json:"data"`
+		}
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		err := o.call(ctx, http.MethodGet, p.Url+apiUrlPrefix+"/version", nil, nil, &res)
+		cancel()
+		if err == nil && (res.Errno != ECSuccess || res.Data == nil) {
+			err = errors.New(res.Error)
+		}
+
+		o.Lock()
+		if err != nil {
+			log.Warnf("refresh peer %s failed: %s", p.Url, err)
+			p.Error = err.Error()
+		} else {
+			p.Tags, p.LastSeen, p.Error = res.Data.Tags, time.Now(), ""
+		}
+		o.Unlock()
+	}
+}
+
+// Forget the forwarded jobs after expire_days like the local ones
+func (o *PeerRegistry) expire() {
+	o.Lock()
+	defer o.Unlock()
+	for id, f := range o.forwards {
+		if time.Since(f.time) > time.Duration(gApp.Cnf.ExpireDays)*24*time.Hour {
+			delete(o.forwards, id)
+		}
+	}
+}
+
+func (o *PeerRegistry) call(ctx context.Context, method, url string, body []byte, tok *Token, v interface{}) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := o.do(req.WithContext(ctx), tok)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected http status: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Send the request for the caller's token, nil means the agent itself
+func (o *PeerRegistry) do(req *http.Request, tok *Token) (*http.Response, error) {
+	if o.token != "" {
+		req.Header.Set("Authorization", "Bearer "+o.token)
+	}
+	req.Header.Set(forwardedHeader, "1")
+	if tok != nil {
+		req.Header.Set(tenantHeader, tok.Name)
+		if tok.Admin {
+			req.Header.Set(tenantAdminHeader, "1")
+		}
+	}
+	return o.client.Do(req)
+}
+
+func (o *PeerRegistry) Peers() []Peer {
+	o.RLock()
+	defer o.RUnlock()
+	peers := make([]Peer, 0, len(o.peers))
+	for _, p := range o.peers {
+		peers = append(peers, *p)
+	}
+	return peers
+}
+
+// The first reachable peer having all the tags, empty if none
+func (o *PeerRegistry) Find(tags []string) string {
+	o.RLock()
+	defer o.RUnlock()
+	for _, p := range o.peers {
+		if p.Error == "" && !p.LastSeen.IsZero() && matchTags(p.Tags, tags) {
+			return p.Url
+		}
+	}
+	return ""
+}
+
+// The forwarded job, nil if not forwarded
+func (o *PeerRegistry) Forwarded(id string) *forwardedJob {
+	o.RLock()
+	defer o.RUnlock()
+	return o.forwards[id]
+}
+
+func (o *PeerRegistry) remember(id, peer, tenant string) {
+	o.Lock()
+	defer o.Unlock()
+	o.forwards[id] = &forwardedJob{peer: peer, tenant: tenant, time: time.Now()}
+}
+
+// Whether have includes all of want. The tags are hierarchical by /, a tag
+// includes its ancestors, e.g. eu/fr/paris includes eu/fr and eu.
+func matchTags(have, want []string) bool {
+	have = expandTags(have)
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if strings.EqualFold(h, strings.Trim(w, "/")) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// The tags with their ancestors, each ancestor before its descendants, e.g.
+// eu/fr and web give eu, eu/fr and web
+func expandTags(tags []string) []string {
+	var res []string
+	seen := make(map[string]bool)
+	for _, t := range tags {
+		segs := strings.Split(strings.Trim(t, "/"), "/")
+		for i := range segs {
+			a := strings.Join(segs[:i+1], "/")
+			if a != "" && !seen[strings.ToLower(a)] {
+				seen[strings.ToLower(a)] = true
+				res = append(res, a)
+			}
+		}
+	}
+	return res
+}
+
+// The tags of both, without duplicates
+func mergeTags(a, b []string) []string {
+	res := append([]string{}, a...)
+	for _, t := range b {
+		found := false
+		for _, x := range a {
+			found = found || strings.EqualFold(x, t)
+		}
+		if !found {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// Forward the run request to a peer matching its target tags, the response
+// of the peer is relayed as it is. A forwarded request isn't forwarded again.
+func forwardRun(w http.ResponseWriter, r *http.Request, req *RunCmdReq) {
+	if gPeerRegistry == nil || r.Header.Get(forwardedHeader) != "" {
+		ServeJSON(w, NewResponse().SetError(ECNoPeer, errTargetTags.Error()))
+		return
+	}
+	peer := gPeerRegistry.Find(req.TargetTags)
+	if peer == "" {
+		ServeJSON(w, NewResponse().SetError(ECNoPeer, errNoPeer.Error()))
+		return
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	preq, err := http.NewRequest(http.MethodPost, peer+r.URL.Path, bytes.NewReader(b))
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	preq.Header.Set(ContentType, JsonContentType)
+	tok := RequestToken(r)
+	resp, err := gPeerRegistry.do(preq.WithContext(r.Context()), tok)
+	if err != nil {
+		log.Errorf("forward job to peer %s failed: %s", peer, err)
+		ServeJSON(w, NewResponse().SetError(ECPeerFailed, "forward to peer failed: "+err.Error()))
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Errorf("forward job to peer %s failed: %s", peer, err)
+		ServeJSON(w, NewResponse().SetError(ECPeerFailed, "forward to peer failed: "+err.Error()))
+		return
+	}
+
+	// Remember the peer of the job, the raw response carries the id in the
+	// X-Job-Id header
+	id := resp.Header.Get("X-Job-Id")
+	if id == "" {
+		var res struct {
+			Data struct {
+				Id string `json:"id"`
+			} `json:"data"`
+		}
+		json.Unmarshal(body, &res)
+		id = res.Data.Id
+	}
+	if id != "" {
+		gPeerRegistry.remember(id, peer, tokenTenant(tok))
+		log.Infof("job %s forwarded to peer %s, target tags: %v", id, peer, req.TargetTags)
+	}
+	relayResponse(w, resp, body, peer)
+}
+
+// Proxy the request about a job forwarded to a peer, false if the job isn't
+// forwarded. The jobs the token doesn't manage are not found, like the local
+// ones.
+func proxyForwarded(w http.ResponseWriter, r *http.Request, id string) bool {
+	if gPeerRegistry == nil {
+		return false
+	}
+	f := gPeerRegistry.Forwarded(id)
+	if f == nil {
+		return false
+	}
+	tok := RequestToken(r)
+	if tok != nil && !tok.Admin && f.tenant != tok.Name {
+		ServeJSON(w, NewResponse().SetError(ECJobNotFound, "job not found: "+id))
+		return true
+	}
+	peer := f.peer
+	preq, err := http.NewRequest(r.Method, peer+r.URL.RequestURI(), nil)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return true
+	}
+	for _, h := range []string{"If-None-Match", "Accept"} {
+		if v := r.Header.Get(h); v != "" {
+			preq.Header.Set(h, v)
+		}
+	}
+	resp, err := gPeerRegistry.do(preq.WithContext(r.Context()), tok)
+	if err != nil {
+		log.Errorf("proxy job %s to peer %s failed: %s", id, peer, err)
+		ServeJSON(w, NewResponse().SetError(ECPeerFailed, "proxy to peer failed: "+err.Error()))
+		return true
+	}
+	defer resp.Body.Close()
+	relayResponse(w, resp, nil, peer)
+	return true
+}
+
+// Copy the peer's response, body is read from resp if nil
+func relayResponse(w http.ResponseWriter, resp *http.Response, body []byte, peer string) {
+	for _, h := range []string{ContentType, "ETag", "X-Job-Id", "X-Job-Status", "X-Job-Exit-Code", "X-Job-Error"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.Header().Set("X-Forwarded-To", peer)
+	w.WriteHeader(resp.StatusCode)
+	if body != nil {
+		w.Write(body)
+	} else {
+		io.Copy(w, resp.Body)
+	}
+}
+
+// Handler to list the peers and their tags
+func ListPeersHandler(w http.ResponseWriter, r *http.Request) {
+	if gPeerRegistry == nil {
+		ServeJSON(w, NewResponse().SetData([]Peer{}))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(gPeerRegistry.Peers()))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A job forwarded for a tenant runs as it on the peer, and is reachable by it
+// only
+func TestForwardedJobTenant(t *testing.T) {
+	setupJobs(t)
+	var tenants []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenants = append(tenants, r.Header.Get(tenantHeader))
+		ServeJSON(w, NewResponse().SetData(&AsyncRuncmdRes{Id: "peer-job"}))
+	}))
+	defer srv.Close()
+	gPeerRegistry = &PeerRegistry{
+		token:    "peer",
+		client:   srv.Client(),
+		peers:    []*Peer{{Url: srv.URL, Tags: []string{"dc2"}, LastSeen: time.Now()}},
+		forwards: make(map[string]*forwardedJob),
+	}
+	defer func() { gPeerRegistry = nil }()
+
+	alice, bob := &Token{Name: "alice"}, &Token{Name: "bob"}
+	request := func(tok *Token, handler http.HandlerFunc, method, url, body string) *Response {
+		w := httptest.NewRecorder()
+		handler(w, withToken(httptest.NewRequest(method, url, strings.NewReader(body)), tok))
+		var res Response
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: %s", err, w.Body)
+		}
+		return &res
+	}
+
+	res := request(alice, RunCmdHandler, "POST", "/api/v1/cmd/run", `{"cmd":"true", "async":true, "target_tags":["dc2"]}`)
+	if res.Errno != ECSuccess || len(tenants) != 1 || tenants[0] != "alice" {
+		t.Fatalf("got %d %s, tenants %v", res.Errno, res.Error, tenants)
+	}
+	for _, h := range []http.HandlerFunc{QueryCmdHandler, CancelCmdHandler, DeleteCmdHandler} {
+		if res := request(bob, h, "POST", "/api/v1/cmd/x?id=peer-job", ""); res.Errno != ECJobNotFound {
+			t.Fatalf("got %d %s", res.Errno, res.Error)
+		}
+	}
+	if len(tenants) != 1 {
+		t.Fatalf("proxied for bob: %v", tenants)
+	}
+	if res := request(alice, QueryCmdHandler, "GET", "/api/v1/cmd/query?id=peer-job", ""); res.Errno != ECSuccess || tenants[1] != "alice" {
+		t.Fatalf("got %d %s, tenants %v", res.Errno, res.Error, tenants)
+	}
+}
+
+// A peer takes the tenant of a forwarded request from an admin token only
+func TestForwardedTenantAuth(t *testing.T) {
+	setupJobs(t)
+	gApp.Cnf.AuthAdminToken = "admin"
+	gTokenStore, _ = NewTokenStore(t.TempDir() + "/tokens.json")
+	defer func() { gTokenStore = nil }()
+	value, _, err := gTokenStore.Create("peer", false, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *Token
+	next := func(w http.ResponseWriter, r *http.Request) { got = RequestToken(r) }
+	for _, c := range []struct {
+		value  string
+		status int
+		name   string
+	}{
+		{"admin", http.StatusOK, "alice"},
+		{value, http.StatusForbidden, ""},
+	} {
+		got = nil
+		r := httptest.NewRequest("GET", "/api/v1/cmd/list", nil)
+		r.Header.Set("Authorization", "Bearer "+c.value)
+		r.Header.Set(forwardedHeader, "1")
+		r.Header.Set(tenantHeader, "alice")
+		w := httptest.NewRecorder()
+		AuthMiddleware(w, r, next)
+		if w.Code != c.status || (c.name != "" && (got == nil || got.Name != c.name || got.Admin)) {
+			t.Errorf("%s: got %d %+v", c.value, w.Code, got)
+		}
+	}
+}
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The agent downloads the central policy bundles selected by its tags from
+// policy::url every policy::interval seconds, and enforces them. The bundles
+// are "default" and one per tag and per ancestor of a hierarchical tag, e.g.
+// the tags eu/fr and web select
+//
+//	<url>/default.json, <url>/eu.json, <url>/eu/fr.json, <url>/web.json
+//
+// applied in this order, so the more specific ones inherit from and override
+// the more general ones. A missing bundle (404) is skipped. The bundles are
+// applied all at once only if all were fetched, and kept in policy::dir, so
+// the last policy is enforced across restarts while the url is unreachable.
+//
+// With policy::public_key, each bundle must be signed by the ed25519 key, the
+// base64 encoded signature of the bundle file is fetched from <bundle>.sig,
+// e.g. <url>/eu/fr.json.sig. A signed bundle carries its name and a version
+// increased by every change, so that neither a bundle of another name nor an
+// older one replayed is applied.
+//
+// A policy applied is reverted to the previous one if the http server isn't
+// healthy within apply::window seconds, and not applied again.
+
+// A bundle of the central policy
+type PolicyBundle struct {
+	// The name the bundle is signed for, required when signed
+	Name string `json:"name,omitempty"`
+	// Increased by every change, a bundle older than the applied one is refused
+	Version int64 `json:"version,omitempty"`
+	// Regexps of the cmds allowed to run, the jobs of other cmds are refused.
+	// Added to those of the parents.
+	Allowlist []string `json:"allowlist,omitempty"`
+	// Named defaults of the run requests, chosen by profile, e.g.
+	// {"db": {"run_as": "postgres", "dir": "/var/lib/pgsql"}}. Overriding
+	// those of the parents by name.
+	Profiles map[string]json.RawMessage `json:"profiles,omitempty"`
+	// Schedules run by the agent, overriding those of the parents by name
+	Schedules []*ScheduleReq `json:"schedules,omitempty"`
+	// Tokens of the api beside those of the agent, overriding those of the
+	// parents by name. Only taken from the signed bundles.
+	Tokens []*PolicyToken `json:"tokens,omitempty"`
+}
+
+// A token of the api given by the policy, only by the hash of its value
+type PolicyToken struct {
+	Name  string `json:"name"`
+	Admin bool   `json:"admin"`
+	Hash  string `json:"hash,omitempty"` // Hex encoded sha256 of the value
+}
+
+// The policy in effect, merged from the bundles
+type Policy struct {
+	Bundles   []string                   `json:"bundles"` // Applied, the most general first
+	Versions  map[string]int64           `json:"versions,omitempty"`
+	Version   string                     `json:"version"` // The versions of the bundles, e.g. default@3,eu@12
+	Signed    bool                       `json:"signed"`
+	ApplyTime time.Time                  `json:"apply_time"`
+	Allowlist []string                   `json:"allowlist,omitempty"`
+	Profiles  map[string]json.RawMessage `json:"profiles,omitempty"`
+	Schedules []*ScheduleReq             `json:"schedules,omitempty"`
+	Tokens    []*PolicyToken             `json:"tokens,omitempty"`
+
+	allow []*regexp.Regexp
+}
+
+type PolicyRes struct {
+	*Policy
+	LastFetch time.Time `json:"last_fetch"`
+	LastError string    `json:"last_error,omitempty"` // Of the last fetch, the policy is kept then
+}
+
+type PolicyManager struct {
+	url      string
+	token    string
+	key      ed25519.PublicKey // Verifying the bundles, nil means unsigned
+	dir      string
+	interval time.Duration
+	client   *http.Client
+
+	mu        sync.RWMutex
+	policy    *Policy
+	reverted  *Policy // Not applied again
+	lastFetch time.Time
+	lastError string
+
+	wg     sync.WaitGroup
+	cancel func()
+}
+
+const policyTenant = "policy"
+
+var (
+	gPolicy *PolicyManager
+
+	errCmdNotAllowed = errors.New("cmd not allowed by the policy")
+)
+
+func init() {
+	gHttpServer.AddToInit(InitPolicy)
+	gHttpServer.AddToStart(StartPolicy)
+	gHttpServer.AddToUninit(UninitPolicy)
+}
+
+func InitPolicy() error {
+	if gApp.Cnf.PolicyUrl == "" {
+		return nil
+	}
+	var key ed25519.PublicKey
+	if gApp.Cnf.PolicyPublicKey != "" {
+		b, err := base64.StdEncoding.DecodeString(gApp.Cnf.PolicyPublicKey)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			log.Errorf("invalid policy public key: %s", gApp.Cnf.PolicyPublicKey)
+			return errors.New("invalid policy public key")
+		}
+		key = b
+	}
+	gPolicy = NewPolicyManager(gApp.Cnf.PolicyUrl, gApp.Cnf.PolicyToken, gApp.Cnf.PolicyDir, gApp.Cnf.PolicyInterval, key)
+	gPolicy.restore()
+	return nil
+}
+
+// Fetch once the subsystems the policy applies to are up
+func StartPolicy() {
+	if gPolicy != nil {
+		gPolicy.start()
+	}
+}
+
+func UninitPolicy() {
+	if gPolicy != nil {
+		gPolicy.Close()
+		gPolicy = nil
+	}
+}
+
+func NewPolicyManager(url, token, dir string, interval int, key ed25519.PublicKey) *PolicyManager {
+	if interval <= 0 {
+		interval = 300
+	}
+	return &PolicyManager{
+		url:      strings.TrimRight(url, "/"),
+		token:    token,
+		key:      key,
+		dir:      dir,
+		interval: time.Duration(interval) * time.Second,
+		client:   NewOutboundClient(30 * time.Second),
+		cancel:   func() {},
+	}
+}
+
+func (o *PolicyManager) path() string {
+	return filepath.Join(o.dir, "policy.json")
+}
+
+// Enforce the policy kept by the last run
+func (o *PolicyManager) restore() {
+	b, err := ioutil.ReadFile(o.path())
+	if os.IsNotExist(err) {
+		return
+	}
+	var p Policy
+	if err == nil {
+		err = json.Unmarshal(b, &p)
+	}
+	if err == nil {
+		err = p.compile()
+	}
+	if err == nil && o.key != nil && !p.Signed {
+		err = errors.New("not signed")
+	}
+	if err != nil {
+		log.Errorf("restore policy from %s failed: %s", o.path(), err)
+		return
+	}
+	o.mu.Lock()
+	o.policy = &p
+	o.mu.Unlock()
+	log.Infof("policy restored, version: %s", p.Version)
+}
+
+func (o *PolicyManager) start() {
+	done := make(chan struct{})
+	o.cancel = func() { close(done) }
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+		ticker := time.NewTicker(o.interval)
+		defer ticker.Stop()
+		for {
+			o.Refresh()
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	log.Infof("policy fetched from %s every %s", o.url, o.interval)
+}
+
+func (o *PolicyManager) Close() {
+	o.cancel()
+	o.wg.Wait()
+}
+
+// Fetch the bundles selected by the tags of the agent and apply them
+func (o *PolicyManager) Refresh() error {
+	names := policyBundleNames(gApp.Cnf.AgentTags())
+	cur := o.Current()
+	p := &Policy{ApplyTime: time.Now(), Versions: make(map[string]int64), Signed: o.key != nil}
+	var versions []string
+	var err error
+	for _, name := range names {
+		var b *PolicyBundle
+		if b, err = o.fetch(name); err != nil {
+			err = fmt.Errorf("bundle %s: %s", name, err)
+			break
+		}
+		if b == nil {
+			continue
+		}
+		if cur != nil && b.Version < cur.Versions[name] {
+			err = fmt.Errorf("bundle %s: version %d older than the applied %d", name, b.Version, cur.Versions[name])
+			break
+		}
+		if len(b.Tokens) > 0 && o.key == nil {
+			err = fmt.Errorf("bundle %s: tokens are only taken from the signed bundles", name)
+			break
+		}
+		p.Bundles = append(p.Bundles, name)
+		p.Versions[name] = b.Version
+		versions = append(versions, fmt.Sprintf("%s@%d", name, b.Version))
+		p.merge(b)
+	}
+	p.Version = strings.Join(versions, ",")
+	if err == nil {
+		err = p.compile()
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lastFetch = p.ApplyTime
+	if err != nil {
+		log.Errorf("fetch policy failed, the current one is kept: %s", err)
+		o.lastError = err.Error()
+		return err
+	}
+	if o.reverted != nil && o.reverted.same(p) {
+		o.lastError = "policy " + p.Version + " was reverted, not applied again"
+		return errors.New(o.lastError)
+	}
+	o.lastError = ""
+	if o.policy != nil && o.policy.same(p) {
+		return nil
+	}
+	prev := o.policy
+	o.policy = p
+	o.save()
+	gSchedules.SyncPolicy(p.Schedules)
+	go o.verify(prev, p)
+	log.Infof("policy applied, version: %s, allowlist: %d, profiles: %d, schedules: %d, tokens: %d",
+		p.Version, len(p.Allowlist), len(p.Profiles), len(p.Schedules), len(p.Tokens))
+	return nil
+}
+
+// Revert to the previous policy if the server isn't healthy in time
+func (o *PolicyManager) verify(prev, p *Policy) {
+	err := waitHealthy(time.Now().Add(time.Duration(gApp.Cnf.ApplyWindow) * time.Second))
+	if err == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.policy != p {
+		return
+	}
+	o.policy, o.reverted = prev, p
+	var schedules []*ScheduleReq
+	if prev != nil {
+		schedules = prev.Schedules
+		o.save()
+	} else {
+		os.Remove(o.path())
+	}
+	gSchedules.SyncPolicy(schedules)
+	res := &PolicyRes{Policy: p.view(), LastFetch: o.lastFetch, LastError: "not healthy in time: " + err.Error()}
+	go raiseAlert("policy apply", "policy "+p.Version+" reverted: "+res.LastError, res)
+}
+
+// The bundle verified by the key if any, nil if not found
+func (o *PolicyManager) fetch(name string) (*PolicyBundle, error) {
+	segs := strings.Split(name, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	path := strings.Join(segs, "/") + ".json"
+	body, err := o.get(path)
+	if body == nil || err != nil {
+		return nil, err
+	}
+	if o.key != nil {
+		sig, err := o.get(path + ".sig")
+		if err != nil {
+			return nil, err
+		}
+		if sig == nil {
+			return nil, errors.New("not signed")
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+		if err != nil || !ed25519.Verify(o.key, body, b) {
+			return nil, errors.New("invalid signature")
+		}
+	}
+	var b PolicyBundle
+	if err = json.Unmarshal(body, &b); err != nil {
+		return nil, err
+	}
+	if o.key != nil && b.Name != name {
+		return nil, fmt.Errorf("signed for %q", b.Name)
+	}
+	return &b, nil
+}
+
+// The file under the url, nil if not found
+func (o *PolicyManager) get(path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, o.url+"/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if o.token != "" {
+		req.Header.Set("Authorization", "Bearer "+o.token)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected http status: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Called with mu held
+func (o *PolicyManager) save() {
+	b, err := json.MarshalIndent(o.policy, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(o.dir, 0700); err == nil {
+			err = writeFileAtomic(o.path(), b, 0600)
+		}
+	}
+	if err != nil {
+		log.Errorf("keep policy in %s failed: %s", o.path(), err)
+	}
+}
+
+// The policy in effect, nil if none
+func (o *PolicyManager) Current() *Policy {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.policy
+}
+
+// "default" then the tags with their ancestors, the most general first
+func policyBundleNames(tags []string) []string {
+	names := []string{"default"}
+	for _, t := range expandTags(tags) {
+		if !strings.EqualFold(t, "default") {
+			names = append(names, t)
+		}
+	}
+	return names
+}
+
+// Merge the more specific bundle
+func (o *Policy) merge(b *PolicyBundle) {
+	o.Allowlist = append(o.Allowlist, b.Allowlist...)
+	for name, p := range b.Profiles {
+		if o.Profiles == nil {
+			o.Profiles = make(map[string]json.RawMessage)
+		}
+		o.Profiles[name] = p
+	}
+	for _, s := range b.Schedules {
+		replaced := false
+		for i, x := range o.Schedules {
+			if x.Name == s.Name {
+				o.Schedules[i], replaced = s, true
+			}
+		}
+		if !replaced {
+			o.Schedules = append(o.Schedules, s)
+		}
+	}
+	for _, t := range b.Tokens {
+		replaced := false
+		for i, x := range o.Tokens {
+			if x.Name == t.Name {
+				o.Tokens[i], replaced = t, true
+			}
+		}
+		if !replaced {
+			o.Tokens = append(o.Tokens, t)
+		}
+	}
+}
+
+// Validate the policy and compile its allowlist
+func (o *Policy) compile() error {
+	o.allow = nil
+	for _, s := range o.Allowlist {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("invalid allowlist %q: %s", s, err)
+		}
+		o.allow = append(o.allow, re)
+	}
+	for name, p := range o.Profiles {
+		var req RunCmdReq
+		if err := json.Unmarshal(p, &req); err != nil {
+			return fmt.Errorf("invalid profile %s: %s", name, err)
+		}
+	}
+	for _, s := range o.Schedules {
+		if s.Name == "" {
+			return errors.New("a schedule has no name")
+		}
+		if s.Req == nil {
+			return fmt.Errorf("schedule %s has no req", s.Name)
+		}
+		s.Req.Async = true
+		if err := s.Req.validate(); err != nil {
+			return fmt.Errorf("invalid schedule %s: %s", s.Name, err)
+		}
+		if _, err := parseCronIn(s.Cron, s.Tz); err != nil {
+			return fmt.Errorf("invalid schedule %s: %s", s.Name, err)
+		}
+	}
+	for _, t := range o.Tokens {
+		if b, err := hex.DecodeString(t.Hash); err != nil || len(b) != 32 || t.Name == "" {
+			return fmt.Errorf("invalid token %q, a name and the hex sha256 of the value are required", t.Name)
+		}
+	}
+	return nil
+}
+
+// Whether the policies enforce the same
+func (o *Policy) same(p *Policy) bool {
+	return o.Version == p.Version && o.Signed == p.Signed && reflect.DeepEqual(o.Allowlist, p.Allowlist) &&
+		reflect.DeepEqual(o.Profiles, p.Profiles) && reflect.DeepEqual(o.Schedules, p.Schedules) &&
+		reflect.DeepEqual(o.Tokens, p.Tokens)
+}
+
+// The version of the policy in effect, empty if none
+func (o *PolicyManager) Version() string {
+	if p := o.Current(); p != nil {
+		return p.Version
+	}
+	return ""
+}
+
+// Whether the policy in effect gives tokens, which enable the authentication
+func (o *PolicyManager) HasTokens() bool {
+	if o == nil {
+		return false
+	}
+	p := o.Current()
+	return p != nil && len(p.Tokens) > 0
+}
+
+// The token of the policy having the value, nil if none
+func (o *PolicyManager) Authenticate(value string) *Token {
+	p := o.Current()
+	if p == nil {
+		return nil
+	}
+	hash := hashTokenValue(value)
+	for _, t := range p.Tokens {
+		if hashEqual(strings.ToLower(t.Hash), hash) {
+			return &Token{Id: policyTenant + ":" + t.Name, Name: t.Name, Admin: t.Admin}
+		}
+	}
+	return nil
+}
+
+// Refuse the request if its cmd or script, or its rollback cmd, is not
+// allowlisted by the policy
+func checkPolicyCmd(req *RunCmdReq) error {
+	cmd := req.Cmd
+	if req.Script != "" {
+		cmd = req.Script
+	}
+	if !policyAllows(cmd) || (req.Rollback != "" && !policyAllows(req.Rollback)) {
+		return errCmdNotAllowed
+	}
+	return nil
+}
+
+// Whether the cmd matches the allowlist of the policy, any cmd does if the
+// allowlist is empty
+func policyAllows(cmd string) bool {
+	if gPolicy == nil {
+		return true
+	}
+	p := gPolicy.Current()
+	if p == nil || len(p.allow) == 0 {
+		return true
+	}
+	for _, re := range p.allow {
+		if re.MatchString(cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decode the run request over its profile, so the fields it gives win
+func decodeRunCmdReq(body []byte, req *RunCmdReq) error {
+	if err := json.Unmarshal(body, req); err != nil || req.Profile == "" {
+		return err
+	}
+	profile := lookupProfile(req.Profile)
+	if profile == nil {
+		return errors.New("profile not found: " + req.Profile)
+	}
+	name := req.Profile
+	*req = RunCmdReq{}
+	if err := json.Unmarshal(profile, req); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, req); err != nil {
+		return err
+	}
+	req.Profile = name
+	return nil
+}
+
+// Handler showing the policy in effect
+func PolicyHandler(w http.ResponseWriter, r *http.Request) {
+	if gPolicy == nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "policy is disabled"))
+		return
+	}
+	if r.FormValue("refresh") == "1" {
+		if err := gPolicy.Refresh(); err != nil {
+			ServeJSON(w, NewResponse().SetError(ECFetchFailed, err.Error()))
+			return
+		}
+	}
+	ServeJSON(w, NewResponse().SetData(gPolicy.res()))
+}
+
+func (o *PolicyManager) res() *PolicyRes {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	res := &PolicyRes{LastFetch: o.lastFetch, LastError: o.lastError}
+	if o.policy != nil {
+		res.Policy = o.policy.view()
+	}
+	return res
+}
+
+// A copy of the policy without the hashes of the tokens
+func (o *Policy) view() *Policy {
+	p := *o
+	p.Tokens = nil
+	for _, t := range o.Tokens {
+		p.Tokens = append(p.Tokens, &PolicyToken{Name: t.Name, Admin: t.Admin})
+	}
+	return &p
+}
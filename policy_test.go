@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestCheckPolicyCmd(t *testing.T) {
+	p := &Policy{Allowlist: []string{"^systemctl status "}}
+	if err := p.compile(); err != nil {
+		t.Fatal(err)
+	}
+	gPolicy = &PolicyManager{policy: p}
+	defer func() { gPolicy = nil }()
+
+	for _, c := range []struct {
+		req *RunCmdReq
+		ok  bool
+	}{
+		{&RunCmdReq{Cmd: "systemctl status nginx"}, true},
+		{&RunCmdReq{Cmd: "rm -rf /"}, false},
+		{&RunCmdReq{Script: "systemctl status nginx\n"}, true},
+		{&RunCmdReq{Cmd: "systemctl status nginx", Rollback: "systemctl status nginx"}, true},
+		// An allowed cmd can't bring in any rollback
+		{&RunCmdReq{Cmd: "systemctl status nginx", Rollback: "rm -rf /"}, false},
+	} {
+		if err := checkPolicyCmd(c.req); (err == nil) != c.ok {
+			t.Errorf("cmd %q rollback %q: got %v", c.req.Cmd+c.req.Script, c.req.Rollback, err)
+		}
+	}
+	if policyAllows("crontab -r") {
+		t.Error("crontab -r allowed")
+	}
+}
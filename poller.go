@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// In the pull mode, the agent long-polls the controller for pending jobs,
+// and posts the results back, so that only outbound connections are needed.
+//
+//   GET  <url>/jobs/pending?agent_id=<id>&wait=<seconds>
+//        200 {"jobs":[{"ref":"<controller's job ref>", "req":{<RunCmdReq>}}]}, or 204 if none
+//   POST <url>/jobs/result
+//        {"agent_id":"<id>", "ref":"<controller's job ref>", "job":{<Job>}}
+//        or with "errno" and a failed job without id if it is refused
+//
+// and the heartbeats of heartbeat.go
+
+type PendingJob struct {
+	Ref string          `json:"ref"`
+	Req json.RawMessage `json:"req"` // A RunCmdReq, of a profile too
+}
+
+type PendingJobsRes struct {
+	Jobs []PendingJob `json:"jobs"`
+}
+
+type JobResultReq struct {
+	AgentId string    `json:"agent_id"`
+	Ref     string    `json:"ref"`
+	Job     *Job      `json:"job"`
+	Errno   ErrorCode `json:"errno,omitempty"` // Why the job is refused, it never ran then
+}
+
+type ControllerPoller struct {
+	url     string
+	token   string
+	agentId string
+	wait    int
+	client  *http.Client
+
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+}
+
+var (
+	gControllerPoller *ControllerPoller
+)
+
+func init() {
+	gHttpServer.AddToInit(InitControllerPoller)
+	gHttpServer.AddToUninit(UninitControllerPoller)
+}
+
+func InitControllerPoller() error {
+	if gApp.Cnf.ControllerUrl == "" {
+		return nil
+	}
+	gControllerPoller = NewControllerPoller(gApp.Cnf.ControllerUrl, gApp.Cnf.ControllerToken,
+		gApp.Cnf.ControllerAgentId, gApp.Cnf.ControllerPollTimeout, gApp.Cnf.ControllerHeartbeat)
+	return nil
+}
+
+func UninitControllerPoller() {
+	if gControllerPoller != nil {
+		gControllerPoller.Close()
+		gControllerPoller = nil
+	}
+}
+
+// A heartbeat is posted every heartbeat seconds, none if 0
+func NewControllerPoller(url, token, agentId string, wait, heartbeat int) *ControllerPoller {
+	if wait <= 0 {
+		wait = 30
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	o := ControllerPoller{
+		url:     url,
+		token:   token,
+		agentId: agentId,
+		wait:    wait,
+		// Leave the controller some time to answer the long poll
+		client: NewOutboundClient(time.Duration(wait+30) * time.Second),
+		cancel: cancel,
+	}
+	o.wg.Add(1)
+	go o.poll(ctx)
+	if heartbeat > 0 {
+		o.wg.Add(1)
+		go o.heartbeat(ctx, time.Duration(heartbeat)*time.Second)
+	}
+	log.Infof("polling jobs from controller: %s", url)
+	return &o
+}
+
+func (o *ControllerPoller) Close() error {
+	o.cancel()
+	o.wg.Wait()
+	return nil
+}
+
+func (o *ControllerPoller) poll(ctx context.Context) {
+	defer o.wg.Done()
+	backoff := time.Second
+	for {
+		// Leave the jobs pending on the controller until the memory is freed
+		if gMemoryGuard.Exceeded() {
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		jobs, err := o.fetch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("poll controller failed: %s", err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+
+		for i := range jobs {
+			o.run(ctx, &jobs[i])
+		}
+	}
+}
+
+func (o *ControllerPoller) fetch(ctx context.Context) ([]PendingJob, error) {
+	q := url.Values{}
+	q.Set("agent_id", o.agentId)
+	q.Set("wait", strconv.Itoa(o.wait))
+	req, err := http.NewRequest(http.MethodGet, o.url+"/jobs/pending?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected http status: %s", resp.Status)
+	}
+	var res PendingJobsRes
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return res.Jobs, nil
+}
+
+// Tenant of the jobs from the controller in the job pool
+const controllerTenant = "controller"
+
+// Run the job in background, and report the result when it finishes, also
+// after the poller is closed. A job refused is reported at once, so the
+// controller doesn't wait for it, and Close waits for the report.
+func (o *ControllerPoller) run(ctx context.Context, p *PendingJob) {
+	req, errno, err := checkRunCmdReq(p.Req, nil)
+	if err == nil {
+		var job *Job
+		if job, err = startJob(req, controllerTenant); err == nil {
+			log.Infof("controller job accepted, ref: %s, id: %s", p.Ref, job.Id)
+			go func() {
+				<-job.Done()
+				o.report(context.Background(), p.Ref, job, ECSuccess)
+			}()
+			return
+		}
+		errno = newJobErrno(err)
+	}
+	log.Errorf("controller job refused, ref: %s, %s", p.Ref, err)
+	now := time.Now()
+	refused := &Job{Status: JSFailed, Error: err.Error(), Tenant: controllerTenant, CreateTime: now, FinishTime: now}
+	if req != nil {
+		refused.Cmd = req.Cmd
+		if req.Script != "" {
+			refused.Cmd, refused.Script = req.Script, true
+		}
+	}
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+		o.report(ctx, p.Ref, refused, errno)
+	}()
+}
+
+func (o *ControllerPoller) report(ctx context.Context, ref string, job *Job, errno ErrorCode) {
+	b, err := json.Marshal(&JobResultReq{AgentId: o.agentId, Ref: ref, Job: job, Errno: errno})
+	if err != nil {
+		log.Errorf("Error occured when marshalling job: %s", err)
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(time.Duration(i) * time.Second):
+			case <-ctx.Done():
+				return
+			}
+		}
+		req, err := http.NewRequest(http.MethodPost, o.url+"/jobs/result", bytes.NewReader(b))
+		if err != nil {
+			log.Errorf("report job result failed: %s", err)
+			return
+		}
+		req.Header.Set(ContentType, JsonContentType)
+		resp, err := o.do(req.WithContext(ctx))
+		if err != nil {
+			log.Errorf("report job result failed, ref: %s, %s", ref, err)
+			continue
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			return
+		}
+		log.Errorf("report job result failed, ref: %s, unexpected http status: %s", ref, resp.Status)
+	}
+}
+
+func (o *ControllerPoller) do(req *http.Request) (*http.Response, error) {
+	if o.token != "" {
+		req.Header.Set("Authorization", "Bearer "+o.token)
+	}
+	resp, err := o.client.Do(req)
+	if err == nil {
+		// The Date is written when the response starts, a long poll included
+		gClock.observeDate(resp.Header.Get("Date"), time.Now(), "controller")
+	}
+	return resp, err
+}
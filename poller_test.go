@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A job refused by the agent is still reported to the controller
+func TestPollerReportsRefusedJob(t *testing.T) {
+	setupJobs(t)
+	resultC := make(chan JobResultReq, 1)
+	var once sync.Once
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/jobs/pending":
+			sent := false
+			once.Do(func() {
+				w.Write([]byte(`{"jobs":[{"ref":"r1", "req":{"cmd":"true", "timeout_seconds":-1}}]}`))
+				sent = true
+			})
+			if !sent {
+				w.WriteHeader(http.StatusNoContent)
+				time.Sleep(50 * time.Millisecond)
+			}
+		case "/jobs/result":
+			var res JobResultReq
+			if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+				t.Error(err)
+			}
+			resultC <- res
+		}
+	}))
+	defer srv.Close()
+
+	p := NewControllerPoller(srv.URL, "", "agent-1", 1, 0)
+	defer p.Close()
+	select {
+	case res := <-resultC:
+		if res.Ref != "r1" || res.Errno != ECInvalidParam || res.Job.Status != JSFailed || res.Job.Id != "" {
+			t.Fatalf("got ref %s, errno %d, status %s, id %q", res.Ref, res.Errno, res.Job.Status, res.Job.Id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no result reported")
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var errQueueFull = errors.New("job queue is full, try again later")
+
+// A fixed number of workers running the tasks of a bounded queue. When the
+// queue is contended, the tenants get the workers in proportion to their
+// weights, by start-time fair queueing: a task is tagged with the virtual
+// time it would start if each tenant had its share, and the smallest tag
+// runs first.
+type WorkerPool struct {
+	// Metrics, the 64 bit atomics come first to be aligned on 32 bit platforms
+	submitted int64
+	completed int64
+	rejected  int64
+	waitNanos int64 // Total time the tasks waited in the queue
+	busy      int32
+
+	name      string
+	size      int
+	queueSize int
+	weights   map[string]int
+
+	// Guard the queues, the workers wait on cond
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queues map[string]*tenantQueue
+	queued int
+	vtime  float64
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type poolTask struct {
+	run         func()
+	tenant      string
+	start       float64 // Virtual start time
+	enqueueTime time.Time
+}
+
+type tenantQueue struct {
+	tasks []*poolTask
+	// Virtual finish time of the last queued task
+	lastFinish float64
+}
+
+type PoolStats struct {
+	Name      string `json:"name"`
+	Size      int    `json:"size"`
+	Busy      int    `json:"busy"`
+	Queued    int    `json:"queued"`
+	QueueSize int    `json:"queue_size"`
+	Submitted int64  `json:"submitted"`
+	Completed int64  `json:"completed"`
+	Rejected  int64  `json:"rejected"`
+	// Average milliseconds the tasks waited in the queue
+	AvgWaitMs float64 `json:"avg_wait_ms"`
+	// Queued tasks by tenant
+	Tenants map[string]int `json:"tenants,omitempty"`
+	// Unfinished jobs by concurrency group, the running one included
+	Groups map[string]int `json:"groups,omitempty"`
+}
+
+var (
+	// Runs the jobs
+	gJobPool *WorkerPool
+	// Serializes the jobs of the same concurrency group
+	gConcurrencyGroups *ConcurrencyGroups
+)
+
+func init() {
+	gHttpServer.AddToInit(InitJobPool)
+	gHttpServer.AddToUninit(UninitJobPool)
+}
+
+func InitJobPool() error {
+	weights, err := parsePoolWeights(gApp.Cnf.PoolWeights)
+	if err != nil {
+		return err
+	}
+	// The running and the queued jobs go on across a restart by a config
+	// apply, a new size is taken at the next start
+	if gJobPool != nil && gHttpServer.Restarting() {
+		return nil
+	}
+	gJobPool = NewWorkerPool("jobs", gApp.Cnf.PoolSize, gApp.Cnf.PoolQueueSize, weights)
+	gConcurrencyGroups = NewConcurrencyGroups(gJobPool, gApp.Cnf.PoolQueueSize)
+	return nil
+}
+
+// Parse the <tenant>:<weight> of pool::weights
+func parsePoolWeights(list []string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, kv := range list {
+		parts := strings.SplitN(kv, ":", 2)
+		w, err := strconv.Atoi(strings.TrimSpace(parts[len(parts)-1]))
+		if len(parts) != 2 || err != nil || w <= 0 {
+			return nil, errors.New("invalid pool weight: " + kv)
+		}
+		weights[strings.TrimSpace(parts[0])] = w
+	}
+	return weights, nil
+}
+
+func UninitJobPool() {
+	if gHttpServer.Restarting() {
+		return
+	}
+	gJobPool.Close()
+}
+
+func NewWorkerPool(name string, size, queueSize int, weights map[string]int) *WorkerPool {
+	if size <= 0 {
+		size = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	o := &WorkerPool{
+		name:      name,
+		size:      size,
+		queueSize: queueSize,
+		weights:   weights,
+		queues:    make(map[string]*tenantQueue),
+	}
+	o.cond = sync.NewCond(&o.mu)
+	o.wg.Add(size)
+	for i := 0; i < size; i++ {
+		go o.work()
+	}
+	log.Infof("worker pool %s started, size: %d, queue size: %d", name, size, queueSize)
+	return o
+}
+
+// Stop the workers after their current tasks, the queued tasks are dropped
+func (o *WorkerPool) Close() {
+	o.mu.Lock()
+	o.closed = true
+	n := o.queued
+	o.mu.Unlock()
+	o.cond.Broadcast()
+	o.wg.Wait()
+	if n > 0 {
+		log.Warnf("worker pool %s closed, %d queued tasks dropped", o.name, n)
+	}
+}
+
+// Queue the task of the tenant, fail if the queue is full
+func (o *WorkerPool) Submit(tenant string, f func()) error {
+	return o.submit(tenant, f, true)
+}
+
+// Queue the task, beyond the queue size unless bounded
+func (o *WorkerPool) submit(tenant string, f func(), bounded bool) error {
+	o.mu.Lock()
+	if o.closed || (bounded && o.queued >= o.queueSize) {
+		o.mu.Unlock()
+		atomic.AddInt64(&o.rejected, 1)
+		return errQueueFull
+	}
+
+	q := o.queues[tenant]
+	if q == nil {
+		q = &tenantQueue{}
+		o.queues[tenant] = q
+	}
+	weight := o.weights[tenant]
+	if weight <= 0 {
+		weight = 1
+	}
+	t := &poolTask{run: f, tenant: tenant, start: q.lastFinish, enqueueTime: time.Now()}
+	if t.start < o.vtime {
+		t.start = o.vtime
+	}
+	q.lastFinish = t.start + 1/float64(weight)
+	q.tasks = append(q.tasks, t)
+	o.queued++
+	o.mu.Unlock()
+
+	atomic.AddInt64(&o.submitted, 1)
+	o.cond.Signal()
+	return nil
+}
+
+// Take the task with the smallest start tag, nil if the pool is closed
+func (o *WorkerPool) next() *poolTask {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for o.queued == 0 && !o.closed {
+		o.cond.Wait()
+	}
+	if o.closed {
+		return nil
+	}
+
+	var best *tenantQueue
+	for _, q := range o.queues {
+		if len(q.tasks) > 0 && (best == nil || q.tasks[0].start < best.tasks[0].start) {
+			best = q
+		}
+	}
+	t := best.tasks[0]
+	best.tasks[0] = nil
+	best.tasks = best.tasks[1:]
+	o.queued--
+	o.vtime = t.start
+
+	// Forget the idle tenants which have no share in advance
+	for tenant, q := range o.queues {
+		if len(q.tasks) == 0 && q.lastFinish <= o.vtime {
+			delete(o.queues, tenant)
+		}
+	}
+	return t
+}
+
+func (o *WorkerPool) work() {
+	defer o.wg.Done()
+	for {
+		t := o.next()
+		if t == nil {
+			return
+		}
+		atomic.AddInt64(&o.waitNanos, int64(time.Since(t.enqueueTime)))
+		atomic.AddInt32(&o.busy, 1)
+		o.runTask(t)
+		atomic.AddInt32(&o.busy, -1)
+		atomic.AddInt64(&o.completed, 1)
+	}
+}
+
+// A panicking task must not take the worker down
+func (o *WorkerPool) runTask(t *poolTask) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("PANIC in worker pool %s: %s", o.name, err)
+		}
+	}()
+	t.run()
+}
+
+func (o *WorkerPool) Stats() *PoolStats {
+	s := &PoolStats{
+		Name:      o.name,
+		Size:      o.size,
+		Busy:      int(atomic.LoadInt32(&o.busy)),
+		QueueSize: o.queueSize,
+		Submitted: atomic.LoadInt64(&o.submitted),
+		Completed: atomic.LoadInt64(&o.completed),
+		Rejected:  atomic.LoadInt64(&o.rejected),
+	}
+	o.mu.Lock()
+	s.Queued = o.queued
+	for tenant, q := range o.queues {
+		if len(q.tasks) > 0 {
+			if s.Tenants == nil {
+				s.Tenants = make(map[string]int)
+			}
+			s.Tenants[tenant] = len(q.tasks)
+		}
+	}
+	o.mu.Unlock()
+
+	if started := s.Submitted - int64(s.Queued); started > 0 {
+		s.AvgWaitMs = float64(atomic.LoadInt64(&o.waitNanos)) / float64(started) / float64(time.Millisecond)
+	}
+	return s
+}
+
+// The jobs of the same concurrency group run one at a time in the submission
+// order, even if other workers are free. Only the head of a group is in the
+// pool, the others wait here without holding a worker or a queue slot, and
+// are queued to the pool when the previous one finishes.
+type ConcurrencyGroups struct {
+	pool *WorkerPool
+	// Max tasks waiting in all the groups
+	limit int
+
+	mu      sync.Mutex
+	groups  map[string][]*poolTask
+	waiting int
+}
+
+func NewConcurrencyGroups(pool *WorkerPool, limit int) *ConcurrencyGroups {
+	return &ConcurrencyGroups{
+		pool:   pool,
+		limit:  limit,
+		groups: make(map[string][]*poolTask),
+	}
+}
+
+// Queue the task of the tenant to the pool if the group is idle, or after
+// the earlier tasks of the group
+func (o *ConcurrencyGroups) Submit(group, tenant string, f func()) error {
+	t := &poolTask{tenant: tenant}
+	t.run = func() {
+		defer o.done(group)
+		f()
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	q := o.groups[group]
+	if len(q) == 0 {
+		if err := o.pool.Submit(tenant, t.run); err != nil {
+			return err
+		}
+	} else {
+		if o.waiting >= o.limit {
+			atomic.AddInt64(&o.pool.rejected, 1)
+			return errQueueFull
+		}
+		o.waiting++
+	}
+	o.groups[group] = append(q, t)
+	return nil
+}
+
+// Queue the next task of the group when the head finishes
+func (o *ConcurrencyGroups) done(group string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	q := o.groups[group]
+	q[0] = nil
+	q = q[1:]
+	if len(q) == 0 {
+		delete(o.groups, group)
+		return
+	}
+	o.waiting--
+	// It has waited for its turn already, so the queue size doesn't apply
+	if err := o.pool.submit(q[0].tenant, q[0].run, false); err != nil {
+		log.Warnf("concurrency group %s closed, %d waiting tasks dropped", group, len(q))
+		o.waiting -= len(q) - 1
+		delete(o.groups, group)
+		return
+	}
+	o.groups[group] = q
+}
+
+// Unfinished tasks by group
+func (o *ConcurrencyGroups) Stats() map[string]int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.groups) == 0 {
+		return nil
+	}
+	res := make(map[string]int, len(o.groups))
+	for group, q := range o.groups {
+		res[group] = len(q)
+	}
+	return res
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// When the queue is contended, the tenants run in proportion to their weights
+func TestWorkerPoolFairQueueing(t *testing.T) {
+	pool := NewWorkerPool("test", 1, 100, map[string]int{"a": 3})
+	defer pool.Close()
+
+	// Hold the only worker while the tasks are queued
+	blockC := make(chan struct{})
+	startedC := make(chan struct{})
+	pool.Submit("x", func() {
+		close(startedC)
+		<-blockC
+	})
+	<-startedC
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		for _, tenant := range []string{"a", "b"} {
+			tenant := tenant
+			wg.Add(1)
+			if err := pool.Submit(tenant, func() {
+				mu.Lock()
+				order = append(order, tenant)
+				mu.Unlock()
+				wg.Done()
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(blockC)
+	wg.Wait()
+
+	// a of weight 3 gets 3 of every 4 runs until its tasks run out, the
+	// ties are in any order
+	n := 0
+	for _, s := range order[:8] {
+		if s == "a" {
+			n++
+		}
+	}
+	if n != 6 {
+		t.Fatalf("got order %v", order)
+	}
+}
+
+func TestWorkerPoolQueueFull(t *testing.T) {
+	pool := NewWorkerPool("test", 1, 1, nil)
+	defer pool.Close()
+	blockC := make(chan struct{})
+	defer close(blockC)
+	startedC := make(chan struct{})
+	pool.Submit("", func() {
+		close(startedC)
+		<-blockC
+	})
+	<-startedC
+	if err := pool.Submit("", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Submit("", func() {}); err != errQueueFull {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// A panicking task doesn't take the worker down
+func TestWorkerPoolPanic(t *testing.T) {
+	pool := NewWorkerPool("test", 1, 10, nil)
+	defer pool.Close()
+	pool.Submit("", func() { panic("boom") })
+	doneC := make(chan struct{})
+	pool.Submit("", func() { close(doneC) })
+	<-doneC
+}
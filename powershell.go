@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// A job with ps_objects runs its cmd in powershell with the objects of the
+// pipeline converted to json, and the json is attached to the job as
+// objects, so the object pipeline of powershell is exposed rather than its
+// formatted text. The objects are always an array, one element per object
+// written to the pipeline.
+
+const (
+	psDefaultDepth = 4
+	psMaxDepth     = 100
+)
+
+func (o *RunCmdReq) validatePsObjects() error {
+	if !o.PsObjects {
+		if o.PsDepth != 0 {
+			return errors.New("param ps_depth needs ps_objects")
+		}
+		return nil
+	}
+	if o.Script != "" {
+		return errors.New("param ps_objects and script are exclusive")
+	}
+	if o.ParseAs != "" {
+		return errors.New("param ps_objects and parse_as are exclusive")
+	}
+	if o.PsDepth < 0 || o.PsDepth > psMaxDepth {
+		return errors.New("param ps_depth must be in [0, " + strconv.Itoa(psMaxDepth) + "]")
+	}
+	return nil
+}
+
+// The args running the cmd of the job in powershell, converting the objects
+// of its pipeline to json. The shell of the config is used if powershell,
+// otherwise powershell on windows and pwsh elsewhere.
+func psObjectsArgs(job *Job) []string {
+	depth := job.PsDepth
+	if depth == 0 {
+		depth = psDefaultDepth
+	}
+	// @() so a single object or none is an array too
+	cmd := "$ProgressPreference = 'SilentlyContinue'\n" +
+		"ConvertTo-Json -Compress -Depth " + strconv.Itoa(depth) + " -InputObject @(& {\n" + job.Cmd + "\n})"
+	shell := gApp.Cnf.JobShell
+	if len(shell) > 0 && isPowerShell(shell[0]) {
+		return append(append([]string{}, shell...), cmd)
+	}
+	exe := "pwsh"
+	if runtime.GOOS == "windows" {
+		exe = "powershell"
+	}
+	return []string{exe, "-NoProfile", "-NonInteractive", "-Command", cmd}
+}
+
+// The objects of the stdout of the job, or why it is not json
+func psObjects(job *Job) (json.RawMessage, string) {
+	stdout, _ := job.Output()
+	b := []byte(strings.TrimPrefix(stdout, "\ufeff"))
+	if !json.Valid(b) {
+		return nil, "the stdout of ps_objects is not json"
+	}
+	return json.RawMessage(b), ""
+}
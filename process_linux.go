@@ -0,0 +1,151 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func processExists(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
+
+// Sum of utime and stime in /proc/<pid>/stat
+func processCpuTicks(pid int) (uint64, bool) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, false
+	}
+	// The command name may contain spaces, so skip to the closing parenthesis
+	s := string(b)
+	i := strings.LastIndexByte(s, ')')
+	if i < 0 {
+		return 0, false
+	}
+	fields := strings.Fields(s[i+1:])
+	// utime and stime are the 14th and 15th fields, state is the 3rd one
+	if len(fields) < 13 {
+		return 0, false
+	}
+	utime, err1 := strconv.ParseUint(fields[11], 10, 64)
+	stime, err2 := strconv.ParseUint(fields[12], 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, false
+	}
+	return utime + stime, true
+}
+
+// Run the command in its own process group, so that it can be killed with its children
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Kill the process and its children, which may hold the output pipes open
+func killProcessTree(cmd *exec.Cmd) error {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
+
+// Ask the process and its children to exit by SIGTERM
+func terminateProcessTree(cmd *exec.Cmd) error {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM); err != nil {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	return nil
+}
+
+// Wrap the command with runcon and aa-exec to apply the mandatory access control of the job,
+// and with the seccomp helper and the sandbox setup
+func confineArgs(job *Job, args []string) ([]string, error) {
+	if strings.HasPrefix(job.SELinuxContext, "-") || strings.HasPrefix(job.AppArmorProfile, "-") {
+		return nil, errors.New("invalid selinux_context or apparmor_profile")
+	}
+	// The filter is loaded innermost, it may deny the syscalls of the wrappers
+	args, err := seccompArgs(job, args)
+	if err != nil {
+		return nil, err
+	}
+	if job.AppArmorProfile != "" {
+		args = append([]string{"aa-exec", "-p", job.AppArmorProfile, "--"}, args...)
+	}
+	if job.SELinuxContext != "" {
+		args = append([]string{"runcon", job.SELinuxContext}, args...)
+	}
+	if job.Sandbox != nil {
+		return sandboxArgs(job.Sandbox, args)
+	}
+	return args, nil
+}
+
+// Prepend a script setting up the mounts of the sandbox, which runs in the
+// new mount namespace before the command.
+func sandboxArgs(sb *Sandbox, args []string) ([]string, error) {
+	script := []string{"set -e", "mount --make-rprivate /"}
+	if sb.NoNetwork {
+		script = append(script, "ip link set lo up 2>/dev/null || true")
+	}
+	if sb.PrivateTmp {
+		script = append(script, "mount -t tmpfs -o mode=1777 tmpfs /tmp")
+	}
+	for _, p := range sb.ReadOnlyPaths {
+		if !filepath.IsAbs(p) {
+			return nil, errors.New("read_only_paths must be absolute: " + p)
+		}
+		p = shellQuote(filepath.Clean(p))
+		script = append(script, "mount --bind "+p+" "+p, "mount -o remount,bind,ro "+p+" "+p)
+	}
+	script = append(script, `exec "$@"`)
+	return append([]string{"sh", "-c", strings.Join(script, "\n"), "sandbox"}, args...), nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Create the namespaces of the sandbox, the agent needs CAP_SYS_ADMIN
+func setNamespaces(cmd *exec.Cmd, job *Job) {
+	if job.Sandbox == nil {
+		return
+	}
+	cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWNS
+	if job.Sandbox.NoNetwork {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+}
+
+// Restricted tokens are only supported on windows
+func setRestrictedToken(cmd *exec.Cmd, job *Job) (func(), error) {
+	if job.RestrictedToken || job.LowIntegrity {
+		return nil, errors.New("restricted_token and low_integrity are only supported on windows")
+	}
+	return func() {}, nil
+}
+
+// Run the job as the user, the agent must be privileged
+func setCredential(cmd *exec.Cmd, runAs string) error {
+	if runAs == "" {
+		return nil
+	}
+	u, err := user.Lookup(runAs)
+	if err != nil {
+		return err
+	}
+	uid, err1 := strconv.ParseUint(u.Uid, 10, 32)
+	gid, err2 := strconv.ParseUint(u.Gid, 10, 32)
+	if err1 != nil || err2 != nil {
+		return errors.New("invalid uid or gid of user " + runAs)
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	return nil
+}
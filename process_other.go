@@ -0,0 +1,82 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+func processExists(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
+
+// Not available without procfs, only the output is used to judge liveness
+func processCpuTicks(pid int) (uint64, bool) {
+	return 0, false
+}
+
+// Run the command in its own process group, so that it can be killed with its children
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Kill the process and its children, which may hold the output pipes open
+func killProcessTree(cmd *exec.Cmd) error {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
+
+// Ask the process and its children to exit by SIGTERM
+func terminateProcessTree(cmd *exec.Cmd) error {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM); err != nil {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	return nil
+}
+
+// Mandatory access control and sandbox are only supported on linux
+func confineArgs(job *Job, args []string) ([]string, error) {
+	if job.SELinuxContext != "" || job.AppArmorProfile != "" {
+		return nil, errors.New("selinux_context and apparmor_profile are only supported on linux")
+	}
+	if job.Sandbox != nil {
+		return nil, errors.New("sandbox is only supported on linux")
+	}
+	return seccompArgs(job, args)
+}
+
+func setNamespaces(cmd *exec.Cmd, job *Job) {
+}
+
+// Restricted tokens are only supported on windows
+func setRestrictedToken(cmd *exec.Cmd, job *Job) (func(), error) {
+	if job.RestrictedToken || job.LowIntegrity {
+		return nil, errors.New("restricted_token and low_integrity are only supported on windows")
+	}
+	return func() {}, nil
+}
+
+// Run the job as the user, the agent must be privileged
+func setCredential(cmd *exec.Cmd, runAs string) error {
+	if runAs == "" {
+		return nil
+	}
+	u, err := user.Lookup(runAs)
+	if err != nil {
+		return err
+	}
+	uid, err1 := strconv.ParseUint(u.Uid, 10, 32)
+	gid, err2 := strconv.ParseUint(u.Gid, 10, 32)
+	if err1 != nil || err2 != nil {
+		return errors.New("invalid uid or gid of user " + runAs)
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	return nil
+}
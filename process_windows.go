@@ -0,0 +1,170 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	processQueryLimitedInformation = 0x1000
+	stillActive                    = 259
+
+	disableMaxPrivilege   = 0x1
+	maximumAllowed        = 0x02000000
+	securityImpersonation = 2
+	tokenPrimary          = 1
+	tokenIntegrityLevel   = 25
+	seGroupIntegrity      = 0x20
+	administratorsSid     = "S-1-5-32-544"
+	lowMandatoryLevelSid  = "S-1-16-4096"
+	restrictedTokenAccess = syscall.TOKEN_DUPLICATE | syscall.TOKEN_QUERY | syscall.TOKEN_ADJUST_DEFAULT | syscall.TOKEN_ASSIGN_PRIMARY
+)
+
+var (
+	modadvapi32               = syscall.NewLazyDLL("advapi32.dll")
+	procCreateRestrictedToken = modadvapi32.NewProc("CreateRestrictedToken")
+	procDuplicateTokenEx      = modadvapi32.NewProc("DuplicateTokenEx")
+	procSetTokenInformation   = modadvapi32.NewProc("SetTokenInformation")
+)
+
+type sidAndAttributes struct {
+	Sid        *syscall.SID
+	Attributes uint32
+}
+
+type tokenMandatoryLabel struct {
+	Label sidAndAttributes
+}
+
+func processExists(pid int) bool {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if err = syscall.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
+
+// Sum of kernel and user time in 100-nanosecond units
+func processCpuTicks(pid int) (uint64, bool) {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return 0, false
+	}
+	defer syscall.CloseHandle(h)
+	var c, e, k, u syscall.Filetime
+	if err = syscall.GetProcessTimes(h, &c, &e, &k, &u); err != nil {
+		return 0, false
+	}
+	kt := uint64(k.HighDateTime)<<32 | uint64(k.LowDateTime)
+	ut := uint64(u.HighDateTime)<<32 | uint64(u.LowDateTime)
+	return kt + ut, true
+}
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// Kill the process and its children, which may hold the output pipes open
+func killProcessTree(cmd *exec.Cmd) error {
+	kill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
+	if err := kill.Run(); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
+
+// Ask the process and its children to exit by taskkill without /F, which
+// closes their windows. The console processes without one fail it.
+func terminateProcessTree(cmd *exec.Cmd) error {
+	return exec.Command("taskkill", "/T", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+}
+
+// Mandatory access control and sandbox are only supported on linux
+func confineArgs(job *Job, args []string) ([]string, error) {
+	if job.SELinuxContext != "" || job.AppArmorProfile != "" {
+		return nil, errors.New("selinux_context and apparmor_profile are only supported on linux")
+	}
+	if job.Sandbox != nil {
+		return nil, errors.New("sandbox is only supported on linux")
+	}
+	return seccompArgs(job, args)
+}
+
+func setNamespaces(cmd *exec.Cmd, job *Job) {
+}
+
+// Run the job with a token derived from the agent's one: without privileges
+// and with the administrators group for deny only, and/or at low integrity
+// level, so that it can't write to the protected locations.
+func setRestrictedToken(cmd *exec.Cmd, job *Job) (func(), error) {
+	if !job.RestrictedToken && !job.LowIntegrity {
+		return func() {}, nil
+	}
+
+	p, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return nil, err
+	}
+	var cur syscall.Token
+	if err = syscall.OpenProcessToken(p, restrictedTokenAccess, &cur); err != nil {
+		return nil, err
+	}
+	defer cur.Close()
+
+	var tok syscall.Handle
+	if job.RestrictedToken {
+		admins, err := syscall.StringToSid(administratorsSid)
+		if err != nil {
+			return nil, err
+		}
+		disable := sidAndAttributes{Sid: admins}
+		r, _, e := procCreateRestrictedToken.Call(uintptr(cur), disableMaxPrivilege,
+			1, uintptr(unsafe.Pointer(&disable)), 0, 0, 0, 0, uintptr(unsafe.Pointer(&tok)))
+		if r == 0 {
+			return nil, e
+		}
+	} else {
+		r, _, e := procDuplicateTokenEx.Call(uintptr(cur), maximumAllowed, 0,
+			securityImpersonation, tokenPrimary, uintptr(unsafe.Pointer(&tok)))
+		if r == 0 {
+			return nil, e
+		}
+	}
+
+	if job.LowIntegrity {
+		low, err := syscall.StringToSid(lowMandatoryLevelSid)
+		if err == nil {
+			label := tokenMandatoryLabel{Label: sidAndAttributes{Sid: low, Attributes: seGroupIntegrity}}
+			size := unsafe.Sizeof(label) + uintptr(syscall.GetLengthSid(low))
+			r, _, e := procSetTokenInformation.Call(uintptr(tok), tokenIntegrityLevel,
+				uintptr(unsafe.Pointer(&label)), size)
+			if r == 0 {
+				err = e
+			}
+		}
+		if err != nil {
+			syscall.CloseHandle(tok)
+			return nil, err
+		}
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Token: syscall.Token(tok)}
+	return func() { syscall.CloseHandle(tok) }, nil
+}
+
+func setCredential(cmd *exec.Cmd, runAs string) error {
+	if runAs != "" {
+		return errors.New("run_as is not supported on windows")
+	}
+	return nil
+}
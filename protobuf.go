@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+)
+
+// The protobuf wire format of the messages of shellagent.proto, written and
+// read by hand rather than by generated code. The fields of the default
+// values are left out as in proto3.
+
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+var errPbTruncated = errors.New("protobuf: truncated message")
+
+type pbWriter struct {
+	buf []byte
+}
+
+func (o *pbWriter) varint(v uint64) {
+	o.buf = binary.AppendUvarint(o.buf, v)
+}
+
+func (o *pbWriter) tag(field, wire int) {
+	o.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (o *pbWriter) Bytes(field int, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	o.tag(field, pbBytes)
+	o.varint(uint64(len(b)))
+	o.buf = append(o.buf, b...)
+}
+
+func (o *pbWriter) String(field int, s string) {
+	o.Bytes(field, []byte(s))
+}
+
+func (o *pbWriter) Strings(field int, list []string) {
+	for _, s := range list {
+		o.tag(field, pbBytes)
+		o.varint(uint64(len(s)))
+		o.buf = append(o.buf, s...)
+	}
+}
+
+// An int32 or an int64, the negative ones take ten bytes
+func (o *pbWriter) Int(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	o.tag(field, pbVarint)
+	o.varint(uint64(v))
+}
+
+func (o *pbWriter) Bool(field int, v bool) {
+	if v {
+		o.tag(field, pbVarint)
+		o.varint(1)
+	}
+}
+
+// An embedded message, written even if empty
+func (o *pbWriter) Message(field int, m *pbWriter) {
+	o.tag(field, pbBytes)
+	o.varint(uint64(len(m.buf)))
+	o.buf = append(o.buf, m.buf...)
+}
+
+// A map<string, string>, by the order of the keys
+func (o *pbWriter) StringMap(field int, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var e pbWriter
+		e.String(1, k)
+		e.String(2, m[k])
+		o.Message(field, &e)
+	}
+}
+
+// A google.protobuf.Timestamp, left out if zero
+func (o *pbWriter) Time(field int, t time.Time) {
+	if t.IsZero() || t.Unix() == 0 {
+		return
+	}
+	var ts pbWriter
+	ts.Int(1, t.Unix())
+	ts.Int(2, int64(t.Nanosecond()))
+	o.Message(field, &ts)
+}
+
+// A field read from a message: the value of a varint or a fixed field, or
+// the data of a length delimited one
+type pbField struct {
+	Num   int
+	Wire  int
+	Value uint64
+	Data  []byte
+}
+
+func (o *pbField) String() string {
+	return string(o.Data)
+}
+
+func (o *pbField) Bool() bool {
+	return o.Value != 0
+}
+
+// The fields of the message in their order, a repeated field comes as many
+func pbFields(b []byte) ([]pbField, error) {
+	var fields []pbField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errPbTruncated
+		}
+		b = b[n:]
+		f := pbField{Num: int(key >> 3), Wire: int(key & 7)}
+		switch f.Wire {
+		case pbVarint:
+			if f.Value, n = binary.Uvarint(b); n <= 0 {
+				return nil, errPbTruncated
+			}
+			b = b[n:]
+		case pbFixed64:
+			if len(b) < 8 {
+				return nil, errPbTruncated
+			}
+			f.Value, b = binary.LittleEndian.Uint64(b), b[8:]
+		case pbFixed32:
+			if len(b) < 4 {
+				return nil, errPbTruncated
+			}
+			f.Value, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case pbBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, errPbTruncated
+			}
+			f.Data, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return nil, errors.New("protobuf: unsupported wire type")
+		}
+		if f.Num <= 0 {
+			return nil, errors.New("protobuf: invalid field number")
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// Read an entry of a map<string, string> into m
+func pbMapEntry(data []byte, m map[string]string) error {
+	fields, err := pbFields(data)
+	if err != nil {
+		return err
+	}
+	var k, v string
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			k = f.String()
+		case 2:
+			v = f.String()
+		}
+	}
+	m[k] = v
+	return nil
+}
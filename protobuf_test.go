@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestPbWriter(t *testing.T) {
+	var w pbWriter
+	w.String(1, "ab")
+	w.Int(2, 150)
+	w.Bool(3, true)
+	w.Int(4, 0)     // Left out
+	w.String(5, "") // Left out
+	w.Int(6, -1)
+	// The example of the protobuf encoding guide, and a negative int taking ten bytes
+	if got := hex.EncodeToString(w.buf); got != "0a026162109601180130ffffffffffffffffff01" {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestPbRoundTrip(t *testing.T) {
+	ts := time.Unix(1700000000, 123)
+	var w pbWriter
+	w.String(1, "job-1")
+	w.Strings(2, []string{"a", "b"})
+	w.Int(3, 300)
+	w.Bool(4, true)
+	w.StringMap(5, map[string]string{"app": "web", "env": "prod"})
+	w.Time(6, ts)
+	w.Time(7, time.Unix(0, 0)) // Left out
+
+	fields, err := pbFields(w.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var strs []string
+	labels := make(map[string]string)
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			if f.String() != "job-1" {
+				t.Errorf("got field 1 %q", f.String())
+			}
+		case 2:
+			strs = append(strs, f.String())
+		case 3:
+			if f.Wire != pbVarint || f.Value != 300 {
+				t.Errorf("got field 3 %d", f.Value)
+			}
+		case 4:
+			if !f.Bool() {
+				t.Error("got field 4 false")
+			}
+		case 5:
+			if err := pbMapEntry(f.Data, labels); err != nil {
+				t.Error(err)
+			}
+		case 6:
+			tf, err := pbFields(f.Data)
+			if err != nil || len(tf) != 2 || int64(tf[0].Value) != ts.Unix() || int64(tf[1].Value) != 123 {
+				t.Errorf("got timestamp %v %v", tf, err)
+			}
+		default:
+			t.Errorf("unexpected field %d", f.Num)
+		}
+	}
+	if len(strs) != 2 || strs[0] != "a" || strs[1] != "b" {
+		t.Errorf("got repeated %v", strs)
+	}
+	if len(labels) != 2 || labels["app"] != "web" || labels["env"] != "prod" {
+		t.Errorf("got map %v", labels)
+	}
+}
+
+func TestPbFieldsTruncated(t *testing.T) {
+	for _, h := range []string{
+		"0a05616263",         // Length past the end
+		"08",                 // Varint missing
+		"09010203",           // Fixed64 too short
+		"0d01",               // Fixed32 too short
+		"0b",                 // Group, unsupported
+		"00",                 // Field 0
+		"08ffffffffffffffff", // Varint not ended
+	} {
+		b, _ := hex.DecodeString(h)
+		if _, err := pbFields(b); err == nil {
+			t.Errorf("%s parsed", h)
+		}
+	}
+}
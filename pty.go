@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nu7hatch/gouuid"
+)
+
+// Interactive shells on a pseudo terminal over a websocket, a pty on linux
+// and a ConPTY on windows. /admin/pty upgrades to a websocket and starts the
+// shell: the binary messages carry the keystrokes to the terminal and its
+// output back, the text messages are the json controls. The sessions are
+// kept by gPtySessions beside the jobs, and closed by the client closing the
+// websocket or sending close, by /admin/pty/close, by the shell exiting, or
+// after pty::idle_timeout seconds without input or output.
+
+// A process attached to a pseudo terminal, reading gives the output of the
+// terminal and writing types into it
+type ptyProcess interface {
+	io.ReadWriter
+	Pid() int
+	Resize(cols, rows int) error
+	Wait() (int, error) // The exit code
+	Kill() error
+	Close() error
+}
+
+// A control message, resize and close from the client, started, exited and
+// error from the agent
+type PtyControl struct {
+	Type     string    `json:"type"`
+	Id       string    `json:"id,omitempty"`
+	Cols     int       `json:"cols,omitempty"`
+	Rows     int       `json:"rows,omitempty"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+	Errno    ErrorCode `json:"errno,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type PtySessionInfo struct {
+	Id         string    `json:"id"`
+	Tenant     string    `json:"tenant,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Shell      []string  `json:"shell"`
+	Dir        string    `json:"dir,omitempty"`
+	Pid        int       `json:"pid"`
+	Cols       int       `json:"cols"`
+	Rows       int       `json:"rows"`
+	CreateTime time.Time `json:"create_time"`
+	LastActive time.Time `json:"last_active"` // The last input or output
+	BytesIn    int64     `json:"bytes_in"`    // Typed into the terminal
+	BytesOut   int64     `json:"bytes_out"`
+}
+
+type PtySession struct {
+	proc  ptyProcess
+	conn  *WsConn
+	doneC chan struct{} // Closed when the session is closed
+
+	mu        sync.Mutex
+	info      PtySessionInfo
+	closeOnce sync.Once
+}
+
+type PtySessions struct {
+	mu       sync.Mutex
+	sessions map[string]*PtySession
+}
+
+const (
+	ptyDefaultCols = 80
+	ptyDefaultRows = 24
+	ptyMaxSize     = 1000
+	// How long the output left is forwarded after the shell exits
+	ptyDrainTimeout = time.Second
+)
+
+var (
+	gPtySessions = &PtySessions{sessions: make(map[string]*PtySession)}
+
+	errPtyDisabled     = errors.New("pty is disabled by enabled of the [pty] config section")
+	errPtySessionsFull = errors.New("too many pty sessions")
+)
+
+func init() {
+	gHttpServer.AddToUninit(UninitPty)
+}
+
+// Close the sessions when the server stops
+func UninitPty() {
+	for _, s := range gPtySessions.all() {
+		s.close("the agent stopped")
+	}
+}
+
+func (o *PtySessions) full() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.fullLocked()
+}
+
+func (o *PtySessions) fullLocked() bool {
+	max := gApp.Cnf.PtyMaxSessions
+	return max > 0 && len(o.sessions) >= max
+}
+
+func (o *PtySessions) add(s *PtySession) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.fullLocked() {
+		return false
+	}
+	o.sessions[s.info.Id] = s
+	return true
+}
+
+func (o *PtySessions) remove(id string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.sessions, id)
+}
+
+func (o *PtySessions) Get(id string) *PtySession {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.sessions[id]
+}
+
+func (o *PtySessions) all() []*PtySession {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	res := make([]*PtySession, 0, len(o.sessions))
+	for _, s := range o.sessions {
+		res = append(res, s)
+	}
+	return res
+}
+
+// The sessions from the oldest
+func (o *PtySessions) List() []*PtySessionInfo {
+	res := []*PtySessionInfo{}
+	for _, s := range o.all() {
+		res = append(res, s.Info())
+	}
+	sort.Slice(res, func(i, k int) bool { return res[i].CreateTime.Before(res[k].CreateTime) })
+	return res
+}
+
+func (o *PtySession) Info() *PtySessionInfo {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	info := o.info
+	return &info
+}
+
+func (o *PtySession) active(in, out int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.info.LastActive = time.Now()
+	o.info.BytesIn += int64(in)
+	o.info.BytesOut += int64(out)
+}
+
+func (o *PtySession) sendControl(c *PtyControl) {
+	b, _ := json.Marshal(c)
+	o.conn.WriteMessage(WsText, b)
+}
+
+// Kill the shell and close the websocket, once
+func (o *PtySession) close(reason string) {
+	o.closeOnce.Do(func() {
+		gPtySessions.remove(o.info.Id)
+		close(o.doneC)
+		o.proc.Kill()
+		o.proc.Close()
+		o.conn.WriteMessage(wsClose, nil)
+		o.conn.Close()
+		info := o.Info()
+		log.Infof("audit: pty session %s of %s closed: %s, %d bytes typed, %d bytes output",
+			info.Id, info.Tenant, reason, info.BytesIn, info.BytesOut)
+	})
+}
+
+// Forward the output of the terminal to the websocket until it ends
+func (o *PtySession) pumpOutput(doneC chan struct{}) {
+	defer close(doneC)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := o.proc.Read(buf)
+		if n > 0 {
+			o.active(0, n)
+			if o.conn.WriteMessage(WsBinary, buf[:n]) != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Close the session when the shell exits, after the output left is forwarded
+func (o *PtySession) waitExit(pumpC chan struct{}) {
+	code, err := o.proc.Wait()
+	select {
+	case <-pumpC:
+	case <-time.After(ptyDrainTimeout):
+	}
+	select {
+	case <-o.doneC:
+		return
+	default:
+	}
+	reason := "the shell exited with " + strconv.Itoa(code)
+	if err != nil {
+		reason = "the shell failed: " + err.Error()
+	}
+	o.sendControl(&PtyControl{Type: "exited", Id: o.info.Id, ExitCode: &code})
+	o.close(reason)
+}
+
+// Close the session without input or output for pty::idle_timeout seconds
+func (o *PtySession) watchIdle() {
+	timeout := time.Duration(gApp.Cnf.PtyIdleTimeout) * time.Second
+	if timeout <= 0 {
+		return
+	}
+	period := timeout / 4
+	if period > 5*time.Second {
+		period = 5 * time.Second
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(o.Info().LastActive) > timeout {
+				o.sendControl(&PtyControl{Type: "error", Id: o.info.Id, Error: "idle timeout"})
+				o.close("idle for " + timeout.String())
+				return
+			}
+		case <-o.doneC:
+			return
+		}
+	}
+}
+
+// Type the binary messages into the terminal and handle the controls until
+// the websocket closes
+func (o *PtySession) serve() {
+	defer o.close("the client disconnected")
+	for {
+		op, data, err := o.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if op == WsBinary {
+			o.active(len(data), 0)
+			if _, err = o.proc.Write(data); err != nil {
+				return
+			}
+			continue
+		}
+		var c PtyControl
+		if op != WsText || json.Unmarshal(data, &c) != nil {
+			o.sendControl(&PtyControl{Type: "error", Errno: ECInvalidParam, Error: "invalid message"})
+			continue
+		}
+		switch c.Type {
+		case "resize":
+			if !validPtySize(c.Cols, c.Rows) {
+				o.sendControl(&PtyControl{Type: "error", Errno: ECInvalidParam, Error: "invalid cols or rows"})
+				continue
+			}
+			if err = o.proc.Resize(c.Cols, c.Rows); err != nil {
+				o.sendControl(&PtyControl{Type: "error", Errno: ECUnknown, Error: err.Error()})
+				continue
+			}
+			o.mu.Lock()
+			o.info.Cols, o.info.Rows = c.Cols, c.Rows
+			o.mu.Unlock()
+		case "close":
+			o.close("closed by the client")
+			return
+		default:
+			o.sendControl(&PtyControl{Type: "error", Errno: ECInvalidParam, Error: "unknown message type: " + c.Type})
+		}
+	}
+}
+
+func validPtySize(cols, rows int) bool {
+	return cols > 0 && cols <= ptyMaxSize && rows > 0 && rows <= ptyMaxSize
+}
+
+// The shell of the sessions, pty::shell or the user's shell
+func ptyShell() []string {
+	if len(gApp.Cnf.PtyShell) > 0 {
+		return gApp.Cnf.PtyShell
+	}
+	if runtime.GOOS == "windows" {
+		return []string{"cmd"}
+	}
+	if sh := os.Getenv("SHELL"); sh != "" {
+		return []string{sh}
+	}
+	return []string{"sh"}
+}
+
+func ptyFormSize(r *http.Request, name string, def int) (int, error) {
+	s := r.FormValue(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 || n > ptyMaxSize {
+		return 0, errors.New("invalid param " + name + ": " + s)
+	}
+	return n, nil
+}
+
+// Handler upgrading to a websocket bridged to a shell on a pseudo terminal,
+// of the size of the params cols and rows, in the param dir
+func PtyHandler(w http.ResponseWriter, r *http.Request) {
+	if !gApp.Cnf.PtyEnabled {
+		ServeJSON(w, NewResponse().SetError(ECForbidden, errPtyDisabled.Error()))
+		return
+	}
+	cols, err := ptyFormSize(r, "cols", ptyDefaultCols)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	rows, err := ptyFormSize(r, "rows", ptyDefaultRows)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	dir, err := JailPath(r.FormValue("dir"))
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECPathNotAllowed, err.Error()))
+		return
+	}
+	if !IsWebsocketRequest(r) {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "not a websocket handshake"))
+		return
+	}
+	u4, err := uuid.NewV4()
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to generate uuid"))
+		return
+	}
+
+	now := time.Now()
+	s := &PtySession{
+		doneC: make(chan struct{}),
+		info: PtySessionInfo{
+			Id:         u4.String(),
+			Tenant:     tokenTenant(RequestToken(r)),
+			RemoteAddr: r.RemoteAddr,
+			Shell:      ptyShell(),
+			Dir:        dir,
+			Cols:       cols,
+			Rows:       rows,
+			CreateTime: now,
+			LastActive: now,
+		},
+	}
+	if gPtySessions.full() {
+		ServeJSON(w, NewResponse().SetError(ECQueueFull, errPtySessionsFull.Error()))
+		return
+	}
+	s.proc, err = startPty(s.info.Shell, dir, jobEnv(&Job{}), cols, rows)
+	if err != nil {
+		log.Errorf("start pty failed: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "start pty failed: "+err.Error()))
+		return
+	}
+	s.info.Pid = s.proc.Pid()
+	if s.conn, err = UpgradeWebsocket(w, r); err != nil {
+		s.proc.Kill()
+		s.proc.Wait()
+		s.proc.Close()
+		log.Errorf("websocket upgrade failed: %s", err)
+		return
+	}
+	// Full again by the sessions opened meanwhile
+	if !gPtySessions.add(s) {
+		s.sendControl(&PtyControl{Type: "error", Errno: ECQueueFull, Error: errPtySessionsFull.Error()})
+		go s.proc.Wait()
+		s.close(errPtySessionsFull.Error())
+		return
+	}
+	log.Infof("audit: pty session %s opened by %s from %s, shell: %s, pid: %d",
+		s.info.Id, s.info.Tenant, s.info.RemoteAddr, strings.Join(s.info.Shell, " "), s.info.Pid)
+
+	s.sendControl(&PtyControl{Type: "started", Id: s.info.Id, Cols: cols, Rows: rows})
+	pumpC := make(chan struct{})
+	go s.pumpOutput(pumpC)
+	go s.waitExit(pumpC)
+	go s.watchIdle()
+	s.serve()
+}
+
+// Handler to list the pty sessions
+func ListPtyHandler(w http.ResponseWriter, r *http.Request) {
+	ServeJSON(w, NewResponse().SetData(gPtySessions.List()))
+}
+
+// Handler to close a pty session by the param id, its shell is killed
+func ClosePtyHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.FormValue("id"))
+	s := gPtySessions.Get(id)
+	if s == nil {
+		ServeJSON(w, NewResponse().SetError(ECPtySessionNotFound, "pty session not found: "+id))
+		return
+	}
+	s.sendControl(&PtyControl{Type: "error", Id: id, Error: "closed by an admin"})
+	s.close("closed by " + tokenTenant(RequestToken(r)))
+	ServeJSON(w, NewResponse())
+}
@@ -0,0 +1,130 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+type winsize struct {
+	Row    uint16
+	Col    uint16
+	Xpixel uint16
+	Ypixel uint16
+}
+
+// The shell on the slave of a pty, the master is read and written
+type unixPty struct {
+	master *os.File
+	cmd    *exec.Cmd
+}
+
+func ptyIoctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	// By the raw fd, Fd() would switch the file to the blocking mode
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func startPty(args []string, dir string, env []string, cols, rows int) (ptyProcess, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	var unlock int32
+	var n uint32
+	if err = ptyIoctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err == nil {
+		err = ptyIoctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n))
+	}
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	defer slave.Close()
+
+	p := &unixPty{master: master}
+	if err = p.Resize(cols, rows); err != nil {
+		master.Close()
+		return nil, err
+	}
+	p.cmd = exec.Command(args[0], args[1:]...)
+	p.cmd.Dir = dir
+	p.cmd.Env = append(env, "TERM=xterm-256color")
+	p.cmd.Stdin, p.cmd.Stdout, p.cmd.Stderr = slave, slave, slave
+	// A session of its own with the pty as the controlling terminal, the
+	// Ctty is the stdin of the child
+	p.cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err = p.cmd.Start(); err != nil {
+		master.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// The master reads EIO once the slave is closed by all
+func (o *unixPty) Read(b []byte) (int, error) {
+	n, err := o.master.Read(b)
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EIO {
+		return n, errors.New("the terminal is closed")
+	}
+	return n, err
+}
+
+func (o *unixPty) Write(b []byte) (int, error) {
+	return o.master.Write(b)
+}
+
+func (o *unixPty) Pid() int {
+	return o.cmd.Process.Pid
+}
+
+func (o *unixPty) Resize(cols, rows int) error {
+	ws := winsize{Row: uint16(rows), Col: uint16(cols)}
+	return ptyIoctl(o.master, syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+}
+
+func (o *unixPty) Wait() (int, error) {
+	err := o.cmd.Wait()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return o.cmd.ProcessState.ExitCode(), nil
+		}
+		return -1, err
+	}
+	return 0, nil
+}
+
+// Kill the session of the shell with its children
+func (o *unixPty) Kill() error {
+	if err := syscall.Kill(-o.cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		return o.cmd.Process.Kill()
+	}
+	return nil
+}
+
+func (o *unixPty) Close() error {
+	return o.master.Close()
+}
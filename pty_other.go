@@ -0,0 +1,12 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"errors"
+)
+
+func startPty(args []string, dir string, env []string, cols, rows int) (ptyProcess, error) {
+	return nil, errors.New("pty is only supported on linux and windows")
+}
@@ -0,0 +1,200 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+)
+
+const (
+	procThreadAttributePseudoConsole = 0x00020016
+	extendedStartupInfoPresent       = 0x00080000
+	createUnicodeEnvironment         = 0x00000400
+)
+
+var (
+	procCreatePseudoConsole               = modkernel32.NewProc("CreatePseudoConsole")
+	procResizePseudoConsole               = modkernel32.NewProc("ResizePseudoConsole")
+	procClosePseudoConsole                = modkernel32.NewProc("ClosePseudoConsole")
+	procInitializeProcThreadAttributeList = modkernel32.NewProc("InitializeProcThreadAttributeList")
+	procUpdateProcThreadAttribute         = modkernel32.NewProc("UpdateProcThreadAttribute")
+	procDeleteProcThreadAttributeList     = modkernel32.NewProc("DeleteProcThreadAttributeList")
+)
+
+type startupInfoEx struct {
+	syscall.StartupInfo
+	attributeList *byte
+}
+
+// The shell on a ConPTY, windows 10 1809 or later. The input and the output
+// of the console are pipes.
+type conPty struct {
+	hpc     uintptr
+	input   *os.File // Written to type into the console
+	output  *os.File // Read for the output of the console
+	process syscall.Handle
+	pid     int
+
+	closeOnce sync.Once
+}
+
+// A COORD passed by value
+func ptyCoord(cols, rows int) uintptr {
+	return uintptr(uint16(cols)) | uintptr(uint16(rows))<<16
+}
+
+func startPty(args []string, dir string, env []string, cols, rows int) (ptyProcess, error) {
+	if err := procCreatePseudoConsole.Find(); err != nil {
+		return nil, fmt.Errorf("ConPTY is not supported by this windows: %s", err)
+	}
+	var inR, inW, outR, outW syscall.Handle
+	if err := syscall.CreatePipe(&inR, &inW, nil, 0); err != nil {
+		return nil, err
+	}
+	if err := syscall.CreatePipe(&outR, &outW, nil, 0); err != nil {
+		syscall.CloseHandle(inR)
+		syscall.CloseHandle(inW)
+		return nil, err
+	}
+	p := &conPty{input: os.NewFile(uintptr(inW), "conpty-input"), output: os.NewFile(uintptr(outR), "conpty-output")}
+	hr, _, _ := procCreatePseudoConsole.Call(ptyCoord(cols, rows), uintptr(inR), uintptr(outW), 0, uintptr(unsafe.Pointer(&p.hpc)))
+	// Duplicated by the console
+	syscall.CloseHandle(inR)
+	syscall.CloseHandle(outW)
+	if hr != 0 {
+		p.input.Close()
+		p.output.Close()
+		return nil, fmt.Errorf("CreatePseudoConsole failed: 0x%x", hr)
+	}
+	if err := p.start(args, dir, env); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Create the process attached to the console
+func (o *conPty) start(args []string, dir string, env []string) error {
+	var size uintptr
+	procInitializeProcThreadAttributeList.Call(0, 1, 0, uintptr(unsafe.Pointer(&size)))
+	list := make([]byte, size)
+	r1, _, err := procInitializeProcThreadAttributeList.Call(uintptr(unsafe.Pointer(&list[0])), 1, 0, uintptr(unsafe.Pointer(&size)))
+	if r1 == 0 {
+		return fmt.Errorf("InitializeProcThreadAttributeList failed: %s", err)
+	}
+	defer procDeleteProcThreadAttributeList.Call(uintptr(unsafe.Pointer(&list[0])))
+	r1, _, err = procUpdateProcThreadAttribute.Call(uintptr(unsafe.Pointer(&list[0])), 0,
+		procThreadAttributePseudoConsole, o.hpc, unsafe.Sizeof(o.hpc), 0, 0)
+	if r1 == 0 {
+		return fmt.Errorf("UpdateProcThreadAttribute failed: %s", err)
+	}
+
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = syscall.EscapeArg(a)
+	}
+	cmdline, err := syscall.UTF16PtrFromString(strings.Join(quoted, " "))
+	if err != nil {
+		return err
+	}
+	app, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	var cwd *uint16
+	if dir != "" {
+		if cwd, err = syscall.UTF16PtrFromString(dir); err != nil {
+			return err
+		}
+	}
+	block := ptyEnvBlock(env)
+
+	si := &startupInfoEx{attributeList: &list[0]}
+	si.Cb = uint32(unsafe.Sizeof(*si))
+	var pi syscall.ProcessInformation
+	err = syscall.CreateProcess(app, cmdline, nil, nil, false,
+		extendedStartupInfoPresent|createUnicodeEnvironment, &block[0], cwd, &si.StartupInfo, &pi)
+	if err != nil {
+		return err
+	}
+	syscall.CloseHandle(pi.Thread)
+	o.process, o.pid = pi.Process, int(pi.ProcessId)
+	return nil
+}
+
+// The environment block of the process, NUL separated and ended by two NULs
+func ptyEnvBlock(env []string) []uint16 {
+	var block []uint16
+	for _, kv := range env {
+		block = append(block, utf16.Encode([]rune(kv))...)
+		block = append(block, 0)
+	}
+	if len(block) == 0 {
+		block = append(block, 0)
+	}
+	return append(block, 0)
+}
+
+func (o *conPty) Read(b []byte) (int, error) {
+	return o.output.Read(b)
+}
+
+func (o *conPty) Write(b []byte) (int, error) {
+	return o.input.Write(b)
+}
+
+func (o *conPty) Pid() int {
+	return o.pid
+}
+
+func (o *conPty) Resize(cols, rows int) error {
+	if hr, _, _ := procResizePseudoConsole.Call(o.hpc, ptyCoord(cols, rows)); hr != 0 {
+		return fmt.Errorf("ResizePseudoConsole failed: 0x%x", hr)
+	}
+	return nil
+}
+
+// Called once, the process handle is closed then
+func (o *conPty) Wait() (int, error) {
+	defer syscall.CloseHandle(o.process)
+	if _, err := syscall.WaitForSingleObject(o.process, syscall.INFINITE); err != nil {
+		return -1, err
+	}
+	var code uint32
+	if err := syscall.GetExitCodeProcess(o.process, &code); err != nil {
+		return -1, err
+	}
+	return int(code), nil
+}
+
+// Kill the shell with its children
+func (o *conPty) Kill() error {
+	kill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(o.pid))
+	if err := kill.Run(); err != nil {
+		return syscall.TerminateProcess(o.process, 1)
+	}
+	return nil
+}
+
+// Closing the console ends the output
+func (o *conPty) Close() error {
+	o.closeOnce.Do(func() {
+		procClosePseudoConsole.Call(o.hpc)
+		o.input.Close()
+		o.output.Close()
+	})
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A job with record set keeps its invocation as resolved when it started:
+// the argv of the shell, the argv after the confinement, the host dir and the
+// whole environment. /cmd/replay runs it again as recorded, e.g. to
+// reproduce a job failing only on one host, but within the jail, the
+// confinement and the policy of the time of the replay: the shell argv is
+// confined again, the dir must still be in the jail, and the environment
+// keeps only the variables the job would get now. The jobs get no stdin, it
+// is the null device.
+
+type JobRecording struct {
+	Args []string `json:"args"`
+	// The argv before the confinement
+	Shell []string `json:"shell"`
+	Dir   string   `json:"dir"` // On the host
+	Env   []string `json:"env"`
+	Host  string   `json:"host"`
+	// The script file in args, written again for the replay
+	ScriptPath string `json:"script_path,omitempty"`
+}
+
+func newJobRecording(args, shell []string, dir string, env []string, scriptPath string) *JobRecording {
+	host, _ := os.Hostname()
+	return &JobRecording{
+		Args:       copyStrings(args),
+		Shell:      copyStrings(shell),
+		Dir:        dir,
+		Env:        copyStrings(env),
+		Host:       host,
+		ScriptPath: scriptPath,
+	}
+}
+
+// The recorded invocation of the replay job, checked like a new job: the
+// shell argv with the script file replaced by the one of the replay and
+// confined again, the dir in the jail, and the recorded values of the
+// variables among env, the environment the job gets now
+func (o *JobRecording) resolve(job *Job, scriptPath string, env []string) ([]string, string, []string, error) {
+	if !policyAllows(job.Cmd) {
+		return nil, "", nil, errCmdNotAllowed
+	}
+	if len(o.Shell) == 0 {
+		return nil, "", nil, errors.New("recorded without the shell argv, it can't be confined again")
+	}
+	args := copyStrings(o.Shell)
+	for i, a := range args {
+		if o.ScriptPath != "" && a == o.ScriptPath {
+			args[i] = scriptPath
+		}
+	}
+	args, err := confineArgs(job, args)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	if gJailRoot != "" {
+		resolved, err := evalExistingSymlinks(o.Dir)
+		if err != nil || o.Dir == "" || !inJail(resolved) {
+			return nil, "", nil, fmt.Errorf("recorded dir %q is out of the jail", o.Dir)
+		}
+	}
+
+	recorded := make(map[string]string)
+	for _, kv := range o.Env {
+		recorded[envName(kv)] = kv
+	}
+	out := make([]string, 0, len(env))
+	for _, kv := range env {
+		if r, ok := recorded[envName(kv)]; ok {
+			kv = r
+		}
+		out = append(out, kv)
+	}
+	return args, o.Dir, out, nil
+}
+
+// The name of the environment variable, case insensitive on windows
+func envName(kv string) string {
+	name := strings.SplitN(kv, "=", 2)[0]
+	if runtime.GOOS == "windows" {
+		name = strings.ToUpper(name)
+	}
+	return name
+}
+
+// Queue a job running the recorded invocation of the job snapshot again.
+// The conditions and the rollback are not run again.
+func replayJob(s *Job, tenant string) (*Job, error) {
+	req := &RunCmdReq{
+		Cmd:              s.Cmd,
+		RunAs:            s.RunAs,
+		Dir:              s.Dir,
+		Env:              s.Env,
+		EnvPass:          s.EnvPass,
+		IdleTimeout:      s.IdleTimeout,
+		Timeout:          s.Timeout,
+		ConcurrencyGroup: s.ConcurrencyGroup,
+		CaptureFiles:     s.CaptureFiles,
+		ParseAs:          s.ParseAs,
+		PsObjects:        s.PsObjects,
+		PsDepth:          s.PsDepth,
+		Record:           true,
+		Labels:           s.Labels,
+		RequireApproval:  s.RequireApproval,
+		SELinuxContext:   s.SELinuxContext,
+		AppArmorProfile:  s.AppArmorProfile,
+		Seccomp:          s.Seccomp,
+		Sandbox:          s.Sandbox,
+		RestrictedToken:  s.RestrictedToken,
+		LowIntegrity:     s.LowIntegrity,
+	}
+	if s.Script {
+		req.Cmd, req.Script = "", s.Cmd
+	}
+	if err := checkPolicyCmd(req); err != nil {
+		return nil, err
+	}
+	rp, ctx, err := newJob(req, "")
+	if err != nil {
+		return nil, err
+	}
+	rp.mu.Lock()
+	rp.Tenant = tenant
+	rp.ReplayOf = s.Id
+	rp.replay = s.Recording
+	rp.mu.Unlock()
+	// The replay of a job needing an approval needs one too
+	if req.RequireApproval {
+		gApprovals.Add(rp, ctx, req)
+	} else if err = submitJob(ctx, rp); err != nil {
+		gJobBookkeeper.Remove(rp.Id)
+		rp.release()
+		return nil, err
+	}
+	return rp, nil
+}
+
+// Handler to run the recorded invocation of a job again, the new job runs
+// async and refers to the job by replay_of
+func ReplayCmdHandler(w http.ResponseWriter, r *http.Request) {
+	tok := RequestToken(r)
+	id := strings.TrimSpace(r.FormValue("id"))
+	job := gJobBookkeeper.Get(id)
+	if job == nil && proxyForwarded(w, r, id) {
+		return
+	}
+	if job == nil {
+		ServeJSON(w, NewResponse().SetError(ECJobNotFound, "job not found: "+id))
+		return
+	}
+	if !canManageJob(tok, job) {
+		ServeJSON(w, NewResponse().SetError(ECForbidden, "job of another tenant: "+id))
+		return
+	}
+	if err := checkRunAs(tok, job.RunAs); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECForbidden, err.Error()))
+		return
+	}
+	s := job.snapshot(false)
+	if s.Recording == nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "job has no recording, submit it with record: "+id))
+		return
+	}
+	rp, err := replayJob(s, tokenTenant(tok))
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(newJobErrno(err), err.Error()))
+		return
+	}
+	log.Infof("audit: job %s replayed by %s as job %s", id, rp.Tenant, rp.Id)
+	ServeJSON(w, NewResponse().SetData(&AsyncRuncmdRes{Id: rp.Id, CreateTime: rp.CreateTime}))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitDone(t *testing.T, job *Job) *Job {
+	select {
+	case <-job.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("job not done")
+	}
+	return job.Snapshot()
+}
+
+// A replay runs the recorded invocation within the jail and the environment
+// the job would get now
+func TestReplayChecksRecording(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	setupJobs(t)
+	gApp.Cnf.PoolSize, gApp.Cnf.PoolQueueSize = 2, 10
+	if err := InitJobPool(); err != nil {
+		t.Fatal(err)
+	}
+	defer gJobPool.Close()
+	defer func() { gJailRoot = "" }()
+
+	job, err := startJob(&RunCmdReq{Cmd: `echo "$A-$EVIL"`, Env: []string{"A=1"}, Record: true}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := waitDone(t, job)
+	if s.Recording == nil || len(s.Recording.Shell) == 0 {
+		t.Fatalf("got recording %+v", s.Recording)
+	}
+
+	s.Recording.Env = append(s.Recording.Env, "A=2", "EVIL=1")
+	rp, err := replayJob(s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs := waitDone(t, rp); rs.Status != JSFinished {
+		t.Fatalf("got status %s, error %s", rs.Status, rs.Error)
+	}
+	if stdout, _ := rp.Output(); strings.TrimSpace(stdout) != "2-" {
+		t.Fatalf("got output %q", stdout)
+	}
+
+	gJailRoot, _ = filepath.EvalSymlinks(t.TempDir())
+	s.Recording.Dir = filepath.Dir(gJailRoot)
+	if rp, err = replayJob(s, ""); err != nil {
+		t.Fatal(err)
+	}
+	if rs := waitDone(t, rp); !strings.HasPrefix(rs.Error, "replay refused") {
+		t.Fatalf("got status %s, error %q", rs.Status, rs.Error)
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nu7hatch/gouuid"
+)
+
+// A rollout runs a cmd on many hosts, this agent and its peers, batch by
+// batch: the canary hosts first alone, then batch_size hosts at a time with a
+// pause between the batches. It's aborted once a canary fails, or the failed
+// hosts exceed max_failure_percent of all.
+
+// The host of a rollout meaning this agent
+const rolloutSelf = "self"
+
+type RolloutStatus string
+
+const (
+	RSRunning  RolloutStatus = "running"
+	RSFinished               = "finished" // All the batches run, within the failure budget
+	RSAborted                = "aborted"  // Too many failures
+	RSCanceled               = "canceled"
+)
+
+type RolloutStrategy struct {
+	Canary            int `json:"canary,omitempty"`              // Hosts run first, any failure aborts
+	BatchSize         int `json:"batch_size,omitempty"`          // Hosts run at the same time, 0 means all
+	MaxFailurePercent int `json:"max_failure_percent,omitempty"` // Of all the hosts, 0 means no failure allowed
+	PauseSeconds      int `json:"pause_seconds,omitempty"`       // Between the batches
+}
+
+type RolloutReq struct {
+	Req *RunCmdReq `json:"req"`
+	// "self" or the urls of the peers, empty means all the hosts having the
+	// target tags
+	Hosts      []string        `json:"hosts,omitempty"`
+	TargetTags []string        `json:"target_tags,omitempty"`
+	Strategy   RolloutStrategy `json:"strategy"`
+}
+
+type RolloutHost struct {
+	Host     string    `json:"host"`
+	Batch    int       `json:"batch"` // 0 is the canary
+	JobId    string    `json:"job_id,omitempty"`
+	Status   JobStatus `json:"status,omitempty"` // Empty until run
+	ExitCode int       `json:"exit_code"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type Rollout struct {
+	Id         string          `json:"id"`
+	Status     RolloutStatus   `json:"status"`
+	Error      string          `json:"error,omitempty"` // Why aborted
+	Cmd        string          `json:"cmd"`
+	Strategy   RolloutStrategy `json:"strategy"`
+	Hosts      []*RolloutHost  `json:"hosts"`
+	Batch      int             `json:"batch"` // The current batch
+	Failed     int             `json:"failed"`
+	CreateTime time.Time       `json:"create_time"`
+	FinishTime time.Time       `json:"finish_time"`
+
+	req    *RunCmdReq
+	tenant string
+	token  *Token // Of the caller, the jobs of the peers run as it
+	ctx    context.Context
+	cancel context.CancelFunc
+	sync.Mutex
+}
+
+type RolloutBookkeeper struct {
+	rollouts map[string]*Rollout
+	sync.RWMutex
+}
+
+var (
+	gRolloutBookkeeper = &RolloutBookkeeper{rollouts: make(map[string]*Rollout)}
+)
+
+func (o *RolloutBookkeeper) Add(r *Rollout) {
+	o.Lock()
+	defer o.Unlock()
+	o.rollouts[r.Id] = r
+	// Keep the finished rollouts for expire_days
+	for id, r := range o.rollouts {
+		if r.Status != RSRunning && time.Since(r.FinishTime) > time.Duration(gApp.Cnf.ExpireDays)*24*time.Hour {
+			delete(o.rollouts, id)
+		}
+	}
+}
+
+func (o *RolloutBookkeeper) Get(id string) *Rollout {
+	o.RLock()
+	defer o.RUnlock()
+	return o.rollouts[id]
+}
+
+// The snapshots of the rollouts ordered by create time desc
+func (o *RolloutBookkeeper) GetAll() []*Rollout {
+	o.RLock()
+	res := make([]*Rollout, 0, len(o.rollouts))
+	for _, r := range o.rollouts {
+		res = append(res, r)
+	}
+	o.RUnlock()
+	for i, r := range res {
+		res[i] = r.Snapshot()
+	}
+	sort.Slice(res, func(i, k int) bool { return res[i].CreateTime.After(res[k].CreateTime) })
+	return res
+}
+
+func (o *Rollout) Snapshot() *Rollout {
+	o.Lock()
+	defer o.Unlock()
+	s := &Rollout{
+		Id:         o.Id,
+		Status:     o.Status,
+		Error:      o.Error,
+		Cmd:        o.Cmd,
+		Strategy:   o.Strategy,
+		Batch:      o.Batch,
+		Failed:     o.Failed,
+		CreateTime: o.CreateTime,
+		FinishTime: o.FinishTime,
+	}
+	for _, h := range o.Hosts {
+		c := *h
+		s.Hosts = append(s.Hosts, &c)
+	}
+	return s
+}
+
+// The hosts of the request, "self" and the known peers only, so that the
+// peer token isn't sent elsewhere
+func rolloutHosts(req *RolloutReq) ([]string, error) {
+	var peers []Peer
+	if gPeerRegistry != nil {
+		peers = gPeerRegistry.Peers()
+	}
+	if len(req.Hosts) == 0 {
+		var hosts []string
+		if matchTags(gApp.Cnf.AgentTags(), req.TargetTags) {
+			hosts = append(hosts, rolloutSelf)
+		}
+		for _, p := range peers {
+			if p.Error == "" && !p.LastSeen.IsZero() && matchTags(p.Tags, req.TargetTags) {
+				hosts = append(hosts, p.Url)
+			}
+		}
+		if len(hosts) == 0 {
+			return nil, errors.New("no host matches the target tags")
+		}
+		return hosts, nil
+	}
+
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, h := range req.Hosts {
+		h = strings.TrimRight(h, "/")
+		known := h == rolloutSelf
+		for _, p := range peers {
+			known = known || p.Url == h
+		}
+		if !known {
+			return nil, errors.New("unknown host, not a peer of peers::urls: " + h)
+		}
+		if !seen[h] {
+			seen[h] = true
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts, nil
+}
+
+func NewRollout(req *RolloutReq, tenant string) (*Rollout, error) {
+	hosts, err := rolloutHosts(req)
+	if err != nil {
+		return nil, err
+	}
+	u4, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	// The hosts run the cmd themselves, rather than forwarding it again
+	run := *req.Req
+	run.TargetTags = nil
+	run.Async = false
+
+	st := req.Strategy
+	if st.Canary < 0 || st.BatchSize < 0 || st.PauseSeconds < 0 || st.MaxFailurePercent < 0 || st.MaxFailurePercent > 100 {
+		return nil, errors.New("invalid strategy")
+	}
+	if st.Canary > len(hosts) {
+		st.Canary = len(hosts)
+	}
+	batchSize := st.BatchSize
+	if batchSize == 0 {
+		batchSize = len(hosts)
+	}
+
+	o := &Rollout{
+		Id:         u4.String(),
+		Status:     RSRunning,
+		Cmd:        run.Cmd,
+		Strategy:   st,
+		CreateTime: time.Now(),
+		FinishTime: time.Unix(0, 0),
+		req:        &run,
+		tenant:     tenant,
+	}
+	o.ctx, o.cancel = context.WithCancel(context.Background())
+	for i, h := range hosts {
+		batch := 0
+		if i >= st.Canary {
+			batch = (i-st.Canary)/batchSize + 1
+		}
+		o.Hosts = append(o.Hosts, &RolloutHost{Host: h, Batch: batch})
+	}
+	return o, nil
+}
+
+func (o *Rollout) start() {
+	go o.run(o.ctx)
+}
+
+func (o *Rollout) run(ctx context.Context) {
+	defer o.cancel()
+	last := o.Hosts[len(o.Hosts)-1].Batch
+	for batch := 0; batch <= last; batch++ {
+		var hosts []*RolloutHost
+		for _, h := range o.Hosts {
+			if h.Batch == batch {
+				hosts = append(hosts, h)
+			}
+		}
+		if len(hosts) == 0 {
+			// No canary
+			continue
+		}
+		if batch > 1 || (batch == 1 && o.Strategy.Canary > 0) {
+			select {
+			case <-time.After(time.Duration(o.Strategy.PauseSeconds) * time.Second):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			o.finish(RSCanceled, "")
+			return
+		}
+
+		o.Lock()
+		o.Batch = batch
+		o.Unlock()
+		log.Infof("rollout %s batch %d: %d hosts", o.Id, batch, len(hosts))
+
+		var wg sync.WaitGroup
+		for _, h := range hosts {
+			wg.Add(1)
+			go func(h *RolloutHost) {
+				defer wg.Done()
+				o.runHost(ctx, h)
+			}(h)
+		}
+		wg.Wait()
+
+		o.Lock()
+		failed := 0
+		for _, h := range o.Hosts {
+			if h.Status != "" && h.Status != JSFinished && h.Status != JSSkipped {
+				failed++
+			}
+		}
+		o.Failed = failed
+		o.Unlock()
+
+		if ctx.Err() != nil {
+			o.finish(RSCanceled, "")
+			return
+		}
+		if batch == 0 && failed > 0 {
+			o.finish(RSAborted, "canary failed")
+			return
+		}
+		if failed*100 > o.Strategy.MaxFailurePercent*len(o.Hosts) {
+			o.finish(RSAborted, "failures exceed max_failure_percent")
+			return
+		}
+	}
+	o.finish(RSFinished, "")
+}
+
+func (o *Rollout) finish(status RolloutStatus, reason string) {
+	o.Lock()
+	defer o.Unlock()
+	o.Status = status
+	o.Error = reason
+	o.FinishTime = time.Now()
+	log.Infof("rollout %s %s, failed: %d of %d hosts %s", o.Id, status, o.Failed, len(o.Hosts), reason)
+}
+
+// Run the cmd on the host synchronously. On cancel the local job is
+// canceled, while the job of a peer keeps running as the peer has no idea.
+func (o *Rollout) runHost(ctx context.Context, h *RolloutHost) {
+	var job *Job
+	var err error
+	if h.Host == rolloutSelf {
+		if job, err = startJob(o.req, o.tenant); err == nil {
+			select {
+			case <-job.Done():
+			case <-ctx.Done():
+				job.cancelFunc()
+				<-job.Done()
+			}
+			job = job.Snapshot()
+		}
+	} else {
+		job, err = runOnPeer(ctx, h.Host, o.req, o.token)
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	if err != nil {
+		h.Status, h.Error = JSFailed, err.Error()
+		return
+	}
+	h.JobId, h.Status, h.ExitCode, h.Error = job.Id, job.Status, job.ExitCode, job.Error
+}
+
+func runOnPeer(ctx context.Context, peer string, req *RunCmdReq, tok *Token) (*Job, error) {
+	if gPeerRegistry == nil {
+		return nil, errors.New("peers::urls is not configured")
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Errno ErrorCode `json:"errno"`
+		Error string    `json:"error"`
+		Data  *Job      `json:"data"`
+	}
+	if err = gPeerRegistry.call(ctx, http.MethodPost, peer+apiUrlPrefix+"/cmd/run", b, tok, &res); err != nil {
+		return nil, err
+	}
+	if res.Errno != ECSuccess || res.Data == nil {
+		return nil, errors.New(res.Error)
+	}
+	return res.Data, nil
+}
+
+// Handler to start a rollout, its id is returned at once
+func RunRolloutHandler(w http.ResponseWriter, r *http.Request) {
+	var req RolloutReq
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("failed to read r.Body: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to read body"))
+		return
+	}
+	defer r.Body.Close()
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		log.Errorf("failed to unmarshall data: %s body:%s", err, body)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to unmarshall data"))
+		return
+	}
+	if req.Req == nil || req.Req.Cmd == "" {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "param cmd is empty"))
+		return
+	}
+	if err := checkRunAs(RequestToken(r), req.Req.RunAs); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECForbidden, err.Error()))
+		return
+	}
+
+	ro, err := NewRollout(&req, tokenTenant(RequestToken(r)))
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	ro.token = RequestToken(r)
+	gRolloutBookkeeper.Add(ro)
+	ro.start()
+	log.Infof("rollout %s started, cmd: %s, hosts: %d", ro.Id, ro.Cmd, len(ro.Hosts))
+	ServeJSON(w, NewResponse().SetData(ro.Snapshot()))
+}
+
+func QueryRolloutHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.FormValue("id"))
+	ro := gRolloutBookkeeper.Get(id)
+	if ro == nil {
+		ServeJSON(w, NewResponse().SetError(ECRolloutNotFound, "rollout not found: "+id))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(ro.Snapshot()))
+}
+
+func ListRolloutHandler(w http.ResponseWriter, r *http.Request) {
+	ServeJSON(w, NewResponse().SetData(gRolloutBookkeeper.GetAll()))
+}
+
+// Handler to cancel a rollout, the running jobs of the batch are canceled
+func CancelRolloutHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.FormValue("id"))
+	ro := gRolloutBookkeeper.Get(id)
+	if ro == nil {
+		ServeJSON(w, NewResponse().SetError(ECRolloutNotFound, "rollout not found: "+id))
+		return
+	}
+	ro.cancel()
+	ServeJSON(w, NewResponse())
+}
+
+func init() {
+	gHttpServer.AddToUninit(UninitRollouts)
+}
+
+// Cancel the running rollouts when the agent stops, they go on across a
+// restart by a config apply
+func UninitRollouts() {
+	if gHttpServer.Restarting() {
+		return
+	}
+	gRolloutBookkeeper.RLock()
+	defer gRolloutBookkeeper.RUnlock()
+	for _, r := range gRolloutBookkeeper.rollouts {
+		r.cancel()
+	}
+}
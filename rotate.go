@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A log file rotated when it exceeds maxSize or a new day begins, the
+// rotated files are named <path>.<yyyymmdd-hhmmss.mmm>, at most maxBackups of
+// them are kept, and none older than maxAge.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+
+	f    *os.File
+	size int64
+	day  string
+	// Last backup stamp and the number of backups taken within it
+	stamp string
+	seq   int
+
+	sync.Mutex
+}
+
+func NewRotatingFile(path string, maxSize int64, maxBackups int, maxAge time.Duration) (*RotatingFile, error) {
+	o := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups, maxAge: maxAge}
+	if err := o.open(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *RotatingFile) Name() string {
+	return o.path
+}
+
+func (o *RotatingFile) open() error {
+	f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	o.f = f
+	o.size = fi.Size()
+	o.day = fi.ModTime().Format("20060102")
+	return nil
+}
+
+func (o *RotatingFile) Write(p []byte) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+	if o.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	if o.size > 0 && (o.size+int64(len(p)) > o.maxSize || time.Now().Format("20060102") != o.day) {
+		if err := o.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := o.f.Write(p)
+	o.size += int64(n)
+	o.day = time.Now().Format("20060102")
+	return n, err
+}
+
+func (o *RotatingFile) Close() error {
+	o.Lock()
+	defer o.Unlock()
+	if o.f == nil {
+		return nil
+	}
+	err := o.f.Close()
+	o.f = nil
+	return err
+}
+
+func (o *RotatingFile) rotate() error {
+	o.f.Close()
+	o.f = nil
+
+	stamp := time.Now().Format("20060102-150405.000")
+	if stamp == o.stamp {
+		o.seq++
+	} else {
+		o.stamp, o.seq = stamp, 0
+	}
+	backup := o.path + "." + stamp
+	if o.seq > 0 {
+		// Several rotations within a millisecond, keep them in order
+		backup = fmt.Sprintf("%s-%03d", backup, o.seq)
+	}
+	if err := os.Rename(o.path, backup); err != nil {
+		// Keep writing to the current file rather than losing the log
+		return o.open()
+	}
+	o.prune()
+	return o.open()
+}
+
+// Remove the backups beyond maxBackups or older than maxAge
+func (o *RotatingFile) prune() {
+	backups, err := filepath.Glob(o.path + ".*")
+	if err != nil {
+		return
+	}
+	// The names sort by time, the newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for i, b := range backups {
+		fi, err := os.Stat(b)
+		if err != nil {
+			continue
+		}
+		if (o.maxBackups > 0 && i >= o.maxBackups) || (o.maxAge > 0 && time.Since(fi.ModTime()) > o.maxAge) {
+			os.Remove(b)
+		}
+	}
+}
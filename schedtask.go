@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A schedule of the host itself, a file of /etc/cron.d on linux or a task of
+// the windows task scheduler, so it keeps running even if the agent is
+// removed. Only the tasks created by the agent are managed, they're kept
+// apart from the others by a prefix, shell-agent-<name> in /etc/cron.d and
+// \shell-agent\<name> in the task scheduler.
+type SchedTask struct {
+	Name  string `json:"name"`
+	Cron  string `json:"cron"`
+	Cmd   string `json:"cmd"`
+	RunAs string `json:"run_as,omitempty"` // The agent's user by default, linux only
+
+	// The native schedule and the next run time, windows only
+	Schedule string `json:"schedule,omitempty"`
+	NextRun  string `json:"next_run,omitempty"`
+}
+
+const schedTaskPrefix = "shell-agent"
+
+var schedTaskNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func (o *SchedTask) validate() error {
+	if !schedTaskNameRe.MatchString(o.Name) {
+		return errors.New("invalid param name, expect 1-64 letters, digits, _ and -")
+	}
+	if o.Cmd == "" {
+		return errors.New("param cmd is empty")
+	}
+	if strings.ContainsAny(o.Cmd, "\r\n") {
+		return errors.New("param cmd must be one line")
+	}
+	// A field of the cron entry, a space or a newline would add more
+	if o.RunAs != "" && !accountNameRe.MatchString(o.RunAs) {
+		return errors.New("invalid param run_as, expect a user name")
+	}
+	if _, err := ParseCron(o.Cron, nil); err != nil {
+		return errors.New("invalid cron: " + err.Error())
+	}
+	return nil
+}
+
+// Handler to list the tasks created by the agent
+func ListSchedTaskHandler(w http.ResponseWriter, r *http.Request) {
+	tasks, err := listSchedTasks()
+	if err != nil {
+		log.Errorf("list scheduled tasks failed: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECFileIOFailed, err.Error()))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(tasks))
+}
+
+// Handler to create a task, or replace the task of the same name
+func CreateSchedTaskHandler(w http.ResponseWriter, r *http.Request) {
+	var req SchedTask
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("failed to read r.Body: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to read body"))
+		return
+	}
+	defer r.Body.Close()
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		log.Errorf("failed to unmarshall data: %s body:%s", err, body)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to unmarshall data"))
+		return
+	}
+	if err := req.validate(); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	tok := RequestToken(r)
+	if err := checkRunAs(tok, req.RunAs); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECForbidden, err.Error()))
+		return
+	}
+	if !policyAllows(req.Cmd) {
+		log.Warnf("audit: scheduled task %s refused for %s, cmd: %s", req.Name, tokenTenant(tok), req.Cmd)
+		ServeJSON(w, NewResponse().SetError(ECForbidden, errCmdNotAllowed.Error()))
+		return
+	}
+
+	if err := createSchedTask(&req); err != nil {
+		log.Errorf("create scheduled task %s failed: %s", req.Name, err)
+		ServeJSON(w, NewResponse().SetError(ECFileIOFailed, err.Error()))
+		return
+	}
+	log.Infof("audit: scheduled task %s created by %s, cron: %s, cmd: %s, run_as: %s",
+		req.Name, tokenTenant(tok), req.Cron, req.Cmd, req.RunAs)
+	ServeJSON(w, NewResponse().SetData(&req))
+}
+
+func DeleteSchedTaskHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if !schedTaskNameRe.MatchString(name) {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid param name: "+name))
+		return
+	}
+	found, err := deleteSchedTask(name)
+	if err != nil {
+		log.Errorf("delete scheduled task %s failed: %s", name, err)
+		ServeJSON(w, NewResponse().SetError(ECFileIOFailed, err.Error()))
+		return
+	}
+	if !found {
+		ServeJSON(w, NewResponse().SetError(ECFileNotFound, "scheduled task not found: "+name))
+		return
+	}
+	log.Infof("audit: scheduled task %s deleted by %s", name, tokenTenant(RequestToken(r)))
+	ServeJSON(w, NewResponse())
+}
@@ -0,0 +1,120 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const cronDir = "/etc/cron.d"
+
+func schedTaskPath(name string) string {
+	return filepath.Join(cronDir, schedTaskPrefix+"-"+name)
+}
+
+func listSchedTasks() ([]*SchedTask, error) {
+	files, err := ioutil.ReadDir(cronDir)
+	if os.IsNotExist(err) {
+		return []*SchedTask{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tasks := []*SchedTask{}
+	for _, fi := range files {
+		name := strings.TrimPrefix(fi.Name(), schedTaskPrefix+"-")
+		if name == fi.Name() || fi.IsDir() {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(cronDir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if t := parseCronFile(name, string(b)); t != nil {
+			tasks = append(tasks, t)
+		}
+	}
+	return tasks, nil
+}
+
+// The task of the first entry of the file, nil if none
+func parseCronFile(name, content string) *SchedTask {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.Contains(strings.SplitN(line, " ", 2)[0], "=") {
+			continue
+		}
+		n := 5
+		if strings.HasPrefix(line, "@") {
+			n = 1
+		}
+		fields := strings.Fields(line)
+		if len(fields) < n+2 {
+			continue
+		}
+		// The cmd keeps its spaces
+		cmd := line
+		for i := 0; i <= n; i++ {
+			cmd = strings.TrimLeft(cmd, " \t")
+			cmd = cmd[strings.IndexAny(cmd, " \t"):]
+		}
+		return &SchedTask{
+			Name:  name,
+			Cron:  strings.Join(fields[:n], " "),
+			RunAs: fields[n],
+			Cmd:   strings.Replace(strings.TrimSpace(cmd), `\%`, "%", -1),
+		}
+	}
+	return nil
+}
+
+// Write the file of the task, cron picks it up by itself
+func createSchedTask(t *SchedTask) error {
+	if _, err := os.Stat(cronDir); err != nil {
+		return fmt.Errorf("%s is missing, is cron installed: %s", cronDir, err)
+	}
+	runAs := t.RunAs
+	if runAs == "" {
+		u, err := user.Current()
+		if err != nil {
+			return err
+		}
+		runAs = u.Username
+	}
+	// % is a newline to cron
+	content := fmt.Sprintf("# Created by shell-agent at %s\nSHELL=/bin/sh\n%s %s %s\n",
+		time.Now().Format(time.RFC3339), strings.Join(strings.Fields(t.Cron), " "), runAs,
+		strings.Replace(t.Cmd, "%", `\%`, -1))
+
+	path := schedTaskPath(t.Name)
+	f, err := ioutil.TempFile(cronDir, "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(content)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	// cron ignores the files writable by others
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func deleteSchedTask(name string) (bool, error) {
+	err := os.Remove(schedTaskPath(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
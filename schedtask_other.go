@@ -0,0 +1,22 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"errors"
+)
+
+var errSchedTaskUnsupported = errors.New("scheduled tasks are only supported on linux and windows")
+
+func listSchedTasks() ([]*SchedTask, error) {
+	return nil, errSchedTaskUnsupported
+}
+
+func createSchedTask(t *SchedTask) error {
+	return errSchedTaskUnsupported
+}
+
+func deleteSchedTask(name string) (bool, error) {
+	return false, errSchedTaskUnsupported
+}
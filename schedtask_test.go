@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestSchedTaskValidate(t *testing.T) {
+	for _, c := range []struct {
+		task SchedTask
+		ok   bool
+	}{
+		{SchedTask{Name: "backup", Cron: "30 2 * * *", Cmd: "/opt/backup/run.sh"}, true},
+		{SchedTask{Name: "backup", Cron: "30 2 * * *", Cmd: "/opt/backup/run.sh", RunAs: "postgres"}, true},
+		{SchedTask{Name: "backup", Cron: "30 2 * * *", Cmd: "a\nb"}, false},
+		// Extra fields or entries of the cron file
+		{SchedTask{Name: "backup", Cron: "30 2 * * *", Cmd: "true", RunAs: "nobody id"}, false},
+		{SchedTask{Name: "backup", Cron: "30 2 * * *", Cmd: "true", RunAs: "nobody true\n* * * * * root id"}, false},
+		{SchedTask{Name: "../x", Cron: "30 2 * * *", Cmd: "true"}, false},
+	} {
+		if err := c.task.validate(); (err == nil) != c.ok {
+			t.Errorf("run_as %q cmd %q: got %v", c.task.RunAs, c.task.Cmd, err)
+		}
+	}
+}
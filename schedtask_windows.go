@@ -0,0 +1,186 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// The columns of schtasks /query /v /fo csv, their headers are localized
+const (
+	schtasksColName      = 1
+	schtasksColNextRun   = 2
+	schtasksColTaskToRun = 8
+	schtasksColRunAs     = 14
+	schtasksColSchedule  = 18
+)
+
+var (
+	schtasksDays   = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+	schtasksMonths = []string{"", "JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+)
+
+func schedTaskPath(name string) string {
+	return `\` + schedTaskPrefix + `\` + name
+}
+
+func schtasks(args ...string) ([]byte, error) {
+	out, err := exec.Command("schtasks", args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// The cron of the task isn't kept by the task scheduler, the native schedule
+// is returned instead
+func listSchedTasks() ([]*SchedTask, error) {
+	out, err := schtasks("/query", "/v", "/fo", "csv", "/nh")
+	if err != nil {
+		return nil, err
+	}
+	r := csv.NewReader(bytes.NewReader(out))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	tasks := []*SchedTask{}
+	seen := make(map[string]bool)
+	prefix := schedTaskPath("")
+	for _, rec := range records {
+		if len(rec) <= schtasksColSchedule || !strings.HasPrefix(rec[schtasksColName], prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(rec[schtasksColName], prefix)
+		// A row per trigger
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		tasks = append(tasks, &SchedTask{
+			Name:     name,
+			Cmd:      strings.TrimPrefix(rec[schtasksColTaskToRun], "cmd /c "),
+			RunAs:    rec[schtasksColRunAs],
+			Schedule: rec[schtasksColSchedule],
+			NextRun:  rec[schtasksColNextRun],
+		})
+	}
+	return tasks, nil
+}
+
+// Create the task running as SYSTEM, replacing the one of the same name
+func createSchedTask(t *SchedTask) error {
+	if t.RunAs != "" {
+		return errors.New("run_as is only supported on linux, the task runs as SYSTEM")
+	}
+	sc, err := schtasksSchedule(t.Cron)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"/create", "/f", "/tn", schedTaskPath(t.Name), "/tr", "cmd /c " + t.Cmd, "/ru", "SYSTEM"}, sc...)
+	_, err = schtasks(args...)
+	return err
+}
+
+func deleteSchedTask(name string) (bool, error) {
+	if _, err := schtasks("/query", "/tn", schedTaskPath(name)); err != nil {
+		return false, nil
+	}
+	_, err := schtasks("/delete", "/f", "/tn", schedTaskPath(name))
+	return err == nil, err
+}
+
+// The schtasks schedule of the cron, only the crons a trigger of the task
+// scheduler can express are supported
+func schtasksSchedule(spec string) ([]string, error) {
+	spec = strings.TrimSpace(spec)
+	if m, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = m
+	}
+	f := strings.Fields(spec)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("invalid cron %q", spec)
+	}
+	unsupported := fmt.Errorf("cron %q can't be expressed by the windows task scheduler, "+
+		"use */N * * * *, M */N * * *, or M H with a day of month or days of week", spec)
+
+	every := func(s string) (int, bool) {
+		if s == "*" {
+			return 1, true
+		}
+		if strings.HasPrefix(s, "*/") {
+			n, err := strconv.Atoi(s[2:])
+			return n, err == nil
+		}
+		return 0, false
+	}
+	single := func(s string, i int) (int, bool) {
+		v, err := cronFields[i].value(s)
+		return v, err == nil
+	}
+
+	if n, ok := every(f[0]); ok && f[1] == "*" && f[2] == "*" && f[3] == "*" && f[4] == "*" {
+		return []string{"/sc", "minute", "/mo", strconv.Itoa(n)}, nil
+	}
+	m, ok := single(f[0], 0)
+	if !ok {
+		return nil, unsupported
+	}
+	if n, ok := every(f[1]); ok && f[2] == "*" && f[3] == "*" && f[4] == "*" {
+		return []string{"/sc", "hourly", "/mo", strconv.Itoa(n), "/st", fmt.Sprintf("00:%02d", m)}, nil
+	}
+	h, ok := single(f[1], 1)
+	if !ok {
+		return nil, unsupported
+	}
+	st := fmt.Sprintf("%02d:%02d", h, m)
+
+	switch {
+	case f[2] == "*" && f[3] == "*" && f[4] == "*":
+		return []string{"/sc", "daily", "/st", st}, nil
+	case f[2] == "*" && f[3] == "*":
+		bits, err := parseCronField(f[4], cronFields[4])
+		if err != nil {
+			return nil, err
+		}
+		var days []string
+		for i := 0; i < 7; i++ {
+			if bits&(1<<uint(i)) != 0 || (i == 0 && bits&(1<<7) != 0) {
+				days = append(days, schtasksDays[i])
+			}
+		}
+		return []string{"/sc", "weekly", "/d", strings.Join(days, ","), "/st", st}, nil
+	case f[4] == "*":
+		d, ok := single(f[2], 2)
+		if !ok {
+			return nil, unsupported
+		}
+		sc := []string{"/sc", "monthly", "/d", strconv.Itoa(d), "/st", st}
+		if f[3] != "*" {
+			bits, err := parseCronField(f[3], cronFields[3])
+			if err != nil {
+				return nil, err
+			}
+			var months []string
+			for i := 1; i <= 12; i++ {
+				if bits&(1<<uint(i)) != 0 {
+					months = append(months, schtasksMonths[i])
+				}
+			}
+			sc = append(sc, "/m", strings.Join(months, ","))
+		}
+		return sc, nil
+	}
+	return nil, unsupported
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nu7hatch/gouuid"
+)
+
+// Recurring jobs run by the agent at the times of a cron expression. The
+// schedules and the outcomes of their recent runs are kept in
+// schedule::dir/schedules.json. The runs missed while the agent was down
+// are not made up. A schedule failing max_failures times in a row is paused
+// until it is resumed.
+
+type Schedule struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	Cron       string     `json:"cron"`
+	Tz         string     `json:"tz,omitempty"` // Local if empty
+	Req        *RunCmdReq `json:"req"`
+	Tenant     string     `json:"tenant,omitempty"`
+	CreateTime time.Time  `json:"create_time"`
+	NextRun    *time.Time `json:"next_run,omitempty"` // Nil if paused or never again
+	// The jobs run as the service account rather than the tenant
+	ServiceAccount string `json:"service_account,omitempty"`
+	// Pause after the consecutive failures, schedule::max_failures if 0,
+	// never if negative
+	MaxFailures int `json:"max_failures,omitempty"`
+	// Notified of the pause
+	Webhook  string `json:"webhook,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Failures int    `json:"failures"` // The consecutive failed runs
+	// Managed by the policy, replaced or removed as the policy changes
+	Policy      bool   `json:"policy,omitempty"`
+	Paused      bool   `json:"paused,omitempty"`
+	PauseReason string `json:"pause_reason,omitempty"`
+	// The recent runs, the oldest first
+	History []*ScheduleRun `json:"history,omitempty"`
+
+	cron  *CronSchedule
+	timer *time.Timer
+}
+
+// A run of a schedule
+type ScheduleRun struct {
+	JobId      string    `json:"job_id,omitempty"`
+	Time       time.Time `json:"time"` // When it was due
+	Status     JobStatus `json:"status"`
+	ExitCode   int       `json:"exit_code"`
+	Error      string    `json:"error,omitempty"`
+	FinishTime time.Time `json:"finish_time,omitempty"`
+	Duration   float64   `json:"duration_seconds"` // From the start of the process to the finish
+}
+
+type ScheduleReq struct {
+	Name        string     `json:"name,omitempty"`
+	Cron        string     `json:"cron"`
+	Tz          string     `json:"tz,omitempty"`
+	Req         *RunCmdReq `json:"req"`
+	MaxFailures int        `json:"max_failures,omitempty"`
+	Webhook     string     `json:"webhook,omitempty"`
+	Email       string     `json:"email,omitempty"`
+
+	ServiceAccount string `json:"service_account,omitempty"`
+}
+
+type ScheduleRes struct {
+	*Schedule
+	LastRun *ScheduleRun `json:"last_run,omitempty"`
+}
+
+const scheduleMaxHistory = 100
+
+type Schedules struct {
+	path string
+
+	mu        sync.Mutex
+	schedules map[string]*Schedule
+}
+
+var (
+	gSchedules *Schedules
+)
+
+func init() {
+	gHttpServer.AddToInit(InitSchedules)
+	gHttpServer.AddToUninit(UninitSchedules)
+}
+
+func InitSchedules() error {
+	gSchedules = NewSchedules(filepath.Join(gApp.Cnf.ScheduleDir, "schedules.json"))
+	return gSchedules.load()
+}
+
+func UninitSchedules() {
+	gSchedules.Close()
+}
+
+func NewSchedules(path string) *Schedules {
+	return &Schedules{path: path, schedules: make(map[string]*Schedule)}
+}
+
+func (o *Schedules) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, s := range o.schedules {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+	}
+}
+
+func (o *Schedules) load() error {
+	b, err := ioutil.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*Schedule
+	if err = json.Unmarshal(b, &list); err != nil {
+		return errors.New("invalid " + o.path + ": " + err.Error())
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, s := range list {
+		if s.cron, err = parseCronIn(s.Cron, s.Tz); err != nil {
+			log.Errorf("schedule %s not loaded: %s", s.Id, err)
+			continue
+		}
+		// Their jobs are gone with the last process
+		for _, run := range s.History {
+			if run.FinishTime.IsZero() {
+				run.Status = JSFailed
+				run.Error = "interrupted by a restart of the agent"
+			}
+		}
+		o.schedules[s.Id] = s
+		o.arm(s)
+	}
+	log.Infof("%d schedules loaded from %s", len(o.schedules), o.path)
+	return nil
+}
+
+// Called with mu held
+func (o *Schedules) save() {
+	list := make([]*Schedule, 0, len(o.schedules))
+	for _, s := range o.schedules {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreateTime.Before(list[j].CreateTime) })
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(o.path, b, 0600)
+	}
+	if err != nil {
+		log.Errorf("save schedules to %s failed: %s", o.path, err)
+	}
+}
+
+// Set the timer of the next run unless paused, called with mu held
+func (o *Schedules) arm(s *Schedule) {
+	s.NextRun, s.timer = nil, nil
+	if s.Paused {
+		return
+	}
+	next := s.cron.Next(time.Now())
+	if next.IsZero() {
+		return
+	}
+	id := s.Id
+	s.NextRun = &next
+	s.timer = time.AfterFunc(time.Until(next), func() { o.fire(id) })
+}
+
+func (o *Schedules) Add(req *ScheduleReq, tenant string) (*Schedule, error) {
+	s, err := newSchedule(req, tenant)
+	if err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.schedules[s.Id] = s
+	o.arm(s)
+	o.save()
+	return s, nil
+}
+
+func newSchedule(req *ScheduleReq, tenant string) (*Schedule, error) {
+	cron, err := parseCronIn(req.Cron, req.Tz)
+	if err != nil {
+		return nil, err
+	}
+	if cron.Next(time.Now()).IsZero() {
+		return nil, errors.New("invalid cron: it never runs")
+	}
+	u4, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	s := &Schedule{
+		Id:          u4.String(),
+		Name:        req.Name,
+		Cron:        req.Cron,
+		Tz:          req.Tz,
+		Req:         req.Req,
+		Tenant:      tenant,
+		CreateTime:  time.Now(),
+		MaxFailures: req.MaxFailures,
+		Webhook:     req.Webhook,
+		Email:       req.Email,
+		cron:        cron,
+
+		ServiceAccount: req.ServiceAccount,
+	}
+	return s, nil
+}
+
+// Replace the schedules of the policy by those given, a schedule unchanged
+// by name keeps its history and failures
+func (o *Schedules) SyncPolicy(reqs []*ScheduleReq) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	current := make(map[string]*Schedule)
+	for _, s := range o.schedules {
+		if s.Policy {
+			current[s.Name] = s
+		}
+	}
+	for _, req := range reqs {
+		if s := current[req.Name]; s != nil {
+			delete(current, req.Name)
+			if reflect.DeepEqual(s.req(), req) {
+				continue
+			}
+			o.remove(s)
+		}
+		s, err := newSchedule(req, policyTenant)
+		if err != nil {
+			log.Errorf("schedule %s of the policy not added: %s", req.Name, err)
+			continue
+		}
+		s.Policy = true
+		o.schedules[s.Id] = s
+		o.arm(s)
+		log.Infof("schedule %s of the policy added as %s, cron: %s", s.Name, s.Id, s.Cron)
+	}
+	for _, s := range current {
+		o.remove(s)
+		log.Infof("schedule %s of the policy removed", s.Name)
+	}
+	o.save()
+}
+
+// Add the schedules of a library imported by the tenant, replacing the local
+// ones of the same names, the unnamed ones are matched by their requests. A
+// schedule unchanged keeps its history. Only the changes are reported if dry.
+func (o *Schedules) Import(reqs []*ScheduleReq, tenant string, dry bool) (*LibraryChanges, error) {
+	added := make([]*Schedule, len(reqs))
+	for i, req := range reqs {
+		s, err := newSchedule(req, tenant)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %s", scheduleLabel(req), err)
+		}
+		added[i] = s
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	changes := &LibraryChanges{}
+	for i, req := range reqs {
+		var cur *Schedule
+		for _, s := range o.schedules {
+			if !s.Policy && s.Name == req.Name && (req.Name != "" || reflect.DeepEqual(s.req(), req)) {
+				cur = s
+				break
+			}
+		}
+		switch {
+		case cur == nil:
+			changes.Added = append(changes.Added, scheduleLabel(req))
+		case reflect.DeepEqual(cur.req(), req):
+			changes.Unchanged = append(changes.Unchanged, scheduleLabel(req))
+			continue
+		default:
+			changes.Updated = append(changes.Updated, scheduleLabel(req))
+		}
+		if dry {
+			continue
+		}
+		if cur != nil {
+			o.remove(cur)
+		}
+		o.schedules[added[i].Id] = added[i]
+		o.arm(added[i])
+	}
+	if !dry {
+		o.save()
+	}
+	return changes, nil
+}
+
+// The name of the schedule, else its cron and cmd
+func scheduleLabel(req *ScheduleReq) string {
+	if req.Name != "" {
+		return req.Name
+	}
+	return req.Cron + " " + strings.TrimSpace(req.Req.Cmd)
+}
+
+// The request creating the schedule
+func (o *Schedule) req() *ScheduleReq {
+	return &ScheduleReq{Name: o.Name, Cron: o.Cron, Tz: o.Tz, Req: o.Req,
+		MaxFailures: o.MaxFailures, Webhook: o.Webhook, Email: o.Email, ServiceAccount: o.ServiceAccount}
+}
+
+// Called with mu held
+func (o *Schedules) remove(s *Schedule) {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	delete(o.schedules, s.Id)
+}
+
+func (o *Schedules) Remove(id string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := o.schedules[id]
+	if s == nil {
+		return false
+	}
+	o.remove(s)
+	o.save()
+	return true
+}
+
+// Clear the failures of the schedule and run it again if paused, nil if not
+// found
+func (o *Schedules) Resume(id string) *ScheduleRes {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := o.schedules[id]
+	if s == nil {
+		return nil
+	}
+	s.Failures = 0
+	if s.Paused {
+		s.Paused, s.PauseReason = false, ""
+		o.arm(s)
+	}
+	o.save()
+	return s.res()
+}
+
+// A copy of the schedule without the history
+func (o *Schedules) Get(id string) *ScheduleRes {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if s := o.schedules[id]; s != nil {
+		return s.res()
+	}
+	return nil
+}
+
+func (o *Schedules) List() []*ScheduleRes {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	res := make([]*ScheduleRes, 0, len(o.schedules))
+	for _, s := range o.schedules {
+		res = append(res, s.res())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CreateTime.Before(res[j].CreateTime) })
+	return res
+}
+
+// The recent runs of the schedule, the latest first, nil if not found
+func (o *Schedules) History(id string, limit int) []*ScheduleRun {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := o.schedules[id]
+	if s == nil {
+		return nil
+	}
+	res := []*ScheduleRun{}
+	for i := len(s.History) - 1; i >= 0 && (limit <= 0 || len(res) < limit); i-- {
+		run := *s.History[i]
+		res = append(res, &run)
+	}
+	return res
+}
+
+// Called with mu held
+func (o *Schedule) res() *ScheduleRes {
+	s := *o
+	s.History = nil
+	res := &ScheduleRes{Schedule: &s}
+	if n := len(o.History); n > 0 {
+		run := *o.History[n-1]
+		res.LastRun = &run
+	}
+	return res
+}
+
+// Called with mu held
+func (o *Schedule) addRun(run *ScheduleRun) {
+	o.History = append(o.History, run)
+	if n := len(o.History) - scheduleMaxHistory; n > 0 {
+		o.History = append([]*ScheduleRun{}, o.History[n:]...)
+	}
+}
+
+// Count the failure streak by the finished run, and pause the schedule when
+// it reaches max_failures. Called with mu held, true if paused by the run.
+func (o *Schedule) countRun(run *ScheduleRun) bool {
+	switch run.Status {
+	case JSFinished:
+		o.Failures = 0
+	case JSFailed, JSTimedOut:
+		o.Failures++
+	default:
+		return false
+	}
+	max := o.MaxFailures
+	if max == 0 {
+		max = gApp.Cnf.ScheduleMaxFailures
+	}
+	if o.Paused || max <= 0 || o.Failures < max {
+		return false
+	}
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+	o.Paused = true
+	o.PauseReason = fmt.Sprintf("%d consecutive failures, the last: %s", o.Failures, run.Error)
+	o.NextRun, o.timer = nil, nil
+	return true
+}
+
+// Tell the paused schedule to its webhook and email
+func notifySchedulePaused(s *ScheduleRes) {
+	log.Warnf("schedule %s paused: %s", s.Id, s.PauseReason)
+	what := "schedule " + s.Id
+	if s.Webhook != "" {
+		go postWebhook(s.Webhook, what, s)
+	}
+	if s.Email != "" {
+		body := fmt.Sprintf("Name: %s\r\nCron: %s\r\nCmd: %s\r\nReason: %s\r\n", s.Name, s.Cron, s.Req.Cmd, s.PauseReason)
+		go sendEmail(s.Email, what, what+" paused", body)
+	}
+}
+
+// Start the job of the schedule and set the timer of the next run
+func (o *Schedules) fire(id string) {
+	o.mu.Lock()
+	s := o.schedules[id]
+	if s == nil || s.Paused || s.NextRun == nil {
+		o.mu.Unlock()
+		return
+	}
+	run := &ScheduleRun{Time: *s.NextRun, Status: JSQueued}
+	req := *s.Req
+	req.Async = true
+	req.scheduleId = s.Id
+	account := s.ServiceAccount
+	tenant := s.Tenant
+	o.arm(s)
+	o.mu.Unlock()
+
+	var job *Job
+	tenant, err := runTenant(account, tenant, &req)
+	if err == nil {
+		job, err = startJob(&req, tenant)
+	}
+	if err == nil && account != "" {
+		log.Infof("audit: schedule %s runs job %s as service account %s", id, job.Id, account)
+	}
+
+	var paused *ScheduleRes
+	o.mu.Lock()
+	if err != nil {
+		log.Warnf("job of schedule %s not started: %s", id, err)
+		run.Status, run.Error, run.FinishTime = JSFailed, err.Error(), time.Now()
+		if s.countRun(run) {
+			paused = s.res()
+		}
+	} else {
+		run.JobId = job.Id
+	}
+	s.addRun(run)
+	o.save()
+	o.mu.Unlock()
+
+	if paused != nil {
+		notifySchedulePaused(paused)
+	}
+
+	if job != nil {
+		go o.wait(s, run, job)
+	}
+}
+
+// Record the outcome of the run when its job finishes
+func (o *Schedules) wait(s *Schedule, run *ScheduleRun, job *Job) {
+	<-job.Done()
+	snap := job.Snapshot()
+	var started time.Time
+	for _, ev := range job.Events(0) {
+		if ev.Type == JEStarted {
+			started = ev.Time
+		}
+	}
+
+	var paused *ScheduleRes
+	o.mu.Lock()
+	run.Status, run.ExitCode, run.Error, run.FinishTime = snap.Status, snap.ExitCode, snap.Error, snap.FinishTime
+	if !started.IsZero() {
+		run.Duration = float64(int(snap.FinishTime.Sub(started).Seconds()*1000)) / 1000
+	}
+	if o.schedules[s.Id] == s {
+		if s.countRun(run) {
+			paused = s.res()
+		}
+		o.save()
+	}
+	o.mu.Unlock()
+
+	if paused != nil {
+		notifySchedulePaused(paused)
+	}
+}
+
+// Validate the request of a schedule created by the token, its job is made
+// async
+func checkScheduleReq(tok *Token, req *ScheduleReq) (ErrorCode, error) {
+	if strings.TrimSpace(req.Cron) == "" {
+		return ECInvalidParam, errors.New("param cron is empty")
+	}
+	if req.Req == nil {
+		return ECInvalidParam, errors.New("param req is empty")
+	}
+	if req.Req.RunAt != nil {
+		return ECInvalidParam, errors.New("param run_at is not supported by schedules")
+	}
+	if err := checkNotifyTargets(req.Webhook, &req.Email); err != nil {
+		return ECInvalidParam, err
+	}
+	req.Req.Async = true
+	if err := req.Req.validate(); err != nil {
+		return ECInvalidParam, err
+	}
+	return checkServiceAccount(tok, req.ServiceAccount, req.Req)
+}
+
+// Handler to create a schedule running the job at the times of the cron
+func CreateScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var req ScheduleReq
+	if !parseJSONBody(w, r, &req) {
+		return
+	}
+	if code, err := checkScheduleReq(RequestToken(r), &req); err != nil {
+		ServeJSON(w, NewResponse().SetError(code, err.Error()))
+		return
+	}
+
+	s, err := gSchedules.Add(&req, tokenTenant(RequestToken(r)))
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	log.Infof("audit: schedule %s created by %s, cron: %s, cmd: %s, service account: %s",
+		s.Id, s.Tenant, s.Cron, s.Req.Cmd, s.ServiceAccount)
+	ServeJSON(w, NewResponse().SetData(gSchedules.Get(s.Id)))
+}
+
+func ListScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	ServeJSON(w, NewResponse().SetData(gSchedules.List()))
+}
+
+func DeleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.FormValue("id"))
+	if !gSchedules.Remove(id) {
+		ServeJSON(w, NewResponse().SetError(ECScheduleNotFound, "schedule not found: "+id))
+		return
+	}
+	log.Infof("audit: schedule %s deleted by %s", id, tokenTenant(RequestToken(r)))
+	ServeJSON(w, NewResponse())
+}
+
+// Handler to resume a paused schedule, its failures are cleared
+func ResumeScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.FormValue("id"))
+	s := gSchedules.Resume(id)
+	if s == nil {
+		ServeJSON(w, NewResponse().SetError(ECScheduleNotFound, "schedule not found: "+id))
+		return
+	}
+	log.Infof("audit: schedule %s resumed by %s", id, tokenTenant(RequestToken(r)))
+	ServeJSON(w, NewResponse().SetData(s))
+}
+
+// Handler to get the recent runs of a schedule with their outcomes, the
+// latest first
+func ScheduleHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.FormValue("id"))
+	limit := 0
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid param limit: "+s))
+			return
+		}
+	}
+	runs := gSchedules.History(id, limit)
+	if runs == nil {
+		ServeJSON(w, NewResponse().SetError(ECScheduleNotFound, "schedule not found: "+id))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(runs))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The jobs submitted with run_at wait here until their time, then are queued
+// like the others. Their requests are kept in schedule::dir/delayed, so they
+// are scheduled again with the same ids after a restart, and the overdue
+// ones are queued at once.
+type DelayedJobs struct {
+	dir string
+
+	mu   sync.Mutex
+	jobs map[string]*delayedJob
+}
+
+type delayedJob struct {
+	job   *Job
+	ctx   context.Context
+	timer *time.Timer
+}
+
+// The file of a delayed job
+type delayedJobRecord struct {
+	Id     string     `json:"id"`
+	Tenant string     `json:"tenant,omitempty"`
+	Req    *RunCmdReq `json:"req"`
+}
+
+var (
+	gDelayedJobs *DelayedJobs
+)
+
+func init() {
+	gHttpServer.AddToInit(InitDelayedJobs)
+	gHttpServer.AddToUninit(UninitDelayedJobs)
+}
+
+func InitDelayedJobs() error {
+	// Their jobs are kept in the bookkeeper across a restart by a config apply
+	if gDelayedJobs != nil && gHttpServer.Restarting() {
+		return nil
+	}
+	gDelayedJobs = NewDelayedJobs(filepath.Join(gApp.Cnf.ScheduleDir, "delayed"))
+	gDelayedJobs.restore()
+	return nil
+}
+
+func UninitDelayedJobs() {
+	if gHttpServer.Restarting() {
+		return
+	}
+	gDelayedJobs.Close()
+}
+
+func NewDelayedJobs(dir string) *DelayedJobs {
+	return &DelayedJobs{dir: dir, jobs: make(map[string]*delayedJob)}
+}
+
+// Stop the timers, the files are kept for the next start
+func (o *DelayedJobs) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, d := range o.jobs {
+		d.timer.Stop()
+	}
+	o.jobs = make(map[string]*delayedJob)
+}
+
+func (o *DelayedJobs) path(id string) string {
+	return filepath.Join(o.dir, id+".json")
+}
+
+// Keep the request of the job and queue it at its run_at
+func (o *DelayedJobs) Add(job *Job, ctx context.Context, req *RunCmdReq) error {
+	b, err := json.Marshal(&delayedJobRecord{Id: job.Id, Tenant: job.Tenant, Req: req})
+	if err != nil {
+		return err
+	}
+	if err = writeFileSealed(o.path(job.Id), b, 0600); err != nil {
+		log.Errorf("keep delayed job %s failed: %s", job.Id, err)
+		return err
+	}
+	o.schedule(job, ctx, *req.RunAt)
+	return nil
+}
+
+func (o *DelayedJobs) schedule(job *Job, ctx context.Context, runAt time.Time) {
+	runAt = runAt.UTC()
+	job.record(JobEvent{Type: JEScheduled, RunAt: &runAt})
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.jobs[job.Id] = &delayedJob{
+		job:   job,
+		ctx:   ctx,
+		timer: time.AfterFunc(time.Until(runAt), func() { o.fire(job.Id) }),
+	}
+	log.Infof("job %s scheduled at %s, cmd: %s", job.Id, runAt.Format(time.RFC3339), job.Cmd)
+}
+
+// Queue the job whose time has come
+func (o *DelayedJobs) fire(id string) {
+	o.mu.Lock()
+	d := o.jobs[id]
+	delete(o.jobs, id)
+	o.mu.Unlock()
+	if d == nil {
+		return
+	}
+	os.Remove(o.path(id))
+
+	if !d.job.queueScheduled() {
+		return
+	}
+	if err := submitJob(d.ctx, d.job); err != nil {
+		log.Warnf("reject delayed job %s: %s", id, err)
+		finishUnrun(d.job, JSFailed, err.Error())
+	}
+}
+
+// The number of the jobs waiting for their run_at
+func (o *DelayedJobs) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.jobs)
+}
+
+// Forget the job canceled before its run_at
+func (o *DelayedJobs) Remove(id string) {
+	o.mu.Lock()
+	d := o.jobs[id]
+	delete(o.jobs, id)
+	o.mu.Unlock()
+	if d == nil {
+		return
+	}
+	d.timer.Stop()
+	os.Remove(o.path(id))
+}
+
+// Schedule the kept jobs again
+func (o *DelayedJobs) restore() {
+	files, _ := filepath.Glob(filepath.Join(o.dir, "*.json"))
+	n := 0
+	for _, f := range files {
+		var rec delayedJobRecord
+		b, err := readFileSealed(f)
+		if err != nil {
+			// Kept for a start with the right key
+			log.Errorf("restore delayed job %s failed: %s", f, err)
+			continue
+		}
+		err = json.Unmarshal(b, &rec)
+		if err == nil && (rec.Req == nil || rec.Req.RunAt == nil || rec.Id+".json" != filepath.Base(f)) {
+			err = os.ErrInvalid
+		}
+		if err != nil {
+			log.Errorf("invalid delayed job %s removed: %s", f, err)
+			os.Remove(f)
+			continue
+		}
+		job, ctx, err := newJob(rec.Req, rec.Id)
+		if err != nil {
+			// Kept for the next start
+			log.Errorf("restore delayed job %s failed: %s", rec.Id, err)
+			continue
+		}
+		job.Tenant = rec.Tenant
+		o.schedule(job, ctx, *rec.Req.RunAt)
+		n++
+	}
+	if n > 0 {
+		log.Infof("%d delayed jobs restored from %s", n, o.dir)
+	}
+}
+
+// Finish a job which never ran
+func finishUnrun(job *Job, status JobStatus, msg string) {
+	job.record(JobEvent{Type: JEFinished, Status: status, Error: msg})
+	job.sign()
+	job.closeOutput()
+}
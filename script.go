@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// The script of a job is written to a file of job::script_dir and the file
+// is run, rather than passing the cmd on the command line, so neither the
+// shell quoting nor the command line length of windows limits it. On unix a
+// script starting with #! is run by its interpreter, otherwise by sh; on
+// windows it is a .cmd file, or a .ps1 one if job::shell is powershell.
+
+// Write the script of the job, the args running it and the file to remove
+// after the run are returned
+func writeJobScript(job *Job) ([]string, string, error) {
+	dir := gApp.Cnf.JobScriptDir
+	// The users of run_as pass through, but can't list it
+	if err := os.MkdirAll(dir, 0711); err != nil {
+		return nil, "", err
+	}
+	if err := os.Chmod(dir, 0711); err != nil {
+		return nil, "", err
+	}
+	shell := gApp.Cnf.JobShell
+	ext := ""
+	if runtime.GOOS == "windows" {
+		ext = ".cmd"
+		if len(shell) > 0 && isPowerShell(shell[0]) {
+			ext = ".ps1"
+		}
+	}
+	path, err := filepath.Abs(filepath.Join(dir, job.Id+ext))
+	if err != nil {
+		return nil, "", err
+	}
+	if err = writeFileAtomic(path, []byte(job.Cmd), 0700); err != nil {
+		return nil, "", err
+	}
+	if job.RunAs != "" {
+		u, err := user.Lookup(job.RunAs)
+		if err == nil {
+			err = chownToUser(path, u)
+		}
+		if err != nil {
+			os.Remove(path)
+			return nil, "", err
+		}
+	}
+
+	var args []string
+	switch {
+	case len(shell) > 0:
+		args = append(append([]string{}, shell...), path)
+	case runtime.GOOS == "windows":
+		args = []string{"cmd", "/c", path}
+	case strings.HasPrefix(job.Cmd, "#!"):
+		args = []string{path}
+	default:
+		args = []string{"sh", path}
+	}
+	return args, path, nil
+}
+
+func isPowerShell(exe string) bool {
+	name := strings.ToLower(strings.TrimSuffix(filepath.Base(exe), filepath.Ext(exe)))
+	return name == "powershell" || name == "pwsh"
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Scrubbing rewrites the kept output of the finished jobs by redaction rules,
+// e.g. when a credential turns out to be leaked in past outputs. The jobs
+// still running are skipped, scrub again after they finish.
+
+type ScrubRule struct {
+	Pattern string `json:"pattern"`           // A regexp
+	Replace string `json:"replace,omitempty"` // <redacted> if empty, $1 expands to the submatch
+}
+
+type ScrubReq struct {
+	Rules  []*ScrubRule `json:"rules"`
+	DryRun bool         `json:"dry_run,omitempty"`
+}
+
+type ScrubReport struct {
+	DryRun   bool `json:"dry_run,omitempty"`
+	Scanned  int  `json:"scanned"`  // Finished jobs
+	Skipped  int  `json:"skipped"`  // Unfinished jobs
+	Modified int  `json:"modified"` // Jobs whose output matched
+	Matches  int  `json:"matches"`
+	// The first scrubMaxReportJobs modified
+	Jobs   []string `json:"jobs,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+const scrubMaxReportJobs = 100
+
+type scrubber struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+func compileScrubRules(rules []*ScrubRule) ([]*scrubber, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("param rules is empty")
+	}
+	var res []*scrubber
+	for i, r := range rules {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil || r.Pattern == "" {
+			return nil, errors.New("invalid pattern of rule " + strconv.Itoa(i) + ": " + r.Pattern)
+		}
+		s := &scrubber{re: re, replace: r.Replace}
+		if s.replace == "" {
+			s.replace = redacted
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// Apply the rules to s, with the number of matches
+func scrubString(s string, rules []*scrubber) (string, int) {
+	n := 0
+	for _, r := range rules {
+		if m := len(r.re.FindAllStringIndex(s, -1)); m > 0 {
+			n += m
+			s = r.re.ReplaceAllString(s, r.replace)
+		}
+	}
+	return s, n
+}
+
+// Scrub the output of all the finished jobs
+func scrubJobs(rules []*scrubber, dryRun bool) *ScrubReport {
+	res := &ScrubReport{DryRun: dryRun}
+	for _, j := range gJobBookkeeper.GetAll() {
+		n, err := j.scrub(rules, dryRun)
+		if err == errJobUnfinished {
+			res.Skipped++
+			continue
+		}
+		res.Scanned++
+		if err != nil {
+			res.Errors = append(res.Errors, j.Id+": "+err.Error())
+			log.Errorf("scrub the output of job %s failed: %s", j.Id, err)
+		}
+		if n > 0 {
+			res.Modified++
+			res.Matches += n
+			if len(res.Jobs) < scrubMaxReportJobs {
+				res.Jobs = append(res.Jobs, j.Id)
+			}
+		}
+	}
+	return res
+}
+
+var errJobUnfinished = errors.New("job is not finished")
+
+// Rewrite the output of the finished job by the rules and sign it again,
+// the matches are returned
+func (o *Job) scrub(rules []*scrubber, dryRun bool) (int, error) {
+	o.mu.Lock()
+	if !o.outputDone {
+		o.mu.Unlock()
+		return 0, errJobUnfinished
+	}
+	stdout, stderr := o.outputLocked()
+	stdout, n1 := scrubString(stdout, rules)
+	stderr, n2 := scrubString(stderr, rules)
+	var err error
+	if !dryRun && n1 > 0 {
+		err = o.stdout.replace([]byte(stdout))
+	}
+	if !dryRun && n2 > 0 && err == nil {
+		err = o.stderr.replace([]byte(stderr))
+	}
+	o.mu.Unlock()
+
+	if !dryRun && n1+n2 > 0 {
+		o.sign()
+	}
+	return n1 + n2, err
+}
+
+// Replace the output of the finished job, on disk if it was spilled.
+// Called with the job's mu held.
+func (o *outputWriter) replace(data []byte) error {
+	spilled := o.spillSize > 0
+	if spilled {
+		if err := writeFileAtomic(o.path, data, 0600); err != nil {
+			return err
+		}
+	}
+	for _, b := range o.blocks {
+		o.putBlock(b)
+	}
+	o.blocks = nil
+	o.job.mem -= o.memSize
+	gMemoryGuard.Add(-o.memSize)
+	o.memSize = 0
+	if spilled {
+		o.spillSize = int64(len(data))
+		if o.spillSize == 0 {
+			os.Remove(o.path)
+		}
+		return nil
+	}
+	if len(data) > 0 {
+		o.blocks = []*[]byte{&data}
+		o.memSize = int64(len(data))
+		o.job.mem += o.memSize
+		gMemoryGuard.Add(o.memSize)
+	}
+	return nil
+}
+
+// Handler to rewrite the kept output of the finished jobs by redaction
+// rules, or only count the matches with dry_run
+func ScrubJobsHandler(w http.ResponseWriter, r *http.Request) {
+	var req ScrubReq
+	if !parseJSONBody(w, r, &req) {
+		return
+	}
+	rules, err := compileScrubRules(req.Rules)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	res := scrubJobs(rules, req.DryRun)
+	if !req.DryRun {
+		log.Infof("audit: output of %d jobs scrubbed by %s, %d matches of %d rules",
+			res.Modified, tokenTenant(RequestToken(r)), res.Matches, len(rules))
+	}
+	ServeJSON(w, NewResponse().SetData(res))
+}
@@ -0,0 +1,139 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// The seccomp filter is loaded by the agent itself, re-executed as a helper
+// between the shell and the agent: the helper loads the filter on its thread
+// and then execs the command, which inherits the filter.
+//
+//	<agent> seccomp-exec <syscall,...> -- sh -c <cmd>
+
+const seccompExecArg = "seccomp-exec"
+
+const (
+	prSetNoNewPrivs   = 38
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+
+	bpfLdWAbs       = 0x20
+	bpfJeqK         = 0x15
+	bpfJsetK        = 0x45
+	bpfRetK         = 0x06
+	seccompRetAllow = 0x7fff0000
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	// Syscalls of the x32 abi have this bit set
+	seccompX32Bit = 0x40000000
+)
+
+type sockFilter struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+type sockFprog struct {
+	Len    uint16
+	Filter *sockFilter
+}
+
+// Wrap the command with the helper if the job asks for seccomp
+func seccompArgs(job *Job, args []string) ([]string, error) {
+	if !job.Seccomp {
+		return args, nil
+	}
+	names := gApp.Cnf.SeccompDenySyscalls
+	if _, err := seccompSyscallNumbers(names); err != nil {
+		return nil, err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{exe, seccompExecArg, strings.Join(names, ","), "--"}, args...), nil
+}
+
+func seccompSyscallNumbers(names []string) ([]uint32, error) {
+	nrs := make([]uint32, 0, len(names))
+	for _, name := range names {
+		nr, ok := seccompSyscalls[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, errors.New("unknown syscall in seccomp::deny_syscalls: " + name)
+		}
+		nrs = append(nrs, nr)
+	}
+	if len(nrs) > 200 {
+		return nil, errors.New("too many syscalls in seccomp::deny_syscalls")
+	}
+	return nrs, nil
+}
+
+// The denied syscalls fail with EPERM, syscalls of another abi kill the process
+func seccompFilter(nrs []uint32) []sockFilter {
+	n := len(nrs)
+	deny := uint8(n + 1) // Offset from the instruction following the x32 check
+	prog := []sockFilter{
+		{Code: bpfLdWAbs, K: 4}, // seccomp_data.arch
+		{Code: bpfJeqK, Jt: 1, K: seccompAuditArch},
+		{Code: bpfRetK, K: seccompRetKillProcess},
+		{Code: bpfLdWAbs, K: 0}, // seccomp_data.nr
+		{Code: bpfJsetK, Jt: deny, K: seccompX32Bit},
+	}
+	for i, nr := range nrs {
+		prog = append(prog, sockFilter{Code: bpfJeqK, Jt: uint8(n - i), K: nr})
+	}
+	return append(prog,
+		sockFilter{Code: bpfRetK, K: seccompRetAllow},
+		sockFilter{Code: bpfRetK, K: seccompRetErrno | uint32(syscall.EPERM)})
+}
+
+// The entry of the helper, it never returns
+func seccompExec(args []string) {
+	if len(args) < 3 || args[1] != "--" {
+		fmt.Fprintln(os.Stderr, "usage: seccomp-exec <syscall,...> -- <cmd> [args...]")
+		os.Exit(126)
+	}
+	if err := loadSeccomp(strings.Split(args[0], ","), args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "seccomp-exec:", err)
+		os.Exit(126)
+	}
+}
+
+func loadSeccomp(names []string, argv []string) error {
+	nrs, err := seccompSyscallNumbers(names)
+	if err != nil {
+		return err
+	}
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		return err
+	}
+
+	// The filter only applies to the calling thread, which then execs
+	runtime.LockOSThread()
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %s", errno)
+	}
+	filter := seccompFilter(nrs)
+	prog := sockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter,
+		uintptr(unsafe.Pointer(&prog)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_SECCOMP): %s", errno)
+	}
+	return syscall.Exec(path, argv, os.Environ())
+}
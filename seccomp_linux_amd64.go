@@ -0,0 +1,37 @@
+package main
+
+// AUDIT_ARCH_X86_64
+const seccompAuditArch = 0xc000003e
+
+var seccompSyscalls = map[string]uint32{
+	"acct":              163,
+	"add_key":           248,
+	"bpf":               321,
+	"chroot":            161,
+	"clock_settime":     227,
+	"delete_module":     176,
+	"finit_module":      313,
+	"init_module":       175,
+	"kexec_file_load":   320,
+	"kexec_load":        246,
+	"keyctl":            250,
+	"mount":             165,
+	"open_by_handle_at": 304,
+	"perf_event_open":   298,
+	"personality":       135,
+	"pivot_root":        155,
+	"process_vm_readv":  310,
+	"process_vm_writev": 311,
+	"ptrace":            101,
+	"reboot":            169,
+	"request_key":       249,
+	"setdomainname":     171,
+	"sethostname":       170,
+	"setns":             308,
+	"settimeofday":      164,
+	"swapoff":           168,
+	"swapon":            167,
+	"umount2":           166,
+	"unshare":           272,
+	"userfaultfd":       323,
+}
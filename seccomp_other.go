@@ -0,0 +1,25 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+const seccompExecArg = "seccomp-exec"
+
+// Seccomp is only supported on linux amd64 and arm64
+func seccompArgs(job *Job, args []string) ([]string, error) {
+	if job.Seccomp {
+		return nil, errors.New("seccomp is only supported on linux amd64 and arm64")
+	}
+	return args, nil
+}
+
+func seccompExec(args []string) {
+	fmt.Fprintln(os.Stderr, "seccomp-exec: not supported on this platform")
+	os.Exit(126)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Problems of the config and the environment found at startup. The errors
+// stop the agent, the warnings only break the features they concern.
+type SelfCheck struct {
+	Errors   []string `json:"errors,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+var (
+	// The result of the check at startup
+	gSelfCheck *SelfCheck
+)
+
+func (o *SelfCheck) fail(format string, args ...interface{}) {
+	o.Errors = append(o.Errors, fmt.Sprintf(format, args...))
+}
+
+func (o *SelfCheck) warn(format string, args ...interface{}) {
+	o.Warnings = append(o.Warnings, fmt.Sprintf(format, args...))
+}
+
+// All the errors in one, nil if none
+func (o *SelfCheck) Err() error {
+	if len(o.Errors) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(o.Errors, "; "))
+}
+
+// Validate the config, check the directories are writable and the programs
+// the jobs need exist, so that the problems show up at startup rather than
+// on the first job.
+func RunSelfCheck(cnf *Config) *SelfCheck {
+	o := &SelfCheck{}
+	o.checkConfig(cnf)
+	o.checkDirs(cnf)
+	o.checkPrograms(cnf)
+	o.checkClock()
+
+	for _, w := range o.Warnings {
+		log.Warnf("self check: %s", w)
+	}
+	for _, e := range o.Errors {
+		log.Errorf("self check: %s", e)
+	}
+	return o
+}
+
+func (o *SelfCheck) checkConfig(cnf *Config) {
+	if _, port, err := net.SplitHostPort(cnf.Addr); err != nil {
+		o.fail("server::address %q is invalid, expect host:port or :port: %s", cnf.Addr, err)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		o.fail("server::address %q has an invalid port", cnf.Addr)
+	}
+
+	if cnf.ExpireDays <= 0 {
+		o.warn("expire_days %d is not positive, 7 is used", cnf.ExpireDays)
+	}
+	if cnf.PoolSize <= 0 {
+		o.fail("pool::size %d must be positive", cnf.PoolSize)
+	}
+	if cnf.PoolQueueSize < 0 {
+		o.fail("pool::queue_size %d must not be negative", cnf.PoolQueueSize)
+	}
+	if _, err := parsePoolWeights(cnf.PoolWeights); err != nil {
+		o.fail("pool::weights: %s, expect <tenant>:<positive weight>;...", err)
+	}
+	if cnf.MemoryLimit < 0 {
+		o.fail("memory::limit %d must not be negative, 0 means unlimited", cnf.MemoryLimit)
+	}
+	if cnf.MemoryRingSize<<10 < outputBlockSize {
+		o.warn("memory::ring_size %dKB is below one block, %dKB is used", cnf.MemoryRingSize, outputBlockSize>>10)
+	}
+	for _, c := range []struct {
+		key string
+		v   int
+	}{
+		{"fetch::rate_limit", cnf.FetchRateLimit},
+		{"transfer::upload_rate_limit", cnf.UploadRateLimit},
+		{"transfer::download_rate_limit", cnf.DownloadRateLimit},
+		{"transfer::total_rate_limit", cnf.TotalRateLimit},
+	} {
+		if c.v < 0 {
+			o.fail("%s %d must not be negative, 0 means unlimited", c.key, c.v)
+		}
+	}
+
+	for _, c := range []struct {
+		key string
+		v   string
+	}{
+		{"controller::url", cnf.ControllerUrl},
+		{"proxy::url", cnf.ProxyUrl},
+		{"fetch::proxy", cnf.FetchProxy},
+	} {
+		if c.v == "" {
+			continue
+		}
+		if u, err := url.Parse(c.v); err != nil || u.Scheme == "" || u.Host == "" {
+			o.fail("%s %q is not an absolute url", c.key, redactUrl(c.v))
+		}
+	}
+	for _, v := range cnf.PeerUrls {
+		if u, err := url.Parse(v); err != nil || u.Scheme == "" || u.Host == "" {
+			o.fail("peers::urls %q is not an absolute url", redactUrl(v))
+		}
+	}
+	if cnf.ControllerUrl != "" && cnf.ControllerToken == "" {
+		o.warn("controller::token is empty, the controller may reject the polls")
+	}
+	if cnf.SmtpAddr != "" {
+		if _, _, err := net.SplitHostPort(cnf.SmtpAddr); err != nil {
+			o.fail("smtp::addr %q is invalid, expect host:port: %s", cnf.SmtpAddr, err)
+		}
+	}
+
+	if cnf.JailRoot != "" {
+		if fi, err := os.Stat(cnf.JailRoot); err != nil || !fi.IsDir() {
+			o.fail("jail::root %q is not a directory, create it or fix jail::root", cnf.JailRoot)
+		}
+	}
+	if cnf.SigningKeyFile != "" {
+		if f, err := os.Open(cnf.SigningKeyFile); err == nil {
+			f.Close()
+		} else if !os.IsNotExist(err) {
+			o.fail("signing::key_file %q is not readable: %s", cnf.SigningKeyFile, err)
+		}
+	}
+	if cnf.TlsCert != "" || cnf.TlsKey != "" {
+		if cert, err := tls.LoadX509KeyPair(cnf.TlsCert, cnf.TlsKey); err != nil {
+			o.fail("server::tls_cert %q or server::tls_key %q is invalid: %s", cnf.TlsCert, cnf.TlsKey, err)
+		} else if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil &&
+			time.Until(leaf.NotAfter) < time.Duration(cnf.CertWarnDays)*24*time.Hour {
+			o.warn("server::tls_cert %q expires at %s, renew it by /api/v1/admin/cert/install", cnf.TlsCert, leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
+	if cnf.AuthAdminToken == "" && cnf.AuthTokenFile == "" && cnf.BootstrapToken == "" {
+		o.warn("auth is disabled, set auth::admin_token or auth::token_file to require tokens")
+		if cnf.SftpEnabled {
+			o.warn("sftp::enabled lets anyone log in to %s while the auth is disabled", cnf.SftpListen)
+		}
+	}
+	if cnf.SftpEnabled {
+		if _, _, err := net.SplitHostPort(cnf.SftpListen); err != nil {
+			o.fail("sftp::listen %q is invalid, expect host:port or :port: %s", cnf.SftpListen, err)
+		}
+		if f, err := os.Open(cnf.SftpHostKey); err == nil {
+			f.Close()
+		} else if !os.IsNotExist(err) {
+			o.fail("sftp::host_key %q is not readable: %s", cnf.SftpHostKey, err)
+		}
+	}
+}
+
+func (o *SelfCheck) checkDirs(cnf *Config) {
+	for _, name := range cnf.LogOutputs {
+		if strings.EqualFold(name, "file") {
+			o.checkWritable("log::dir", cnf.LogDir, true)
+		}
+	}
+	// The output of the jobs is only spilled above memory::ring_size
+	o.checkWritable("memory::spill_dir", cnf.MemorySpillDir, false)
+	if cnf.BootstrapToken != "" {
+		o.checkWritable("bootstrap::dir", cnf.BootstrapDir, true)
+	}
+	o.checkWritable("schedule::dir", cnf.ScheduleDir, false)
+	o.checkWritable("job::script_dir", cnf.JobScriptDir, false)
+	for _, s := range cnf.Shares {
+		if !strings.HasPrefix(s.Path, `\\`) {
+			o.fail("share_%s::path %q is not a UNC path", s.Name, s.Path)
+		}
+	}
+	for _, r := range cnf.JanitorRules {
+		if err := r.validate(); err != nil {
+			o.fail("%s", err)
+		} else {
+			o.checkWritable("janitor_"+r.Name+"::path", r.Path, false)
+		}
+	}
+	if cnf.AuthTokenFile != "" {
+		o.checkWritable("auth::token_file", filepath.Dir(cnf.AuthTokenFile), true)
+	}
+	if cnf.SigningKeyFile != "" {
+		if _, err := os.Stat(cnf.SigningKeyFile); os.IsNotExist(err) {
+			// Generated at the first start
+			o.checkWritable("signing::key_file", filepath.Dir(cnf.SigningKeyFile), true)
+		}
+	}
+	if cnf.SftpEnabled {
+		if _, err := os.Stat(cnf.SftpHostKey); os.IsNotExist(err) {
+			o.checkWritable("sftp::host_key", filepath.Dir(cnf.SftpHostKey), true)
+		}
+	}
+}
+
+// Create the dir if missing and a file in it. Not being able to write a
+// required dir is an error, otherwise only the feature is broken.
+func (o *SelfCheck) checkWritable(key, dir string, required bool) {
+	report := o.warn
+	if required {
+		report = o.fail
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		report("%s: can't create %q: %s, fix the permission or set %s", key, dir, err, key)
+		return
+	}
+	f, err := ioutil.TempFile(dir, ".selfcheck")
+	if err != nil {
+		report("%s: %q is not writable: %s, fix the permission or set %s", key, dir, err, key)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// A clock not synchronized drifts, see /time
+func (o *SelfCheck) checkClock() {
+	if ntp, err := readNtpStatus(); err == nil && !ntp.Synchronized {
+		o.warn("the host clock is not synchronized by ntp, the run_at, the schedules and the job times may drift")
+	}
+}
+
+func (o *SelfCheck) checkPrograms(cnf *Config) {
+	shell := "sh"
+	if runtime.GOOS == "windows" {
+		shell = "cmd"
+	}
+	key := "the default shell"
+	if len(cnf.JobShell) > 0 {
+		shell, key = cnf.JobShell[0], "job::shell"
+	}
+	if _, err := exec.LookPath(shell); err != nil {
+		o.fail("%s %q is not found: %s, install it or set job::shell", key, shell, err)
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		o.warn("git is not found, the git api will fail until it's installed")
+	}
+}
+
+// The url without its userinfo, which may carry a password
+func redactUrl(s string) string {
+	if u, err := url.Parse(s); err == nil && u.User != nil {
+		u.User = url.User(redacted)
+		return u.String()
+	}
+	return s
+}
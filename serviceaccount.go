@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A service account is the principal the jobs of a schedule or a watch run
+// as, rather than the token which created it, so the automated runs are
+// attributed to it and limited to its scope: the cmds it allows and the
+// users it may run as. The scope is checked when the schedule or the watch
+// is created, and again by every run, as the config may have changed. The
+// jobs have the tenant svc:<name>.
+
+type ServiceAccount struct {
+	Name   string   `json:"name"`
+	Allow  []string `json:"allow,omitempty"`  // Regexps of the cmds or the scripts, empty means any
+	RunAs  []string `json:"run_as,omitempty"` // The users the jobs may run as
+	Owners []string `json:"owners,omitempty"` // The tokens giving it beside the admin ones
+
+	allow []*regexp.Regexp
+}
+
+const serviceAccountTenantPrefix = "svc:"
+
+var (
+	gServiceAccounts map[string]*ServiceAccount
+)
+
+func init() {
+	gHttpServer.AddToInit(InitServiceAccounts)
+}
+
+func InitServiceAccounts() error {
+	accounts := make(map[string]*ServiceAccount)
+	for _, sa := range gApp.Cnf.ServiceAccounts {
+		if err := sa.compile(); err != nil {
+			log.Errorf("invalid service account %s: %s", sa.Name, err)
+			return err
+		}
+		accounts[sa.Name] = sa
+	}
+	gServiceAccounts = accounts
+	return nil
+}
+
+func (o *ServiceAccount) compile() error {
+	o.allow = nil
+	for _, s := range o.Allow {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("invalid allow %q: %s", s, err)
+		}
+		o.allow = append(o.allow, re)
+	}
+	return nil
+}
+
+// The tenant of the jobs run as the account
+func (o *ServiceAccount) Tenant() string {
+	return serviceAccountTenantPrefix + o.Name
+}
+
+// Whether the token may give the account to a schedule or a watch
+func (o *ServiceAccount) ownedBy(tok *Token) bool {
+	if tok == nil || tok.Admin {
+		return true
+	}
+	for _, name := range o.Owners {
+		if name == tok.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Refuse the request out of the scope of the account
+func (o *ServiceAccount) permit(req *RunCmdReq) error {
+	if req.RunAs != "" {
+		allowed := false
+		for _, u := range o.RunAs {
+			if u == req.RunAs {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("run_as %s is not allowed to service account %s", req.RunAs, o.Name)
+		}
+	}
+	if len(o.allow) == 0 {
+		return nil
+	}
+	cmd := req.Cmd
+	if req.Script != "" {
+		cmd = req.Script
+	}
+	for _, re := range o.allow {
+		if re.MatchString(cmd) {
+			return nil
+		}
+	}
+	return fmt.Errorf("cmd not allowed to service account %s", o.Name)
+}
+
+// The account of the name, an error if not found
+func lookupServiceAccount(name string) (*ServiceAccount, error) {
+	if sa := gServiceAccounts[name]; sa != nil {
+		return sa, nil
+	}
+	return nil, errors.New("service account not found: " + name)
+}
+
+// Validate the service account given to a schedule or a watch by the token,
+// and the run_as of its request. Without an account, the token must be
+// allowed the run_as.
+func checkServiceAccount(tok *Token, name string, req *RunCmdReq) (ErrorCode, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		if gApp.Cnf.ServiceAccountRequired {
+			return ECInvalidParam, errors.New("param service_account is required by the config")
+		}
+		if err := checkRunAs(tok, req.RunAs); err != nil {
+			return ECForbidden, err
+		}
+		return ECSuccess, nil
+	}
+	sa, err := lookupServiceAccount(name)
+	if err != nil {
+		return ECInvalidParam, err
+	}
+	if !sa.ownedBy(tok) {
+		return ECForbidden, fmt.Errorf("service account %s is not allowed to token %s", name, tok.Name)
+	}
+	if err := sa.permit(req); err != nil {
+		return ECForbidden, err
+	}
+	return ECSuccess, nil
+}
+
+// The tenant a run of a schedule or a watch is started for: the service
+// account if any, checked against the request, else the creator
+func runTenant(account, creator string, req *RunCmdReq) (string, error) {
+	if account == "" {
+		return creator, nil
+	}
+	sa, err := lookupServiceAccount(account)
+	if err != nil {
+		return "", err
+	}
+	if err = sa.permit(req); err != nil {
+		return "", err
+	}
+	return sa.Tenant(), nil
+}
@@ -0,0 +1,736 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The sftp subsystem, version 3 as the openssh server speaks it. The paths
+// of the clients are slash separated and absolute, mapped to the host by
+// JailPath like those of the file api. Without a jail a path of windows is
+// given as /C:/Users/...
+
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpReadlink = 19
+	sftpSymlink  = 20
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpExtended = 200
+)
+
+const (
+	sftpOk               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreat  = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+
+	sftpAttrSize        = 0x01
+	sftpAttrUidGid      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrAcModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+const (
+	// The requests larger are refused
+	sftpMaxPacket = 256<<10 + 1024
+	// The data of a read at most
+	sftpMaxRead = 256 << 10
+	// The entries of a readdir at most
+	sftpMaxNames   = 128
+	sftpMaxHandles = 256
+)
+
+// The extensions of openssh supported, told to the clients by the version
+var sftpExtensions = []string{"posix-rename@openssh.com", "fsync@openssh.com"}
+
+// An open file or directory of a session
+type sftpFile struct {
+	path    string // Of the client
+	file    *os.File
+	dir     bool
+	append  bool
+	written int64
+}
+
+type sftpSession struct {
+	rw      io.ReadWriter
+	tok     *Token
+	who     string
+	handles map[string]*sftpFile
+	nextId  int
+	// By transfer::upload_rate_limit and download_rate_limit, and
+	// gTotalRateLimiter for all the transfers
+	upload, download *RateLimiter
+}
+
+// Serve the sftp requests of the channel one by one, until the client closes it
+func serveSftp(rw io.ReadWriter, tok *Token, who string) error {
+	o := &sftpSession{rw: rw, tok: tok, who: who, handles: make(map[string]*sftpFile),
+		upload:   NewRateLimiter(int64(gApp.Cnf.UploadRateLimit) * 1024),
+		download: NewRateLimiter(int64(gApp.Cnf.DownloadRateLimit) * 1024)}
+	defer func() {
+		for _, h := range o.handles {
+			o.closeHandle(h)
+		}
+	}()
+	for {
+		var lb [4]byte
+		if _, err := io.ReadFull(rw, lb[:]); err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(lb[:])
+		if n == 0 || n > sftpMaxPacket {
+			return fmt.Errorf("invalid sftp packet length %d", n)
+		}
+		p := make([]byte, n)
+		if _, err := io.ReadFull(rw, p); err != nil {
+			return err
+		}
+		if err := o.handle(p); err != nil {
+			return err
+		}
+	}
+}
+
+func (o *sftpSession) send(w *sshWriter) error {
+	b := make([]byte, 4, 4+len(w.buf))
+	binary.BigEndian.PutUint32(b, uint32(len(w.buf)))
+	_, err := o.rw.Write(append(b, w.buf...))
+	return err
+}
+
+func (o *sftpSession) sendStatus(id uint32, code uint32, msg string) error {
+	var w sshWriter
+	w.Byte(sftpStatus)
+	w.Uint32(id)
+	w.Uint32(code)
+	w.String(msg)
+	w.String("")
+	return o.send(&w)
+}
+
+// The status of the error of a file operation, the host path is left out of
+// the message
+func (o *sftpSession) sendError(id uint32, err error) error {
+	if err == nil {
+		return o.sendStatus(id, sftpOk, "")
+	}
+	var pe *os.PathError
+	var le *os.LinkError
+	msg := err.Error()
+	if errors.As(err, &pe) {
+		msg = pe.Err.Error()
+	} else if errors.As(err, &le) {
+		msg = le.Err.Error()
+	}
+	switch {
+	case os.IsNotExist(err):
+		return o.sendStatus(id, sftpNoSuchFile, msg)
+	case os.IsPermission(err) || err == errPathNotAllowed:
+		return o.sendStatus(id, sftpPermissionDenied, msg)
+	}
+	return o.sendStatus(id, sftpFailure, msg)
+}
+
+func (o *sftpSession) handle(packet []byte) error {
+	typ := packet[0]
+	r := &sshReader{b: packet[1:]}
+	if typ == sftpInit {
+		var w sshWriter
+		w.Byte(sftpVersion)
+		w.Uint32(3)
+		for _, ext := range sftpExtensions {
+			w.String(ext)
+			w.String("1")
+		}
+		return o.send(&w)
+	}
+
+	id := r.Uint32()
+	if r.err != nil {
+		return r.err
+	}
+	switch typ {
+	case sftpOpen:
+		p, pflags := r.String(), r.Uint32()
+		attrs := readSftpAttrs(r)
+		if r.err != nil {
+			break
+		}
+		return o.open(id, p, pflags, attrs)
+	case sftpClose:
+		handle := r.String()
+		h := o.handles[handle]
+		if h == nil {
+			break
+		}
+		delete(o.handles, handle)
+		return o.sendError(id, o.closeHandle(h))
+	case sftpRead:
+		h, offset, n := o.handles[r.String()], r.Uint64(), r.Uint32()
+		if h == nil || h.dir {
+			break
+		}
+		return o.read(id, h, offset, n)
+	case sftpWrite:
+		h, offset, data := o.handles[r.String()], r.Uint64(), r.Bytes()
+		if h == nil || h.dir || r.err != nil {
+			break
+		}
+		return o.write(id, h, offset, data)
+	case sftpStat, sftpLstat:
+		p := r.String()
+		if r.err != nil {
+			break
+		}
+		var hp string
+		var err error
+		if typ == sftpStat {
+			hp, err = o.hostPath(p)
+		} else {
+			hp, err = o.linkPath(p)
+		}
+		var fi os.FileInfo
+		if err == nil {
+			if typ == sftpStat {
+				fi, err = os.Stat(hp)
+			} else {
+				fi, err = os.Lstat(hp)
+			}
+		}
+		if err != nil {
+			return o.sendError(id, err)
+		}
+		return o.sendAttrs(id, fi)
+	case sftpFstat:
+		h := o.handles[r.String()]
+		if h == nil {
+			break
+		}
+		fi, err := h.file.Stat()
+		if err != nil {
+			return o.sendError(id, err)
+		}
+		return o.sendAttrs(id, fi)
+	case sftpSetstat:
+		p := r.String()
+		attrs := readSftpAttrs(r)
+		if r.err != nil {
+			break
+		}
+		hp, err := o.hostPath(p)
+		if err == nil {
+			err = attrs.apply(hp)
+		}
+		return o.sendError(id, err)
+	case sftpFsetstat:
+		h := o.handles[r.String()]
+		attrs := readSftpAttrs(r)
+		if h == nil || r.err != nil {
+			break
+		}
+		return o.sendError(id, attrs.apply(h.file.Name()))
+	case sftpOpendir:
+		p := r.String()
+		if r.err != nil {
+			break
+		}
+		return o.opendir(id, p)
+	case sftpReaddir:
+		h := o.handles[r.String()]
+		if h == nil || !h.dir {
+			break
+		}
+		return o.readdir(id, h)
+	case sftpRemove, sftpRmdir:
+		p := r.String()
+		if r.err != nil {
+			break
+		}
+		return o.remove(id, p, typ == sftpRmdir)
+	case sftpMkdir:
+		p := r.String()
+		attrs := readSftpAttrs(r)
+		if r.err != nil {
+			break
+		}
+		return o.mkdir(id, p, attrs)
+	case sftpRealpath:
+		p := r.String()
+		if r.err != nil {
+			break
+		}
+		return o.sendName(id, sftpCleanPath(p))
+	case sftpRename:
+		from, to := r.String(), r.String()
+		if r.err != nil {
+			break
+		}
+		return o.rename(id, from, to, false)
+	case sftpReadlink:
+		p := r.String()
+		if r.err != nil {
+			break
+		}
+		return o.readlink(id, p)
+	case sftpSymlink:
+		// In the order of openssh, the target before the link
+		target, link := r.String(), r.String()
+		if r.err != nil {
+			break
+		}
+		return o.symlink(id, target, link)
+	case sftpExtended:
+		switch ext := r.String(); ext {
+		case "posix-rename@openssh.com":
+			from, to := r.String(), r.String()
+			if r.err != nil {
+				break
+			}
+			return o.rename(id, from, to, true)
+		case "fsync@openssh.com":
+			h := o.handles[r.String()]
+			if h == nil || h.dir {
+				break
+			}
+			return o.sendError(id, h.file.Sync())
+		default:
+			return o.sendStatus(id, sftpOpUnsupported, "unsupported extension: "+ext)
+		}
+	default:
+		return o.sendStatus(id, sftpOpUnsupported, fmt.Sprintf("unsupported request %d", typ))
+	}
+	if r.err != nil {
+		return o.sendStatus(id, sftpBadMessage, r.err.Error())
+	}
+	return o.sendStatus(id, sftpFailure, "invalid handle")
+}
+
+// The host path of the client's path in the jail
+func (o *sftpSession) hostPath(p string) (string, error) {
+	return JailPath(sftpHostPath(p))
+}
+
+// The host path of the link itself rather than of its target: the parent
+// is resolved in the jail
+func (o *sftpSession) linkPath(p string) (string, error) {
+	p = sftpCleanPath(p)
+	if gJailRoot == "" || p == "/" {
+		return o.hostPath(p)
+	}
+	dir, err := JailPath(sftpHostPath(path.Dir(p)))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, path.Base(p)), nil
+}
+
+func (o *sftpSession) sendHandle(id uint32, h *sftpFile) error {
+	if len(o.handles) >= sftpMaxHandles {
+		h.file.Close()
+		return o.sendStatus(id, sftpFailure, "too many open handles")
+	}
+	o.nextId++
+	handle := strconv.Itoa(o.nextId)
+	o.handles[handle] = h
+	var w sshWriter
+	w.Byte(sftpHandle)
+	w.Uint32(id)
+	w.String(handle)
+	return o.send(&w)
+}
+
+func (o *sftpSession) closeHandle(h *sftpFile) error {
+	err := h.file.Close()
+	if h.written > 0 {
+		log.Infof("sftp uploaded %s by %s, size: %d", h.path, o.who, h.written)
+	}
+	return err
+}
+
+func (o *sftpSession) open(id uint32, p string, pflags uint32, attrs *sftpFileAttrs) error {
+	flag := os.O_RDONLY
+	switch {
+	case pflags&sftpFlagRead != 0 && pflags&sftpFlagWrite != 0:
+		flag = os.O_RDWR
+	case pflags&sftpFlagWrite != 0:
+		flag = os.O_WRONLY
+	}
+	if pflags&sftpFlagAppend != 0 {
+		flag |= os.O_APPEND
+	}
+	if pflags&sftpFlagCreat != 0 {
+		flag |= os.O_CREATE
+	}
+	if pflags&sftpFlagTrunc != 0 {
+		flag |= os.O_TRUNC
+	}
+	if pflags&sftpFlagExcl != 0 {
+		flag |= os.O_EXCL
+	}
+	perm := os.FileMode(0644)
+	if attrs.flags&sftpAttrPermissions != 0 {
+		perm = os.FileMode(attrs.perm & 0777)
+	}
+
+	hp, err := o.hostPath(p)
+	if err != nil {
+		return o.sendError(id, err)
+	}
+	f, err := os.OpenFile(hp, flag, perm)
+	if err != nil {
+		return o.sendError(id, err)
+	}
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		f.Close()
+		return o.sendStatus(id, sftpFailure, "is a directory")
+	}
+	return o.sendHandle(id, &sftpFile{path: sftpCleanPath(p), file: f, append: pflags&sftpFlagAppend != 0})
+}
+
+func (o *sftpSession) read(id uint32, h *sftpFile, offset uint64, n uint32) error {
+	if n > sftpMaxRead {
+		n = sftpMaxRead
+	}
+	b := make([]byte, n)
+	read, err := h.file.ReadAt(b, int64(offset))
+	if read == 0 && err == io.EOF {
+		return o.sendStatus(id, sftpEOF, "")
+	}
+	if read == 0 && err != nil {
+		return o.sendError(id, err)
+	}
+	o.download.WaitN(read)
+	gTotalRateLimiter.WaitN(read)
+	var w sshWriter
+	w.Byte(sftpData)
+	w.Uint32(id)
+	w.Bytes(b[:read])
+	return o.send(&w)
+}
+
+func (o *sftpSession) write(id uint32, h *sftpFile, offset uint64, data []byte) error {
+	o.upload.WaitN(len(data))
+	gTotalRateLimiter.WaitN(len(data))
+	var err error
+	// A file opened to append refuses WriteAt
+	if h.append {
+		_, err = h.file.Write(data)
+	} else {
+		_, err = h.file.WriteAt(data, int64(offset))
+	}
+	if err == nil {
+		h.written += int64(len(data))
+	}
+	return o.sendError(id, err)
+}
+
+func (o *sftpSession) opendir(id uint32, p string) error {
+	hp, err := o.hostPath(p)
+	if err != nil {
+		return o.sendError(id, err)
+	}
+	f, err := os.Open(hp)
+	if err != nil {
+		return o.sendError(id, err)
+	}
+	if fi, err := f.Stat(); err != nil || !fi.IsDir() {
+		f.Close()
+		return o.sendStatus(id, sftpFailure, "not a directory")
+	}
+	return o.sendHandle(id, &sftpFile{path: sftpCleanPath(p), file: f, dir: true})
+}
+
+func (o *sftpSession) readdir(id uint32, h *sftpFile) error {
+	entries, err := h.file.Readdir(sftpMaxNames)
+	if len(entries) == 0 {
+		if err == nil || err == io.EOF {
+			return o.sendStatus(id, sftpEOF, "")
+		}
+		return o.sendError(id, err)
+	}
+
+	var w sshWriter
+	w.Byte(sftpName)
+	w.Uint32(id)
+	w.Uint32(uint32(len(entries)))
+	for _, fi := range entries {
+		w.String(fi.Name())
+		w.String(sftpLongName(fi))
+		writeSftpAttrs(&w, fi)
+	}
+	return o.send(&w)
+}
+
+func (o *sftpSession) remove(id uint32, p string, dir bool) error {
+	if gJailRoot != "" && sftpCleanPath(p) == "/" {
+		return o.sendError(id, errPathNotAllowed)
+	}
+	hp, err := o.linkPath(p)
+	if err != nil {
+		return o.sendError(id, err)
+	}
+	fi, err := os.Lstat(hp)
+	if err != nil {
+		return o.sendError(id, err)
+	}
+	if fi.IsDir() != dir {
+		if dir {
+			return o.sendStatus(id, sftpFailure, "not a directory")
+		}
+		return o.sendStatus(id, sftpFailure, "is a directory")
+	}
+	if err = os.Remove(hp); err == nil {
+		log.Infof("sftp removed %s by %s", sftpCleanPath(p), o.who)
+	}
+	return o.sendError(id, err)
+}
+
+func (o *sftpSession) mkdir(id uint32, p string, attrs *sftpFileAttrs) error {
+	perm := os.FileMode(0755)
+	if attrs.flags&sftpAttrPermissions != 0 {
+		perm = os.FileMode(attrs.perm & 0777)
+	}
+	hp, err := o.hostPath(p)
+	if err == nil {
+		err = os.Mkdir(hp, perm)
+	}
+	if err == nil {
+		log.Infof("sftp made dir %s by %s", sftpCleanPath(p), o.who)
+	}
+	return o.sendError(id, err)
+}
+
+func (o *sftpSession) rename(id uint32, oldPath, newPath string, overwrite bool) error {
+	if gJailRoot != "" && (sftpCleanPath(oldPath) == "/" || sftpCleanPath(newPath) == "/") {
+		return o.sendError(id, errPathNotAllowed)
+	}
+	from, err := o.linkPath(oldPath)
+	if err != nil {
+		return o.sendError(id, err)
+	}
+	to, err := o.linkPath(newPath)
+	if err != nil {
+		return o.sendError(id, err)
+	}
+	// A rename of version 3 doesn't replace the existing file
+	if _, err := os.Lstat(to); err == nil && !overwrite {
+		return o.sendStatus(id, sftpFailure, "file already exists")
+	}
+	if err = os.Rename(from, to); err == nil {
+		log.Infof("sftp renamed %s to %s by %s", sftpCleanPath(oldPath), sftpCleanPath(newPath), o.who)
+	}
+	return o.sendError(id, err)
+}
+
+func (o *sftpSession) readlink(id uint32, p string) error {
+	hp, err := o.linkPath(p)
+	if err != nil {
+		return o.sendError(id, err)
+	}
+	target, err := os.Readlink(hp)
+	if err != nil {
+		return o.sendError(id, err)
+	}
+	// An absolute target is told as a path in the jail
+	if gJailRoot != "" && filepath.IsAbs(target) {
+		if !inJail(target) {
+			return o.sendError(id, errPathNotAllowed)
+		}
+		rel, _ := filepath.Rel(gJailRoot, target)
+		target = path.Join("/", filepath.ToSlash(rel))
+	}
+	return o.sendName(id, filepath.ToSlash(target))
+}
+
+func (o *sftpSession) symlink(id uint32, target, link string) error {
+	// The target could lead out of the jail
+	if gJailRoot != "" {
+		return o.sendStatus(id, sftpPermissionDenied, "symlinks are not allowed in the jail")
+	}
+	hp, err := o.linkPath(link)
+	if err == nil {
+		err = os.Symlink(filepath.FromSlash(target), hp)
+	}
+	if err == nil {
+		log.Infof("sftp linked %s to %s by %s", sftpCleanPath(link), target, o.who)
+	}
+	return o.sendError(id, err)
+}
+
+// A name without its attributes, of realpath and readlink
+func (o *sftpSession) sendName(id uint32, name string) error {
+	var w sshWriter
+	w.Byte(sftpName)
+	w.Uint32(id)
+	w.Uint32(1)
+	w.String(name)
+	w.String(name)
+	w.Uint32(0)
+	return o.send(&w)
+}
+
+func (o *sftpSession) sendAttrs(id uint32, fi os.FileInfo) error {
+	var w sshWriter
+	w.Byte(sftpAttrs)
+	w.Uint32(id)
+	writeSftpAttrs(&w, fi)
+	return o.send(&w)
+}
+
+// The path cleaned and absolute, a relative one is under the home
+func sftpCleanPath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(gApp.Cnf.SftpHome, p)
+	}
+	return path.Clean("/" + p)
+}
+
+// The host path of the client's path before the jail, /C:/Users is C:\Users
+// on windows without a jail
+func sftpHostPath(p string) string {
+	p = sftpCleanPath(p)
+	if runtime.GOOS == "windows" && gJailRoot == "" && len(p) >= 3 && p[2] == ':' {
+		p = p[1:]
+		if len(p) == 2 {
+			p += "/"
+		}
+	}
+	return filepath.FromSlash(p)
+}
+
+// The attributes of setstat, mkdir and open, the owner and the extended
+// ones are ignored
+type sftpFileAttrs struct {
+	flags        uint32
+	size         uint64
+	perm         uint32
+	atime, mtime uint32
+}
+
+// Read the attributes, a truncated message is left in r.err
+func readSftpAttrs(r *sshReader) *sftpFileAttrs {
+	a := &sftpFileAttrs{flags: r.Uint32()}
+	if a.flags&sftpAttrSize != 0 {
+		a.size = r.Uint64()
+	}
+	if a.flags&sftpAttrUidGid != 0 {
+		r.Uint32()
+		r.Uint32()
+	}
+	if a.flags&sftpAttrPermissions != 0 {
+		a.perm = r.Uint32()
+	}
+	if a.flags&sftpAttrAcModTime != 0 {
+		a.atime, a.mtime = r.Uint32(), r.Uint32()
+	}
+	if a.flags&sftpAttrExtended != 0 {
+		for n := r.Uint32(); n > 0 && r.err == nil; n-- {
+			r.Bytes()
+			r.Bytes()
+		}
+	}
+	return a
+}
+
+func (o *sftpFileAttrs) apply(hp string) error {
+	if o.flags&sftpAttrSize != 0 {
+		if err := os.Truncate(hp, int64(o.size)); err != nil {
+			return err
+		}
+	}
+	if o.flags&sftpAttrPermissions != 0 {
+		if err := os.Chmod(hp, os.FileMode(o.perm&0777)); err != nil {
+			return err
+		}
+	}
+	if o.flags&sftpAttrAcModTime != 0 {
+		return os.Chtimes(hp, time.Unix(int64(o.atime), 0), time.Unix(int64(o.mtime), 0))
+	}
+	return nil
+}
+
+// The unix mode of the file, with the bits of its type
+func sftpMode(fi os.FileInfo) uint32 {
+	m := fi.Mode()
+	mode := uint32(m.Perm())
+	switch {
+	case m.IsDir():
+		mode |= 0040000
+	case m&os.ModeSymlink != 0:
+		mode |= 0120000
+	case m.IsRegular():
+		mode |= 0100000
+	}
+	return mode
+}
+
+func writeSftpAttrs(w *sshWriter, fi os.FileInfo) {
+	w.Uint32(sftpAttrSize | sftpAttrPermissions | sftpAttrAcModTime)
+	w.Uint64(uint64(fi.Size()))
+	w.Uint32(sftpMode(fi))
+	mtime := uint32(fi.ModTime().Unix())
+	w.Uint32(mtime)
+	w.Uint32(mtime)
+}
+
+// The line of ls -l, the owner is unknown to the clients
+func sftpLongName(fi os.FileInfo) string {
+	typ := "-"
+	switch {
+	case fi.IsDir():
+		typ = "d"
+	case fi.Mode()&os.ModeSymlink != 0:
+		typ = "l"
+	}
+	stamp := fi.ModTime().Format("Jan _2 15:04")
+	if time.Since(fi.ModTime()) > 180*24*time.Hour {
+		stamp = fi.ModTime().Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s%s    1 -        -        %8d %s %s", typ, fi.Mode().Perm().String()[1:], fi.Size(), stamp, fi.Name())
+}
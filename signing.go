@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Sign the finished jobs with the agent's ed25519 key, so that the results
+// can be verified against the public key returned by /version.
+type JobSigner struct {
+	key ed25519.PrivateKey
+}
+
+var (
+	gJobSigner *JobSigner
+)
+
+func init() {
+	gHttpServer.AddToInit(InitJobSigner)
+}
+
+func InitJobSigner() error {
+	gJobSigner = nil
+	if gApp.Cnf.SigningKeyFile == "" {
+		return nil
+	}
+	key, err := loadOrCreateSigningKey(gApp.Cnf.SigningKeyFile)
+	if err != nil {
+		log.Errorf("load signing key failed: %s", err)
+		return err
+	}
+	gJobSigner = &JobSigner{key: key}
+	return nil
+}
+
+// Load the PKCS#8 PEM encoded key, a new key is generated if the file doesn't exist
+func loadOrCreateSigningKey(path string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		b = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err = ioutil.WriteFile(path, b, 0600); err != nil {
+			return nil, err
+		}
+		log.Warnf("generated a new ed25519 key: %s", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no pem block found in " + path)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an ed25519 key: " + path)
+	}
+	return key, nil
+}
+
+func (o *JobSigner) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(o.key.Public().(ed25519.PublicKey))
+}
+
+func (o *JobSigner) Sign(job *Job) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(o.key, JobSigningPayload(job)))
+}
+
+// Sign the job by the agent's key if configured, called by the worker when
+// the job finishes
+func (o *Job) sign() {
+	if gJobSigner == nil {
+		return
+	}
+	sig := gJobSigner.Sign(o)
+	o.mu.Lock()
+	o.Signature = sig
+	o.mu.Unlock()
+}
+
+// The signed payload is the following lines joined by "\n", the free-form
+// fields are represented by their hex encoded sha256:
+//
+//	shell-agent-job-v1, id, status, exit_code, create_time, finish_time,
+//	sha256(cmd), sha256(dir), sha256(error), sha256(stdout), sha256(stderr)
+//
+// The times are in UTC, formatted as RFC 3339 with nanoseconds.
+func JobSigningPayload(job *Job) []byte {
+	digest := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	stdout, stderr := job.Output()
+	return []byte(strings.Join([]string{
+		"shell-agent-job-v1",
+		job.Id,
+		string(job.Status),
+		strconv.Itoa(job.ExitCode),
+		job.CreateTime.UTC().Format(time.RFC3339Nano),
+		job.FinishTime.UTC().Format(time.RFC3339Nano),
+		digest(job.Cmd),
+		digest(job.Dir),
+		digest(job.Error),
+		digest(stdout),
+		digest(stderr),
+	}, "\n"))
+}
@@ -0,0 +1,1517 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A minimal ssh server on sftp::listen offering the sftp subsystem, so that
+// sftp, scp, WinSCP or FileZilla move files to the agent under the same jail
+// as the file api, with no client software of the agent, and the commands
+// run as jobs with sftp::exec. A client logs in by the password of an api
+// token, by an ssh key added to a token, or by a certificate of a CA.
+// Like grpc, it is written on the standard library: curve25519-sha256 or
+// ecdh-sha2-nistp256 key exchange, an ssh-ed25519 host key, and aes-gcm, or
+// aes-ctr with hmac-sha2. Only the ssh framing is written here, the
+// primitives are those of crypto/, as golang.org/x/crypto/ssh isn't
+// vendored; ssh_test.go runs it against the OpenSSH client for each of the
+// algorithms, the rekeys and the auth methods.
+
+const sshServerVersion = "SSH-2.0-ShellAgent"
+
+const (
+	sshMsgDisconnect              = 1
+	sshMsgIgnore                  = 2
+	sshMsgUnimplemented           = 3
+	sshMsgDebug                   = 4
+	sshMsgServiceRequest          = 5
+	sshMsgServiceAccept           = 6
+	sshMsgExtInfo                 = 7
+	sshMsgKexInit                 = 20
+	sshMsgNewKeys                 = 21
+	sshMsgKexEcdhInit             = 30
+	sshMsgKexEcdhReply            = 31
+	sshMsgUserauthRequest         = 50
+	sshMsgUserauthFailure         = 51
+	sshMsgUserauthSuccess         = 52
+	sshMsgUserauthPkOk            = 60
+	sshMsgGlobalRequest           = 80
+	sshMsgRequestFailure          = 82
+	sshMsgChannelOpen             = 90
+	sshMsgChannelOpenConfirmation = 91
+	sshMsgChannelOpenFailure      = 92
+	sshMsgChannelWindowAdjust     = 93
+	sshMsgChannelData             = 94
+	sshMsgChannelExtendedData     = 95
+	sshMsgChannelEOF              = 96
+	sshMsgChannelClose            = 97
+	sshMsgChannelRequest          = 98
+	sshMsgChannelSuccess          = 99
+	sshMsgChannelFailure          = 100
+)
+
+const (
+	sshDisconnectProtocolError = 2
+	sshDisconnectKexFailed     = 3
+	sshDisconnectAuthFailed    = 14
+
+	sshExtendedStderr = 1
+
+	sshOpenAdministrativelyProhibited = 1
+	sshOpenUnknownChannelType         = 3
+)
+
+const (
+	// The packets larger are refused, the sftp writes of 256KB included
+	sshMaxPacket = 512 << 10
+	// The data a channel buffers from the client
+	sshChannelWindow = 2 << 20
+	// The data in a message to the client
+	sshChannelMaxData = 32 << 10
+	sshMaxChannels    = 8
+	sshMaxAuthTries   = 6
+	// To finish the key exchange and the auth
+	sshHandshakeTimeout = time.Minute
+)
+
+var (
+	sshKexAlgos     = []string{"curve25519-sha256", "curve25519-sha256@libssh.org", "ecdh-sha2-nistp256"}
+	sshHostKeyAlgos = []string{"ssh-ed25519"}
+	sshCiphers      = []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr"}
+	sshMacs         = []string{"hmac-sha2-256", "hmac-sha2-512"}
+	// The algorithms of the keys of the tokens, told to the clients by ext-info
+	sshSigAlgos = []string{"ssh-ed25519", "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521", "rsa-sha2-256", "rsa-sha2-512"}
+
+	errSshTruncated = errors.New("ssh: truncated message")
+)
+
+// A message of the ssh wire format, written like pbWriter
+type sshWriter struct {
+	buf []byte
+}
+
+func (o *sshWriter) Byte(b byte) {
+	o.buf = append(o.buf, b)
+}
+
+func (o *sshWriter) Bool(v bool) {
+	if v {
+		o.Byte(1)
+	} else {
+		o.Byte(0)
+	}
+}
+
+func (o *sshWriter) Uint32(v uint32) {
+	o.buf = binary.BigEndian.AppendUint32(o.buf, v)
+}
+
+func (o *sshWriter) Uint64(v uint64) {
+	o.buf = binary.BigEndian.AppendUint64(o.buf, v)
+}
+
+func (o *sshWriter) Bytes(b []byte) {
+	o.Uint32(uint32(len(b)))
+	o.buf = append(o.buf, b...)
+}
+
+func (o *sshWriter) String(s string) {
+	o.Bytes([]byte(s))
+}
+
+// A positive integer given by its big endian bytes
+func (o *sshWriter) Mpint(b []byte) {
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	o.Bytes(b)
+}
+
+// A message read by the ssh wire format, the first error sticks and the
+// values after it are zero
+type sshReader struct {
+	b   []byte
+	err error
+}
+
+func (o *sshReader) next(n int) []byte {
+	if o.err != nil || n < 0 || len(o.b) < n {
+		o.err = errSshTruncated
+		return nil
+	}
+	b := o.b[:n]
+	o.b = o.b[n:]
+	return b
+}
+
+func (o *sshReader) Byte() byte {
+	if b := o.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (o *sshReader) Bool() bool {
+	return o.Byte() != 0
+}
+
+func (o *sshReader) Uint32() uint32 {
+	if b := o.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (o *sshReader) Uint64() uint64 {
+	if b := o.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (o *sshReader) Bytes() []byte {
+	n := o.Uint32()
+	if o.err != nil || n > uint32(len(o.b)) {
+		o.err = errSshTruncated
+		return nil
+	}
+	return o.next(int(n))
+}
+
+func (o *sshReader) String() string {
+	return string(o.Bytes())
+}
+
+func (o *sshReader) NameList() []string {
+	if s := o.String(); s != "" {
+		return strings.Split(s, ",")
+	}
+	return nil
+}
+
+// The ssh public key of the wire format in a line of authorized_keys, e.g.
+// "ssh-ed25519 AAAAC3Nza... alice@laptop", the options are not supported
+func parseAuthorizedKey(line string) ([]byte, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, errors.New("expect <type> <base64 key> [comment]")
+	}
+	b, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	r := &sshReader{b: b}
+	if algo := r.String(); algo != fields[0] {
+		return nil, fmt.Errorf("key type %q is not %q", algo, fields[0])
+	}
+	if _, err = parseSshPublicKey(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// The public key of the wire format, one of ed25519.PublicKey,
+// *ecdsa.PublicKey or *rsa.PublicKey
+func parseSshPublicKey(b []byte) (crypto.PublicKey, error) {
+	r := &sshReader{b: b}
+	algo := r.String()
+	var key crypto.PublicKey
+	switch algo {
+	case "ssh-ed25519":
+		pk := r.Bytes()
+		if r.err == nil && len(pk) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key")
+		}
+		key = ed25519.PublicKey(pk)
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		curve := sshCurve(strings.TrimPrefix(algo, "ecdsa-sha2-"))
+		if r.String() != strings.TrimPrefix(algo, "ecdsa-sha2-") {
+			return nil, errors.New("invalid ecdsa key")
+		}
+		x, y := elliptic.Unmarshal(curve, r.Bytes())
+		if r.err == nil && x == nil {
+			return nil, errors.New("invalid ecdsa key")
+		}
+		key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	case "ssh-rsa":
+		e := new(big.Int).SetBytes(r.Bytes())
+		n := new(big.Int).SetBytes(r.Bytes())
+		if r.err == nil && (!e.IsInt64() || e.Int64() < 3 || n.BitLen() < 2048) {
+			return nil, errors.New("invalid rsa key, or shorter than 2048 bits")
+		}
+		key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	default:
+		return nil, errors.New("unsupported key type: " + algo)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return key, nil
+}
+
+func sshCurve(name string) elliptic.Curve {
+	switch name {
+	case "nistp384":
+		return elliptic.P384()
+	case "nistp521":
+		return elliptic.P521()
+	}
+	return elliptic.P256()
+}
+
+// Verify the signature of the wire format by the key for the data
+func verifySshSignature(key crypto.PublicKey, algo string, data, sig []byte) bool {
+	r := &sshReader{b: sig}
+	if r.String() != algo {
+		return false
+	}
+	blob := r.Bytes()
+	if r.err != nil {
+		return false
+	}
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return algo == "ssh-ed25519" && ed25519.Verify(k, data, blob)
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch algo {
+		case "ecdsa-sha2-nistp256":
+			h := sha256.Sum256(data)
+			digest = h[:]
+		case "ecdsa-sha2-nistp384":
+			h := sha512.Sum384(data)
+			digest = h[:]
+		case "ecdsa-sha2-nistp521":
+			h := sha512.Sum512(data)
+			digest = h[:]
+		default:
+			return false
+		}
+		rs := &sshReader{b: blob}
+		er, es := new(big.Int).SetBytes(rs.Bytes()), new(big.Int).SetBytes(rs.Bytes())
+		return rs.err == nil && "ecdsa-sha2-"+sshCurveName(k.Curve) == algo && ecdsa.Verify(k, digest, er, es)
+	case *rsa.PublicKey:
+		// The sha1 signatures of ssh-rsa are refused
+		switch algo {
+		case "rsa-sha2-256":
+			h := sha256.Sum256(data)
+			return rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], blob) == nil
+		case "rsa-sha2-512":
+			h := sha512.Sum512(data)
+			return rsa.VerifyPKCS1v15(k, crypto.SHA512, h[:], blob) == nil
+		}
+	}
+	return false
+}
+
+func sshCurveName(curve elliptic.Curve) string {
+	return "nistp" + strings.TrimPrefix(curve.Params().Name, "P-")
+}
+
+// The cipher and the mac of a direction, both nil before the first NEWKEYS
+type sshCipherState struct {
+	seq uint32
+
+	// aes-gcm, the last 8 bytes of the nonce count the packets
+	aead  cipher.AEAD
+	nonce []byte
+
+	// aes-ctr, with the mac of the sequence number and the plain packet
+	stream cipher.Stream
+	mac    hash.Hash
+}
+
+func (o *sshCipherState) blockSize() int {
+	if o.aead != nil || o.stream != nil {
+		return aes.BlockSize
+	}
+	return 8
+}
+
+// The keys of a direction derived from the exchange: iv, key and mac key
+func newSshCipherState(name, macName string, iv, key, macKey []byte) (*sshCipherState, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	o := &sshCipherState{}
+	if strings.Contains(name, "gcm") {
+		o.aead, err = cipher.NewGCM(block)
+		o.nonce = append([]byte(nil), iv[:12]...)
+		return o, err
+	}
+	o.stream = cipher.NewCTR(block, iv[:aes.BlockSize])
+	if macName == "hmac-sha2-512" {
+		o.mac = hmac.New(sha512.New, macKey)
+	} else {
+		o.mac = hmac.New(sha256.New, macKey)
+	}
+	return o, nil
+}
+
+func sshKeySize(cipherName string) int {
+	switch cipherName {
+	case "aes256-gcm@openssh.com", "aes256-ctr":
+		return 32
+	case "aes192-ctr":
+		return 24
+	}
+	return 16
+}
+
+func sshMacKeySize(macName string) int {
+	if macName == "hmac-sha2-512" {
+		return 64
+	}
+	return 32
+}
+
+func (o *sshCipherState) incNonce() {
+	for i := len(o.nonce) - 1; i >= 4; i-- {
+		o.nonce[i]++
+		if o.nonce[i] != 0 {
+			break
+		}
+	}
+}
+
+func (o *sshCipherState) macSum(packet []byte) []byte {
+	o.mac.Reset()
+	var seq [4]byte
+	binary.BigEndian.PutUint32(seq[:], o.seq)
+	o.mac.Write(seq[:])
+	o.mac.Write(packet)
+	return o.mac.Sum(nil)
+}
+
+// The algorithms agreed by the key exchange, the first of the client's
+// supported by the server
+type sshAlgorithms struct {
+	kex, hostKey      string
+	cipherIn, macIn   string
+	cipherOut, macOut string
+	// The client sent a packet of a guessed key exchange, which is wrong
+	guessWrong bool
+	// The client supports kex-strict and ext-info
+	strict, extInfo bool
+}
+
+func sshChoose(client, server []string) string {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c
+			}
+		}
+	}
+	return ""
+}
+
+func sshContains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// A connection of a client, the handshake, the auth and the channels
+type sshConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	clientV  string
+	hostKey  ed25519.PrivateKey
+	session  []byte
+	user     string
+	token    *Token
+	in, out  *sshCipherState
+	kexDone  bool
+	outClose bool
+	// By kex-strict, the sequence numbers restart at each NEWKEYS
+	strict bool
+
+	// Held to write, and by the key exchange throughout
+	wmu sync.Mutex
+
+	mu sync.Mutex
+	// The keys of the CAs of the user certificates
+	userCas [][]byte
+	// Whether the commands of ssh run as jobs, by sftp::exec
+	exec     bool
+	channels map[uint32]*sshChannel
+	nextId   uint32
+	wg       sync.WaitGroup
+}
+
+// The name in the logs of the user logged in
+func (o *sshConn) who() string {
+	if o.token == nil {
+		return fmt.Sprintf("%s from %s", o.user, o.conn.RemoteAddr())
+	}
+	return fmt.Sprintf("%s(token %s) from %s", o.user, o.token.Name, o.conn.RemoteAddr())
+}
+
+func (o *sshConn) readPacket() ([]byte, error) {
+	in := o.in
+	var packet []byte
+	switch {
+	case in.aead != nil:
+		var lb [4]byte
+		if _, err := io.ReadFull(o.r, lb[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(lb[:])
+		if n > sshMaxPacket || n < aes.BlockSize || n%aes.BlockSize != 0 {
+			return nil, errors.New("ssh: invalid packet length")
+		}
+		ct := make([]byte, int(n)+in.aead.Overhead())
+		if _, err := io.ReadFull(o.r, ct); err != nil {
+			return nil, err
+		}
+		plain, err := in.aead.Open(ct[:0], in.nonce, ct, lb[:])
+		if err != nil {
+			return nil, errors.New("ssh: packet authentication failed")
+		}
+		in.incNonce()
+		packet = append(lb[:], plain...)
+	case in.stream != nil:
+		first := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(o.r, first); err != nil {
+			return nil, err
+		}
+		in.stream.XORKeyStream(first, first)
+		n := binary.BigEndian.Uint32(first)
+		if n > sshMaxPacket || n+4 < aes.BlockSize || (n+4)%aes.BlockSize != 0 {
+			return nil, errors.New("ssh: invalid packet length")
+		}
+		packet = make([]byte, 4+int(n)+in.mac.Size())
+		copy(packet, first)
+		if _, err := io.ReadFull(o.r, packet[aes.BlockSize:]); err != nil {
+			return nil, err
+		}
+		mac := packet[4+n:]
+		packet = packet[:4+n]
+		in.stream.XORKeyStream(packet[aes.BlockSize:], packet[aes.BlockSize:])
+		if !hmac.Equal(mac, in.macSum(packet)) {
+			return nil, errors.New("ssh: packet authentication failed")
+		}
+	default:
+		var lb [4]byte
+		if _, err := io.ReadFull(o.r, lb[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(lb[:])
+		if n > sshMaxPacket || n < 5 {
+			return nil, errors.New("ssh: invalid packet length")
+		}
+		packet = make([]byte, 4+n)
+		copy(packet, lb[:])
+		if _, err := io.ReadFull(o.r, packet[4:]); err != nil {
+			return nil, err
+		}
+	}
+	in.seq++
+	pad := int(packet[4])
+	if len(packet) < 5+pad+1 {
+		return nil, errors.New("ssh: invalid padding")
+	}
+	return packet[5 : len(packet)-pad], nil
+}
+
+func (o *sshConn) writePacket(payload []byte) error {
+	o.wmu.Lock()
+	defer o.wmu.Unlock()
+	return o.writePacketLocked(payload)
+}
+
+// Called with wmu held
+func (o *sshConn) writePacketLocked(payload []byte) error {
+	if o.outClose {
+		return io.ErrClosedPipe
+	}
+	out := o.out
+	bs := out.blockSize()
+	// The length is out of the blocks of aes-gcm
+	n := 5 + len(payload)
+	if out.aead != nil {
+		n = 1 + len(payload)
+	}
+	pad := bs - n%bs
+	if pad < 4 {
+		pad += bs
+	}
+	packet := make([]byte, 5+len(payload)+pad, 5+len(payload)+pad+64)
+	binary.BigEndian.PutUint32(packet, uint32(1+len(payload)+pad))
+	packet[4] = byte(pad)
+	copy(packet[5:], payload)
+	rand.Read(packet[5+len(payload):])
+
+	switch {
+	case out.aead != nil:
+		packet = out.aead.Seal(packet[:4], out.nonce, packet[4:], packet[:4])
+		out.incNonce()
+	case out.stream != nil:
+		mac := out.macSum(packet)
+		out.stream.XORKeyStream(packet, packet)
+		packet = append(packet, mac...)
+	}
+	out.seq++
+	if _, err := o.conn.Write(packet); err != nil {
+		o.outClose = true
+		return err
+	}
+	return nil
+}
+
+func (o *sshConn) disconnect(reason uint32, msg string) {
+	var w sshWriter
+	w.Byte(sshMsgDisconnect)
+	w.Uint32(reason)
+	w.String(msg)
+	w.String("")
+	o.writePacket(w.buf)
+}
+
+// Exchange the versions, the first line of the client may be preceded by others
+func (o *sshConn) handshakeVersion() error {
+	if _, err := io.WriteString(o.conn, sshServerVersion+"\r\n"); err != nil {
+		return err
+	}
+	for i := 0; i < 16; i++ {
+		line, err := o.r.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		s := strings.TrimRight(string(line), "\r\n")
+		if strings.HasPrefix(s, "SSH-") {
+			if !strings.HasPrefix(s, "SSH-2.0-") && !strings.HasPrefix(s, "SSH-1.99-") {
+				return errors.New("unsupported ssh version: " + s)
+			}
+			o.clientV = s
+			return nil
+		}
+	}
+	return errors.New("no ssh version from the client")
+}
+
+func (o *sshConn) kexInit(initial bool) []byte {
+	var w sshWriter
+	w.Byte(sshMsgKexInit)
+	cookie := make([]byte, 16)
+	rand.Read(cookie)
+	w.buf = append(w.buf, cookie...)
+	kex := sshKexAlgos
+	if initial {
+		kex = append(append([]string(nil), kex...), "kex-strict-s-v00@openssh.com")
+	}
+	for _, list := range [][]string{kex, sshHostKeyAlgos, sshCiphers, sshCiphers, sshMacs, sshMacs,
+		{"none"}, {"none"}, nil, nil} {
+		w.String(strings.Join(list, ","))
+	}
+	w.Bool(false)
+	w.Uint32(0)
+	return w.buf
+}
+
+func parseKexInit(payload []byte) (*sshAlgorithms, error) {
+	r := &sshReader{b: payload[1:]}
+	r.next(16)
+	lists := make([][]string, 10)
+	for i := range lists {
+		lists[i] = r.NameList()
+	}
+	firstKexFollows := r.Bool()
+	if r.err != nil {
+		return nil, r.err
+	}
+	a := &sshAlgorithms{}
+	a.kex = sshChoose(lists[0], sshKexAlgos)
+	a.hostKey = sshChoose(lists[1], sshHostKeyAlgos)
+	a.cipherIn = sshChoose(lists[2], sshCiphers)
+	a.cipherOut = sshChoose(lists[3], sshCiphers)
+	a.macIn = sshChoose(lists[4], sshMacs)
+	a.macOut = sshChoose(lists[5], sshMacs)
+	switch {
+	case a.kex == "":
+		return nil, errors.New("no common key exchange")
+	case a.hostKey == "":
+		return nil, errors.New("no common host key")
+	case a.cipherIn == "" || a.cipherOut == "":
+		return nil, errors.New("no common cipher")
+	case (a.macIn == "" && !strings.Contains(a.cipherIn, "gcm")) || (a.macOut == "" && !strings.Contains(a.cipherOut, "gcm")):
+		return nil, errors.New("no common mac")
+	case !sshContains(lists[6], "none") || !sshContains(lists[7], "none"):
+		return nil, errors.New("no common compression")
+	}
+	a.guessWrong = firstKexFollows && (lists[0][0] != a.kex || lists[1][0] != a.hostKey)
+	a.strict = sshContains(lists[0], "kex-strict-c-v00@openssh.com")
+	a.extInfo = sshContains(lists[0], "ext-info-c")
+	return a, nil
+}
+
+// Run a key exchange on the KEXINIT of the client, the writes of the others
+// wait until it finishes
+func (o *sshConn) kex(clientInit []byte) error {
+	o.wmu.Lock()
+	defer o.wmu.Unlock()
+
+	initial := !o.kexDone
+	serverInit := o.kexInit(initial)
+	if err := o.writePacketLocked(serverInit); err != nil {
+		return err
+	}
+	algos, err := parseKexInit(clientInit)
+	if err != nil {
+		return err
+	}
+	if initial {
+		o.strict = algos.strict
+	}
+	// Only the messages of the exchange are allowed in the first one by kex-strict
+	strict := initial && o.strict
+
+	// The ECDH_INIT, after the wrongly guessed packet of the client if any
+	var qc []byte
+	for qc == nil {
+		p, err := o.readPacket()
+		if err != nil {
+			return err
+		}
+		switch {
+		case algos.guessWrong:
+			algos.guessWrong = false
+		case p[0] == sshMsgKexEcdhInit:
+			r := &sshReader{b: p[1:]}
+			if qc = r.Bytes(); r.err != nil {
+				return r.err
+			}
+		case !strict && (p[0] == sshMsgIgnore || p[0] == sshMsgDebug):
+		default:
+			return fmt.Errorf("unexpected message %d in the key exchange", p[0])
+		}
+	}
+
+	curve := ecdh.X25519()
+	if algos.kex == "ecdh-sha2-nistp256" {
+		curve = ecdh.P256()
+	}
+	clientPub, err := curve.NewPublicKey(qc)
+	if err != nil {
+		return err
+	}
+	priv, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	secret, err := priv.ECDH(clientPub)
+	if err != nil {
+		return err
+	}
+	qs := priv.PublicKey().Bytes()
+
+	var ks sshWriter
+	ks.String("ssh-ed25519")
+	ks.Bytes(o.hostKey.Public().(ed25519.PublicKey))
+	var hw sshWriter
+	hw.String(o.clientV)
+	hw.String(sshServerVersion)
+	hw.Bytes(clientInit)
+	hw.Bytes(serverInit)
+	hw.Bytes(ks.buf)
+	hw.Bytes(qc)
+	hw.Bytes(qs)
+	hw.Mpint(secret)
+	h := sha256.Sum256(hw.buf)
+	if o.session == nil {
+		o.session = h[:]
+	}
+
+	var sig sshWriter
+	sig.String("ssh-ed25519")
+	sig.Bytes(ed25519.Sign(o.hostKey, h[:]))
+	var reply sshWriter
+	reply.Byte(sshMsgKexEcdhReply)
+	reply.Bytes(ks.buf)
+	reply.Bytes(qs)
+	reply.Bytes(sig.buf)
+	if err = o.writePacketLocked(reply.buf); err != nil {
+		return err
+	}
+	if err = o.writePacketLocked([]byte{sshMsgNewKeys}); err != nil {
+		return err
+	}
+
+	var k sshWriter
+	k.Mpint(secret)
+	derive := func(letter byte, n int) []byte {
+		d := sha256.New()
+		d.Write(k.buf)
+		d.Write(h[:])
+		d.Write([]byte{letter})
+		d.Write(o.session)
+		key := d.Sum(nil)
+		for len(key) < n {
+			d.Reset()
+			d.Write(k.buf)
+			d.Write(h[:])
+			d.Write(key)
+			key = d.Sum(key)
+		}
+		return key[:n]
+	}
+	out, err := newSshCipherState(algos.cipherOut, algos.macOut, derive('B', 16), derive('D', sshKeySize(algos.cipherOut)),
+		derive('F', sshMacKeySize(algos.macOut)))
+	if err != nil {
+		return err
+	}
+	in, err := newSshCipherState(algos.cipherIn, algos.macIn, derive('A', 16), derive('C', sshKeySize(algos.cipherIn)),
+		derive('E', sshMacKeySize(algos.macIn)))
+	if err != nil {
+		return err
+	}
+	if !o.strict {
+		out.seq = o.out.seq
+	}
+	o.out = out
+	if initial && algos.extInfo {
+		var w sshWriter
+		w.Byte(sshMsgExtInfo)
+		w.Uint32(1)
+		w.String("server-sig-algs")
+		w.String(strings.Join(sshSigAlgos, ","))
+		if err = o.writePacketLocked(w.buf); err != nil {
+			return err
+		}
+	}
+
+	for {
+		p, err := o.readPacket()
+		if err != nil {
+			return err
+		}
+		if p[0] == sshMsgNewKeys {
+			break
+		}
+		if strict || (p[0] != sshMsgIgnore && p[0] != sshMsgDebug) {
+			return fmt.Errorf("unexpected message %d in the key exchange", p[0])
+		}
+	}
+	if !o.strict {
+		in.seq = o.in.seq
+	}
+	o.in = in
+	o.kexDone = true
+	return nil
+}
+
+// The next message not of the transport, the key exchanges requested by
+// the client are run in between
+func (o *sshConn) next() ([]byte, error) {
+	for {
+		p, err := o.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		if len(p) == 0 {
+			return nil, errors.New("ssh: empty packet")
+		}
+		switch p[0] {
+		case sshMsgDisconnect:
+			return nil, io.EOF
+		case sshMsgIgnore, sshMsgDebug, sshMsgUnimplemented:
+		case sshMsgKexInit:
+			if err = o.kex(p); err != nil {
+				return nil, err
+			}
+		default:
+			if !o.kexDone {
+				return nil, fmt.Errorf("unexpected message %d before the key exchange", p[0])
+			}
+			return p, nil
+		}
+	}
+}
+
+func (o *sshConn) unimplemented() error {
+	var w sshWriter
+	w.Byte(sshMsgUnimplemented)
+	w.Uint32(o.in.seq - 1)
+	return o.writePacket(w.buf)
+}
+
+// The user certificate of the wire format, checked valid for the user, a
+// principal of it
+func (o *sshConn) userCert(blob []byte, user string) (*sshCert, error) {
+	if len(o.userCas) == 0 || tokenStore() == nil {
+		return nil, errors.New("no trusted user CA, or no token file")
+	}
+	cert, err := parseSshCert(blob)
+	if err != nil {
+		return nil, err
+	}
+	if err = cert.checkAuthority(o.userCas, user, o.conn.RemoteAddr(), time.Now()); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Authenticate the client by the password of a token, by a key of a token,
+// or by a certificate of a trusted CA for a token, or let it in if the auth
+// of the agent is disabled
+func (o *sshConn) auth() error {
+	p, err := o.next()
+	if err != nil {
+		return err
+	}
+	r := &sshReader{b: p[1:]}
+	if p[0] != sshMsgServiceRequest || r.String() != "ssh-userauth" {
+		return errors.New("expect the ssh-userauth service")
+	}
+	var w sshWriter
+	w.Byte(sshMsgServiceAccept)
+	w.String("ssh-userauth")
+	if err = o.writePacket(w.buf); err != nil {
+		return err
+	}
+
+	// The key last accepted by a probe without a signature
+	var probed []byte
+	for tries := 0; tries < sshMaxAuthTries; {
+		p, err := o.next()
+		if err != nil {
+			return err
+		}
+		if p[0] != sshMsgUserauthRequest {
+			return fmt.Errorf("unexpected message %d in the auth", p[0])
+		}
+		r := &sshReader{b: p[1:]}
+		user, service, method := r.String(), r.String(), r.String()
+		if r.err != nil {
+			return r.err
+		}
+		o.user = user
+		if service != "ssh-connection" {
+			return errors.New("unsupported service: " + service)
+		}
+
+		var tok *Token
+		err = errTokenInvalid
+		switch {
+		case !AuthEnabled():
+			// Anyone is let in like to the http api
+			err = nil
+		case method == "password":
+			if r.Bool() {
+				// Changing the password is not supported
+				break
+			}
+			tries++
+			password := r.String()
+			tok, err = authenticateToken(password)
+			if err == errTokenInvalid && gLdap != nil {
+				tok, err = gLdap.Authenticate(user, password)
+			}
+		case method == "publickey":
+			signed := r.Bool()
+			algo, blob := r.String(), r.Bytes()
+			if r.err != nil {
+				return r.err
+			}
+			// The probes count too, so that the keys of the tokens can't be
+			// tried without a limit, but not the signature of the key the
+			// probe before accepted
+			if !signed || !bytes.Equal(blob, probed) {
+				tries++
+			}
+			probed = nil
+			// A certificate, or a key of a token
+			sigAlgo, cert := algo, (*sshCert)(nil)
+			var key crypto.PublicKey
+			var perr error
+			if sshContains(sshCertAlgos, algo) {
+				sigAlgo = strings.TrimSuffix(algo, sshCertSuffix)
+				if cert, perr = o.userCert(blob, user); perr == nil {
+					key = cert.Key
+				}
+			} else if key, perr = parseSshPublicKey(blob); perr == nil && (tokenStore() == nil || !tokenStore().HasSshKey(blob)) {
+				perr = errTokenInvalid
+			}
+			if perr != nil || !sshContains(sshSigAlgos, sigAlgo) {
+				if perr != nil && perr != errTokenInvalid {
+					err = perr
+				}
+				break
+			}
+			if !signed {
+				probed = blob
+				var ok sshWriter
+				ok.Byte(sshMsgUserauthPkOk)
+				ok.String(algo)
+				ok.Bytes(blob)
+				if err = o.writePacket(ok.buf); err != nil {
+					return err
+				}
+				continue
+			}
+			var data sshWriter
+			data.Bytes(o.session)
+			data.Byte(sshMsgUserauthRequest)
+			data.String(user)
+			data.String(service)
+			data.String("publickey")
+			data.Bool(true)
+			data.String(algo)
+			data.Bytes(blob)
+			if !verifySshSignature(key, sigAlgo, data.buf, r.Bytes()) {
+				break
+			}
+			if cert == nil {
+				tok, err = tokenStore().AuthenticateSshKey(blob)
+				break
+			}
+			if tok, err = tokenStore().AuthenticateName(user); err == nil {
+				log.Infof("audit: sftp login of %s by the certificate %q, serial %d", user, cert.KeyId, cert.Serial)
+			}
+		}
+
+		if err == nil {
+			o.token = tok
+			return o.writePacket([]byte{sshMsgUserauthSuccess})
+		}
+		if method != "none" {
+			msg := fmt.Sprintf("auth failed: sftp %s of %s from %s: %s", method, user, o.conn.RemoteAddr(), err)
+			log.Warn(msg)
+			ReportWarningEvent(EventAuthFailed, msg)
+		}
+		var fail sshWriter
+		fail.Byte(sshMsgUserauthFailure)
+		fail.String("publickey,password")
+		fail.Bool(false)
+		if err = o.writePacket(fail.buf); err != nil {
+			return err
+		}
+	}
+	o.disconnect(sshDisconnectAuthFailed, "too many authentication failures")
+	return errors.New("too many auth failures")
+}
+
+// Serve the channels of the client until it disconnects
+func (o *sshConn) serve() error {
+	defer o.closeChannels()
+	for {
+		p, err := o.next()
+		if err != nil {
+			return err
+		}
+		r := &sshReader{b: p[1:]}
+		switch p[0] {
+		case sshMsgGlobalRequest:
+			r.Bytes()
+			if r.Bool() {
+				err = o.writePacket([]byte{sshMsgRequestFailure})
+			}
+		case sshMsgChannelOpen:
+			err = o.openChannel(r)
+		case sshMsgChannelData, sshMsgChannelExtendedData, sshMsgChannelWindowAdjust,
+			sshMsgChannelEOF, sshMsgChannelClose, sshMsgChannelRequest:
+			o.mu.Lock()
+			ch := o.channels[r.Uint32()]
+			o.mu.Unlock()
+			if ch == nil {
+				return fmt.Errorf("message %d of an unknown channel", p[0])
+			}
+			err = ch.handle(p[0], r)
+		case sshMsgChannelSuccess, sshMsgChannelFailure:
+		default:
+			err = o.unimplemented()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (o *sshConn) openChannel(r *sshReader) error {
+	typ, peerId, peerWindow, peerMax := r.String(), r.Uint32(), r.Uint32(), r.Uint32()
+	if r.err != nil {
+		return r.err
+	}
+	var w sshWriter
+	o.mu.Lock()
+	if typ != "session" || len(o.channels) >= sshMaxChannels {
+		o.mu.Unlock()
+		reason, msg := uint32(sshOpenUnknownChannelType), "only the session channel is supported"
+		if typ == "session" {
+			reason, msg = sshOpenAdministrativelyProhibited, "too many channels"
+		}
+		w.Byte(sshMsgChannelOpenFailure)
+		w.Uint32(peerId)
+		w.Uint32(reason)
+		w.String(msg)
+		w.String("")
+		return o.writePacket(w.buf)
+	}
+	ch := &sshChannel{conn: o, id: o.nextId, peerId: peerId, peerWindow: peerWindow, peerMax: peerMax, window: sshChannelWindow,
+		closedC: make(chan struct{})}
+	ch.cond = sync.NewCond(&ch.mu)
+	o.nextId++
+	o.channels[ch.id] = ch
+	o.mu.Unlock()
+
+	w.Byte(sshMsgChannelOpenConfirmation)
+	w.Uint32(peerId)
+	w.Uint32(ch.id)
+	w.Uint32(sshChannelWindow)
+	w.Uint32(sshMaxPacket - 1024)
+	return o.writePacket(w.buf)
+}
+
+func (o *sshConn) closeChannels() {
+	o.mu.Lock()
+	for _, ch := range o.channels {
+		ch.close()
+	}
+	o.mu.Unlock()
+	o.wg.Wait()
+}
+
+// A session channel, the client's data is buffered within the window
+// advertised, and the data to the client waits for the client's window
+type sshChannel struct {
+	conn   *sshConn
+	id     uint32
+	peerId uint32
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	peerWindow uint32
+	peerMax    uint32
+	in         []byte
+	window     uint32 // The data the client may still send
+	consumed   uint32 // The data read since the last window adjust
+	eof        bool
+	closed     bool
+	closedC    chan struct{} // Closed with closed
+	subsystem  string
+
+	// Held to send the last messages, none is sent after CLOSE
+	closeMu   sync.Mutex
+	sentClose bool
+}
+
+func (o *sshChannel) handle(typ byte, r *sshReader) error {
+	switch typ {
+	case sshMsgChannelData, sshMsgChannelExtendedData:
+		if typ == sshMsgChannelExtendedData {
+			r.Uint32()
+		}
+		data := r.Bytes()
+		if r.err != nil {
+			return r.err
+		}
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		if uint32(len(data)) > o.window {
+			return errors.New("the client sent over the channel window")
+		}
+		o.window -= uint32(len(data))
+		if typ == sshMsgChannelData {
+			o.in = append(o.in, data...)
+		} else {
+			o.consumed += uint32(len(data))
+		}
+		o.cond.Broadcast()
+	case sshMsgChannelWindowAdjust:
+		n := r.Uint32()
+		o.mu.Lock()
+		o.peerWindow += n
+		o.cond.Broadcast()
+		o.mu.Unlock()
+	case sshMsgChannelEOF:
+		o.mu.Lock()
+		o.eof = true
+		o.cond.Broadcast()
+		o.mu.Unlock()
+	case sshMsgChannelClose:
+		o.close()
+		o.conn.mu.Lock()
+		delete(o.conn.channels, o.id)
+		o.conn.mu.Unlock()
+		return o.sendClose()
+	case sshMsgChannelRequest:
+		return o.request(r)
+	}
+	return nil
+}
+
+// Closed by the client, or the connection
+func (o *sshChannel) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.closed {
+		close(o.closedC)
+	}
+	o.eof, o.closed = true, true
+	o.cond.Broadcast()
+}
+
+func (o *sshChannel) request(r *sshReader) error {
+	typ, wantReply := r.String(), r.Bool()
+	// Started after the reply
+	var start func()
+	switch typ {
+	case "subsystem":
+		name := r.String()
+		o.mu.Lock()
+		if name == "sftp" && o.subsystem == "" {
+			o.subsystem, start = name, o.runSftp
+		}
+		o.mu.Unlock()
+	case "exec":
+		cmd := r.String()
+		o.mu.Lock()
+		if o.conn.exec && r.err == nil && o.subsystem == "" {
+			o.subsystem, start = typ, func() { o.runExec(cmd) }
+		}
+		o.mu.Unlock()
+		if start == nil {
+			log.Warnf("sftp exec of %s refused: %s", o.conn.who(), cmd)
+		}
+	case "shell":
+		log.Warnf("sftp shell of %s refused, only the sftp subsystem and the commands are supported", o.conn.who())
+	}
+	if wantReply {
+		var w sshWriter
+		if start != nil {
+			w.Byte(sshMsgChannelSuccess)
+		} else {
+			w.Byte(sshMsgChannelFailure)
+		}
+		w.Uint32(o.peerId)
+		if err := o.conn.writePacket(w.buf); err != nil {
+			return err
+		}
+	}
+	if start != nil {
+		o.conn.wg.Add(1)
+		go start()
+	}
+	return nil
+}
+
+func (o *sshChannel) runSftp() {
+	defer o.conn.wg.Done()
+	log.Infof("audit: sftp session of %s", o.conn.who())
+	err := serveSftp(o, o.conn.token, o.conn.who())
+	if err != nil && err != io.EOF {
+		log.Warnf("sftp session of %s failed: %s", o.conn.who(), err)
+	}
+	log.Infof("sftp session of %s closed", o.conn.who())
+	o.exit(0)
+}
+
+// Send the exit status, then close the channel
+func (o *sshChannel) exit(code uint32) {
+	o.closeMu.Lock()
+	defer o.closeMu.Unlock()
+	if o.sentClose {
+		return
+	}
+	var status sshWriter
+	status.Byte(sshMsgChannelRequest)
+	status.Uint32(o.peerId)
+	status.String("exit-status")
+	status.Bool(false)
+	status.Uint32(code)
+	var eof sshWriter
+	eof.Byte(sshMsgChannelEOF)
+	eof.Uint32(o.peerId)
+	if o.conn.writePacket(status.buf) == nil && o.conn.writePacket(eof.buf) == nil {
+		o.sendCloseLocked()
+	}
+}
+
+func (o *sshChannel) sendClose() error {
+	o.closeMu.Lock()
+	defer o.closeMu.Unlock()
+	return o.sendCloseLocked()
+}
+
+// Called with closeMu held
+func (o *sshChannel) sendCloseLocked() error {
+	if o.sentClose {
+		return nil
+	}
+	o.sentClose = true
+	var w sshWriter
+	w.Byte(sshMsgChannelClose)
+	w.Uint32(o.peerId)
+	return o.conn.writePacket(w.buf)
+}
+
+// Read the client's data, io.EOF once it sent EOF and everything is read
+func (o *sshChannel) Read(p []byte) (int, error) {
+	o.mu.Lock()
+	for len(o.in) == 0 && !o.eof {
+		o.cond.Wait()
+	}
+	if len(o.in) == 0 {
+		o.mu.Unlock()
+		return 0, io.EOF
+	}
+	n := copy(p, o.in)
+	o.in = o.in[n:]
+	o.consumed += uint32(n)
+	var adjust uint32
+	if o.consumed >= sshChannelWindow/2 && !o.closed {
+		adjust, o.consumed = o.consumed, 0
+		o.window += adjust
+	}
+	o.mu.Unlock()
+
+	if adjust > 0 {
+		var w sshWriter
+		w.Byte(sshMsgChannelWindowAdjust)
+		w.Uint32(o.peerId)
+		w.Uint32(adjust)
+		if err := o.conn.writePacket(w.buf); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Write the data to the client in the messages its window and packet size allow
+func (o *sshChannel) Write(p []byte) (int, error) {
+	return o.write(0, p)
+}
+
+// Write the data of the stream, 0 for stdout, or sshExtendedStderr
+func (o *sshChannel) write(stream uint32, p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		o.mu.Lock()
+		for o.peerWindow == 0 && !o.closed {
+			o.cond.Wait()
+		}
+		if o.closed {
+			o.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		n := uint32(len(p))
+		if n > o.peerWindow {
+			n = o.peerWindow
+		}
+		if n > o.peerMax {
+			n = o.peerMax
+		}
+		if n > sshChannelMaxData {
+			n = sshChannelMaxData
+		}
+		o.peerWindow -= n
+		o.mu.Unlock()
+
+		var w sshWriter
+		if stream == 0 {
+			w.Byte(sshMsgChannelData)
+			w.Uint32(o.peerId)
+		} else {
+			w.Byte(sshMsgChannelExtendedData)
+			w.Uint32(o.peerId)
+			w.Uint32(stream)
+		}
+		w.Bytes(p[:n])
+		if err := o.conn.writePacket(w.buf); err != nil {
+			return written, err
+		}
+		written += int(n)
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// The ssh server on sftp::listen
+type SftpServer struct {
+	ln      net.Listener
+	hostKey ed25519.PrivateKey
+	userCas [][]byte
+	exec    bool
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+var (
+	gSftpServer *SftpServer
+)
+
+func init() {
+	gHttpServer.AddToInit(InitSftpServer)
+	gHttpServer.AddToUninit(UninitSftpServer)
+}
+
+func InitSftpServer() error {
+	gSftpServer = nil
+	cnf := gApp.Cnf
+	if !cnf.SftpEnabled {
+		return nil
+	}
+	key, err := loadOrCreateSigningKey(cnf.SftpHostKey)
+	if err != nil {
+		log.Errorf("load sftp host key failed: %s", err)
+		return err
+	}
+	var cas [][]byte
+	if cnf.SftpTrustedUserCaKeys != "" {
+		if cas, err = loadSshCaKeys(cnf.SftpTrustedUserCaKeys); err != nil {
+			log.Errorf("load sftp trusted user CA keys failed: %s", err)
+			return err
+		}
+	}
+	ln, err := net.Listen("tcp", cnf.SftpListen)
+	if err != nil {
+		log.Errorf("sftp listen %s failed: %s", cnf.SftpListen, err)
+		return err
+	}
+	if !AuthEnabled() {
+		log.Warnf("sftp server on %s lets anyone in, the auth is disabled", cnf.SftpListen)
+	}
+	log.Printf("sftp server serving addr: %s, host key: %s", cnf.SftpListen, sshFingerprint(key))
+	gSftpServer = &SftpServer{ln: ln, hostKey: key, userCas: cas, exec: cnf.SftpExec, conns: make(map[net.Conn]struct{})}
+	go gSftpServer.serve()
+	return nil
+}
+
+func UninitSftpServer() {
+	if gSftpServer != nil {
+		gSftpServer.Close()
+		gSftpServer = nil
+	}
+}
+
+// The sha256 fingerprint of the host key as ssh-keygen -l prints it
+func sshFingerprint(key ed25519.PrivateKey) string {
+	var w sshWriter
+	w.String("ssh-ed25519")
+	w.Bytes(key.Public().(ed25519.PublicKey))
+	sum := sha256.Sum256(w.buf)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func (o *SftpServer) serve() {
+	for {
+		c, err := o.ln.Accept()
+		if err != nil {
+			o.mu.Lock()
+			closed := o.closed
+			o.mu.Unlock()
+			if !closed {
+				log.Errorf("sftp server quit: %s", err)
+			}
+			return
+		}
+		o.mu.Lock()
+		if o.closed {
+			o.mu.Unlock()
+			c.Close()
+			return
+		}
+		o.conns[c] = struct{}{}
+		o.wg.Add(1)
+		o.mu.Unlock()
+		go o.handle(c)
+	}
+}
+
+func (o *SftpServer) handle(c net.Conn) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("PANIC: sftp connection from %s: %s", c.RemoteAddr(), err)
+		}
+		c.Close()
+		o.mu.Lock()
+		delete(o.conns, c)
+		o.mu.Unlock()
+		o.wg.Done()
+	}()
+
+	conn := &sshConn{conn: c, r: bufio.NewReaderSize(c, 64<<10), hostKey: o.hostKey, userCas: o.userCas, exec: o.exec,
+		in: &sshCipherState{}, out: &sshCipherState{}, channels: make(map[uint32]*sshChannel)}
+	c.SetDeadline(time.Now().Add(sshHandshakeTimeout))
+	err := conn.handshakeVersion()
+	if err == nil {
+		var p []byte
+		if p, err = conn.readPacket(); err == nil {
+			if p[0] != sshMsgKexInit {
+				err = errors.New("expect KEXINIT")
+			} else {
+				err = conn.kex(p)
+			}
+		}
+		if err != nil && conn.clientV != "" {
+			conn.disconnect(sshDisconnectKexFailed, err.Error())
+		}
+	}
+	if err == nil {
+		err = conn.auth()
+	}
+	if err != nil {
+		log.Warnf("sftp handshake from %s failed: %s", c.RemoteAddr(), err)
+		return
+	}
+	c.SetDeadline(time.Time{})
+	log.Infof("sftp login of %s, client: %s", conn.who(), conn.clientV)
+
+	err = conn.serve()
+	if err != nil && err != io.EOF && !isClosedConnError(err) {
+		log.Warnf("sftp connection of %s failed: %s", conn.who(), err)
+		conn.disconnect(sshDisconnectProtocolError, err.Error())
+	}
+}
+
+func isClosedConnError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Stop accepting, and close the connections
+func (o *SftpServer) Close() {
+	o.mu.Lock()
+	o.closed = true
+	o.ln.Close()
+	for c := range o.conns {
+		c.Close()
+	}
+	o.mu.Unlock()
+	o.wg.Wait()
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The ssh server is tested against the sftp client of OpenSSH, skipped where
+// it isn't installed
+type sftpTest struct {
+	t        *testing.T
+	dir      string
+	jail     string
+	port     string
+	password string
+	hostKey  ed25519.PrivateKey
+	cas      [][]byte
+}
+
+func startSftpTest(t *testing.T) *sftpTest {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs the openssh client of unix")
+	}
+	for _, bin := range []string{"sftp", "ssh-keygen"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skip(bin + " not found")
+		}
+	}
+	setupJobs(t)
+	dir := t.TempDir()
+	jail, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gJailRoot = jail
+	t.Cleanup(func() { gJailRoot = "" })
+
+	var keys []string
+	for _, typ := range []string{"ed25519", "ecdsa", "rsa"} {
+		key := filepath.Join(dir, "id_"+typ)
+		if out, err := exec.Command("ssh-keygen", "-q", "-t", typ, "-N", "", "-f", key).CombinedOutput(); err != nil {
+			t.Fatalf("ssh-keygen: %s %s", err, out)
+		}
+		pub, _ := ioutil.ReadFile(key + ".pub")
+		keys = append(keys, strings.TrimSpace(string(pub)))
+	}
+	gTokenStore, err = NewTokenStore(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gTokenStore = nil })
+	password, _, err := gTokenStore.Create("ci", false, 0, nil, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The CA of the user certificates
+	ca := filepath.Join(dir, "ca")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", ca).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen: %s %s", err, out)
+	}
+	cas, err := loadSshCaKeys(ca + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	o := &sftpTest{t: t, dir: dir, jail: jail, password: password, hostKey: hostKey, cas: cas}
+	o.port = o.serve(false)
+	return o
+}
+
+// Start a server, running the commands of ssh with exec, whose port is
+// returned. Its settings are given before it starts, as the connections read
+// them.
+func (o *sftpTest) serve(exec bool) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	srv := &SftpServer{ln: ln, hostKey: o.hostKey, userCas: o.cas, exec: exec, conns: make(map[net.Conn]struct{})}
+	go srv.serve()
+	o.t.Cleanup(srv.Close)
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	var w sshWriter
+	w.String("ssh-ed25519")
+	w.Bytes(o.hostKey.Public().(ed25519.PublicKey))
+	f, err := os.OpenFile(filepath.Join(o.dir, "known_hosts"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "[127.0.0.1]:%s ssh-ed25519 %s\n", port, base64.StdEncoding.EncodeToString(w.buf))
+	return port
+}
+
+// Run the sftp commands of batch, logged in by the key of identity, or by
+// the password of the token if identity is empty
+func (o *sftpTest) run(identity, batch string, opts ...string) (string, error) {
+	batchFile := filepath.Join(o.dir, "batch")
+	if err := ioutil.WriteFile(batchFile, []byte(batch), 0600); err != nil {
+		o.t.Fatal(err)
+	}
+	args := []string{"-F", "none", "-P", o.port,
+		"-o", "UserKnownHostsFile=" + filepath.Join(o.dir, "known_hosts"),
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "ConnectTimeout=10",
+	}
+	cmd := exec.Command("sftp")
+	if identity != "" {
+		args = append(args, "-i", filepath.Join(o.dir, identity), "-o", "IdentitiesOnly=yes",
+			"-o", "PreferredAuthentications=publickey", "-o", "BatchMode=yes")
+	} else {
+		// The password is given by an askpass script, as sshpass isn't at hand
+		askpass := filepath.Join(o.dir, "askpass")
+		ioutil.WriteFile(askpass, []byte("#!/bin/sh\necho '"+o.password+"'\n"), 0700)
+		// Before -b, which turns on BatchMode, as ssh takes the first value of an option
+		args = append(args, "-o", "BatchMode=no", "-o", "PreferredAuthentications=password", "-o", "PubkeyAuthentication=no")
+		cmd.Env = append(os.Environ(), "SSH_ASKPASS="+askpass, "SSH_ASKPASS_REQUIRE=force", "DISPLAY=:0")
+	}
+	for _, opt := range opts {
+		args = append(args, "-o", opt)
+	}
+	cmd.Args = append(cmd.Args, append(args, "-b", batchFile, "ci@127.0.0.1")...)
+	cmd.Dir = o.dir
+	cmd.Stdin = nil
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// Upload a file, list, rename, download and remove it
+func (o *sftpTest) roundTrip(identity string, size int, opts ...string) {
+	data := make([]byte, size)
+	rand.Read(data)
+	local := filepath.Join(o.dir, "up")
+	if err := ioutil.WriteFile(local, data, 0600); err != nil {
+		o.t.Fatal(err)
+	}
+	os.Remove(filepath.Join(o.dir, "down"))
+	batch := "put up /a\nls -l /\nrename /a /b\nget /b down\nrm /b\n"
+	out, err := o.run(identity, batch, opts...)
+	if err != nil {
+		o.t.Fatalf("sftp %v: %s\n%s", opts, err, out)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(o.dir, "down"))
+	if err != nil || !bytes.Equal(got, data) {
+		o.t.Fatalf("sftp %v: got %d bytes back of %d, %v\n%s", opts, len(got), size, err, out)
+	}
+	if _, err = os.Stat(filepath.Join(o.jail, "b")); !os.IsNotExist(err) {
+		o.t.Fatalf("sftp %v: /b not removed: %v", opts, err)
+	}
+}
+
+func TestSftpOpenSshAlgorithms(t *testing.T) {
+	o := startSftpTest(t)
+	for _, kex := range sshKexAlgos {
+		o.roundTrip("id_ed25519", 100<<10, "KexAlgorithms="+kex)
+	}
+	for _, c := range sshCiphers {
+		if strings.HasSuffix(c, "-gcm@openssh.com") {
+			o.roundTrip("id_ed25519", 100<<10, "Ciphers="+c)
+			continue
+		}
+		for _, mac := range sshMacs {
+			o.roundTrip("id_ed25519", 100<<10, "Ciphers="+c, "MACs="+mac)
+			o.roundTrip("id_ed25519", 100<<10, "Ciphers="+c, "MACs="+mac+"-etm@openssh.com,"+mac)
+		}
+	}
+}
+
+func TestSftpOpenSshAuth(t *testing.T) {
+	o := startSftpTest(t)
+	o.roundTrip("id_ecdsa", 1000)
+	o.roundTrip("id_rsa", 1000, "PubkeyAcceptedAlgorithms=rsa-sha2-256")
+	o.roundTrip("id_rsa", 1000, "PubkeyAcceptedAlgorithms=rsa-sha2-512")
+	o.roundTrip("", 1000)
+
+	// A key of no token
+	key := filepath.Join(o.dir, "id_other")
+	exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", key).Run()
+	if out, err := o.run("id_other", "ls /\n"); err == nil {
+		t.Fatalf("logged in by an unknown key: %s", out)
+	}
+	// The sha1 signatures of ssh-rsa
+	if out, err := o.run("id_rsa", "ls /\n", "PubkeyAcceptedAlgorithms=ssh-rsa"); err == nil {
+		t.Fatalf("logged in by ssh-rsa: %s", out)
+	}
+	o.password = "wrong"
+	if out, err := o.run("", "ls /\n", "NumberOfPasswordPrompts=1"); err == nil {
+		t.Fatalf("logged in by a wrong password: %s", out)
+	}
+}
+
+// The keys probed without a signature count to the auth tries, but not the
+// signature of the key a probe accepted
+func TestSftpOpenSshProbes(t *testing.T) {
+	o := startSftpTest(t)
+	var others []string
+	for i := 0; i < sshMaxAuthTries; i++ {
+		key := fmt.Sprintf("id_other%d", i)
+		exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", filepath.Join(o.dir, key)).Run()
+		others = append(others, "IdentityFile="+filepath.Join(o.dir, key))
+	}
+	good := "IdentityFile=" + filepath.Join(o.dir, "id_ed25519")
+	few := append(append([]string{}, others[1:sshMaxAuthTries-2]...), good)
+	if out, err := o.run("id_other0", "ls /\n", few...); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if out, err := o.run("id_other0", "ls /\n", append(others[1:], good)...); err == nil {
+		t.Fatalf("logged in after %d probes: %s", sshMaxAuthTries, out)
+	}
+}
+
+// The keys exchanged again in the middle of a transfer
+func TestSftpOpenSshRekey(t *testing.T) {
+	o := startSftpTest(t)
+	o.roundTrip("id_ed25519", 4<<20, "RekeyLimit=256K")
+	o.roundTrip("id_ed25519", 4<<20, "RekeyLimit=256K", "Ciphers=aes256-ctr", "MACs=hmac-sha2-512")
+}
+
+// Outside of the jail
+func TestSftpOpenSshJail(t *testing.T) {
+	o := startSftpTest(t)
+	if err := os.Symlink("/etc", filepath.Join(o.jail, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range []string{"get /../../etc/passwd x\n", "get /etc/passwd x\n", "ls /etc/passwd\n"} {
+		if out, err := o.run("id_ed25519", batch); err == nil {
+			t.Errorf("%q: %s", batch, out)
+		}
+	}
+}
+
+// A new key of no token, and its certificate signed by the CA with the
+// options of ssh-keygen
+func (o *sftpTest) certify(name, typ string, opts ...string) {
+	key := filepath.Join(o.dir, name)
+	os.Remove(key)
+	os.Remove(key + ".pub")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", typ, "-N", "", "-f", key).CombinedOutput(); err != nil {
+		o.t.Fatalf("ssh-keygen: %s %s", err, out)
+	}
+	args := append([]string{"-q", "-s", filepath.Join(o.dir, "ca"), "-I", "test-" + name}, opts...)
+	if out, err := exec.Command("ssh-keygen", append(args, key+".pub")...).CombinedOutput(); err != nil {
+		o.t.Fatalf("ssh-keygen -s: %s %s", err, out)
+	}
+}
+
+func TestSftpOpenSshCertificate(t *testing.T) {
+	o := startSftpTest(t)
+	o.certify("id_cert", "ed25519", "-n", "ci,deploy", "-V", "-5m:+5m")
+	o.roundTrip("id_cert", 1000)
+	o.certify("id_cert", "rsa", "-n", "ci", "-V", "+0:+5m", "-O", "source-address=10.0.0.0/8,127.0.0.1")
+	o.roundTrip("id_cert", 1000, "PubkeyAcceptedAlgorithms=rsa-sha2-512-cert-v01@openssh.com")
+	o.certify("id_cert", "ecdsa", "-n", "ci")
+	o.roundTrip("id_cert", 1000)
+
+	for _, opts := range [][]string{
+		{"-n", "deploy"},
+		{"-n", "ci", "-V", "20200101:20200102"},
+		{"-n", "ci", "-V", "+1h:+2h"},
+		{"-n", "ci", "-O", "source-address=10.0.0.0/8"},
+		{"-n", "ci", "-O", "force-command=/bin/true"},
+		{"-n", "ci", "-h"},
+	} {
+		o.certify("id_cert", "ed25519", opts...)
+		if out, err := o.run("id_cert", "ls /\n"); err == nil {
+			t.Errorf("%v: logged in: %s", opts, out)
+		}
+	}
+
+	// Signed by another CA
+	os.Rename(filepath.Join(o.dir, "ca"), filepath.Join(o.dir, "ca.trusted"))
+	exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", filepath.Join(o.dir, "ca")).Run()
+	o.certify("id_cert", "ed25519", "-n", "ci")
+	if out, err := o.run("id_cert", "ls /\n"); err == nil {
+		t.Errorf("logged in by an untrusted CA: %s", out)
+	}
+}
+
+// The sessions are limited by transfer::upload_rate_limit and
+// download_rate_limit
+func TestSftpOpenSshRateLimit(t *testing.T) {
+	o := startSftpTest(t)
+	gApp.Cnf.UploadRateLimit, gApp.Cnf.DownloadRateLimit = 200, 200
+	start := time.Now()
+	// 300KB each way, less a burst of a second at most
+	o.roundTrip("id_ed25519", 300<<10)
+	if d := time.Since(start); d < time.Second {
+		t.Fatalf("took %s", d)
+	}
+}
+
+func TestSftpOpenSshExec(t *testing.T) {
+	o := startSftpTest(t)
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh not found")
+	}
+	gJobPool = NewWorkerPool("test", 2, 10, nil)
+	defer gJobPool.Close()
+	refused, port := o.port, o.serve(true)
+	sshRun := func(port, remote string) (string, string, int) {
+		cmd := exec.Command("ssh", "-F", "none", "-p", port, "-i", filepath.Join(o.dir, "id_ed25519"),
+			"-o", "IdentitiesOnly=yes", "-o", "BatchMode=yes",
+			"-o", "UserKnownHostsFile="+filepath.Join(o.dir, "known_hosts"), "-o", "StrictHostKeyChecking=yes",
+			"ci@127.0.0.1", remote)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		cmd.Run()
+		return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+	}
+
+	if _, _, code := sshRun(refused, "echo hi"); code != 255 {
+		t.Fatalf("exec not refused, exit %d", code)
+	}
+	if stdout, stderr, code := sshRun(port, "echo out; echo err >&2; exit 3"); stdout != "out\n" || stderr != "err\n" || code != 3 {
+		t.Fatalf("got %q, %q, exit %d", stdout, stderr, code)
+	}
+	// A body of /api/v1/cmd/run, checked like it
+	if stdout, _, code := sshRun(port, `{"cmd":"echo $A", "env":["A=1"]}`); stdout != "1\n" || code != 0 {
+		t.Fatalf("got %q, exit %d", stdout, code)
+	}
+	if _, stderr, code := sshRun(port, `{"cmd":"id", "run_as":"root"}`); code != 255 || !strings.Contains(stderr, "run_as") {
+		t.Fatalf("got %q, exit %d", stderr, code)
+	}
+	if _, stderr, code := sshRun(port, `{"cmd":"sleep 10", "timeout_seconds":1}`); code != 255 || !strings.Contains(stderr, "timed_out") {
+		t.Fatalf("got %q, exit %d", stderr, code)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// The OpenSSH user certificates of PROTOCOL.certkeys, signed by a CA of
+// sftp::trusted_user_ca_keys. A client logs in as a principal of its
+// certificate, by the token of that name, so that the short-lived
+// certificates a fleet already hands out need no keys added to the tokens.
+
+const sshCertSuffix = "-cert-v01@openssh.com"
+
+const sshUserCert = 1
+
+// The algorithms of the certificates accepted
+var sshCertAlgos = []string{
+	"ssh-ed25519" + sshCertSuffix,
+	"ecdsa-sha2-nistp256" + sshCertSuffix, "ecdsa-sha2-nistp384" + sshCertSuffix, "ecdsa-sha2-nistp521" + sshCertSuffix,
+	"rsa-sha2-256" + sshCertSuffix, "rsa-sha2-512" + sshCertSuffix,
+}
+
+type sshCert struct {
+	Key         crypto.PublicKey
+	Serial      uint64
+	Type        uint32
+	KeyId       string
+	Principals  []string
+	ValidAfter  uint64
+	ValidBefore uint64
+	Critical    map[string]string
+	// The key of the CA of the wire format, and its signature of signed
+	CaKey     []byte
+	Signature []byte
+	signed    []byte
+}
+
+// Parse a certificate of the wire format. The signature is not verified.
+func parseSshCert(b []byte) (*sshCert, error) {
+	r := &sshReader{b: b}
+	typ := r.String()
+	r.Bytes() // Nonce
+	plain := strings.TrimSuffix(typ, sshCertSuffix)
+	var fields int
+	switch plain {
+	case "ssh-ed25519":
+		fields = 1
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521", "ssh-rsa":
+		fields = 2
+	default:
+		return nil, errors.New("unsupported certificate type: " + typ)
+	}
+	// The key is the fields of the plain key after the nonce
+	var w sshWriter
+	w.String(plain)
+	for i := 0; i < fields; i++ {
+		w.Bytes(r.Bytes())
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	key, err := parseSshPublicKey(w.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &sshCert{Key: key, Critical: make(map[string]string)}
+	c.Serial, c.Type, c.KeyId = r.Uint64(), r.Uint32(), r.String()
+	principals := &sshReader{b: r.Bytes()}
+	c.ValidAfter, c.ValidBefore = r.Uint64(), r.Uint64()
+	critical := &sshReader{b: r.Bytes()}
+	r.Bytes() // Extensions
+	r.Bytes() // Reserved
+	c.CaKey = r.Bytes()
+	// Signed up to the key of the CA
+	c.signed = b[:len(b)-len(r.b)]
+	c.Signature = r.Bytes()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.b) > 0 {
+		return nil, errors.New("trailing data after the certificate")
+	}
+	for len(principals.b) > 0 && principals.err == nil {
+		c.Principals = append(c.Principals, principals.String())
+	}
+	for len(critical.b) > 0 && critical.err == nil {
+		name, data := critical.String(), &sshReader{b: critical.Bytes()}
+		c.Critical[name] = data.String()
+	}
+	if principals.err != nil || critical.err != nil {
+		return nil, errors.New("invalid certificate principals or options")
+	}
+	return c, nil
+}
+
+// Check the certificate is a user certificate signed by one of the CAs,
+// valid now for the principal from the address
+func (o *sshCert) checkAuthority(cas [][]byte, principal string, addr net.Addr, now time.Time) error {
+	if o.Type != sshUserCert {
+		return errors.New("not a user certificate")
+	}
+	trusted := false
+	for _, ca := range cas {
+		trusted = trusted || bytes.Equal(ca, o.CaKey)
+	}
+	if !trusted {
+		return errors.New("certificate signed by an untrusted CA")
+	}
+	caKey, err := parseSshPublicKey(o.CaKey)
+	if err != nil {
+		return fmt.Errorf("invalid CA key: %s", err)
+	}
+	algo := (&sshReader{b: o.Signature}).String()
+	if !sshContains(sshSigAlgos, algo) || !verifySshSignature(caKey, algo, o.signed, o.Signature) {
+		return errors.New("invalid certificate signature")
+	}
+	if t := uint64(now.Unix()); t < o.ValidAfter || t >= o.ValidBefore {
+		return errors.New("certificate expired or not yet valid")
+	}
+	found := false
+	for _, p := range o.Principals {
+		found = found || p == principal
+	}
+	if !found {
+		return fmt.Errorf("%s is not a principal of the certificate", principal)
+	}
+	for name, data := range o.Critical {
+		if name != "source-address" {
+			return errors.New("unsupported critical option: " + name)
+		}
+		if !sshSourceAllowed(data, addr) {
+			return fmt.Errorf("source address %s not allowed", addr)
+		}
+	}
+	return nil
+}
+
+// Whether the address is in the comma separated addresses and CIDRs
+func sshSourceAllowed(list string, addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.Equal(tcp.IP) {
+				return true
+			}
+			continue
+		}
+		if _, n, err := net.ParseCIDR(s); err == nil && n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// The keys of the CAs in a file of authorized_keys lines, # for comments
+func loadSshCaKeys(path string) ([][]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := parseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, i+1, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no CA key in " + path)
+	}
+	return keys, nil
+}
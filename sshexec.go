@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// With sftp::exec, the command of ssh runs as a job of the token, checked
+// like the body of /api/v1/cmd/run, e.g. ssh -p 2222 ci@build-01 'make
+// deploy', or is a json body of /api/v1/cmd/run itself. The output goes to
+// the stdout and the stderr of the client as it comes, and the exit code of
+// the job is the exit status. Closing the session cancels the job.
+func (o *sshChannel) runExec(cmd string) {
+	defer o.conn.wg.Done()
+	tok := o.conn.token
+	body := []byte(cmd)
+	if !strings.HasPrefix(strings.TrimSpace(cmd), "{") {
+		body, _ = json.Marshal(map[string]string{"cmd": cmd})
+	}
+	req, _, err := checkRunCmdReq(body, tok)
+	var job *Job
+	if err == nil {
+		job, err = startJob(req, tokenTenant(tok))
+	}
+	if err != nil {
+		log.Warnf("sftp exec of %s refused: %s", o.conn.who(), err)
+		o.write(sshExtendedStderr, []byte(err.Error()+"\n"))
+		o.exit(255)
+		return
+	}
+	log.Infof("audit: sftp exec of %s, job %s, cmd: %s", o.conn.who(), job.Id, job.Cmd)
+
+	backlog, c := job.Subscribe()
+	defer job.Unsubscribe(c)
+	send := func(chunk OutputChunk) {
+		var stream uint32
+		if chunk.Stream == "stderr" {
+			stream = sshExtendedStderr
+		}
+		o.write(stream, []byte(chunk.Data))
+	}
+	for _, chunk := range backlog {
+		send(chunk)
+	}
+	for c != nil {
+		select {
+		case chunk, ok := <-c:
+			if ok {
+				send(chunk)
+				continue
+			}
+			if !job.Finished() {
+				o.write(sshExtendedStderr, []byte("output subscriber too slow, dropped\n"))
+			}
+			c = nil
+		case <-o.closedC:
+			log.Infof("sftp exec of %s closed, cancel job %s", o.conn.who(), job.Id)
+			cancelJob(job.Id, tok)
+			return
+		}
+	}
+	select {
+	case <-job.Done():
+	case <-o.closedC:
+		cancelJob(job.Id, tok)
+		return
+	}
+
+	// A job which didn't exit by itself with a non-zero code tells why
+	s := job.Snapshot()
+	code := s.ExitCode
+	if s.Status != JSFinished && (code <= 0 || code > 255 || s.Status != JSFailed) {
+		o.write(sshExtendedStderr, []byte(fmt.Sprintf("job %s: %s\n", s.Status, s.Error)))
+		code = 255
+	}
+	o.exit(uint32(code))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Host counters streamed over a websocket, one json text message per
+// interval. The counters are cumulative since boot, the rates are of the
+// last interval.
+
+type HostStats struct {
+	Time       time.Time      `json:"time"`
+	Interval   float64        `json:"interval"` // Seconds since the last sample
+	Cpus       int            `json:"cpus"`
+	CpuPercent float64        `json:"cpu_percent"` // Of all the cpus
+	Load       []float64      `json:"load,omitempty"`
+	Memory     MemoryStats    `json:"memory"`
+	Disks      []*DiskIOStats `json:"disks"`
+	Net        []*NetIOStats  `json:"net"`
+}
+
+type MemoryStats struct {
+	Total       uint64  `json:"total"`
+	Available   uint64  `json:"available"`
+	Used        uint64  `json:"used"`
+	UsedPercent float64 `json:"used_percent"`
+	SwapTotal   uint64  `json:"swap_total"`
+	SwapUsed    uint64  `json:"swap_used"`
+}
+
+type DiskIOStats struct {
+	Name             string  `json:"name"`
+	ReadBytes        uint64  `json:"read_bytes"`
+	WriteBytes       uint64  `json:"write_bytes"`
+	Reads            uint64  `json:"reads"`
+	Writes           uint64  `json:"writes"`
+	ReadBytesPerSec  float64 `json:"read_bytes_per_sec"`
+	WriteBytesPerSec float64 `json:"write_bytes_per_sec"`
+	ReadsPerSec      float64 `json:"reads_per_sec"`
+	WritesPerSec     float64 `json:"writes_per_sec"`
+}
+
+type NetIOStats struct {
+	Name          string  `json:"name"`
+	RxBytes       uint64  `json:"rx_bytes"`
+	TxBytes       uint64  `json:"tx_bytes"`
+	RxPackets     uint64  `json:"rx_packets"`
+	TxPackets     uint64  `json:"tx_packets"`
+	RxErrors      uint64  `json:"rx_errors"`
+	TxErrors      uint64  `json:"tx_errors"`
+	RxBytesPerSec float64 `json:"rx_bytes_per_sec"`
+	TxBytesPerSec float64 `json:"tx_bytes_per_sec"`
+}
+
+// The raw counters read by the platform, the cpu times are in any unit
+type hostSample struct {
+	time              time.Time
+	cpuBusy, cpuTotal uint64
+	load              []float64
+	memory            MemoryStats
+	disks             []*DiskIOStats
+	net               []*NetIOStats
+}
+
+func (o *MemoryStats) setUsage() {
+	o.Used = o.Total - o.Available
+	if o.Total > 0 {
+		o.UsedPercent = float64(int(float64(o.Used)/float64(o.Total)*10000)) / 100
+	}
+}
+
+// The rate of a counter, 0 if it was reset or wrapped
+func counterRate(prev, cur uint64, secs float64) float64 {
+	if cur < prev || secs <= 0 {
+		return 0
+	}
+	return float64(int((float64(cur-prev)/secs)*100)) / 100
+}
+
+// The stats of cur with the rates since prev
+func newHostStats(prev, cur *hostSample) *HostStats {
+	secs := cur.time.Sub(prev.time).Seconds()
+	res := &HostStats{
+		Time:     cur.time,
+		Interval: float64(int(secs*1000)) / 1000,
+		Cpus:     runtime.NumCPU(),
+		Load:     cur.load,
+		Memory:   cur.memory,
+		Disks:    cur.disks,
+		Net:      cur.net,
+	}
+	if cur.cpuTotal > prev.cpuTotal && cur.cpuBusy >= prev.cpuBusy {
+		res.CpuPercent = float64(int(float64(cur.cpuBusy-prev.cpuBusy)/float64(cur.cpuTotal-prev.cpuTotal)*10000)) / 100
+	}
+
+	prevDisks := map[string]*DiskIOStats{}
+	for _, d := range prev.disks {
+		prevDisks[d.Name] = d
+	}
+	for _, d := range res.Disks {
+		if p := prevDisks[d.Name]; p != nil {
+			d.ReadBytesPerSec = counterRate(p.ReadBytes, d.ReadBytes, secs)
+			d.WriteBytesPerSec = counterRate(p.WriteBytes, d.WriteBytes, secs)
+			d.ReadsPerSec = counterRate(p.Reads, d.Reads, secs)
+			d.WritesPerSec = counterRate(p.Writes, d.Writes, secs)
+		}
+	}
+	prevNet := map[string]*NetIOStats{}
+	for _, n := range prev.net {
+		prevNet[n.Name] = n
+	}
+	for _, n := range res.Net {
+		if p := prevNet[n.Name]; p != nil {
+			n.RxBytesPerSec = counterRate(p.RxBytes, n.RxBytes, secs)
+			n.TxBytesPerSec = counterRate(p.TxBytes, n.TxBytes, secs)
+		}
+	}
+	return res
+}
+
+// Handler of the websocket streaming the host stats every interval seconds,
+// 5 by default
+func StatsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	interval := 5
+	if v := r.FormValue("interval"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 3600 {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid param interval, expect 1-3600 seconds"))
+			return
+		}
+		interval = n
+	}
+	prev, err := readHostSample()
+	if err != nil {
+		log.Errorf("read host stats failed: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+
+	conn, err := UpgradeWebsocket(w, r)
+	if err != nil {
+		log.Errorf("websocket upgrade failed: %s", err)
+		return
+	}
+	log.Infof("stats stream opened: %s", r.RemoteAddr)
+	defer log.Infof("stats stream closed: %s", r.RemoteAddr)
+	defer conn.Close()
+
+	// The client sends nothing but the control frames, the read loop ends
+	// when it goes away
+	closedC := make(chan struct{})
+	go func() {
+		defer close(closedC)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-closedC:
+			return
+		case <-gHttpServer.quitC:
+			conn.WriteMessage(wsClose, nil)
+			return
+		}
+		cur, err := readHostSample()
+		if err != nil {
+			log.Errorf("read host stats failed: %s", err)
+			continue
+		}
+		b, _ := json.Marshal(newHostStats(prev, cur))
+		if err = conn.WriteMessage(WsText, b); err != nil {
+			return
+		}
+		prev = cur
+	}
+}
@@ -0,0 +1,149 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The fields of a line of /proc/stat, /proc/diskstats and so on
+func procFields(path string, f func(fields []string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		f(strings.Fields(s.Text()))
+	}
+	return s.Err()
+}
+
+func parseUints(fields []string) []uint64 {
+	res := make([]uint64, len(fields))
+	for i, f := range fields {
+		res[i], _ = strconv.ParseUint(f, 10, 64)
+	}
+	return res
+}
+
+func readHostSample() (*hostSample, error) {
+	res := &hostSample{time: time.Now()}
+
+	err := procFields("/proc/stat", func(fields []string) {
+		// user nice system idle iowait irq softirq steal, the guest time is
+		// counted in user
+		if len(fields) < 9 || fields[0] != "cpu" {
+			return
+		}
+		v := parseUints(fields[1:9])
+		for _, t := range v {
+			res.cpuTotal += t
+		}
+		res.cpuBusy = res.cpuTotal - v[3] - v[4]
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.cpuTotal == 0 {
+		return nil, errors.New("no cpu line in /proc/stat")
+	}
+
+	if b, err := ioutil.ReadFile("/proc/loadavg"); err == nil && len(strings.Fields(string(b))) >= 3 {
+		for _, f := range strings.Fields(string(b))[:3] {
+			l, _ := strconv.ParseFloat(f, 64)
+			res.load = append(res.load, l)
+		}
+	}
+
+	var swapFree uint64
+	err = procFields("/proc/meminfo", func(fields []string) {
+		if len(fields) < 2 {
+			return
+		}
+		kb, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			res.memory.Total = kb * 1024
+		case "MemAvailable:":
+			res.memory.Available = kb * 1024
+		case "SwapTotal:":
+			res.memory.SwapTotal = kb * 1024
+		case "SwapFree:":
+			swapFree = kb * 1024
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	res.memory.setUsage()
+	res.memory.SwapUsed = res.memory.SwapTotal - swapFree
+
+	// The whole disks only, the partitions are not in /sys/block
+	res.disks = []*DiskIOStats{}
+	err = procFields("/proc/diskstats", func(fields []string) {
+		if len(fields) < 10 {
+			return
+		}
+		name := fields[2]
+		for _, p := range diskSkipPrefixes {
+			if strings.HasPrefix(name, p) {
+				return
+			}
+		}
+		if _, err := os.Stat("/sys/block/" + name); err != nil {
+			return
+		}
+		// reads merged sectors ms writes merged sectors, a sector is 512 bytes
+		v := parseUints(fields[3:10])
+		res.disks = append(res.disks, &DiskIOStats{
+			Name:       name,
+			Reads:      v[0],
+			ReadBytes:  v[2] * 512,
+			Writes:     v[4],
+			WriteBytes: v[6] * 512,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res.net = []*NetIOStats{}
+	err = procFields("/proc/net/dev", func(fields []string) {
+		// The name may stick to the first counter, e.g. eth0:123
+		if len(fields) == 0 || !strings.Contains(fields[0], ":") {
+			return
+		}
+		i := strings.Index(fields[0], ":")
+		name := fields[0][:i]
+		if rest := fields[0][i+1:]; rest != "" {
+			fields = append([]string{name, rest}, fields[1:]...)
+		}
+		if len(fields) < 17 || name == "lo" {
+			return
+		}
+		// rx: bytes packets errs drop fifo frame compressed multicast, then tx
+		v := parseUints(fields[1:17])
+		res.net = append(res.net, &NetIOStats{
+			Name:      name,
+			RxBytes:   v[0],
+			RxPackets: v[1],
+			RxErrors:  v[2],
+			TxBytes:   v[8],
+			TxPackets: v[9],
+			TxErrors:  v[10],
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"errors"
+)
+
+func readHostSample() (*hostSample, error) {
+	return nil, errors.New("host stats are only supported on linux and windows")
+}
@@ -0,0 +1,144 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	ioctlDiskPerformance = 0x70020
+	maxPhysicalDrives    = 32
+)
+
+var (
+	procGetSystemTimes       = modkernel32.NewProc("GetSystemTimes")
+	procGlobalMemoryStatusEx = modkernel32.NewProc("GlobalMemoryStatusEx")
+)
+
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+type diskPerformance struct {
+	BytesRead           int64
+	BytesWritten        int64
+	ReadTime            int64
+	WriteTime           int64
+	IdleTime            int64
+	ReadCount           uint32
+	WriteCount          uint32
+	QueueDepth          uint32
+	SplitCount          uint32
+	QueryTime           int64
+	StorageDeviceNumber uint32
+	StorageManagerName  [8]uint16
+}
+
+func filetimeTicks(ft *syscall.Filetime) uint64 {
+	return uint64(ft.HighDateTime)<<32 | uint64(ft.LowDateTime)
+}
+
+func readHostSample() (*hostSample, error) {
+	res := &hostSample{time: time.Now()}
+
+	// The kernel time includes the idle time
+	var idle, kernel, user syscall.Filetime
+	r, _, err := procGetSystemTimes.Call(uintptr(unsafe.Pointer(&idle)), uintptr(unsafe.Pointer(&kernel)), uintptr(unsafe.Pointer(&user)))
+	if r == 0 {
+		return nil, errors.New("GetSystemTimes: " + err.Error())
+	}
+	res.cpuTotal = filetimeTicks(&kernel) + filetimeTicks(&user)
+	res.cpuBusy = res.cpuTotal - filetimeTicks(&idle)
+
+	ms := memoryStatusEx{}
+	ms.Length = uint32(unsafe.Sizeof(ms))
+	r, _, err = procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&ms)))
+	if r == 0 {
+		return nil, errors.New("GlobalMemoryStatusEx: " + err.Error())
+	}
+	res.memory.Total, res.memory.Available = ms.TotalPhys, ms.AvailPhys
+	res.memory.setUsage()
+	// The page file limit is the physical memory plus the page files
+	if ms.TotalPageFile > ms.TotalPhys {
+		res.memory.SwapTotal = ms.TotalPageFile - ms.TotalPhys
+		committed, used := ms.TotalPageFile-ms.AvailPageFile, ms.TotalPhys-ms.AvailPhys
+		if committed > used {
+			res.memory.SwapUsed = committed - used
+		}
+	}
+
+	res.disks = []*DiskIOStats{}
+	for i := 0; i < maxPhysicalDrives; i++ {
+		if d := physicalDriveStats(i); d != nil {
+			res.disks = append(res.disks, d)
+		}
+	}
+
+	// The counters of the interfaces are 32-bit, a wrap shows as a rate of 0
+	res.net = []*NetIOStats{}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		row := syscall.MibIfRow{Index: uint32(iface.Index)}
+		if err := syscall.GetIfEntry(&row); err != nil {
+			continue
+		}
+		res.net = append(res.net, &NetIOStats{
+			Name:      iface.Name,
+			RxBytes:   uint64(row.InOctets),
+			RxPackets: uint64(row.InUcastPkts) + uint64(row.InNUcastPkts),
+			RxErrors:  uint64(row.InErrors),
+			TxBytes:   uint64(row.OutOctets),
+			TxPackets: uint64(row.OutUcastPkts) + uint64(row.OutNUcastPkts),
+			TxErrors:  uint64(row.OutErrors),
+		})
+	}
+	return res, nil
+}
+
+// The io counters of \\.\PhysicalDriveN, nil if it doesn't exist
+func physicalDriveStats(n int) *DiskIOStats {
+	name := "PhysicalDrive" + strconv.Itoa(n)
+	p, _ := syscall.UTF16PtrFromString(`\\.\` + name)
+	// No access right is needed to query the device
+	h, err := syscall.CreateFile(p, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return nil
+	}
+	defer syscall.CloseHandle(h)
+
+	var perf diskPerformance
+	var size uint32
+	err = syscall.DeviceIoControl(h, ioctlDiskPerformance, nil, 0,
+		(*byte)(unsafe.Pointer(&perf)), uint32(unsafe.Sizeof(perf)), &size, nil)
+	if err != nil {
+		return nil
+	}
+	return &DiskIOStats{
+		Name:       name,
+		ReadBytes:  uint64(perf.BytesRead),
+		WriteBytes: uint64(perf.BytesWritten),
+		Reads:      uint64(perf.ReadCount),
+		Writes:     uint64(perf.WriteCount),
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// A token bucket limiting the throughput of readers to rate bytes per second
+type RateLimiter struct {
+	rate   int64
+	tokens int64
+	last   time.Time
+
+	sync.Mutex
+}
+
+// A limiter with rate <= 0 never blocks
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{rate: rate, last: time.Now()}
+}
+
+// Block until n bytes may pass
+func (o *RateLimiter) WaitN(n int) {
+	if o == nil || o.rate <= 0 {
+		return
+	}
+	o.Lock()
+	now := time.Now()
+	o.tokens += int64(now.Sub(o.last).Seconds() * float64(o.rate))
+	if o.tokens > o.rate {
+		// Burst at most one second worth of data
+		o.tokens = o.rate
+	}
+	o.last = now
+	o.tokens -= int64(n)
+	deficit := -o.tokens
+	o.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(float64(deficit) / float64(o.rate) * float64(time.Second)))
+	}
+}
+
+type throttledReader struct {
+	r io.Reader
+	l *RateLimiter
+}
+
+func NewThrottledReader(r io.Reader, l *RateLimiter) io.Reader {
+	return &throttledReader{r: r, l: l}
+}
+
+func (o *throttledReader) Read(p []byte) (int, error) {
+	// Keep each read small enough to smooth out the traffic
+	if o.l != nil && o.l.rate > 0 && int64(len(p)) > o.l.rate {
+		p = p[:o.l.rate]
+	}
+	n, err := o.r.Read(p)
+	o.l.WaitN(n)
+	return n, err
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nu7hatch/gouuid"
+)
+
+// An api token, only the sha256 of the secret value is kept, the value
+// itself is returned once when the token is created or rotated.
+type Token struct {
+	Id           string    `json:"id"`
+	Name         string    `json:"name"`
+	Admin        bool      `json:"admin"`
+	Hash         string    `json:"hash,omitempty"`
+	CreateTime   time.Time `json:"create_time"`
+	ExpireTime   time.Time `json:"expire_time"` // Zero means never
+	LastUsedTime time.Time `json:"last_used_time"`
+	Revoked      bool      `json:"revoked"`
+	// The token only works in these windows, empty means any time
+	AllowedTimes []TimeWindow `json:"allowed_times,omitempty"`
+	// The public keys logging in to the sftp server as the token, as the
+	// lines of authorized_keys
+	SshKeys []string `json:"ssh_keys,omitempty"`
+
+	// The previous value keeps working until PrevExpireTime after a rotation
+	PrevHash       string    `json:"prev_hash,omitempty"`
+	PrevExpireTime time.Time `json:"prev_expire_time"`
+}
+
+// A weekly time window, e.g. {"days":["mon","fri"], "start":"09:00", "end":"18:00"}
+type TimeWindow struct {
+	Days     []string `json:"days,omitempty"`     // mon, tue, ..., sun, empty means every day
+	Start    string   `json:"start"`              // HH:MM
+	End      string   `json:"end"`                // HH:MM, less than start means crossing midnight
+	Timezone string   `json:"timezone,omitempty"` // IANA name, empty means the agent's local time
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+var (
+	errTokenInvalid  = errors.New("invalid token")
+	errTokenRevoked  = errors.New("token revoked")
+	errTokenExpired  = errors.New("token expired")
+	errTokenNotFound = errors.New("token not found")
+)
+
+// The id of the token configured by auth::admin_token
+const configAdminTokenId = "config"
+
+// How often the last used time of a token is persisted
+const lastUsedPersistInterval = time.Minute
+
+type TokenStore struct {
+	path   string
+	tokens map[string]*Token
+
+	sync.RWMutex
+}
+
+var (
+	gTokenStore *TokenStore
+	// Guards gTokenStore, which the bootstrap sets while the requests are served
+	gTokenStoreMu sync.RWMutex
+)
+
+func init() {
+	gHttpServer.AddToInit(InitTokenStore)
+}
+
+func InitTokenStore() error {
+	setTokenStore(nil)
+	if gApp.Cnf.AuthTokenFile == "" {
+		return nil
+	}
+	store, err := NewTokenStore(gApp.Cnf.AuthTokenFile)
+	if err != nil {
+		log.Errorf("load token file failed: %s", err)
+		return err
+	}
+	setTokenStore(store)
+	return nil
+}
+
+// The token store, nil if there is none
+func tokenStore() *TokenStore {
+	gTokenStoreMu.RLock()
+	defer gTokenStoreMu.RUnlock()
+	return gTokenStore
+}
+
+func setTokenStore(store *TokenStore) {
+	gTokenStoreMu.Lock()
+	gTokenStore = store
+	gTokenStoreMu.Unlock()
+}
+
+func AuthEnabled() bool {
+	return gApp.Cnf.AuthAdminToken != "" || tokenStore() != nil || gPolicy.HasTokens() || gLdap != nil || gKerberos != nil
+}
+
+func NewTokenStore(path string) (*TokenStore, error) {
+	o := &TokenStore{path: path, tokens: make(map[string]*Token)}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []*Token
+	if err = json.Unmarshal(b, &tokens); err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		o.tokens[t.Id] = t
+	}
+	return o, nil
+}
+
+// Write the tokens to a temporary file, then move it to the path, the lock must be held
+func (o *TokenStore) save() error {
+	tokens := make([]*Token, 0, len(o.tokens))
+	for _, t := range o.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreateTime.Before(tokens[j].CreateTime) })
+	b, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(o.path), filepath.Base(o.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Chmod(0600)
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), o.path)
+}
+
+func (o *TokenStore) Create(name string, admin bool, ttl time.Duration, windows []TimeWindow, sshKeys []string) (string, *Token, error) {
+	u, err := uuid.NewV4()
+	if err != nil {
+		return "", nil, err
+	}
+	value, hash, err := newTokenValue()
+	if err != nil {
+		return "", nil, err
+	}
+
+	t := &Token{Id: u.String(), Name: name, Admin: admin, Hash: hash, CreateTime: time.Now(), AllowedTimes: windows, SshKeys: sshKeys}
+	if ttl > 0 {
+		t.ExpireTime = t.CreateTime.Add(ttl)
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	o.tokens[t.Id] = t
+	if err = o.save(); err != nil {
+		delete(o.tokens, t.Id)
+		return "", nil, err
+	}
+	return value, t.view(), nil
+}
+
+func (o *TokenStore) List() []*Token {
+	o.RLock()
+	defer o.RUnlock()
+	tokens := make([]*Token, 0, len(o.tokens))
+	for _, t := range o.tokens {
+		tokens = append(tokens, t.view())
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreateTime.Before(tokens[j].CreateTime) })
+	return tokens
+}
+
+func (o *TokenStore) Revoke(id string) (*Token, error) {
+	o.Lock()
+	defer o.Unlock()
+	t, ok := o.tokens[id]
+	if !ok {
+		return nil, errTokenNotFound
+	}
+	t.Revoked = true
+	t.PrevHash = ""
+	return t.view(), o.save()
+}
+
+// Replace the time windows of the token
+func (o *TokenStore) SetAllowedTimes(id string, windows []TimeWindow) (*Token, error) {
+	o.Lock()
+	defer o.Unlock()
+	t, ok := o.tokens[id]
+	if !ok {
+		return nil, errTokenNotFound
+	}
+	t.AllowedTimes = windows
+	return t.view(), o.save()
+}
+
+// Replace the ssh public keys of the token
+func (o *TokenStore) SetSshKeys(id string, keys []string) (*Token, error) {
+	o.Lock()
+	defer o.Unlock()
+	t, ok := o.tokens[id]
+	if !ok {
+		return nil, errTokenNotFound
+	}
+	t.SshKeys = keys
+	return t.view(), o.save()
+}
+
+// Replace the value of the token, the old value keeps working for grace.
+// A positive ttl renews the expiry.
+func (o *TokenStore) Rotate(id string, ttl, grace time.Duration) (string, *Token, error) {
+	value, hash, err := newTokenValue()
+	if err != nil {
+		return "", nil, err
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	t, ok := o.tokens[id]
+	if !ok {
+		return "", nil, errTokenNotFound
+	}
+	if t.Revoked {
+		return "", nil, errTokenRevoked
+	}
+	now := time.Now()
+	t.PrevHash, t.PrevExpireTime = "", time.Time{}
+	if grace > 0 {
+		t.PrevHash, t.PrevExpireTime = t.Hash, now.Add(grace)
+	}
+	t.Hash = hash
+	if ttl > 0 {
+		t.ExpireTime = now.Add(ttl)
+	}
+	return value, t.view(), o.save()
+}
+
+// Find the token of value, and record its use
+func (o *TokenStore) Authenticate(value string) (*Token, error) {
+	hash := hashTokenValue(value)
+	now := time.Now()
+
+	o.Lock()
+	defer o.Unlock()
+	for _, t := range o.tokens {
+		prev := t.PrevHash != "" && now.Before(t.PrevExpireTime) && hashEqual(t.PrevHash, hash)
+		if !prev && !hashEqual(t.Hash, hash) {
+			continue
+		}
+		return o.use(t, now)
+	}
+	return nil, errTokenInvalid
+}
+
+// Find the token having the ssh public key of the wire format, and record its use
+func (o *TokenStore) AuthenticateSshKey(key []byte) (*Token, error) {
+	o.Lock()
+	defer o.Unlock()
+	if t := o.findSshKey(key); t != nil {
+		return o.use(t, time.Now())
+	}
+	return nil, errTokenInvalid
+}
+
+// Find the token of the name, which an ssh certificate of the name as its
+// principal logs in as, and record its use
+func (o *TokenStore) AuthenticateName(name string) (*Token, error) {
+	o.Lock()
+	defer o.Unlock()
+	var found *Token
+	for _, t := range o.tokens {
+		if t.Name != name || t.Revoked {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("more than one token named %s", name)
+		}
+		found = t
+	}
+	if found == nil {
+		return nil, errTokenInvalid
+	}
+	return o.use(found, time.Now())
+}
+
+// Whether a token not revoked has the ssh public key, before the client
+// proves it holds the private key
+func (o *TokenStore) HasSshKey(key []byte) bool {
+	o.RLock()
+	defer o.RUnlock()
+	t := o.findSshKey(key)
+	return t != nil && !t.Revoked
+}
+
+// The lock must be held
+func (o *TokenStore) findSshKey(key []byte) *Token {
+	for _, t := range o.tokens {
+		for _, line := range t.SshKeys {
+			if b, err := parseAuthorizedKey(line); err == nil && bytes.Equal(b, key) {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// Check the token found is usable now, and record its use, the lock must be held
+func (o *TokenStore) use(t *Token, now time.Time) (*Token, error) {
+	if t.Revoked {
+		return nil, errTokenRevoked
+	}
+	if !t.ExpireTime.IsZero() && now.After(t.ExpireTime) {
+		return nil, errTokenExpired
+	}
+	if !t.allowedAt(now) {
+		return nil, fmt.Errorf("token %s is not allowed at this time", t.Name)
+	}
+
+	persist := now.Sub(t.LastUsedTime) > lastUsedPersistInterval
+	t.LastUsedTime = now
+	if persist {
+		if err := o.save(); err != nil {
+			log.Warnf("save token file failed: %s", err)
+		}
+	}
+	return t.view(), nil
+}
+
+func (o *Token) allowedAt(now time.Time) bool {
+	if len(o.AllowedTimes) == 0 {
+		return true
+	}
+	for _, w := range o.AllowedTimes {
+		if w.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// A copy of the token without the hashes
+func (o *Token) view() *Token {
+	t := *o
+	t.Hash = ""
+	t.PrevHash = ""
+	return &t
+}
+
+func newTokenValue() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	value := "sa_" + hex.EncodeToString(b)
+	return value, hashTokenValue(value), nil
+}
+
+func hashTokenValue(value string) string {
+	h := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(h[:])
+}
+
+func hashEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+type tokenCtxKey struct{}
+
+// The token authenticating the request, nil if the auth is disabled
+func RequestToken(r *http.Request) *Token {
+	t, _ := r.Context().Value(tokenCtxKey{}).(*Token)
+	return t
+}
+
+func withToken(r *http.Request, t *Token) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tokenCtxKey{}, t))
+}
+
+func (o *TimeWindow) Validate() error {
+	for _, d := range o.Days {
+		if weekday(d) < 0 {
+			return errors.New("invalid day: " + d)
+		}
+	}
+	if _, err := parseClock(o.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(o.End); err != nil {
+		return err
+	}
+	if o.Timezone != "" {
+		if _, err := time.LoadLocation(o.Timezone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The days are the days the window starts, so after midnight a window
+// crossing midnight is matched against the previous day
+func (o *TimeWindow) Contains(t time.Time) bool {
+	if o.Timezone != "" {
+		loc, err := time.LoadLocation(o.Timezone)
+		if err != nil {
+			return false
+		}
+		t = t.In(loc)
+	}
+
+	start, err1 := parseClock(o.Start)
+	end, err2 := parseClock(o.End)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	m := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if start <= end {
+		if m < start || m >= end {
+			return false
+		}
+	} else if m < end {
+		day = t.AddDate(0, 0, -1).Weekday()
+	} else if m < start {
+		return false
+	}
+
+	if len(o.Days) == 0 {
+		return true
+	}
+	for _, d := range o.Days {
+		if weekday(d) == int(day) {
+			return true
+		}
+	}
+	return false
+}
+
+func weekday(d string) int {
+	d = strings.ToLower(d)
+	for i, w := range weekdays {
+		if d == w {
+			return i
+		}
+	}
+	return -1
+}
+
+// Minutes since midnight of HH:MM, 24:00 is allowed as the end of a day
+func parseClock(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, errors.New("invalid time, HH:MM expected: " + s)
+	}
+	return h*60 + m, nil
+}
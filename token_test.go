@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindowContains(t *testing.T) {
+	// Friday 22:00 to Saturday 06:00
+	w := &TimeWindow{Days: []string{"fri"}, Start: "22:00", End: "06:00", Timezone: "UTC"}
+	for _, c := range []struct {
+		at   string
+		want bool
+	}{
+		{"2026-10-16T21:59:00Z", false}, // Fri
+		{"2026-10-16T22:00:00Z", true},
+		{"2026-10-17T03:00:00Z", true}, // Sat, after midnight of Fri
+		{"2026-10-17T06:00:00Z", false},
+		{"2026-10-17T23:00:00Z", false}, // Sat
+		{"2026-10-16T03:00:00Z", false}, // Fri, after midnight of Thu
+	} {
+		at, _ := time.Parse(time.RFC3339, c.at)
+		if got := w.Contains(at); got != c.want {
+			t.Errorf("%s: got %v", c.at, got)
+		}
+	}
+
+	w = &TimeWindow{Days: []string{"mon"}, Start: "09:00", End: "17:00", Timezone: "UTC"}
+	for at, want := range map[string]bool{
+		"2026-10-19T09:00:00Z": true, // Mon
+		"2026-10-19T17:00:00Z": false,
+		"2026-10-20T10:00:00Z": false, // Tue
+	} {
+		tm, _ := time.Parse(time.RFC3339, at)
+		if got := w.Contains(tm); got != want {
+			t.Errorf("%s: got %v", at, got)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Local users and groups managed by the native tools, useradd and gpasswd on
+// linux, net user and net localgroup on windows. The calls are idempotent, an
+// existing user, member or key is left as it is.
+
+type UserReq struct {
+	Name    string   `json:"name"`
+	Comment string   `json:"comment,omitempty"`
+	Shell   string   `json:"shell,omitempty"` // Linux only
+	Groups  []string `json:"groups,omitempty"`
+	// Required by the password policy of windows, not used on linux where the
+	// users log in by their authorized keys
+	Password string `json:"password,omitempty"`
+}
+
+type UserRes struct {
+	Name    string `json:"name"`
+	Created bool   `json:"created"` // False if the user existed
+}
+
+type GroupMemberReq struct {
+	Group  string `json:"group"`
+	User   string `json:"user"`
+	Remove bool   `json:"remove,omitempty"`
+}
+
+type AuthorizedKeysReq struct {
+	User string   `json:"user"`
+	Keys []string `json:"keys"`
+	// Replace all the keys of the user rather than adding the missing ones
+	Exclusive bool `json:"exclusive,omitempty"`
+}
+
+var (
+	accountNameRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,31}$`)
+	sshKeyRe      = regexp.MustCompile(`^(ssh-|ecdsa-|sk-)[A-Za-z0-9@.-]+ [A-Za-z0-9+/=]+( .*)?$`)
+)
+
+func validateAccountName(kind, name string) error {
+	if !accountNameRe.MatchString(name) {
+		return errors.New("invalid param " + kind + ", expect 1-32 letters, digits, _, . and -: " + name)
+	}
+	return nil
+}
+
+func userExists(name string) bool {
+	_, err := user.Lookup(name)
+	return err == nil
+}
+
+// Run the tool, its output is the error if it fails
+func runTool(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return errors.New(name + ": " + msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// Read the body into v, false if failed and the response has been served
+func parseJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("failed to read r.Body: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to read body"))
+		return false
+	}
+	defer r.Body.Close()
+
+	if err := json.Unmarshal(body, v); err != nil {
+		log.Errorf("failed to unmarshall data: %s", err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, "failed to unmarshall data"))
+		return false
+	}
+	return true
+}
+
+// Handler to create a user, or add an existing one to the missing groups
+func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req UserReq
+	if !parseJSONBody(w, r, &req) {
+		return
+	}
+	if err := validateAccountName("name", req.Name); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	for _, g := range req.Groups {
+		if err := validateAccountName("groups", g); err != nil {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+			return
+		}
+	}
+
+	res := &UserRes{Name: req.Name}
+	var err error
+	if !userExists(req.Name) {
+		if err = createUser(&req); err == nil {
+			res.Created = true
+			log.Infof("audit: user %s created by %s, groups: %v", req.Name, tokenTenant(RequestToken(r)), req.Groups)
+		}
+	}
+	for _, g := range req.Groups {
+		if err != nil {
+			break
+		}
+		var added bool
+		if added, err = setGroupMember(g, req.Name, false); added {
+			log.Infof("audit: user %s added to group %s by %s", req.Name, g, tokenTenant(RequestToken(r)))
+		}
+	}
+	if err != nil {
+		log.Errorf("create user %s failed: %s", req.Name, err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	ServeJSON(w, NewResponse().SetData(res))
+}
+
+// Handler to disable a user, who can't log in any more
+func DisableUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if err := validateAccountName("name", name); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	if !userExists(name) {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "user not found: "+name))
+		return
+	}
+	if err := disableUser(name); err != nil {
+		log.Errorf("disable user %s failed: %s", name, err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	log.Infof("audit: user %s disabled by %s", name, tokenTenant(RequestToken(r)))
+	ServeJSON(w, NewResponse())
+}
+
+// Handler to add a user to a group or remove it
+func GroupMemberHandler(w http.ResponseWriter, r *http.Request) {
+	var req GroupMemberReq
+	if !parseJSONBody(w, r, &req) {
+		return
+	}
+	for _, err := range []error{validateAccountName("group", req.Group), validateAccountName("user", req.User)} {
+		if err != nil {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+			return
+		}
+	}
+	changed, err := setGroupMember(req.Group, req.User, req.Remove)
+	if err != nil {
+		log.Errorf("change group %s of user %s failed: %s", req.Group, req.User, err)
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	if changed && req.Remove {
+		log.Infof("audit: user %s removed from group %s by %s", req.User, req.Group, tokenTenant(RequestToken(r)))
+	} else if changed {
+		log.Infof("audit: user %s added to group %s by %s", req.User, req.Group, tokenTenant(RequestToken(r)))
+	}
+	ServeJSON(w, NewResponse().SetData(map[string]bool{"changed": changed}))
+}
+
+// Handler to deploy the ssh authorized keys of a user
+func AuthorizedKeysHandler(w http.ResponseWriter, r *http.Request) {
+	var req AuthorizedKeysReq
+	if !parseJSONBody(w, r, &req) {
+		return
+	}
+	if err := validateAccountName("user", req.User); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return
+	}
+	for _, k := range req.Keys {
+		if !sshKeyRe.MatchString(strings.TrimSpace(k)) || strings.ContainsAny(k, "\r\n") {
+			ServeJSON(w, NewResponse().SetError(ECInvalidParam, "invalid ssh public key: "+k))
+			return
+		}
+	}
+	u, err := user.Lookup(req.User)
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, "user not found: "+req.User))
+		return
+	}
+
+	added, err := deployAuthorizedKeys(u, req.Keys, req.Exclusive)
+	if err != nil {
+		log.Errorf("deploy the authorized keys of %s failed: %s", req.User, err)
+		ServeJSON(w, NewResponse().SetError(ECFileIOFailed, err.Error()))
+		return
+	}
+	log.Infof("audit: %d authorized keys of user %s deployed by %s, exclusive: %v",
+		added, req.User, tokenTenant(RequestToken(r)), req.Exclusive)
+	ServeJSON(w, NewResponse().SetData(map[string]int{"added": added}))
+}
+
+// Add the missing keys to ~/.ssh/authorized_keys, or replace the file if
+// exclusive. The number of the added keys is returned.
+func deployAuthorizedKeys(u *user.User, keys []string, exclusive bool) (int, error) {
+	dir := filepath.Join(u.HomeDir, ".ssh")
+	path := filepath.Join(dir, "authorized_keys")
+
+	var lines []string
+	if !exclusive {
+		b, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		for _, l := range strings.Split(string(b), "\n") {
+			if strings.TrimSpace(l) != "" {
+				lines = append(lines, l)
+			}
+		}
+	}
+	added := 0
+	for _, k := range keys {
+		k = strings.TrimSpace(k)
+		found := false
+		for _, l := range lines {
+			found = found || sameSshKey(l, k)
+		}
+		if !found {
+			lines = append(lines, k)
+			added++
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	f, err := ioutil.TempFile(dir, ".authorized_keys")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	f.Close()
+	if err != nil {
+		return 0, err
+	}
+	// sshd rejects the keys writable by others
+	for _, p := range []string{dir, f.Name()} {
+		if err = chownToUser(p, u); err != nil {
+			return 0, err
+		}
+	}
+	if err = os.Chmod(f.Name(), 0600); err != nil {
+		return 0, err
+	}
+	return added, os.Rename(f.Name(), path)
+}
+
+// Whether the line has the key, ignoring the options and the comments
+func sameSshKey(line, key string) bool {
+	kf := strings.Fields(key)
+	lf := strings.Fields(line)
+	for i := 0; i+1 < len(lf); i++ {
+		if lf[i] == kf[0] && lf[i+1] == kf[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+)
+
+var errUserAdminUnsupported = errors.New("user management is only supported on linux and windows")
+
+func createUser(req *UserReq) error {
+	if runtime.GOOS != "linux" {
+		return errUserAdminUnsupported
+	}
+	args := []string{"-m"}
+	if req.Shell != "" {
+		args = append(args, "-s", req.Shell)
+	}
+	if req.Comment != "" {
+		args = append(args, "-c", req.Comment)
+	}
+	return runTool("useradd", append(args, req.Name)...)
+}
+
+// Lock the password and expire the account, which stops the key logins too
+func disableUser(name string) error {
+	if runtime.GOOS != "linux" {
+		return errUserAdminUnsupported
+	}
+	return runTool("usermod", "-L", "-e", "1", name)
+}
+
+// Add the user to the group, created if missing, or remove it. Whether the
+// membership changed is returned.
+func setGroupMember(group, name string, remove bool) (bool, error) {
+	if runtime.GOOS != "linux" {
+		return false, errUserAdminUnsupported
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return false, err
+	}
+	g, err := user.LookupGroup(group)
+	if _, ok := err.(user.UnknownGroupError); ok && !remove {
+		if err = runTool("groupadd", group); err == nil {
+			g, err = user.LookupGroup(group)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return false, err
+	}
+	member := false
+	for _, gid := range gids {
+		member = member || gid == g.Gid
+	}
+	switch {
+	case remove && member:
+		return true, runTool("gpasswd", "-d", name, group)
+	case !remove && !member:
+		return true, runTool("gpasswd", "-a", name, group)
+	}
+	return false, nil
+}
+
+func chownToUser(path string, u *user.User) error {
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	return os.Chown(path, uid, gid)
+}
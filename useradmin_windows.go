@@ -0,0 +1,60 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os/user"
+	"strings"
+)
+
+// The system errors of net localgroup
+const (
+	errNotMember     = "1377"
+	errAlreadyMember = "1378"
+	errNoSuchGroup   = "1376"
+)
+
+func createUser(req *UserReq) error {
+	if req.Password == "" {
+		return errors.New("param password is required on windows")
+	}
+	args := []string{"user", req.Name, req.Password, "/add"}
+	if req.Comment != "" {
+		args = append(args, "/comment:"+req.Comment)
+	}
+	return runTool("net", args...)
+}
+
+func disableUser(name string) error {
+	return runTool("net", "user", name, "/active:no")
+}
+
+// Add the user to the local group, created if missing, or remove it. Whether
+// the membership changed is returned.
+func setGroupMember(group, name string, remove bool) (bool, error) {
+	op := "/add"
+	if remove {
+		op = "/delete"
+	}
+	err := runTool("net", "localgroup", group, name, op)
+	if err != nil && !remove && strings.Contains(err.Error(), errNoSuchGroup) {
+		if err = runTool("net", "localgroup", group, "/add"); err == nil {
+			err = runTool("net", "localgroup", group, name, op)
+		}
+	}
+	switch {
+	case err == nil:
+		return true, nil
+	case remove && strings.Contains(err.Error(), errNotMember),
+		!remove && strings.Contains(err.Error(), errAlreadyMember):
+		return false, nil
+	}
+	return false, err
+}
+
+// The new files inherit the acl of the profile
+func chownToUser(path string, u *user.User) error {
+	return nil
+}
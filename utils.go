@@ -14,20 +14,76 @@ const (
 	ECInvalidParam
 	ECJobNotFound
 	ECJobNotRunning
+	ECGitFailed
+	ECFetchFailed
+	ECChecksumMismatch
+	ECFileNotFound
+	ECFileIOFailed
+	ECSubscriberDropped
+	ECUnauthorized
+	ECForbidden
+	ECTokenNotFound
+	ECPathNotAllowed
+	ECElevationNotFound
+	ECMemoryLimit
+	ECQueueFull
+	ECBootstrapLocked
+	ECNoPeer
+	ECPeerFailed
+	ECRolloutNotFound
+	ECScheduleNotFound
+	ECJobNotFinished
+	ECWatchNotFound
+	ECJobNotPendingApproval
+	ECHistoryNotFound
+	ECPtySessionNotFound
+	ECHookNotFound
+	ECSignatureInvalid
 )
 
 type JobStatus string
 
 const (
-	JSRunning  JobStatus = "running"
-	JSCanceled           = "canceled"
-	JSFinished           = "finished"
-	JSFailed             = "failed"
+	JSScheduled JobStatus = "scheduled" // Waiting for its run_at
+	JSQueued              = "queued"    // Waiting for a worker of the job pool
+	JSRunning             = "running"
+	JSCanceled            = "canceled"
+	JSFinished            = "finished"
+	JSFailed              = "failed"
+	JSSkipped             = "skipped" // Not run since its run_if was false
+	JSBlocked             = "blocked" // Not run since a precondition was unmet
+	// Killed for running longer than its timeout_seconds
+	JSTimedOut = "timed_out"
+	// Waiting for an admin to approve it by /cmd/approve
+	JSPendingApproval = "pending_approval"
+)
+
+// Why a job is skipped, blocked, pending approval, rejected or timed out, so
+// that the jobs which didn't need to run are told from the failed ones
+type StatusReason struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	RCRunIfFalse        = "run_if_false"       // The message is the run_if
+	RCPreconditionUnmet = "precondition_unmet" // The message is why it is unmet
+	RCApprovalRequired  = "approval_required"
+	RCRejected          = "rejected" // The message is given by the rejecting admin
+	RCTimedOut          = "timed_out"
+)
+
+// The phase which stopped a canceled, idle or timed out job
+const (
+	KPTerminate = "terminate" // Exited within job::kill_grace after SIGTERM, or taskkill without /F
+	KPKill      = "kill"      // Killed by SIGKILL, or taskkill /F
 )
 
 const (
 	ContentType     = "Content-Type"
 	JsonContentType = "application/json;charset=UTF-8"
+
+	NdjsonContentType = "application/x-ndjson"
 )
 
 type Response struct {
@@ -57,3 +113,11 @@ func ServeJSON(w http.ResponseWriter, v interface{}) {
 		log.Errorf("Error occured when marshalling response: %s", err)
 	}
 }
+
+func ServeJSONWithStatus(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set(ContentType, JsonContentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Error occured when marshalling response: %s", err)
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/nu7hatch/gouuid"
+)
+
+// A watch runs a job when the files of a dir matching a pattern are created
+// or modified, e.g. an import when a file lands in a share. The dirs are
+// polled every watch::interval seconds rather than notified, which works for
+// the network shares as well. The changes are debounced: the job runs once
+// the files have been quiet for debounce_seconds, with the changed files in
+// WATCH_FILES. The watches are kept in schedule::dir/watches.json, the
+// changes while the agent is down are not seen.
+
+type Watch struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	Path       string     `json:"path"`    // The dir
+	Pattern    string     `json:"pattern"` // Glob of the names of the files
+	Debounce   int        `json:"debounce_seconds"`
+	Req        *RunCmdReq `json:"req"`
+	Tenant     string     `json:"tenant,omitempty"`
+	CreateTime time.Time  `json:"create_time"`
+	// The jobs run as the service account rather than the tenant
+	ServiceAccount string `json:"service_account,omitempty"`
+
+	Triggers    int64      `json:"triggers"`
+	LastTrigger *time.Time `json:"last_trigger,omitempty"`
+	LastJobId   string     `json:"last_job_id,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+
+	// The files of the last scan, nil before the first one
+	files map[string]watchedFile
+	// The changed files not run yet, and when the last changed
+	pending    map[string]bool
+	lastChange time.Time
+}
+
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+type WatchReq struct {
+	Id       string     `json:"id,omitempty"` // Only to update
+	Name     string     `json:"name,omitempty"`
+	Path     string     `json:"path"`
+	Pattern  string     `json:"pattern,omitempty"` // Default to *
+	Debounce int        `json:"debounce_seconds,omitempty"`
+	Req      *RunCmdReq `json:"req"`
+
+	ServiceAccount string `json:"service_account,omitempty"`
+}
+
+const watchDefaultDebounce = 5
+
+type Watcher struct {
+	path     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	watches map[string]*Watch
+
+	quitC chan struct{}
+	wg    sync.WaitGroup
+}
+
+var (
+	gWatcher *Watcher
+)
+
+func init() {
+	gHttpServer.AddToInit(InitWatcher)
+	gHttpServer.AddToUninit(UninitWatcher)
+}
+
+func InitWatcher() error {
+	gWatcher = NewWatcher(filepath.Join(gApp.Cnf.ScheduleDir, "watches.json"),
+		time.Duration(gApp.Cnf.WatchInterval)*time.Second)
+	return gWatcher.load()
+}
+
+func UninitWatcher() {
+	gWatcher.Close()
+}
+
+func NewWatcher(path string, interval time.Duration) *Watcher {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	o := &Watcher{
+		path:     path,
+		interval: interval,
+		watches:  make(map[string]*Watch),
+		quitC:    make(chan struct{}),
+	}
+	o.wg.Add(1)
+	go o.loop()
+	return o
+}
+
+func (o *Watcher) Close() {
+	close(o.quitC)
+	o.wg.Wait()
+}
+
+func (o *Watcher) load() error {
+	b, err := ioutil.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*Watch
+	if err = json.Unmarshal(b, &list); err != nil {
+		return errors.New("invalid " + o.path + ": " + err.Error())
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, w := range list {
+		o.watches[w.Id] = w
+	}
+	log.Infof("%d watches loaded from %s", len(o.watches), o.path)
+	return nil
+}
+
+// Called with mu held
+func (o *Watcher) save() {
+	list := make([]*Watch, 0, len(o.watches))
+	for _, w := range o.watches {
+		list = append(list, w)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreateTime.Before(list[j].CreateTime) })
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(o.path, b, 0600)
+	}
+	if err != nil {
+		log.Errorf("save watches to %s failed: %s", o.path, err)
+	}
+}
+
+func (o *WatchReq) validate() error {
+	if strings.TrimSpace(o.Path) == "" {
+		return errors.New("param path is empty")
+	}
+	if o.Pattern == "" {
+		o.Pattern = "*"
+	}
+	if _, err := filepath.Match(o.Pattern, ""); err != nil || strings.ContainsAny(o.Pattern, `/\`) {
+		return errors.New("invalid param pattern: " + o.Pattern)
+	}
+	if o.Debounce < 0 {
+		return errors.New("param debounce_seconds must not be negative")
+	}
+	if o.Debounce == 0 {
+		o.Debounce = watchDefaultDebounce
+	}
+	if o.Req == nil {
+		return errors.New("param req is empty")
+	}
+	if o.Req.RunAt != nil {
+		return errors.New("param run_at is not supported by watches")
+	}
+	o.Req.Async = true
+	return o.Req.validate()
+}
+
+func (o *Watcher) Add(req *WatchReq, tenant string) (*Watch, error) {
+	u4, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watch{
+		Id:         u4.String(),
+		Name:       req.Name,
+		Path:       req.Path,
+		Pattern:    req.Pattern,
+		Debounce:   req.Debounce,
+		Req:        req.Req,
+		Tenant:     tenant,
+		CreateTime: time.Now(),
+
+		ServiceAccount: req.ServiceAccount,
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.watches[w.Id] = w
+	o.save()
+	return w.copy(), nil
+}
+
+// Replace the settings of the watch, its files are scanned afresh. Nil if
+// not found.
+func (o *Watcher) Update(req *WatchReq, tenant string) *Watch {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	w := o.watches[req.Id]
+	if w == nil {
+		return nil
+	}
+	w.Name, w.Path, w.Pattern, w.Debounce, w.Req, w.Tenant = req.Name, req.Path, req.Pattern, req.Debounce, req.Req, tenant
+	w.ServiceAccount = req.ServiceAccount
+	w.files, w.pending = nil, nil
+	o.save()
+	return w.copy()
+}
+
+func (o *Watcher) Remove(id string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.watches[id] == nil {
+		return false
+	}
+	delete(o.watches, id)
+	o.save()
+	return true
+}
+
+func (o *Watcher) List() []*Watch {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	res := make([]*Watch, 0, len(o.watches))
+	for _, w := range o.watches {
+		res = append(res, w.copy())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CreateTime.Before(res[j].CreateTime) })
+	return res
+}
+
+// Called with mu held
+func (o *Watch) copy() *Watch {
+	return &Watch{
+		Id:          o.Id,
+		Name:        o.Name,
+		Path:        o.Path,
+		Pattern:     o.Pattern,
+		Debounce:    o.Debounce,
+		Req:         o.Req,
+		Tenant:      o.Tenant,
+		CreateTime:  o.CreateTime,
+		Triggers:    o.Triggers,
+		LastTrigger: o.LastTrigger,
+		LastJobId:   o.LastJobId,
+		LastError:   o.LastError,
+
+		ServiceAccount: o.ServiceAccount,
+	}
+}
+
+func (o *Watcher) loop() {
+	defer o.wg.Done()
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			o.poll()
+		case <-o.quitC:
+			return
+		}
+	}
+}
+
+// Scan the dirs, and run the jobs of the watches whose changes have settled
+func (o *Watcher) poll() {
+	o.mu.Lock()
+	watches := make([]*Watch, 0, len(o.watches))
+	for _, w := range o.watches {
+		watches = append(watches, w.copy())
+	}
+	o.mu.Unlock()
+
+	for _, c := range watches {
+		files, err := scanWatch(c.Path, c.Pattern)
+		now := time.Now()
+
+		o.mu.Lock()
+		w := o.watches[c.Id]
+		// Removed or updated meanwhile
+		if w == nil || w.Path != c.Path || w.Pattern != c.Pattern {
+			o.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			if w.LastError != err.Error() {
+				log.Warnf("watch %s scan failed: %s", w.Id, err)
+			}
+			w.LastError = err.Error()
+			o.mu.Unlock()
+			continue
+		}
+		changed := w.diff(files, now)
+		o.mu.Unlock()
+
+		if len(changed) > 0 {
+			o.trigger(c, changed)
+		}
+	}
+}
+
+// The files of the dir matching the pattern
+func scanWatch(path, pattern string) (map[string]watchedFile, error) {
+	dir, err := JailPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, errors.New("not a dir: " + path)
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]watchedFile, len(matches))
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		res[m] = watchedFile{size: fi.Size(), modTime: fi.ModTime()}
+	}
+	return res, nil
+}
+
+// Record the scanned files, the settled changes to run are returned. The
+// first scan only takes the files as they are. Called with mu held.
+func (o *Watch) diff(files map[string]watchedFile, now time.Time) []string {
+	prev := o.files
+	o.files = files
+	if prev == nil {
+		return nil
+	}
+	for name, f := range files {
+		if p, ok := prev[name]; !ok || p != f {
+			if o.pending == nil {
+				o.pending = make(map[string]bool)
+			}
+			o.pending[name] = true
+			o.lastChange = now
+		}
+	}
+	if len(o.pending) == 0 || now.Sub(o.lastChange) < time.Duration(o.Debounce)*time.Second {
+		return nil
+	}
+	var changed []string
+	for name := range o.pending {
+		// Gone before it settled
+		if _, ok := files[name]; ok {
+			changed = append(changed, name)
+		}
+	}
+	o.pending = nil
+	sort.Strings(changed)
+	return changed
+}
+
+// Run the job of the watch for the changed files. The runs of a watch are
+// serialized by a concurrency group unless the req has its own.
+func (o *Watcher) trigger(w *Watch, files []string) {
+	req := *w.Req
+	req.Async = true
+	req.Env = append(append([]string{}, w.Req.Env...), "WATCH_ID="+w.Id, "WATCH_FILES="+strings.Join(files, "\n"))
+	if req.ConcurrencyGroup == "" {
+		req.ConcurrencyGroup = "watch:" + w.Id
+	}
+	var job *Job
+	tenant, err := runTenant(w.ServiceAccount, w.Tenant, &req)
+	if err == nil {
+		job, err = startJob(&req, tenant)
+	}
+	if err == nil && w.ServiceAccount != "" {
+		log.Infof("audit: watch %s runs job %s as service account %s", w.Id, job.Id, w.ServiceAccount)
+	}
+	now := time.Now()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	cur := o.watches[w.Id]
+	if cur == nil {
+		return
+	}
+	cur.Triggers++
+	cur.LastTrigger = &now
+	if err != nil {
+		log.Warnf("job of watch %s not started: %s", w.Id, err)
+		cur.LastError = err.Error()
+	} else {
+		log.Infof("watch %s triggered job %s by %d files", w.Id, job.Id, len(files))
+		cur.LastJobId, cur.LastError = job.Id, ""
+	}
+	o.save()
+}
+
+func parseWatchReq(w http.ResponseWriter, r *http.Request) (*WatchReq, bool) {
+	var req WatchReq
+	if !parseJSONBody(w, r, &req) {
+		return nil, false
+	}
+	if err := req.validate(); err != nil {
+		ServeJSON(w, NewResponse().SetError(ECInvalidParam, err.Error()))
+		return nil, false
+	}
+	if code, err := checkServiceAccount(RequestToken(r), req.ServiceAccount, req.Req); err != nil {
+		ServeJSON(w, NewResponse().SetError(code, err.Error()))
+		return nil, false
+	}
+	return &req, true
+}
+
+// Handler to create a watch running the job when the files change
+func CreateWatchHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := parseWatchReq(w, r)
+	if !ok {
+		return
+	}
+	watch, err := gWatcher.Add(req, tokenTenant(RequestToken(r)))
+	if err != nil {
+		ServeJSON(w, NewResponse().SetError(ECUnknown, err.Error()))
+		return
+	}
+	log.Infof("audit: watch %s created by %s, path: %s, pattern: %s, service account: %s",
+		watch.Id, watch.Tenant, watch.Path, watch.Pattern, watch.ServiceAccount)
+	ServeJSON(w, NewResponse().SetData(watch))
+}
+
+func UpdateWatchHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := parseWatchReq(w, r)
+	if !ok {
+		return
+	}
+	watch := gWatcher.Update(req, tokenTenant(RequestToken(r)))
+	if watch == nil {
+		ServeJSON(w, NewResponse().SetError(ECWatchNotFound, "watch not found: "+req.Id))
+		return
+	}
+	log.Infof("audit: watch %s updated by %s, path: %s, pattern: %s, service account: %s",
+		watch.Id, watch.Tenant, watch.Path, watch.Pattern, watch.ServiceAccount)
+	ServeJSON(w, NewResponse().SetData(watch))
+}
+
+func ListWatchHandler(w http.ResponseWriter, r *http.Request) {
+	ServeJSON(w, NewResponse().SetData(gWatcher.List()))
+}
+
+func DeleteWatchHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.FormValue("id"))
+	if !gWatcher.Remove(id) {
+		ServeJSON(w, NewResponse().SetError(ECWatchNotFound, "watch not found: "+id))
+		return
+	}
+	log.Infof("audit: watch %s deleted by %s", id, tokenTenant(RequestToken(r)))
+	ServeJSON(w, NewResponse())
+}
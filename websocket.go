@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// A minimal server side websocket (RFC 6455) connection, enough for the
+// agent's own endpoints: no extensions, no subprotocols.
+
+const (
+	WsText   = 1
+	WsBinary = 2
+	wsClose  = 8
+	wsPing   = 9
+	wsPong   = 10
+
+	wsGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxMessageSize = 16 << 20
+)
+
+var errWsClosed = errors.New("websocket closed")
+
+type WsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	writeMu sync.Mutex
+	closed  bool
+}
+
+func IsWebsocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// Take over the http connection and switch it to the websocket protocol
+func UpgradeWebsocket(w http.ResponseWriter, r *http.Request) (*WsConn, error) {
+	if !IsWebsocketRequest(r) || !strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		http.Error(w, "not a websocket handshake", http.StatusBadRequest)
+		return nil, errors.New("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-Websocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-Websocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-Websocket-Key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket is not supported", http.StatusInternalServerError)
+		return nil, errors.New("the response writer can't be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h[:]) + "\r\n\r\n")
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WsConn{conn: conn, rw: rw}, nil
+}
+
+// Read a whole data message, control frames are handled on the way
+func (o *WsConn) ReadMessage() (int, []byte, error) {
+	var msg []byte
+	opcode := 0
+	for {
+		fin, op, payload, err := o.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsPing:
+			if err = o.WriteMessage(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			o.WriteMessage(wsClose, payload)
+			o.Close()
+			return 0, nil, io.EOF
+		case 0:
+			// Continuation of a fragmented message
+		default:
+			opcode = op
+		}
+		msg = append(msg, payload...)
+		if len(msg) > wsMaxMessageSize {
+			return 0, nil, errors.New("websocket message too large")
+		}
+		if fin {
+			return opcode, msg, nil
+		}
+	}
+}
+
+func (o *WsConn) readFrame() (bool, int, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(o.rw, hdr[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := hdr[0]&0x80 != 0
+	opcode := int(hdr[0] & 0x0f)
+	masked := hdr[1]&0x80 != 0
+	length := uint64(hdr[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(o.rw, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(o.rw, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	if length > wsMaxMessageSize {
+		return false, 0, nil, errors.New("websocket frame too large")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(o.rw, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(o.rw, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// Write a message in a single frame, safe for concurrent use
+func (o *WsConn) WriteMessage(opcode int, data []byte) error {
+	o.writeMu.Lock()
+	defer o.writeMu.Unlock()
+	if o.closed {
+		return errWsClosed
+	}
+
+	hdr := []byte{0x80 | byte(opcode)}
+	n := len(data)
+	switch {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n <= 0xffff:
+		hdr = append(hdr, 126, byte(n>>8), byte(n))
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		hdr = append(append(hdr, 127), b[:]...)
+	}
+	o.rw.Write(hdr)
+	o.rw.Write(data)
+	return o.rw.Flush()
+}
+
+func (o *WsConn) Close() error {
+	o.writeMu.Lock()
+	defer o.writeMu.Unlock()
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	return o.conn.Close()
+}
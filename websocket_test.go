@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A client writing masked frames as the browsers do
+type wsTestClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialWsTest(t *testing.T, url string) *wsTestClient {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	c := &wsTestClient{conn: conn, r: bufio.NewReader(conn)}
+	resp, err := http.ReadResponse(c.r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The example of RFC 6455
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake: %s, accept %q", resp.Status, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return c
+}
+
+func (o *wsTestClient) writeFrame(fin bool, opcode int, data []byte) {
+	b := byte(opcode)
+	if fin {
+		b |= 0x80
+	}
+	hdr := []byte{b}
+	switch n := len(data); {
+	case n < 126:
+		hdr = append(hdr, 0x80|byte(n))
+	case n <= 0xffff:
+		hdr = append(hdr, 0x80|126, byte(n>>8), byte(n))
+	default:
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(n))
+		hdr = append(append(hdr, 0x80|127), l[:]...)
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	masked := make([]byte, len(data))
+	for i := range data {
+		masked[i] = data[i] ^ mask[i%4]
+	}
+	o.conn.Write(append(append(hdr, mask...), masked...))
+}
+
+// Read an unmasked frame of the server
+func (o *wsTestClient) readFrame(t *testing.T) (int, []byte) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(o.r, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if hdr[0]&0x80 == 0 || hdr[1]&0x80 != 0 {
+		t.Fatalf("unexpected frame header % x", hdr)
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var l [2]byte
+		io.ReadFull(o.r, l[:])
+		n = uint64(binary.BigEndian.Uint16(l[:]))
+	case 127:
+		var l [8]byte
+		io.ReadFull(o.r, l[:])
+		n = binary.BigEndian.Uint64(l[:])
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(o.r, data); err != nil {
+		t.Fatal(err)
+	}
+	return int(hdr[0] & 0x0f), data
+}
+
+func TestWebsocket(t *testing.T) {
+	closedC := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := UpgradeWebsocket(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// Echo the messages
+		for {
+			op, data, err := conn.ReadMessage()
+			if err != nil {
+				closedC <- err
+				return
+			}
+			conn.WriteMessage(op, data)
+		}
+	}))
+	defer srv.Close()
+	c := dialWsTest(t, srv.URL)
+	defer c.conn.Close()
+
+	c.writeFrame(true, WsText, []byte("hello"))
+	if op, data := c.readFrame(t); op != WsText || string(data) != "hello" {
+		t.Fatalf("got %d %q", op, data)
+	}
+
+	// Fragmented, with a ping between the fragments, and 16 bit lengths
+	big := bytes.Repeat([]byte("x"), 70000)
+	c.writeFrame(false, WsBinary, big[:200])
+	c.writeFrame(true, wsPing, []byte("p"))
+	c.writeFrame(true, 0, big[200:])
+	if op, data := c.readFrame(t); op != wsPong || string(data) != "p" {
+		t.Fatalf("got %d %q instead of the pong", op, data)
+	}
+	if op, data := c.readFrame(t); op != WsBinary || !bytes.Equal(data, big) {
+		t.Fatalf("got %d of %d bytes", op, len(data))
+	}
+
+	c.writeFrame(true, wsClose, []byte{0x03, 0xe8})
+	if op, _ := c.readFrame(t); op != wsClose {
+		t.Fatalf("got %d instead of the close", op)
+	}
+	if err := <-closedC; err != io.EOF {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestWebsocketHandshakeRefused(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		UpgradeWebsocket(w, r)
+	}))
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Sec-Websocket-Version") != "13" {
+		t.Fatalf("got %s", resp.Status)
+	}
+}